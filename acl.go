@@ -0,0 +1,60 @@
+package gochinadns
+
+import (
+	"expvar"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/yl2chen/cidranger"
+)
+
+var refusedClients = expvar.NewInt("chinadns_refused_clients")
+
+// WithAllowedClients answers queries only from clients in networks, such as `192.168.1.0/24` or `fd00::/8` (a single
+// IP is taken as a network of itself), and REFUSED to others, e.g. for a server listening on all addresses which
+// should only serve the LAN and VPN. All clients are allowed if networks is empty.
+func WithAllowedClients(networks ...string) ServerOption {
+	return func(o *serverOptions) error {
+		o.AllowedClients = nil
+		for _, n := range networks {
+			network, err := parseCIDROrIP(n)
+			if err != nil {
+				return err
+			}
+			o.AllowedClients = append(o.AllowedClients, network)
+		}
+		return nil
+	}
+}
+
+// newClientACL compiles networks into a set of allowed clients, or returns nil if all clients are allowed.
+func newClientACL(networks []*net.IPNet) *cidrSet {
+	if len(networks) == 0 {
+		return nil
+	}
+	ranger := cidranger.NewPCTrieRanger()
+	for _, n := range networks {
+		// Networks are parsed already, so inserting them never fails.
+		_ = ranger.Insert(cidranger.NewBasicRangerEntry(*n))
+	}
+	return newCIDRSet(ranger)
+}
+
+// refusedClientReply returns a REFUSED reply to req if client is not allowed to query. Otherwise it returns nil.
+func (s *Server) refusedClientReply(client net.IP, req *dns.Msg) *dns.Msg {
+	if s.allowedClients == nil || client != nil && s.allowedClients.Has(client) {
+		return nil
+	}
+	refusedClients.Add(1)
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	return m
+}
+
+func networkStrings(networks []*net.IPNet) []string {
+	var list []string
+	for _, n := range networks {
+		list = append(list, n.String())
+	}
+	return list
+}
@@ -0,0 +1,38 @@
+package gochinadns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAllowedClients(t *testing.T) {
+	s, err := NewServer(NewClient(),
+		WithSkipRefineResolvers(true),
+		WithAllowedClients("192.168.1.0/24", "fd00::/8", "10.8.0.1"),
+		WithDomainBlacklist(writeTestList(t, "blacklist", "ads.example.com\n")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("ads.example.com.", dns.TypeA)
+	for client, refused := range map[string]bool{
+		"192.168.1.20": false,
+		"fd00::1":      false,
+		"10.8.0.1":     false,
+		"10.8.0.2":     true,
+		"8.8.8.8":      true,
+		"2001:db8::1":  true,
+	} {
+		w := newFakeResponseWriter(client)
+		s.Serve(w, req.Copy())
+		if w.msg == nil || (w.msg.Rcode == dns.RcodeRefused) != refused {
+			t.Errorf("Client %s should be refused: %v, got %v", client, refused, w.msg)
+		}
+	}
+
+	if err = WithAllowedClients("192.168.1.0/33")(newServerOptions()); err == nil {
+		t.Error("Invalid network should fail")
+	}
+}
@@ -0,0 +1,123 @@
+package gochinadns
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Environment variables of socket activation passed by the init system. See sd_listen_fds(3).
+const (
+	listenPIDEnv     = "LISTEN_PID"
+	listenFDsEnv     = "LISTEN_FDS"
+	listenFDNamesEnv = "LISTEN_FDNAMES"
+	// listenFDsStart is the first file descriptor passed by socket activation.
+	listenFDsStart = 3
+)
+
+// Names of sockets serving other than DNS by socket activation, which are set by FileDescriptorName= in
+// systemd.socket(5). Sockets of other names serve DNS.
+const (
+	ActivationAdminName = "admin" // the admin API
+	ActivationDoTName   = "dot"   // DNS over TLS
+	ActivationDoHName   = "doh"   // DNS over HTTPS
+	ActivationDebugName = "debug" // the debug listener
+	ActivationStatsName = "stats" // the stats listener
+)
+
+// WithSocketActivation enables using listening sockets passed by the init system, e.g. by systemd socket activation
+// (see sd_listen_fds(3)), instead of binding them, so that the server runs unprivileged and starts on demand.
+// Enabled by default, which changes nothing unless the init system passes sockets: they are used only if LISTEN_PID
+// is the PID of the server's process, so that sockets meant for another process, like the shell starting the server,
+// are ignored.
+func WithSocketActivation(enable bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.SocketActivation = enable
+		return nil
+	}
+}
+
+// activatedSockets returns listening sockets passed by the init system, if any. The environment variables are
+// cleared, so that sockets are activated only once, and not passed to child processes.
+func activatedSockets() (sockets, error) {
+	pid, fds, names := os.Getenv(listenPIDEnv), os.Getenv(listenFDsEnv), os.Getenv(listenFDNamesEnv)
+	if fds == "" {
+		return sockets{}, nil
+	}
+	for _, env := range []string{listenPIDEnv, listenFDsEnv, listenFDNamesEnv} {
+		_ = os.Unsetenv(env)
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		// Meant for another process, e.g. the shell starting the server.
+		return sockets{}, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return sockets{}, fmt.Errorf("invalid %s: %s", listenFDsEnv, fds)
+	}
+	files := make([]*os.File, n)
+	for i := range files {
+		files[i] = os.NewFile(uintptr(listenFDsStart+i), listenFDsEnv+"-"+strconv.Itoa(listenFDsStart+i))
+	}
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+	a, err := activate(files, fdNames)
+	if err == nil {
+		logrus.Infof("Activated %d listening sockets by the init system.", n)
+	}
+	return a, err
+}
+
+// activate returns listening sockets of files named by names, which are closed anyway. Files of
+// ActivationXXXName serve the admin API, DoT, DoH, the debug listener and the stats listener, and
+// others serve DNS, as UDP sockets and TCP listeners.
+func activate(files []*os.File, names []string) (a sockets, err error) {
+	defer func() {
+		for _, f := range files {
+			_ = f.Close() // the sockets are duplicated by net
+		}
+		if err != nil {
+			a.close()
+			a = sockets{}
+		}
+	}()
+	named := map[string]*net.Listener{
+		ActivationAdminName: &a.admin,
+		ActivationDoTName:   &a.dot,
+		ActivationDoHName:   &a.doh,
+		ActivationDebugName: &a.debug,
+		ActivationStatsName: &a.stats,
+	}
+	for i, f := range files {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		if ln := named[name]; ln != nil {
+			if *ln != nil {
+				return a, fmt.Errorf("duplicate socket %s", name)
+			}
+			if *ln, err = net.FileListener(f); err != nil {
+				return a, fmt.Errorf("fail to activate socket %s: %w", name, err)
+			}
+			continue
+		}
+		// The type of a DNS socket is told by trying it as a stream listener.
+		if ln, e := net.FileListener(f); e == nil {
+			a.tcp = append(a.tcp, ln)
+			continue
+		}
+		conn, e := net.FilePacketConn(f)
+		if e != nil {
+			return a, fmt.Errorf("fail to activate socket %s: %w", name, e)
+		}
+		a.udp = append(a.udp, conn)
+	}
+	return a, nil
+}
@@ -0,0 +1,84 @@
+package gochinadns
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+// setActivationEnv sets environment variables of socket activation for the test, which are cleared after it.
+func setActivationEnv(t *testing.T, pid, fds, names string) {
+	t.Helper()
+	for env, v := range map[string]string{listenPIDEnv: pid, listenFDsEnv: fds, listenFDNamesEnv: names} {
+		if err := os.Setenv(env, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		for _, env := range []string{listenPIDEnv, listenFDsEnv, listenFDNamesEnv} {
+			_ = os.Unsetenv(env)
+		}
+	})
+}
+
+func TestActivatedSockets(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+
+	// Sockets meant for another process are ignored, and not passed on either.
+	setActivationEnv(t, "1", "2", "")
+	a, err := activatedSockets()
+	if err != nil || a.udp != nil || a.tcp != nil {
+		t.Errorf("Sockets of another process should be ignored, got %+v, %v", a, err)
+	}
+	for _, env := range []string{listenPIDEnv, listenFDsEnv, listenFDNamesEnv} {
+		if os.Getenv(env) != "" {
+			t.Errorf("%s should be cleared", env)
+		}
+	}
+
+	setActivationEnv(t, pid, "0", "")
+	if a, err = activatedSockets(); err != nil || a.udp != nil || a.tcp != nil {
+		t.Errorf("No socket should be activated, got %+v, %v", a, err)
+	}
+
+	setActivationEnv(t, pid, "two", "")
+	if _, err = activatedSockets(); err == nil {
+		t.Error("Invalid LISTEN_FDS should fail")
+	}
+}
+
+func TestListenSocketActivation(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	o := newServerOptions()
+	if !o.SocketActivation {
+		t.Fatal("Socket activation should be enabled by default")
+	}
+	if err := WithListenAddrs("127.0.0.1:0")(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o}
+
+	// Sockets passed by the init system are used by default.
+	setActivationEnv(t, pid, "two", "")
+	if a, err := s.listen(); err == nil {
+		a.close()
+		t.Error("Sockets passed by the init system should be activated by default")
+	}
+
+	// They are left alone if disabled, and the server binds its own sockets.
+	if err := WithSocketActivation(false)(o); err != nil {
+		t.Fatal(err)
+	}
+	setActivationEnv(t, pid, "two", "")
+	a, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+	if len(a.udp) != 1 || len(a.tcp) != 1 {
+		t.Errorf("DNS sockets should be created, got %+v", a)
+	}
+	if os.Getenv(listenFDsEnv) != "two" {
+		t.Error("Environment of socket activation should be untouched if disabled")
+	}
+}
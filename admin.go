@@ -0,0 +1,388 @@
+package gochinadns
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AdminHandler returns an HTTP handler serving the admin API.
+// The admin API is not authenticated, so it should only listen on localhost.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.handleStatus)
+	mux.HandleFunc("/stats", s.handleStats)
+	mux.HandleFunc("/debug/state", s.handleState)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/queries", s.handleQueries)
+	mux.HandleFunc("/queries/cancel", s.handleCancelQuery)
+	mux.HandleFunc("/cidr", s.handleCIDR)
+	mux.HandleFunc("/reverse", s.handleReverse)
+	mux.HandleFunc("/reload", s.handleReload)
+	mux.HandleFunc("/upstreams", s.handleUpstreams)
+	mux.HandleFunc("/upstreams/add", s.handleAddUpstream)
+	mux.HandleFunc("/upstreams/remove", s.handleRemoveUpstream)
+	mux.HandleFunc("/upstreams/drain", s.handleDrainUpstream(true))
+	mux.HandleFunc("/upstreams/resume", s.handleDrainUpstream(false))
+	mux.HandleFunc("/cache", s.handleCache)
+	mux.HandleFunc("/cache/flush", s.handleFlushCache)
+	mux.HandleFunc("/config", s.handleConfig)
+	mux.HandleFunc("/audit", s.handleAudit)
+	mux.HandleFunc("/pinnings", s.handlePinnings)
+	mux.HandleFunc("/pinnings/clear", s.handleClearPinnings)
+	mux.HandleFunc("/speeds", s.handleSpeeds)
+	mux.HandleFunc("/speeds/report", s.handleReportSpeed)
+	mux.HandleFunc("/speeds/clear", s.handleClearSpeeds)
+	mux.HandleFunc("/verdicts", s.handleVerdicts)
+	mux.HandleFunc("/verdicts/clear", s.handleClearVerdicts)
+	mux.HandleFunc("/flagged", s.handleFlagged)
+	mux.HandleFunc("/flagged/clear", s.handleClearFlagged)
+	return mux
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Status())
+}
+
+// handleStats reports stats with top talkers of at most top each, DefaultStatsTop if absent.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	top := DefaultStatsTop
+	if v := r.FormValue("top"); v != "" {
+		var err error
+		if top, err = strconv.Atoi(v); err != nil || top < 0 {
+			s.writeError(w, http.StatusBadRequest, "invalid top")
+			return
+		}
+	}
+	report := s.Stats(top)
+	if report == nil {
+		s.writeError(w, http.StatusNotFound, "stats are disabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+func (s *Server) handleState(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := s.DumpState(w); err != nil {
+		logrus.WithError(err).Error("Fail to write state dump.")
+	}
+}
+
+func (s *Server) handleQueries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.InFlight())
+}
+
+func (s *Server) handleCancelQuery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalid query id")
+		return
+	}
+	if !s.CancelQuery(id) {
+		s.writeError(w, http.StatusNotFound, "query not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]uint64{"canceled": id})
+}
+
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := s.Reload(); err != nil {
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"reloaded": true})
+}
+
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.AuditReport())
+}
+
+func (s *Server) handlePinnings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	pinnings := s.Pinnings()
+	if pinnings == nil {
+		pinnings = []Pinning{}
+	}
+	writeJSON(w, http.StatusOK, pinnings)
+}
+
+// handleClearPinnings clears upstreams pinned by a client, or all clients if client is absent.
+func (s *Server) handleClearPinnings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var client net.IP
+	if v := r.FormValue("client"); v != "" {
+		if client = net.ParseIP(v); client == nil {
+			s.writeError(w, http.StatusBadRequest, "invalid client")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"cleared": s.ClearPinnings(client)})
+}
+
+func (s *Server) handleSpeeds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Speeds())
+}
+
+// handleReportSpeed records a speed report of a prefix, with rtt and ttl in Go duration format, and optional loss.
+func (s *Server) handleReportSpeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	rtt, err := time.ParseDuration(r.FormValue("rtt"))
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, "invalid rtt")
+		return
+	}
+	var loss float64
+	if v := r.FormValue("loss"); v != "" {
+		if loss, err = strconv.ParseFloat(v, 64); err != nil {
+			s.writeError(w, http.StatusBadRequest, "invalid loss")
+			return
+		}
+	}
+	var ttl time.Duration
+	if v := r.FormValue("ttl"); v != "" {
+		if ttl, err = time.ParseDuration(v); err != nil {
+			s.writeError(w, http.StatusBadRequest, "invalid ttl")
+			return
+		}
+	}
+	prefix := r.FormValue("prefix")
+	if err = s.ReportSpeed(prefix, rtt, loss, ttl); err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"prefix": prefix})
+}
+
+func (s *Server) handleClearSpeeds(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"cleared": s.ClearSpeeds()})
+}
+
+func (s *Server) handleVerdicts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Verdicts())
+}
+
+func (s *Server) handleClearVerdicts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"cleared": s.ClearVerdicts()})
+}
+
+func (s *Server) handleFlagged(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.FlaggedDomains())
+}
+
+func (s *Server) handleClearFlagged(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"cleared": s.ClearFlaggedDomains()})
+}
+
+func (s *Server) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.Upstreams())
+}
+
+// handleAddUpstream adds a resolver in schema format (see ParseResolver), forced trusted if trusted=true.
+func (s *Server) handleAddUpstream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	resolver, err := ParseResolver(r.FormValue("resolver"), s.TCPOnly)
+	if err != nil {
+		s.writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	trusted, _ := strconv.ParseBool(r.FormValue("trusted"))
+	if err = s.AddResolver(resolver, trusted); err != nil {
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"added": resolver.String()})
+}
+
+// handleRemoveUpstream removes a resolver by its address, such as 8.8.8.8:53 or a DoH URL.
+func (s *Server) handleRemoveUpstream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	addr := r.FormValue("addr")
+	if !s.RemoveResolver(addr) {
+		s.writeError(w, http.StatusNotFound, "resolver not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"removed": addr})
+}
+
+// handleDrainUpstream drains or resumes a resolver by its address.
+func (s *Server) handleDrainUpstream(drain bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		addr := r.FormValue("addr")
+		if !s.DrainResolver(addr, drain) {
+			s.writeError(w, http.StatusNotFound, "resolver not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"addr": addr, "drained": drain})
+	}
+}
+
+func (s *Server) handleCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	entries, ok := s.InspectCache(r.FormValue("name"))
+	if !ok {
+		s.writeError(w, http.StatusNotImplemented, "cache backend can't be inspected")
+		return
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (s *Server) handleFlushCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	f := CacheFilter{Upstream: r.FormValue("upstream"), Suffix: r.FormValue("suffix")}
+	if v := r.FormValue("cidr"); v != "" {
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			s.writeError(w, http.StatusBadRequest, "invalid cidr")
+			return
+		}
+		f.CIDR = ipNet
+	}
+	if f == (CacheFilter{}) {
+		if !s.FlushCache() {
+			s.writeError(w, http.StatusNotImplemented, "cache backend can't be flushed")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"flushed": true})
+		return
+	}
+	n, ok := s.FlushCacheMatching(f)
+	if !ok {
+		s.writeError(w, http.StatusNotImplemented, "cache backend can't be flushed selectively")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"flushed": true, "entries": n})
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Config())
+}
+
+func (s *Server) handleCIDR(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.FormValue("ip"))
+	if ip == nil {
+		s.writeError(w, http.StatusBadRequest, "invalid ip")
+		return
+	}
+	c, err := s.ClassifyIP(ip)
+	if err != nil {
+		s.writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+func (s *Server) handleReverse(w http.ResponseWriter, r *http.Request) {
+	ip := net.ParseIP(r.FormValue("ip"))
+	if ip == nil {
+		s.writeError(w, http.StatusBadRequest, "invalid ip")
+		return
+	}
+	names, err := s.ReverseLookup(ip)
+	if err != nil {
+		s.writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ip": ip.String(), "names": names})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.WithError(err).Error("Fail to encode admin API response.")
+	}
+}
+
+// adminError is an error response of the admin API. Error is in English for automation, and Message is in the
+// language of the server for display, see WithLanguage.
+type adminError struct {
+	Error   string `json:"error"`
+	Message string `json:"message"`
+}
+
+func (s *Server) writeError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, &adminError{Error: msg, Message: Localize(s.Language, msg)})
+}
@@ -0,0 +1,102 @@
+package gochinadns
+
+import (
+	"expvar"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// queueTimeout is how long a query waits for a slot to be served, after which its client has likely retried.
+const queueTimeout = time.Second
+
+var (
+	queriesQueued   = expvar.NewInt("chinadns_queries_queued")
+	queriesRejected = expvar.NewInt("chinadns_queries_rejected")
+)
+
+// WithMaxInFlight limits queries being served at a time to max, so that a burst can't spawn lookups without bound
+// and exhaust the memory of small routers. Up to queue more queries wait (for a second at most) for a slot, and the
+// others are rejected with SERVFAIL, so that clients turn to other resolvers at once. Unlimited if max is 0.
+func WithMaxInFlight(max, queue int) ServerOption {
+	return func(o *serverOptions) error {
+		if max < 0 || queue < 0 {
+			return fmt.Errorf("invalid max queries in flight: %d, queued %d", max, queue)
+		}
+		o.MaxInFlight, o.MaxQueued = max, queue
+		return nil
+	}
+}
+
+// admission bounds queries being served, with a queue of those waiting for a slot.
+type admission struct {
+	queued    int64 // accessed atomically, so it's the first field to be 64-bit aligned
+	maxQueued int64
+	slots     chan struct{}
+	timeout   time.Duration
+}
+
+// newAdmission returns the admission of queries for the options, or nil if they are unlimited.
+func newAdmission(o *serverOptions) *admission {
+	if o.MaxInFlight <= 0 {
+		return nil
+	}
+	return &admission{
+		maxQueued: int64(o.MaxQueued),
+		slots:     make(chan struct{}, o.MaxInFlight),
+		timeout:   queueTimeout,
+	}
+}
+
+// acquire takes a slot, waiting in the queue if there is room. It returns false if the query is rejected.
+func (a *admission) acquire() bool {
+	select {
+	case a.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if atomic.AddInt64(&a.queued, 1) > a.maxQueued {
+		atomic.AddInt64(&a.queued, -1)
+		return false
+	}
+	queriesQueued.Add(1)
+	defer func() {
+		atomic.AddInt64(&a.queued, -1)
+		queriesQueued.Add(-1)
+	}()
+
+	timer := time.NewTimer(a.timeout)
+	defer timer.Stop()
+	select {
+	case a.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// queuedLen returns the number of queries waiting for a slot.
+func (a *admission) queuedLen() int64 {
+	return atomic.LoadInt64(&a.queued)
+}
+
+func (a *admission) release() {
+	<-a.slots
+}
+
+// serve serves req by next once a slot is taken, or replies SERVFAIL if the query is rejected.
+func (a *admission) serve(w dns.ResponseWriter, req *dns.Msg, next func(dns.ResponseWriter, *dns.Msg)) {
+	if !a.acquire() {
+		queriesRejected.Add(1)
+		logrus.WithField("client", clientIP(w)).Debug("Too many queries in flight. Reject the query.")
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeServerFailure)
+		_ = w.WriteMsg(m)
+		return
+	}
+	defer a.release()
+	next(w, req)
+}
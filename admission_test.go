@@ -0,0 +1,80 @@
+package gochinadns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestAdmission(t *testing.T) {
+	o := newServerOptions()
+	if err := WithMaxInFlight(1, 1)(o); err != nil {
+		t.Fatal(err)
+	}
+	a := newAdmission(o)
+	a.timeout = 50 * time.Millisecond
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	entered, leave := make(chan struct{}), make(chan struct{})
+	next := func(w dns.ResponseWriter, req *dns.Msg) {
+		entered <- struct{}{}
+		<-leave
+		m := new(dns.Msg)
+		m.SetReply(req)
+		_ = w.WriteMsg(m)
+	}
+	w1, w2 := newFakeResponseWriter("192.0.2.1"), newFakeResponseWriter("192.0.2.2")
+	done := make(chan struct{})
+	go func() {
+		a.serve(w1, req, next)
+		done <- struct{}{}
+	}()
+	<-entered
+	go func() {
+		a.serve(w2, req, next)
+		done <- struct{}{}
+	}()
+	for a.queuedLen() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The queue is full, so that another query is rejected at once.
+	w3 := newFakeResponseWriter("192.0.2.3")
+	a.serve(w3, req, next)
+	if w3.msg == nil || w3.msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Query beyond the queue should be rejected, got %v", w3.msg)
+	}
+
+	// The queued query is served once the slot is released.
+	leave <- struct{}{}
+	<-done
+	<-entered
+	leave <- struct{}{}
+	<-done
+	if w2.msg == nil || w2.msg.Rcode != dns.RcodeSuccess {
+		t.Errorf("Queued query should be served, got %v", w2.msg)
+	}
+
+	// A query waiting longer than the timeout is rejected.
+	go func() {
+		a.serve(w1, req, next)
+		done <- struct{}{}
+	}()
+	<-entered
+	w4 := newFakeResponseWriter("192.0.2.4")
+	a.serve(w4, req, next)
+	if w4.msg == nil || w4.msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Query timed out in the queue should be rejected, got %v", w4.msg)
+	}
+	leave <- struct{}{}
+	<-done
+
+	if newAdmission(newServerOptions()) != nil {
+		t.Error("Queries should be unlimited by default")
+	}
+	if err := WithMaxInFlight(-1, 0)(o); err == nil {
+		t.Error("Negative limit should fail")
+	}
+}
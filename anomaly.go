@@ -0,0 +1,204 @@
+package gochinadns
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Actions on queries of anomalous names. See WithNameAnomalies.
+const (
+	AnomalyLog   = "log"   // count and log them only
+	AnomalyBlock = "block" // answer them like blacklisted domains
+	AnomalyLimit = "limit" // answer REFUSED to clients querying them beyond a rate
+)
+
+// Reasons of flagging a name as anomalous, which are keys of chinadns_name_anomalies.
+const (
+	anomalyEntropy    = "entropy"    // a label looks random, like names generated by malware (DGA)
+	anomalyConsonants = "consonants" // a label has a run of consonants unlikely in words
+	anomalyDigits     = "digits"     // a label alternates between letters and digits, like hex strings
+	anomalyLongLabel  = "long_label" // a label is nearly as long as allowed, like data tunneled through DNS
+	anomalyLongName   = "long_name"  // the name is nearly as long as allowed, like data tunneled through DNS
+)
+
+const (
+	// anomalyEntropyMinLen is the length of labels from which entropy is compared, since the entropy of shorter
+	// labels is bounded by the logarithm of their length.
+	anomalyEntropyMinLen = 12
+	// anomalyClassMinLen is the length of labels from which character classes are compared.
+	anomalyClassMinLen = 8
+	// anomalyConsonantRun is the length of runs of consonants to flag a label.
+	anomalyConsonantRun = 6
+	anomalyLongLabelLen = 50
+	anomalyLongNameLen  = 160
+)
+
+var (
+	nameAnomalies     = expvar.NewMap("chinadns_name_anomalies")
+	anomalousQueries  = expvar.NewInt("chinadns_anomalous_queries")
+	anomaliesEnforced = expvar.NewInt("chinadns_anomalies_enforced")
+)
+
+// WithNameAnomalies flags query names which look generated by malware (DGA) or carry data tunneled through DNS, by
+// the Shannon entropy (in bits per character) of labels of 12 characters or more reaching entropy, by character
+// classes and by length. Queries of flagged names are counted by reason in chinadns_name_anomalies, and dealt with by
+// action, see AnomalyXXX. With AnomalyLimit, each client may query flagged names at qps on average.
+// Names in the domain whitelist and reverse lookups are never flagged. Disabled if entropy is 0.
+func WithNameAnomalies(entropy float64, action string, qps float64) ServerOption {
+	return func(o *serverOptions) error {
+		if entropy < 0 || qps < 0 {
+			return fmt.Errorf("invalid name anomaly threshold: entropy %v, %v qps", entropy, qps)
+		}
+		switch action {
+		case AnomalyLog, AnomalyBlock:
+		case AnomalyLimit:
+			if qps == 0 {
+				return fmt.Errorf("name anomaly action %s needs a rate", action)
+			}
+		default:
+			return fmt.Errorf("unknown name anomaly action [%s], expect log, block or limit", action)
+		}
+		o.AnomalyEntropy, o.AnomalyAction, o.AnomalyQPS = entropy, action, qps
+		return nil
+	}
+}
+
+// newAnomalyLimiter returns the limiter of clients querying anomalous names, or nil if they are not limited.
+func newAnomalyLimiter(o *serverOptions) *rateLimiter {
+	if o.AnomalyEntropy <= 0 || o.AnomalyAction != AnomalyLimit {
+		return nil
+	}
+	return newRateLimiter(&serverOptions{RateLimitQPS: o.AnomalyQPS, RateLimitBurst: int(o.AnomalyQPS) + 1, RateLimitAction: RateLimitRefuse})
+}
+
+// nameAnomalyReasons returns the reasons of flagging name, flagging random labels by entropy, or nil if it looks
+// normal. Labels are flagged as random by two signals of entropy, consonants and digits, since each of them alone
+// catches plenty of real names, like stackoverflow.com by entropy. The top-level domain is not looked into.
+func nameAnomalyReasons(name string, entropy float64) []string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	var reasons []string
+	flag := func(reason string) {
+		for _, r := range reasons {
+			if r == reason {
+				return
+			}
+		}
+		reasons = append(reasons, reason)
+	}
+	if len(name) >= anomalyLongNameLen {
+		flag(anomalyLongName)
+	}
+	labels := dns.SplitDomainName(name)
+	if len(labels) > 0 {
+		labels = labels[:len(labels)-1]
+	}
+	for _, label := range labels {
+		if len(label) >= anomalyLongLabelLen {
+			flag(anomalyLongLabel)
+		}
+		if len(label) < anomalyClassMinLen || strings.HasPrefix(label, "xn--") {
+			continue
+		}
+		var signals []string
+		if len(label) >= anomalyEntropyMinLen && labelEntropy(label) >= entropy {
+			signals = append(signals, anomalyEntropy)
+		}
+		run, maxRun, switches := 0, 0, 0
+		for i := 0; i < len(label); i++ {
+			if isConsonant(label[i]) {
+				if run++; run > maxRun {
+					maxRun = run
+				}
+			} else {
+				run = 0
+			}
+			if i > 0 && (isDigit(label[i]) && isLetter(label[i-1]) || isLetter(label[i]) && isDigit(label[i-1])) {
+				switches++
+			}
+		}
+		if maxRun >= anomalyConsonantRun {
+			signals = append(signals, anomalyConsonants)
+		}
+		if switches*2 >= len(label) {
+			signals = append(signals, anomalyDigits)
+		}
+		if len(signals) >= 2 {
+			for _, reason := range signals {
+				flag(reason)
+			}
+		}
+	}
+	return reasons
+}
+
+// labelEntropy returns the Shannon entropy of characters of label in bits per character.
+func labelEntropy(label string) float64 {
+	var counts [256]int
+	for i := 0; i < len(label); i++ {
+		counts[label[i]]++
+	}
+	var h float64
+	n := float64(len(label))
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / n
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+func isDigit(c byte) bool  { return c >= '0' && c <= '9' }
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' }
+
+func isConsonant(c byte) bool {
+	return isLetter(c) && !strings.ContainsRune("aeiouy", rune(c))
+}
+
+// anomalousNameReply counts the name of req by client if it's anomalous, and returns the reply by the action, along
+// with the verdict of it. Otherwise it returns nil.
+func (s *Server) anomalousNameReply(req *dns.Msg, client net.IP) (*dns.Msg, string) {
+	if s.AnomalyEntropy <= 0 {
+		return nil, ""
+	}
+	name := req.Question[0].Name
+	if dns.IsSubDomain("arpa.", strings.ToLower(name)) {
+		return nil, ""
+	}
+	reasons := nameAnomalyReasons(name, s.AnomalyEntropy)
+	if len(reasons) == 0 {
+		return nil, ""
+	}
+	s.listsMu.RLock()
+	whitelisted := s.DomainWhitelist.Contain(name)
+	s.listsMu.RUnlock()
+	if whitelisted {
+		return nil, ""
+	}
+	anomalousQueries.Add(1)
+	for _, reason := range reasons {
+		nameAnomalies.Add(reason, 1)
+	}
+	logrus.WithFields(logrus.Fields{"client": client, "reasons": strings.Join(reasons, ",")}).Debug("Anomalous query name: ", RedactName(name))
+
+	switch s.AnomalyAction {
+	case AnomalyBlock:
+		anomaliesEnforced.Add(1)
+		return s.blockedReply(req), VerdictBlocked
+	case AnomalyLimit:
+		if s.anomalyLimiter.allow(rateLimitKey(client), s.Clock.Now()) {
+			return nil, ""
+		}
+		anomaliesEnforced.Add(1)
+		m := new(dns.Msg)
+		m.SetRcode(req, dns.RcodeRefused)
+		return m, VerdictRefused
+	}
+	return nil, ""
+}
@@ -0,0 +1,89 @@
+package gochinadns
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cherrot/gochinadns/clock"
+	"github.com/miekg/dns"
+)
+
+func TestNameAnomalyReasons(t *testing.T) {
+	for name, want := range map[string]string{
+		"www.google.com.":                                "",
+		"safebrowsing.googleapis.com.":                   "",
+		"lh3.googleusercontent.com.":                     "",
+		"login.microsoftonline.com.":                     "",
+		"ec2-54-12-33-101.compute.amazonaws.com":         "",
+		"e1234567.dscb.akamaiedge.net.":                  "",
+		"xkqjzpwemvbt.com.":                              "entropy,consonants",
+		"a8f3k2j9x0q1.example.com.":                      "entropy,digits",
+		"stackoverflow.com.":                             "",
+		"d1a2b3c4.cloudfront.net.":                       "",
+		"f9e8d7c6b5a4z3y2.cloudfront.net.":               "entropy,digits",
+		strings.Repeat("a", 52) + ".t.example.com.":      "long_label",
+		strings.Repeat("abcdefgh.", 20) + "example.com.": "long_name",
+	} {
+		if got := strings.Join(nameAnomalyReasons(name, 3.5), ","); got != want {
+			t.Errorf("%s: expect reasons %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestAnomalousNameReply(t *testing.T) {
+	whitelist := WithDomainWhitelist(writeTestList(t, "whitelist", "xkqjzpwemvbt.com\n"))
+	for _, action := range []string{AnomalyLog, AnomalyBlock, AnomalyLimit} {
+		clk := clock.NewFake(time.Unix(1600000000, 0))
+		s, err := NewServer(NewClient(), WithSkipRefineResolvers(true), WithNameAnomalies(3.5, action, 1), whitelist,
+			WithBlockResponse(BlockNXDomain), WithClock(clk))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := net.ParseIP("192.168.1.20")
+		var rcodes []int
+		for i := 0; i < 3; i++ {
+			m, _ := s.anomalousNameReply(new(dns.Msg).SetQuestion("qzjxkwpvtmcl.com.", dns.TypeA), client)
+			if m != nil {
+				rcodes = append(rcodes, m.Rcode)
+			}
+		}
+		switch action {
+		case AnomalyLog:
+			if len(rcodes) != 0 {
+				t.Errorf("Anomalous names should only be counted, got rcodes %v", rcodes)
+			}
+		case AnomalyBlock:
+			if len(rcodes) != 3 || rcodes[0] != dns.RcodeNameError {
+				t.Errorf("Anomalous names should be blocked, got rcodes %v", rcodes)
+			}
+			w := newFakeResponseWriter("192.168.1.20")
+			s.Serve(w, new(dns.Msg).SetQuestion("a8f3k2j9x0q1.example.com.", dns.TypeA))
+			if w.msg == nil || w.msg.Rcode != dns.RcodeNameError {
+				t.Errorf("Anomalous query should be served blocked, got %v", w.msg)
+			}
+		case AnomalyLimit:
+			// A burst of 2 is allowed.
+			if len(rcodes) != 1 || rcodes[0] != dns.RcodeRefused {
+				t.Errorf("Anomalous names beyond the rate should be refused, got rcodes %v", rcodes)
+			}
+			// The rate is measured by the clock of the server.
+			clk.Advance(time.Second)
+			if m, _ := s.anomalousNameReply(new(dns.Msg).SetQuestion("qzjxkwpvtmcl.com.", dns.TypeA), client); m != nil {
+				t.Errorf("Anomalous names within the rate should be allowed, got %v", m)
+			}
+		}
+		for _, name := range []string{"xkqjzpwemvbt.com.", "4.3.2.1.in-addr.arpa.", "www.qq.com."} {
+			if m, _ := s.anomalousNameReply(new(dns.Msg).SetQuestion(name, dns.TypeA), client); m != nil {
+				t.Errorf("%s: %s should not be flagged, got %v", action, name, m)
+			}
+		}
+	}
+
+	for _, f := range []ServerOption{WithNameAnomalies(3.5, "drop", 1), WithNameAnomalies(3.5, AnomalyLimit, 0), WithNameAnomalies(-1, AnomalyLog, 0)} {
+		if err := f(newServerOptions()); err == nil {
+			t.Error("Invalid name anomaly option should fail")
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Policies of locating answers with multiple IPs, e.g. CDN answers spanning regions, or poisoned answers mixing
+// a Chinese IP with bogus ones.
+const (
+	AnswerMatchAll = "all" // an answer is located in China if all IPs are, the default
+	AnswerMatchAny = "any" // an answer is located in China if any IP is
+)
+
+// WithAnswerMatch sets the policy of locating answers by their IPs. An answer is blacklisted if any IP is,
+// regardless of the policy. See AnswerMatchXXX for available policies.
+func WithAnswerMatch(policy string) ServerOption {
+	return func(o *serverOptions) error {
+		switch policy {
+		case "", AnswerMatchAll, AnswerMatchAny:
+		default:
+			return fmt.Errorf("unknown answer match policy [%s], expect all or any", policy)
+		}
+		o.AnswerMatch = policy
+		return nil
+	}
+}
+
+// isBlacklistedAnswer tells whether any IP of an answer is blacklisted.
+func (s *Server) isBlacklistedAnswer(ips []net.IP) (bool, error) {
+	for _, ip := range ips {
+		if hit, err := s.isBlacklistedIP(ip); hit || err != nil {
+			return hit, err
+		}
+	}
+	return false, nil
+}
+
+// isChinaAnswer tells whether an answer of ips is located in China by the answer match policy.
+func (s *Server) isChinaAnswer(ctx context.Context, ips []net.IP) (bool, error) {
+	if len(ips) == 0 {
+		return false, nil
+	}
+	matchAny := s.AnswerMatch == AnswerMatchAny
+	for _, ip := range ips {
+		contain, err := s.isChinaIP(ctx, ip)
+		if err != nil {
+			return false, err
+		}
+		// The first IP deciding the policy: one in China for any, or one overseas for all.
+		if contain == matchAny {
+			return contain, nil
+		}
+	}
+	return !matchAny, nil
+}
@@ -0,0 +1,53 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestAnswerMatch(t *testing.T) {
+	o := newServerOptions()
+	for _, opt := range []ServerOption{
+		WithCHNList(writeTestList(t, "china.list", "1.0.1.0/24\n")),
+		WithIPBlacklist(writeTestList(t, "blacklist", "8.7.198.45\n")),
+	} {
+		if err := opt(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{serverOptions: o}
+
+	parse := func(ips ...string) (parsed []net.IP) {
+		for _, ip := range ips {
+			parsed = append(parsed, net.ParseIP(ip))
+		}
+		return
+	}
+	for _, tc := range []struct {
+		ips      []net.IP
+		all, any bool
+	}{
+		{parse("1.0.1.1", "1.0.1.2"), true, true},
+		{parse("1.0.1.1", "8.8.8.8"), false, true},
+		{parse("8.8.8.8", "1.0.1.1"), false, true},
+		{parse("8.8.8.8", "8.8.4.4"), false, false},
+		{nil, false, false},
+	} {
+		for policy, want := range map[string]bool{AnswerMatchAll: tc.all, AnswerMatchAny: tc.any} {
+			if err := WithAnswerMatch(policy)(o); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := s.isChinaAnswer(context.Background(), tc.ips); err != nil || got != want {
+				t.Errorf("isChinaAnswer(%v) by %s = %v, %v, want %v", tc.ips, policy, got, err, want)
+			}
+		}
+	}
+
+	if hit, _ := s.isBlacklistedAnswer(parse("1.0.1.1", "8.7.198.45")); !hit {
+		t.Error("Answer with a blacklisted IP should be blacklisted")
+	}
+	if err := WithAnswerMatch("most")(o); err == nil {
+		t.Error("Unknown answer match policy should fail")
+	}
+}
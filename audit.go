@@ -0,0 +1,262 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Results of comparing answers of trusted and untrusted servers in an audit.
+const (
+	AuditConsistent = "consistent" // the answers share addresses
+	AuditCDN        = "cdn"        // the answers diverge, and untrusted addresses are located in China, e.g. CDN mapping
+	AuditPoisoned   = "poisoned"   // the answers diverge, and untrusted addresses are blacklisted
+	AuditDiverged   = "diverged"   // the answers diverge, and untrusted addresses are located overseas, e.g. geo DNS or poisoning
+	AuditFailed     = "failed"     // either group fails to answer
+)
+
+const (
+	// auditRounds is the number of audit rounds kept in the report.
+	auditRounds = 96
+	// auditDivergences is the number of recent divergent answers kept in the report.
+	auditDivergences = 100
+	// defaultAuditSample is the number of recently answered questions audited per round by default.
+	defaultAuditSample = 32
+)
+
+// AuditRound counts results of an audit round.
+type AuditRound struct {
+	Time    time.Time      `json:"time"`
+	Results map[string]int `json:"results"` // indexed by AuditXXX
+}
+
+// AuditDivergence is a question whose answers of trusted and untrusted servers diverge in an audit.
+type AuditDivergence struct {
+	Time      time.Time `json:"time"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Result    string    `json:"result"` // see AuditXXX
+	Trusted   []string  `json:"trusted"`
+	Untrusted []string  `json:"untrusted"`
+}
+
+// AuditReport is the report of answer consistency audits, the oldest rounds and divergences first.
+type AuditReport struct {
+	Interval    time.Duration     `json:"interval"`
+	Totals      map[string]int    `json:"totals"` // results of all rounds kept, indexed by AuditXXX
+	Rounds      []AuditRound      `json:"rounds"`
+	Divergences []AuditDivergence `json:"divergences"`
+}
+
+// WithAudit re-resolves up to sample recently answered A and AAAA questions through both trusted and untrusted
+// servers every interval, and records how their answers diverge over time, such as poisoning trends and
+// CDN mapping differences. Audits are disabled if interval is 0. sample defaults to 32 if 0.
+func WithAudit(interval time.Duration, sample int) ServerOption {
+	return func(o *serverOptions) error {
+		if sample <= 0 {
+			sample = defaultAuditSample
+		}
+		o.AuditInterval = interval
+		o.AuditSample = sample
+		return nil
+	}
+}
+
+// auditLog keeps results of recent audits. It's nil-safe.
+type auditLog struct {
+	mu          sync.Mutex
+	rounds      []AuditRound
+	divergences []AuditDivergence
+}
+
+func (l *auditLog) add(round AuditRound, divergences []AuditDivergence) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rounds = append(l.rounds, round)
+	if len(l.rounds) > auditRounds {
+		l.rounds = l.rounds[len(l.rounds)-auditRounds:]
+	}
+	l.divergences = append(l.divergences, divergences...)
+	if len(l.divergences) > auditDivergences {
+		l.divergences = l.divergences[len(l.divergences)-auditDivergences:]
+	}
+}
+
+// AuditReport returns the report of recent answer consistency audits.
+func (s *Server) AuditReport() *AuditReport {
+	r := &AuditReport{
+		Interval:    s.AuditInterval,
+		Totals:      make(map[string]int),
+		Rounds:      []AuditRound{},
+		Divergences: []AuditDivergence{},
+	}
+	if s.audit == nil {
+		return r
+	}
+	s.audit.mu.Lock()
+	defer s.audit.mu.Unlock()
+	r.Rounds = append(r.Rounds, s.audit.rounds...)
+	r.Divergences = append(r.Divergences, s.audit.divergences...)
+	for _, round := range r.Rounds {
+		for result, n := range round.Results {
+			r.Totals[result] += n
+		}
+	}
+	return r
+}
+
+// runAudits audits a sample of recently answered questions every AuditInterval, until ctx is done.
+func (s *Server) runAudits(ctx context.Context) {
+	if s.AuditInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.AuditInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		s.auditRound(ctx)
+	}
+}
+
+// auditRound audits recently answered A and AAAA questions, and records the results.
+func (s *Server) auditRound(ctx context.Context) {
+	round := AuditRound{Time: time.Now(), Results: make(map[string]int)}
+	var divergences []AuditDivergence
+	for _, q := range s.provenance.Recent(s.AuditSample, s.isAuditable) {
+		if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		result, trusted, untrusted := s.auditQuestion(ctx, q)
+		round.Results[result]++
+		if result == AuditConsistent || result == AuditFailed {
+			continue
+		}
+		d := AuditDivergence{
+			Time:      round.Time,
+			Name:      RedactName(q.Name),
+			Type:      dns.TypeToString[q.Qtype],
+			Result:    result,
+			Trusted:   ipStrings(trusted),
+			Untrusted: ipStrings(untrusted),
+		}
+		divergences = append(divergences, d)
+		logrus.WithField("question", questionString(&q)).Debugf("Audit: answers diverge (%s), trusted %v, untrusted %v.",
+			result, d.Trusted, d.Untrusted)
+	}
+	s.audit.add(round, divergences)
+}
+
+// isAuditable tells whether the answer of name with verdict is raced between trusted and untrusted servers, so that
+// it makes sense to compare their answers. Names answered locally, routed to designated upstreams, or routed to
+// trusted servers only as polluted are not, by their verdicts or by the lists they are in now.
+func (s *Server) isAuditable(name, verdict string) bool {
+	switch verdict {
+	case VerdictForwarded, VerdictHosts, VerdictFiltered, VerdictRewritten, VerdictRefused:
+		return false
+	}
+	if s.isDomainPolluted(name) || s.forwardServers(name) != nil || s.rewriteRule(name) != nil {
+		return false
+	}
+	s.listsMu.RLock()
+	defer s.listsMu.RUnlock()
+	if s.Hosts == nil {
+		return true
+	}
+	_, found := s.Hosts.Lookup(name)
+	return !found
+}
+
+// auditQuestion resolves q through both trusted and untrusted servers, and compares their answers.
+func (s *Server) auditQuestion(ctx context.Context, q dns.Question) (result string, trusted, untrusted []net.IP) {
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	s.normalizeRequest(req)
+
+	trustedServers, untrustedServers := s.activeResolvers()
+	var (
+		wg               sync.WaitGroup
+		trustedReplied   bool
+		untrustedReplied bool
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		trusted, trustedReplied = auditLookup(ctx, req, trustedServers, s.lookupTrusted)
+	}()
+	go func() {
+		defer wg.Done()
+		untrusted, untrustedReplied = auditLookup(ctx, req, untrustedServers, s.lookupUntrusted)
+	}()
+	wg.Wait()
+
+	switch {
+	case !trustedReplied || !untrustedReplied:
+		return AuditFailed, trusted, untrusted
+	case len(untrusted) == 0 && len(trusted) == 0, sharesIP(trusted, untrusted):
+		return AuditConsistent, trusted, untrusted
+	case len(untrusted) == 0:
+		return AuditDiverged, trusted, untrusted
+	}
+	result = AuditCDN
+	for _, ip := range untrusted {
+		if blacklisted, _ := s.isBlacklistedIP(ip); blacklisted {
+			return AuditPoisoned, trusted, untrusted
+		}
+		if china, _ := s.isChinaIP(ctx, ip); !china {
+			result = AuditDiverged
+		}
+	}
+	return result, trusted, untrusted
+}
+
+// auditLookup returns addresses answered by the first server in servers which replies successfully.
+func auditLookup(ctx context.Context, req *dns.Msg, servers resolverList, lookup LookupFunc) (ips []net.IP, ok bool) {
+	for _, server := range servers {
+		reply, _, err := lookup(ctx, req.Copy(), server)
+		if err != nil || (reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError) {
+			continue
+		}
+		for _, ip := range answerIPs(reply) {
+			if (req.Question[0].Qtype == dns.TypeA) == (ip.To4() != nil) {
+				ips = append(ips, ip)
+			}
+		}
+		return ips, true
+	}
+	return nil, false
+}
+
+func sharesIP(a, b []net.IP) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x.Equal(y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ipStrings(ips []net.IP) []string {
+	ret := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		ret = append(ret, ip.String())
+	}
+	sort.Strings(ret)
+	return ret
+}
@@ -0,0 +1,66 @@
+package gochinadns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestAuditRound(t *testing.T) {
+	o := newServerOptions()
+	if err := WithCHNList(writeTestList(t, "china.list", "1.0.1.0/24\n"))(o); err != nil {
+		t.Fatal(err)
+	}
+	if err := WithDomainPolluted(writeTestList(t, "polluted.list", "google.com\n"))(o); err != nil {
+		t.Fatal(err)
+	}
+	if err := WithAudit(time.Minute, 0)(o); err != nil {
+		t.Fatal(err)
+	}
+	o.TrustedServers = resolverList{startAnswerUpstream(t, "142.250.1.1")}
+	s := &Server{
+		serverOptions: o,
+		Client:        NewClient(WithTimeout(time.Second)),
+		provenance:    newProvenanceLog(provenanceLogSize),
+		audit:         new(auditLog),
+	}
+	q := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	s.provenance.Record(&q, Provenance{Verdict: VerdictChina})
+	s.provenance.Record(&dns.Question{Name: "www.example.com.", Qtype: dns.TypeMX, Qclass: dns.ClassINET}, Provenance{Verdict: VerdictTrusted})
+	// Names not raced between trusted and untrusted servers are not audited.
+	for name, verdict := range map[string]string{
+		"www.google.com.":  VerdictTrusted,
+		"nas.lan.":         VerdictHosts,
+		"corp.example.":    VerdictForwarded,
+		"intranet.corp.":   VerdictRewritten,
+		"ads.example.com.": VerdictBlocked,
+	} {
+		s.provenance.Record(&dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}, Provenance{Verdict: verdict})
+	}
+
+	for _, tc := range []struct {
+		untrusted []string
+		result    string
+	}{
+		{[]string{"142.250.1.1", "1.0.1.1"}, AuditConsistent},
+		{[]string{"1.0.1.1"}, AuditCDN},
+		{[]string{"31.13.1.1"}, AuditDiverged},
+	} {
+		s.UntrustedServers = resolverList{startAnswerUpstream(t, tc.untrusted...)}
+		s.auditRound(context.Background())
+	}
+
+	r := s.AuditReport()
+	if len(r.Rounds) != 3 || r.Totals[AuditConsistent] != 1 || r.Totals[AuditCDN] != 1 || r.Totals[AuditDiverged] != 1 {
+		t.Fatalf("Unexpected audit report %+v", r)
+	}
+	if len(r.Divergences) != 2 {
+		t.Fatalf("Divergent answers should be recorded, got %+v", r.Divergences)
+	}
+	if d := r.Divergences[1]; d.Result != AuditDiverged || d.Name != "www.example.com." || d.Type != "A" ||
+		len(d.Trusted) != 1 || d.Untrusted[0] != "31.13.1.1" {
+		t.Errorf("Unexpected divergence %+v", d)
+	}
+}
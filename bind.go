@@ -0,0 +1,95 @@
+package gochinadns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// WithBindRetry retries binding a listening address of DNS for retries times if it's in use, waiting for backoff
+// before the first retry and doubling it on each one, e.g. while the previous server is exiting on restart.
+func WithBindRetry(retries int, backoff time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if retries < 0 || backoff < 0 {
+			return fmt.Errorf("invalid bind retry: %d times after %s", retries, backoff)
+		}
+		o.BindRetries, o.BindBackoff = retries, backoff
+		return nil
+	}
+}
+
+// WithFallbackPort listens for DNS on port instead, on the same host, if a listening address is still in use after
+// retries (see WithBindRetry), e.g. when port 53 is held by systemd-resolved or dnsmasq. Disabled if 0.
+func WithFallbackPort(port int) ServerOption {
+	return func(o *serverOptions) error {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("invalid fallback port: %d", port)
+		}
+		o.FallbackPort = port
+		return nil
+	}
+}
+
+// BindError is the error of binding a listening address which is in use.
+type BindError struct {
+	Network string
+	Addr    string
+	Holder  string // the process holding the address, like `dnsmasq (pid 1234)`, or empty if unknown
+	Err     error
+}
+
+func newBindError(network, addr string, err error) *BindError {
+	return &BindError{Network: network, Addr: addr, Holder: portHolder(network, addr), Err: err}
+}
+
+func (e *BindError) Error() string {
+	msg := e.Network + " " + e.Addr + " is in use"
+	if e.Holder != "" {
+		msg += " by " + e.Holder
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+func (e *BindError) Unwrap() error { return e.Err }
+
+// PortHolder returns the process listening on the port of addr over network (udp or tcp), like `dnsmasq (pid 1234)`,
+// or empty if it's unknown. It's only supported on Linux, and finds processes of other users only with privileges.
+func PortHolder(network, addr string) string {
+	return portHolder(network, addr)
+}
+
+// bindDNS binds addr by bind, which fails with a *BindError if addr is in use. It's retried for BindRetries times,
+// and then addr with FallbackPort is bound instead if set.
+func (s *Server) bindDNS(addr string, bind func(addr string) error) error {
+	backoff := s.BindBackoff
+	for i := 0; ; i++ {
+		err := bind(addr)
+		var bindErr *BindError
+		if !errors.As(err, &bindErr) {
+			return err
+		}
+		if i < s.BindRetries {
+			logrus.WithError(err).Warnf("Retry binding in %s.", backoff)
+			time.Sleep(backoff)
+			backoff *= 2
+			continue
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		if s.FallbackPort == 0 || port == strconv.Itoa(s.FallbackPort) {
+			return err
+		}
+		fallback := net.JoinHostPort(host, strconv.Itoa(s.FallbackPort))
+		logrus.WithError(err).Warnf("Listen on the fallback address %s instead.", fallback)
+		return bind(fallback)
+	}
+}
+
+// isAddrInUse tells whether err of binding an address is for it's in use.
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE)
+}
@@ -0,0 +1,69 @@
+package gochinadns
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// portHolder returns the process listening on the port of addr over network, like `dnsmasq (pid 1234)`, or empty if
+// it's unknown. Sockets of processes of other users are found only with privileges.
+func portHolder(network, addr string) string {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return ""
+	}
+	inodes := make(map[string]bool)
+	for _, table := range []string{network, network + "6"} {
+		data, err := ioutil.ReadFile("/proc/net/" + table)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n")[1:] {
+			// Fields are like `0: 00000000:0035 00000000:0000 0A ... 12345`, where the state is 0A (LISTEN) for
+			// TCP listeners, and the 10th is the inode of the socket.
+			fields := strings.Fields(line)
+			if len(fields) < 10 || network == "tcp" && fields[3] != "0A" {
+				continue
+			}
+			i := strings.LastIndexByte(fields[1], ':')
+			if local, err := strconv.ParseUint(fields[1][i+1:], 16, 16); err == nil && local == port {
+				inodes["socket:["+fields[9]+"]"] = true
+			}
+		}
+	}
+	if len(inodes) == 0 {
+		return ""
+	}
+
+	procs, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return ""
+	}
+	for _, proc := range procs {
+		pid := proc.Name()
+		if _, err := strconv.Atoi(pid); err != nil {
+			continue
+		}
+		dir, err := os.Open("/proc/" + pid + "/fd")
+		if err != nil {
+			continue
+		}
+		fds, _ := dir.Readdirnames(-1)
+		_ = dir.Close()
+		for _, fd := range fds {
+			if link, err := os.Readlink("/proc/" + pid + "/fd/" + fd); err == nil && inodes[link] {
+				comm, _ := ioutil.ReadFile("/proc/" + pid + "/comm")
+				return fmt.Sprintf("%s (pid %s)", strings.TrimSpace(string(comm)), pid)
+			}
+		}
+	}
+	return ""
+}
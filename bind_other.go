@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package gochinadns
+
+// portHolder is unsupported on this platform.
+func portHolder(network, addr string) string {
+	return ""
+}
@@ -0,0 +1,53 @@
+package gochinadns
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBindRetry(t *testing.T) {
+	held, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer held.Close()
+	o := newServerOptions()
+	o.Listen = held.Addr().String()
+	if err := WithBindRetry(2, time.Millisecond)(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o}
+	_, err = s.listen()
+	var bindErr *BindError
+	if !errors.As(err, &bindErr) || bindErr.Network != "tcp" || bindErr.Addr != o.Listen {
+		t.Fatalf("Address in use should fail with BindError, got %v", err)
+	}
+	if runtime.GOOS == "linux" && !strings.Contains(bindErr.Holder, "pid "+strconv.Itoa(os.Getpid())) {
+		t.Errorf("Holder of the address should be found, got %q", bindErr.Holder)
+	}
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+	if err := WithFallbackPort(port)(o); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.listen()
+	if err != nil {
+		t.Fatal("Fallback port should be bound: ", err)
+	}
+	defer got.close()
+	if len(got.udp) != 1 || len(got.tcp) != 1 || got.tcp[0].Addr().(*net.TCPAddr).Port != port ||
+		got.udp[0].LocalAddr().(*net.UDPAddr).Port != port {
+		t.Errorf("Both transports should fall back to port %d, got %v %v", port, got.udp, got.tcp)
+	}
+}
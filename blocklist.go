@@ -0,0 +1,213 @@
+package gochinadns
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/cherrot/gochinadns/sitelist"
+	"github.com/miekg/dns"
+)
+
+// Responses to blocked queries. An IP (or comma separated IPs) is also accepted as a sinkhole, answering A and
+// AAAA questions with the IPs of the same family, and other questions with BlockEmpty.
+const (
+	BlockEmpty    = "empty"    // NOERROR without answers
+	BlockNXDomain = "nxdomain" // NXDOMAIN
+	BlockRefused  = "refused"  // REFUSED
+)
+
+// blockTTL is the TTL of sinkhole answers to blocked queries.
+const blockTTL = 60
+
+// domainList matches names by suffixes, wildcards and regular expressions:
+//   - `example.com` matches example.com and its subdomains
+//   - `*.example.com` matches subdomains of example.com only
+//   - `ads.*.example.com` matches names with any label in place of `*`
+//   - `/^ad[0-9]+\./` matches names (lower cased, without the trailing dot) by the regular expression
+//
+// Empty lines and lines starting with `#` are ignored.
+// Rules of site lists (see package sitelist) may also match full names or keywords, with exceptions.
+type domainList struct {
+	suffixes  *domainTrie
+	wildcards *domainTrie // parents of names matched by leading wildcards
+	regexps   []*regexp.Regexp
+	full      map[string]struct{}
+	keywords  []string
+	except    *domainList // names never matched
+}
+
+// Contain tells whether name matches the list.
+func (l *domainList) Contain(name string) bool {
+	if l == nil {
+		return false
+	}
+	if l.except.Contain(name) {
+		return false
+	}
+	if l.suffixes.Contain(name) {
+		return true
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if _, ok := l.full[name]; ok {
+		return true
+	}
+	for _, keyword := range l.keywords {
+		if strings.Contains(name, keyword) {
+			return true
+		}
+	}
+	if l.wildcards != nil {
+		if i := strings.IndexByte(name, '.'); i >= 0 && l.wildcards.Contain(name[i+1:]) {
+			return true
+		}
+	}
+	for _, re := range l.regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds an entry of the list.
+func (l *domainList) add(entry string) error {
+	switch {
+	case len(entry) > 1 && entry[0] == '/' && entry[len(entry)-1] == '/':
+		re, err := regexp.Compile(entry[1 : len(entry)-1])
+		if err != nil {
+			return err
+		}
+		l.regexps = append(l.regexps, re)
+	case strings.HasPrefix(entry, "*.") && !strings.Contains(entry[2:], "*"):
+		if l.wildcards == nil {
+			l.wildcards = new(domainTrie)
+		}
+		l.wildcards.Add(strings.ToLower(entry[2:]))
+	case strings.Contains(entry, "*"):
+		pattern := strings.ReplaceAll(regexp.QuoteMeta(strings.ToLower(strings.TrimSuffix(entry, "."))), `\*`, `[^.]+`)
+		l.regexps = append(l.regexps, regexp.MustCompile("^"+pattern+"$"))
+	default:
+		if l.suffixes == nil {
+			l.suffixes = new(domainTrie)
+		}
+		l.suffixes.Add(entry)
+	}
+	return nil
+}
+
+// addRule adds a rule of site lists.
+func (l *domainList) addRule(rule sitelist.Rule) error {
+	switch rule.Type {
+	case sitelist.Keyword:
+		l.keywords = append(l.keywords, rule.Value)
+	case sitelist.Regexp:
+		re, err := regexp.Compile(rule.Value)
+		if err != nil {
+			return err
+		}
+		l.regexps = append(l.regexps, re)
+	case sitelist.Domain:
+		if l.suffixes == nil {
+			l.suffixes = new(domainTrie)
+		}
+		l.suffixes.Add(rule.Value)
+	case sitelist.Full:
+		if l.full == nil {
+			l.full = make(map[string]struct{})
+		}
+		l.full[rule.Value] = struct{}{}
+	default:
+		return fmt.Errorf("unsupported rule type %s", rule.Type)
+	}
+	return nil
+}
+
+// loadDomainList adds entries in file path into list. A new list is created if list is nil.
+// desc describes the list in error messages. Errors are collected in errs, see listErrors.
+func loadDomainList(list *domainList, path, desc string, errs *listErrors) (*domainList, error) {
+	if path == "" {
+		return list, fmt.Errorf("%w for %s", ErrEmptyPath, desc)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return list, errs.add(fmt.Errorf("fail to open %s: %w", desc, err))
+	}
+	defer file.Close()
+
+	load := startListLoad()
+	if list == nil {
+		list = new(domainList)
+	}
+	scanner := bufio.NewScanner(file)
+	count := 0
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		if err := list.add(entry); err != nil {
+			if err := errs.add(fmt.Errorf("parse %s entry %s at line %d failed: %w", desc, entry, line, err)); err != nil {
+				return list, err
+			}
+			continue
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		if err := errs.add(fmt.Errorf("fail to scan %s: %v", desc, err.Error())); err != nil {
+			return list, err
+		}
+	}
+	load.done(desc, path, count)
+	return list, nil
+}
+
+// WithBlockResponse sets the response to queries blocked by the domain blacklist or scheduled blocking rules:
+// BlockEmpty (the default), BlockNXDomain, BlockRefused, or sinkhole IPs separated by comma like `0.0.0.0,::`.
+func WithBlockResponse(resp string) ServerOption {
+	return func(o *serverOptions) error {
+		switch resp {
+		case "":
+			resp = BlockEmpty
+		case BlockEmpty, BlockNXDomain, BlockRefused:
+		default:
+			var sinkhole []net.IP
+			for _, s := range strings.Split(resp, ",") {
+				ip := net.ParseIP(strings.TrimSpace(s))
+				if ip == nil {
+					return fmt.Errorf("invalid block response [%s], expect empty, nxdomain, refused or IPs", resp)
+				}
+				sinkhole = append(sinkhole, ip)
+			}
+			o.BlockSinkhole = sinkhole
+		}
+		o.BlockResponse = resp
+		return nil
+	}
+}
+
+// blockedReply returns the reply to the blocked query req.
+func (s *Server) blockedReply(req *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	switch s.BlockResponse {
+	case BlockNXDomain:
+		m.Rcode = dns.RcodeNameError
+	case BlockRefused:
+		m.Rcode = dns.RcodeRefused
+	}
+	q := req.Question[0]
+	for _, ip := range s.BlockSinkhole {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: blockTTL}
+		if ip4 := ip.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+		} else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return m
+}
@@ -0,0 +1,96 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/cherrot/gochinadns/clock"
+	"github.com/miekg/dns"
+)
+
+func TestDomainList(t *testing.T) {
+	path := writeTestList(t, "blacklist", "# ads\nads.example.com\n*.doubleclick.net\nad.*.example.net\n/^ad[0-9]+\\.example\\.org$/\n\n")
+	l, err := loadDomainList(nil, path, "domain blacklist", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{
+		"ads.example.com.":      true,
+		"x.ads.example.com.":    true,
+		"example.com.":          false,
+		"doubleclick.net.":      false,
+		"g.doubleclick.net.":    true,
+		"a.b.DoubleClick.net.":  true,
+		"ad.cdn.example.net.":   true,
+		"ad.a.b.example.net.":   false,
+		"ad12.example.org.":     true,
+		"ad12.example.org.evil": false,
+		"ad.example.org.":       false,
+	} {
+		if got := l.Contain(name); got != want {
+			t.Errorf("Contain(%s) = %v, want %v", name, got, want)
+		}
+	}
+
+	if _, err = loadDomainList(nil, writeTestList(t, "bad", "/[/\n"), "domain blacklist", nil); err == nil {
+		t.Error("Invalid regular expression should be rejected")
+	}
+}
+
+func TestBlockedReply(t *testing.T) {
+	req := new(dns.Msg).SetQuestion("ads.example.com.", dns.TypeA)
+	for resp, check := range map[string]func(*dns.Msg) bool{
+		"":            func(m *dns.Msg) bool { return m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0 },
+		BlockNXDomain: func(m *dns.Msg) bool { return m.Rcode == dns.RcodeNameError },
+		BlockRefused:  func(m *dns.Msg) bool { return m.Rcode == dns.RcodeRefused },
+		"0.0.0.0, ::": func(m *dns.Msg) bool {
+			return m.Rcode == dns.RcodeSuccess && len(m.Answer) == 1 && m.Answer[0].(*dns.A).A.Equal(net.IPv4zero)
+		},
+	} {
+		o := newServerOptions()
+		if err := WithBlockResponse(resp)(o); err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{serverOptions: o}
+		if m := s.blockedReply(req); !check(m) {
+			t.Errorf("Unexpected reply with block response %q: %v", resp, m)
+		}
+	}
+
+	if err := WithBlockResponse("sinkhole")(newServerOptions()); err == nil {
+		t.Error("Unknown block response should be rejected")
+	}
+}
+
+func TestWhitelistOverridesBlocking(t *testing.T) {
+	clk := clock.NewFake(time.Date(2021, 3, 7, 12, 0, 0, 0, time.UTC))
+	schedule := writeTestList(t, "schedule", "* * 00:00-23:59 UTC "+writeTestList(t, "video.list", "video.com\n")+"\n")
+	upstream := NewUpstreamResolver("upstream", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+		m := newTestReply(req.Question[0].Name, 60, "1.0.1.1")
+		m.Id = req.Id
+		return m, time.Millisecond, nil
+	}))
+	s, err := NewServer(NewClient(), WithSkipRefineResolvers(true), WithClock(clk), WithUpstreams(true, upstream),
+		WithBlockResponse(BlockNXDomain),
+		WithDomainBlacklist(writeTestList(t, "blacklist", "example.com\n")),
+		WithDomainWhitelist(writeTestList(t, "whitelist", "www.example.com\nwww.video.com\n")),
+		WithBlockSchedule(schedule))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, blocked := range map[string]bool{
+		"www.example.com.": false,
+		"ads.example.com.": true,
+		"example.com.":     true,
+		"www.video.com.":   false,
+		"m.video.com.":     true,
+	} {
+		w := newFakeResponseWriter("192.168.1.20")
+		s.Serve(w, new(dns.Msg).SetQuestion(name, dns.TypeA))
+		if w.msg == nil || (w.msg.Rcode == dns.RcodeNameError) != blocked || (len(w.msg.Answer) == 1) == blocked {
+			t.Errorf("%s should be blocked: %v, got %v", name, blocked, w.msg)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package gochinadns
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Periods of upstream budgets, which start at midnight in local time.
+const (
+	BudgetDaily   = "day"
+	BudgetMonthly = "month"
+)
+
+var (
+	budgetSpent       = expvar.NewMap("chinadns_budget_spent") // queries sent to upstreams with budgets, by address
+	budgetExhaustions = expvar.NewInt("chinadns_budget_exhaustions")
+)
+
+// UpstreamBudget limits queries sent to an upstream per period, e.g. for commercial DoH endpoints metering usage.
+type UpstreamBudget struct {
+	Addr   string // address of the resolver, as Resolver.GetAddr
+	Limit  uint64
+	Period string // see BudgetXXX
+}
+
+func (b UpstreamBudget) String() string {
+	return b.Addr + "=" + strconv.FormatUint(b.Limit, 10) + "/" + b.Period
+}
+
+// budgetFileSuffix is appended to the path of the cache file to save budget counters to, see WithUpstreamBudgets.
+const budgetFileSuffix = ".budgets"
+
+// ParseUpstreamBudget parses a budget in format addr=limit/period, such as https://dns.example/dns-query=10000/day.
+func ParseUpstreamBudget(s string) (b UpstreamBudget, err error) {
+	i := strings.LastIndexByte(s, '=')
+	j := strings.LastIndexByte(s, '/')
+	if i <= 0 || j < i {
+		return b, fmt.Errorf("invalid upstream budget [%s], expect addr=limit/period", s)
+	}
+	b.Addr, b.Period = s[:i], s[j+1:]
+	if b.Limit, err = strconv.ParseUint(s[i+1:j], 10, 64); err != nil || b.Limit == 0 {
+		return b, fmt.Errorf("invalid limit of upstream budget [%s], expect a positive integer", s)
+	}
+	if b.Period != BudgetDaily && b.Period != BudgetMonthly {
+		return b, fmt.Errorf("invalid period of upstream budget [%s], expect day or month", s)
+	}
+	return b, nil
+}
+
+// WithUpstreamBudgets limits queries sent to upstreams per day or month, in format addr=limit/period (see
+// ParseUpstreamBudget). An upstream may have both a daily and a monthly budget. Queries include health checks.
+// An upstream exhausting a budget is demoted, i.e. left out of its group like a drained one, until the period ends,
+// unless all upstreams of the group are left out. Budgets are applied again by Reload and ApplyConfig, keeping
+// queries counted against those unchanged. With WithCacheFile, counters are saved next to the cache file (with suffix
+// .budgets) on shutdown, and loaded on start if their periods have not ended, so that a restart doesn't reset them.
+func WithUpstreamBudgets(budgets ...string) ServerOption {
+	return func(o *serverOptions) error {
+		for _, s := range budgets {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			b, err := ParseUpstreamBudget(s)
+			if err != nil {
+				return err
+			}
+			o.Budgets = append(o.Budgets, b)
+		}
+		return nil
+	}
+}
+
+// budgetStrings returns budgets in the format of WithUpstreamBudgets.
+func budgetStrings(budgets []UpstreamBudget) []string {
+	list := make([]string, len(budgets))
+	for i, b := range budgets {
+		list[i] = b.String()
+	}
+	return list
+}
+
+// BudgetStatus is the consumption of an upstream budget in the current period.
+type BudgetStatus struct {
+	Period string    `json:"period"`
+	Limit  uint64    `json:"limit"`
+	Used   uint64    `json:"used"`
+	Resets time.Time `json:"resets"` // when the next period starts
+}
+
+// budgetCounter counts queries of a budget in the current period.
+type budgetCounter struct {
+	UpstreamBudget
+	used  uint64
+	start time.Time // of the current period
+}
+
+// budgetTable counts queries of upstreams against their budgets, indexed by address. A nil table has no budgets.
+type budgetTable struct {
+	mu       sync.Mutex
+	budgets  []UpstreamBudget
+	counters map[string][]*budgetCounter
+	now      func() time.Time // replaced in tests
+}
+
+// newBudgetTable returns a table of budgets, which may be changed later by Set.
+func newBudgetTable(budgets []UpstreamBudget) *budgetTable {
+	t := &budgetTable{now: time.Now}
+	t.Set(budgets)
+	return t
+}
+
+// Set replaces budgets of the table. Counters of budgets of the same address and period are kept, and so are they
+// if the limit changes.
+func (t *budgetTable) Set(budgets []UpstreamBudget) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counters := make(map[string][]*budgetCounter, len(budgets))
+	for _, b := range budgets {
+		c := &budgetCounter{UpstreamBudget: b}
+		if old := t.counter(b.Addr, b.Period); old != nil {
+			c.used, c.start = old.used, old.start
+		}
+		counters[b.Addr] = append(counters[b.Addr], c)
+	}
+	t.budgets, t.counters = budgets, counters
+}
+
+// counter returns the counter of the budget of addr and period, or nil if there is none. t.mu must be held.
+func (t *budgetTable) counter(addr, period string) *budgetCounter {
+	for _, c := range t.counters[addr] {
+		if c.Period == period {
+			return c
+		}
+	}
+	return nil
+}
+
+// Budgets returns budgets of the table.
+func (t *budgetTable) Budgets() []UpstreamBudget {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.budgets
+}
+
+// periodStart returns the start of the period containing now.
+func periodStart(period string, now time.Time) time.Time {
+	day := 1
+	if period == BudgetDaily {
+		day = now.Day()
+	}
+	return time.Date(now.Year(), now.Month(), day, 0, 0, 0, 0, now.Location())
+}
+
+// periodEnd returns the start of the period following the one starting at start.
+func periodEnd(period string, start time.Time) time.Time {
+	if period == BudgetDaily {
+		return start.AddDate(0, 0, 1)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+// current resets c if a new period started by now. t.mu must be held.
+func (c *budgetCounter) current(now time.Time) *budgetCounter {
+	if start := periodStart(c.Period, now); !start.Equal(c.start) {
+		c.start, c.used = start, 0
+	}
+	return c
+}
+
+// Spend counts a query sent to r.
+func (t *budgetTable) Spend(r *Resolver) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	counters := t.counters[r.GetAddr()]
+	if len(counters) == 0 {
+		return
+	}
+	budgetSpent.Add(r.GetAddr(), 1)
+	now := t.now()
+	for _, c := range counters {
+		c.current(now).used++
+		if c.used == c.Limit {
+			budgetExhaustions.Add(1)
+			logrus.WithField("server", r).Warnf("Upstream budget of %d queries per %s exhausted. Demote it until %s.",
+				c.Limit, c.Period, periodEnd(c.Period, c.start).Format(time.RFC3339))
+		}
+	}
+}
+
+// Exhausted tells whether r has exhausted any budget in the current period.
+func (t *budgetTable) Exhausted(r *Resolver) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	for _, c := range t.counters[r.GetAddr()] {
+		if c.current(now).used >= c.Limit {
+			return true
+		}
+	}
+	return false
+}
+
+// Status returns the consumption of budgets of r, or nil if it has none.
+func (t *budgetTable) Status(r *Resolver) []BudgetStatus {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var list []BudgetStatus
+	now := t.now()
+	for _, c := range t.counters[r.GetAddr()] {
+		c.current(now)
+		list = append(list, BudgetStatus{Period: c.Period, Limit: c.Limit, Used: c.used, Resets: periodEnd(c.Period, c.start)})
+	}
+	return list
+}
+
+// withinBudget returns resolvers in list which have not exhausted their budgets, or list as is if all have.
+func (t *budgetTable) withinBudget(list resolverList) resolverList {
+	if t == nil {
+		return list
+	}
+	var result resolverList
+	for _, r := range list {
+		if !t.Exhausted(r) {
+			result = append(result, r)
+		}
+	}
+	if len(result) == 0 {
+		return list
+	}
+	return result
+}
+
+// budgetFile is the content of a file of budget counters.
+type budgetFile struct {
+	Counters []budgetFileCounter `json:"counters"`
+}
+
+type budgetFileCounter struct {
+	Addr   string    `json:"addr"`
+	Period string    `json:"period"`
+	Used   uint64    `json:"used"`
+	Start  time.Time `json:"start"` // of the period counted
+}
+
+// Save writes counters of the current periods to w.
+func (t *budgetTable) Save(w io.Writer) error {
+	var f budgetFile
+	t.mu.Lock()
+	now := t.now()
+	for _, b := range t.budgets {
+		c := t.counter(b.Addr, b.Period).current(now)
+		f.Counters = append(f.Counters, budgetFileCounter{Addr: c.Addr, Period: c.Period, Used: c.used, Start: c.start})
+	}
+	t.mu.Unlock()
+	return json.NewEncoder(w).Encode(&f)
+}
+
+// Load restores counters written by Save from r, and returns how many are restored. Counters of budgets not in the
+// table, and of periods which have ended, are skipped.
+func (t *budgetTable) Load(r io.Reader) (int, error) {
+	var f budgetFile
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return 0, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	n := 0
+	for _, fc := range f.Counters {
+		c := t.counter(fc.Addr, fc.Period)
+		if c == nil || !periodStart(fc.Period, now).Equal(fc.Start) {
+			continue
+		}
+		c.start, c.used = fc.Start, fc.Used
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,144 @@
+package gochinadns
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUpstreamBudget(t *testing.T) {
+	b, err := ParseUpstreamBudget("https://dns.example/dns-query?x=1=10000/day")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Addr != "https://dns.example/dns-query?x=1" || b.Limit != 10000 || b.Period != BudgetDaily {
+		t.Errorf("Unexpected budget %+v", b)
+	}
+	for _, s := range []string{"8.8.8.8:53", "8.8.8.8:53=0/day", "8.8.8.8:53=100/week", "=100/day", "8.8.8.8:53=-1/month"} {
+		if _, err := ParseUpstreamBudget(s); err == nil {
+			t.Errorf("Budget %s should be invalid", s)
+		}
+	}
+}
+
+func TestBudgetTable(t *testing.T) {
+	o := newServerOptions()
+	if err := WithUpstreamBudgets("8.8.8.8:53=2/day", "8.8.8.8:53=3/month")(o); err != nil {
+		t.Fatal(err)
+	}
+	metered, other := &Resolver{Addr: "8.8.8.8:53"}, &Resolver{Addr: "1.1.1.1:53"}
+	table := newBudgetTable(o.Budgets)
+	now := time.Date(2021, 1, 31, 23, 0, 0, 0, time.Local)
+	table.now = func() time.Time { return now }
+
+	table.Spend(metered)
+	table.Spend(other)
+	if table.Exhausted(metered) || table.Exhausted(other) {
+		t.Fatal("Budgets should not be exhausted yet")
+	}
+	table.Spend(metered)
+	if !table.Exhausted(metered) {
+		t.Fatal("Daily budget should be exhausted")
+	}
+	if list := table.withinBudget(resolverList{metered, other}); len(list) != 1 || list[0] != other {
+		t.Errorf("Exhausted upstream should be left out, got %s", list)
+	}
+	if list := table.withinBudget(resolverList{metered}); len(list) != 1 {
+		t.Errorf("Exhausted upstreams should be used if all are, got %s", list)
+	}
+
+	// A new day starts, and so does a new month.
+	now = now.Add(2 * time.Hour)
+	if table.Exhausted(metered) {
+		t.Error("Budgets should reset in a new period")
+	}
+	table.Spend(metered)
+	st := table.Status(metered)
+	if len(st) != 2 || st[0].Used != 1 || st[1].Used != 1 || !st[1].Resets.Equal(time.Date(2021, 3, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("Unexpected status %+v", st)
+	}
+	if table.Status(other) != nil {
+		t.Error("Upstream without budgets should have no status")
+	}
+}
+
+func TestBudgetTableSet(t *testing.T) {
+	s, err := NewServer(NewClient(), WithSkipRefineResolvers(true), WithUpstreamBudgets("8.8.8.8:53=2/day"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	metered := &Resolver{Addr: "8.8.8.8:53"}
+	s.budgets.Spend(metered)
+	s.budgets.Spend(metered)
+	if !s.budgets.Exhausted(metered) {
+		t.Fatal("Daily budget should be exhausted")
+	}
+
+	// Raising the limit keeps queries counted.
+	o := newServerOptions()
+	if err = WithUpstreamBudgets("8.8.8.8:53=3/day", "1.1.1.1:53=1/month")(o); err != nil {
+		t.Fatal(err)
+	}
+	s.cutover(o, false)
+	if s.budgets.Exhausted(metered) {
+		t.Error("Raised budget should not be exhausted")
+	}
+	if st := s.budgets.Status(metered); len(st) != 1 || st[0].Used != 2 || st[0].Limit != 3 {
+		t.Errorf("Unexpected status %+v", st)
+	}
+	if got := s.Config().Budgets; len(got) != 2 || got[1] != "1.1.1.1:53=1/month" {
+		t.Errorf("Unexpected budgets in config %v", got)
+	}
+
+	s.cutover(newServerOptions(), false)
+	if st := s.budgets.Status(metered); st != nil {
+		t.Errorf("Budgets should be removed, got %+v", st)
+	}
+}
+
+func TestBudgetFile(t *testing.T) {
+	budgets := []UpstreamBudget{{"8.8.8.8:53", 10, BudgetDaily}, {"8.8.8.8:53", 100, BudgetMonthly}}
+	metered := &Resolver{Addr: "8.8.8.8:53"}
+	now := time.Date(2021, 1, 31, 12, 0, 0, 0, time.Local)
+	table := newBudgetTable(budgets)
+	table.now = func() time.Time { return now }
+	table.Spend(metered)
+	table.Spend(metered)
+	var buf bytes.Buffer
+	if err := table.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	saved := buf.String()
+
+	table = newBudgetTable(budgets)
+	table.now = func() time.Time { return now.Add(time.Hour) }
+	if n, err := table.Load(strings.NewReader(saved)); err != nil || n != 2 {
+		t.Fatalf("Load = %d, %v", n, err)
+	}
+	if st := table.Status(metered); st[0].Used != 2 || st[1].Used != 2 {
+		t.Errorf("Unexpected status %+v", st)
+	}
+
+	// The day has ended, but not the month.
+	table = newBudgetTable(budgets[1:])
+	table.now = func() time.Time { return now.Add(24 * time.Hour) }
+	if n, err := table.Load(strings.NewReader(saved)); err != nil || n != 0 {
+		t.Fatalf("Load = %d, %v", n, err)
+	}
+
+	// Counters survive a restart of a server with a cache file.
+	path := filepath.Join(t.TempDir(), "cache.json")
+	for i := 0; i < 2; i++ {
+		s, err := NewServer(NewClient(), WithSkipRefineResolvers(true), WithCacheFile(path), WithUpstreamBudgets("8.8.8.8:53=10/day"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.budgets.Spend(metered)
+		if st := s.budgets.Status(metered); st[0].Used != uint64(i+1) {
+			t.Errorf("Unexpected status after %d restarts %+v", i, st)
+		}
+		s.saveBudgetFile()
+	}
+}
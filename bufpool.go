@@ -0,0 +1,73 @@
+package gochinadns
+
+import (
+	"net"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// pooledBufferSize is the size of pooled buffers, enough for queries and most UDP replies, whose EDNS buffer size is
+// 1232 bytes as recommended by DNS flag day 2020. Larger buffers are allocated as needed, and never pooled.
+const pooledBufferSize = 4096
+
+// bufferPool pools buffers to pack queries and read replies of upstreams, to reduce GC pressure under high QPS.
+var bufferPool = sync.Pool{New: func() interface{} {
+	b := make([]byte, pooledBufferSize)
+	return &b
+}}
+
+// getBuffer returns a buffer of size bytes, pooled if it fits. Return it by putBuffer once it's no longer used.
+func getBuffer(size int) *[]byte {
+	if size > pooledBufferSize {
+		b := make([]byte, size)
+		return &b
+	}
+	b := bufferPool.Get().(*[]byte)
+	*b = (*b)[:size]
+	return b
+}
+
+// putBuffer returns b to the pool, unless it's not from the pool.
+func putBuffer(b *[]byte) {
+	if cap(*b) == pooledBufferSize {
+		bufferPool.Put(b)
+	}
+}
+
+// packMsg packs m like m.Pack, into a pooled buffer if it fits. Return buf by putBuffer once raw is no longer used.
+func packMsg(m *dns.Msg) (raw []byte, buf *[]byte, err error) {
+	buf = getBuffer(pooledBufferSize)
+	if raw, err = m.PackBuffer(*buf); err != nil {
+		putBuffer(buf)
+		return nil, nil, err
+	}
+	return raw, buf, nil
+}
+
+// readMsg reads a message from conn like conn.ReadMsg, into a pooled buffer over UDP. Unpack keeps slices of the
+// buffer in some EDNS0 options, like padding, so messages are unpacked from a copy of what's read, and the buffer is
+// returned to the pool at once.
+func readMsg(conn *dns.Conn) (*dns.Msg, error) {
+	if _, ok := conn.Conn.(net.PacketConn); !ok {
+		return conn.ReadMsg()
+	}
+	size := int(conn.UDPSize)
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+	buf := getBuffer(size)
+	defer putBuffer(buf)
+	n, err := conn.Read(*buf)
+	if err != nil {
+		return nil, err
+	}
+	if n < 12 {
+		return nil, dns.ErrShortRead
+	}
+	m := new(dns.Msg)
+	if err = m.Unpack(append([]byte(nil), (*buf)[:n]...)); err != nil {
+		return m, err
+	}
+	return m, nil
+}
@@ -0,0 +1,141 @@
+package gochinadns
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestReadMsgPooled(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	nc, err := net.Dial("udp", server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &dns.Conn{Conn: nc, UDPSize: 1232}
+	defer conn.Close()
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	raw, buf, err := packMsg(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write(raw); err != nil {
+		t.Fatal(err)
+	}
+	putBuffer(buf)
+
+	b := make([]byte, dns.MinMsgSize)
+	n, addr, err := server.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := newTestReply("example.com.", 60, "192.0.2.1")
+	reply.Id = req.Id
+	if q := new(dns.Msg); q.Unpack(b[:n]) != nil || q.Id != req.Id {
+		t.Fatal("Query packed in a pooled buffer should be sent as is")
+	}
+	packed, _ := reply.Pack()
+	if _, err = server.WriteTo(packed, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	m, err := readMsg(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Overwrite pooled buffers, which must not be referred by the message read.
+	for i := 0; i < 4; i++ {
+		b := getBuffer(pooledBufferSize)
+		for j := range *b {
+			(*b)[j] = 0xff
+		}
+		putBuffer(b)
+	}
+	if len(m.Answer) != 1 || m.Answer[0].(*dns.A).A.String() != "192.0.2.1" || m.Answer[0].Header().Name != "example.com." {
+		t.Errorf("Unexpected reply %v", m)
+	}
+}
+
+func TestReadMsgPadded(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	// Replies are padded by the low byte of their IDs.
+	go func() {
+		b := make([]byte, dns.MinMsgSize)
+		for {
+			n, addr, err := server.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			req := new(dns.Msg)
+			if req.Unpack(b[:n]) != nil {
+				continue
+			}
+			reply := newTestReply(req.Question[0].Name, 60, "192.0.2.1")
+			reply.Id = req.Id
+			reply.SetEdns0(1232, false)
+			opt := reply.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: bytes.Repeat([]byte{byte(req.Id)}, 64)})
+			packed, _ := reply.Pack()
+			_, _ = server.WriteTo(packed, addr)
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nc, err := net.Dial("udp", server.LocalAddr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn := &dns.Conn{Conn: nc, UDPSize: 1232}
+			defer conn.Close()
+			for j := 0; j < 20; j++ {
+				req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+				if err = conn.WriteMsg(req); err != nil {
+					t.Error(err)
+					return
+				}
+				_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+				m, err := readMsg(conn)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				// Pooled buffers are reused by other readers meanwhile, which must not change the padding read.
+				b := getBuffer(pooledBufferSize)
+				for k := range *b {
+					(*b)[k] = 0xff
+				}
+				putBuffer(b)
+				opt := m.IsEdns0()
+				if opt == nil || len(opt.Option) != 1 {
+					t.Errorf("Unexpected reply %v", m)
+					return
+				}
+				if p := opt.Option[0].(*dns.EDNS0_PADDING).Padding; !bytes.Equal(p, bytes.Repeat([]byte{byte(req.Id)}, 64)) {
+					t.Errorf("Padding of reply %d is overwritten: %x", req.Id, p)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
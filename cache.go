@@ -1,8 +1,459 @@
 package gochinadns
 
-var (
-// flagDisableCache    = flag.Bool("disable-cache", false, "Disable built-in DNS cache.")
-// flagMaxCacheEntries = flag.Int("cache-entries", 5000, "Max DNS cache entries.")
-// flagCacheTTL        = flag.Duration("cache-ttl", 0, "Cache TTL. Set to 0 to use TTL in DNS answers.")
-// flagLazyExpire      = flag.Bool("lazy-expire", true, "In lazy mode, cache could still be used when DNS timeout happens, even if it was expired.")
+import (
+	"container/list"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// entryOverhead roughly estimates memory used by a cache entry besides the message itself.
+	entryOverhead = 256
+	// staleAnswerTTL is TTL of records in stale answers, as recommended by RFC 8767.
+	staleAnswerTTL = 30
+	// maxNegativeTTL caps TTL of negative answers, as recommended by RFC 2308.
+	maxNegativeTTL = 3 * 3600
 )
+
+// Cache stores DNS replies. Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns a copy of the reply cached for q with TTLs decreased by the time elapsed since it's set,
+	// along with the remaining TTL of the entry, which is not positive if the entry is stale.
+	// It returns nil if the entry is absent, or expired for longer than the stale duration it's set with.
+	Get(q *dns.Question) (m *dns.Msg, ttl time.Duration)
+	// Set caches reply m of q for ttl, and keeps it for another stale duration after it expires.
+	Set(q *dns.Question, m *dns.Msg, ttl, stale time.Duration)
+	// Delete removes the entry of q if any.
+	Delete(q *dns.Question)
+	// Len returns the number of entries.
+	Len() int
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+func newCacheKey(q *dns.Question) cacheKey {
+	return cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass}
+}
+
+type cacheEntry struct {
+	key        cacheKey
+	msg        *dns.Msg
+	stored     time.Time
+	expire     time.Time
+	evict      time.Time // time after which a stale entry can't be served
+	size       int
+	provenance Provenance // zero if unknown
+}
+
+// CachedEntry describes an entry of the response cache.
+type CachedEntry struct {
+	Name       string      `json:"name"`
+	Type       string      `json:"type"`
+	Expires    time.Time   `json:"expires"`
+	Stale      bool        `json:"stale,omitempty"`      // expired, and served only if upstreams fail
+	Provenance *Provenance `json:"provenance,omitempty"` // which upstream and decision produced the reply, nil if unknown
+}
+
+// CacheFilter selects cache entries to flush, e.g. after an upstream is found poisoned for a while.
+// Entries matching all non-empty conditions are selected.
+type CacheFilter struct {
+	Upstream string     // upstream producing the entry, as in Provenance, or its address like 8.8.8.8:53
+	Suffix   string     // domain suffix of the entry's name, matching the domain itself and its subdomains
+	CIDR     *net.IPNet // network containing any address in the entry's answer
+}
+
+func (f CacheFilter) normalize() CacheFilter {
+	if f.Suffix != "" {
+		f.Suffix = dns.Fqdn(strings.ToLower(f.Suffix))
+	}
+	return f
+}
+
+// match tells whether e matches f, which is normalized.
+func (f CacheFilter) match(e *cacheEntry) bool {
+	if f.Upstream != "" && e.provenance.Upstream != f.Upstream && !strings.HasSuffix(e.provenance.Upstream, "@"+f.Upstream) {
+		return false
+	}
+	if f.Suffix != "" && f.Suffix != "." && e.key.name != f.Suffix && !strings.HasSuffix(e.key.name, "."+f.Suffix) {
+		return false
+	}
+	if f.CIDR != nil {
+		for _, ip := range answerIPs(e.msg) {
+			if f.CIDR.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// CacheStats contains statistics of the response cache.
+type CacheStats struct {
+	Entries int    `json:"entries"`
+	Bytes   int    `json:"bytes"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// MemoryCache is an in-memory LRU Cache.
+// It is bounded by both the number of entries and the estimated memory usage.
+type MemoryCache struct {
+	maxEntries int
+	maxBytes   int // unlimited if 0
+	now        func() time.Time
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List // of *cacheEntry, the most recently used first
+	bytes   int
+	hits    uint64
+	misses  uint64
+}
+
+// NewMemoryCache creates a MemoryCache bounded by max entries and estimated memory usage (unlimited if 0).
+func NewMemoryCache(maxEntries, maxBytes int) *MemoryCache {
+	return &MemoryCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		now:        time.Now,
+		entries:    make(map[cacheKey]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Get implements Cache.
+func (c *MemoryCache) Get(q *dns.Question) (*dns.Msg, time.Duration) {
+	key := newCacheKey(q)
+	now := c.now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem := c.entries[key]
+	if elem == nil {
+		c.misses++
+		return nil, 0
+	}
+	e := elem.Value.(*cacheEntry)
+	if !now.Before(e.evict) {
+		c.remove(elem)
+		c.misses++
+		return nil, 0
+	}
+	c.lru.MoveToFront(elem)
+	ttl := e.expire.Sub(now)
+	if ttl > 0 {
+		c.hits++
+	} else {
+		c.misses++
+	}
+
+	m := e.msg.Copy()
+	decreaseTTL(m, now.Sub(e.stored))
+	return m, ttl
+}
+
+// Set implements Cache.
+func (c *MemoryCache) Set(q *dns.Question, m *dns.Msg, ttl, stale time.Duration) {
+	c.SetWithProvenance(q, m, ttl, stale, Provenance{})
+}
+
+// SetWithProvenance is like Set, and remembers which upstream and decision produced m.
+func (c *MemoryCache) SetWithProvenance(q *dns.Question, m *dns.Msg, ttl, stale time.Duration, p Provenance) {
+	now := c.now()
+	if p.Verdict != "" && p.Time.IsZero() {
+		p.Time = now
+	}
+	e := &cacheEntry{
+		key:        newCacheKey(q),
+		msg:        m.Copy(),
+		stored:     now,
+		expire:     now.Add(ttl),
+		evict:      now.Add(ttl + stale),
+		size:       m.Len() + entryOverhead,
+		provenance: p,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem := c.entries[e.key]; elem != nil {
+		c.remove(elem)
+	}
+	c.push(e)
+}
+
+// push adds e as the most recently used entry, and evicts the least recently used ones beyond the bounds.
+// It must be called with c.mu held.
+func (c *MemoryCache) push(e *cacheEntry) {
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.bytes += e.size
+	for c.lru.Len() > c.maxEntries || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Delete implements Cache.
+func (c *MemoryCache) Delete(q *dns.Question) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem := c.entries[newCacheKey(q)]; elem != nil {
+		c.remove(elem)
+	}
+}
+
+// Len implements Cache.
+func (c *MemoryCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// Flush removes all entries.
+func (c *MemoryCache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[cacheKey]*list.Element)
+	c.lru.Init()
+	c.bytes = 0
+}
+
+// FlushMatching removes entries matching f, and returns how many are removed.
+func (c *MemoryCache) FlushMatching(f CacheFilter) int {
+	f = f.normalize()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if f.match(elem.Value.(*cacheEntry)) {
+			c.remove(elem)
+			n++
+		}
+		elem = next
+	}
+	return n
+}
+
+// Shrink evicts the least recently used half of entries, and returns how many are evicted.
+func (c *MemoryCache) Shrink() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.lru.Len() / 2
+	for i := 0; i < n; i++ {
+		c.remove(c.lru.Back())
+	}
+	return n
+}
+
+// Inspect returns entries of name ordered by type, or all entries ordered by name if name is empty.
+// Entries which can't be served any more are skipped.
+func (c *MemoryCache) Inspect(name string) []CachedEntry {
+	name = strings.ToLower(name)
+	if name != "" {
+		name = dns.Fqdn(name)
+	}
+	now := c.now()
+	list := []CachedEntry{}
+	c.mu.Lock()
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		e := elem.Value.(*cacheEntry)
+		if name != "" && e.key.name != name || !now.Before(e.evict) {
+			continue
+		}
+		entry := CachedEntry{Name: e.key.name, Type: dns.TypeToString[e.key.qtype], Expires: e.expire, Stale: !now.Before(e.expire)}
+		if e.provenance.Verdict != "" {
+			p := e.provenance
+			entry.Provenance = &p
+		}
+		list = append(list, entry)
+	}
+	c.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Name != list[j].Name {
+			return list[i].Name < list[j].Name
+		}
+		return list[i].Type < list[j].Type
+	})
+	return list
+}
+
+// Stats returns statistics of the cache.
+func (c *MemoryCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Entries: c.lru.Len(), Bytes: c.bytes, Hits: c.hits, Misses: c.misses}
+}
+
+// remove must be called with c.mu held.
+func (c *MemoryCache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+}
+
+// cacheGet looks up reply of q in the cache if it's enabled, and q is cached by its strategy (see WithCacheStrategy).
+// A stale reply is returned separately, to be served only if upstreams fail.
+func (s *Server) cacheGet(q *dns.Question) (fresh, stale *dns.Msg) {
+	if s.cache == nil {
+		return nil, nil
+	}
+	strategy := s.cacheStrategyOf(q.Name)
+	if strategy.noCache {
+		return nil, nil
+	}
+	m, ttl := s.cache.Get(q)
+	if m == nil || ttl > 0 {
+		return m, nil
+	}
+	if strategy.stale <= 0 {
+		return nil, nil
+	}
+	forEachRR(m, func(rr dns.RR) {
+		rr.Header().Ttl = staleAnswerTTL
+	})
+	return nil, m
+}
+
+// cacheSet caches reply m of q if the cache is enabled, and keeps it for ServeStale after it expires, unless the
+// strategy of q says otherwise (see WithCacheStrategy). Provenance p of m is stored along if the backend supports it,
+// like MemoryCache.
+func (s *Server) cacheSet(q *dns.Question, m *dns.Msg, p Provenance) {
+	if s.cache == nil {
+		return
+	}
+	strategy := s.cacheStrategyOf(q.Name)
+	if strategy.noCache {
+		return
+	}
+	m = strategy.apply(m)
+	ttl, ok := cacheTTL(m)
+	if !ok || ttl == 0 {
+		return
+	}
+	if c, ok := s.cache.(interface {
+		SetWithProvenance(*dns.Question, *dns.Msg, time.Duration, time.Duration, Provenance)
+	}); ok {
+		c.SetWithProvenance(q, m, time.Duration(ttl)*time.Second, strategy.stale, p)
+		return
+	}
+	s.cache.Set(q, m, time.Duration(ttl)*time.Second, strategy.stale)
+}
+
+// InspectCache returns entries of name in the response cache along with their provenance, or all entries if name
+// is empty. It returns false if the cache backend can't be inspected.
+func (s *Server) InspectCache(name string) ([]CachedEntry, bool) {
+	switch c := s.cache.(type) {
+	case nil:
+		return []CachedEntry{}, true
+	case interface{ Inspect(string) []CachedEntry }:
+		return c.Inspect(name), true
+	}
+	return nil, false
+}
+
+// FlushCacheMatching removes cache entries matching f, and returns how many are removed, or false if the cache
+// backend can't be flushed selectively.
+func (s *Server) FlushCacheMatching(f CacheFilter) (int, bool) {
+	switch c := s.cache.(type) {
+	case nil:
+		return 0, true
+	case interface{ FlushMatching(CacheFilter) int }:
+		n := c.FlushMatching(f)
+		logrus.WithFields(logrus.Fields{"upstream": f.Upstream, "suffix": f.Suffix, "cidr": f.CIDR}).
+			Infof("Flushed %d cache entries.", n)
+		return n, true
+	}
+	return 0, false
+}
+
+// cacheStats returns statistics of the cache. Only the number of entries is known if the backend doesn't report its stats.
+func (s *Server) cacheStats() CacheStats {
+	switch c := s.cache.(type) {
+	case nil:
+		return CacheStats{}
+	case interface{ Stats() CacheStats }:
+		return c.Stats()
+	default:
+		return CacheStats{Entries: c.Len()}
+	}
+}
+
+// cacheTTL returns how long reply m can be cached.
+// Successful answers are cached for the minimal TTL of their records.
+// Negative answers (NXDOMAIN and NODATA) are cached per SOA in the authority section (RFC 2308).
+func cacheTTL(m *dns.Msg) (ttl uint32, ok bool) {
+	if m.Truncated {
+		return 0, false
+	}
+	switch {
+	case m.Rcode == dns.RcodeSuccess && len(m.Answer) > 0:
+		return minTTL(m)
+	case m.Rcode == dns.RcodeNameError, m.Rcode == dns.RcodeSuccess:
+		return negativeTTL(m)
+	}
+	return 0, false
+}
+
+// negativeTTL returns the lesser of TTL and MINIMUM field of the SOA record in the authority section of m.
+func negativeTTL(m *dns.Msg) (ttl uint32, ok bool) {
+	for _, rr := range m.Ns {
+		if soa, isSOA := rr.(*dns.SOA); isSOA {
+			ttl = soa.Hdr.Ttl
+			if soa.Minttl < ttl {
+				ttl = soa.Minttl
+			}
+			if ttl > maxNegativeTTL {
+				ttl = maxNegativeTTL
+			}
+			return ttl, true
+		}
+	}
+	return 0, false
+}
+
+// minTTL returns the minimal TTL of records in m, excluding the OPT pseudo record.
+func minTTL(m *dns.Msg) (ttl uint32, ok bool) {
+	forEachRR(m, func(rr dns.RR) {
+		if t := rr.Header().Ttl; !ok || t < ttl {
+			ttl, ok = t, true
+		}
+	})
+	return
+}
+
+// decreaseTTL decreases TTLs of records in m by elapsed, which is the time since m is cached.
+func decreaseTTL(m *dns.Msg, elapsed time.Duration) {
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	seconds := uint32(elapsed / time.Second)
+	forEachRR(m, func(rr dns.RR) {
+		if h := rr.Header(); h.Ttl > seconds {
+			h.Ttl -= seconds
+		} else {
+			h.Ttl = 0
+		}
+	})
+}
+
+// forEachRR calls f with each record in m, excluding the OPT pseudo record.
+func forEachRR(m *dns.Msg, f func(dns.RR)) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			f(rr)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func newTestReply(name string, ttl uint32, ips ...string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeA)
+	m.Response = true
+	for _, ip := range ips {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+			A:   net.ParseIP(ip),
+		})
+	}
+	return m
+}
+
+func TestMemoryCacheTTL(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	c := NewMemoryCache(10, 0)
+	c.now = func() time.Time { return now }
+
+	m := newTestReply("example.com", 60, "1.1.1.1")
+	c.Set(&m.Question[0], m, 60*time.Second, 0)
+
+	now = now.Add(20 * time.Second)
+	q := dns.Question{Name: "EXAMPLE.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	got, remain := c.Get(&q)
+	if got == nil {
+		t.Fatal("Cache should hit case-insensitively")
+	}
+	if ttl := got.Answer[0].Header().Ttl; ttl != 40 || remain != 40*time.Second {
+		t.Errorf("TTL should be decreased to 40, got %d (%s remaining)", ttl, remain)
+	}
+	if m.Answer[0].Header().Ttl != 60 {
+		t.Error("Cache should not modify the original message")
+	}
+
+	now = now.Add(40 * time.Second)
+	if m, _ := c.Get(&q); m != nil {
+		t.Error("Entry should expire")
+	}
+	if st := c.Stats(); st.Entries != 0 || st.Hits != 1 || st.Misses != 1 {
+		t.Errorf("Unexpected stats %+v", st)
+	}
+
+	c.Set(&m.Question[0], m, 60*time.Second, 0)
+	c.Delete(&q)
+	if c.Len() != 0 {
+		t.Error("Entry should be deleted")
+	}
+}
+
+func cached(c Cache, q *dns.Question) bool {
+	m, _ := c.Get(q)
+	return m != nil
+}
+
+func TestMemoryCacheEviction(t *testing.T) {
+	c := NewMemoryCache(2, 0)
+	a, b, d := newTestReply("a.com", 60, "1.1.1.1"), newTestReply("b.com", 60, "1.1.1.1"), newTestReply("d.com", 60, "1.1.1.1")
+	c.Set(&a.Question[0], a, time.Minute, 0)
+	c.Set(&b.Question[0], b, time.Minute, 0)
+	c.Get(&a.Question[0])
+	c.Set(&d.Question[0], d, time.Minute, 0)
+	if cached(c, &b.Question[0]) {
+		t.Error("The least recently used entry should be evicted")
+	}
+	if !cached(c, &a.Question[0]) || !cached(c, &d.Question[0]) {
+		t.Error("Recently used entries should be kept")
+	}
+
+	c = NewMemoryCache(100, a.Len()+entryOverhead)
+	c.Set(&a.Question[0], a, time.Minute, 0)
+	c.Set(&b.Question[0], b, time.Minute, 0)
+	if st := c.Stats(); st.Entries != 1 || st.Bytes > a.Len()+entryOverhead {
+		t.Errorf("Cache should be bounded by memory, got %+v", st)
+	}
+}
+
+func TestMemoryCacheInspect(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	c := NewMemoryCache(10, 0)
+	c.now = func() time.Time { return now }
+	a, b := newTestReply("a.com", 60, "1.1.1.1"), newTestReply("b.com", 60, "1.0.1.1")
+	c.SetWithProvenance(&b.Question[0], b, time.Minute, time.Hour, Provenance{Upstream: "udp@114.114.114.114:53", Verdict: VerdictChina, RTT: time.Millisecond})
+	c.Set(&a.Question[0], a, time.Minute, 0)
+
+	list := c.Inspect("")
+	if len(list) != 2 || list[0].Name != "a.com." || list[0].Type != "A" || list[0].Provenance != nil {
+		t.Fatalf("Unexpected entries %+v", list)
+	}
+	if p := list[1].Provenance; p == nil || p.Upstream != "udp@114.114.114.114:53" || p.Verdict != VerdictChina || !p.Time.Equal(now) {
+		t.Errorf("Provenance should be kept, got %+v", p)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if list = c.Inspect("B.com"); len(list) != 1 || !list[0].Stale || list[0].Provenance == nil {
+		t.Errorf("Stale entry should be listed with its provenance, got %+v", list)
+	}
+	if list = c.Inspect("a.com."); len(list) != 0 {
+		t.Errorf("Evicted entry should not be listed, got %+v", list)
+	}
+}
+
+func TestMemoryCacheFlushMatching(t *testing.T) {
+	c := NewMemoryCache(10, 0)
+	set := func(name, upstream string, ips ...string) {
+		m := newTestReply(name, 60, ips...)
+		c.SetWithProvenance(&m.Question[0], m, time.Minute, 0, Provenance{Upstream: upstream, Verdict: VerdictChina})
+	}
+	set("www.google.com", "udp@114.114.114.114:53", "1.0.1.1")
+	set("google.com", "udp@114.114.114.114:53", "93.46.8.90")
+	set("notgoogle.com", "udp@114.114.114.114:53", "1.0.1.2")
+	set("www.qq.com", "udp@119.29.29.29:53", "1.0.1.3", "93.46.8.91")
+	set("www.baidu.com", "udp@119.29.29.29:53", "1.0.2.1")
+
+	if n := c.FlushMatching(CacheFilter{Suffix: "Google.com", Upstream: "114.114.114.114:53"}); n != 2 {
+		t.Errorf("Entries of the suffix from the upstream should be flushed, got %d", n)
+	}
+	_, cidr, _ := net.ParseCIDR("93.46.8.0/24")
+	if n := c.FlushMatching(CacheFilter{CIDR: cidr}); n != 1 {
+		t.Errorf("Entries with any answer in the CIDR should be flushed, got %d", n)
+	}
+	if n := c.FlushMatching(CacheFilter{Upstream: "udp@119.29.29.29:53"}); n != 1 {
+		t.Errorf("Entries from the upstream should be flushed, got %d", n)
+	}
+	if list := c.Inspect(""); len(list) != 1 || list[0].Name != "notgoogle.com." {
+		t.Errorf("Unexpected entries left %+v", list)
+	}
+}
+
+func TestCacheSetSkip(t *testing.T) {
+	s := &Server{serverOptions: newServerOptions(), cache: NewMemoryCache(10, 0)}
+	empty := newTestReply("empty.com", 60)
+	zero := newTestReply("zero.com", 0, "1.1.1.1")
+	fail := newTestReply("fail.com", 60, "1.1.1.1")
+	fail.Rcode = dns.RcodeServerFailure
+	for _, m := range []*dns.Msg{empty, zero, fail} {
+		s.cacheSet(&m.Question[0], m, Provenance{})
+		if fresh, _ := s.cacheGet(&m.Question[0]); fresh != nil {
+			t.Errorf("%s should not be cached", m.Question[0].Name)
+		}
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	c := NewMemoryCache(10, 0)
+	c.now = func() time.Time { return now }
+	s := &Server{serverOptions: &serverOptions{ServeStale: time.Hour}, cache: c}
+
+	m := newTestReply("example.com", 60, "1.1.1.1")
+	s.cacheSet(&m.Question[0], m, Provenance{})
+
+	now = now.Add(10 * time.Minute)
+	fresh, stale := s.cacheGet(&m.Question[0])
+	if fresh != nil || stale == nil {
+		t.Fatal("Expired entry should be returned as stale")
+	}
+	if ttl := stale.Answer[0].Header().Ttl; ttl != staleAnswerTTL {
+		t.Errorf("TTL of stale answer should be %d, got %d", staleAnswerTTL, ttl)
+	}
+
+	now = now.Add(time.Hour)
+	if fresh, stale = s.cacheGet(&m.Question[0]); fresh != nil || stale != nil {
+		t.Error("Entry should be evicted after the stale duration")
+	}
+}
+
+func TestNegativeCache(t *testing.T) {
+	soa := func(ttl, minttl uint32) *dns.SOA {
+		return &dns.SOA{
+			Hdr:    dns.RR_Header{Name: "com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+			Ns:     "a.gtld-servers.net.",
+			Mbox:   "nstld.verisign-grs.com.",
+			Minttl: minttl,
+		}
+	}
+	nx := newTestReply("nx.com", 0)
+	nx.Rcode = dns.RcodeNameError
+	nx.Ns = []dns.RR{soa(900, 300)}
+	nodata := newTestReply("nodata.com", 0)
+	nodata.Ns = []dns.RR{soa(60, 86400)}
+	long := newTestReply("long.com", 0)
+	long.Ns = []dns.RR{soa(86400, 86400)}
+	noSOA := newTestReply("nosoa.com", 0)
+
+	for _, c := range []struct {
+		m   *dns.Msg
+		ttl uint32
+		ok  bool
+	}{
+		{nx, 300, true},
+		{nodata, 60, true},
+		{long, maxNegativeTTL, true},
+		{noSOA, 0, false},
+	} {
+		if ttl, ok := cacheTTL(c.m); ttl != c.ttl || ok != c.ok {
+			t.Errorf("%s: expect TTL %d (%v), got %d (%v)", c.m.Question[0].Name, c.ttl, c.ok, ttl, ok)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package gochinadns
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// cacheFileVersion is the version of the format of cache files. Files of other versions are not loaded.
+const cacheFileVersion = 1
+
+// WithCacheFile saves the response cache to path on shutdown and loads it on start, so that a restart, e.g. on
+// reboot of a router, doesn't begin with a cold cache and a storm of upstream queries. Entries expire by the wall
+// clock time elapsed in between. The cache backend must support it, like MemoryCache. Disabled if empty.
+func WithCacheFile(path string) ServerOption {
+	return func(o *serverOptions) error {
+		o.CacheFile = path
+		return nil
+	}
+}
+
+// cacheFile is the content of a cache file.
+type cacheFile struct {
+	Version int              `json:"version"`
+	Saved   time.Time        `json:"saved"`
+	Entries []cacheFileEntry `json:"entries"` // the least recently used first
+}
+
+type cacheFileEntry struct {
+	Name       string      `json:"name"`
+	Qtype      uint16      `json:"qtype"`
+	Qclass     uint16      `json:"qclass"`
+	Msg        []byte      `json:"msg"` // in wire format
+	Stored     time.Time   `json:"stored"`
+	Expire     time.Time   `json:"expire"`
+	Evict      time.Time   `json:"evict"`
+	Provenance *Provenance `json:"provenance,omitempty"`
+}
+
+// Save writes entries which can still be served to w, and returns how many are written. Times of entries are
+// written in wall clock, so that they expire correctly when loaded by another process.
+func (c *MemoryCache) Save(w io.Writer) (int, error) {
+	now := c.now()
+	f := cacheFile{Version: cacheFileVersion, Saved: now.Round(0)}
+	c.mu.Lock()
+	for elem := c.lru.Back(); elem != nil; elem = elem.Prev() {
+		e := elem.Value.(*cacheEntry)
+		if !now.Before(e.evict) {
+			continue
+		}
+		b, err := e.msg.Pack()
+		if err != nil {
+			continue
+		}
+		entry := cacheFileEntry{
+			Name:   e.key.name,
+			Qtype:  e.key.qtype,
+			Qclass: e.key.qclass,
+			Msg:    b,
+			Stored: e.stored.Round(0),
+			Expire: e.expire.Round(0),
+			Evict:  e.evict.Round(0),
+		}
+		if e.provenance.Verdict != "" {
+			p := e.provenance
+			entry.Provenance = &p
+		}
+		f.Entries = append(f.Entries, entry)
+	}
+	c.mu.Unlock()
+	return len(f.Entries), json.NewEncoder(w).Encode(&f)
+}
+
+// Load adds entries written by Save from r, and returns how many are added. Entries which can't be served any more
+// are skipped, and so are entries already in the cache. Nothing is loaded if the clock is behind the time the entries
+// are saved, e.g. on a router without RTC before NTP syncs, since their age is unknown.
+func (c *MemoryCache) Load(r io.Reader) (int, error) {
+	var f cacheFile
+	if err := json.NewDecoder(r).Decode(&f); err != nil {
+		return 0, err
+	}
+	if f.Version != cacheFileVersion {
+		return 0, fmt.Errorf("unsupported cache file version %d", f.Version)
+	}
+	now := c.now()
+	if now.Before(f.Saved) {
+		return 0, fmt.Errorf("clock is behind the time the cache is saved (%s)", f.Saved.Format(time.RFC3339))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.lru.Len()
+	for _, fe := range f.Entries {
+		if !now.Before(fe.Evict) {
+			continue
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(fe.Msg); err != nil {
+			continue
+		}
+		e := &cacheEntry{
+			key:    cacheKey{name: strings.ToLower(fe.Name), qtype: fe.Qtype, qclass: fe.Qclass},
+			msg:    m,
+			stored: fe.Stored,
+			expire: fe.Expire,
+			evict:  fe.Evict,
+			size:   m.Len() + entryOverhead,
+		}
+		if fe.Provenance != nil {
+			e.provenance = *fe.Provenance
+		}
+		if c.entries[e.key] == nil {
+			c.push(e)
+		}
+	}
+	return c.lru.Len() - n, nil
+}
+
+// loadCacheFile loads the response cache from CacheFile if it's set.
+func (s *Server) loadCacheFile() {
+	if s.CacheFile == "" || s.cache == nil {
+		return
+	}
+	logger := logrus.WithField("path", s.CacheFile)
+	c, ok := s.cache.(interface{ Load(io.Reader) (int, error) })
+	if !ok {
+		logger.Warn("The cache backend can't be loaded from a file.")
+		return
+	}
+	f, err := os.Open(s.CacheFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Fail to open the cache file.")
+		return
+	}
+	defer f.Close()
+	n, err := c.Load(f)
+	if err != nil {
+		logger.WithError(err).Warn("Fail to load the cache file. Start with an empty cache.")
+		return
+	}
+	logger.Infof("Loaded %d cache entries.", n)
+}
+
+// saveCacheFile saves the response cache to CacheFile if it's set. The file is replaced atomically.
+func (s *Server) saveCacheFile() {
+	if s.CacheFile == "" || s.cache == nil {
+		return
+	}
+	logger := logrus.WithField("path", s.CacheFile)
+	c, ok := s.cache.(interface{ Save(io.Writer) (int, error) })
+	if !ok {
+		logger.Warn("The cache backend can't be saved to a file.")
+		return
+	}
+	var n int
+	err := writeFileAtomic(s.CacheFile, func(w io.Writer) (err error) {
+		n, err = c.Save(w)
+		return
+	})
+	if err != nil {
+		logger.WithError(err).Error("Fail to save the cache.")
+		return
+	}
+	logger.Infof("Saved %d cache entries.", n)
+}
+
+// loadBudgetFile restores budget counters saved next to CacheFile if it's set, see WithUpstreamBudgets.
+func (s *Server) loadBudgetFile() {
+	if s.CacheFile == "" || len(s.budgets.Budgets()) == 0 {
+		return
+	}
+	path := s.CacheFile + budgetFileSuffix
+	logger := logrus.WithField("path", path)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		logger.WithError(err).Warn("Fail to open the budget file.")
+		return
+	}
+	defer f.Close()
+	n, err := s.budgets.Load(f)
+	if err != nil {
+		logger.WithError(err).Warn("Fail to load the budget file. Count budgets from zero.")
+		return
+	}
+	logger.Infof("Restored %d budget counters.", n)
+}
+
+// saveBudgetFile saves budget counters next to CacheFile if it's set.
+func (s *Server) saveBudgetFile() {
+	if s.CacheFile == "" || len(s.budgets.Budgets()) == 0 {
+		return
+	}
+	path := s.CacheFile + budgetFileSuffix
+	if err := writeFileAtomic(path, s.budgets.Save); err != nil {
+		logrus.WithField("path", path).WithError(err).Error("Fail to save budget counters.")
+	}
+}
+
+// writeFileAtomic writes path by write through a temporary file, which replaces path at once, so that it's never
+// left half written.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
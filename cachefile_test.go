@@ -0,0 +1,49 @@
+package gochinadns
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMemoryCacheSaveLoad(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	c := NewMemoryCache(10, 0)
+	c.now = func() time.Time { return now }
+	long, short := newTestReply("long.example.com", 600, "1.1.1.1"), newTestReply("short.example.com", 10, "1.1.1.2")
+	c.SetWithProvenance(&long.Question[0], long, 600*time.Second, 0, Provenance{Upstream: "udp@8.8.8.8:53", Verdict: VerdictOverseas})
+	c.Set(&short.Question[0], short, 10*time.Second, 20*time.Second)
+
+	var buf bytes.Buffer
+	if n, err := c.Save(&buf); err != nil || n != 2 {
+		t.Fatalf("Expect 2 entries saved, got %d, %v", n, err)
+	}
+	saved := buf.Bytes()
+
+	// Entries expire by the time elapsed until the cache is loaded by another process.
+	now = now.Add(60 * time.Second)
+	loaded := NewMemoryCache(10, 0)
+	loaded.now = func() time.Time { return now }
+	if n, err := loaded.Load(bytes.NewReader(saved)); err != nil || n != 1 {
+		t.Fatalf("Expect 1 entry loaded, got %d, %v", n, err)
+	}
+	got, remain := loaded.Get(&long.Question[0])
+	if got == nil || got.Answer[0].Header().Ttl != 540 || remain != 540*time.Second {
+		t.Fatalf("TTL should be decreased by the elapsed time, got %v (%s remaining)", got, remain)
+	}
+	if entries := loaded.Inspect("long.example.com"); len(entries) != 1 || entries[0].Provenance == nil ||
+		entries[0].Provenance.Verdict != VerdictOverseas {
+		t.Errorf("Provenance should be loaded, got %v", entries)
+	}
+	if got, _ := loaded.Get(&short.Question[0]); got != nil {
+		t.Errorf("Evicted entry should not be loaded, got %v", got)
+	}
+
+	// The age of entries is unknown if the clock is behind.
+	now = time.Unix(0, 0)
+	behind := NewMemoryCache(10, 0)
+	behind.now = func() time.Time { return now }
+	if n, err := behind.Load(bytes.NewReader(saved)); err == nil || n != 0 {
+		t.Errorf("Nothing should be loaded if the clock is behind, got %d, %v", n, err)
+	}
+}
@@ -0,0 +1,125 @@
+package gochinadns
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// CacheSetPolluted is the domain set of polluted domains for WithCacheStrategy: those in -domain-polluted, gfwlist or
+// geosite, and flagged by verification.
+const CacheSetPolluted = "polluted"
+
+// Hints of cache strategies, see WithCacheStrategy.
+const (
+	CacheNoCache = "no-cache" // never cache answers
+	CacheLong    = "long"     // long:DURATION, cache positive answers for at least DURATION
+	CacheStale   = "stale"    // stale:DURATION, serve expired answers for DURATION if upstreams fail
+)
+
+// cacheStrategy is how answers of names in a domain set are cached.
+type cacheStrategy struct {
+	set      string      // CacheSetPolluted or path of the domain list
+	strategy string      // hints as given, see WithCacheStrategy
+	domains  *domainTrie // nil for CacheSetPolluted
+	noCache  bool
+	minTTL   time.Duration // floor of TTLs of positive answers, unset if 0
+	stale    time.Duration // how long expired answers are served if upstreams fail, ServeStale if negative
+}
+
+func (cs *cacheStrategy) String() string {
+	return cs.set + "=" + cs.strategy
+}
+
+// WithCacheStrategy sets how answers of names in a domain set are cached, so that e.g. polluted domains are cached
+// longer to spare the slow trusted path. set is CacheSetPolluted, or the path of a domain list. strategy is hints
+// joined by `+`, like `long:1h+stale:24h`:
+//
+//	no-cache        never cache answers
+//	long:DURATION   cache positive answers for at least DURATION, raising their TTLs
+//	stale:DURATION  serve expired answers for DURATION if upstreams fail, overriding WithServeStale
+//
+// The first set containing a name applies, in the order of options.
+func WithCacheStrategy(set, strategy string) ServerOption {
+	return func(o *serverOptions) (err error) {
+		cs := &cacheStrategy{set: set, strategy: strategy, stale: -1}
+		for _, hint := range strings.Split(strategy, "+") {
+			name, arg := hint, ""
+			if i := strings.IndexByte(hint, ':'); i >= 0 {
+				name, arg = hint[:i], hint[i+1:]
+			}
+			var d time.Duration
+			if name == CacheLong || name == CacheStale {
+				if d, err = time.ParseDuration(arg); err != nil || d <= 0 {
+					return fmt.Errorf("invalid cache strategy [%s] of %s, expect %s:DURATION", hint, set, name)
+				}
+			}
+			switch {
+			case name == CacheNoCache && arg == "":
+				cs.noCache = true
+			case name == CacheLong:
+				cs.minTTL = d
+			case name == CacheStale:
+				cs.stale = d
+			default:
+				return fmt.Errorf("invalid cache strategy [%s] of %s, expect %s, %s:DURATION or %s:DURATION",
+					hint, set, CacheNoCache, CacheLong, CacheStale)
+			}
+		}
+		if set != CacheSetPolluted {
+			if cs.domains, err = loadDomainTrie(nil, set, "cache strategy domain list", &o.ListErrors); err != nil {
+				return
+			}
+		}
+		o.CacheStrategies = append(o.CacheStrategies, cs)
+		return nil
+	}
+}
+
+// cacheStrategyStrings returns strategies in the form of set=strategy, or nil if there is none.
+func cacheStrategyStrings(strategies []*cacheStrategy) []string {
+	var list []string
+	for _, cs := range strategies {
+		list = append(list, cs.String())
+	}
+	return list
+}
+
+// cacheStrategyOf returns the strategy of the first domain set containing name, or the default one caching answers
+// by their TTLs and serving them stale for ServeStale.
+func (s *Server) cacheStrategyOf(name string) cacheStrategy {
+	s.listsMu.RLock()
+	strategies := s.CacheStrategies
+	s.listsMu.RUnlock()
+	cs := cacheStrategy{stale: -1}
+	for _, c := range strategies {
+		if c.domains.Contain(name) || (c.domains == nil && s.isDomainPolluted(name)) {
+			cs = *c
+			break
+		}
+	}
+	if cs.stale < 0 {
+		cs.stale = s.ServeStale
+	}
+	return cs
+}
+
+// apply returns m with TTLs raised to the floor of the strategy if it's a positive answer, copying m if raised.
+func (cs *cacheStrategy) apply(m *dns.Msg) *dns.Msg {
+	floor := uint32(cs.minTTL / time.Second)
+	if floor == 0 || m.Rcode != dns.RcodeSuccess || len(m.Answer) == 0 {
+		return m
+	}
+	if ttl, _ := minTTL(m); ttl >= floor {
+		return m
+	}
+	m = m.Copy()
+	forEachRR(m, func(rr dns.RR) {
+		if h := rr.Header(); h.Ttl < floor {
+			h.Ttl = floor
+		}
+	})
+	return m
+}
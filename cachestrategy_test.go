@@ -0,0 +1,58 @@
+package gochinadns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheStrategy(t *testing.T) {
+	internal := writeTestList(t, "internal.list", "corp.example\n")
+	polluted := new(domainTrie)
+	polluted.Add("google.com")
+	o := newServerOptions()
+	o.DomainPolluted = polluted
+	o.ServeStale = 0
+	for _, f := range []ServerOption{
+		WithCacheStrategy(internal, CacheNoCache),
+		WithCacheStrategy(CacheSetPolluted, "long:1h+stale:24h"),
+	} {
+		if err := f(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Unix(1600000000, 0)
+	cache := NewMemoryCache(10, 0)
+	cache.now = func() time.Time { return now }
+	s := &Server{serverOptions: o, cache: cache}
+
+	for _, name := range []string{"www.google.com.", "git.corp.example.", "www.example.com."} {
+		m := newTestReply(name, 60, "1.2.3.4")
+		s.cacheSet(&m.Question[0], m, Provenance{})
+	}
+	q := newTestReply("git.corp.example.", 60).Question[0]
+	if m, _ := s.cacheGet(&q); m != nil || cache.Len() != 2 {
+		t.Error("Answers of no-cache sets should not be cached")
+	}
+	q = newTestReply("www.google.com.", 60).Question[0]
+	if m, _ := s.cacheGet(&q); m == nil || m.Answer[0].Header().Ttl != 3600 {
+		t.Errorf("TTLs of long sets should be raised, got %v", m)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, stale := s.cacheGet(&q); stale == nil {
+		t.Error("Expired answers of stale sets should be served stale")
+	}
+	q = newTestReply("www.example.com.", 60).Question[0]
+	if _, stale := s.cacheGet(&q); stale != nil {
+		t.Error("Expired answers should not be served stale with ServeStale disabled")
+	}
+	if got := cacheStrategyStrings(s.CacheStrategies); len(got) != 2 || got[1] != "polluted=long:1h+stale:24h" {
+		t.Errorf("Unexpected effective strategies %v", got)
+	}
+
+	for _, strategy := range []string{"", "long", "long:0s", "stale:soon", "no-cache:1h", "forever"} {
+		if err := WithCacheStrategy(CacheSetPolluted, strategy)(newServerOptions()); err == nil {
+			t.Errorf("Invalid strategy %q should fail", strategy)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// canaryPoisonTTL is how long a poisoned IP learned from canary domains is blacklisted after last seen.
+const canaryPoisonTTL = 24 * time.Hour
+
+// canaryState learns poisoned IPs from canary domains, which are known to be poisoned on untrusted paths.
+// It's nil-safe.
+type canaryState struct {
+	mu       sync.Mutex
+	poisoned map[string]time.Time // poisoned IPs, with the time last seen
+}
+
+func newCanaryState() *canaryState {
+	return &canaryState{poisoned: make(map[string]time.Time)}
+}
+
+// IsPoisoned reports whether ip was seen in poisoned replies of canary domains recently.
+func (c *canaryState) IsPoisoned(ip net.IP) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen, ok := c.poisoned[ip.String()]
+	return ok && time.Since(seen) < canaryPoisonTTL
+}
+
+// Learn records poisoned IPs in a reply.
+func (c *canaryState) Learn(ips []net.IP) {
+	if c == nil {
+		return
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, ip := range ips {
+		c.poisoned[ip.String()] = now
+	}
+	for ip, seen := range c.poisoned {
+		if now.Sub(seen) >= canaryPoisonTTL {
+			delete(c.poisoned, ip)
+		}
+	}
+}
+
+// Len returns the number of poisoned IPs learned.
+func (c *canaryState) Len() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.poisoned)
+}
+
+// runCanaries queries canary domains immediately and then every CanaryInterval, until ctx is done.
+func (s *Server) runCanaries(ctx context.Context) {
+	if s.CanaryInterval <= 0 || len(s.CanaryDomains) == 0 {
+		return
+	}
+	ticker := time.NewTicker(s.CanaryInterval)
+	defer ticker.Stop()
+	for {
+		for _, domain := range s.CanaryDomains {
+			s.queryCanary(dns.Fqdn(domain))
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// queryCanary queries name through untrusted upstreams, and learns IPs in their answers as poisoned,
+// except ones answered by any trusted upstream too, in case name is not poisoned anymore, or is served by different
+// IPs of a CDN.
+// Replies are never served to clients or cached.
+func (s *Server) queryCanary(name string) {
+	logger := logrus.WithField("canary", name)
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeA)
+	s.normalizeRequest(req)
+
+	trusted, untrusted := s.activeResolvers()
+	genuine := make(map[string]bool)
+	verified := false
+	for _, server := range trusted {
+		reply, _, err := s.lookupTrusted(context.Background(), req.Copy(), server)
+		if err != nil || reply.Rcode != dns.RcodeSuccess {
+			continue
+		}
+		for _, ip := range answerIPs(reply) {
+			genuine[ip.String()] = true
+		}
+		verified = true
+	}
+	if !verified {
+		logger.Warn("No trusted reply of canary domain. Skip learning.")
+		return
+	}
+
+	for _, server := range untrusted {
+		reply, rtt, err := s.lookupNormal(context.Background(), req.Copy(), server)
+		if err != nil {
+			continue
+		}
+		var poisoned []net.IP
+		for _, ip := range answerIPs(reply) {
+			if !genuine[ip.String()] {
+				poisoned = append(poisoned, ip)
+			}
+		}
+		if len(poisoned) == 0 {
+			logger.WithField("server", server).Debug("Canary domain is not poisoned.")
+			continue
+		}
+		logger.WithField("server", server).Debugf("Learned poisoned IPs %v in %s.", poisoned, rtt)
+		s.canary.Learn(poisoned)
+	}
+}
+
+// answerIPs returns IPs of A and AAAA records in the answer section of m.
+func answerIPs(m *dns.Msg) (ips []net.IP) {
+	for _, rr := range m.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			ips = append(ips, rr.A)
+		case *dns.AAAA:
+			ips = append(ips, rr.AAAA)
+		}
+	}
+	return
+}
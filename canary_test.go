@@ -0,0 +1,63 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startAnswerUpstream starts a UDP upstream answering A questions with ips.
+func startAnswerUpstream(t *testing.T, ips ...string) *Resolver {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		for _, ip := range ips {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(ip),
+			})
+		}
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	r, err := ParseResolver(pc.LocalAddr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestQueryCanary(t *testing.T) {
+	o := newServerOptions()
+	o.TrustedServers = resolverList{startAnswerUpstream(t, "142.250.1.1"), startAnswerUpstream(t, "142.250.2.2")}
+	untrusted := startAnswerUpstream(t, "142.250.1.1", "142.250.2.2", "31.13.1.1")
+	o.UntrustedServers = resolverList{untrusted}
+	s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second)), canary: newCanaryState()}
+
+	s.queryCanary("www.google.com.")
+	if ok, _ := s.isBlacklistedIP(net.ParseIP("31.13.1.1")); !ok {
+		t.Error("IP only answered by untrusted servers should be learned as poisoned")
+	}
+	for _, ip := range []string{"142.250.1.1", "142.250.2.2"} {
+		if ok, _ := s.isBlacklistedIP(net.ParseIP(ip)); ok {
+			t.Errorf("IP %s answered by any trusted server should not be learned as poisoned", ip)
+		}
+	}
+
+	c, err := s.ClassifyIP(net.ParseIP("31.13.1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Blacklisted || len(c.Matches[ListCanary]) != 1 {
+		t.Errorf("Unexpected classification %+v", c)
+	}
+}
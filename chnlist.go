@@ -0,0 +1,223 @@
+package gochinadns
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/yl2chen/cidranger"
+)
+
+// chinaListTimeout is the timeout to download a China route list.
+const chinaListTimeout = time.Minute
+
+// WithCHNListURL downloads a China route list from url on start and every refresh interval (never if 0).
+// Both CIDR lists (e.g. from ipverse.net) and APNIC delegated files (only CN entries are used) are supported.
+// The downloaded list is used along with lists loaded by WithCHNList.
+func WithCHNListURL(url string, refresh time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return fmt.Errorf("invalid China route list URL: %s", url)
+		}
+		if refresh < 0 {
+			return fmt.Errorf("invalid China route list refresh interval: %s", refresh)
+		}
+		o.ChinaListURL = url
+		o.ChinaListRefresh = refresh
+		return nil
+	}
+}
+
+// fetchChinaList downloads the China route list and swaps it in. The old list is kept on failure.
+func (s *Server) fetchChinaList(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, chinaListTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.ChinaListURL, nil)
+	if err != nil {
+		return err
+	}
+	cli := s.chinaListClient()
+	defer cli.CloseIdleConnections()
+	resp, err := cli.Do(req)
+	if err != nil {
+		return fmt.Errorf("fail to download China route list: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fail to download China route list: %s", resp.Status)
+	}
+
+	ranger := cidranger.NewPCTrieRanger()
+	if err = parseChinaList(ranger, resp.Body, s.ChinaListURL); err != nil {
+		return err
+	}
+	if ranger.Len() == 0 {
+		return fmt.Errorf("no CIDR in China route list %s", s.ChinaListURL)
+	}
+	s.listsMu.Lock()
+	s.chinaRemote = ranger
+	s.matchers.Store(s.compileMatchers())
+	s.listsMu.Unlock()
+	logrus.Infof("China route list downloaded from %s, %d CIDRs.", s.ChinaListURL, ranger.Len())
+	return nil
+}
+
+// chinaListClient returns the HTTP client to download China route lists, which resolves the host of the URL through
+// trusted upstreams, since the system resolver may be this server, whose lists are not loaded yet, or a poisoned one.
+func (s *Server) chinaListClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = s.dialTrusted
+	return &http.Client{Timeout: chinaListTimeout, Transport: transport}
+}
+
+// dialTrusted dials addr on network like net.Dialer, resolving its host through trusted upstreams.
+// The system resolver is used if there are no trusted upstreams.
+func (s *Server) dialTrusted(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{Timeout: dnsTimeout}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	trusted, _ := s.activeResolvers()
+	if net.ParseIP(host) != nil || len(trusted) == 0 {
+		return d.DialContext(ctx, network, addr)
+	}
+
+	var ips []net.IP
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(host), qtype)
+		for _, server := range trusted {
+			reply, _, err := s.lookupTrusted(ctx, req.Copy(), server)
+			if err == nil && reply.Rcode == dns.RcodeSuccess {
+				ips = append(ips, answerIPs(reply)...)
+				break
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("fail to resolve %s through trusted upstreams", host)
+	}
+	var conn net.Conn
+	for _, ip := range ips {
+		if conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// runChinaListRefresh refreshes the China route list every ChinaListRefresh, until ctx is done.
+func (s *Server) runChinaListRefresh(ctx context.Context) {
+	if s.ChinaListURL == "" || s.ChinaListRefresh <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.ChinaListRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := s.fetchChinaList(ctx); err != nil {
+			logrus.WithError(err).Error("Fail to refresh China route list. Keep using the old one.")
+		}
+	}
+}
+
+// parseChinaList inserts CIDRs in r into ranger. Lines are either CIDRs or records of an APNIC delegated file like
+// apnic|CN|ipv4|1.0.1.0|256|20110414|allocated. Comments and records of other countries are skipped.
+func parseChinaList(ranger cidranger.Ranger, r io.Reader, source string) error {
+	var (
+		arena   = newCIDRArena(0)
+		buf     [net.IPv6len]byte
+		scanner = bufio.NewScanner(r)
+	)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 || text[0] == '#' {
+			continue
+		}
+		if bytes.IndexByte(text, '|') < 0 {
+			ip, ones, ok := parseCIDR(text, &buf)
+			if !ok {
+				_, _, err := net.ParseCIDR(string(text))
+				return fmt.Errorf("parse %s as CIDR failed: %v", text, err.Error())
+			}
+			if err := ranger.Insert(arena.entry(ip, ones, source, line)); err != nil {
+				return fmt.Errorf("insert %s as CIDR failed: %v", text, err.Error())
+			}
+			continue
+		}
+		networks, err := parseAPNICRecord(string(text))
+		if err != nil {
+			return fmt.Errorf("parse %s failed: %v", text, err.Error())
+		}
+		for _, network := range networks {
+			if err := ranger.Insert(newSourcedEntry(network, source, line)); err != nil {
+				return fmt.Errorf("insert %s as CIDR failed: %v", network.String(), err.Error())
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// parseAPNICRecord returns networks of a CN ipv4 or ipv6 record. Other records are ignored.
+// The value of an ipv4 record is the count of addresses, which may span several CIDRs.
+// The value of an ipv6 record is the prefix length.
+func parseAPNICRecord(record string) ([]net.IPNet, error) {
+	fields := strings.Split(record, "|")
+	if len(fields) < 5 || fields[1] != chinaCountryCode || (fields[2] != "ipv4" && fields[2] != "ipv6") {
+		return nil, nil
+	}
+	ip := net.ParseIP(fields[3])
+	value, err := strconv.ParseUint(fields[4], 10, 32)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid record")
+	}
+	if fields[2] == "ipv6" {
+		if value > 128 {
+			return nil, fmt.Errorf("invalid prefix length %d", value)
+		}
+		mask := net.CIDRMask(int(value), 128)
+		return []net.IPNet{{IP: ip.Mask(mask), Mask: mask}}, nil
+	}
+
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("invalid IPv4 address %s", fields[3])
+	}
+	start, count := uint64(ip4[0])<<24|uint64(ip4[1])<<16|uint64(ip4[2])<<8|uint64(ip4[3]), value
+	if start+count > 1<<32 {
+		return nil, fmt.Errorf("address count %d overflows", count)
+	}
+	var networks []net.IPNet
+	for count > 0 {
+		// The largest block aligned at start and no larger than count.
+		size := uint64(1) << (63 - bits.LeadingZeros64(count))
+		if start != 0 {
+			if align := start & -start; align < size {
+				size = align
+			}
+		}
+		ones := 32 - bits.TrailingZeros64(size)
+		networks = append(networks, net.IPNet{
+			IP:   net.IPv4(byte(start>>24), byte(start>>16), byte(start>>8), byte(start)).To4(),
+			Mask: net.CIDRMask(ones, 32),
+		})
+		start += size
+		count -= size
+	}
+	return networks, nil
+}
@@ -0,0 +1,106 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseAPNICRecord(t *testing.T) {
+	tests := []struct {
+		record string
+		want   []string
+	}{
+		{"apnic|CN|ipv4|1.0.8.0|2048|20110412|allocated", []string{"1.0.8.0/21"}},
+		{"apnic|CN|ipv4|1.0.1.0|768|20110414|allocated", []string{"1.0.1.0/24", "1.0.2.0/23"}},
+		{"apnic|CN|ipv6|2001:250::|35|20000426|allocated", []string{"2001:250::/35"}},
+		{"apnic|JP|ipv4|1.0.16.0|4096|20110412|allocated", nil},
+		{"apnic|CN|asn|4134|1|20020801|allocated", nil},
+		{"apnic|*|ipv4|*|45000|summary", nil},
+	}
+	for _, tt := range tests {
+		networks, err := parseAPNICRecord(tt.record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, n := range networks {
+			got = append(got, n.String())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseAPNICRecord(%s) = %v, want %v", tt.record, got, tt.want)
+		}
+	}
+}
+
+func TestFetchChinaList(t *testing.T) {
+	list := "# China route list\n1.0.1.0/24\n"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(list))
+	}))
+	defer ts.Close()
+
+	o := newServerOptions()
+	if err := WithCHNListURL(ts.URL, 0)(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o}
+	if err := s.fetchChinaList(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.isChinaIP(context.Background(), net.ParseIP("1.0.1.1")); !ok {
+		t.Error("Downloaded China route list should be used")
+	}
+
+	list = "apnic|CN|ipv4|1.0.8.0|2048|20110412|allocated\n"
+	if err := s.fetchChinaList(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.isChinaIP(context.Background(), net.ParseIP("1.0.1.1")); ok {
+		t.Error("China route list should be swapped on refresh")
+	}
+	if ok, _ := s.isChinaIP(context.Background(), net.ParseIP("1.0.8.1")); !ok {
+		t.Error("APNIC delegated file should be parsed")
+	}
+
+	list = "apnic|JP|ipv4|1.0.16.0|4096|20110412|allocated\n"
+	if err := s.fetchChinaList(context.Background()); err == nil {
+		t.Error("Empty China route list should fail")
+	}
+	if ok, _ := s.isChinaIP(context.Background(), net.ParseIP("1.0.8.1")); !ok {
+		t.Error("China route list should be kept on failure")
+	}
+
+	// The host of the URL is resolved through trusted upstreams.
+	list = "1.0.1.0/24\n"
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	if err := WithCHNListURL("http://lists.example:"+port+"/china.list", 0)(o); err != nil {
+		t.Fatal(err)
+	}
+	var resolved int
+	trusted := NewUpstreamResolver("trusted", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+		resolved++
+		if req.Question[0].Qtype == dns.TypeA && req.Question[0].Name == "lists.example." {
+			return newTestReply("lists.example", 60, "127.0.0.1"), 0, nil
+		}
+		m := new(dns.Msg)
+		return m.SetReply(req), 0, nil
+	}))
+	if err := WithUpstreams(true, trusted)(o); err != nil {
+		t.Fatal(err)
+	}
+	s = &Server{serverOptions: o, Client: NewClient()}
+	s.partitionResolvers()
+	if err := s.fetchChinaList(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.isChinaIP(context.Background(), net.ParseIP("1.0.1.1")); !ok || resolved == 0 {
+		t.Errorf("China route list should be downloaded from the host resolved by trusted upstreams, resolved %d times", resolved)
+	}
+}
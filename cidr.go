@@ -0,0 +1,132 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+
+	"github.com/yl2chen/cidranger"
+)
+
+// Names of CIDR lists.
+const (
+	ListChina        = "china"
+	ListChina6       = "china6"
+	ListChinaExclude = "china-exclude"
+	ListIPBlacklist  = "ip-blacklist"
+	ListGeoIP        = "geoip"
+	ListCanary       = "canary"    // poisoned IPs learned from canary domains
+	ListChinaURL     = "china-url" // China route list downloaded from a URL
+)
+
+// sourcedEntry is a ranger entry remembering where it comes from.
+type sourcedEntry struct {
+	network net.IPNet
+	source  string
+	line    int
+}
+
+func newSourcedEntry(network net.IPNet, source string, line int) cidranger.RangerEntry {
+	return &sourcedEntry{network: network, source: source, line: line}
+}
+
+func (e *sourcedEntry) Network() net.IPNet {
+	return e.network
+}
+
+// CIDRMatch is a prefix matching an IP, along with the source file and line contributing it.
+type CIDRMatch struct {
+	Network string `json:"network"`
+	Source  string `json:"source,omitempty"`
+	Line    int    `json:"line,omitempty"`
+}
+
+// IPClassification describes how an IP is classified by CIDR lists.
+type IPClassification struct {
+	IP          string                 `json:"ip"`
+	China       bool                   `json:"china"`
+	Blacklisted bool                   `json:"blacklisted"`
+	Embedded    string                 `json:"embedded,omitempty"` // IPv4 address embedded in the IPv6 one, which lists are checked by
+	Country     string                 `json:"country,omitempty"`  // country located by the GeoIP provider if any
+	ASN         uint32                 `json:"asn,omitempty"`      // autonomous system located by the GeoIP provider if any
+	Matches     map[string][]CIDRMatch `json:"matches"`            // matching prefixes indexed by list name
+}
+
+// ClassifyIP checks ip against all CIDR lists, to debug misclassification.
+// An IPv6 address embedding an IPv4 address (see embeddedIPv4) is checked by the IPv4 address.
+func (s *Server) ClassifyIP(ip net.IP) (*IPClassification, error) {
+	c := &IPClassification{
+		IP:      ip.String(),
+		Matches: make(map[string][]CIDRMatch),
+	}
+	if ip4 := embeddedIPv4(ip); ip4 != nil && ip.To4() == nil {
+		c.Embedded = ip4.String()
+		ip = ip4
+	}
+	s.listsMu.RLock()
+	lists := []struct {
+		name   string
+		ranger cidranger.Ranger
+	}{
+		{ListChina, s.ChinaCIDR},
+		{ListChinaURL, s.chinaRemote},
+		{ListChina6, s.ChinaCIDR6},
+		{ListChinaExclude, s.ChinaCIDRExclude},
+		{ListIPBlacklist, s.IPBlacklist},
+	}
+	geo, _ := s.ChinaBackend.(*geoMatcher)
+	s.listsMu.RUnlock()
+	for _, l := range lists {
+		if l.ranger == nil {
+			continue
+		}
+		matches, err := containingCIDRs(l.ranger, ip)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) > 0 {
+			c.Matches[l.name] = matches
+		}
+	}
+
+	if geo != nil {
+		info, err := geo.provider.Locate(context.Background(), ip)
+		if err != nil {
+			return nil, err
+		}
+		c.Country, c.ASN = info.Country, info.ASN
+		if info.Country == geo.country {
+			m := CIDRMatch{Network: ip.String(), Source: info.Source}
+			if info.Network != nil {
+				m.Network = info.Network.String()
+			}
+			c.Matches[ListGeoIP] = []CIDRMatch{m}
+		}
+	}
+
+	var err error
+	if c.China, err = s.isChinaIP(context.Background(), ip); err != nil {
+		return nil, err
+	}
+	if s.canary.IsPoisoned(ip) {
+		c.Matches[ListCanary] = []CIDRMatch{{Network: ip.String()}}
+	}
+	c.Blacklisted = len(c.Matches[ListIPBlacklist]) > 0 || len(c.Matches[ListCanary]) > 0
+	return c, nil
+}
+
+func containingCIDRs(ranger cidranger.Ranger, ip net.IP) ([]CIDRMatch, error) {
+	entries, err := ranger.ContainingNetworks(ip)
+	if err != nil {
+		return nil, err
+	}
+	matches := make([]CIDRMatch, 0, len(entries))
+	for _, e := range entries {
+		network := e.Network()
+		m := CIDRMatch{Network: network.String()}
+		if se, ok := e.(*sourcedEntry); ok {
+			m.Source, m.Line = se.source, se.line
+		}
+		matches = append(matches, m)
+	}
+	return matches, nil
+}
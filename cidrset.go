@@ -0,0 +1,212 @@
+package gochinadns
+
+import (
+	"encoding/binary"
+	"net"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yl2chen/cidranger"
+)
+
+var (
+	allIPv4 = net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}
+	allIPv6 = net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(0, 128)}
+)
+
+// cidrSet is an immutable set of IP ranges compiled from a CIDR ranger, checked by binary search.
+// It's safe for concurrent use without locks. A nil set is empty.
+type cidrSet struct {
+	v4 []v4Range // sorted and merged, so that ranges neither overlap nor adjoin
+	v6 []v6Range
+
+	ranger cidranger.Ranger // checked instead if it can't be compiled
+}
+
+type v4Range struct{ lo, hi uint32 }
+
+// uint128 is an IPv6 address as an integer.
+type uint128 struct{ hi, lo uint64 }
+
+func (a uint128) less(b uint128) bool {
+	return a.hi < b.hi || a.hi == b.hi && a.lo < b.lo
+}
+
+// next returns a+1, which wraps around at the max.
+func (a uint128) next() uint128 {
+	if a.lo++; a.lo == 0 {
+		a.hi++
+	}
+	return a
+}
+
+type v6Range struct{ lo, hi uint128 }
+
+// newCIDRSet compiles networks of ranger into a set, or returns nil if ranger is nil.
+func newCIDRSet(ranger cidranger.Ranger) *cidrSet {
+	if ranger == nil {
+		return nil
+	}
+	s := new(cidrSet)
+	entries4, err := ranger.CoveredNetworks(allIPv4)
+	if err == nil {
+		var entries6 []cidranger.RangerEntry
+		if entries6, err = ranger.CoveredNetworks(allIPv6); err == nil {
+			s.v4 = compileV4(entries4)
+			s.v6 = compileV6(entries6)
+			return s
+		}
+	}
+	logrus.WithError(err).Warn("Fail to compile a CIDR list. Check it by the ranger.")
+	return &cidrSet{ranger: ranger}
+}
+
+func compileV4(entries []cidranger.RangerEntry) []v4Range {
+	ranges := make([]v4Range, 0, len(entries))
+	for _, e := range entries {
+		network := e.Network()
+		ip := network.IP.To4()
+		if ip == nil || len(network.Mask) != net.IPv4len {
+			continue
+		}
+		lo := binary.BigEndian.Uint32(ip) & binary.BigEndian.Uint32(network.Mask)
+		ranges = append(ranges, v4Range{lo: lo, hi: lo | ^binary.BigEndian.Uint32(network.Mask)})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].lo < ranges[j].lo })
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && (r.lo <= merged[n-1].hi || r.lo == merged[n-1].hi+1) {
+			if r.hi > merged[n-1].hi {
+				merged[n-1].hi = r.hi
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func compileV6(entries []cidranger.RangerEntry) []v6Range {
+	ranges := make([]v6Range, 0, len(entries))
+	for _, e := range entries {
+		network := e.Network()
+		if len(network.IP) != net.IPv6len || len(network.Mask) != net.IPv6len || network.IP.To4() != nil {
+			continue
+		}
+		ip, mask := toUint128(network.IP), toUint128(net.IP(network.Mask))
+		lo := uint128{hi: ip.hi & mask.hi, lo: ip.lo & mask.lo}
+		ranges = append(ranges, v6Range{lo: lo, hi: uint128{hi: lo.hi | ^mask.hi, lo: lo.lo | ^mask.lo}})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].lo.less(ranges[j].lo) })
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && (!merged[n-1].hi.less(r.lo) || merged[n-1].hi.next() == r.lo) {
+			if merged[n-1].hi.less(r.hi) {
+				merged[n-1].hi = r.hi
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func toUint128(ip net.IP) uint128 {
+	return uint128{hi: binary.BigEndian.Uint64(ip[:8]), lo: binary.BigEndian.Uint64(ip[8:])}
+}
+
+// Has tells whether ip is in s.
+func (s *cidrSet) Has(ip net.IP) bool {
+	if s == nil {
+		return false
+	}
+	if s.ranger != nil {
+		contain, _ := s.ranger.Contains(ip)
+		return contain
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		v := binary.BigEndian.Uint32(ip4)
+		// The first range ending at or after v is the only one which may contain v.
+		i := sort.Search(len(s.v4), func(i int) bool { return s.v4[i].hi >= v })
+		return i < len(s.v4) && s.v4[i].lo <= v
+	}
+	if len(ip) != net.IPv6len {
+		return false
+	}
+	v := toUint128(ip)
+	i := sort.Search(len(s.v6), func(i int) bool { return !s.v6[i].hi.less(v) })
+	return i < len(s.v6) && !v.less(s.v6[i].lo)
+}
+
+// Overlaps tells whether any IP of network is in s.
+func (s *cidrSet) Overlaps(network *net.IPNet) bool {
+	if s == nil {
+		return false
+	}
+	if s.ranger != nil {
+		if contain, _ := s.ranger.Contains(network.IP); contain {
+			return true
+		}
+		covered, _ := s.ranger.CoveredNetworks(*network)
+		return len(covered) > 0
+	}
+	if ip4 := network.IP.To4(); ip4 != nil && len(network.Mask) == net.IPv4len {
+		lo := binary.BigEndian.Uint32(ip4) & binary.BigEndian.Uint32(network.Mask)
+		hi := lo | ^binary.BigEndian.Uint32(network.Mask)
+		// The first range ending at or after lo is the only one which may start before hi.
+		i := sort.Search(len(s.v4), func(i int) bool { return s.v4[i].hi >= lo })
+		return i < len(s.v4) && s.v4[i].lo <= hi
+	}
+	if len(network.IP) != net.IPv6len || len(network.Mask) != net.IPv6len {
+		return false
+	}
+	ip, mask := toUint128(network.IP), toUint128(net.IP(network.Mask))
+	lo := uint128{hi: ip.hi & mask.hi, lo: ip.lo & mask.lo}
+	hi := uint128{hi: lo.hi | ^mask.hi, lo: lo.lo | ^mask.lo}
+	i := sort.Search(len(s.v6), func(i int) bool { return !s.v6[i].hi.less(lo) })
+	return i < len(s.v6) && !hi.less(s.v6[i].lo)
+}
+
+// Len returns the number of merged ranges in s.
+func (s *cidrSet) Len() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.v4) + len(s.v6)
+}
+
+// cidrMatchers are CIDR lists of a server compiled into sets, which are swapped at once when lists change,
+// so that answers are checked without locks.
+type cidrMatchers struct {
+	china     *cidrSet
+	remote    *cidrSet // downloaded from ChinaListURL
+	china6    *cidrSet // nil unless the IPv6 China route list is loaded
+	exclude   *cidrSet
+	blacklist *cidrSet
+	backend   IPMatcher // ChinaBackend
+}
+
+// compileMatchers compiles the current CIDR lists. s.listsMu must be held.
+func (s *Server) compileMatchers() *cidrMatchers {
+	return &cidrMatchers{
+		china:     newCIDRSet(s.ChinaCIDR),
+		remote:    newCIDRSet(s.chinaRemote),
+		china6:    newCIDRSet(s.ChinaCIDR6),
+		exclude:   newCIDRSet(s.ChinaCIDRExclude),
+		blacklist: newCIDRSet(s.IPBlacklist),
+		backend:   s.ChinaBackend,
+	}
+}
+
+// loadMatchers returns the compiled CIDR lists, compiling them if they're not yet.
+func (s *Server) loadMatchers() *cidrMatchers {
+	if m, _ := s.matchers.Load().(*cidrMatchers); m != nil {
+		return m
+	}
+	s.listsMu.RLock()
+	defer s.listsMu.RUnlock()
+	// Stored under the lock, so that lists switched in the meantime are not overwritten by stale ones.
+	m := s.compileMatchers()
+	s.matchers.Store(m)
+	return m
+}
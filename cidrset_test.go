@@ -0,0 +1,65 @@
+package gochinadns
+
+import (
+	"math/rand"
+	"net"
+	"testing"
+
+	"github.com/yl2chen/cidranger"
+)
+
+func TestCIDRSet(t *testing.T) {
+	ranger := cidranger.NewPCTrieRanger()
+	for _, cidr := range []string{
+		"1.0.1.0/24", "1.0.2.0/23", "1.0.1.128/25", // nested and adjoining
+		"10.0.0.0/8", "255.255.255.255/32", "0.0.0.0/32",
+		"240e::/20", "240e:1::/32", "2400:da00::/32", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff/128",
+	} {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ranger.Insert(cidranger.NewBasicRangerEntry(*network)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newCIDRSet(ranger)
+	if s.Len() != 7 {
+		t.Errorf("Adjoining and nested networks should be merged, got %d ranges: %v %v", s.Len(), s.v4, s.v6)
+	}
+
+	for ip, want := range map[string]bool{
+		"1.0.0.255": false, "1.0.1.0": true, "1.0.3.255": true, "1.0.4.0": false,
+		"10.255.255.255": true, "11.0.0.0": false, "255.255.255.255": true, "0.0.0.0": true, "0.0.0.1": false,
+		"240e:fff:ffff::1": true, "2410::": false, "2400:da00:ffff::": true, "::1": false,
+		"ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff": true,
+	} {
+		if got := s.Has(net.ParseIP(ip)); got != want {
+			t.Errorf("Has(%s) = %v, want %v", ip, got, want)
+		}
+	}
+
+	// Random IPs are matched like the ranger.
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		ip := make(net.IP, net.IPv4len)
+		if i%2 == 1 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		rnd.Read(ip)
+		if i%4 == 0 {
+			copy(ip, []byte{1, 0})
+		} else if i%4 == 3 {
+			copy(ip, []byte{0x24, 0x0e})
+		}
+		want, _ := ranger.Contains(ip)
+		if got := s.Has(ip); got != want {
+			t.Fatalf("Has(%s) = %v, but the ranger contains it: %v", ip, got, want)
+		}
+	}
+
+	var empty *cidrSet
+	if empty.Has(net.ParseIP("1.0.1.1")) || newCIDRSet(nil) != nil {
+		t.Error("Nil set should be empty")
+	}
+}
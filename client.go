@@ -1,18 +1,30 @@
 package gochinadns
 
 import (
+	"context"
+	"io"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 
 	"github.com/cherrot/gochinadns/doh"
+	"github.com/cherrot/gochinadns/dot"
+	"github.com/cherrot/gochinadns/proxy"
 )
 
+// dnsTimeout is the timeout of a query if Timeout is not set, the same as that of dns.Client.
+const dnsTimeout = 2 * time.Second
+
 type Client struct {
 	*clientOptions
 	UDPCli *dns.Client
 	TCPCli *dns.Client
 	DoHCli *doh.Client
+	DoTCli *dot.Client
+
+	tcpPool *tcpPool // persistent TCP connections to upstreams
+	timed   sync.Map // clients of other timeouts by timeout, see withTimeout
 }
 
 func NewClient(opts ...ClientOption) *Client {
@@ -20,15 +32,168 @@ func NewClient(opts ...ClientOption) *Client {
 	for _, f := range opts {
 		f(o)
 	}
-	return &Client{
+	return newClient(o)
+}
+
+func newClient(o *clientOptions) *Client {
+	dohOpts := []doh.ClientOption{
+		doh.WithTimeout(o.Timeout),
+		doh.WithSkipQueryMySelf(o.DoHSkipQuerySelf),
+	}
+	c := &Client{
 		clientOptions: o,
 		UDPCli:        &dns.Client{Timeout: o.Timeout, Net: "udp"},
 		TCPCli:        &dns.Client{Timeout: o.Timeout, Net: "tcp"},
-		DoHCli: doh.NewClient(
-			doh.WithTimeout(o.Timeout),
-			doh.WithSkipQueryMySelf(o.DoHSkipQuerySelf),
-		),
 	}
+	// DoT connections are always dialed by the client, so that their events are emitted. DoH connections are traced
+	// by httptrace instead, see withDoHTrace.
+	dotOpts := []dot.ClientOption{dot.WithTimeout(o.Timeout), dot.WithDialContext(c.dialContext), dot.WithTrace(c.dotTrace())}
+	if o.Dial != nil {
+		dohOpts = append(dohOpts, doh.WithDialContext(o.Dial))
+	} else if o.DialContext != nil {
+		dohOpts = append(dohOpts, doh.WithDialContext(o.DialContext))
+	}
+	c.DoHCli = doh.NewClient(dohOpts...)
+	c.DoTCli = dot.NewClient(dotOpts...)
+	c.tcpPool = newTCPPool(c.dialTCP)
+	c.tcpPool.onReuse = func(addr string) {
+		c.emitConn(&ConnEvent{Phase: ConnReused, Network: "tcp", Addr: addr})
+	}
+	return c
+}
+
+// withTimeout returns a client like c, with queries timing out after timeout instead, which shares pooled TCP, DoT and
+// DoH connections with c. It returns c if timeout is 0.
+func (c *Client) withTimeout(timeout time.Duration) *Client {
+	if timeout <= 0 || timeout == c.Timeout {
+		return c
+	}
+	if tc, ok := c.timed.Load(timeout); ok {
+		return tc.(*Client)
+	}
+	o := *c.clientOptions
+	o.Timeout = timeout
+	tc := &Client{
+		clientOptions: &o,
+		UDPCli:        &dns.Client{Timeout: timeout, Net: "udp"},
+		TCPCli:        &dns.Client{Timeout: timeout, Net: "tcp"},
+		DoHCli:        c.DoHCli.WithTimeout(timeout),
+		DoTCli:        c.DoTCli.WithTimeout(timeout),
+		tcpPool:       c.tcpPool,
+	}
+	actual, _ := c.timed.LoadOrStore(timeout, tc)
+	return actual.(*Client)
+}
+
+// dialTCP connects to addr over TCP, through the proxy if Dial is set.
+func (c *Client) dialTCP(addr string) (*dns.Conn, error) {
+	conn, err := c.dialTimeout("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// exchangeUDP sends req to addr over UDP, until ctx is done.
+func (c *Client) exchangeUDP(ctx context.Context, req *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	return exchangeContext(ctx, c.UDPCli, c.dialUDP, req, addr)
+}
+
+// exchangeTCP sends req to addr over a pooled TCP connection, through the proxy if Dial is set, until ctx is done.
+func (c *Client) exchangeTCP(ctx context.Context, req *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	t := time.Now()
+	raw, buf, err := packMsg(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer putBuffer(buf)
+	reply, err := c.exchangeTCPRaw(ctx, req, raw, addr)
+	return reply, time.Since(t), err
+}
+
+// exchangeTCPRaw sends req packed in raw, which may be mutated, to addr over a pooled TCP connection, and returns its
+// reply if it's valid (see validateReply).
+func (c *Client) exchangeTCPRaw(ctx context.Context, req *dns.Msg, raw []byte, addr string) (*dns.Msg, error) {
+	timeout := c.TCPCli.Timeout
+	if timeout <= 0 {
+		timeout = dnsTimeout
+	}
+	b, err := c.tcpPool.exchange(ctx, raw, addr, time.Now().Add(timeout))
+	if err != nil {
+		return nil, err
+	}
+	reply := new(dns.Msg)
+	if err = reply.Unpack(b); err != nil {
+		return nil, err
+	}
+	if err = validateReply(req, reply, replyCheckFromContext(ctx)); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// exchangeContext sends req by cli over a connection to addr dialed by dial. The connection is closed once ctx is
+// done, so that a query given up doesn't hold a socket until the timeout. Replies are validated by readValidReply,
+// along with the check of ctx if any (see withReplyCheck).
+func exchangeContext(ctx context.Context, cli *dns.Client, dial func(string) (*dns.Conn, error), req *dns.Msg, addr string) (*dns.Msg, time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	t := time.Now()
+	conn, err := dial(addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+	reply, _, err := cli.ExchangeWithConn(req, conn)
+	if err == nil {
+		reply, err = readValidReply(conn, req, reply, replyCheckFromContext(ctx))
+	}
+	if err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return reply, time.Since(t), err
+}
+
+// closeOnDone closes conn once ctx is done, until the returned function is called.
+func closeOnDone(ctx context.Context, conn io.Closer) (stop func()) {
+	done := ctx.Done()
+	if done == nil {
+		return func() {}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-done:
+			_ = conn.Close()
+		case <-stopped:
+		}
+	}()
+	return func() { close(stopped) }
+}
+
+// protocolsOf returns protocols to query server with. UDP is replaced by TCP if queries go through a proxy.
+func (c *Client) protocolsOf(server *Resolver) []string {
+	protocols := server.protocols()
+	if c.Dial == nil {
+		return protocols
+	}
+	result := make([]string, 0, len(protocols))
+	seen := make(map[string]bool, len(protocols))
+	for _, p := range protocols {
+		if p == "udp" {
+			p = "tcp"
+		}
+		if !seen[p] {
+			seen[p] = true
+			result = append(result, p)
+		}
+	}
+	return result
 }
 
 type clientOptions struct {
@@ -37,6 +202,13 @@ type clientOptions struct {
 	TCPOnly          bool          // Use TCP only
 	Mutation         bool          // Enable DNS pointer mutation for trusted servers
 	DoHSkipQuerySelf bool
+	Padding          bool           // Pad queries over DoT and DoH (RFC 7830)
+	Dial             proxy.DialFunc // Dial TCP connections through a proxy if set. UDP is replaced by TCP then.
+	DialContext      proxy.DialFunc // Dial connections of all transports if set, see WithDialContext
+	MaxReplySize     int            // Max packed size of replies of upstreams. Disabled if 0.
+	MaxAdditional    int            // Max additional records (besides OPT) of replies of upstreams. Disabled if 0.
+
+	ConnObservers []func(*ConnEvent) // Called on lifecycle events of connections to upstreams
 }
 
 type ClientOption func(*clientOptions)
@@ -70,3 +242,11 @@ func WithDoHSkipQuerySelf(skip bool) ClientOption {
 		o.DoHSkipQuerySelf = skip
 	}
 }
+
+// WithDialer makes TCP, DoT and DoH queries through dial, which is usually created by proxy.New.
+// Since proxies don't relay UDP, UDP queries are sent over TCP instead.
+func WithDialer(dial proxy.DialFunc) ClientOption {
+	return func(o *clientOptions) {
+		o.Dial = dial
+	}
+}
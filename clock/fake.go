@@ -0,0 +1,134 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a clock for tests, whose time only moves by Advance. Timers and tickers fire when the time passes them.
+// Channels of timers and tickers are buffered by one like those of package time, and ticks are dropped if not
+// received in time.
+type Fake struct {
+	mu      sync.Mutex
+	cond    *sync.Cond // broadcast when timers are added or removed
+	now     time.Time
+	waiters []*fakeWaiter // pending timers and tickers
+}
+
+// NewFake returns a fake clock starting at now.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// Now implements Clock.
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// NewTimer implements Clock. A timer of a non-positive duration fires on the next Advance.
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	return fakeTimer{f.add(d, 0)}
+}
+
+// NewTicker implements Clock.
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	return fakeTicker{f.add(d, d)}
+}
+
+func (f *Fake) add(d, period time.Duration) *fakeWaiter {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := &fakeWaiter{f: f, c: make(chan time.Time, 1), at: f.now.Add(d), period: period}
+	f.waiters = append(f.waiters, w)
+	f.cond.Broadcast()
+	return w
+}
+
+// Advance moves the time forward by d, firing timers and tickers due in order of their times.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	end := f.now.Add(d)
+	for {
+		var next *fakeWaiter
+		for _, w := range f.waiters {
+			if !w.at.After(end) && (next == nil || w.at.Before(next.at)) {
+				next = w
+			}
+		}
+		if next == nil {
+			break
+		}
+		f.now = next.at
+		select {
+		case next.c <- f.now:
+		default:
+		}
+		if next.period > 0 {
+			next.at = next.at.Add(next.period)
+		} else {
+			f.remove(next)
+		}
+	}
+	f.now = end
+}
+
+// Waiters returns the number of pending timers and tickers.
+func (f *Fake) Waiters() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.waiters)
+}
+
+// BlockUntil blocks until there are at least n pending timers and tickers, e.g. until goroutines under test
+// start waiting, before advancing the time.
+func (f *Fake) BlockUntil(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+}
+
+// remove removes w from pending waiters. It returns false if w is not pending. f.mu must be held.
+func (f *Fake) remove(w *fakeWaiter) bool {
+	for i, pending := range f.waiters {
+		if pending == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			f.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
+
+// fakeWaiter is a timer or a ticker of a fake clock.
+type fakeWaiter struct {
+	f      *Fake
+	c      chan time.Time
+	at     time.Time     // when it fires next
+	period time.Duration // 0 for timers
+}
+
+func (w *fakeWaiter) C() <-chan time.Time { return w.c }
+
+func (w *fakeWaiter) stop() bool {
+	w.f.mu.Lock()
+	defer w.f.mu.Unlock()
+	return w.f.remove(w)
+}
+
+type fakeTimer struct{ *fakeWaiter }
+
+func (t fakeTimer) Stop() bool { return t.stop() }
+
+type fakeTicker struct{ *fakeWaiter }
+
+func (t fakeTicker) Stop() { t.stop() }
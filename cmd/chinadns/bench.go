@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/cherrot/gochinadns"
+)
+
+// Roles of upstreams suggested by the bench subcommand.
+const (
+	benchTrusted     = "trusted"     // canary domains are answered without poisoned IPs
+	benchUntrusted   = "untrusted"   // canary domains are answered with poisoned IPs
+	benchUnknown     = "unknown"     // no canary domain is answered
+	benchUnreachable = "unreachable" // no query is answered
+)
+
+// benchResult is a result of the bench subcommand in JSON output, of an upstream over a transport.
+type benchResult struct {
+	Server   string  `json:"server"`
+	Group    string  `json:"group"` // trusted or untrusted, as configured
+	Queries  int     `json:"queries"`
+	Answered int     `json:"answered"`
+	MinRTT   float64 `json:"min_rtt_ms"`
+	AvgRTT   float64 `json:"avg_rtt_ms"`
+	MaxRTT   float64 `json:"max_rtt_ms"`
+	China    int     `json:"china"`    // answers of test domains with IPs in China
+	Tested   int     `json:"tested"`   // answers of test domains
+	Poisoned int     `json:"poisoned"` // answers of canary domains with IPs in China or blacklisted
+	Canaries int     `json:"canaries"` // answers of canary domains
+	Role     string  `json:"role"`     // suggested role: trusted, untrusted, unknown or unreachable
+	Errors   int     `json:"errors"`
+}
+
+// runBench queries test domains (args, or -test-domains) and canary domains (-canary-domains, or well-known poisoned
+// ones) -bench-count times through each upstream over each of its transports, one upstream after another, and prints
+// a line of each, ordered by suggested role and latency:
+//
+//	<server> (<group>): answered <n>/<queries>, rtt <min>/<avg>/<max>, china <n>/<tested>, poisoned <n>/<canaries>, role <role>
+//
+// or benchResult in JSON output. Answers of test domains in China make good untrusted servers, while those answering
+// canary domains without poisoned IPs can be trusted. It returns 2 on usage error, and 1 if no upstream is reachable.
+func runBench(args []string) int {
+	if *flagBenchCount <= 0 {
+		fmt.Fprintln(os.Stderr, tr("Usage: chinadns [options] bench [-bench-count N] [DOMAIN...]\n"+
+			"Upstreams are those of -s and -trusted-servers, and domains are -test-domains if not given."))
+		return 2
+	}
+	domains := args
+	if len(domains) == 0 {
+		domains = strings.Split(*flagTestDomains, ",")
+	}
+	canaries := doctorPoisonedDomains
+	if *flagCanaryDomains != "" {
+		canaries = strings.Split(*flagCanaryDomains, ",")
+	}
+
+	opts := append(serverOptions(), gochinadns.WithSkipRefineResolvers(true))
+	client := gochinadns.NewClient(clientOptions()...)
+	server, err := gochinadns.NewServer(client, opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var (
+		resolvers []*gochinadns.Resolver
+		groups    []string
+	)
+	for _, g := range []struct {
+		name      string
+		resolvers []*gochinadns.Resolver
+	}{{"untrusted", server.UntrustedServers}, {"trusted", server.TrustedServers}} {
+		for _, r := range g.resolvers {
+			for _, t := range splitTransports(r) {
+				resolvers, groups = append(resolvers, t), append(groups, g.name)
+			}
+		}
+	}
+
+	// Upstreams are benched one after another too, so that they don't compete for the uplink.
+	benches := make([]*benchResult, len(resolvers))
+	for i, r := range resolvers {
+		benches[i] = bench(server, client, r, domains, canaries)
+		benches[i].Group = groups[i]
+	}
+	roles := map[string]int{benchTrusted: 0, benchUntrusted: 0, benchUnknown: 1, benchUnreachable: 2}
+	sort.SliceStable(benches, func(i, j int) bool {
+		a, b := benches[i], benches[j]
+		if roles[a.Role] != roles[b.Role] {
+			return roles[a.Role] < roles[b.Role]
+		}
+		return a.AvgRTT < b.AvgRTT
+	})
+
+	results := newCommandResults("bench")
+	reachable := false
+	for _, b := range benches {
+		results.Add(b, formatBench(b))
+		reachable = reachable || b.Answered > 0
+	}
+	if code := results.Print(); code != 0 || reachable {
+		return code
+	}
+	return 1
+}
+
+// bench queries domains and canaries through r one after another, so that latency is not skewed by concurrency.
+func bench(server *gochinadns.Server, client *gochinadns.Client, r *gochinadns.Resolver, domains, canaries []string) *benchResult {
+	b := &benchResult{Server: r.String()}
+	var total time.Duration
+	query := func(domain string) *dns.Msg {
+		b.Queries++
+		reply, rtt, err := lookupA(client, r, domain)
+		if err != nil {
+			b.Errors++
+			return nil
+		}
+		b.Answered++
+		total += rtt
+		ms := float64(rtt) / float64(time.Millisecond)
+		if b.MinRTT == 0 || ms < b.MinRTT {
+			b.MinRTT = ms
+		}
+		if ms > b.MaxRTT {
+			b.MaxRTT = ms
+		}
+		return reply
+	}
+	for i := 0; i < *flagBenchCount; i++ {
+		for _, domain := range domains {
+			if reply := query(domain); reply != nil {
+				b.Tested++
+				if answeredInChina(server, reply) {
+					b.China++
+				}
+			}
+		}
+		for _, domain := range canaries {
+			if reply := query(domain); reply != nil {
+				b.Canaries++
+				if poisonedIP(server, reply) != "" {
+					b.Poisoned++
+				}
+			}
+		}
+	}
+	if b.Answered > 0 {
+		b.AvgRTT = float64(total) / float64(b.Answered) / float64(time.Millisecond)
+	}
+	switch {
+	case b.Answered == 0:
+		b.Role = benchUnreachable
+	case b.Canaries == 0:
+		b.Role = benchUnknown
+	case b.Poisoned > 0:
+		b.Role = benchUntrusted
+	default:
+		b.Role = benchTrusted
+	}
+	return b
+}
+
+// splitTransports returns r queried over each of its transports, with UDP and TCP of plain DNS separated.
+func splitTransports(r *gochinadns.Resolver) []*gochinadns.Resolver {
+	var resolvers []*gochinadns.Resolver
+	for _, proto := range r.GetProtocols() {
+		if proto != "udp" && proto != "tcp" {
+			resolvers = append(resolvers, r)
+			continue
+		}
+		if t, err := gochinadns.ParseResolver(proto+"@"+r.GetAddr(), false); err == nil {
+			resolvers = append(resolvers, t)
+		}
+	}
+	return resolvers
+}
+
+// answeredInChina tells whether any IP in the answer of reply is located in China.
+func answeredInChina(server *gochinadns.Server, reply *dns.Msg) bool {
+	for _, rr := range reply.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			if c, err := server.ClassifyIP(a.A); err == nil && c.China {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func formatBench(b *benchResult) string {
+	ms := func(v float64) string {
+		return time.Duration(v * float64(time.Millisecond)).Round(time.Millisecond).String()
+	}
+	return tr("%s (%s): answered %d/%d, rtt %s/%s/%s, china %d/%d, poisoned %d/%d, role %s",
+		b.Server, b.Group, b.Answered, b.Queries, ms(b.MinRTT), ms(b.AvgRTT), ms(b.MaxRTT),
+		b.China, b.Tested, b.Poisoned, b.Canaries, b.Role)
+}
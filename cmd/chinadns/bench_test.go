@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/cherrot/gochinadns"
+)
+
+func TestBenchRoles(t *testing.T) {
+	setFlag(t, "bench-count", "2")
+	server := newDoctorServer(t)
+	client := gochinadns.NewClient()
+	domains, canaries := []string{"www.qq.com"}, []string{"www.google.com"}
+
+	tests := []struct {
+		upstream *gochinadns.Resolver
+		want     benchResult
+	}{
+		{fakeUpstream("china", map[string]string{"www.qq.com.": "1.0.1.1", "www.google.com.": "1.0.1.2"}),
+			benchResult{Queries: 4, Answered: 4, China: 2, Tested: 2, Poisoned: 2, Canaries: 2, Role: benchUntrusted}},
+		{fakeUpstream("overseas", map[string]string{"www.qq.com.": "142.250.1.1", "www.google.com.": "142.250.1.2"}),
+			benchResult{Queries: 4, Answered: 4, Tested: 2, Canaries: 2, Role: benchTrusted}},
+		{fakeUpstream("blacklisted", map[string]string{"www.qq.com.": "142.250.1.1", "www.google.com.": "8.7.198.45"}),
+			benchResult{Queries: 4, Answered: 4, Tested: 2, Poisoned: 2, Canaries: 2, Role: benchUntrusted}},
+		{fakeUpstream("no-canary", map[string]string{"www.qq.com.": "1.0.1.1"}),
+			benchResult{Queries: 4, Answered: 2, China: 2, Tested: 2, Role: benchUnknown, Errors: 2}},
+		{fakeUpstream("broken", nil),
+			benchResult{Queries: 4, Role: benchUnreachable, Errors: 4}},
+	}
+	for _, tt := range tests {
+		b := bench(server, client, tt.upstream, domains, canaries)
+		if b.Server != tt.upstream.String() {
+			t.Errorf("Unexpected server %s of %s", b.Server, tt.upstream)
+		}
+		if (b.Answered > 0) != (b.MinRTT > 0 && b.MinRTT <= b.AvgRTT && b.AvgRTT <= b.MaxRTT) {
+			t.Errorf("%s: unexpected RTTs %v/%v/%v", tt.upstream, b.MinRTT, b.AvgRTT, b.MaxRTT)
+		}
+		b.Server, b.MinRTT, b.AvgRTT, b.MaxRTT = "", 0, 0, 0
+		if *b != tt.want {
+			t.Errorf("%s: got %+v, want %+v", tt.upstream, *b, tt.want)
+		}
+	}
+}
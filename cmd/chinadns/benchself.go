@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/cherrot/gochinadns"
+)
+
+// benchRegression is how much slower than its baseline a benchmark may run before it regresses, as benchmarks on
+// busy machines are noisy.
+const benchRegression = 0.2
+
+// runBenchSelf runs canonical benchmarks of hot paths of the server in process (args, or all of
+// gochinadns.SelfBenchmarks), each for about a second, and prints a line of each:
+//
+//	<name>: <ns> ns/op, <bytes> B/op, <allocs> allocs/op (<n> runs)
+//
+// or gochinadns.SelfBenchResult in JSON output. With -bench-baseline, the JSON output of a previous run, benchmarks
+// running slower than their baselines by more than 20% fail. It returns 2 on usage error, and 1 if any benchmark
+// regresses.
+func runBenchSelf(args []string) int {
+	all := gochinadns.SelfBenchmarks()
+	benchmarks := all
+	if len(args) > 0 {
+		byName := make(map[string]gochinadns.SelfBenchmark, len(all))
+		names := make([]string, len(all))
+		for i, bm := range all {
+			byName[bm.Name], names[i] = bm, bm.Name
+		}
+		benchmarks = nil
+		for _, name := range args {
+			bm, ok := byName[name]
+			if !ok {
+				fmt.Fprintln(os.Stderr, tr("Usage: chinadns [options] bench-self [-bench-baseline FILE] [BENCHMARK...]\n"+
+					"Benchmarks are %s.", strings.Join(names, ", ")))
+				return 2
+			}
+			benchmarks = append(benchmarks, bm)
+		}
+	}
+	baseline, err := loadBenchBaseline(*flagBenchBaseline)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	results := newCommandResults("bench-self")
+	for _, bm := range benchmarks {
+		r, err := gochinadns.RunSelfBenchmark(bm)
+		if err != nil {
+			results.Fail(bm.Name, err)
+			continue
+		}
+		results.Add(r, tr("%s: %d ns/op, %d B/op, %d allocs/op (%d runs)", r.Name, r.NsPerOp, r.BytesPerOp, r.AllocsPerOp, r.N))
+		if base, ok := baseline[r.Name]; ok && base.NsPerOp > 0 {
+			if slower := float64(r.NsPerOp)/float64(base.NsPerOp) - 1; slower > benchRegression {
+				results.Fail(r.Name, fmt.Errorf("%.0f%% slower than the baseline of %d ns/op", slower*100, base.NsPerOp))
+			}
+		}
+	}
+	return results.Print()
+}
+
+// loadBenchBaseline loads results by name from the JSON output of bench-self at path, or none if path is empty.
+func loadBenchBaseline(path string) (map[string]*gochinadns.SelfBenchResult, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var output struct {
+		Command string                        `json:"command"`
+		Results []*gochinadns.SelfBenchResult `json:"results"`
+	}
+	if err = json.Unmarshal(data, &output); err != nil || output.Command != "bench-self" {
+		return nil, fmt.Errorf("invalid baseline %s, expect the JSON output of bench-self", path)
+	}
+	baseline := make(map[string]*gochinadns.SelfBenchResult, len(output.Results))
+	for _, r := range output.Results {
+		baseline[r.Name] = r
+	}
+	return baseline, nil
+}
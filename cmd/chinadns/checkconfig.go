@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cherrot/gochinadns"
+)
+
+// checkConfigResult is the result of the check-config subcommand in JSON output.
+type checkConfigResult struct {
+	Valid  bool                        `json:"valid"`
+	Config *gochinadns.EffectiveConfig `json:"config"`
+}
+
+// runCheckConfig loads the options and lists the server runs with, without starting it or probing upstreams, and
+// prints whether they are valid, or checkConfigResult in JSON output. It returns 2 on usage error, and 1 if the
+// configuration is invalid.
+func runCheckConfig(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, tr("Usage: chinadns [options] check-config\n"+
+			"Options and lists are checked without starting the server."))
+		return 2
+	}
+	// Errors are of the config file if any, or of the command line.
+	source := *flagConfig
+	if source == "" {
+		source = "command line"
+	}
+	results := newCommandResults("check-config")
+	opts := append(serverOptions(), gochinadns.WithSkipRefineResolvers(true))
+	server, err := gochinadns.NewServer(gochinadns.NewClient(clientOptions()...), opts...)
+	if err != nil {
+		results.Fail(source, err)
+		return results.Print()
+	}
+	c := server.Config()
+	results.Add(&checkConfigResult{Valid: true, Config: c},
+		tr("Configuration is valid: %d trusted and %d untrusted servers", len(c.TrustedServers), len(c.UntrustedServers)))
+	return results.Print()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/cherrot/gochinadns"
+)
+
+// classifyResult is a result of the classify subcommand in JSON output.
+type classifyResult struct {
+	*gochinadns.IPClassification
+	Verdict string `json:"verdict"` // china, overseas or blacklisted
+}
+
+// runClassify loads configured CIDR lists and prints classification of each IP in args, one per line:
+//
+//	<ip>	<china|overseas|blacklisted>	<list>:<prefix>(<source>:<line>) ... [location:<country>/AS<asn>]
+//
+// or classifyResult in JSON output. It returns 2 on usage error, and 1 if any IP is invalid.
+func runClassify(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, tr("Usage: chinadns [options] classify IP..."))
+		return 2
+	}
+
+	opts := append(serverOptions(), gochinadns.WithSkipRefineResolvers(true))
+	server, err := gochinadns.NewServer(gochinadns.NewClient(clientOptions()...), opts...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	results := newCommandResults("classify")
+	for _, arg := range args {
+		ip := net.ParseIP(arg)
+		if ip == nil {
+			results.Fail(arg, errors.New("invalid IP"))
+			continue
+		}
+		c, err := server.ClassifyIP(ip)
+		if err != nil {
+			results.Fail(arg, err)
+			continue
+		}
+		results.Add(&classifyResult{IPClassification: c, Verdict: classifyVerdict(c)}, formatClassification(c))
+	}
+	return results.Print()
+}
+
+func classifyVerdict(c *gochinadns.IPClassification) string {
+	switch {
+	case c.Blacklisted:
+		return "blacklisted"
+	case c.China:
+		return "china"
+	}
+	return "overseas"
+}
+
+func formatClassification(c *gochinadns.IPClassification) string {
+	lists := make([]string, 0, len(c.Matches))
+	for list := range c.Matches {
+		lists = append(lists, list)
+	}
+	sort.Strings(lists)
+	var matches []string
+	for _, list := range lists {
+		for _, m := range c.Matches[list] {
+			s := list + ":" + m.Network
+			if m.Source != "" {
+				s += fmt.Sprintf("(%s:%d)", m.Source, m.Line)
+			}
+			matches = append(matches, s)
+		}
+	}
+	if len(matches) == 0 {
+		matches = append(matches, "-")
+	}
+	ip := c.IP
+	if c.Embedded != "" {
+		ip += "(" + c.Embedded + ")"
+	}
+	if c.Country != "" || c.ASN != 0 {
+		geo := []string{c.Country}
+		if c.ASN != 0 {
+			geo = append(geo, fmt.Sprintf("AS%d", c.ASN))
+		}
+		matches = append(matches, "location:"+strings.Trim(strings.Join(geo, "/"), "/"))
+	}
+	return ip + "\t" + classifyVerdict(c) + "\t" + strings.Join(matches, " ")
+}
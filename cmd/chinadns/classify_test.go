@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/cherrot/gochinadns"
+)
+
+func TestFormatClassification(t *testing.T) {
+	tests := []struct {
+		c    gochinadns.IPClassification
+		want string
+	}{
+		{gochinadns.IPClassification{IP: "8.8.8.8"}, "8.8.8.8\toverseas\t-"},
+		{gochinadns.IPClassification{
+			IP:    "1.2.3.4",
+			China: true,
+			Matches: map[string][]gochinadns.CIDRMatch{
+				"china":   {{Network: "1.2.3.0/24", Source: "china.list", Line: 3}, {Network: "1.2.0.0/16"}},
+				"bogus":   {{Network: "1.2.3.4/32", Source: "bogus.list", Line: 1}},
+				"reserve": {{Network: "1.0.0.0/8", Source: "reserve.list", Line: 12}},
+			},
+		}, "1.2.3.4\tchina\tbogus:1.2.3.4/32(bogus.list:1) china:1.2.3.0/24(china.list:3) china:1.2.0.0/16 reserve:1.0.0.0/8(reserve.list:12)"},
+		{gochinadns.IPClassification{
+			IP:          "64:ff9b::102:304",
+			China:       true,
+			Blacklisted: true,
+			Embedded:    "1.2.3.4",
+			Matches:     map[string][]gochinadns.CIDRMatch{"blacklist": {{Network: "1.2.3.4/32", Source: "black.list", Line: 2}}},
+		}, "64:ff9b::102:304(1.2.3.4)\tblacklisted\tblacklist:1.2.3.4/32(black.list:2)"},
+		{gochinadns.IPClassification{IP: "1.1.1.1", Country: "AU", ASN: 13335}, "1.1.1.1\toverseas\t- location:AU/AS13335"},
+		{gochinadns.IPClassification{IP: "1.1.1.1", Country: "AU"}, "1.1.1.1\toverseas\t- location:AU"},
+		{gochinadns.IPClassification{IP: "1.1.1.1", ASN: 13335}, "1.1.1.1\toverseas\t- location:AS13335"},
+	}
+	for _, tt := range tests {
+		if got := formatClassification(&tt.c); got != tt.want {
+			t.Errorf("formatClassification(%+v) = %q, want %q", tt.c, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// loadConfig applies a YAML config file to flags. Keys are flag names, and lists are joined by comma. For example:
+//
+//	p: 5553
+//	c: [./china.list, ./extra.list]
+//	s: [114.114.114.114, https://dns.google/dns-query]
+//	timeout: 3s
+//
+// Flags set on command line take precedence over the config file.
+func loadConfig(fs *flag.FlagSet, path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err = yaml.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("fail to parse config file %s: %w", path, err)
+	}
+
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for name, v := range config {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown option %q in config file %s", name, path)
+		}
+		if explicit[name] {
+			continue
+		}
+		value, err := configValue(v)
+		if err != nil {
+			return fmt.Errorf("invalid option %q in config file %s: %w", name, path, err)
+		}
+		if err = fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid option %q in config file %s: %w", name, path, err)
+		}
+	}
+	return nil
+}
+
+// configValue converts a YAML value into the flag value form.
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, e := range v {
+			value, err := configValue(e)
+			if err != nil {
+				return "", err
+			}
+			values = append(values, value)
+		}
+		return strings.Join(values, ","), nil
+	case map[interface{}]interface{}:
+		return "", fmt.Errorf("unexpected mapping")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	newFlagSet := func() *flag.FlagSet {
+		fs := flag.NewFlagSet("chinadns", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		fs.Int("p", 53, "")
+		fs.String("c", "", "")
+		fs.String("s", "", "")
+		fs.Duration("timeout", time.Second, "")
+		fs.Bool("v", false, "")
+		return fs
+	}
+
+	fs := newFlagSet()
+	if err := fs.Parse([]string{"-p", "5353"}); err != nil {
+		t.Fatal(err)
+	}
+	path := writeList(t, "config.yaml", "p: 5553\n"+
+		"c: [./china.list, ./extra.list]\n"+
+		"s:\n  - 114.114.114.114\n  - https://dns.google/dns-query\n"+
+		"timeout: 3s\n"+
+		"v: true\n")
+	if err := loadConfig(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{
+		"p":       "5353", // set on command line
+		"c":       "./china.list,./extra.list",
+		"s":       "114.114.114.114,https://dns.google/dns-query",
+		"timeout": "3s",
+		"v":       "true",
+	} {
+		if got := fs.Lookup(name).Value.String(); got != want {
+			t.Errorf("Flag %s = %q, want %q", name, got, want)
+		}
+	}
+
+	for content, wantErr := range map[string]string{
+		"p: 5553\nunknown: 1\n":       `unknown option "unknown"`,
+		"s:\n  primary: 8.8.8.8\n":    `invalid option "s"`,
+		"c: [./china.list, {a: b}]\n": `invalid option "c"`,
+		"timeout: soon\n":             `invalid option "timeout"`,
+		"p: [5553\n":                  "fail to parse config file",
+	} {
+		err := loadConfig(newFlagSet(), writeList(t, "config.yaml", content))
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("Config %q should fail with %q, got %v", content, wantErr, err)
+		}
+	}
+	if err := loadConfig(newFlagSet(), writeList(t, "missing", "")+".yaml"); err == nil {
+		t.Error("Missing config file should fail")
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"github.com/cherrot/gochinadns"
+)
+
+// diffLocal is the pseudo server of the diff subcommand, which is the running server listening on -b and -p,
+// answering from its cache if cached.
+const diffLocal = "local"
+
+// ANSI colors of records only in either reply.
+const (
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorReset = "\x1b[0m"
+)
+
+// diffRecord is a record in a section of a reply, without TTL.
+type diffRecord struct {
+	Section string `json:"section"` // answer, authority or additional
+	Record  string `json:"record"`
+}
+
+// diffField is a header field differing between replies.
+type diffField struct {
+	Field string `json:"field"`
+	A     string `json:"a"`
+	B     string `json:"b"`
+}
+
+// diffResult is a result of the diff subcommand in JSON output.
+type diffResult struct {
+	Name      string       `json:"name"`
+	Type      string       `json:"type"`
+	Servers   [2]string    `json:"servers"`
+	Identical bool         `json:"identical"`
+	Fields    []diffField  `json:"fields"` // header fields which differ
+	OnlyA     []diffRecord `json:"only_a"` // records only in the reply of the first server
+	OnlyB     []diffRecord `json:"only_b"` // records only in the reply of the second server
+}
+
+// diffFlags are flags of the diff subcommand, which may go before, after or between domains.
+type diffFlags struct {
+	servers []string
+	qtype   uint16
+	domains []string
+}
+
+// parseDiffArgs parses args of the diff subcommand, writing errors and the usage to output.
+func parseDiffArgs(args []string, output io.Writer) (*diffFlags, error) {
+	fs := flag.NewFlagSet("diff", flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.Usage = func() {
+		fmt.Fprintln(output, tr("Usage: chinadns [options] diff -servers A,B [-qtype TYPE] DOMAIN...\n"+
+			"A and B are in the same format as -s, or local for the running server."))
+		fs.PrintDefaults()
+	}
+	servers := fs.String("servers", "", "Two servers to compare replies of, separated by comma. Same format as -s, or local for the running server (answering from its cache).")
+	qtype := fs.String("qtype", "A", "Query type.")
+
+	f := new(diffFlags)
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		f.domains = append(f.domains, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if f.servers = strings.Split(*servers, ","); len(f.domains) == 0 || len(f.servers) != 2 {
+		fs.Usage()
+		return nil, flag.ErrHelp
+	}
+	var ok bool
+	if f.qtype, ok = dns.StringToType[strings.ToUpper(*qtype)]; !ok {
+		err := errors.New(tr("Unknown query type %s", *qtype))
+		fmt.Fprintln(output, err)
+		return nil, err
+	}
+	return f, nil
+}
+
+// runDiff queries each domain in args against the two servers of -servers, and prints differences of the replies,
+// ignoring TTLs and the order of records:
+//
+//	<domain> <type>: <server a> vs <server b>
+//	  <field>: <a> | <b>
+//	- <section> <record only in a>
+//	+ <section> <record only in b>
+//
+// or diffResult in JSON output. It returns 2 on usage error, and 1 if any lookup fails.
+func runDiff(args []string) int {
+	f, err := parseDiffArgs(args, os.Stderr)
+	if err != nil {
+		return 2
+	}
+	var resolvers [2]*gochinadns.Resolver
+	for i, addr := range f.servers {
+		if addr = strings.TrimSpace(addr); addr == diffLocal {
+			addr = localAddr()
+		}
+		r, err := gochinadns.ParseResolver(addr, *flagForceTCP)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, tr("Invalid server %s: %v", addr, err))
+			return 2
+		}
+		resolvers[i] = r
+	}
+
+	client := gochinadns.NewClient(clientOptions()...)
+	color := useColor()
+	results := newCommandResults("diff")
+	for _, arg := range f.domains {
+		var replies [2]*dns.Msg
+		var err error
+		for i, r := range resolvers {
+			req := new(dns.Msg)
+			req.SetQuestion(dns.Fqdn(arg), f.qtype)
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			if replies[i], _, err = client.LookupContext(context.Background(), req, r); err != nil {
+				err = fmt.Errorf("%s: %w", r, err)
+				break
+			}
+			if replies[i] == nil {
+				err = fmt.Errorf("%s: no reply", r)
+				break
+			}
+		}
+		if err != nil {
+			results.Fail(arg, err)
+			continue
+		}
+		d := diffReplies(replies[0], replies[1])
+		d.Name, d.Type = dns.Fqdn(arg), dns.TypeToString[f.qtype]
+		d.Servers = [2]string{resolvers[0].String(), resolvers[1].String()}
+		results.Add(d, formatDiff(d, color))
+	}
+	return results.Print()
+}
+
+// localAddr returns the address of the running server, by the first address of -b and -p.
+func localAddr() string {
+	host, port, _ := net.SplitHostPort(listenAddrs()[0])
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// useColor tells whether to color text output, which is only for terminals, unless NO_COLOR is set.
+func useColor() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	fi, err := os.Stdout.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// diffReplies compares header fields and records of a and b.
+func diffReplies(a, b *dns.Msg) *diffResult {
+	d := &diffResult{Fields: []diffField{}, OnlyA: []diffRecord{}, OnlyB: []diffRecord{}}
+	for _, f := range []struct {
+		name string
+		a, b string
+	}{
+		{"rcode", dns.RcodeToString[a.Rcode], dns.RcodeToString[b.Rcode]},
+		{"aa", strconv.FormatBool(a.Authoritative), strconv.FormatBool(b.Authoritative)},
+		{"tc", strconv.FormatBool(a.Truncated), strconv.FormatBool(b.Truncated)},
+		{"ra", strconv.FormatBool(a.RecursionAvailable), strconv.FormatBool(b.RecursionAvailable)},
+		{"ad", strconv.FormatBool(a.AuthenticatedData), strconv.FormatBool(b.AuthenticatedData)},
+	} {
+		if f.a != f.b {
+			d.Fields = append(d.Fields, diffField{Field: f.name, A: f.a, B: f.b})
+		}
+	}
+	recordsA, recordsB := diffRecords(a), diffRecords(b)
+	d.OnlyA = subtractRecords(recordsA, recordsB)
+	d.OnlyB = subtractRecords(recordsB, recordsA)
+	d.Identical = len(d.Fields) == 0 && len(d.OnlyA) == 0 && len(d.OnlyB) == 0
+	return d
+}
+
+// diffRecords returns records of m in order, without TTLs and OPT records.
+func diffRecords(m *dns.Msg) []diffRecord {
+	var records []diffRecord
+	for _, section := range []struct {
+		name string
+		rrs  []dns.RR
+	}{{"answer", m.Answer}, {"authority", m.Ns}, {"additional", m.Extra}} {
+		for _, rr := range section.rrs {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			rdata := strings.TrimPrefix(rr.String(), h.String())
+			record := strings.ToLower(h.Name) + " " + dns.ClassToString[h.Class] + " " + dns.TypeToString[h.Rrtype] + " " + rdata
+			records = append(records, diffRecord{Section: section.name, Record: record})
+		}
+	}
+	return records
+}
+
+// subtractRecords returns records in a but not in b, counting duplicates.
+func subtractRecords(a, b []diffRecord) []diffRecord {
+	counts := make(map[diffRecord]int, len(b))
+	for _, r := range b {
+		counts[r]++
+	}
+	result := []diffRecord{}
+	for _, r := range a {
+		if counts[r] > 0 {
+			counts[r]--
+			continue
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// formatDiff formats d in text output, coloring the first server red and the second green if color.
+func formatDiff(d *diffResult, color bool) string {
+	paint := func(c, s string) string {
+		if !color {
+			return s
+		}
+		return c + s + colorReset
+	}
+	sb := new(strings.Builder)
+	fmt.Fprintf(sb, "%s %s: %s vs %s", d.Name, d.Type, paint(colorRed, d.Servers[0]), paint(colorGreen, d.Servers[1]))
+	if d.Identical {
+		sb.WriteString("\n  identical")
+		return sb.String()
+	}
+	for _, f := range d.Fields {
+		fmt.Fprintf(sb, "\n  %s: %s | %s", f.Field, paint(colorRed, f.A), paint(colorGreen, f.B))
+	}
+	for _, r := range d.OnlyA {
+		sb.WriteString("\n" + paint(colorRed, "- "+r.Section+"\t"+r.Record))
+	}
+	for _, r := range d.OnlyB {
+		sb.WriteString("\n" + paint(colorGreen, "+ "+r.Section+"\t"+r.Record))
+	}
+	return sb.String()
+}
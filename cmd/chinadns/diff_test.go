@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		args       []string
+		flags      []string
+		subcommand string
+		subArgs    []string
+	}{
+		{[]string{"-v", "-p", "5353"}, []string{"-v", "-p", "5353"}, "", nil},
+		{[]string{"-p", "5353", "diff", "example.com", "-servers", "a,b", "-v"},
+			[]string{"-p", "5353", "-v"}, "diff", []string{"example.com", "-servers", "a,b"}},
+		{[]string{"diff", "-p=5353", "-qtype", "AAAA", "example.com"},
+			[]string{"-p=5353"}, "diff", []string{"-qtype", "AAAA", "example.com"}},
+		// Flags of diff are unknown before it.
+		{[]string{"-servers", "a,b", "diff", "example.com"}, []string{"-servers", "a,b", "diff", "example.com"}, "", nil},
+		{[]string{"classify", "--", "-v"}, nil, "classify", []string{"--", "-v"}},
+	}
+	for _, tt := range tests {
+		flags, subcommand, subArgs := splitArgs(flag.CommandLine, tt.args)
+		if !reflect.DeepEqual(flags, tt.flags) || subcommand != tt.subcommand || !reflect.DeepEqual(subArgs, tt.subArgs) {
+			t.Errorf("splitArgs(%q) = %q, %q, %q", tt.args, flags, subcommand, subArgs)
+		}
+	}
+}
+
+func TestParseDiffArgs(t *testing.T) {
+	f, err := parseDiffArgs([]string{"a.com", "-servers", "local,8.8.8.8", "b.com", "-qtype", "aaaa", "c.com"}, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &diffFlags{servers: []string{"local", "8.8.8.8"}, qtype: dns.TypeAAAA, domains: []string{"a.com", "b.com", "c.com"}}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("Unexpected flags %+v", f)
+	}
+
+	for _, args := range [][]string{
+		{"-servers", "local,8.8.8.8"},
+		{"-servers", "8.8.8.8", "a.com"},
+		{"-servers", "local,8.8.8.8", "-qtype", "BOGUS", "a.com"},
+		{"-unknown", "a.com"},
+	} {
+		if _, err = parseDiffArgs(args, ioutil.Discard); err == nil {
+			t.Errorf("parseDiffArgs(%q) should fail", args)
+		}
+	}
+}
+
+// newDiffReply returns a reply to an A query of example.com. of rrs.
+func newDiffReply(t *testing.T, rrs ...string) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Response = true
+	for _, s := range rrs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func TestDiffReplies(t *testing.T) {
+	a := newDiffReply(t, "example.com. 300 IN A 1.1.1.1", "example.com. 300 IN A 2.2.2.2")
+	b := newDiffReply(t, "EXAMPLE.com. 60 IN A 2.2.2.2", "example.com. 600 IN A 1.1.1.1")
+	b.SetEdns0(dns.DefaultMsgSize, false)
+	if d := diffReplies(a, b); !d.Identical || len(d.Fields) != 0 || len(d.OnlyA) != 0 || len(d.OnlyB) != 0 {
+		t.Errorf("TTLs, case, order and OPT records should be ignored: %+v", d)
+	}
+
+	b = newDiffReply(t, "example.com. 300 IN A 1.1.1.1", "example.com. 300 IN A 3.3.3.3")
+	b.Rcode, b.AuthenticatedData = dns.RcodeServerFailure, true
+	d := diffReplies(a, b)
+	wantFields := []diffField{{"rcode", "NOERROR", "SERVFAIL"}, {"ad", "false", "true"}}
+	if d.Identical || !reflect.DeepEqual(d.Fields, wantFields) {
+		t.Errorf("Unexpected fields %+v", d.Fields)
+	}
+	if want := []diffRecord{{"answer", "example.com. IN A 2.2.2.2"}}; !reflect.DeepEqual(d.OnlyA, want) {
+		t.Errorf("Unexpected records only in a %+v", d.OnlyA)
+	}
+	if want := []diffRecord{{"answer", "example.com. IN A 3.3.3.3"}}; !reflect.DeepEqual(d.OnlyB, want) {
+		t.Errorf("Unexpected records only in b %+v", d.OnlyB)
+	}
+}
+
+func TestSubtractRecords(t *testing.T) {
+	r1 := diffRecord{"answer", "example.com. IN A 1.1.1.1"}
+	r2 := diffRecord{"additional", "example.com. IN A 1.1.1.1"}
+	tests := []struct {
+		a, b, want []diffRecord
+	}{
+		{nil, []diffRecord{r1}, []diffRecord{}},
+		{[]diffRecord{r1, r2}, nil, []diffRecord{r1, r2}},
+		// Sections differ.
+		{[]diffRecord{r1}, []diffRecord{r2}, []diffRecord{r1}},
+		// Duplicates are counted.
+		{[]diffRecord{r1, r1, r2}, []diffRecord{r1}, []diffRecord{r1, r2}},
+		{[]diffRecord{r1}, []diffRecord{r1, r1}, []diffRecord{}},
+	}
+	for _, tt := range tests {
+		if got := subtractRecords(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("subtractRecords(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
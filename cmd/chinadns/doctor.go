@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/cherrot/gochinadns"
+)
+
+// Statuses of doctor checks, in the order of priority of their advice.
+const (
+	doctorFail = "fail"
+	doctorWarn = "warn"
+	doctorOK   = "ok"
+)
+
+// doctorListMaxAge is the age beyond which a list is deemed stale. China route lists change every month or so.
+const doctorListMaxAge = 90 * 24 * time.Hour
+
+// doctorPoisonedDomains are queried through trusted servers to spot poisoning if -canary-domains is not set.
+var doctorPoisonedDomains = []string{"www.google.com", "www.facebook.com", "www.youtube.com"}
+
+// doctorResolvers are names of DNS daemons which may hold port 53 or bypass chinadns.
+var doctorResolvers = []string{
+	"systemd-resolve", "dnsmasq", "unbound", "named", "pdns_recursor", "dnscrypt-proxy", "smartdns", "AdGuardHome",
+	"coredns", "mosdns", "pihole-FTL",
+}
+
+// doctorCheck is a result of the doctor subcommand in JSON output.
+type doctorCheck struct {
+	Check  string `json:"check"` // port, resolvers, config, lists, upstream or poisoning
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Advice string `json:"advice,omitempty"` // how to remedy a failure or warning
+}
+
+// runDoctor checks the local environment and configuration by flags, and prints a line of each check:
+//
+//	[ OK ] <check>: <detail>
+//	[WARN] <check>: <detail>
+//	[FAIL] <check>: <detail>
+//
+// followed by advice on failures and then warnings, or doctorCheck in JSON output. Checks are on availability of
+// listening addresses, other DNS daemons, lists, reachability of upstreams over each transport, and poisoned answers
+// of trusted servers. It returns 2 on usage error, and 1 if any check fails.
+func runDoctor(args []string) int {
+	if len(args) > 0 {
+		fmt.Fprintln(os.Stderr, tr("Usage: chinadns [options] doctor\n"+
+			"Checks are done by the same options the server runs with."))
+		return 2
+	}
+
+	var checks []doctorCheck
+	checks = append(checks, checkListenAddrs()...)
+	checks = append(checks, checkResolvers())
+	opts := append(serverOptions(), gochinadns.WithSkipRefineResolvers(true))
+	client := gochinadns.NewClient(clientOptions()...)
+	server, err := gochinadns.NewServer(client, opts...)
+	if err != nil {
+		checks = append(checks, doctorCheck{Check: "config", Status: doctorFail, Detail: err.Error(),
+			Advice: tr("Fix the configuration, so that the server can start.")})
+	}
+	checks = append(checks, checkLists()...)
+	checks = append(checks, checkUpstreams(client)...)
+	if server != nil {
+		checks = append(checks, checkPoisoning(server, client)...)
+	}
+
+	results := newCommandResults("doctor")
+	failed := false
+	for i := range checks {
+		results.Add(&checks[i], formatDoctorCheck(&checks[i]))
+		failed = failed || checks[i].Status == doctorFail
+	}
+	if *flagOutput != outputJSON {
+		if advice := formatDoctorAdvice(checks); advice != "" {
+			fmt.Println(advice)
+		}
+	}
+	if code := results.Print(); code != 0 || !failed {
+		return code
+	}
+	return 1
+}
+
+// checkListenAddrs checks whether each listening address of DNS is available over UDP and TCP. Addresses held by a
+// running chinadns are fine.
+func checkListenAddrs() []doctorCheck {
+	var checks []doctorCheck
+	for _, addr := range listenAddrs() {
+		for _, network := range []string{"udp", "tcp"} {
+			checks = append(checks, checkListenAddr(network, addr))
+		}
+	}
+	return checks
+}
+
+func checkListenAddr(network, addr string) doctorCheck {
+	c := doctorCheck{Check: "port", Status: doctorOK, Detail: tr("%s %s is available", network, addr)}
+	var err error
+	if network == "udp" {
+		var pc net.PacketConn
+		if pc, err = net.ListenPacket(network, addr); err == nil {
+			_ = pc.Close()
+		}
+	} else {
+		var l net.Listener
+		if l, err = net.Listen(network, addr); err == nil {
+			_ = l.Close()
+		}
+	}
+	switch {
+	case err == nil:
+	case errors.Is(err, syscall.EADDRINUSE):
+		holder := gochinadns.PortHolder(network, addr)
+		if strings.HasPrefix(holder, "chinadns ") {
+			c.Detail = tr("%s %s is served by %s", network, addr, holder)
+			break
+		}
+		c.Status, c.Detail = doctorFail, tr("%s %s is in use", network, addr)
+		if holder != "" {
+			c.Detail = tr("%s %s is in use by %s", network, addr, holder)
+		}
+		c.Advice = tr("Free %s or listen on another port by -p or -fallback-port.", addr)
+		switch {
+		case strings.HasPrefix(holder, "systemd-resolve"):
+			c.Advice = tr("Set DNSStubListener=no in /etc/systemd/resolved.conf and restart systemd-resolved, " +
+				"or listen on another port by -p.")
+		case strings.HasPrefix(holder, "dnsmasq"):
+			c.Advice = tr("Listen on another port by -p (e.g. 5353), and forward dnsmasq to it by " +
+				"server=127.0.0.1#5353 and no-resolv in dnsmasq.conf.")
+		}
+	case errors.Is(err, syscall.EACCES):
+		c.Status, c.Detail = doctorFail, tr("%s %s needs privileges", network, addr)
+		c.Advice = tr("Run as root, or grant the binary the capability by `setcap cap_net_bind_service=+ep chinadns`.")
+	default:
+		c.Status, c.Detail = doctorFail, err.Error()
+		c.Advice = tr("Check the addresses of -b and -p.")
+	}
+	return c
+}
+
+// checkResolvers checks other DNS daemons running, which may hold port 53, or serve clients without chinadns.
+func checkResolvers() doctorCheck {
+	c := doctorCheck{Check: "resolvers", Status: doctorOK, Detail: tr("no other DNS daemon is running")}
+	if running := runningProcesses(doctorResolvers); len(running) > 0 {
+		c.Status, c.Detail = doctorWarn, tr("%s running", strings.Join(running, ", "))
+		c.Advice = tr("Make sure other DNS daemons neither listen on the addresses of chinadns, nor answer clients " +
+			"without forwarding to chinadns.")
+	}
+	if servers := resolvConfServers("/etc/resolv.conf"); len(servers) > 0 {
+		c.Detail = tr("%s; nameservers of /etc/resolv.conf: %s", c.Detail, strings.Join(servers, ", "))
+	}
+	return c
+}
+
+// runningProcesses returns processes among names running, like `dnsmasq (pid 1234)`. It finds nothing on platforms
+// without /proc.
+func runningProcesses(names []string) []string {
+	procs, _ := ioutil.ReadDir("/proc")
+	var running []string
+	for _, proc := range procs {
+		pid := proc.Name()
+		if _, err := strconv.Atoi(pid); err != nil {
+			continue
+		}
+		comm, err := ioutil.ReadFile("/proc/" + pid + "/comm")
+		if err != nil {
+			continue
+		}
+		// comm is truncated to 15 bytes, like systemd-resolve.
+		name := strings.TrimSpace(string(comm))
+		for _, n := range names {
+			if name == n {
+				running = append(running, fmt.Sprintf("%s (pid %s)", name, pid))
+			}
+		}
+	}
+	return running
+}
+
+// resolvConfServers returns nameservers of resolv.conf at path.
+func resolvConfServers(path string) []string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var servers []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// checkLists checks whether lists of flags exist, and whether they are updated in doctorListMaxAge.
+func checkLists() []doctorCheck {
+	var paths []string
+	if *flagCHNList != "" && (*flagGeoIP == "" && *flagCHNListURL == "" || isFlagSet("c")) {
+		paths = append(paths, strings.Split(*flagCHNList, ",")...)
+	}
+	if *flagCHNListExclude != "" {
+		paths = append(paths, strings.Split(*flagCHNListExclude, ",")...)
+	}
+	for _, path := range []string{*flagCHNList6, *flagGeoIP, *flagIPBlacklist, *flagGFWList, *flagGeoSite} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 && *flagCHNListURL == "" {
+		return []doctorCheck{{Check: "lists", Status: doctorFail, Detail: tr("no China route list"),
+			Advice: tr("Set a China route list by -c, -chnlist-url or -geoip, or all answers are located overseas.")}}
+	}
+
+	var checks []doctorCheck
+	now := time.Now()
+	for _, path := range paths {
+		c := doctorCheck{Check: "lists", Status: doctorOK}
+		fi, err := os.Stat(path)
+		if err != nil {
+			c.Status, c.Detail = doctorFail, err.Error()
+			c.Advice = tr("Download the list to %s, or fix its path.", path)
+			checks = append(checks, c)
+			continue
+		}
+		switch age := now.Sub(fi.ModTime()); {
+		case age > doctorListMaxAge:
+			c.Status = doctorWarn
+			c.Detail = tr("%s was updated %d days ago", path, int(age/(24*time.Hour)))
+			c.Advice = tr("Update %s. China route lists can be downloaded and refreshed by -chnlist-url.", path)
+		default:
+			c.Detail = tr("%s was updated %s ago", path, age.Round(time.Minute))
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// checkUpstreams queries the first domain of -test-domains through each upstream over each of its transports
+// concurrently.
+func checkUpstreams(client *gochinadns.Client) []doctorCheck {
+	var resolvers []*gochinadns.Resolver
+	for _, addr := range append(append([]string{}, flagResolvers...), flagTrustedResolvers...) {
+		r, err := gochinadns.ParseResolver(addr, *flagForceTCP)
+		if err != nil {
+			continue // Reported by the config check.
+		}
+		resolvers = append(resolvers, splitTransports(r)...)
+	}
+	domain := strings.Split(*flagTestDomains, ",")[0]
+	if domain == "" {
+		domain = "www.qq.com"
+	}
+
+	checks := make([]doctorCheck, len(resolvers))
+	var wg sync.WaitGroup
+	for i, r := range resolvers {
+		i, r := i, r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := doctorCheck{Check: "upstream", Status: doctorOK}
+			_, rtt, err := lookupA(client, r, domain)
+			if err != nil {
+				c.Status, c.Detail = doctorFail, fmt.Sprintf("%s: %v", r, err)
+				c.Advice = tr("Check the network and firewall to %s, or remove %s from upstreams.", r.GetAddr(), r)
+				if other := map[string]string{"udp": "tcp", "tcp": "udp"}[r.GetProtocols()[0]]; other != "" {
+					c.Advice = tr("Check the network and firewall to %s, or query it by %s@%[1]s only if that works.",
+						r.GetAddr(), other)
+				}
+			} else {
+				c.Detail = tr("%s answered %s in %s", r, domain, rtt.Round(time.Millisecond))
+			}
+			checks[i] = c
+		}()
+	}
+	wg.Wait()
+	return checks
+}
+
+// checkPoisoning queries poisoned domains (by -canary-domains) through trusted servers, and checks whether their
+// answers are located in China or blacklisted, which tells the trusted servers are poisoned on the path.
+func checkPoisoning(server *gochinadns.Server, client *gochinadns.Client) []doctorCheck {
+	if len(server.TrustedServers) == 0 {
+		return []doctorCheck{{Check: "poisoning", Status: doctorWarn, Detail: tr("no trusted server"),
+			Advice: tr("Add servers outside China by -s or -trusted-servers, or all answers of untrusted servers are accepted.")}}
+	}
+	domains := doctorPoisonedDomains
+	if *flagCanaryDomains != "" {
+		domains = strings.Split(*flagCanaryDomains, ",")
+	}
+
+	var checks []doctorCheck
+	for _, r := range server.TrustedServers {
+		c := doctorCheck{Check: "poisoning", Status: doctorOK,
+			Detail: tr("%s answered %s without poisoned IPs", r, strings.Join(domains, ", "))}
+		for _, domain := range domains {
+			reply, _, err := lookupA(client, r, domain)
+			if err != nil {
+				c.Status, c.Detail = doctorWarn, fmt.Sprintf("%s: %s: %v", r, domain, err)
+				c.Advice = tr("Check whether %s is reachable.", r)
+				break
+			}
+			if ip := poisonedIP(server, reply); ip != "" {
+				c.Status, c.Detail = doctorFail, tr("%s answered %s with poisoned IP %s", r, domain, ip)
+				c.Advice = tr("Query %s over an encrypted transport (tls:// or https://), "+
+					"or through a tunnel by -trusted-proxy, since it's poisoned on the path.", r.GetAddr())
+				break
+			}
+		}
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// poisonedIP returns the first IP in the answer of reply which is located in China or blacklisted.
+func poisonedIP(server *gochinadns.Server, reply *dns.Msg) string {
+	for _, rr := range reply.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		if c, err := server.ClassifyIP(a.A); err == nil && (c.China || c.Blacklisted) {
+			return a.A.String()
+		}
+	}
+	return ""
+}
+
+// lookupA queries A records of domain through r.
+func lookupA(client *gochinadns.Client, r *gochinadns.Resolver, domain string) (*dns.Msg, time.Duration, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(domain), dns.TypeA)
+	reply, rtt, err := client.LookupContext(context.Background(), req, r)
+	if err == nil && reply == nil {
+		err = errors.New("no reply")
+	}
+	return reply, rtt, err
+}
+
+func formatDoctorCheck(c *doctorCheck) string {
+	status := map[string]string{doctorOK: "[ OK ]", doctorWarn: "[WARN]", doctorFail: "[FAIL]"}[c.Status]
+	return status + " " + c.Check + ": " + c.Detail
+}
+
+// formatDoctorAdvice lists distinct advice of checks, failures first, or returns empty if there is none.
+func formatDoctorAdvice(checks []doctorCheck) string {
+	sorted := append([]doctorCheck(nil), checks...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Status == doctorFail && sorted[j].Status != doctorFail
+	})
+	var b strings.Builder
+	seen := make(map[string]bool)
+	for _, c := range sorted {
+		if c.Advice == "" || seen[c.Advice] {
+			continue
+		}
+		seen[c.Advice] = true
+		if len(seen) == 1 {
+			b.WriteString("\n" + tr("Advice:") + "\n")
+		}
+		fmt.Fprintf(&b, "  %d. [%s] %s\n", len(seen), strings.ToUpper(c.Status), c.Advice)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
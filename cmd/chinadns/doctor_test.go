@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/cherrot/gochinadns"
+)
+
+// writeList writes a list of content for the test, and returns its path.
+func writeList(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// fakeUpstream returns a resolver answering A queries of names by the IPs of answers, and failing other names.
+func fakeUpstream(name string, answers map[string]string) *gochinadns.Resolver {
+	return gochinadns.NewUpstreamResolver(name, gochinadns.UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+		ip, ok := answers[req.Question[0].Name]
+		if !ok {
+			return nil, 0, errors.New("connection refused")
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		}}
+		return m, time.Millisecond, nil
+	}))
+}
+
+// newDoctorServer returns a server locating 1.0.1.0/24 in China and blacklisting 8.7.198.45, with opts.
+func newDoctorServer(t *testing.T, opts ...gochinadns.ServerOption) *gochinadns.Server {
+	t.Helper()
+	opts = append([]gochinadns.ServerOption{
+		gochinadns.WithSkipRefineResolvers(true),
+		gochinadns.WithCHNList(writeList(t, "china.list", "1.0.1.0/24\n")),
+		gochinadns.WithIPBlacklist(writeList(t, "blacklist", "8.7.198.45\n")),
+	}, opts...)
+	server, err := gochinadns.NewServer(gochinadns.NewClient(), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestPoisonedIP(t *testing.T) {
+	server := newDoctorServer(t)
+	tests := []struct {
+		rrs  []string
+		want string
+	}{
+		{[]string{"www.google.com. 60 IN A 142.250.1.1"}, ""},
+		{[]string{"www.google.com. 60 IN A 142.250.1.1", "www.google.com. 60 IN A 1.0.1.1"}, "1.0.1.1"},
+		{[]string{"www.google.com. 60 IN A 8.7.198.45"}, "8.7.198.45"},
+		// Only A records are looked into.
+		{[]string{"www.google.com. 60 IN CNAME cdn.example.com.", "www.google.com. 60 IN AAAA 2404:6800::1"}, ""},
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		reply := new(dns.Msg)
+		for _, s := range tt.rrs {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reply.Answer = append(reply.Answer, rr)
+		}
+		if got := poisonedIP(server, reply); got != tt.want {
+			t.Errorf("poisonedIP(%v) = %q, want %q", tt.rrs, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPoisoning(t *testing.T) {
+	setFlag(t, "canary-domains", "www.google.com,www.youtube.com")
+	clean := fakeUpstream("clean", map[string]string{"www.google.com.": "142.250.1.1", "www.youtube.com.": "142.250.1.2"})
+	poisoned := fakeUpstream("poisoned", map[string]string{"www.google.com.": "142.250.1.1", "www.youtube.com.": "1.0.1.1"})
+	blacklisted := fakeUpstream("blacklisted", map[string]string{"www.google.com.": "8.7.198.45"})
+	broken := fakeUpstream("broken", nil)
+	server := newDoctorServer(t, gochinadns.WithUpstreams(true, clean, poisoned, blacklisted, broken))
+
+	checks := checkPoisoning(server, gochinadns.NewClient())
+	want := []string{doctorOK, doctorFail, doctorFail, doctorWarn}
+	if len(checks) != len(want) {
+		t.Fatalf("Expect a check of each trusted server, got %+v", checks)
+	}
+	for i, c := range checks {
+		if c.Check != "poisoning" || c.Status != want[i] {
+			t.Errorf("Check %d: expect status %s, got %+v", i, want[i], c)
+		}
+		if (c.Status == doctorOK) != (c.Advice == "") {
+			t.Errorf("Check %d: advice should be given on failures and warnings only, got %+v", i, c)
+		}
+	}
+	if d := checks[1].Detail; d != "custom@poisoned answered www.youtube.com with poisoned IP 1.0.1.1" {
+		t.Errorf("Unexpected detail %q", d)
+	}
+
+	// Without trusted servers, nothing can be checked.
+	server = newDoctorServer(t, gochinadns.WithUpstreams(false, fakeUpstream("untrusted", nil)))
+	if checks = checkPoisoning(server, gochinadns.NewClient()); len(checks) != 1 || checks[0].Status != doctorWarn {
+		t.Errorf("Expect a warning of no trusted server, got %+v", checks)
+	}
+}
@@ -1,43 +1,186 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
 	"net"
+	"os"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/cherrot/gochinadns"
 )
 
 var (
 	flagVersion = flag.Bool("V", false, "Print version and exit.")
 	flagVerbose = flag.Bool("v", false, "Enable verbose logging.")
+	flagConfig  = flag.String("config", "", "Path to a YAML config file. Keys are flag names (without dash), and lists are joined by comma. Flags on command line take precedence.")
+
+	flagLogThrottle = flag.Duration("log-throttle", time.Minute, "Interval to summarize repeated warning and error logs beyond -log-burst. 0 to log all of them.")
+	flagLogBurst    = flag.Int("log-burst", 10, "Number of repeated warning and error logs (of the same message and server) logged per -log-throttle.")
 
-	flagBind            = flag.String("b", "::", "Bind address.")
-	flagPort            = flag.Int("p", 53, "Listening port.")
 	flagUDPMaxBytes     = flag.Int("udp-max-bytes", 4096, "Default DNS max message size on UDP.")
+	flagTrustedSettings = flag.String("trusted-settings", "", "Default parameters of trusted servers in the format of resolver parameters, like timeout=5s&mutation=never&tcp=true. Those of a server take precedence.")
+	flagUntrustSettings = flag.String("untrusted-settings", "", "Default parameters of untrusted servers in the format of resolver parameters, like timeout=1s&edns=1232. Those of a server take precedence.")
 	flagForceTCP        = flag.Bool("force-tcp", false, "Force DNS queries use TCP only. Only applies to resolvers declared in ip:port format.")
-	flagMutation        = flag.Bool("m", false, "Enable compression pointer mutation in DNS queries.")
+	flagMutation        = flag.Bool("m", false, "Enable compression pointer mutation in DNS queries. Same as -mutation always.")
+	flagMutationMode    = flag.String("mutation", "", "Compression pointer mutation strategy of trusted servers: never, always or polluted (only for domains in -domain-polluted and -mutation-domains). Overrides -m if set.")
+	flagMutationDomains = flag.String("mutation-domains", "", "Path to domain list whose queries are mutated with -mutation polluted, besides polluted domains.")
+	flagMaxReplySize    = flag.Int("max-reply-size", 0, "Max size (in bytes) of replies of upstreams. Authority and additional records of larger replies are stripped, and they're rejected if still larger. Disabled if 0.")
+	flagMaxAdditional   = flag.Int("max-additional", 0, "Max additional records (besides OPT) kept in replies of upstreams, against amplification by glue records. Disabled if 0.")
+	flagEDNSPadding     = flag.Bool("edns-padding", true, "Pad queries over DoT and DoH to a multiple of 128 bytes (RFC 7830), so that names can't be told by the length of encrypted queries.")
+	flagRandomizeCase   = flag.Bool("randomize-case", false, "Randomize the case of question names sent to untrusted servers (DNS 0x20), and discard replies not echoing it.")
+	flagBlockQTypes     = flag.String("block-qtypes", "", "Comma separated query types answered without querying upstreams, such as ANY,HTTPS,SVCB. Disabled if empty.")
+	flagQTypeAction     = flag.String("block-qtypes-action", "empty", "Answer to queries of -block-qtypes: empty (without records) or refuse (REFUSED).")
+	flagAnomalyEntropy  = flag.Float64("anomaly-entropy", 0, "Entropy (bits per character) of labels of 12 characters or more to flag query names as anomalous, e.g. generated by malware, along with runs of consonants and hex-like labels (two signals flag a label), and overlong names. 3.5 is a fair start. Disabled if 0.")
+	flagAnomalyAction   = flag.String("anomaly-action", "log", "Action on queries of anomalous names: log (count them in /debug/vars only), block (answer like -domain-blacklist) or limit (answer REFUSED beyond -anomaly-qps per client).")
+	flagAnomalyQPS      = flag.Float64("anomaly-qps", 1, "Queries of anomalous names allowed per second per client with -anomaly-action limit.")
+	flagTunnelWindow    = flag.Duration("tunnel-window", 0, "Window of detecting clients tunneling through DNS under a domain, by too many unique names, long labels or TXT queries in it, such as 1m. Disabled if 0.")
+	flagTunnelAction    = flag.String("tunnel-action", "alert", "Action on clients detected tunneling: alert (log a warning only) or block (block their queries under the domain for a -tunnel-window).")
+	flagTunnelLabelLen  = flag.Int("tunnel-label-len", 40, "Length of labels deemed long by -tunnel-window. Most queries under a domain with long labels is tunneling.")
+	flagTunnelNames     = flag.Int("tunnel-subdomains", 100, "Unique names under a domain a client may query in a -tunnel-window.")
+	flagTunnelTXTRatio  = flag.Float64("tunnel-txt-ratio", 0.5, "Share of TXT and NULL queries under a domain from which a client is tunneling, by -tunnel-window.")
+	flagRecursion       = flag.String("recursion", "", "Handling of the RD bit of queries: preserve (keep RD of clients, e.g. for authoritative-only servers of forward rules) or refuse (answer iterative queries with REFUSED). Always set RD if empty.")
+	flagEmptyAnswers    = flag.String("empty-answer-policy", "", "Policy of empty NOERROR answers from untrusted servers: address (wait for trusted replies on empty answers of A and AAAA queries) or all (of all queries). Accept them as is if empty.")
+	flagRcodePolicy     = flag.String("rcode-policy", "", "Policy of error rcodes from untrusted servers: accept (use them as is) or strict (wait for trusted replies on any error rcode). Wait for trusted replies on SERVFAIL, and on NXDOMAIN of polluted domains (including CNAME targets) if empty.")
+	flagIPSet           = flag.String("ipset", "", "ipsets to add IPs outside China in trusted answers to, in format ipv4set[,ipv6set]. Linux only.")
+	flagNFTSet          = flag.String("nftset", "", "nftables sets to add IPs outside China in trusted answers to, in format family@table@ipv4set[,family@table@ipv6set]. Linux only.")
+	flagIPSetMinTTL     = flag.Duration("ipset-min-ttl", 0, "Min TTL of answers with IPs served while -ipset or -nftset is set, so that client caches don't expire ahead of set entries, such as 5m. Disabled if 0.")
+	flagHosts           = flag.String("hosts", "", "Path to a hosts file (/etc/hosts format, *.domain for wildcards) whose A/AAAA/PTR records are answered locally.")
+	flagRewriteRules    = flag.String("rewrite-rules", "", "Path to rules rewriting answers of names (name address|cname|strip args...), for split-horizon of internal services.")
+	flagForwardRules    = flag.String("forward-rules", "", "Path to dnsmasq style forwarding rules (server=/domain/upstream). Queries of these domains are only sent to the given upstreams.")
+	flagAnswerMatch     = flag.String("answer-match", "all", "Policy of locating answers with multiple IPs: all (in China only if all IPs are) or any (in China if any IP is). Answers with any blacklisted IP are blacklisted either way.")
+	flagScoreBudget     = flag.Duration("score-budget", 0, "Latency budget to wait for replies of both upstream groups, which are scored to pick the best one instead of the first acceptable one. Disabled if 0.")
+	flagScoreWeights    = flag.String("score-weights", "", "Weights of reply scores, like origin=1,latency=1,locality=2,blacklist=10,ttl=1 (the defaults of those absent). See README.")
+	flagCNAMEChase      = flag.Int("cname-chase", 0, "Max follow-up queries chasing CNAME chains dangling in answers of A and AAAA questions, whose addresses are then evaluated like any answer. Disabled if 0.")
+	flagVerdictTTL      = flag.Duration("verdict-ttl", 0, "How long the outcome of the race of a domain (China answer accepted, or trusted answer needed) is cached, sending later queries of the domain to that group only. Disabled if 0.")
 	flagBidirectional   = flag.Bool("d", true, "Drop results of trusted servers which containing IPs in China. (Bidirectional mode.)")
-	flagReusePort       = flag.Bool("reuse-port", true, "Enable SO_REUSEPORT to gain some performance optimization. Need Linux>=3.9")
+	flagReusePort       = flag.Bool("reuse-port", true, "Enable SO_REUSEPORT (SO_REUSEPORT_LB on FreeBSD) to share listening ports among processes, which balances queries on Linux>=3.9, DragonFly and FreeBSD>=12. Ignored if unsupported, like on Windows.")
 	flagTimeout         = flag.Duration("timeout", 2*time.Second, "DNS request timeout")
+	flagQueryTimeout    = flag.Duration("query-timeout", 5*time.Second, "Deadline to resolve a query of a UDP client (doubled for TCP clients), after which lookups in upstreams are given up.")
+	flagTCPReadTimeout  = flag.Duration("tcp-read-timeout", 2*time.Second, "Timeout to read the first query of a client TCP connection.")
+	flagTCPIdleTimeout  = flag.Duration("tcp-idle-timeout", 8*time.Second, "Timeout to wait for subsequent queries of a client TCP connection.")
+	flagTCPMaxConns     = flag.Int("tcp-max-conns", 1000, "Max concurrent client TCP connections. Set to 0 for unlimited.")
+	flagTCPMaxQueries   = flag.Int("tcp-max-queries", 128, "Max queries per client TCP connection. Set to -1 for unlimited.")
+	flagMaxInFlight     = flag.Int("max-in-flight", 1000, "Max queries served at a time, to bound memory under bursts. Set to 0 for unlimited.")
+	flagMaxQueued       = flag.Int("max-queued", 1000, "Max queries waiting (for a second at most) beyond -max-in-flight. Others are replied SERVFAIL.")
 	flagDelay           = flag.Float64("y", 0.1, "Delay (in seconds) to query another DNS server when no reply received.")
 	flagTestDomains     = flag.String("test-domains", "www.qq.com", "Domain names to test DNS connection health, separated by comma.")
-	flagCHNList         = flag.String("c", "./china.list", "Path to China route list. Both IPv4 and IPv6 are supported. See http://ipverse.net")
+	flagCanaryDomains   = flag.String("canary-domains", "", "Domain names known to be poisoned, separated by comma. They are queried through untrusted servers to learn poisoned IPs.")
+	flagCanaryInterval  = flag.Duration("canary-interval", 10*time.Minute, "Interval to query canary domains.")
+	flagCHNList         = flag.String("c", "./china.list", "Comma separated paths to China route lists. Both IPv4 and IPv6 are supported. See http://ipverse.net")
+	flagCHNListExclude  = flag.String("c-exclude", "", "Comma separated paths to CIDR lists which are excluded from China route lists.")
+	flagGeoIP           = flag.String("geoip", "", "Path to a MaxMind DB (e.g. GeoLite2-Country.mmdb) to check whether an IP is in China, instead of -c.")
+	flagCHNListURL      = flag.String("chnlist-url", "", "URL to download a China route list from, e.g. http://ftp.apnic.net/apnic/stats/apnic/delegated-apnic-latest. CIDR lists and APNIC delegated files are supported.")
+	flagCHNListRefresh  = flag.Duration("chnlist-refresh", 24*time.Hour, "Interval to download the China route list from -chnlist-url again. Set to 0 to disable.")
+	flagCHNList6        = flag.String("c6", "", "Path to a separate China route list used to check IPv6 addresses only.")
+	flagDualStack       = flag.String("dualstack-prefer", "", "Preferred family when A and AAAA answers mismatch in locality: ipv4, ipv6 or domestic. Disabled if empty.")
+	flagDNS64           = flag.Bool("dns64", false, "Synthesize AAAA records from A records of domains without native AAAA records, for IPv6-only clients behind NAT64.")
+	flagDNS64Prefix     = flag.String("dns64-prefix", "64:ff9b::/96", "NAT64 prefix of -dns64, with length 32, 40, 48, 56, 64 or 96.")
+	flagAAAAMode        = flag.String("aaaa", "", "AAAA handling: filter (answer AAAA questions without records), prefer-ipv4 (drop AAAA answers of domains with A records) or prefer-ipv6 (drop A answers of domains with AAAA records). Keep AAAA if empty.")
+	flagPrefetch        = flag.Bool("prefetch-counterpart", false, "Resolve and cache AAAA questions along with A questions in the background, and vice versa, so that the second query of dual-stack clients hits the cache. Doubles upstream queries of addresses.")
 	flagIPBlacklist     = flag.String("l", "", "Path to IP blacklist file.")
-	flagDomainBlacklist = flag.String("domain-blacklist", "", "Path to domain blacklist file.")
+	flagDomainBlacklist = flag.String("domain-blacklist", "", "Path to domain blacklist file. Entries are domains (with subdomains), wildcards like *.example.com or regular expressions like /^ads?[0-9]*\\./.")
+	flagBlockResponse   = flag.String("block-response", "empty", "Response to blocked queries: empty (NOERROR without answers), nxdomain, refused, or sinkhole IPs separated by comma like 0.0.0.0,::.")
+	flagDomainWhitelist = flag.String("domain-whitelist", "", "Path to domain whitelist file. Domains in it are never blocked by domain blacklist.")
+	flagBlockSchedule   = flag.String("block-schedule", "", "Path to scheduled blocking rules file. Each line is a rule like: <clients> <days> <hh:mm-hh:mm> <timezone> <domain list path>")
+	flagECHStrip        = flag.String("ech-strip", "", "Path to domain list whose ECH parameters in HTTPS/SVCB answers are stripped. Add a single dot to strip for all domains.")
+	flagECHPreserve     = flag.String("ech-preserve", "", "Path to domain list whose ECH parameters are always preserved, overriding -ech-strip.")
 	flagDomainPolluted  = flag.String("domain-polluted", "", "Path to polluted domains list. Queries of these domains will not be sent to DNS in China.")
+	flagGFWList         = flag.String("gfwlist", "", "Path to gfwlist (base64 encoded or decoded). Queries of domains in it will not be sent to DNS in China, except for @@ rules.")
+	flagGeoSite         = flag.String("geosite", "", "Path to v2ray geosite.dat. Queries of domains in -geosite-tags will not be sent to DNS in China.")
+	flagGeoSiteTags     = flag.String("geosite-tags", "gfw", "Comma separated categories of -geosite, such as gfw or geolocation-!cn.")
+	flagUpstreamBudgets = flag.String("upstream-budgets", "", "Comma separated query budgets of upstreams, in format addr=limit/period where period is day or month, like https://dns.example/dns-query=10000/day. Upstreams exhausting a budget are left out until the period ends.")
+	flagVerifyChina     = flag.Int("verify-china", 0, "Verify accepted China answers against trusted servers in the background (paranoid mode), and treat a domain as polluted after this many disagreements in a row, for a day. Disabled if 0.")
+	flagDegradeAfter    = flag.Duration("degrade-after", 0, "Degrade untrusted servers slower than the fastest trusted server for this period, such as 10m, leaving them out unless all untrusted servers are degraded. Compared on health checks. Disabled if 0.")
 	flagSkipRefine      = flag.Bool("skip-refine", false, "If true, will keep the specified resolver order and skip the refine process.")
+	flagAdminListen     = flag.String("admin-listen", "", "Listening address of the admin HTTP API, such as 127.0.0.1:8053. Disabled if empty.")
+	flagStatsListen     = flag.String("stats-listen", "", "Listening address of read-only counters at /stats for dashboard widgets, such as 0.0.0.0:8054. Exposes no names or clients. Disabled if empty.")
+	flagStatsOrigin     = flag.String("stats-allow-origin", "*", "Origin allowed to read -stats-listen in browsers by CORS, like https://dash.lan, or * for any.")
+	flagDebugListen     = flag.String("debug-listen", "", "Listening address of pprof and dumps of internal state at /debug/, such as 127.0.0.1:6060. Not authenticated, so listen on localhost only. Disabled if empty.")
+	flagStatsPeriod     = flag.Duration("stats-period", 24*time.Hour, "Period of rolling counters of queries by domain, client and upstream, reported by the stats subcommand and /stats of the admin API. Disabled if 0.")
+	flagDoTListen       = flag.String("dot-listen", "", "Listening address to serve DNS over TLS, such as [::]:853. Requires -tls-cert and -tls-key. Disabled if empty.")
+	flagDoHListen       = flag.String("doh-listen", "", "Listening address to serve DNS over HTTPS, such as [::]:443. Requires -tls-cert and -tls-key. Disabled if empty.")
+	flagDoHPath         = flag.String("doh-path", "/dns-query", "URL path to serve DNS over HTTPS at.")
+	flagTLSCert         = flag.String("tls-cert", "", "Path to the PEM certificate (chain) of -dot-listen and -doh-listen. Reloaded on SIGHUP.")
+	flagTLSKey          = flag.String("tls-key", "", "Path to the PEM private key of -tls-cert.")
+	flagWhoAnswered     = flag.Bool("whoanswered", false, "Answer TXT questions like whoanswered.example.com.chinadns. with the upstream and decision which produced answers of example.com.")
+	flagShuffle         = flag.String("shuffle", "", "Reorder A/AAAA records in answers: random, round-robin, or speed (by reports to the admin API /speeds/report). Keep upstream order if empty.")
+	flagRateLimit       = flag.Float64("rate-limit", 0, "Max UDP queries per second of each client on average, against DNS amplification. Large responses cost more. Set to 0 to disable.")
+	flagRateLimitBurst  = flag.Int("rate-limit-burst", 0, "Max UDP queries of each client in a burst. Defaults to -rate-limit plus 1 if 0.")
+	flagRateLimitAction = flag.String("rate-limit-action", "truncate", "Action on UDP queries beyond -rate-limit: truncate (so that genuine clients retry over TCP), refuse or drop.")
+	flagCacheEntries    = flag.Int("cache-entries", 5000, "Max DNS cache entries. Set to 0 to disable the built-in DNS cache.")
+	flagCacheMaxBytes   = flag.Int("cache-max-bytes", 8<<20, "Max estimated memory usage (in bytes) of the built-in DNS cache. Set to 0 for unlimited.")
+	flagCacheFile       = flag.String("cache-file", "", "File to save the DNS cache to on shutdown, and load it from on start, so that a restart doesn't begin with a cold cache. Disabled if empty.")
+	flagRedis           = flag.String("redis", "", "URL of a Redis server to share the DNS cache and verdicts (see -verdict-ttl) with other servers, like redis://[:password@]host[:port][/db]. The in-memory cache is used if empty.")
+	flagRedisPrefix     = flag.String("redis-prefix", "chinadns:", "Prefix of keys in Redis, to share a Redis server among groups of servers.")
+	flagMemoryLimit     = flag.Int("memory-limit", 0, "Estimated memory usage (in bytes) of the process, beyond which the DNS cache is shrunk by half, such as 48000000 on routers with 64MB of memory. Disabled if 0.")
+	flagGCPercent       = flag.Int("gc-percent", 0, "GC target percentage. A lower one trades CPU for less memory, such as 50 on routers. Unchanged if 0.")
+	flagMinTTL          = flag.Duration("min-ttl", 0, "Raise TTLs of answers from upstreams (and cache entries) to it, such as 60s. Disabled if 0.")
+	flagMaxTTL          = flag.Duration("max-ttl", 0, "Lower TTLs of answers from upstreams (and cache entries) to it, such as 1h. Disabled if 0.")
+	flagCacheStrategy   = flag.String("cache-strategy", "", "Cache strategies of domain sets, in format set=hint[+hint...] separated by comma. A set is polluted (polluted domains) or the path of a domain list, and hints are no-cache, long:DURATION (cache positive answers at least that long) and stale:DURATION (serve expired answers that long). The first set containing a name applies.")
+	flagServeStale      = flag.Duration("serve-stale", 24*time.Hour, "How long expired cache entries are kept to answer when upstreams time out or fail. Set to 0 to disable.")
+	flagFailurePolicy   = flag.String("failure-policy", "stale", "Comma separated steps tried in order when all upstreams time out or fail: retry (resolve once more with doubled timeouts), stale (serve an expired cache entry, see -serve-stale) or servfail. SERVFAIL is answered if all steps fail.")
+	flagDDR             = flag.Bool("ddr", false, "Discover DoT endpoints of servers in ip:port format by DDR (RFC 9462), and upgrade them like -opportunistic-dot if verified. Requires -probe-interval.")
+	flagUpgradeDoT      = flag.Bool("opportunistic-dot", false, "Upgrade servers in ip:port format to DoT on port 853 if probed available, and pin them to DoT after the first success. Requires -probe-interval.")
+	flagECSTrusted      = flag.String("ecs-trusted", "forward", "EDNS Client Subnet policy of trusted servers: forward, strip, or a subnet to send instead, e.g. 203.0.113.0/24.")
+	flagECSUntrusted    = flag.String("ecs-untrusted", "forward", "EDNS Client Subnet policy of untrusted servers: forward, strip, or a subnet to send instead, e.g. 203.0.113.0/24.")
+	flagDNSSEC          = flag.Bool("dnssec", false, "Validate DNSSEC signatures of trusted answers. Answers failing validation are treated like ones hitting the IP blacklist.")
+	flagTrustedProxy    = flag.String("trusted-proxy", "", "Query trusted servers through a proxy, e.g. socks5://127.0.0.1:1080 or http://127.0.0.1:8080 (HTTP CONNECT). UDP queries are sent over TCP then.")
+	flagProbeInterval   = flag.Duration("probe-interval", 30*time.Minute, "Interval to probe capabilities (UDP, TCP, EDNS, cookie, DoT) of upstreams. Transports of servers in ip:port format and EDNS UDP size are chosen by probing. Set to 0 to disable.")
+	flagAuditInterval   = flag.Duration("audit-interval", 0, "Interval to re-resolve recently answered questions through both trusted and untrusted servers, and record how their answers diverge. Disabled if 0.")
+	flagAuditSample     = flag.Int("audit-sample", 32, "Number of recently answered questions audited every -audit-interval.")
+	flagHealthInterval  = flag.Duration("health-interval", 30*time.Second, "Interval to check health of upstreams by querying test domains. Failing upstreams are skipped until they recover. Set to 0 to disable.")
+	flagPermissiveLists = flag.Bool("permissive-lists", false, "Skip missing list files and bad lines of lists with warnings, instead of failing to start or reload.")
+	flagPinUpstreams    = flag.Bool("pin-upstreams", false, "Pin each client to an upstream within each group by hashing its IP, so that its CDN mappings stay stable.")
+	flagSelection       = flag.String("selection", "fastest", "Strategy to select upstreams within the trusted or untrusted group: sequential (specified or refined order), parallel (all at once), round-robin, weighted (random, favoring fast ones) or fastest.")
+	flagGoroutineMaxAge = flag.Duration("goroutine-max-age", time.Minute, "Lookup goroutines running longer than it are logged and canceled. Set to 0 to disable.")
+	flagRedactNames     = flag.String("redact-names", "", "Redact domain names in logs and the admin API: hmac (irreversible tokens) or encrypt (decryptable by the decrypt-name subcommand).")
+	flagRedactKeyFile   = flag.String("redact-key-file", "", "Path to the site key file to redact domain names with.")
+	flagQueryLog        = flag.String("query-log", "", "Path of the query log, with a record per query. Disabled if empty.")
+	flagQueryLogFormat  = flag.String("query-log-format", "json", "Format of the query log: json (a JSON object per line) or dnstap.")
+	flagQueryLogMaxSize = flag.Int64("query-log-max-bytes", 64<<20, "Size (in bytes) of the query log to rotate at. Set to 0 to never rotate.")
+	flagQueryLogBackups = flag.Int("query-log-backups", 3, "Number of rotated query logs to keep.")
+	flagAllowedClients  = flag.String("allowed-clients", "", "Comma separated CIDRs of clients allowed to query, such as 192.168.1.0/24,10.8.0.0/16,fd00::/8. Others are answered with REFUSED. All clients are allowed if empty.")
+	flagTenants         = flag.String("tenants", "", "Path to tenants file, breaking down stats and query logs per tenant. Each line is a tenant like: <name> <comma separated CIDR list>")
+	flagMirror          = flag.String("mirror", "", "Mirror queries and their final answers to host:port over UDP for offline analysis, without using its answers. Disabled if empty.")
+	flagMirrorPercent   = flag.Float64("mirror-percent", 100, "Percent of queries to mirror.")
+	flagUbus            = flag.Bool("ubus", false, "Register on OpenWrt's ubus as object chinadns, with methods status and reload.")
+	flagUbusSocket      = flag.String("ubus-socket", "", "Path of the ubusd socket. Defaults to /var/run/ubus/ubus.sock if empty.")
+	flagActivation      = flag.Bool("socket-activation", true, "Use listening sockets passed by the init system (LISTEN_FDS of systemd socket activation) instead of binding them.")
+	flagBindRetries     = flag.Int("bind-retries", 0, "Times to retry binding a listening address in use, e.g. while the previous server is exiting.")
+	flagBindBackoff     = flag.Duration("bind-backoff", time.Second, "Wait before the first retry of binding, doubled on each retry.")
+	flagFallbackPort    = flag.Int("fallback-port", 0, "Port to listen on instead if a listening address is still in use after retries, e.g. held by systemd-resolved or dnsmasq. Disabled if 0.")
+	flagUpgrade         = flag.Bool("upgrade", false, "Upgrade to the current executable without dropping queries on SIGUSR2, handing listening sockets over to a new process.")
+	flagServiceName     = flag.String("service-name", "chinadns", "Name of the Windows service managed by the service subcommand. Windows only.")
+	flagLang            = flag.String("lang", "en", "Language of user-facing messages of the admin API and subcommands: en or zh-CN.")
+	flagOutput          = flag.String("o", "text", "Output format of subcommands: text or json (a document with a stable schema, for automation).")
+	flagBenchCount      = flag.Int("bench-count", 3, "Queries of each domain through each upstream and transport by the bench subcommand.")
+	flagBenchBaseline   = flag.String("bench-baseline", "", "JSON output of a previous run of the bench-self subcommand, benchmarks slower than which by more than 20% fail.")
+	flagDumpDir         = flag.String("dump-dir", os.TempDir(), "Directory to write state dumps into when receiving SIGQUIT.")
 
 	flagResolvers        resolverAddrs = []string{"udp+tcp@119.29.29.29:53", "udp+tcp@114.114.114.114:53"}
 	flagTrustedResolvers resolverAddrs = []string{}
+	flagBind                           = &listFlag{values: []string{"::"}}
+	flagPort                           = &listFlag{values: []string{"53"}, check: checkPort}
 )
 
 func init() {
+	flag.Var(flagBind, "b", "Bind addresses, separated by comma or by repeating the flag. An address with a port, like [::1]:5353, "+
+		"listens on that port only, and others on all ports of -p.")
+	flag.Var(flagPort, "p", "Listening ports, separated by comma or by repeating the flag.")
 	flag.Var(&flagResolvers, "s", "Comma separated list of upstream DNS servers. Need China route list to check whether it's a trusted server or not.\n"+
 		"Servers can be in format ip:port or protocol[+protocol]@ip:port where protocol is udp or tcp.\n"+
 		"Protocols are dialed in order left to right. Rightmost protocol will only be dialed if the leftmost fails.\n"+
 		"Protocols will override force-tcp flag. "+
 		"If empty, protocol defaults to udp+tcp (tcp if force-tcp is set) and port defaults to 53.\n"+
-		"Examples: 8.8.8.8,udp@127.0.0.1:5353,udp+tcp@1.1.1.1, doh@https://cloudflare-dns.com/dns-query")
+		"DoH servers can be specified as a https:// URL directly.\n"+
+		"DoT servers can be specified as tls://ip[:port][#name], where name is used to verify the server certificate.\n"+
+		"UDP and TCP servers can also be specified as udp://ip[:port] or tcp://ip[:port], regardless of force-tcp.\n"+
+		"UDP and TCP servers can override -mutation by a suffix like ?mutation=never, and the EDNS size by ?edns=1232 (or off).\n"+
+		"Examples: 8.8.8.8,udp@127.0.0.1:5353,udp+tcp@1.1.1.1,doh@https://cloudflare-dns.com/dns-query,https://dns.google/dns-query,tls://1.1.1.1,tcp://8.8.8.8")
 	flag.Var(&flagTrustedResolvers, "trusted-servers", "Comma separated list of servers which (located in China but) can be trusted. \n"+
 		"Uses the same format as -s.")
 }
@@ -64,7 +207,74 @@ func (rs *resolverAddrs) String() string {
 }
 
 func (rs *resolverAddrs) Set(s string) error {
-	addrs := strings.Split(s, ",")
+	addrs := make([]string, 0, strings.Count(s, ",")+1)
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		if _, err := gochinadns.ParseResolver(addr, false); err != nil {
+			return err
+		}
+		addrs = append(addrs, addr)
+	}
 	*rs = addrs
 	return nil
 }
+
+// listFlag is a comma separated list, which is appended to by repeating the flag. The first value set replaces the
+// default one.
+type listFlag struct {
+	values []string
+	check  func(string) error // checks each value, if not nil
+	set    bool
+}
+
+func (l *listFlag) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(l.values, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	if !l.set {
+		l.values, l.set = nil, true
+	}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		if l.check != nil {
+			if err := l.check(v); err != nil {
+				return err
+			}
+		}
+		l.values = append(l.values, v)
+	}
+	if len(l.values) == 0 {
+		return errors.New("empty list")
+	}
+	return nil
+}
+
+func checkPort(s string) error {
+	if port, err := strconv.Atoi(s); err != nil || port < 0 || port > 65535 {
+		return fmt.Errorf("invalid port: %s", s)
+	}
+	return nil
+}
+
+// listenAddrs returns listening addresses by -b and -p.
+func listenAddrs() []string {
+	var addrs []string
+	for _, bind := range flagBind.values {
+		if _, _, err := net.SplitHostPort(bind); err == nil {
+			addrs = append(addrs, bind)
+			continue
+		}
+		for _, port := range flagPort.values {
+			addrs = append(addrs, net.JoinHostPort(strings.Trim(bind, "[]"), port))
+		}
+	}
+	return addrs
+}
@@ -2,13 +2,13 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"net"
+	"os"
 	"reflect"
 	"runtime"
 	"runtime/debug"
-	"strconv"
 	"strings"
 	"time"
 
@@ -17,8 +17,32 @@ import (
 	"github.com/cherrot/gochinadns"
 )
 
+// subcommands maps subcommand names to their entries. The server runs if no subcommand is given.
+// A subcommand gets remaining arguments after global flags, including its own flags, and returns the exit code.
+var subcommands = map[string]func(args []string) int{
+	"bench":        runBench,
+	"bench-self":   runBenchSelf,
+	"check-config": runCheckConfig,
+	"classify":     runClassify,
+	"decrypt-name": runDecryptName,
+	"diff":         runDiff,
+	"doctor":       runDoctor,
+	"service":      runService,
+	"stats":        runStats,
+}
+
 func main() {
-	flag.Parse()
+	// Flags may go either before or after the subcommand.
+	flags, name, args := splitArgs(flag.CommandLine, os.Args[1:])
+	subcommand := subcommands[name]
+	_ = flag.CommandLine.Parse(flags)
+	if *flagConfig != "" {
+		if err := loadConfig(flag.CommandLine, *flagConfig); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
 	if *flagVersion {
 		fmt.Println(gochinadns.GetVersion())
 		fmt.Printf("Go version: %s\n", runtime.Version())
@@ -27,22 +51,179 @@ func main() {
 	if *flagVerbose {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
+	if err := setNameRedactor(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if _, err := gochinadns.ParseLanguage(*flagLang); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if subcommand != nil {
+		if err := checkOutputFormat(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		os.Exit(subcommand(args))
+	}
+
+	service, err := initService(*flagServiceName)
+	if err != nil {
+		logrus.WithError(err).Fatal("Fail to init service.")
+	}
+	stopThrottle := gochinadns.ThrottleLogs(logrus.StandardLogger(), *flagLogThrottle, *flagLogBurst)
+	defer stopThrottle()
+
+	client := gochinadns.NewClient(clientOptions()...)
+	server, err := gochinadns.NewServer(client, serverOptions()...)
+	if err != nil {
+		panic(err)
+	}
+	handleDumpSignal(server, *flagDumpDir)
+	handleReloadSignal(server)
+	ctx, cancel := context.WithCancel(context.Background())
+	handleStopSignal(cancel)
+	if *flagUpgrade {
+		handleUpgradeSignal(server, cancel)
+	}
+
+	if !service {
+		runUntilCanceled(ctx, server.Run)
+	} else if err = serveService(*flagServiceName, func() { runUntilCanceled(ctx, server.Run) }, cancel); err != nil {
+		logrus.WithError(err).Fatal("Fail to run service.")
+	}
+}
 
-	listen := net.JoinHostPort(*flagBind, strconv.Itoa(*flagPort))
+// serverOptions builds server options from command line flags.
+func serverOptions() []gochinadns.ServerOption {
 	opts := []gochinadns.ServerOption{
-		gochinadns.WithListenAddr(listen),
+		gochinadns.WithListenAddrs(listenAddrs()...),
+		gochinadns.WithPermissiveLists(*flagPermissiveLists),
 		gochinadns.WithBidirectional(*flagBidirectional),
 		gochinadns.WithReusePort(*flagReusePort),
+		gochinadns.WithSocketActivation(*flagActivation),
+		gochinadns.WithBindRetry(*flagBindRetries, *flagBindBackoff),
+		gochinadns.WithFallbackPort(*flagFallbackPort),
 		gochinadns.WithDelay(time.Duration(*flagDelay * float64(time.Second))),
 		gochinadns.WithTrustedResolvers(*flagForceTCP, flagTrustedResolvers...),
 		gochinadns.WithResolvers(*flagForceTCP, flagResolvers...),
 		gochinadns.WithSkipRefineResolvers(*flagSkipRefine),
+		gochinadns.WithAdminListenAddr(*flagAdminListen),
+		gochinadns.WithDebugListenAddr(*flagDebugListen),
+		gochinadns.WithStatsListenAddr(*flagStatsListen),
+		gochinadns.WithStatsAllowOrigin(*flagStatsOrigin),
+		gochinadns.WithLanguage(*flagLang),
+		gochinadns.WithDoTListenAddr(*flagDoTListen),
+		gochinadns.WithDoHListenAddr(*flagDoHListen, *flagDoHPath),
+		gochinadns.WithTLSCertificate(*flagTLSCert, *flagTLSKey),
+		gochinadns.WithWhoAnswered(*flagWhoAnswered),
+		gochinadns.WithAnswerShuffle(*flagShuffle),
+		gochinadns.WithDualStackPreference(*flagDualStack),
+		gochinadns.WithAAAAMode(*flagAAAAMode),
+		gochinadns.WithCounterpartPrefetch(*flagPrefetch),
+		gochinadns.WithCache(*flagCacheEntries, *flagCacheMaxBytes),
+		gochinadns.WithQueryTimeout(*flagQueryTimeout),
+		gochinadns.WithTCPTimeouts(*flagTCPReadTimeout, *flagTCPIdleTimeout),
+		gochinadns.WithTCPLimits(*flagTCPMaxConns, *flagTCPMaxQueries),
+		gochinadns.WithMaxInFlight(*flagMaxInFlight, *flagMaxQueued),
+		gochinadns.WithRateLimit(*flagRateLimit, *flagRateLimitBurst, *flagRateLimitAction),
+		gochinadns.WithServeStale(*flagServeStale),
+		gochinadns.WithFailurePolicy(strings.Split(*flagFailurePolicy, ",")...),
+		gochinadns.WithCacheFile(*flagCacheFile),
+		gochinadns.WithMemoryLimit(*flagMemoryLimit),
+		gochinadns.WithGCPercent(*flagGCPercent),
+		gochinadns.WithTTLClamp(*flagMinTTL, *flagMaxTTL),
+		gochinadns.WithGoroutineMaxAge(*flagGoroutineMaxAge),
+		gochinadns.WithProbeInterval(*flagProbeInterval),
+		gochinadns.WithHealthCheck(*flagHealthInterval),
+		gochinadns.WithAudit(*flagAuditInterval, *flagAuditSample),
+		gochinadns.WithSelection(*flagSelection),
+		gochinadns.WithPinning(*flagPinUpstreams),
+		gochinadns.WithBlockResponse(*flagBlockResponse),
+		gochinadns.WithOpportunisticDoT(*flagUpgradeDoT),
+		gochinadns.WithDDR(*flagDDR),
+		gochinadns.WithDNSSECValidation(*flagDNSSEC),
+		gochinadns.WithECS(*flagECSTrusted, *flagECSUntrusted),
+		gochinadns.WithMutationStrategy(*flagMutationMode),
+		gochinadns.WithCaseRandomization(*flagRandomizeCase),
+		gochinadns.WithRecursionMode(*flagRecursion),
+		gochinadns.WithRcodePolicy(*flagRcodePolicy),
+		gochinadns.WithGroupSettings(true, *flagTrustedSettings),
+		gochinadns.WithGroupSettings(false, *flagUntrustSettings),
+		gochinadns.WithEmptyAnswerPolicy(*flagEmptyAnswers),
+		gochinadns.WithAnswerMatch(*flagAnswerMatch),
+		gochinadns.WithVerdictCache(*flagVerdictTTL),
+		gochinadns.WithCNAMEChase(*flagCNAMEChase),
+		gochinadns.WithLatencyDegradation(*flagDegradeAfter),
+		gochinadns.WithChinaVerification(*flagVerifyChina),
+		gochinadns.WithUpstreamBudgets(strings.Split(*flagUpstreamBudgets, ",")...),
 	}
 	if *flagTestDomains != "" {
 		opts = append(opts, gochinadns.WithTestDomains(strings.Split(*flagTestDomains, ",")...))
 	}
-	if *flagCHNList != "" {
-		opts = append(opts, gochinadns.WithCHNList(*flagCHNList))
+	if *flagCanaryDomains != "" {
+		opts = append(opts, gochinadns.WithCanaryDomains(*flagCanaryInterval, strings.Split(*flagCanaryDomains, ",")...))
+	}
+	if *flagQueryLog != "" {
+		opts = append(opts, gochinadns.WithQueryLog(*flagQueryLog, *flagQueryLogFormat, *flagQueryLogMaxSize, *flagQueryLogBackups))
+	}
+	if *flagDNS64 {
+		opts = append(opts, gochinadns.WithDNS64(*flagDNS64Prefix))
+	}
+	if *flagBlockQTypes != "" {
+		opts = append(opts, gochinadns.WithBlockedQTypes(*flagQTypeAction, strings.Split(*flagBlockQTypes, ",")...))
+	}
+	if *flagAnomalyEntropy > 0 {
+		opts = append(opts, gochinadns.WithNameAnomalies(*flagAnomalyEntropy, *flagAnomalyAction, *flagAnomalyQPS))
+	}
+	if *flagTunnelWindow > 0 {
+		opts = append(opts,
+			gochinadns.WithTunnelDetection(*flagTunnelWindow, *flagTunnelAction),
+			gochinadns.WithTunnelThresholds(*flagTunnelLabelLen, *flagTunnelNames, *flagTunnelTXTRatio))
+	}
+	if *flagStatsPeriod > 0 {
+		opts = append(opts, gochinadns.WithStats(*flagStatsPeriod))
+	}
+	if *flagRedis != "" {
+		opts = append(opts, gochinadns.WithRedis(*flagRedis, *flagRedisPrefix))
+	}
+	if *flagAllowedClients != "" {
+		opts = append(opts, gochinadns.WithAllowedClients(strings.Split(*flagAllowedClients, ",")...))
+	}
+	if *flagTenants != "" {
+		opts = append(opts, gochinadns.WithTenants(*flagTenants))
+	}
+	if *flagMirror != "" {
+		opts = append(opts, gochinadns.WithMirror(*flagMirror, *flagMirrorPercent))
+	}
+	if *flagUbus {
+		opts = append(opts, gochinadns.WithUbus(*flagUbusSocket))
+	}
+	if *flagScoreBudget > 0 {
+		opts = append(opts, gochinadns.WithScoreWeights(*flagScoreWeights, *flagScoreBudget))
+	}
+	if *flagTrustedProxy != "" {
+		opts = append(opts, gochinadns.WithTrustedProxy(*flagTrustedProxy))
+	}
+	if *flagGeoIP != "" {
+		opts = append(opts, gochinadns.WithGeoIP(*flagGeoIP))
+	}
+	if *flagCHNListURL != "" {
+		opts = append(opts, gochinadns.WithCHNListURL(*flagCHNListURL, *flagCHNListRefresh))
+	}
+	// China route lists are replaced by the GeoIP database or the downloaded list, unless given explicitly.
+	if *flagCHNList != "" && (*flagGeoIP == "" && *flagCHNListURL == "" || isFlagSet("c")) {
+		for _, path := range strings.Split(*flagCHNList, ",") {
+			opts = append(opts, gochinadns.WithCHNList(path))
+		}
+	}
+	if *flagCHNListExclude != "" {
+		for _, path := range strings.Split(*flagCHNListExclude, ",") {
+			opts = append(opts, gochinadns.WithCHNListExclude(path))
+		}
+	}
+	if *flagCHNList6 != "" {
+		opts = append(opts, gochinadns.WithCHNList6(*flagCHNList6))
 	}
 	if *flagIPBlacklist != "" {
 		opts = append(opts, gochinadns.WithIPBlacklist(*flagIPBlacklist))
@@ -50,28 +231,96 @@ func main() {
 	if *flagDomainBlacklist != "" {
 		opts = append(opts, gochinadns.WithDomainBlacklist(*flagDomainBlacklist))
 	}
+	if *flagDomainWhitelist != "" {
+		opts = append(opts, gochinadns.WithDomainWhitelist(*flagDomainWhitelist))
+	}
+	if *flagBlockSchedule != "" {
+		opts = append(opts, gochinadns.WithBlockSchedule(*flagBlockSchedule))
+	}
+	if *flagECHStrip != "" {
+		opts = append(opts, gochinadns.WithECHStrip(*flagECHStrip))
+	}
+	if *flagECHPreserve != "" {
+		opts = append(opts, gochinadns.WithECHPreserve(*flagECHPreserve))
+	}
+	if *flagMutationDomains != "" {
+		opts = append(opts, gochinadns.WithMutationDomains(*flagMutationDomains))
+	}
 	if *flagDomainPolluted != "" {
 		opts = append(opts, gochinadns.WithDomainPolluted(*flagDomainPolluted))
 	}
+	if *flagGFWList != "" {
+		opts = append(opts, gochinadns.WithGFWList(*flagGFWList))
+	}
+	if *flagGeoSite != "" {
+		opts = append(opts, gochinadns.WithGeoSite(*flagGeoSite, strings.Split(*flagGeoSiteTags, ",")...))
+	}
+	for _, sets := range []string{*flagIPSet, *flagNFTSet} {
+		if sets != "" {
+			set4, set6 := splitPair(sets)
+			opts = append(opts, gochinadns.WithForeignIPSets(set4, set6))
+		}
+	}
+	if *flagCacheStrategy != "" {
+		for _, rule := range strings.Split(*flagCacheStrategy, ",") {
+			set, strategy := rule, ""
+			if i := strings.LastIndex(rule, "="); i >= 0 {
+				set, strategy = rule[:i], rule[i+1:]
+			}
+			opts = append(opts, gochinadns.WithCacheStrategy(set, strategy))
+		}
+	}
+	if *flagIPSetMinTTL > 0 {
+		opts = append(opts, gochinadns.WithIPSetMinTTL(*flagIPSetMinTTL))
+	}
+	if *flagHosts != "" {
+		opts = append(opts, gochinadns.WithHosts(*flagHosts))
+	}
+	if *flagRewriteRules != "" {
+		opts = append(opts, gochinadns.WithRewriteRules(*flagRewriteRules))
+	}
+	if *flagForwardRules != "" {
+		opts = append(opts, gochinadns.WithForwardRules(*flagForceTCP, *flagForwardRules))
+	}
+	return opts
+}
+
+// splitPair splits s in format "first[,second]".
+func splitPair(s string) (first, second string) {
+	i := strings.IndexByte(s, ',')
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i+1:]
+}
 
-	copts := []gochinadns.ClientOption{
+// isFlagSet reports whether flag name is set by command line or the config file.
+func isFlagSet(name string) (set bool) {
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return
+}
+
+// clientOptions builds client options from command line flags.
+func clientOptions() []gochinadns.ClientOption {
+	return []gochinadns.ClientOption{
 		gochinadns.WithUDPMaxBytes(*flagUDPMaxBytes),
 		gochinadns.WithTCPOnly(*flagForceTCP),
 		gochinadns.WithMutation(*flagMutation),
 		gochinadns.WithTimeout(*flagTimeout),
 		gochinadns.WithDoHSkipQuerySelf(true),
+		gochinadns.WithPadding(*flagEDNSPadding),
+		gochinadns.WithMaxReplySize(*flagMaxReplySize),
+		gochinadns.WithMaxAdditional(*flagMaxAdditional),
 	}
-
-	client := gochinadns.NewClient(copts...)
-	server, err := gochinadns.NewServer(client, opts...)
-	if err != nil {
-		panic(err)
-	}
-
-	runUntilCanceled(context.Background(), server.Run)
 }
 
-func runUntilCanceled(ctx context.Context, f func() error) {
+// runUntilCanceled runs f with ctx, and runs it again with growing gaps if it fails, until ctx is done.
+// It exits if a listening address is in use, which is retried by -bind-retries instead.
+func runUntilCanceled(ctx context.Context, f func(context.Context) error) {
 	minGap := time.Millisecond * 100
 	maxGap := time.Second * 16
 	gap := minGap
@@ -82,7 +331,11 @@ func runUntilCanceled(ctx context.Context, f func() error) {
 					logrus.Errorf("%s:%s", r, string(debug.Stack()))
 				}
 			}()
-			err := f()
+			err := f(ctx)
+			var bindErr *gochinadns.BindError
+			if errors.As(err, &bindErr) {
+				logrus.WithError(err).Fatal("Fail to listen. Stop the process holding the address, or see -fallback-port.")
+			}
 			if err == nil {
 				gap = minGap
 			} else {
@@ -114,3 +367,43 @@ func trimLocPrefix(s string) string {
 	}
 	return s
 }
+
+// splitArgs splits args into flags of fs and the subcommand with its args, so that flags of fs may go either before
+// or after the subcommand, and flags of the subcommand itself after it. All args are flags if there is no subcommand,
+// so that unknown ones fail parsing.
+func splitArgs(fs *flag.FlagSet, args []string) (flags []string, subcommand string, subArgs []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			subArgs = append(subArgs, args[i:]...)
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' {
+			if subcommand == "" && len(subArgs) == 0 && subcommands[arg] != nil {
+				subcommand = arg
+			} else {
+				subArgs = append(subArgs, arg)
+			}
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		value := strings.Contains(name, "=")
+		if value {
+			name = name[:strings.Index(name, "=")]
+		}
+		f := fs.Lookup(name)
+		if f == nil {
+			subArgs = append(subArgs, arg)
+			continue
+		}
+		flags = append(flags, arg)
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !value && !(ok && b.IsBoolFlag()) && i+1 < len(args) {
+			i++
+			flags = append(flags, args[i])
+		}
+	}
+	if subcommand == "" {
+		return args, "", nil
+	}
+	return flags, subcommand, subArgs
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/cherrot/gochinadns"
+)
+
+// Output formats of subcommands, set by -o.
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// outputSchemaVersion is the version of JSON outputs of subcommands. It's increased on incompatible changes only,
+// so that automation can check whether it understands the output. Fields are only added within a version.
+const outputSchemaVersion = 1
+
+// commandOutput is the JSON output of a subcommand, printed as a single document.
+type commandOutput struct {
+	SchemaVersion int           `json:"schema_version"`
+	Command       string        `json:"command"`
+	Results       interface{}   `json:"results"` // a list of results in the order of arguments, see each subcommand
+	Errors        []outputError `json:"errors"`  // arguments failing the subcommand
+}
+
+// outputError is an argument failing a subcommand in its JSON output.
+type outputError struct {
+	Arg   string `json:"arg"`
+	Error string `json:"error"`
+}
+
+// tr returns message of a subcommand in the language of -lang, formatted with args if any. See gochinadns.Localize.
+func tr(message string, args ...interface{}) string {
+	lang, _ := gochinadns.ParseLanguage(*flagLang)
+	return gochinadns.Localize(lang, message, args...)
+}
+
+// checkOutputFormat checks -o.
+func checkOutputFormat() error {
+	switch *flagOutput {
+	case outputText, outputJSON:
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %s, expect text or json", *flagOutput)
+	}
+}
+
+// commandResults collects results of a subcommand, and prints them by -o: as they are added in text,
+// or at once by print in JSON. Errors are printed to stderr in text.
+type commandResults struct {
+	command string
+	results []interface{}
+	errors  []outputError
+}
+
+func newCommandResults(command string) *commandResults {
+	return &commandResults{command: command, results: []interface{}{}, errors: []outputError{}}
+}
+
+// Add adds result, printing text as a line in text format.
+func (r *commandResults) Add(result interface{}, text string) {
+	if *flagOutput == outputJSON {
+		r.results = append(r.results, result)
+		return
+	}
+	fmt.Println(text)
+}
+
+// Fail adds an error of arg.
+func (r *commandResults) Fail(arg string, err error) {
+	r.errors = append(r.errors, outputError{Arg: arg, Error: err.Error()})
+	if *flagOutput != outputJSON {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", arg, err)
+	}
+}
+
+// Print prints the JSON output, and returns the exit code: 1 if any argument fails, 0 otherwise.
+func (r *commandResults) Print() int {
+	if *flagOutput == outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(&commandOutput{
+			SchemaVersion: outputSchemaVersion,
+			Command:       r.command,
+			Results:       r.results,
+			Errors:        r.errors,
+		})
+	}
+	if len(r.errors) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// setFlag sets flag name to value for the test, restoring it after the test.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	old := flag.Lookup(name).Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = flag.Set(name, old) })
+}
+
+// captureStdout returns what f prints to stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	f()
+	_ = w.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestCheckOutputFormat(t *testing.T) {
+	for format, ok := range map[string]bool{"text": true, "json": true, "yaml": false} {
+		setFlag(t, "o", format)
+		if err := checkOutputFormat(); (err == nil) != ok {
+			t.Errorf("checkOutputFormat(%s) = %v", format, err)
+		}
+	}
+}
+
+func TestCommandResultsText(t *testing.T) {
+	setFlag(t, "o", outputText)
+	var code int
+	out := captureStdout(t, func() {
+		r := newCommandResults("test")
+		r.Add(map[string]int{"n": 1}, "first")
+		r.Add(map[string]int{"n": 2}, "second")
+		code = r.Print()
+	})
+	if out != "first\nsecond\n" || code != 0 {
+		t.Errorf("Unexpected text output %q with exit code %d", out, code)
+	}
+}
+
+func TestCommandResultsJSON(t *testing.T) {
+	setFlag(t, "o", outputJSON)
+	var code int
+	out := captureStdout(t, func() {
+		r := newCommandResults("test")
+		r.Add(map[string]int{"n": 1}, "first")
+		r.Fail("bogus", errors.New("invalid"))
+		r.Add(map[string]int{"n": 2}, "second")
+		code = r.Print()
+	})
+	if code != 1 {
+		t.Errorf("Exit code should be 1 with errors, got %d", code)
+	}
+	var doc struct {
+		SchemaVersion int              `json:"schema_version"`
+		Command       string           `json:"command"`
+		Results       []map[string]int `json:"results"`
+		Errors        []outputError    `json:"errors"`
+	}
+	if err := json.Unmarshal([]byte(out), &doc); err != nil {
+		t.Fatalf("Output is not a JSON document: %v\n%s", err, out)
+	}
+	if doc.SchemaVersion != outputSchemaVersion || doc.Command != "test" || len(doc.Results) != 2 || doc.Results[1]["n"] != 2 {
+		t.Errorf("Unexpected output %s", out)
+	}
+	if len(doc.Errors) != 1 || doc.Errors[0] != (outputError{Arg: "bogus", Error: "invalid"}) {
+		t.Errorf("Unexpected errors %+v", doc.Errors)
+	}
+
+	// Empty lists are printed as such rather than null.
+	out = captureStdout(t, func() { newCommandResults("test").Print() })
+	if !strings.Contains(out, `"results": []`) || !strings.Contains(out, `"errors": []`) {
+		t.Errorf("Unexpected empty output %s", out)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	setFlag(t, "o", outputJSON)
+	var code int
+	out := captureStdout(t, func() { code = runCheckConfig(nil) })
+	var doc struct {
+		Results []checkConfigResult `json:"results"`
+	}
+	if err := json.Unmarshal([]byte(out), &doc); err != nil || code != 0 {
+		t.Fatalf("Unexpected output with exit code %d: %v\n%s", code, err, out)
+	}
+	if len(doc.Results) != 1 || !doc.Results[0].Valid || len(doc.Results[0].Config.UntrustedServers) == 0 {
+		t.Errorf("Unexpected results %+v", doc.Results)
+	}
+
+	setFlag(t, "c", "./missing.list")
+	out = captureStdout(t, func() { code = runCheckConfig(nil) })
+	if code != 1 || !strings.Contains(out, "missing.list") {
+		t.Errorf("Missing list should fail with exit code 1, got %d: %s", code, out)
+	}
+	if code = runCheckConfig([]string{"extra"}); code != 2 {
+		t.Errorf("Extra arguments should fail with exit code 2, got %d", code)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/cherrot/gochinadns"
+)
+
+// setNameRedactor redacts names in logs and the admin API by -redact-names.
+func setNameRedactor() error {
+	if *flagRedactNames == "" {
+		return nil
+	}
+	key, err := readRedactKey()
+	if err != nil {
+		return err
+	}
+	switch *flagRedactNames {
+	case "hmac":
+		gochinadns.SetNameRedactor(gochinadns.NewHMACRedactor(key))
+	case "encrypt":
+		r, err := gochinadns.NewAESRedactor(key)
+		if err != nil {
+			return err
+		}
+		gochinadns.SetNameRedactor(r)
+	default:
+		return fmt.Errorf("unknown name redaction mode %s, expect hmac or encrypt", *flagRedactNames)
+	}
+	return nil
+}
+
+func readRedactKey() ([]byte, error) {
+	if *flagRedactKeyFile == "" {
+		return nil, fmt.Errorf("-redact-key-file is required to redact names")
+	}
+	key, err := os.ReadFile(*flagRedactKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key = bytes.TrimSpace(key)
+	if len(key) == 0 {
+		return nil, fmt.Errorf("empty key in %s", *flagRedactKeyFile)
+	}
+	return key, nil
+}
+
+// decryptResult is a result of the decrypt-name subcommand in JSON output.
+type decryptResult struct {
+	Token string `json:"token"`
+	Name  string `json:"name"`
+}
+
+// runDecryptName decrypts names encrypted with -redact-names encrypt, one per line, or decryptResult in JSON output.
+// It returns 2 on usage error, and 1 if any name fails to decrypt.
+func runDecryptName(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, tr("Usage: chinadns -redact-key-file FILE decrypt-name TOKEN..."))
+		return 2
+	}
+	key, err := readRedactKey()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	results := newCommandResults("decrypt-name")
+	for _, arg := range args {
+		name, err := gochinadns.DecryptName(key, arg)
+		if err != nil {
+			results.Fail(arg, err)
+			continue
+		}
+		results.Add(&decryptResult{Token: arg, Name: name}, arg+"\t"+name)
+	}
+	return results.Print()
+}
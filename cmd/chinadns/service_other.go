@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// runService is only supported on Windows.
+func runService([]string) int {
+	fmt.Fprintln(os.Stderr, tr("The service subcommand is only supported on Windows. Run chinadns by the init system, like systemd, procd or launchd."))
+	return 1
+}
+
+// initService tells whether the process runs as a Windows service, which is never on this platform.
+func initService(string) (bool, error) {
+	return false, nil
+}
+
+// serveService is only supported on Windows.
+func serveService(string, func(), context.CancelFunc) error {
+	return errors.New("service is unsupported on this platform")
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceStopTimeout is how long the service subcommand waits for the service to stop.
+const serviceStopTimeout = 30 * time.Second
+
+// runService installs, uninstalls, starts or stops the Windows service named by -service-name. The service runs the
+// executable with the options of the install command, so paths in them should be absolute, or relative to the
+// directory of the executable, which is the working directory of the service. It returns 2 on usage error.
+func runService(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintln(os.Stderr, tr("Usage: chinadns [options] service install|uninstall|start|stop\n"+
+			"The service runs with the options of install."))
+		return 2
+	}
+	var err error
+	switch args[0] {
+	case "install":
+		err = installService(*flagServiceName, serviceArgs())
+	case "uninstall":
+		err = uninstallService(*flagServiceName)
+	case "start":
+		err = controlService(*flagServiceName, func(s *mgr.Service) error { return s.Start() })
+	case "stop":
+		err = controlService(*flagServiceName, stopService)
+	default:
+		fmt.Fprintln(os.Stderr, tr("Unknown service action %s", args[0]))
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// serviceArgs returns the options on the command line, without the service subcommand and its action.
+// Flags are only parsed before the first non-flag argument, which is either the subcommand or its action.
+func serviceArgs() []string {
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "service" {
+		args = args[1:]
+	}
+	return args[:len(args)-len(flag.Args())]
+}
+
+func installService(name string, args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "ChinaDNS (" + name + ")",
+		Description: "DNS forwarder picking answers of China and trusted upstreams.",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if err = eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		_ = s.Delete()
+		return fmt.Errorf("fail to register event log source: %w", err)
+	}
+	return nil
+}
+
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer s.Close()
+	if err = s.Delete(); err != nil {
+		return err
+	}
+	_ = eventlog.Remove(name)
+	return nil
+}
+
+func controlService(name string, f func(*mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer s.Close()
+	return f(s)
+}
+
+// stopService stops s, and waits until it's stopped, draining queries being served.
+func stopService(s *mgr.Service) error {
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(serviceStopTimeout)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for service %s to stop", s.Name)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// initService tells whether the process runs as a Windows service. If so, the working directory is changed to the
+// directory of the executable (rather than System32), and logs are written to the Windows event log as well.
+func initService(name string) (bool, error) {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil || interactive {
+		return false, err
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return true, err
+	}
+	if err = os.Chdir(filepath.Dir(exe)); err != nil {
+		return true, err
+	}
+	elog, err := eventlog.Open(name)
+	if err != nil {
+		return true, fmt.Errorf("fail to open event log: %w", err)
+	}
+	logrus.AddHook(&eventLogHook{elog})
+	return true, nil
+}
+
+// serveService runs serve as the Windows service name until it returns, and calls cancel to make it return when the
+// service is stopped, or the system shuts down.
+func serveService(name string, serve func(), cancel context.CancelFunc) error {
+	return svc.Run(name, &windowsService{serve: serve, cancel: cancel})
+}
+
+// windowsService is the handler of the Windows service.
+type windowsService struct {
+	serve  func()
+	cancel context.CancelFunc
+}
+
+func (s *windowsService) Execute(_ []string, r <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.serve()
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case <-done:
+			return false, 0
+		case c := <-r:
+			switch c.Cmd {
+			case svc.Interrogate:
+				status <- c.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				logrus.Info("Service is stopping. Shutting down.")
+				status <- svc.Status{State: svc.StopPending}
+				s.cancel()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
+
+// eventLogHook writes logs to the Windows event log.
+type eventLogHook struct {
+	log *eventlog.Log
+}
+
+func (h *eventLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *eventLogHook) Fire(entry *logrus.Entry) error {
+	msg, err := entry.String()
+	if err != nil {
+		return err
+	}
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		return h.log.Error(1, msg)
+	case logrus.WarnLevel:
+		return h.log.Warning(1, msg)
+	default:
+		return h.log.Info(1, msg)
+	}
+}
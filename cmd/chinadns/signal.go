@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/cherrot/gochinadns"
+)
+
+// handleDumpSignal writes a state dump of server into dir each time SIGQUIT is received.
+// Note that this overrides Go runtime's default SIGQUIT behavior (dump stacks and exit).
+func handleDumpSignal(server *gochinadns.Server, dir string) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGQUIT)
+	go func() {
+		for range sig {
+			path, err := dumpState(server, dir)
+			if err != nil {
+				logrus.WithError(err).Error("Fail to dump server state.")
+				continue
+			}
+			logrus.Info("Server state dumped to ", path)
+		}
+	}()
+}
+
+// handleReloadSignal reloads lists of server each time SIGHUP is received.
+func handleReloadSignal(server *gochinadns.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			if err := server.Reload(); err != nil {
+				logrus.WithError(err).Error("Fail to reload lists. Keep using the old ones.")
+			}
+		}
+	}()
+}
+
+// handleStopSignal calls cancel when SIGTERM or SIGINT is received, e.g. when procd stops the service,
+// so that the server stops accepting queries and drains queries being served before exiting.
+func handleStopSignal(cancel context.CancelFunc) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		logrus.Infof("Received %s. Shutting down.", <-sig)
+		cancel()
+	}()
+}
+
+func dumpState(server *gochinadns.Server, dir string) (path string, err error) {
+	name := fmt.Sprintf("chinadns-dump-%d-%s.txt", os.Getpid(), time.Now().Format("20060102-150405"))
+	path = filepath.Join(dir, name)
+	file, err := os.Create(path)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if e := file.Close(); err == nil {
+			err = e
+		}
+	}()
+	err = server.DumpState(file)
+	return
+}
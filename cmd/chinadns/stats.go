@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cherrot/gochinadns"
+)
+
+// statsTimeout limits fetching stats from the running server.
+const statsTimeout = 5 * time.Second
+
+// runStats fetches stats of the running server from its admin API on -admin-listen, and prints a report with at
+// most TOP domains and clients each (gochinadns.DefaultStatsTop if absent):
+//
+//	Queries since <time>: <n> (<cached>% cached, <blocked>% blocked)
+//
+//	Top domains:
+//	  <count>  <domain>
+//	...
+//
+// or gochinadns.StatsReport in JSON output. It returns 2 on usage error, and 1 if stats can't be fetched.
+func runStats(args []string) int {
+	top := gochinadns.DefaultStatsTop
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 || len(args) > 1 {
+			fmt.Fprintln(os.Stderr, tr("Usage: chinadns [options] stats [TOP]\n"+
+				"Stats are fetched from the running server by -admin-listen, and kept for -stats-period."))
+			return 2
+		}
+		top = n
+	}
+	if *flagAdminListen == "" {
+		fmt.Fprintln(os.Stderr, tr("The stats subcommand needs -admin-listen of the running server."))
+		return 2
+	}
+
+	results := newCommandResults("stats")
+	report, err := fetchStats(adminAddr(), top)
+	if err != nil {
+		results.Fail("stats", err)
+	} else {
+		results.Add(report, formatStats(report))
+	}
+	return results.Print()
+}
+
+// adminAddr returns the address of the admin API of the running server, by -admin-listen.
+func adminAddr() string {
+	host, port, _ := net.SplitHostPort(*flagAdminListen)
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func fetchStats(addr string, top int) (*gochinadns.StatsReport, error) {
+	cli := &http.Client{Timeout: statsTimeout}
+	resp, err := cli.Get("http://" + addr + "/stats?top=" + strconv.Itoa(top))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&e)
+		return nil, fmt.Errorf("%s: %s", resp.Status, e.Error)
+	}
+	report := new(gochinadns.StatsReport)
+	if err = json.NewDecoder(resp.Body).Decode(report); err != nil {
+		return nil, fmt.Errorf("invalid stats: %w", err)
+	}
+	return report, nil
+}
+
+func formatStats(r *gochinadns.StatsReport) string {
+	percent := func(n uint64) float64 {
+		if r.Queries == 0 {
+			return 0
+		}
+		return float64(n) * 100 / float64(r.Queries)
+	}
+	var b strings.Builder
+	b.WriteString(tr("Queries since %s: %d (%.1f%% cached, %.1f%% blocked)",
+		r.Since.Local().Format("2006-01-02 15:04:05"), r.Queries, percent(r.Cached), percent(r.Blocked)) + "\n")
+	for _, section := range []struct {
+		title  string
+		counts []gochinadns.StatsCount
+	}{
+		{"Top domains", r.TopDomains},
+		{"Top blocked domains", r.TopBlocked},
+		{"Top clients", r.TopClients},
+		{"Answers by upstream", r.Upstreams},
+		{"Answers by country", r.Countries},
+	} {
+		fmt.Fprintf(&b, "\n%s:\n", tr(section.title))
+		if len(section.counts) == 0 {
+			b.WriteString("  -\n")
+		}
+		for _, c := range section.counts {
+			fmt.Fprintf(&b, "  %8d  %s\n", c.Count, c.Name)
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
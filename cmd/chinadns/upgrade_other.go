@@ -0,0 +1,17 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package main
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/cherrot/gochinadns"
+)
+
+// handleUpgradeSignal is unsupported on this platform.
+func handleUpgradeSignal(*gochinadns.Server, context.CancelFunc) {
+	logrus.Warn("Upgrade is unsupported on this platform.")
+}
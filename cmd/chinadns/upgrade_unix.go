@@ -0,0 +1,35 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/cherrot/gochinadns"
+)
+
+// handleUpgradeSignal upgrades server to the current executable each time SIGUSR2 is received,
+// and calls cancel to drain queries and exit once the new process serves.
+func handleUpgradeSignal(server *gochinadns.Server, cancel context.CancelFunc) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR2)
+	go func() {
+		for range sig {
+			logrus.Info("Received SIGUSR2. Upgrading.")
+			proc, err := server.Upgrade()
+			if err != nil {
+				logrus.WithError(err).Error("Fail to upgrade. Keep serving.")
+				continue
+			}
+			logrus.Infof("New process %d is serving. Shutting down.", proc.Pid)
+			cancel()
+			return
+		}
+	}()
+}
@@ -4,6 +4,7 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"net"
@@ -21,8 +22,70 @@ var (
 	flagMutation    = flag.Bool("m", false, "Enable compression pointer mutation in DNS queries.")
 	flagTimeout     = flag.Duration("timeout", 2*time.Second, "DNS request timeout")
 	flagVerbose     = flag.Bool("v", false, "Enable verbose logging.")
+	flagOutput      = flag.String("o", "text", "Output format: text or json (a document with the same schema as subcommands of chinadns).")
 )
 
+// outputSchemaVersion is the version of the JSON output, the same as that of subcommands of chinadns.
+const outputSchemaVersion = 1
+
+// output is the JSON output, in the same schema as subcommands of chinadns.
+type output struct {
+	SchemaVersion int            `json:"schema_version"`
+	Command       string         `json:"command"`
+	Results       []lookupResult `json:"results"`
+	Errors        []outputError  `json:"errors"`
+}
+
+type outputError struct {
+	Arg   string `json:"arg"`
+	Error string `json:"error"`
+}
+
+// lookupResult is the reply of a lookup in JSON output.
+type lookupResult struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Server     string   `json:"server"`
+	Rcode      string   `json:"rcode"`
+	RTT        int64    `json:"rtt_ms"`
+	Answer     []string `json:"answer"`
+	Authority  []string `json:"authority"`
+	Additional []string `json:"additional"`
+}
+
+func recordStrings(rrs []dns.RR) []string {
+	ret := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		ret = append(ret, rr.String())
+	}
+	return ret
+}
+
+// printJSON prints the JSON output of a lookup of m by resolver, and returns the exit code.
+func printJSON(m, r *dns.Msg, rtt time.Duration, resolver *gochinadns.Resolver, err error) int {
+	out := &output{SchemaVersion: outputSchemaVersion, Command: "lookup", Results: []lookupResult{}, Errors: []outputError{}}
+	code := 0
+	if r == nil {
+		out.Errors = append(out.Errors, outputError{Arg: m.Question[0].Name, Error: err.Error()})
+		code = 1
+	} else {
+		out.Results = append(out.Results, lookupResult{
+			Name:       m.Question[0].Name,
+			Type:       dns.TypeToString[m.Question[0].Qtype],
+			Server:     resolver.String(),
+			Rcode:      dns.RcodeToString[r.Rcode],
+			RTT:        rtt.Milliseconds(),
+			Answer:     recordStrings(r.Answer),
+			Authority:  recordStrings(r.Ns),
+			Additional: recordStrings(r.Extra),
+		})
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(out)
+	return code
+}
+
 func usage() {
 	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [options] [proto[+proto]]@server www.domain.com\n", os.Args[0])
 	fmt.Fprintln(flag.CommandLine.Output(), "Where proto being one of: ", gochinadns.SupportedProtocols())
@@ -33,6 +96,10 @@ func usage() {
 func main() {
 	flag.Usage = usage
 	flag.Parse()
+	if *flagOutput != "text" && *flagOutput != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %s, expect text or json\n", *flagOutput)
+		os.Exit(2)
+	}
 
 	if *flagVerbose {
 		logrus.SetLevel(logrus.DebugLevel)
@@ -53,6 +120,9 @@ func main() {
 	m.RecursionDesired = true
 
 	r, rtt, err := client.Lookup(m, resolver)
+	if *flagOutput == "json" {
+		os.Exit(printJSON(m, r, rtt, resolver, err))
+	}
 
 	if r == nil {
 		logrus.Fatalln(err)
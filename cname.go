@@ -0,0 +1,98 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// WithCNAMEChase chases CNAME chains dangling in answers of A and AAAA questions (without addresses of the last
+// target) by up to depth follow-up queries of the targets, through the upstream replying the chain. Addresses at the
+// end of the chain are evaluated like those of any answer (China routes, blacklist and DNSSEC), so that poisoning
+// behind CNAME indirection is caught. Targets cached are answered from the cache. Disabled if 0.
+func WithCNAMEChase(depth int) ServerOption {
+	return func(o *serverOptions) error {
+		if depth < 0 {
+			return fmt.Errorf("invalid CNAME chase depth: %d", depth)
+		}
+		o.CNAMEChaseDepth = depth
+		return nil
+	}
+}
+
+// chaseCNAME follows the CNAME chain dangling at the end of the answer of rep, and returns a copy of rep with answers
+// of the targets appended, or nil if it's not chased or the chase fails. The chain is abandoned on loops, on targets
+// beyond CNAMEChaseDepth, and on polluted targets of untrusted servers, which are never queried of them.
+func (s *Server) chaseCNAME(ctx context.Context, logger *logrus.Entry, rep *upstreamReply) *upstreamReply {
+	if s.CNAMEChaseDepth <= 0 || rep.server == nil || len(rep.Question) == 0 {
+		return nil
+	}
+	q := rep.Question[0]
+	if q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA {
+		return nil
+	}
+	lookup, trusted := s.lookupUntrusted, false
+	trustedServers, _ := s.resolvers()
+	for _, r := range trustedServers {
+		if r == rep.server {
+			lookup, trusted = s.lookupTrusted, true
+			break
+		}
+	}
+
+	chased := &upstreamReply{Msg: rep.Msg.Copy(), server: rep.server, rtt: rep.rtt}
+	seen := map[string]bool{strings.ToLower(q.Name): true}
+	for _, rr := range chased.Answer {
+		seen[strings.ToLower(rr.Header().Name)] = true
+	}
+	for depth := 0; depth < s.CNAMEChaseDepth; depth++ {
+		cname, ok := chased.Answer[len(chased.Answer)-1].(*dns.CNAME)
+		if !ok {
+			return chased
+		}
+		target := cname.Target
+		logger := logger.WithField("target", RedactName(target))
+		if seen[strings.ToLower(target)] {
+			logger.Warn("CNAME chain loops. Stop chasing it.")
+			return nil
+		}
+		if !trusted && s.isDomainPolluted(target) {
+			logger.Debug("CNAME target is polluted. Stop chasing it in untrusted servers.")
+			return nil
+		}
+
+		tq := dns.Question{Name: target, Qtype: q.Qtype, Qclass: q.Qclass}
+		m, _ := s.cacheGet(&tq)
+		if m != nil {
+			logger.Debug("Chase CNAME in cache.")
+		} else {
+			logger.Debug("Chase CNAME.")
+			req := new(dns.Msg)
+			req.SetQuestion(target, q.Qtype)
+			req.Question[0].Qclass = q.Qclass
+			s.normalizeRequest(req)
+			reply, rtt, err := lookup(ctx, req, rep.server)
+			chased.rtt += rtt
+			if err != nil || reply == nil || reply.Rcode != dns.RcodeSuccess {
+				logger.WithError(err).Debug("Fail to chase CNAME.")
+				return nil
+			}
+			m = reply
+		}
+		if len(m.Answer) == 0 {
+			return nil
+		}
+		for _, rr := range m.Answer {
+			seen[strings.ToLower(rr.Header().Name)] = true
+		}
+		chased.Answer = append(chased.Answer, m.Answer...)
+	}
+	if _, ok := chased.Answer[len(chased.Answer)-1].(*dns.CNAME); !ok {
+		return chased
+	}
+	logger.Debug("CNAME chain is longer than the chase depth.")
+	return nil
+}
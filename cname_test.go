@@ -0,0 +1,90 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCNAMEChase(t *testing.T) {
+	china := writeTestList(t, "china.list", "1.0.1.0/24\n")
+	cname := func(name, target string) *dns.CNAME {
+		return &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60}, Target: target}
+	}
+	for _, tc := range []struct {
+		name    string
+		depth   int
+		target  []dns.RR // answer of cdn.example.net. from the untrusted server
+		cached  string   // cached address of cdn.example.net.
+		trusted bool     // whether the trusted reply is chosen
+		answers int
+	}{
+		{"disabled", 0, nil, "", false, 1},
+		{"china", 3, newTestReply("cdn.example.net.", 60, "1.0.1.1").Answer, "", false, 2},
+		{"overseas", 3, newTestReply("cdn.example.net.", 60, "8.8.8.8").Answer, "", true, 1},
+		{"chain", 3, append([]dns.RR{cname("cdn.example.net.", "edge.example.net.")}, newTestReply("edge.example.net.", 60, "1.0.1.1").Answer...), "", false, 3},
+		{"too long", 1, []dns.RR{cname("cdn.example.net.", "edge.example.net.")}, "", false, 1},
+		{"loop", 3, []dns.RR{cname("cdn.example.net.", "www.example.com.")}, "", false, 1},
+		{"cached", 3, nil, "1.0.1.2", false, 2},
+	} {
+		o := newServerOptions()
+		o.Delay = time.Second
+		trusted := NewUpstreamResolver("trusted", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			}
+			m := newTestReply(req.Question[0].Name, 60, "142.250.1.1")
+			m.Id = req.Id
+			return m, 50 * time.Millisecond, nil
+		}))
+		untrusted := NewUpstreamResolver("untrusted", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			switch req.Question[0].Name {
+			case "www.example.com.":
+				m.Answer = []dns.RR{cname("www.example.com.", "cdn.example.net.")}
+			case "cdn.example.net.":
+				if tc.target == nil {
+					return nil, 0, errors.New("unexpected query")
+				}
+				m.Answer = tc.target
+			}
+			return m, time.Millisecond, nil
+		}))
+		for _, f := range []ServerOption{WithCHNList(china), WithUpstreams(true, trusted), WithUpstreams(false, untrusted), WithCNAMEChase(tc.depth)} {
+			if err := f(o); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second)), goroutines: newGoroutineTracker(), cache: NewMemoryCache(10, 0)}
+		if err := s.partitionResolvers(); err != nil {
+			t.Fatal(err)
+		}
+		if tc.cached != "" {
+			m := newTestReply("cdn.example.net.", 60, tc.cached)
+			s.cacheSet(&m.Question[0], m, Provenance{})
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		reply := s.resolve(context.Background(), logrus.WithField("test", t.Name()), req)
+		if reply == nil {
+			t.Fatalf("%s: no reply", tc.name)
+		}
+		if got := reply.server == trusted; got != tc.trusted {
+			t.Errorf("%s: trusted reply chosen %v, want %v", tc.name, got, tc.trusted)
+		}
+		if len(reply.Answer) != tc.answers {
+			t.Errorf("%s: unexpected answer %v", tc.name, reply.Answer)
+		}
+	}
+	if err := WithCNAMEChase(-1)(newServerOptions()); err == nil {
+		t.Error("Negative depth should fail")
+	}
+}
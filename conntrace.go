@@ -0,0 +1,197 @@
+package gochinadns
+
+import (
+	"context"
+	"crypto/tls"
+	"expvar"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/cherrot/gochinadns/dot"
+	"github.com/cherrot/gochinadns/proxy"
+)
+
+// Phases of connections to upstreams in ConnEvent.
+const (
+	ConnDialStart    = "dial-start"    // a connection is being dialed
+	ConnDialed       = "dialed"        // a connection is dialed, in Duration
+	ConnDialFailed   = "dial-failed"   // a connection fails to be dialed by Err, in Duration
+	ConnTLSHandshake = "tls-handshake" // a TLS handshake is done in Duration, failing if Err is not nil
+	ConnReused       = "reused"        // a kept-alive connection is reused for a query
+)
+
+// upstreamConns has counters of connections to upstreams keyed by network and address, like "tcp 8.8.8.8:53".
+var upstreamConns = expvar.NewMap("chinadns_upstream_conns")
+
+// upstreamConnsMu serializes adding counters of an address to upstreamConns.
+var upstreamConnsMu sync.Mutex
+
+// ConnEvent is a lifecycle event of a connection to an upstream.
+type ConnEvent struct {
+	Phase    string        // see ConnXXX
+	Network  string        // "udp", "tcp", "tls" (DoT) or "https" (DoH)
+	Addr     string        // address of the upstream, which is the URL for DoH
+	Duration time.Duration // time taken to dial or handshake
+	Err      error
+}
+
+// WithDialContext connects to upstreams by dial over all transports, including UDP, e.g. to pick source addresses or
+// interfaces per upstream. DoT and DoH connections are dialed on "tcp". Unlike WithDialer, UDP queries are kept, and
+// WithDialer takes precedence where both are set. Proxies of the environment are ignored by DoH queries then.
+func WithDialContext(dial proxy.DialFunc) ClientOption {
+	return func(o *clientOptions) {
+		o.DialContext = dial
+	}
+}
+
+// WithConnObserver calls f on lifecycle events of connections to upstreams, which are counted in
+// chinadns_upstream_conns anyway. f is called synchronously in the lookup, so it should return quickly.
+func WithConnObserver(f func(*ConnEvent)) ClientOption {
+	return func(o *clientOptions) {
+		o.ConnObservers = append(o.ConnObservers, f)
+	}
+}
+
+// emitConn counts e in upstreamConns, and calls observers of c.
+func (c *Client) emitConn(e *ConnEvent) {
+	counters := connCounters(e.Network + " " + e.Addr)
+	ms := float64(e.Duration) / float64(time.Millisecond)
+	switch e.Phase {
+	case ConnDialed:
+		counters.Add("dials", 1)
+		counters.AddFloat("dial_ms", ms)
+	case ConnDialFailed:
+		counters.Add("dials", 1)
+		counters.Add("dial_errors", 1)
+	case ConnTLSHandshake:
+		counters.Add("handshakes", 1)
+		if e.Err != nil {
+			counters.Add("handshake_errors", 1)
+		} else {
+			counters.AddFloat("handshake_ms", ms)
+		}
+	case ConnReused:
+		counters.Add("reuses", 1)
+	}
+	for _, f := range c.ConnObservers {
+		f(e)
+	}
+}
+
+// connCounters returns counters of key in upstreamConns, which are added if absent.
+func connCounters(key string) *expvar.Map {
+	if m, ok := upstreamConns.Get(key).(*expvar.Map); ok {
+		return m
+	}
+	upstreamConnsMu.Lock()
+	defer upstreamConnsMu.Unlock()
+	if m, ok := upstreamConns.Get(key).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map).Init()
+	upstreamConns.Set(key, m)
+	return m
+}
+
+// dialContext connects to addr on network by the proxy (TCP only) or DialContext if set, or a plain dialer otherwise,
+// emitting its events.
+func (c *Client) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	dial := c.DialContext
+	if c.Dial != nil && network != "udp" {
+		dial = c.Dial
+	}
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	c.emitConn(&ConnEvent{Phase: ConnDialStart, Network: network, Addr: addr})
+	start := time.Now()
+	conn, err := dial(ctx, network, addr)
+	e := &ConnEvent{Phase: ConnDialed, Network: network, Addr: addr, Duration: time.Since(start), Err: err}
+	if err != nil {
+		e.Phase = ConnDialFailed
+	}
+	c.emitConn(e)
+	return conn, err
+}
+
+// dialTimeout is dialContext bounded by the timeout of c.
+func (c *Client) dialTimeout(network, addr string) (net.Conn, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = dnsTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.dialContext(ctx, network, addr)
+}
+
+// dialUDP connects a UDP socket to addr.
+func (c *Client) dialUDP(addr string) (*dns.Conn, error) {
+	conn, err := c.dialTimeout("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+// dotTrace returns the trace of DoT connections of c.
+func (c *Client) dotTrace() *dot.Trace {
+	return &dot.Trace{
+		TLSHandshakeDone: func(address string, d time.Duration, err error) {
+			c.emitConn(&ConnEvent{Phase: ConnTLSHandshake, Network: "tls", Addr: address, Duration: d, Err: err})
+		},
+		ConnReused: func(address string) {
+			c.emitConn(&ConnEvent{Phase: ConnReused, Network: "tls", Addr: address})
+		},
+	}
+}
+
+// withDoHTrace returns a context of ctx tracing connections of the DoH query to url.
+func (c *Client) withDoHTrace(ctx context.Context, url string) context.Context {
+	var (
+		mu        sync.Mutex
+		dials     = make(map[string]time.Time) // by dialed address, which may be raced (RFC 8305)
+		handshake time.Time
+	)
+	emit := func(phase string, d time.Duration, err error) {
+		c.emitConn(&ConnEvent{Phase: phase, Network: "https", Addr: url, Duration: d, Err: err})
+	}
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			dials[addr] = time.Now()
+			mu.Unlock()
+			emit(ConnDialStart, 0, nil)
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			d := time.Since(dials[addr])
+			mu.Unlock()
+			if err != nil {
+				emit(ConnDialFailed, d, err)
+			} else {
+				emit(ConnDialed, d, nil)
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			handshake = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			mu.Lock()
+			d := time.Since(handshake)
+			mu.Unlock()
+			emit(ConnTLSHandshake, d, err)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				emit(ConnReused, 0, nil)
+			}
+		},
+	})
+}
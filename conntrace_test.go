@@ -0,0 +1,68 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestDialContext(t *testing.T) {
+	addr := startTestUpstream(t)
+	var (
+		mu       sync.Mutex
+		networks []string
+		phases   = make(map[string]int)
+	)
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mu.Lock()
+		networks = append(networks, network)
+		mu.Unlock()
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+	c := NewClient(WithTimeout(time.Second), WithDialContext(dial), WithConnObserver(func(e *ConnEvent) {
+		mu.Lock()
+		phases[e.Network+" "+e.Phase]++
+		mu.Unlock()
+	}))
+
+	req := new(dns.Msg).SetQuestion("www.qq.com.", dns.TypeA)
+	if _, _, err := c.exchangeUDP(context.Background(), req.Copy(), addr); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, _, err := c.exchangeTCP(context.Background(), req.Copy(), addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mu.Lock()
+	if len(networks) != 2 || networks[0] != "udp" || networks[1] != "tcp" {
+		t.Errorf("Unexpected networks dialed %v", networks)
+	}
+	for _, p := range []string{"udp " + ConnDialStart, "udp " + ConnDialed, "tcp " + ConnDialed, "tcp " + ConnReused} {
+		if phases[p] != 1 {
+			t.Errorf("Expect an event of %s, got %v", p, phases)
+		}
+	}
+	mu.Unlock()
+	if v, ok := connCounters("tcp " + addr).Get("reuses").(*expvar.Int); !ok || v.Value() != 1 {
+		t.Errorf("Unexpected counters %s", connCounters("tcp "+addr))
+	}
+
+	// Counters are global, so reset those of the address for repeated runs.
+	upstreamConns.Delete("udp 192.0.2.1:53")
+	failed := NewClient(WithDialContext(func(context.Context, string, string) (net.Conn, error) {
+		return nil, errors.New("no route")
+	}))
+	if _, _, err := failed.exchangeUDP(context.Background(), req.Copy(), "192.0.2.1:53"); err == nil {
+		t.Fatal("Query should fail by the dialer")
+	}
+	if v, ok := connCounters("udp 192.0.2.1:53").Get("dial_errors").(*expvar.Int); !ok || v.Value() != 1 {
+		t.Errorf("Unexpected counters %s", connCounters("udp 192.0.2.1:53"))
+	}
+}
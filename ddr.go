@@ -0,0 +1,114 @@
+package gochinadns
+
+import (
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cherrot/gochinadns/dot"
+)
+
+// ddrName is the special-use name to discover designated resolvers of an unencrypted resolver (RFC 9462).
+const ddrName = "_dns.resolver.arpa."
+
+// WithDDR discovers DoT endpoints of UDP and TCP upstreams by Discovery of Designated Resolvers (RFC 9462) when
+// probing (see WithProbeInterval), and upgrades upstreams to them like WithOpportunisticDoT, even on ports other
+// than 853. A designated resolver is used only if it's verified as the same server: it's reachable at the IP of the
+// upstream (so SVCB records hinting other IPs are skipped), and its certificate is valid for that IP.
+// DoH designated resolvers are not used.
+func WithDDR(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.DDR = b
+		return nil
+	}
+}
+
+// discoverDoT returns the address of a verified DoT designated resolver of r at ip, which probe is sent to by dotCli,
+// or an empty string if none.
+func (s *Server) discoverDoT(r *Resolver, ip net.IP, probe *dns.Msg, dotCli *dot.Client) string {
+	req := new(dns.Msg)
+	req.SetQuestion(ddrName, dns.TypeSVCB)
+	reply, _, err := s.UDPCli.Exchange(req, r.GetAddr())
+	if err != nil || reply.Rcode != dns.RcodeSuccess {
+		return ""
+	}
+	for _, addr := range designatedDoTAddrs(reply, ip) {
+		// The certificate is verified against the IP, since no server name is given (RFC 9462 section 4.2).
+		if _, _, err := dotCli.Exchange(probe.Copy(), addr, ""); err != nil {
+			logrus.WithField("server", r).WithError(err).Debugf("Fail to verify designated resolver %s.", addr)
+			continue
+		}
+		logrus.WithField("server", r).Debugf("Discovered designated resolver %s.", addr)
+		return addr
+	}
+	return ""
+}
+
+// designatedDoTAddrs returns DoT addresses at ip designated by SVCB records in m, in order of priority.
+// Records without the dot ALPN, with hints of the same family excluding ip, or with unknown mandatory keys are skipped.
+func designatedDoTAddrs(m *dns.Msg, ip net.IP) []string {
+	var records []*dns.SVCB
+	for _, rr := range m.Answer {
+		if svcb, ok := rr.(*dns.SVCB); ok && svcb.Priority > 0 {
+			records = append(records, svcb)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+
+	var addrs []string
+	for _, svcb := range records {
+		if addr, ok := designatedDoTAddr(svcb, ip); ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+func designatedDoTAddr(svcb *dns.SVCB, ip net.IP) (string, bool) {
+	var (
+		dot  bool
+		port = dotPort
+	)
+	for _, kv := range svcb.Value {
+		switch kv := kv.(type) {
+		case *dns.SVCBMandatory:
+			for _, key := range kv.Code {
+				switch key {
+				case dns.SVCB_ALPN, dns.SVCB_PORT, dns.SVCB_IPV4HINT, dns.SVCB_IPV6HINT:
+				default:
+					return "", false
+				}
+			}
+		case *dns.SVCBAlpn:
+			for _, alpn := range kv.Alpn {
+				dot = dot || alpn == "dot"
+			}
+		case *dns.SVCBPort:
+			port = strconv.Itoa(int(kv.Port))
+		case *dns.SVCBIPv4Hint:
+			if ip.To4() != nil && !containsIP(kv.Hint, ip) {
+				return "", false
+			}
+		case *dns.SVCBIPv6Hint:
+			if ip.To4() == nil && !containsIP(kv.Hint, ip) {
+				return "", false
+			}
+		}
+	}
+	if !dot {
+		return "", false
+	}
+	return net.JoinHostPort(ip.String(), port), true
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package gochinadns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDesignatedDoTAddrs(t *testing.T) {
+	svcb := func(priority uint16, values ...dns.SVCBKeyValue) dns.RR {
+		return &dns.SVCB{
+			Hdr:      dns.RR_Header{Name: ddrName, Rrtype: dns.TypeSVCB, Class: dns.ClassINET, Ttl: 300},
+			Priority: priority,
+			Target:   "dns.example.net.",
+			Value:    values,
+		}
+	}
+	dot, doh := &dns.SVCBAlpn{Alpn: []string{"dot"}}, &dns.SVCBAlpn{Alpn: []string{"h2"}}
+	m := new(dns.Msg)
+	m.Answer = []dns.RR{
+		svcb(2, dot, &dns.SVCBPort{Port: 8853}, &dns.SVCBIPv4Hint{Hint: []net.IP{net.ParseIP("1.1.1.1")}}),
+		svcb(1, dot, &dns.SVCBIPv6Hint{Hint: []net.IP{net.ParseIP("2606:4700::1111")}}),
+		svcb(1, doh),
+		svcb(3, dot, &dns.SVCBIPv4Hint{Hint: []net.IP{net.ParseIP("1.0.0.1")}}),
+		svcb(4, dot, &dns.SVCBMandatory{Code: []dns.SVCBKey{dns.SVCB_ECHCONFIG}}),
+		svcb(0),
+	}
+
+	want := []string{"1.1.1.1:853", "1.1.1.1:8853"}
+	if got := designatedDoTAddrs(m, net.ParseIP("1.1.1.1")); !reflect.DeepEqual(got, want) {
+		t.Errorf("Designated DoT addresses = %v, want %v", got, want)
+	}
+	// Hints of the other family don't matter.
+	want = []string{"[2606:4700::1111]:853", "[2606:4700::1111]:8853", "[2606:4700::1111]:853"}
+	if got := designatedDoTAddrs(m, net.ParseIP("2606:4700::1111")); !reflect.DeepEqual(got, want) {
+		t.Errorf("Designated DoT addresses = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,150 @@
+package gochinadns
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const recentErrorsSize = 64
+
+var (
+	recentErrors     = newErrorRing(recentErrorsSize)
+	recentErrorsOnce sync.Once
+)
+
+// errorRing is a logrus hook keeping the latest error logs in memory,
+// so that they can be attached to a state dump.
+type errorRing struct {
+	mu      sync.Mutex
+	entries []string
+	next    int
+	full    bool
+}
+
+func newErrorRing(size int) *errorRing {
+	return &errorRing{entries: make([]string, size)}
+}
+
+func (r *errorRing) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel}
+}
+
+func (r *errorRing) Fire(entry *logrus.Entry) error {
+	line, err := entry.String()
+	if err != nil {
+		line = entry.Time.Format(time.RFC3339) + " " + entry.Message + "\n"
+	}
+
+	r.mu.Lock()
+	r.entries[r.next] = line
+	r.next++
+	if r.next == len(r.entries) {
+		r.next, r.full = 0, true
+	}
+	r.mu.Unlock()
+	return nil
+}
+
+// Lines returns recorded errors from the oldest to the newest.
+func (r *errorRing) Lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.full {
+		return append([]string(nil), r.entries[:r.next]...)
+	}
+	lines := make([]string, 0, len(r.entries))
+	lines = append(lines, r.entries[r.next:]...)
+	return append(lines, r.entries[:r.next]...)
+}
+
+func registerRecentErrors() {
+	recentErrorsOnce.Do(func() {
+		logrus.AddHook(recentErrors)
+	})
+}
+
+// DumpState writes a diagnostic snapshot of the server to w.
+// It is meant to be attached to bug reports about hangs, so it includes stacks of all goroutines.
+func (s *Server) DumpState(w io.Writer) error {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	sections := []func(io.Writer) error{
+		func(w io.Writer) error {
+			_, err := fmt.Fprintf(w, "# %s state dump at %s\n\n", GetVersion(), time.Now().Format(time.RFC3339))
+			return err
+		},
+		func(w io.Writer) error {
+			_, err := fmt.Fprintf(w, "## Runtime\ngo: %s\ngoroutines: %d\nlookup goroutines: %d (%s)\nheap alloc: %d\nsys: %d\nnum gc: %d\n\n",
+				runtime.Version(), runtime.NumGoroutine(), s.goroutines.Len(), formatSubsystems(s.goroutines.Subsystems()), mem.HeapAlloc, mem.Sys, mem.NumGC)
+			return err
+		},
+		func(w io.Writer) error {
+			queries := s.inflight.List()
+			if _, err := fmt.Fprintf(w, "## Queries\nin-flight: %d\n", len(queries)); err != nil {
+				return err
+			}
+			for _, q := range queries {
+				if _, err := fmt.Fprintf(w, "#%d %s from %s, %s, age %s, trace %s\n", q.ID, q.Question, q.Client, q.State, q.Age, q.Trace); err != nil {
+					return err
+				}
+			}
+			_, err := io.WriteString(w, "\n")
+			return err
+		},
+		func(w io.Writer) error {
+			st := s.cacheStats()
+			_, err := fmt.Fprintf(w, "## Cache\nentries: %d\nbytes: %d\nhits: %d\nmisses: %d\n\n", st.Entries, st.Bytes, st.Hits, st.Misses)
+			return err
+		},
+		func(w io.Writer) error {
+			trusted, untrusted := s.resolvers()
+			if _, err := fmt.Fprintf(w, "## Upstreams\ntrusted: %s\nuntrusted: %s\n", trusted, untrusted); err != nil {
+				return err
+			}
+			for _, u := range s.Upstreams() {
+				if _, err := fmt.Fprintf(w, "%s queries=%d errors=%d avg_rtt=%s drained=%v last_error=%q\n", u.Resolver, u.Queries, u.Errors, u.AvgRTT, u.Drained, u.LastError); err != nil {
+					return err
+				}
+			}
+			for _, c := range s.upstreamConns() {
+				if _, err := fmt.Fprintf(w, "tcp %s proxied=%v open=%d idle=%d in_flight=%d\n", c.Upstream, c.Proxied, c.Open, c.Idle, c.InFlight); err != nil {
+					return err
+				}
+			}
+			_, err := io.WriteString(w, "\n")
+			return err
+		},
+		func(w io.Writer) error {
+			if _, err := io.WriteString(w, "## Recent errors\n"); err != nil {
+				return err
+			}
+			for _, line := range recentErrors.Lines() {
+				if _, err := io.WriteString(w, line); err != nil {
+					return err
+				}
+			}
+			_, err := io.WriteString(w, "\n")
+			return err
+		},
+		func(w io.Writer) error {
+			if _, err := io.WriteString(w, "## Goroutines\n"); err != nil {
+				return err
+			}
+			return pprof.Lookup("goroutine").WriteTo(w, 2)
+		},
+	}
+
+	for _, section := range sections {
+		if err := section(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package gochinadns
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestDumpState(t *testing.T) {
+	upstream := NewUpstreamResolver("dump", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+		return nil, 0, context.Canceled
+	}))
+	s, err := NewServer(NewClient(), WithSkipRefineResolvers(true), WithCache(10, 0), WithUpstreams(true, upstream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := dns.Question{Name: "www.example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	s.cacheSet(&q, newTestReply(q.Name, 60, "1.0.1.1"), Provenance{})
+	query := s.inflight.Add(questionString(&q), "192.168.1.20:5353", "abcd1234", func() {})
+	query.SetState(QueryStateWaitingTrusted)
+	logrus.WithField("test", t.Name()).Error("Error to dump.")
+
+	var buf bytes.Buffer
+	if err = s.DumpState(&buf); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.String()
+	for _, want := range []string{
+		"## Runtime\ngo: ",
+		"## Queries\nin-flight: 1\n#1 www.example.com. A from 192.168.1.20:5353, waiting trusted, age ",
+		", trace abcd1234\n",
+		"## Cache\nentries: 1\n",
+		"## Upstreams\ntrusted: " + resolverList{upstream}.String() + "\n",
+		"\n" + upstream.String() + " queries=0 errors=0 ",
+		"## Recent errors\n",
+		"Error to dump.",
+		"## Goroutines\ngoroutine ",
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("Dump should contain %q:\n%s", want, dump)
+		}
+	}
+	// Sections are in order.
+	last := -1
+	for _, section := range []string{"## Runtime", "## Queries", "## Cache", "## Upstreams", "## Recent errors", "## Goroutines"} {
+		i := strings.Index(dump, section)
+		if i < last {
+			t.Errorf("%s is out of order", section)
+		}
+		last = i
+	}
+}
+
+func TestErrorRing(t *testing.T) {
+	logger := logrus.New()
+	logger.Formatter = &logrus.TextFormatter{DisableTimestamp: true}
+	r := newErrorRing(3)
+	fire := func(msg string) {
+		e := logrus.NewEntry(logger)
+		e.Level, e.Message = logrus.ErrorLevel, msg
+		if err := r.Fire(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(want ...string) {
+		t.Helper()
+		lines := r.Lines()
+		if len(lines) != len(want) {
+			t.Fatalf("Unexpected lines %q, want %q", lines, want)
+		}
+		for i, line := range lines {
+			if !strings.Contains(line, "msg="+want[i]) {
+				t.Errorf("Line %d: got %q, want %s", i, line, want[i])
+			}
+		}
+	}
+
+	check()
+	fire("e0")
+	fire("e1")
+	check("e0", "e1")
+	fire("e2")
+	check("e0", "e1", "e2")
+	// The oldest errors are overwritten, and lines are still the oldest first.
+	fire("e3")
+	fire("e4")
+	check("e2", "e3", "e4")
+	for i := 5; i < 9; i++ {
+		fire("e" + strconv.Itoa(i))
+	}
+	check("e6", "e7", "e8")
+}
@@ -0,0 +1,105 @@
+package gochinadns
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WithDebugListenAddr serves net/http/pprof and dumps of internal state on addr, such as `127.0.0.1:6060`, see
+// DebugHandler. It is not authenticated, and profiles may be costly, so it should only listen on localhost.
+// Disabled if empty.
+func WithDebugListenAddr(addr string) ServerOption {
+	return func(o *serverOptions) error {
+		o.DebugListen = addr
+		return nil
+	}
+}
+
+// DebugState is a snapshot of internal state of a server.
+type DebugState struct {
+	Goroutines int            `json:"goroutines"`
+	Subsystems map[string]int `json:"subsystems"` // goroutines serving queries by subsystem, like lookup and forward
+	HeapAlloc  uint64         `json:"heap_alloc"`
+	Sys        uint64         `json:"sys"`
+	NumGC      uint32         `json:"num_gc"`
+	Cache      CacheStats     `json:"cache"`
+	// Connections are pooled TCP connections to upstreams, by address.
+	Connections []UpstreamConnStats `json:"connections"`
+}
+
+// UpstreamConnStats are states of pooled TCP connections to an upstream.
+type UpstreamConnStats struct {
+	Upstream string `json:"upstream"`
+	Proxied  bool   `json:"proxied,omitempty"` // through the trusted proxy
+	Open     int    `json:"open"`
+	Idle     int    `json:"idle"` // open connections without queries in flight
+	InFlight int    `json:"in_flight"`
+}
+
+// DebugState returns a snapshot of internal state of the server.
+func (s *Server) DebugState() *DebugState {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	return &DebugState{
+		Goroutines:  runtime.NumGoroutine(),
+		Subsystems:  s.goroutines.Subsystems(),
+		HeapAlloc:   mem.HeapAlloc,
+		Sys:         mem.Sys,
+		NumGC:       mem.NumGC,
+		Cache:       s.cacheStats(),
+		Connections: s.upstreamConns(),
+	}
+}
+
+// upstreamConns returns states of pooled TCP connections to upstreams, including those through the trusted proxy.
+func (s *Server) upstreamConns() []UpstreamConnStats {
+	conns := s.Client.tcpPool.stats()
+	if s.proxyCli != nil {
+		for _, c := range s.proxyCli.tcpPool.stats() {
+			c.Proxied = true
+			conns = append(conns, c)
+		}
+	}
+	return conns
+}
+
+// DebugHandler returns an HTTP handler serving net/http/pprof at /debug/pprof/, along with the state dump at
+// /debug/state, DebugState in JSON at /debug/runtime, and expvars at /debug/vars.
+func (s *Server) DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/state", s.handleState)
+	mux.HandleFunc("/debug/runtime", s.handleDebugState)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+func (s *Server) handleDebugState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.DebugState())
+}
+
+// formatSubsystems formats goroutine counts of subsystems like `forward=1 lookup=4`.
+func formatSubsystems(subsystems map[string]int) string {
+	names := make([]string, 0, len(subsystems))
+	for name := range subsystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = name + "=" + strconv.Itoa(subsystems[name])
+	}
+	return strings.Join(names, " ")
+}
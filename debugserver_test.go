@@ -0,0 +1,50 @@
+package gochinadns
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDebugHandler(t *testing.T) {
+	addr := startTestUpstream(t)
+	s, err := NewServer(NewClient(), WithSkipRefineResolvers(true), WithDebugListenAddr("127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.DebugServer == nil {
+		t.Fatal("Debug server should be created")
+	}
+	if _, _, err = s.exchangeTCP(context.Background(), new(dns.Msg).SetQuestion("example.com.", dns.TypeA), addr); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.goroutines.Go("lookup example.com. A in trusted servers", cancel, func() { <-ctx.Done() })
+
+	w := httptest.NewRecorder()
+	s.DebugHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/runtime", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body)
+	}
+	var st DebugState
+	if err = json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Goroutines == 0 || st.Subsystems["lookup"] != 1 {
+		t.Errorf("Unexpected goroutines: %d, %v", st.Goroutines, st.Subsystems)
+	}
+	if len(st.Connections) != 1 || st.Connections[0] != (UpstreamConnStats{Upstream: addr, Open: 1, Idle: 1}) {
+		t.Errorf("Unexpected connections: %+v", st.Connections)
+	}
+
+	w = httptest.NewRecorder()
+	s.DebugHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/pprof/goroutine?debug=1", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected status of pprof %d: %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,249 @@
+package gochinadns
+
+import (
+	"context"
+	"expvar"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// dedupedQueries counts queries answered by a resolution shared with identical queries in flight.
+var dedupedQueries = expvar.NewInt("chinadns_deduplicated_queries")
+
+// flightKey identifies queries which can share a resolution: the same question, with the same flags and ECS
+// which change answers. req should have been normalized.
+func flightKey(req *dns.Msg) string {
+	q := req.Question[0]
+	sb := new(strings.Builder)
+	sb.WriteString(strings.ToLower(q.Name))
+	sb.WriteByte(' ')
+	sb.WriteString(strconv.Itoa(int(q.Qtype)))
+	sb.WriteByte(' ')
+	sb.WriteString(strconv.Itoa(int(q.Qclass)))
+	if !req.RecursionDesired {
+		sb.WriteString(" nord")
+	}
+	if req.CheckingDisabled {
+		sb.WriteString(" cd")
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		if opt.Do() {
+			sb.WriteString(" do")
+		}
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				sb.WriteByte(' ')
+				sb.WriteString(ecs.String())
+			}
+		}
+	}
+	return sb.String()
+}
+
+// sharedResolution is the result of a resolution shared by identical queries.
+type sharedResolution struct {
+	reply *upstreamReply
+	trace string // trace ID of the query resolving it, in whose logs the resolution is
+}
+
+// resolveShared resolves req like resolve, but collapses concurrent identical queries into a single resolution,
+// so that a burst of duplicates doesn't launch a race per query. A shared reply is copied for each query,
+// with the ID and question of the query. The resolution runs under a flightContext, so that it isn't canceled with
+// the query starting it while others wait for it, but is once none waits.
+func (s *Server) resolveShared(ctx context.Context, logger *logrus.Entry, req *dns.Msg) *upstreamReply {
+	key := flightKey(req)
+	if client := pinnedClientFromContext(ctx); client != nil {
+		// Clients pinned to different upstreams can't share resolutions.
+		key += " " + client.String()
+	}
+	s.flightMu.Lock()
+	fctx := s.flightCtxs[key]
+	if fctx != nil && fctx.Err() != nil {
+		// The flight is ending without a reply, which a new query shouldn't wait for.
+		s.forgetFlight(key, fctx)
+		fctx = nil
+	}
+	if fctx == nil {
+		fctx = newFlightContext(ctx)
+		if s.flightCtxs == nil {
+			s.flightCtxs = make(map[string]*flightContext)
+		}
+		s.flightCtxs[key] = fctx
+	} else {
+		fctx.join(ctx)
+	}
+	ch := s.flights.DoChan(key, func() (interface{}, error) {
+		defer func() {
+			s.flightMu.Lock()
+			s.forgetFlight(key, fctx)
+			s.flightMu.Unlock()
+			fctx.cancel()
+		}()
+		return &sharedResolution{reply: s.resolve(fctx, logger, req), trace: traceIDFromContext(ctx)}, nil
+	})
+	s.flightMu.Unlock()
+	var res singleflight.Result
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		s.flightMu.Lock()
+		if fctx.leave(ctx) {
+			s.forgetFlight(key, fctx)
+		}
+		s.flightMu.Unlock()
+		return nil
+	}
+	resolution := res.Val.(*sharedResolution)
+	reply := resolution.reply
+	if reply == nil || !res.Shared {
+		return reply
+	}
+	if trace := traceIDFromContext(ctx); resolution.trace != trace {
+		logger.WithField("shared_trace", resolution.trace).Debug("Share the resolution of an identical query.")
+	}
+	dedupedQueries.Add(1)
+	shared := *reply
+	shared.Msg = reply.Msg.Copy()
+	shared.Id = req.Id
+	shared.Question = req.Question
+	return &shared
+}
+
+// forgetFlight forgets the flight of key with its context fctx at once, so that later queries don't join one without
+// the other, unless a new flight has taken the key. s.flightMu should be held.
+func (s *Server) forgetFlight(key string, fctx *flightContext) {
+	if s.flightCtxs[key] == fctx {
+		s.flights.Forget(key)
+		delete(s.flightCtxs, key)
+	}
+}
+
+// flightContext is the context of a shared resolution. It carries values of the query starting the resolution, but
+// lasts until the latest deadline of the queries waiting for it, rather than being canceled with the first one. It's
+// canceled once every query waiting for it is done. States of the waiting queries are set through it, see
+// inflightFromContext.
+type flightContext struct {
+	detachedContext
+	done chan struct{}
+
+	mu        sync.Mutex
+	deadline  time.Time
+	unbounded bool // a query without deadline waits for it
+	timer     *time.Timer
+	waiters   map[queryState]int // states of queries waiting for it, and how many times each waits
+	state     string             // set to queries waiting for it, and those joining later
+	err       error
+}
+
+func newFlightContext(ctx context.Context) *flightContext {
+	c := &flightContext{
+		detachedContext: detachedContext{ctx},
+		done:            make(chan struct{}),
+		waiters:         map[queryState]int{inflightFromContext(ctx): 1},
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		c.unbounded = true
+		return c
+	}
+	c.deadline = deadline
+	c.timer = time.AfterFunc(time.Until(deadline), func() { c.finish(context.DeadlineExceeded) })
+	return c
+}
+
+// join makes the query of ctx wait for the resolution, and extends the deadline to that of ctx, if later.
+func (c *flightContext) join(ctx context.Context) {
+	deadline, ok := ctx.Deadline()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	q := inflightFromContext(ctx)
+	c.waiters[q]++
+	if c.state != "" {
+		q.SetState(c.state)
+	}
+	switch {
+	case c.err != nil || c.unbounded:
+	case !ok:
+		c.unbounded = true
+		c.timer.Stop()
+	case deadline.After(c.deadline):
+		c.deadline = deadline
+		c.timer.Reset(time.Until(deadline))
+	}
+}
+
+// leave stops the query of ctx waiting for the resolution, which is canceled if none waits any more. It reports
+// whether the resolution is canceled.
+func (c *flightContext) leave(ctx context.Context) bool {
+	q := inflightFromContext(ctx)
+	c.mu.Lock()
+	if c.waiters[q]--; c.waiters[q] <= 0 {
+		delete(c.waiters, q)
+	}
+	left := len(c.waiters) == 0
+	c.mu.Unlock()
+	if left {
+		c.finish(context.Canceled)
+	}
+	return left
+}
+
+// SetState sets the state of the queries waiting for the resolution.
+func (c *flightContext) SetState(state string) {
+	c.mu.Lock()
+	c.state = state
+	waiters := make([]queryState, 0, len(c.waiters))
+	for q := range c.waiters {
+		waiters = append(waiters, q)
+	}
+	c.mu.Unlock()
+	for _, q := range waiters {
+		q.SetState(state)
+	}
+}
+
+// Value returns the flight itself as the state of in-flight queries, instead of the query starting it.
+func (c *flightContext) Value(key interface{}) interface{} {
+	if key == (inflightKey{}) {
+		return c
+	}
+	return c.detachedContext.Value(key)
+}
+
+// cancel releases the context once the resolution is done.
+func (c *flightContext) cancel() {
+	c.finish(context.Canceled)
+}
+
+func (c *flightContext) finish(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	close(c.done)
+}
+
+func (c *flightContext) Deadline() (time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.deadline, !c.unbounded
+}
+
+func (c *flightContext) Done() <-chan struct{} { return c.done }
+
+func (c *flightContext) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
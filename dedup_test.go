@@ -0,0 +1,191 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestResolveShared(t *testing.T) {
+	var queries int32
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&queries, 1)
+		time.Sleep(100 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("142.250.1.1"),
+		})
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = upstream.ActivateAndServe() }()
+	defer func() { _ = upstream.Shutdown() }()
+	r, err := ParseResolver("udp@"+pc.LocalAddr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := newServerOptions()
+	o.Delay = time.Second
+	o.TrustedServers = resolverList{r}
+	s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second)), goroutines: newGoroutineTracker()}
+
+	const clients = 8
+	replies := make([]*upstreamReply, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := new(dns.Msg)
+			req.SetQuestion("WWW.example.com.", dns.TypeA)
+			if i%2 == 1 {
+				req.Question[0].Name = "www.EXAMPLE.com."
+			}
+			req.Id = uint16(i + 1)
+			replies[i] = s.resolveShared(context.Background(), logrus.NewEntry(logrus.StandardLogger()), req)
+		}(i)
+	}
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("%d upstream queries for identical questions, want 1", n)
+	}
+	for i, reply := range replies {
+		if reply == nil || len(reply.Answer) != 1 {
+			t.Fatalf("Unexpected reply %d: %v", i, reply)
+		}
+		if reply.Id != uint16(i+1) {
+			t.Errorf("Reply %d has ID %d", i, reply.Id)
+		}
+	}
+}
+
+func TestResolveSharedDeadline(t *testing.T) {
+	var queries int32
+	upstream := NewUpstreamResolver("slow", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+		atomic.AddInt32(&queries, 1)
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("142.250.1.1"),
+		})
+		return m, 100 * time.Millisecond, nil
+	}))
+	s, err := NewServer(NewClient(WithTimeout(time.Second)), WithSkipRefineResolvers(true), WithUpstreams(true, upstream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := logrus.NewEntry(logrus.StandardLogger())
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+
+	// The query starting the resolution gives up early, while another one waits longer for it.
+	short, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	go s.resolveShared(short, logger, req.Copy())
+	time.Sleep(5 * time.Millisecond)
+	long, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if reply := s.resolveShared(long, logger, req.Copy()); reply == nil || len(reply.Answer) != 1 {
+		t.Errorf("Shared resolution should last until the latest deadline, got %v", reply)
+	}
+	if n := atomic.LoadInt32(&queries); n != 1 {
+		t.Errorf("%d upstream queries for identical questions, want 1", n)
+	}
+	s.flightMu.Lock()
+	defer s.flightMu.Unlock()
+	if len(s.flightCtxs) != 0 {
+		t.Errorf("Contexts of finished flights are kept: %v", s.flightCtxs)
+	}
+}
+
+func TestResolveSharedCancel(t *testing.T) {
+	lookups := make(chan error, 1)
+	trusted := NewUpstreamResolver("stuck", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+		<-ctx.Done()
+		lookups <- ctx.Err()
+		return nil, 0, ctx.Err()
+	}))
+	untrusted := NewUpstreamResolver("overseas", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+		m := newTestReply(req.Question[0].Name, 60, "8.8.8.8")
+		m.Id = req.Id
+		return m, time.Millisecond, nil
+	}))
+	s, err := NewServer(NewClient(WithTimeout(5*time.Second)), WithSkipRefineResolvers(true),
+		WithUpstreams(true, trusted), WithUpstreams(false, untrusted))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	// waitInFlight waits until n queries are in flight, all in state.
+	waitInFlight := func(n int, state string) []InFlightQuery {
+		t.Helper()
+		for start := time.Now(); time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+			queries := s.InFlight()
+			ok := len(queries) == n
+			for _, q := range queries {
+				ok = ok && q.State == state
+			}
+			if ok {
+				return queries
+			}
+		}
+		t.Fatalf("Expect %d queries %s, got %+v", n, state, s.InFlight())
+		return nil
+	}
+
+	// A query joining the resolution has its state set too.
+	done := make(chan struct{}, 2)
+	for _, client := range []string{"192.0.2.1", "192.0.2.2"} {
+		w := newFakeResponseWriter(client)
+		go func() {
+			s.Serve(w, new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA))
+			done <- struct{}{}
+		}()
+		time.Sleep(10 * time.Millisecond)
+	}
+	queries := waitInFlight(2, QueryStateWaitingTrusted)
+
+	// The resolution goes on for the other query, until it's canceled too.
+	if !s.CancelQuery(queries[0].ID) {
+		t.Fatal("Query should be found")
+	}
+	<-done
+	select {
+	case err = <-lookups:
+		t.Fatalf("Lookup of a query waited for is canceled: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	waitInFlight(1, QueryStateWaitingTrusted)
+	if !s.CancelQuery(queries[1].ID) {
+		t.Fatal("Query should be found")
+	}
+	select {
+	case err = <-lookups:
+		if err != context.Canceled {
+			t.Errorf("Lookup should be canceled, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Lookup of canceled queries goes on")
+	}
+	<-done
+}
@@ -0,0 +1,115 @@
+package gochinadns
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var degradations = expvar.NewInt("chinadns_degradations")
+
+// WithLatencyDegradation moves an untrusted upstream into a degraded tier once its average RTT has exceeded that of
+// the fastest trusted upstream for after, since the benefit of CDN locality is gone then. Degraded upstreams are
+// left out of the untrusted group, unless all of them are degraded, and restored once they are faster again.
+// RTTs are compared on health checks (see WithHealthCheck), which keep measuring degraded upstreams.
+// Disabled if after is 0.
+func WithLatencyDegradation(after time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if after < 0 {
+			return fmt.Errorf("invalid degradation period: %s", after)
+		}
+		o.DegradeAfter = after
+		return nil
+	}
+}
+
+// degradedTable tracks untrusted upstreams slower than trusted ones. A nil table is disabled.
+type degradedTable struct {
+	after time.Duration
+
+	mu        sync.Mutex
+	slowSince map[string]time.Time // by resolver string, since when an upstream is slower than trusted ones
+	degraded  map[string]bool
+}
+
+// newDegradedTable returns a table degrading upstreams slow for after, or nil if after is not positive.
+func newDegradedTable(after time.Duration) *degradedTable {
+	if after <= 0 {
+		return nil
+	}
+	return &degradedTable{after: after, slowSince: make(map[string]time.Time), degraded: make(map[string]bool)}
+}
+
+// update compares RTTs of untrusted upstreams with the fastest trusted one at now, and degrades or restores them.
+// Nothing changes until a trusted upstream is measured.
+func (t *degradedTable) update(now time.Time, upstreams *upstreamTable, trusted, untrusted resolverList) {
+	if t == nil {
+		return
+	}
+	var fastest time.Duration
+	for _, r := range trusted {
+		st := upstreams.get(r)
+		if st.ConsecutiveErrors < unhealthyErrors && st.AvgRTT > 0 && (fastest == 0 || st.AvgRTT < fastest) {
+			fastest = st.AvgRTT
+		}
+	}
+	if fastest == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, r := range untrusted {
+		key := r.String()
+		rtt := upstreams.get(r).AvgRTT
+		if rtt <= fastest {
+			delete(t.slowSince, key)
+			if t.degraded[key] {
+				delete(t.degraded, key)
+				logrus.WithField("server", r).Infof("Untrusted server is faster than trusted ones again (%s < %s). Restored.", rtt, fastest)
+			}
+			continue
+		}
+		since, ok := t.slowSince[key]
+		if !ok {
+			t.slowSince[key] = now
+			continue
+		}
+		if !t.degraded[key] && now.Sub(since) >= t.after {
+			t.degraded[key] = true
+			degradations.Add(1)
+			logrus.WithField("server", r).Warnf("Untrusted server is slower than trusted ones for %s (%s > %s). Degraded.",
+				now.Sub(since).Round(time.Second), rtt, fastest)
+		}
+	}
+}
+
+// IsDegraded tells whether r is degraded.
+func (t *degradedTable) IsDegraded(r *Resolver) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.degraded[r.String()]
+}
+
+// undegraded returns resolvers in list which are not degraded, or list itself if all of them are.
+func (t *degradedTable) undegraded(list resolverList) resolverList {
+	if t == nil {
+		return list
+	}
+	var result resolverList
+	for _, r := range list {
+		if !t.IsDegraded(r) {
+			result = append(result, r)
+		}
+	}
+	if len(result) == 0 {
+		return list
+	}
+	return result
+}
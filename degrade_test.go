@@ -0,0 +1,66 @@
+package gochinadns
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDegradedTable(t *testing.T) {
+	trusted := &Resolver{Addr: "8.8.8.8:53"}
+	slow, fast := &Resolver{Addr: "114.114.114.114:53"}, &Resolver{Addr: "119.29.29.29:53"}
+	upstreams := newUpstreamTable()
+	record := func(r *Resolver, rtt time.Duration) {
+		// Enough samples to settle the moving average.
+		for i := 0; i < 50; i++ {
+			upstreams.Record(&UpstreamReplyEvent{Upstream: r, RTT: rtt})
+		}
+	}
+	table := newDegradedTable(10 * time.Minute)
+	now := time.Unix(1600000000, 0)
+	update := func(d time.Duration) {
+		now = now.Add(d)
+		table.update(now, upstreams, resolverList{trusted}, resolverList{slow, fast})
+	}
+
+	record(slow, 80*time.Millisecond)
+	record(fast, 10*time.Millisecond)
+	update(0)
+	if table.IsDegraded(slow) {
+		t.Fatal("Nothing should be degraded before trusted servers are measured")
+	}
+	record(trusted, 50*time.Millisecond)
+	update(0)
+	update(9 * time.Minute)
+	if table.IsDegraded(slow) {
+		t.Fatal("Slow server should not be degraded before the period")
+	}
+	update(time.Minute)
+	if !table.IsDegraded(slow) || table.IsDegraded(fast) {
+		t.Fatal("Server slower than trusted ones for the period should be degraded")
+	}
+	if list := table.undegraded(resolverList{slow, fast}); len(list) != 1 || list[0] != fast {
+		t.Errorf("Degraded server should be left out, got %s", list)
+	}
+	if list := table.undegraded(resolverList{slow}); len(list) != 1 {
+		t.Errorf("Degraded servers should be used if all are, got %s", list)
+	}
+
+	record(slow, 20*time.Millisecond)
+	update(time.Minute)
+	if table.IsDegraded(slow) {
+		t.Error("Server faster than trusted ones should be restored")
+	}
+	// Being slow again restarts the period.
+	record(slow, 80*time.Millisecond)
+	update(time.Minute)
+	update(5 * time.Minute)
+	if table.IsDegraded(slow) {
+		t.Error("Server should be degraded only after being slow for the whole period again")
+	}
+
+	var disabled *degradedTable
+	disabled.update(now, upstreams, resolverList{trusted}, resolverList{slow})
+	if disabled.IsDegraded(slow) || len(disabled.undegraded(resolverList{slow, fast})) != 2 {
+		t.Error("Nil table should degrade nothing")
+	}
+}
@@ -2,61 +2,86 @@ package gochinadns
 
 import (
 	"context"
+	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/cherrot/gochinadns/clock"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 )
 
+// Verdicts on how a reply was chosen.
+const (
+	VerdictChina     = "china"      // an untrusted answer located in China
+	VerdictTrusted   = "trusted"    // a trusted answer, not checked in China route list
+	VerdictOverseas  = "overseas"   // a trusted answer located overseas
+	VerdictFallback  = "fallback"   // no better reply arrived in time
+	VerdictNoAddress = "no-address" // the answer contains no IP to check
+	VerdictBlocked   = "blocked"    // the question hit domain blacklist
+	VerdictStale     = "stale"      // upstreams failed, and an expired cached answer is served
+	VerdictForwarded = "forwarded"  // the question is routed to designated upstreams by forward rules
+	VerdictHosts     = "hosts"      // the question is answered by hosts files
+	VerdictFiltered  = "filtered"   // the question is answered without records by the AAAA mode or its blocked type
+	VerdictRewritten = "rewritten"  // the question is answered by rewrite rules
+	VerdictRefused   = "refused"    // the query is refused by the recursion mode, the client ACL or its blocked type
+)
+
+// defaultQueryTimeout is the default deadline to resolve a query of a UDP client, the default timeout of glibc stubs.
+const defaultQueryTimeout = 5 * time.Second
+
+// upstreamReply is a DNS reply along with the upstream it comes from.
+type upstreamReply struct {
+	*dns.Msg
+	server  *Resolver
+	rtt     time.Duration
+	verdict string
+}
+
+// lookupInServers looks up req in servers one after another, paced by waitInterval on clk (see pacer), and sends
+// the first reply to result. cancel is called once a reply arrives, or all lookups fail.
 func lookupInServers(
-	ctx context.Context, cancel context.CancelFunc, result chan<- *dns.Msg, req *dns.Msg,
-	servers []*Resolver, waitInterval time.Duration, lookup LookupFunc,
+	ctx context.Context, cancel context.CancelFunc, result chan<- *upstreamReply, req *dns.Msg,
+	servers []*Resolver, waitInterval time.Duration, clk clock.Clock, lookup LookupFunc, tracker *goroutineTracker,
 ) {
 	defer cancel()
 	if len(servers) == 0 {
 		return
 	}
-	logger := logrus.WithField("question", questionString(&req.Question[0]))
+	qs := questionString(&req.Question[0])
+	logger := logEntry(ctx).WithField("question", qs)
 
-	// TODO: replace ticker by ratelimit
-	ticker := time.NewTicker(waitInterval)
-	defer ticker.Stop()
-	queryNext := make(chan struct{}, len(servers))
-	queryNext <- struct{}{}
+	pace := newPacer(len(servers), waitInterval, clk)
 	var wg sync.WaitGroup
 
 	doLookup := func(server *Resolver) {
 		defer wg.Done()
 		logger := logger.WithField("server", server.GetAddr())
 
-		reply, rtt, err := lookup(req.Copy(), server)
+		reply, rtt, err := lookup(ctx, req.Copy(), server)
 		if err != nil {
-			queryNext <- struct{}{}
+			upstreamErrorsFromContext(ctx).Add(server, err)
+			pace.Fail()
 			return
 		}
 
 		select {
-		case result <- reply:
+		case result <- &upstreamReply{Msg: reply, server: server, rtt: rtt}:
 			logger.Debug("Query RTT: ", rtt)
 		default:
 		}
 		cancel()
 	}
 
-LOOP:
 	for _, server := range servers {
-		select {
-		case <-ctx.Done():
-			break LOOP
-		case <-queryNext:
-			wg.Add(1)
-			go doLookup(server)
-		case <-ticker.C:
-			wg.Add(1)
-			go doLookup(server)
+		if !pace.Wait(ctx) {
+			break
 		}
+		server := server
+		wg.Add(1)
+		tracker.Go("lookup "+qs+" in "+server.String(), cancel, func() { doLookup(server) })
 	}
 
 	wg.Wait()
@@ -66,114 +91,441 @@ LOOP:
 func (s *Server) Serve(w dns.ResponseWriter, req *dns.Msg) {
 	// Its client's responsibility to close this conn.
 	// defer w.Close()
-	var reply *dns.Msg
+	var reply *upstreamReply
 
-	start := time.Now()
+	start := s.Clock.Now()
 	qName := req.Question[0].Name
-	logger := logrus.WithField("question", questionString(&req.Question[0]))
+	client := clientIP(w)
+	trace := newTraceID()
+	logger := logrus.WithFields(logrus.Fields{traceField: trace, "question": questionString(&req.Question[0])})
+	limits := newClientLimits(w, req, s.tcpIdleTimeout())
+	s.hooks.emitQuery(&QueryEvent{Question: req.Question[0], Client: client, Transport: limits.transport()})
 
-	if s.DomainBlacklist.Contain(qName) {
-		reply = new(dns.Msg)
-		reply.SetReply(req)
-		_ = w.WriteMsg(reply)
+	if m := s.refusedClientReply(client, req); m != nil {
+		s.hooks.emitAnswer(&AnswerEvent{Question: req.Question[0], Client: client, Answer: m, Verdict: VerdictRefused, Latency: s.Clock.Now().Sub(start), Transport: limits.transport()})
+		_ = w.WriteMsg(limits.fit(m))
 		return
 	}
 
-	ctx, cancel := context.WithCancel(context.TODO())
-	uctx, ucancel := context.WithCancel(ctx)
-	tctx, tcancel := context.WithCancel(ctx)
-	go func() {
-		<-uctx.Done()
-		<-tctx.Done()
-		cancel()
-	}()
+	if s.WhoAnswered && s.serveWhoAnswered(w, req) {
+		return
+	}
+
+	if m := s.refusedIterativeReply(req); m != nil {
+		s.hooks.emitAnswer(&AnswerEvent{Question: req.Question[0], Client: client, Answer: m, Verdict: VerdictRefused, Latency: s.Clock.Now().Sub(start), Transport: limits.transport()})
+		_ = w.WriteMsg(limits.fit(m))
+		return
+	}
+
+	if m, verdict := s.blockedQTypeReply(req); m != nil {
+		s.hooks.emitAnswer(&AnswerEvent{Question: req.Question[0], Client: client, Answer: m, Verdict: verdict, Latency: s.Clock.Now().Sub(start), Transport: limits.transport()})
+		_ = w.WriteMsg(limits.fit(m))
+		s.provenance.Record(&req.Question[0], Provenance{Verdict: verdict})
+		return
+	}
+
+	if s.isDomainBlocked(qName, client) {
+		m := s.blockedReply(req)
+		s.hooks.emitBlocked(&BlockedEvent{Question: req.Question[0], Client: client, Transport: limits.transport()})
+		_ = w.WriteMsg(limits.fit(m))
+		s.provenance.Record(&req.Question[0], Provenance{Verdict: VerdictBlocked})
+		return
+	}
+
+	if m, verdict := s.anomalousNameReply(req, client); m != nil {
+		if verdict == VerdictBlocked {
+			s.hooks.emitBlocked(&BlockedEvent{Question: req.Question[0], Client: client, Transport: limits.transport()})
+		} else {
+			s.hooks.emitAnswer(&AnswerEvent{Question: req.Question[0], Client: client, Answer: m, Verdict: verdict, Latency: s.Clock.Now().Sub(start), Transport: limits.transport()})
+		}
+		_ = w.WriteMsg(limits.fit(m))
+		s.provenance.Record(&req.Question[0], Provenance{Verdict: verdict})
+		return
+	}
+
+	if m := s.tunnelReply(req, client); m != nil {
+		s.hooks.emitBlocked(&BlockedEvent{Question: req.Question[0], Client: client, Transport: limits.transport()})
+		_ = w.WriteMsg(limits.fit(m))
+		s.provenance.Record(&req.Question[0], Provenance{Verdict: VerdictBlocked})
+		return
+	}
+
+	if m := s.answerHosts(req); m != nil {
+		s.hooks.emitAnswer(&AnswerEvent{Question: req.Question[0], Client: client, Answer: m, Verdict: VerdictHosts, Latency: s.Clock.Now().Sub(start), Transport: limits.transport()})
+		_ = w.WriteMsg(limits.fit(m))
+		s.provenance.Record(&req.Question[0], Provenance{Verdict: VerdictHosts})
+		return
+	}
+
+	if m := s.answerRewrite(req); m != nil {
+		s.hooks.emitAnswer(&AnswerEvent{Question: req.Question[0], Client: client, Answer: m, Verdict: VerdictRewritten, Latency: s.Clock.Now().Sub(start), Transport: limits.transport()})
+		_ = w.WriteMsg(limits.fit(m))
+		s.provenance.Record(&req.Question[0], Provenance{Verdict: VerdictRewritten})
+		return
+	}
+
+	if m := s.filteredAAAAReply(req); m != nil {
+		s.hooks.emitAnswer(&AnswerEvent{Question: req.Question[0], Client: client, Answer: m, Verdict: VerdictFiltered, Latency: s.Clock.Now().Sub(start), Transport: limits.transport()})
+		_ = w.WriteMsg(limits.fit(m))
+		s.provenance.Record(&req.Question[0], Provenance{Verdict: VerdictFiltered})
+		return
+	}
+
+	// Pinned clients get answers of their own upstreams, rather than those cached from others.
+	pinned := s.PinUpstreams && client != nil
+	var m, stale *dns.Msg
+	if !pinned {
+		m, stale = s.cacheGet(&req.Question[0])
+	}
+	if m != nil && limits.do && !hasDO(m) {
+		// Cached without DNSSEC records, which the client asks for.
+		m = nil
+	}
+	if m != nil {
+		logger.Debug("Cache hit.")
+		m.Id = req.Id
+		m.Question = req.Question
+		s.shuffler.Shuffle(m)
+		s.raiseSetTTLs(m)
+		s.hooks.emitAnswer(&AnswerEvent{Question: req.Question[0], Client: client, Answer: m, Cached: true, Latency: s.Clock.Now().Sub(start), Transport: limits.transport()})
+		_ = w.WriteMsg(limits.fit(m))
+		return
+	}
+
+	timeout := s.queryTimeout(limits)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	query := s.inflight.Add(questionString(&req.Question[0]), w.RemoteAddr().String(), trace, cancel)
+	defer s.inflight.Remove(query)
+	ctx = withInflightEntry(withTraceID(ctx, trace), query)
+	ctx, errs := withUpstreamErrors(ctx)
+	if pinned {
+		ctx = withPinnedClient(ctx, client)
+	}
 
 	s.normalizeRequest(req)
 
-	trusted := make(chan *dns.Msg, 1)
-	untrusted := make(chan *dns.Msg, 1)
-	go lookupInServers(tctx, tcancel, trusted, req, s.TrustedServers, s.Delay, s.Lookup)
-	if !s.DomainPolluted.Contain(qName) {
-		go lookupInServers(uctx, ucancel, untrusted, req, s.UntrustedServers, s.Delay, s.lookupNormal)
+	var counterpart chan *upstreamReply
+	if counterReq := s.dualStackCounterpart(req); counterReq != nil {
+		counterpart = make(chan *upstreamReply, 1)
+		cq := questionString(&counterReq.Question[0])
+		s.goroutines.Go("resolve counterpart "+cq, cancel, func() {
+			counterpart <- s.resolveShared(ctx, logger.WithField("counterpart", cq), counterReq)
+		})
+	}
+
+	reply = s.resolveShared(ctx, logger, req)
+	if counterpart != nil && reply != nil {
+		// The counterpart is given up once the query times out, and the reply is served without it.
+		var c *upstreamReply
+		select {
+		case c = <-counterpart:
+		case <-ctx.Done():
+		}
+		reply = s.applyAAAAMode(logger, reply, c)
+		reply = s.applyDualStackPreference(ctx, logger, reply, c)
+	}
+	reply = s.synthesizeDNS64(ctx, logger, req, reply)
+	if upstreamFailed(reply) {
+		reply = s.answerFailure(ctx, logger, req, reply, stale, timeout, errs, func(ctx context.Context) *upstreamReply {
+			return s.synthesizeDNS64(ctx, logger, req, s.resolveShared(ctx, logger, req))
+		})
+	}
+	query.SetState(QueryStateReplying)
+
+	m = reply.Msg
+	// https://github.com/miekg/dns/issues/216
+	m.Compress = true
+	if s.shouldStripECH(qName) {
+		stripECH(m)
+	}
+	if reply.verdict != VerdictStale && reply.verdict != VerdictFailed {
+		s.stripRewrite(logger, qName, m)
+		s.clampTTLs(m)
+		if cacheable(req) && !pinned {
+			s.cacheSet(&req.Question[0], m, reply.provenance())
+			s.prefetchCounterpart(logger, req, client)
+		}
+	}
+	s.shuffler.Shuffle(m)
+	s.raiseSetTTLs(m)
+	s.provenance.Record(&req.Question[0], reply.provenance())
+
+	s.hooks.emitAnswer(&AnswerEvent{
+		Question:  req.Question[0],
+		Client:    client,
+		Answer:    m,
+		Upstream:  reply.server,
+		Verdict:   reply.verdict,
+		Latency:   s.Clock.Now().Sub(start),
+		Transport: limits.transport(),
+	})
+	_ = w.WriteMsg(limits.fit(m))
+	logger.Debug("SERVING RTT: ", s.Clock.Now().Sub(start))
+}
+
+// queryTimeout returns the deadline to resolve a query of a client over the transport of l. UDP clients retry by new
+// queries, while TCP clients wait longer on their connections. It's never shorter than the timeout of the client or
+// any resolver, so that upstreams get a chance to reply.
+func (s *Server) queryTimeout(l clientLimits) time.Duration {
+	timeout := s.QueryTimeout
+	if timeout == 0 {
+		timeout = defaultQueryTimeout
+	}
+	if l.tcp {
+		timeout *= 2
+	}
+	if timeout < s.Timeout {
+		timeout = s.Timeout
+	}
+	trusted, untrusted := s.resolvers()
+	for _, list := range []resolverList{trusted, untrusted} {
+		for _, r := range list {
+			if t := r.params().timeout; timeout < t {
+				timeout = t
+			}
+		}
+	}
+	return timeout
+}
+
+// resolve races req in trusted and untrusted servers, or only in the group routed by the verdict of the domain,
+// and returns the chosen reply (nil if nothing replied).
+func (s *Server) resolve(parent context.Context, logger *logrus.Entry, req *dns.Msg) (reply *upstreamReply) {
+	qName := req.Question[0].Name
+	if rule := s.rewriteRule(qName); rule != nil && rule.cname != "" && parent.Value(rewrittenKey{}) == nil {
+		return s.resolveRewrite(parent, logger, req, rule.cname)
+	}
+	if servers := s.forwardServers(qName); servers != nil {
+		return s.forward(parent, logger, req, servers)
+	}
+
+	// Answers without IPs, e.g. of AAAA questions of IPv4-only domains, don't change the verdict of the domain.
+	if route := s.verdicts.Route(qName); route != "" {
+		reply = s.race(parent, logger, req, route)
+		if reply != nil && (routeOf(reply.verdict) == route || reply.verdict == VerdictNoAddress) {
+			return
+		}
+		logger.WithField("route", route).Debug("Verdict of the domain changed. Race both groups.")
+	}
+	reply = s.race(parent, logger, req, "")
+	if reply != nil && reply.verdict != VerdictNoAddress {
+		s.verdicts.Set(qName, routeOf(reply.verdict))
+	}
+	return
+}
+
+// race races req in trusted and untrusted servers, and returns the chosen reply (nil if nothing replied).
+// Only the group of route is queried if route is not empty (see WithVerdictCache).
+func (s *Server) race(parent context.Context, logger *logrus.Entry, req *dns.Msg, route string) (reply *upstreamReply) {
+	qName := req.Question[0].Name
+	qs := questionString(&req.Question[0])
+	start := s.Clock.Now()
+	ctx, cancel := context.WithCancel(parent)
+	// ctx is canceled once lookups in both groups are done, without a goroutine waiting for them.
+	pending := int32(2)
+	uctx, ucancel := withCountedCancel(ctx, cancel, &pending)
+	tctx, tcancel := withCountedCancel(ctx, cancel, &pending)
+
+	trustedServers, untrustedServers := s.selectedResolvers(pinnedClientFromContext(ctx))
+	trusted := make(chan *upstreamReply, 1)
+	untrusted := make(chan *upstreamReply, 1)
+	polluted := s.isDomainPolluted(qName)
+	if route != RouteUntrusted || polluted {
+		s.goroutines.Go("lookup "+qs+" in trusted servers", tcancel, func() {
+			lookupInServers(tctx, tcancel, trusted, req, trustedServers, s.selectionDelay(), s.Clock, s.hooks.hookLookup(s.lookupTrusted), s.goroutines)
+		})
+	} else {
+		tcancel()
+	}
+	if !polluted && route != RouteTrusted {
+		s.goroutines.Go("lookup "+qs+" in untrusted servers", ucancel, func() {
+			lookupInServers(uctx, ucancel, untrusted, req, untrustedServers, s.selectionDelay(), s.Clock, s.hooks.hookLookup(s.lookupUntrusted), s.goroutines)
+		})
 	} else {
 		ucancel()
 	}
 
+	if s.Scorer != nil {
+		reply = s.pickScored(ctx, logger, start, tctx.Done(), trusted, uctx.Done(), untrusted)
+		cancel()
+		return
+	}
 	select {
 	case rep := <-untrusted:
-		reply = s.processReply(ctx, logger, rep, trusted, s.processUntrustedAnswer)
+		if s.isSuspiciousRcode(rep) {
+			logger.WithField("rcode", dns.RcodeToString[rep.Rcode]).Debug("Untrusted reply has a suspicious rcode. Wait for trusted reply.")
+			rep.verdict = VerdictFallback
+			reply = s.waitTrusted(ctx, logger, rep, trusted)
+		} else if s.isSuspiciousEmpty(rep) {
+			logger.Debug("Untrusted reply has an empty answer. Wait for trusted reply.")
+			rep.verdict = VerdictFallback
+			reply = s.waitTrusted(ctx, logger, rep, trusted)
+		} else {
+			reply = s.processReply(ctx, logger, rep, trusted, s.processUntrustedAnswer)
+		}
 	case rep := <-trusted:
 		reply = s.processReply(ctx, logger, rep, untrusted, s.processTrustedAnswer)
 	case <-ctx.Done():
 	}
 	// notify lookupInServers to quit.
 	cancel()
+	return
+}
 
-	if reply != nil {
-		// https://github.com/miekg/dns/issues/216
-		reply.Compress = true
-	} else {
-		reply = new(dns.Msg)
-		reply.SetReply(req)
+// withCountedCancel returns a child context of parent like context.WithCancel, whose cancel function also decrements
+// pending the first time it's called, and calls done once pending drops to zero.
+func withCountedCancel(parent context.Context, done context.CancelFunc, pending *int32) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	var once sync.Once
+	return ctx, func() {
+		cancel()
+		once.Do(func() {
+			if atomic.AddInt32(pending, -1) == 0 {
+				done()
+			}
+		})
+	}
+}
+
+// isDomainBlocked checks name against domain blacklist and scheduled blocking rules.
+// Whitelist takes precedence, so that a whitelisted domain (or its subdomain) is never blocked.
+func (s *Server) isDomainBlocked(name string, client net.IP) bool {
+	s.listsMu.RLock()
+	defer s.listsMu.RUnlock()
+	if s.DomainWhitelist.Contain(name) {
+		return false
+	}
+	return s.DomainBlacklist.Contain(name) || s.BlockSchedule.Blocks(client, name, s.Clock.Now())
+}
+
+func (s *Server) isDomainPolluted(name string) bool {
+	if s.verifier.IsFlagged(name) {
+		return true
 	}
+	s.listsMu.RLock()
+	defer s.listsMu.RUnlock()
+	return s.DomainPolluted.Contain(name) || s.PollutedSites.Contain(name)
+}
 
-	_ = w.WriteMsg(reply)
-	logger.Debug("SERVING RTT: ", time.Since(start))
+// isBlacklistedIP checks whether ip is in the IP blacklist, or learned as poisoned from canary domains.
+// An IPv6 address embedding an IPv4 address (see embeddedIPv4) is blacklisted if either of them is.
+func (s *Server) isBlacklistedIP(ip net.IP) (bool, error) {
+	hit, err := s.isBlacklistedAddr(ip)
+	if ip4 := embeddedIPv4(ip); !hit && err == nil && ip4 != nil {
+		hit, err = s.isBlacklistedAddr(ip4)
+	}
+	return hit, err
 }
 
+func (s *Server) isBlacklistedAddr(ip net.IP) (bool, error) {
+	if s.canary.IsPoisoned(ip) {
+		return true, nil
+	}
+	return s.loadMatchers().blacklist.Has(ip), nil
+}
+
+// clientIP returns IP address of the client, or nil if unknown.
+func clientIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// normalizeRequest prepares req to query upstreams. The DO bit and EDNS options of the client are kept as is,
+// and only the UDP size is raised. The DO bit is always set if DNSSEC validation is enabled, in order to get signatures.
+// edns-tcp-keepalive is removed, which is about the connection of the client only.
+// RD is set unless the recursion mode preserves it.
 func (s *Server) normalizeRequest(req *dns.Msg) {
-	req.RecursionDesired = true
+	if s.RecursionMode != RecursionPreserve {
+		req.RecursionDesired = true
+	}
+	if opt := req.IsEdns0(); opt != nil {
+		opt.Option = removeEDNSOption(opt.Option, dns.EDNS0TCPKEEPALIVE)
+	}
 	if !s.TCPOnly {
 		setUDPSize(req, uint16(s.UDPMaxSize))
 	}
+	if s.DNSSEC {
+		if opt := req.IsEdns0(); opt != nil {
+			opt.SetDo()
+		} else {
+			req.SetEdns0(dns.DefaultMsgSize, true)
+		}
+	}
 }
 
 func (s *Server) processReply(
-	ctx context.Context, logger *logrus.Entry, rep *dns.Msg, other <-chan *dns.Msg,
-	process func(context.Context, *logrus.Entry, *dns.Msg, net.IP, <-chan *dns.Msg) *dns.Msg,
-) (reply *dns.Msg) {
-	reply = rep
+	ctx context.Context, logger *logrus.Entry, rep *upstreamReply, other <-chan *upstreamReply,
+	process func(context.Context, *logrus.Entry, *upstreamReply, []net.IP, <-chan *upstreamReply) *upstreamReply,
+) (reply *upstreamReply) {
+	reply, ips := s.addressedReply(ctx, logger, rep)
+	if len(ips) == 0 {
+		rep.verdict = VerdictNoAddress
+		return rep
+	}
+	return process(ctx, logger, reply, ips, other)
+}
+
+// addressedReply returns rep and IPs of its answer, or the reply of the CNAME chain dangling in its answer chased
+// (see WithCNAMEChase) and IPs at the end of it. IPs are nil if the answer has none.
+func (s *Server) addressedReply(ctx context.Context, logger *logrus.Entry, rep *upstreamReply) (*upstreamReply, []net.IP) {
 	for i, rr := range rep.Answer {
 		switch answer := rr.(type) {
-		case *dns.A:
-			return process(ctx, logger, rep, answer.A, other)
-		case *dns.AAAA:
-			return process(ctx, logger, rep, answer.AAAA, other)
+		case *dns.A, *dns.AAAA:
+			return rep, answerIPs(rep.Msg)
 		case *dns.CNAME:
 			if i < len(rep.Answer)-1 {
 				continue
 			}
-			logger.Debug("CNAME to ", answer.Target)
-			return
+			logger.Debug("CNAME to ", RedactName(answer.Target))
+			if chased := s.chaseCNAME(ctx, logger, rep); chased != nil {
+				if ips := answerIPs(chased.Msg); len(ips) > 0 {
+					return chased, ips
+				}
+			}
+			return rep, nil
 		default:
-			return
+			return rep, nil
 		}
 	}
-	return
+	return rep, nil
 }
 
-func (s *Server) processUntrustedAnswer(ctx context.Context, logger *logrus.Entry, rep *dns.Msg, answer net.IP, trusted <-chan *dns.Msg) (reply *dns.Msg) {
+func (s *Server) processUntrustedAnswer(ctx context.Context, logger *logrus.Entry, rep *upstreamReply, answers []net.IP, trusted <-chan *upstreamReply) (reply *upstreamReply) {
 	reply = rep
-	logger = logger.WithField("answer", answer)
+	reply.verdict = VerdictFallback
+	logger = logger.WithField("answers", answers)
 
-	hit, err := s.IPBlacklist.Contains(answer)
+	hit, err := s.isBlacklistedAnswer(answers)
 	if err != nil {
 		logger.WithError(err).Error("Blacklist CIDR error.")
 	}
 	if hit {
 		logger.Debug("Answer hit blacklist. Wait for trusted reply.")
 	} else {
-		contain, err := s.ChinaCIDR.Contains(answer)
+		contain, err := s.isChinaAnswer(ctx, answers)
 		if err != nil {
 			logger.WithError(err).Error("CIDR error.")
 		}
 		if contain {
 			logger.Debug("Answer belongs to China. Use it.")
+			reply.verdict = VerdictChina
 			return
 		}
 		logger.Debug("Answer is overseas. Wait for trusted reply.")
 	}
+	return s.waitTrusted(ctx, logger, reply, trusted)
+}
 
+// waitTrusted waits for a trusted reply to replace rep, an untrusted reply which is used as fallback.
+func (s *Server) waitTrusted(ctx context.Context, logger *logrus.Entry, rep *upstreamReply, trusted <-chan *upstreamReply) (reply *upstreamReply) {
+	reply = rep
+	inflightFromContext(ctx).SetState(QueryStateWaitingTrusted)
 	select {
 	case rep := <-trusted:
 		reply = s.processReply(ctx, logger, rep, nil, s.processTrustedAnswer)
@@ -183,35 +535,55 @@ func (s *Server) processUntrustedAnswer(ctx context.Context, logger *logrus.Entr
 	return
 }
 
-func (s *Server) processTrustedAnswer(ctx context.Context, logger *logrus.Entry, rep *dns.Msg, answer net.IP, untrusted <-chan *dns.Msg) (reply *dns.Msg) {
+func (s *Server) processTrustedAnswer(ctx context.Context, logger *logrus.Entry, rep *upstreamReply, answers []net.IP, untrusted <-chan *upstreamReply) (reply *upstreamReply) {
 	reply = rep
-	logger = logger.WithField("answer", answer)
+	reply.verdict = VerdictFallback
+	logger = logger.WithField("answers", answers)
 
-	hit, err := s.IPBlacklist.Contains(answer)
+	hit, err := s.isBlacklistedAnswer(answers)
 	if err != nil {
 		logger.WithError(err).Error("Blacklist CIDR error.")
 	}
+	if !hit && s.dnssec != nil {
+		if err = s.dnssec.Validate(ctx, rep.Msg); errors.Is(err, errDNSSECBogus) {
+			logger.WithError(err).Warn("Answer fails DNSSEC validation. Wait for untrusted reply.")
+			hit = true
+		} else if err != nil {
+			logger.WithError(err).Debug("Answer can't be validated by DNSSEC. Take it as insecure.")
+		}
+	}
 	if hit {
 		logger.Debug("Answer hit blacklist. Wait for trusted reply.")
 	} else {
 		if !s.Bidirectional {
 			logger.Debug("Answer is trusted. Use it.")
+			reply.verdict = VerdictTrusted
 			return
 		}
 
-		contain, err := s.ChinaCIDR.Contains(answer)
+		contain, err := s.isChinaAnswer(ctx, answers)
 		if err != nil {
 			logger.WithError(err).Error("CIDR error.")
 		}
 		if !contain {
 			logger.Debug("Answer is trusted and overseas. Use it.")
+			reply.verdict = VerdictOverseas
 			return
 		}
 		logger.Debug("Answer may not be the nearest. Wait for untrusted reply.")
 	}
 
+	inflightFromContext(ctx).SetState(QueryStateWaitingUntrusted)
 	select {
 	case rep := <-untrusted:
+		if s.isSuspiciousRcode(rep) {
+			logger.WithField("rcode", dns.RcodeToString[rep.Rcode]).Debug("Untrusted reply has a suspicious rcode. Use this as fallback.")
+			break
+		}
+		if s.isSuspiciousEmpty(rep) {
+			logger.Debug("Untrusted reply has an empty answer. Use this as fallback.")
+			break
+		}
 		reply = s.processReply(ctx, logger, rep, nil, s.processUntrustedAnswer)
 	case <-ctx.Done():
 		logger.Debug("No untrusted reply. Use this as fallback.")
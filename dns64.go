@@ -0,0 +1,120 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultDNS64Prefix is the well-known prefix of NAT64 (RFC 6052).
+const DefaultDNS64Prefix = "64:ff9b::/96"
+
+// WithDNS64 synthesizes AAAA records from A records of domains without native AAAA records (RFC 6147),
+// by embedding IPv4 addresses in prefix, for IPv6-only clients behind a NAT64 gateway.
+// prefix must be an IPv6 network of length 32, 40, 48, 56, 64 or 96 (RFC 6052). DNS64 is disabled if prefix is empty.
+func WithDNS64(prefix string) ServerOption {
+	return func(o *serverOptions) error {
+		if prefix == "" {
+			o.DNS64Prefix = nil
+			return nil
+		}
+		ip, network, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return fmt.Errorf("invalid DNS64 prefix: %w", err)
+		}
+		ones, bits := network.Mask.Size()
+		if ip.To4() != nil || bits != 8*net.IPv6len {
+			return fmt.Errorf("DNS64 prefix %s is not IPv6", prefix)
+		}
+		switch ones {
+		case 32, 40, 48, 56, 64, 96:
+		default:
+			return fmt.Errorf("DNS64 prefix length should be 32, 40, 48, 56, 64 or 96, got %d", ones)
+		}
+		o.DNS64Prefix = network
+		return nil
+	}
+}
+
+// synthesizeIPv6 embeds ip4 in prefix by RFC 6052, where bits 64 to 71 are skipped.
+func synthesizeIPv6(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	i := ones / 8
+	for _, b := range ip4.To4() {
+		if i == 8 {
+			i++
+		}
+		ip[i] = b
+		i++
+	}
+	return ip
+}
+
+// hasNativeAAAA tells whether m contains AAAA records, excluding IPv4-mapped addresses (RFC 6147 section 5.1.4).
+func hasNativeAAAA(m *dns.Msg) bool {
+	for _, rr := range m.Answer {
+		if aaaa, ok := rr.(*dns.AAAA); ok && !isIPv4Mapped(aaaa.AAAA) {
+			return true
+		}
+	}
+	return false
+}
+
+func isIPv4Mapped(ip net.IP) bool {
+	return len(ip) == net.IPv6len && ip.To4() != nil
+}
+
+// synthesizeDNS64 returns a reply of AAAA records synthesized from A records, if DNS64 is enabled and reply of
+// the AAAA question req contains no native AAAA records. Otherwise reply is returned as is.
+// Clients validating DNSSEC themselves (with DO and CD bits) get no synthesized records, which would fail validation.
+func (s *Server) synthesizeDNS64(ctx context.Context, logger *logrus.Entry, req *dns.Msg, reply *upstreamReply) *upstreamReply {
+	if s.DNS64Prefix == nil || req.Question[0].Qtype != dns.TypeAAAA || s.AAAAMode == AAAAPreferIPv4 {
+		return reply
+	}
+	if reply == nil || reply.Rcode != dns.RcodeSuccess || hasNativeAAAA(reply.Msg) {
+		return reply
+	}
+	if opt := req.IsEdns0(); opt != nil && opt.Do() && req.CheckingDisabled {
+		return reply
+	}
+
+	areq := req.Copy()
+	areq.Id = dns.Id()
+	areq.Question[0].Qtype = dns.TypeA
+	logger = logger.WithField("dns64", questionString(&areq.Question[0]))
+	arep := s.resolveShared(ctx, logger, areq)
+	if arep == nil || arep.Rcode != dns.RcodeSuccess {
+		return reply
+	}
+
+	m := reply.Msg.Copy()
+	m.Answer, m.Ns = nil, nil
+	m.AuthenticatedData = false
+	synthesized := 0
+	for _, rr := range arep.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			if rr.A.IsLoopback() || rr.A.IsUnspecified() || rr.A.IsLinkLocalUnicast() {
+				continue
+			}
+			hdr := rr.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: synthesizeIPv6(s.DNS64Prefix, rr.A)})
+			synthesized++
+		case *dns.RRSIG:
+			// Signatures don't cover synthesized records.
+		default:
+			m.Answer = append(m.Answer, dns.Copy(rr))
+		}
+	}
+	if synthesized == 0 {
+		return reply
+	}
+	logger.Debugf("Synthesized %d AAAA records by DNS64.", synthesized)
+	return &upstreamReply{Msg: m, server: arep.server, rtt: arep.rtt, verdict: arep.verdict}
+}
@@ -0,0 +1,68 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestSynthesizeIPv6(t *testing.T) {
+	for prefix, want := range map[string]string{
+		"64:ff9b::/96":          "64:ff9b::c000:221",
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+	} {
+		o := newServerOptions()
+		if err := WithDNS64(prefix)(o); err != nil {
+			t.Fatal(err)
+		}
+		if got := synthesizeIPv6(o.DNS64Prefix, net.ParseIP("192.0.2.33")); !got.Equal(net.ParseIP(want)) {
+			t.Errorf("192.0.2.33 in %s should be %s, got %s", prefix, want, got)
+		}
+	}
+	for _, prefix := range []string{"64:ff9b::/80", "192.0.2.0/24", "nat64"} {
+		if err := WithDNS64(prefix)(newServerOptions()); err == nil {
+			t.Errorf("Invalid prefix %s should fail", prefix)
+		}
+	}
+}
+
+func TestSynthesizeDNS64(t *testing.T) {
+	o := newServerOptions()
+	o.Delay = time.Second
+	if err := WithDNS64(DefaultDNS64Prefix)(o); err != nil {
+		t.Fatal(err)
+	}
+	o.TrustedServers = resolverList{startAnswerUpstream(t, "192.0.2.33", "127.0.0.1")}
+	s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second)), goroutines: newGoroutineTracker()}
+	logger := logrus.WithField("test", t.Name())
+
+	req := new(dns.Msg)
+	req.SetQuestion("ipv4only.example.com.", dns.TypeAAAA)
+	empty := new(dns.Msg)
+	empty.SetReply(req)
+	reply := s.synthesizeDNS64(context.Background(), logger, req, &upstreamReply{Msg: empty})
+	if len(reply.Answer) != 1 {
+		t.Fatalf("AAAA records should be synthesized except for loopback, got %v", reply.Answer)
+	}
+	if aaaa, ok := reply.Answer[0].(*dns.AAAA); !ok || !aaaa.AAAA.Equal(net.ParseIP("64:ff9b::c000:221")) || aaaa.Hdr.Name != "ipv4only.example.com." {
+		t.Errorf("Unexpected synthesized record %v", reply.Answer[0])
+	}
+
+	native := newTestAAAAReply("ipv4only.example.com.", "2001:db8::1")
+	if reply := s.synthesizeDNS64(context.Background(), logger, req, &upstreamReply{Msg: native}); reply.Msg != native {
+		t.Error("Native AAAA records should be kept")
+	}
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	req.CheckingDisabled = true
+	if reply := s.synthesizeDNS64(context.Background(), logger, req, &upstreamReply{Msg: empty}); reply.Msg != empty {
+		t.Error("AAAA records should not be synthesized for clients validating DNSSEC")
+	}
+}
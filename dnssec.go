@@ -0,0 +1,421 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// dnssecMaxKeyTTL caps how long validated keys, and proofs of insecure delegations, are kept.
+	dnssecMaxKeyTTL = time.Hour
+	// dnssecMaxDepth limits zones walked up to the root, against loops of bogus signer names.
+	dnssecMaxDepth = 16
+	// dnssecMaxZones limits zones, and names proven not to be zones, kept with their keys.
+	dnssecMaxZones = 10000
+)
+
+// rootAnchors are DS records of the root KSKs (KSK-2017 and KSK-2024), the trust anchors of DNSSEC validation.
+var rootAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// errDNSSECBogus is wrapped by errors of answers failing validation. Other errors of validation, such as failures to
+// look up keys, leave answers indeterminate rather than bogus.
+var errDNSSECBogus = errors.New("DNSSEC bogus")
+
+// WithDNSSECValidation validates DNSSEC signatures of trusted answers. The DO bit is set on upstream queries,
+// and signatures in answers are verified along the chain of trust from the root. An answer failing validation
+// is treated like one hitting the IP blacklist, so that the server waits for the untrusted reply.
+func WithDNSSECValidation(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.DNSSEC = b
+		return nil
+	}
+}
+
+// zoneKeys are validated DNSKEYs of a zone, or what its parent proves about the name otherwise.
+type zoneKeys struct {
+	keys     []*dns.DNSKEY
+	insecure bool // the parent proves the delegation to the zone has no DS, so its signatures can't be validated
+	noZone   bool // the parent proves the name is no delegation, but a name of the parent zone
+	absent   bool // the parent proves the name doesn't exist, nor do names under it
+	expire   time.Time
+}
+
+// dnssecValidator validates signatures of answers. Keys of zones are looked up by lookup and cached.
+type dnssecValidator struct {
+	lookup  func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error)
+	anchors []*dns.DS
+
+	mu   sync.Mutex
+	keys map[string]*zoneKeys // indexed by zone in lower case
+}
+
+func newDNSSECValidator(lookup func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error), anchors ...string) *dnssecValidator {
+	v := &dnssecValidator{
+		lookup: lookup,
+		keys:   make(map[string]*zoneKeys),
+	}
+	for _, a := range anchors {
+		rr, err := dns.NewRR(a)
+		if err != nil {
+			panic(err)
+		}
+		v.anchors = append(v.anchors, rr.(*dns.DS))
+	}
+	return v
+}
+
+// Validate verifies RRsets in the answer section of m, walking the chain of trust down to each owner name. RRsets
+// under a delegation proven insecure by its parent are accepted, and others must be signed along the chain. The
+// error wraps errDNSSECBogus if m fails validation, and doesn't if m can't be validated, such as keys failing to be
+// looked up.
+func (v *dnssecValidator) Validate(ctx context.Context, m *dns.Msg) error {
+	sets, sigs := splitRRsets(m.Answer)
+	for key, set := range sets {
+		insecure, err := v.provenInsecure(ctx, key.name)
+		if err != nil {
+			return err
+		}
+		if insecure {
+			continue
+		}
+		if len(sigs[key]) == 0 {
+			return fmt.Errorf("%w: signatures of %s %s in a signed zone are missing", errDNSSECBogus,
+				RedactName(key.name), dns.TypeToString[key.rrtype])
+		}
+		if _, err = v.verifyRRset(ctx, set, sigs[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// provenInsecure walks the chain of trust from the root down to name, and tells whether a delegation on the way is
+// proven to have no DS, so that name can't be signed.
+func (v *dnssecValidator) provenInsecure(ctx context.Context, name string) (bool, error) {
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - 1; i >= 0; i-- {
+		zk, err := v.zoneKeys(ctx, strings.Join(labels[i:], ".")+".", 0)
+		if err != nil {
+			return false, err
+		}
+		if zk.insecure {
+			return true, nil
+		}
+		if zk.absent {
+			break
+		}
+	}
+	return false, nil
+}
+
+// verifyRRset verifies set by one of sigs. It returns false if the signer zone is insecure.
+func (v *dnssecValidator) verifyRRset(ctx context.Context, set []dns.RR, sigs []*dns.RRSIG) (secure bool, err error) {
+	return v.verifyRRsetDepth(ctx, set, sigs, 0)
+}
+
+func (v *dnssecValidator) verifyRRsetDepth(ctx context.Context, set []dns.RR, sigs []*dns.RRSIG, depth int) (secure bool, err error) {
+	owner := set[0].Header().Name
+	now := time.Now()
+	err = fmt.Errorf("%w: no valid signature of %s %s", errDNSSECBogus, RedactName(owner), dns.TypeToString[set[0].Header().Rrtype])
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, owner) || !sig.ValidityPeriod(now) {
+			continue
+		}
+		zk, e := v.zoneKeys(ctx, sig.SignerName, depth+1)
+		if e != nil {
+			err = e
+			continue
+		}
+		if zk.insecure {
+			return false, nil
+		}
+		for _, k := range zk.keys {
+			if sig.Verify(k, set) == nil {
+				return true, nil
+			}
+		}
+	}
+	return false, err
+}
+
+// zoneKeys returns validated keys of zone. Keys of the root are validated by the trust anchors, and keys of other
+// zones are validated by DS records in their parents. Without DS records, the parent must prove by NSEC or NSEC3
+// that zone is an insecure delegation, or no zone at all.
+func (v *dnssecValidator) zoneKeys(ctx context.Context, zone string, depth int) (*zoneKeys, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	if depth > dnssecMaxDepth {
+		return nil, fmt.Errorf("%w: chain of trust of %s is too long", errDNSSECBogus, RedactName(zone))
+	}
+	v.mu.Lock()
+	zk := v.keys[zone]
+	v.mu.Unlock()
+	if zk != nil && time.Now().Before(zk.expire) {
+		return zk, nil
+	}
+
+	var anchors []*dns.DS
+	ttl := dnssecMaxKeyTTL
+	if zone == "." {
+		anchors = v.anchors
+	} else {
+		reply, err := v.lookup(ctx, zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		if reply.Rcode != dns.RcodeSuccess && reply.Rcode != dns.RcodeNameError {
+			return nil, fmt.Errorf("fail to look up DS of %s: %s", RedactName(zone), dns.RcodeToString[reply.Rcode])
+		}
+		sets, sigs := splitRRsets(reply.Answer)
+		key := rrsetKey{name: zone, rrtype: dns.TypeDS}
+		if len(sets[key]) == 0 {
+			if zk, err = v.proveNoDS(ctx, zone, reply, depth); err != nil {
+				return nil, err
+			}
+			v.setZoneKeys(zone, zk)
+			return zk, nil
+		}
+		secure, err := v.verifyRRsetDepth(ctx, sets[key], sigs[key], depth)
+		if err != nil {
+			return nil, err
+		}
+		if !secure {
+			zk = &zoneKeys{insecure: true, expire: time.Now().Add(ttl)}
+			v.setZoneKeys(zone, zk)
+			return zk, nil
+		}
+		for _, rr := range sets[key] {
+			anchors = append(anchors, rr.(*dns.DS))
+		}
+		ttl = capTTL(ttl, sets[key])
+	}
+
+	reply, err := v.lookup(ctx, zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	sets, sigs := splitRRsets(reply.Answer)
+	key := rrsetKey{name: zone, rrtype: dns.TypeDNSKEY}
+	keySet := sets[key]
+	var keys []*dns.DNSKEY
+	for _, rr := range keySet {
+		keys = append(keys, rr.(*dns.DNSKEY))
+	}
+	now := time.Now()
+	for _, sig := range sigs[key] {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, k := range keys {
+			if !matchDS(k, anchors) || sig.Verify(k, keySet) != nil {
+				continue
+			}
+			zk = &zoneKeys{keys: keys, expire: now.Add(capTTL(ttl, keySet))}
+			v.setZoneKeys(zone, zk)
+			return zk, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: no DNSKEY of %s matches its DS", errDNSSECBogus, RedactName(zone))
+}
+
+// proveNoDS looks for NSEC or NSEC3 records in the authority section of reply, a reply to the DS query of zone
+// without DS records, proving what zone is. The records must be signed by a zone above zone, rather than zone
+// itself, whose apex NSEC denies DS on the child side of the delegation.
+func (v *dnssecValidator) proveNoDS(ctx context.Context, zone string, reply *dns.Msg, depth int) (*zoneKeys, error) {
+	sets, sigs := splitRRsets(reply.Ns)
+	err := fmt.Errorf("%w: absence of DS of %s is not proven", errDNSSECBogus, RedactName(zone))
+	for key, set := range sets {
+		var proof *zoneKeys
+		switch rr := set[0].(type) {
+		case *dns.NSEC:
+			proof = nsecProof(zone, rr)
+		case *dns.NSEC3:
+			proof = nsec3Proof(zone, rr)
+		}
+		if proof == nil {
+			continue
+		}
+		var parentSigs []*dns.RRSIG
+		for _, sig := range sigs[key] {
+			if signer := strings.ToLower(sig.SignerName); signer != zone && dns.IsSubDomain(signer, zone) {
+				parentSigs = append(parentSigs, sig)
+			}
+		}
+		if len(parentSigs) == 0 {
+			continue
+		}
+		secure, e := v.verifyRRsetDepth(ctx, set, parentSigs, depth)
+		if e != nil {
+			if !errors.Is(e, errDNSSECBogus) {
+				return nil, e
+			}
+			continue
+		}
+		if !secure {
+			proof = &zoneKeys{insecure: true}
+		}
+		proof.expire = time.Now().Add(capTTL(dnssecMaxKeyTTL, set))
+		return proof, nil
+	}
+	return nil, err
+}
+
+// nsecProof returns what nsec proves about zone without DS, or nil if it proves nothing.
+func nsecProof(zone string, nsec *dns.NSEC) *zoneKeys {
+	if strings.EqualFold(nsec.Hdr.Name, zone) {
+		return typeBitMapProof(nsec.TypeBitMap)
+	}
+	owner, next := strings.ToLower(nsec.Hdr.Name), strings.ToLower(nsec.NextDomain)
+	covered := canonicalLess(owner, zone) && canonicalLess(zone, next)
+	if !canonicalLess(owner, next) {
+		// The last NSEC of a zone points back to its apex.
+		covered = canonicalLess(owner, zone) || canonicalLess(zone, next)
+	}
+	if covered {
+		return &zoneKeys{noZone: true, absent: true}
+	}
+	return nil
+}
+
+// nsec3Proof returns what nsec3 proves about zone without DS, or nil if it proves nothing. A covering NSEC3 with the
+// opt-out flag may skip unsigned delegations, so zone is insecure if there is one.
+func nsec3Proof(zone string, nsec3 *dns.NSEC3) *zoneKeys {
+	switch {
+	case nsec3.Match(zone):
+		return typeBitMapProof(nsec3.TypeBitMap)
+	case nsec3.Cover(zone):
+		if nsec3.Flags&1 != 0 {
+			return &zoneKeys{insecure: true}
+		}
+		return &zoneKeys{noZone: true, absent: true}
+	}
+	return nil
+}
+
+// typeBitMapProof returns what types of a name in its parent zone prove, provided there is no DS: it's an
+// insecure delegation with NS, or a name of the parent zone without NS.
+func typeBitMapProof(types []uint16) *zoneKeys {
+	var ns bool
+	for _, t := range types {
+		switch t {
+		case dns.TypeDS:
+			return nil
+		case dns.TypeNS:
+			ns = true
+		}
+	}
+	if ns {
+		return &zoneKeys{insecure: true}
+	}
+	return &zoneKeys{noZone: true}
+}
+
+// canonicalLess tells whether name a sorts before b in the canonical order of RFC 4034, comparing labels from the
+// right. Names are in lower case.
+func canonicalLess(a, b string) bool {
+	la, lb := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if la[i] != lb[j] {
+			return la[i] < lb[j]
+		}
+	}
+	return len(la) < len(lb)
+}
+
+// setZoneKeys caches zk of zone. Expired zones are swept if there are too many.
+func (v *dnssecValidator) setZoneKeys(zone string, zk *zoneKeys) {
+	now := time.Now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.keys) >= dnssecMaxZones {
+		for z, k := range v.keys {
+			if now.After(k.expire) {
+				delete(v.keys, z)
+			}
+		}
+		if len(v.keys) >= dnssecMaxZones {
+			return
+		}
+	}
+	v.keys[zone] = zk
+}
+
+// matchDS tells whether k is the key of one of ds.
+func matchDS(k *dns.DNSKEY, ds []*dns.DS) bool {
+	tag := k.KeyTag()
+	for _, d := range ds {
+		if d.KeyTag != tag || d.Algorithm != k.Algorithm {
+			continue
+		}
+		if kd := k.ToDS(d.DigestType); kd != nil && strings.EqualFold(kd.Digest, d.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+// splitRRsets groups rrs into RRsets, and RRSIGs by the RRsets they cover. Names are in lower case.
+func splitRRsets(rrs []dns.RR) (sets map[rrsetKey][]dns.RR, sigs map[rrsetKey][]*dns.RRSIG) {
+	sets = make(map[rrsetKey][]dns.RR)
+	sigs = make(map[rrsetKey][]*dns.RRSIG)
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey{name: name, rrtype: sig.TypeCovered}
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		key := rrsetKey{name: name, rrtype: rr.Header().Rrtype}
+		sets[key] = append(sets[key], rr)
+	}
+	return
+}
+
+// capTTL lowers ttl to the minimal TTL of rrs.
+func capTTL(ttl time.Duration, rrs []dns.RR) time.Duration {
+	for _, rr := range rrs {
+		if t := time.Duration(rr.Header().Ttl) * time.Second; t < ttl {
+			ttl = t
+		}
+	}
+	return ttl
+}
+
+// lookupDNSSEC looks up DNSSEC records of name in trusted servers, which are tried in order.
+func (s *Server) lookupDNSSEC(ctx context.Context, name string, qtype uint16) (reply *dns.Msg, err error) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	req.SetEdns0(dns.DefaultMsgSize, true)
+	// Validation is done here, so that bogus records are returned to be checked rather than SERVFAIL.
+	req.CheckingDisabled = true
+
+	trusted, _ := s.activeResolvers()
+	err = errors.New("no trusted server")
+	for _, server := range trusted {
+		if reply, _, err = s.lookupTrusted(ctx, req.Copy(), server); err == nil {
+			return
+		}
+		logrus.WithField("server", server).WithError(err).Debug("Fail to look up DNSSEC records.")
+	}
+	return nil, err
+}
+
+// hasDO tells whether m is a reply to a query with the DO bit set.
+func hasDO(m *dns.Msg) bool {
+	opt := m.IsEdns0()
+	return opt != nil && opt.Do()
+}
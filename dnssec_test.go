@@ -0,0 +1,153 @@
+package gochinadns
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is a signed zone with a single key.
+type testZone struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testZone{key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *testZone) sign(t *testing.T, rrs ...dns.RR) []dns.RR {
+	t.Helper()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrs[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrs[0].Header().Ttl},
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.key.Hdr.Name,
+		Algorithm:  z.key.Algorithm,
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+	}
+	if err := sig.Sign(z.priv, rrs); err != nil {
+		t.Fatal(err)
+	}
+	return append(rrs, sig)
+}
+
+// nsec returns an NSEC record of name with types.
+func nsec(name, next string, types ...uint16) *dns.NSEC {
+	return &dns.NSEC{
+		Hdr:        dns.RR_Header{Name: name, Rrtype: dns.TypeNSEC, Class: dns.ClassINET, Ttl: 3600},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+func TestDNSSECValidate(t *testing.T) {
+	root, example := newTestZone(t, "."), newTestZone(t, "example.")
+	ds := example.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+	records := map[string][]dns.RR{
+		".":        root.sign(t, root.key),
+		"example.": example.sign(t, example.key),
+	}
+	dsRecords := map[string][]dns.RR{"example.": root.sign(t, ds)}
+	// Proofs of DS absence in the authority section.
+	sub := &dns.NSEC3{
+		Hdr:        dns.RR_Header{Name: dns.HashName("sub.example.", dns.SHA1, 0, "") + ".example.", Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 3600},
+		Hash:       dns.SHA1,
+		NextDomain: dns.HashName("next.example.", dns.SHA1, 0, ""),
+		TypeBitMap: []uint16{dns.TypeNS},
+	}
+	child := newTestZone(t, "child.")
+	proofs := map[string][]dns.RR{
+		"insecure.":    root.sign(t, nsec("insecure.", "stripped.", dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC)),
+		"www.example.": example.sign(t, nsec("www.example.", "example.", dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC)),
+		"sub.example.": example.sign(t, sub),
+		// An NSEC of the child apex, rather than of the parent, proves nothing about DS.
+		"child.": child.sign(t, nsec("child.", "child.", dns.TypeSOA, dns.TypeNS, dns.TypeDNSKEY)),
+	}
+	lookup := func(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+		if strings.HasSuffix(name, "down.") {
+			return nil, errors.New("timeout")
+		}
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		switch qtype {
+		case dns.TypeDNSKEY:
+			m.Answer = records[name]
+		case dns.TypeDS:
+			m.Answer = dsRecords[name]
+			m.Ns = proofs[name]
+		}
+		return m, nil
+	}
+	v := newDNSSECValidator(lookup, root.key.ToDS(dns.SHA256).String())
+	ctx := context.Background()
+
+	answer := func(name, ip string) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(ip),
+		}}
+		return m
+	}
+
+	signed := answer("www.example.", "10.0.0.1")
+	signed.Answer = example.sign(t, signed.Answer...)
+	if err := v.Validate(ctx, signed); err != nil {
+		t.Fatalf("signed answer: %v", err)
+	}
+	forged := signed.Copy()
+	forged.Answer[0].(*dns.A).A = net.ParseIP("10.0.0.2")
+	if err := v.Validate(ctx, forged); !errors.Is(err, errDNSSECBogus) {
+		t.Errorf("forged answer should be bogus, got %v", err)
+	}
+	if err := v.Validate(ctx, answer("www.example.", "10.0.0.2")); !errors.Is(err, errDNSSECBogus) {
+		t.Errorf("answer without signatures in a signed zone should be bogus, got %v", err)
+	}
+
+	// Unsigned answers are insecure only under delegations proven to have no DS.
+	for _, name := range []string{"www.insecure.", "www.sub.example."} {
+		if err := v.Validate(ctx, answer(name, "10.0.0.1")); err != nil {
+			t.Errorf("unsigned answer of %s under an insecure delegation: %v", name, err)
+		}
+	}
+	for _, name := range []string{"www.stripped.", "www.child."} {
+		if err := v.Validate(ctx, answer(name, "10.0.0.1")); !errors.Is(err, errDNSSECBogus) {
+			t.Errorf("unsigned answer of %s without proof of DS absence should be bogus, got %v", name, err)
+		}
+	}
+
+	// Failures to look up keys leave answers indeterminate.
+	if err := v.Validate(ctx, answer("www.down.", "10.0.0.1")); err == nil || errors.Is(err, errDNSSECBogus) {
+		t.Errorf("answer failing to be validated should not be bogus, got %v", err)
+	}
+
+	// A key without DS in the parent can't sign the zone.
+	rogue := newTestZone(t, "example.")
+	records["example."] = rogue.sign(t, rogue.key)
+	v = newDNSSECValidator(lookup, root.key.ToDS(dns.SHA256).String())
+	rogueAnswer := answer("www.example.", "10.0.0.3")
+	rogueAnswer.Answer = rogue.sign(t, rogueAnswer.Answer...)
+	if err := v.Validate(ctx, rogueAnswer); !errors.Is(err, errDNSSECBogus) {
+		t.Errorf("answer signed by a key not matching DS should be bogus, got %v", err)
+	}
+}
@@ -1,9 +1,12 @@
 package doh
 
 import (
+	"context"
 	"encoding/base64"
 	"errors"
 	"io"
+	"mime"
+	"net"
 	"net/http"
 	"net/url"
 	"time"
@@ -19,6 +22,7 @@ var ErrQueryMyself = errors.New("not allowed to query myself")
 type clientOptions struct {
 	Timeout         time.Duration
 	SkipQueryMyself bool
+	DialContext     func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
 type ClientOption func(*clientOptions)
@@ -40,6 +44,13 @@ func WithSkipQueryMySelf(skip bool) ClientOption {
 	}
 }
 
+// WithDialContext sets the function to connect to servers, such as one through a proxy.
+func WithDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) ClientOption {
+	return func(o *clientOptions) {
+		o.DialContext = dial
+	}
+}
+
 type Client struct {
 	opt *clientOptions
 	cli *http.Client
@@ -53,12 +64,56 @@ func NewClient(opts ...ClientOption) *Client {
 	return &Client{
 		opt: o,
 		cli: &http.Client{
-			Timeout: o.Timeout,
+			Timeout:   o.Timeout,
+			Transport: newTransport(o),
 		},
 	}
 }
 
+// WithTimeout returns a client like c, with queries timing out after t instead, which shares the transport and its
+// connections with c.
+func (c *Client) WithTimeout(t time.Duration) *Client {
+	o := *c.opt
+	o.Timeout = t
+	return &Client{
+		opt: &o,
+		cli: &http.Client{
+			Timeout:   t,
+			Transport: c.cli.Transport,
+		},
+	}
+}
+
+// newTransport creates a dedicated HTTP transport, so that connections (HTTP/2 preferred)
+// to DoH servers are kept alive and reused across queries.
+// Proxies of the environment are ignored if DialContext is set, which usually dials through a proxy itself.
+func newTransport(o *clientOptions) *http.Transport {
+	t := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   o.Timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: o.Timeout,
+	}
+	if o.DialContext != nil {
+		t.Proxy = nil
+		t.DialContext = o.DialContext
+	}
+	return t
+}
+
+// Exchange is ExchangeContext with the background context.
 func (c *Client) Exchange(req *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error) {
+	return c.ExchangeContext(context.Background(), req, address)
+}
+
+// ExchangeContext sends req to the DoH server at address (a https:// URL) and waits for its reply, until ctx is done.
+func (c *Client) ExchangeContext(ctx context.Context, req *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error) {
 	var (
 		buf, b64 []byte
 		begin    = time.Now()
@@ -87,7 +142,10 @@ func (c *Client) Exchange(req *dns.Msg, address string) (r *dns.Msg, rtt time.Du
 	// No need to use hreq.URL.Query()
 	uri := address + "?dns=" + string(b64)
 	logrus.Debugln("DoH request:", uri)
-	hreq, _ := http.NewRequest("GET", uri, nil)
+	hreq, err := http.NewRequestWithContext(ctx, "GET", uri, nil)
+	if err != nil {
+		return
+	}
 	hreq.Header.Add("Accept", DoHMediaType)
 	resp, err := c.cli.Do(hreq)
 	if err != nil {
@@ -95,17 +153,31 @@ func (c *Client) Exchange(req *dns.Msg, address string) (r *dns.Msg, rtt time.Du
 	}
 	defer resp.Body.Close()
 
-	content, err := io.ReadAll(resp.Body)
+	// A DNS message is at most 64KiB, so anything longer is not read into memory.
+	content, err := io.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize+1))
 	if err != nil {
 		return
 	}
+	if len(content) > dns.MaxMsgSize {
+		err = errors.New("DoH query failed: reply exceeds 64KiB")
+		return
+	}
 	if resp.StatusCode != http.StatusOK {
 		err = errors.New("DoH query failed: " + string(content))
 		return
 	}
+	// Parameters of the media type, like charset, are ignored.
+	ct := resp.Header.Get("Content-Type")
+	if mediaType, _, e := mime.ParseMediaType(ct); e != nil || mediaType != DoHMediaType {
+		err = errors.New("DoH query failed: unexpected content type " + ct)
+		return
+	}
 
 	r = new(dns.Msg)
-	err = r.Unpack(content)
+	if err = r.Unpack(content); err != nil {
+		r = nil
+		return
+	}
 	r.Id = origID
 	rtt = time.Since(begin)
 	return
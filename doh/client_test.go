@@ -0,0 +1,52 @@
+package doh
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestContentType(t *testing.T) {
+	var contentType string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := new(dns.Msg)
+		b, err := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		if err == nil {
+			err = req.Unpack(b)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		b, _ = m.Pack()
+		w.Header().Set("Content-Type", contentType)
+		_, _ = w.Write(b)
+	}))
+	defer srv.Close()
+
+	c := NewClient(WithTimeout(time.Second))
+	for ct, ok := range map[string]bool{
+		DoHMediaType:                         true,
+		"application/dns-message; charset=x": true,
+		"Application/DNS-Message":            true,
+		"application/dns-message+json":       false,
+		"text/html; charset=utf-8":           false,
+		"":                                   false,
+	} {
+		contentType = ct
+		req := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+		r, _, err := c.Exchange(req, srv.URL+"/dns-query")
+		if (err == nil) != ok {
+			t.Errorf("Content type %q should be accepted: %v, got %v", ct, ok, err)
+		}
+		if err == nil && (len(r.Question) != 1 || r.Question[0] != req.Question[0]) {
+			t.Errorf("Unexpected reply %v", r)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+// Package dot implements a DNS over TLS (RFC 7858) client which keeps persistent connections to servers.
+package dot
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultMaxIdleConns = 4
+	defaultIdleTimeout  = 30 * time.Second
+)
+
+type clientOptions struct {
+	Timeout      time.Duration
+	MaxIdleConns int
+	IdleTimeout  time.Duration
+	DialContext  func(ctx context.Context, network, addr string) (net.Conn, error)
+	Trace        *Trace
+	RootCAs      *x509.CertPool // to verify servers, the system roots if nil
+}
+
+// Trace observes connections of a client. Any of its functions may be nil.
+type Trace struct {
+	TLSHandshakeDone func(address string, d time.Duration, err error) // after a TLS handshake with a server
+	ConnReused       func(address string)                             // when an idle connection is reused for a query
+}
+
+type ClientOption func(*clientOptions)
+
+// WithTimeout set a DNS query timeout
+func WithTimeout(t time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.Timeout = t
+	}
+}
+
+// WithMaxIdleConns limits idle connections kept for each server.
+func WithMaxIdleConns(n int) ClientOption {
+	return func(o *clientOptions) {
+		o.MaxIdleConns = n
+	}
+}
+
+// WithIdleTimeout sets how long an idle connection is kept before being closed.
+// Most servers close idle connections in tens of seconds, so it should be kept short.
+func WithIdleTimeout(t time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.IdleTimeout = t
+	}
+}
+
+// WithDialContext sets the function to connect to servers, such as one through a proxy.
+func WithDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) ClientOption {
+	return func(o *clientOptions) {
+		o.DialContext = dial
+	}
+}
+
+// WithTrace observes connections of the client by t.
+func WithTrace(t *Trace) ClientOption {
+	return func(o *clientOptions) {
+		o.Trace = t
+	}
+}
+
+type Client struct {
+	opt *clientOptions
+
+	sessions tls.ClientSessionCache // shared to resume TLS sessions on reconnecting
+	idle     *idlePool              // shared by clients of other timeouts, see WithTimeout
+}
+
+// idlePool keeps idle connections indexed by server address and name.
+type idlePool struct {
+	mu    sync.Mutex
+	conns map[string][]*conn
+}
+
+type conn struct {
+	*dns.Conn
+	lastUsed time.Time
+}
+
+func NewClient(opts ...ClientOption) *Client {
+	o := &clientOptions{
+		MaxIdleConns: defaultMaxIdleConns,
+		IdleTimeout:  defaultIdleTimeout,
+	}
+	for _, f := range opts {
+		f(o)
+	}
+	return &Client{
+		opt:      o,
+		sessions: tls.NewLRUClientSessionCache(0),
+		idle:     &idlePool{conns: make(map[string][]*conn)},
+	}
+}
+
+// WithTimeout returns a client like c, with queries timing out after t instead, which shares idle connections and TLS
+// sessions with c.
+func (c *Client) WithTimeout(t time.Duration) *Client {
+	o := *c.opt
+	o.Timeout = t
+	return &Client{opt: &o, sessions: c.sessions, idle: c.idle}
+}
+
+// Exchange is ExchangeContext with the background context.
+func (c *Client) Exchange(req *dns.Msg, address, serverName string) (r *dns.Msg, rtt time.Duration, err error) {
+	return c.ExchangeContext(context.Background(), req, address, serverName)
+}
+
+// ExchangeContext sends req to the DoT server at address (in ip:port format) and waits for its reply, until ctx is
+// done. The server certificate is verified against serverName, or the IP of address if serverName is empty.
+func (c *Client) ExchangeContext(ctx context.Context, req *dns.Msg, address, serverName string) (r *dns.Msg, rtt time.Duration, err error) {
+	begin := time.Now()
+	key := address + "#" + serverName
+
+	co, reused := c.get(key)
+	if reused && c.opt.Trace != nil && c.opt.Trace.ConnReused != nil {
+		c.opt.Trace.ConnReused(address)
+	}
+	if co == nil {
+		if co, err = c.dial(ctx, address, serverName); err != nil {
+			return
+		}
+	}
+	r, err = c.exchange(ctx, co, req)
+	if err != nil && reused && ctx.Err() == nil {
+		// The idle connection may be closed by server. Retry once with a fresh one.
+		_ = co.Close()
+		if co, err = c.dial(ctx, address, serverName); err != nil {
+			return
+		}
+		r, err = c.exchange(ctx, co, req)
+	}
+	rtt = time.Since(begin)
+	if err != nil {
+		_ = co.Close()
+		return
+	}
+	c.put(key, co)
+	return
+}
+
+// exchange sends req over co and waits for its reply. It's interrupted once ctx is done, and co should be closed then.
+func (c *Client) exchange(ctx context.Context, co *conn, req *dns.Msg) (*dns.Msg, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	// The deadline is reset even without a timeout, in case it's left by a query interrupted after its reply.
+	var deadline time.Time
+	if c.opt.Timeout > 0 {
+		deadline = time.Now().Add(c.opt.Timeout)
+	}
+	_ = co.SetDeadline(deadline)
+	defer interruptOnDone(ctx, co)()
+	if err := co.WriteMsg(req); err != nil {
+		return nil, contextError(ctx, err)
+	}
+	r, err := co.ReadMsg()
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	if r.Id != req.Id {
+		return r, dns.ErrId
+	}
+	return r, nil
+}
+
+func (c *Client) dial(ctx context.Context, address, serverName string) (*conn, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if serverName == "" {
+		if net.ParseIP(host) == nil {
+			return nil, errors.New("server name is required to verify " + address)
+		}
+		serverName = host
+	}
+	config := &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         tls.VersionTLS12,
+		ClientSessionCache: c.sessions,
+		RootCAs:            c.opt.RootCAs,
+	}
+	return c.dialContext(ctx, address, config)
+}
+
+// dialContext connects to address by DialContext (a plain dialer if not set), and then runs TLS handshake on the
+// connection, until ctx is done or the timeout of the client.
+func (c *Client) dialContext(ctx context.Context, address string, config *tls.Config) (*conn, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.opt.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.opt.Timeout)
+		defer cancel()
+	}
+	dial := c.opt.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: c.opt.Timeout, KeepAlive: c.opt.IdleTimeout}).DialContext
+	}
+	raw, err := dial(ctx, "tcp", address)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	tc := tls.Client(raw, config)
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = tc.SetDeadline(deadline)
+	}
+	start := time.Now()
+	stop := interruptOnDone(ctx, raw)
+	err = tc.Handshake()
+	stop()
+	if c.opt.Trace != nil && c.opt.Trace.TLSHandshakeDone != nil {
+		c.opt.Trace.TLSHandshakeDone(address, time.Since(start), err)
+	}
+	if err != nil {
+		_ = raw.Close()
+		return nil, contextError(ctx, err)
+	}
+	return &conn{Conn: &dns.Conn{Conn: tc}}, nil
+}
+
+// get pops the most recently used idle connection of key. Expired connections are closed.
+func (c *Client) get(key string) (co *conn, ok bool) {
+	c.idle.mu.Lock()
+	defer c.idle.mu.Unlock()
+	idle := c.idle.conns[key]
+	for len(idle) > 0 {
+		co, idle = idle[len(idle)-1], idle[:len(idle)-1]
+		if time.Since(co.lastUsed) < c.opt.IdleTimeout {
+			c.idle.conns[key] = idle
+			return co, true
+		}
+		_ = co.Close()
+	}
+	c.idle.conns[key] = idle
+	return nil, false
+}
+
+func (c *Client) put(key string, co *conn) {
+	co.lastUsed = time.Now()
+	c.idle.mu.Lock()
+	defer c.idle.mu.Unlock()
+	if len(c.idle.conns[key]) >= c.opt.MaxIdleConns {
+		_ = co.Close()
+		return
+	}
+	c.idle.conns[key] = append(c.idle.conns[key], co)
+}
+
+// interruptOnDone interrupts I/O on co once ctx is done, by setting its deadline to now. The returned function stops
+// it, and returns once co won't be touched any more, so that it can be reused by another query.
+func interruptOnDone(ctx context.Context, co net.Conn) (stop func()) {
+	done := ctx.Done()
+	if done == nil {
+		return func() {}
+	}
+	stopped, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-done:
+			_ = co.SetDeadline(time.Now())
+		case <-stopped:
+		}
+	}()
+	return func() {
+		close(stopped)
+		<-exited
+	}
+}
+
+// contextError returns the error of ctx if it's done, which is the cause of err. Deadlines of connections set by
+// that of ctx may pass a moment before ctx is done.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
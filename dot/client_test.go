@@ -0,0 +1,274 @@
+package dot
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testServer is a DoT server answering A queries with 192.0.2.1, whose certificate is of localhost and 127.0.0.1.
+type testServer struct {
+	addr     string
+	accepted int32 // connections accepted
+	roots    *x509.CertPool
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func startServer(t *testing.T) *testServer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{roots: x509.NewCertPool()}
+	s.roots.AddCert(cert)
+
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ln.Close()
+		s.closeConns()
+	})
+	s.addr = ln.Addr().String()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&s.accepted, 1)
+			s.mu.Lock()
+			s.conns = append(s.conns, c)
+			s.mu.Unlock()
+			go s.serve(&dns.Conn{Conn: c})
+		}
+	}()
+	return s
+}
+
+func (s *testServer) serve(co *dns.Conn) {
+	defer co.Close()
+	for {
+		req, err := co.ReadMsg()
+		if err != nil {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(192, 0, 2, 1),
+		}}
+		if err = co.WriteMsg(m); err != nil {
+			return
+		}
+	}
+}
+
+// closeConns closes connections accepted, like servers closing idle connections.
+func (s *testServer) closeConns() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.conns {
+		c.Close()
+	}
+	s.conns = nil
+}
+
+// newTestClient returns a client trusting the certificate of s.
+func newTestClient(s *testServer, opts ...ClientOption) *Client {
+	opts = append([]ClientOption{WithTimeout(time.Second), func(o *clientOptions) { o.RootCAs = s.roots }}, opts...)
+	return NewClient(opts...)
+}
+
+// exchange sends a query to s verified against serverName by c, and checks the reply.
+func exchange(t *testing.T, c *Client, s *testServer, serverName string) {
+	t.Helper()
+	req := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+	r, _, err := c.Exchange(req, s.addr, serverName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Answer) != 1 || r.Id != req.Id {
+		t.Fatalf("Unexpected reply %v", r)
+	}
+}
+
+func TestExchangeContext(t *testing.T) {
+	s := startServer(t)
+	c := newTestClient(s)
+
+	// A query done already doesn't connect.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA)
+	if _, _, err := c.ExchangeContext(ctx, req, s.addr, "localhost"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Canceled query should fail, got %v", err)
+	}
+	if n := atomic.LoadInt32(&s.accepted); n != 0 {
+		t.Errorf("Canceled query should not connect, got %d connections", n)
+	}
+
+	// The TLS handshake gives up once the query is done, though the client has a longer timeout.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, _, err = c.ExchangeContext(ctx, req, ln.Addr().String(), "localhost"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Stuck handshake should time out with the query, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Stuck handshake should time out with the query, took %s", d)
+	}
+
+	// Connections of queries canceled after their replies are reused, even without timeouts.
+	c = newTestClient(s, WithTimeout(0))
+	ctx, cancel = context.WithCancel(context.Background())
+	if _, _, err = c.ExchangeContext(ctx, req, s.addr, "localhost"); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	exchange(t, c, s, "localhost")
+	if n := atomic.LoadInt32(&s.accepted); n != 1 {
+		t.Errorf("Connection should be reused, got %d connections", n)
+	}
+}
+
+func TestConnectionReuse(t *testing.T) {
+	s := startServer(t)
+	var reused int32
+	c := newTestClient(s, WithTrace(&Trace{ConnReused: func(string) { atomic.AddInt32(&reused, 1) }}))
+	for i := 0; i < 3; i++ {
+		exchange(t, c, s, "localhost")
+	}
+	if n := atomic.LoadInt32(&s.accepted); n != 1 {
+		t.Errorf("Connection should be reused, got %d connections", n)
+	}
+	if n := atomic.LoadInt32(&reused); n != 2 {
+		t.Errorf("Connection should be reused twice, got %d", n)
+	}
+
+	// A client of another timeout shares idle connections.
+	exchange(t, c.WithTimeout(2*time.Second), s, "localhost")
+	if n := atomic.LoadInt32(&s.accepted); n != 1 {
+		t.Errorf("Connection should be shared, got %d connections", n)
+	}
+
+	// Connections are kept by address and server name.
+	exchange(t, c, s, "")
+	if n := atomic.LoadInt32(&s.accepted); n != 2 {
+		t.Errorf("Connection to another server name should not be reused, got %d connections", n)
+	}
+	c.idle.mu.Lock()
+	defer c.idle.mu.Unlock()
+	if len(c.idle.conns[s.addr+"#localhost"]) != 1 || len(c.idle.conns[s.addr+"#"]) != 1 {
+		t.Errorf("Unexpected idle connections %v", c.idle.conns)
+	}
+}
+
+func TestConnectionClosedByServer(t *testing.T) {
+	s := startServer(t)
+	c := newTestClient(s)
+	exchange(t, c, s, "localhost")
+	s.closeConns()
+	// The query is retried once on a fresh connection.
+	exchange(t, c, s, "localhost")
+	if n := atomic.LoadInt32(&s.accepted); n != 2 {
+		t.Errorf("Closed connection should be replaced, got %d connections", n)
+	}
+	exchange(t, c, s, "localhost")
+	if n := atomic.LoadInt32(&s.accepted); n != 2 {
+		t.Errorf("Fresh connection should be reused, got %d connections", n)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := startServer(t)
+	c := newTestClient(s, WithIdleTimeout(50*time.Millisecond))
+	exchange(t, c, s, "localhost")
+	time.Sleep(100 * time.Millisecond)
+	exchange(t, c, s, "localhost")
+	if n := atomic.LoadInt32(&s.accepted); n != 2 {
+		t.Errorf("Expired connection should not be reused, got %d connections", n)
+	}
+}
+
+func TestMaxIdleConns(t *testing.T) {
+	s := startServer(t)
+	c := newTestClient(s, WithMaxIdleConns(1))
+	key := s.addr + "#localhost"
+	var conns []*conn
+	for i := 0; i < 2; i++ {
+		co, err := c.dial(context.Background(), s.addr, "localhost")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, co)
+	}
+	for _, co := range conns {
+		c.put(key, co)
+	}
+	if idle := c.idle.conns[key]; len(idle) != 1 || idle[0] != conns[0] {
+		t.Errorf("Idle connections beyond the cap should be dropped, got %v", idle)
+	}
+	// Dropped connections are closed.
+	if _, err := conns[1].Write([]byte{0}); err == nil {
+		t.Error("Dropped connection should be closed")
+	}
+	if co, ok := c.get(key); !ok || co != conns[0] {
+		t.Errorf("Idle connection should be got, got %v", co)
+	}
+	if _, ok := c.get(key); ok {
+		t.Error("No idle connection should be left")
+	}
+}
@@ -0,0 +1,243 @@
+package gochinadns
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+var counterpartPrefetches = expvar.NewInt("chinadns_counterpart_prefetches")
+
+// Preferences when A and AAAA answers of a domain mismatch in locality,
+// i.e. one of them is located in China while the other is overseas.
+const (
+	DualStackNone     = ""
+	DualStackIPv4     = "ipv4"     // drop AAAA answers
+	DualStackIPv6     = "ipv6"     // drop A answers
+	DualStackDomestic = "domestic" // drop answers of the overseas family
+)
+
+// Modes of handling AAAA questions and answers, e.g. for networks with broken IPv6 routes overseas.
+const (
+	AAAAKeep       = ""
+	AAAAFilter     = "filter"      // answer AAAA questions without records, and never query upstreams
+	AAAAPreferIPv4 = "prefer-ipv4" // drop AAAA answers of domains with A records
+	AAAAPreferIPv6 = "prefer-ipv6" // drop A answers of domains with AAAA records
+)
+
+func checkDualStackPreference(pref string) error {
+	switch pref {
+	case DualStackNone, DualStackIPv4, DualStackIPv6, DualStackDomestic:
+		return nil
+	}
+	return fmt.Errorf("unknown dual stack preference [%s]", pref)
+}
+
+// WithAAAAMode sets the mode of handling AAAA questions and answers. See AAAAXXX for available modes.
+func WithAAAAMode(mode string) ServerOption {
+	return func(o *serverOptions) error {
+		switch mode {
+		case AAAAKeep, AAAAFilter, AAAAPreferIPv4, AAAAPreferIPv6:
+		default:
+			return fmt.Errorf("unknown AAAA mode [%s], expect filter, prefer-ipv4 or prefer-ipv6", mode)
+		}
+		o.AAAAMode = mode
+		return nil
+	}
+}
+
+// filteredAAAAReply returns an empty reply to req if it is an AAAA question filtered by the AAAA mode.
+// Otherwise it returns nil.
+func (s *Server) filteredAAAAReply(req *dns.Msg) *dns.Msg {
+	if s.AAAAMode != AAAAFilter || req.Question[0].Qtype != dns.TypeAAAA {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	return m
+}
+
+// aaaaModeDrops tells whether answers of qtype are dropped by the AAAA mode if the domain has addresses of
+// the other family.
+func (s *Server) aaaaModeDrops(qtype uint16) bool {
+	switch s.AAAAMode {
+	case AAAAPreferIPv4:
+		return qtype == dns.TypeAAAA
+	case AAAAPreferIPv6:
+		return qtype == dns.TypeA
+	}
+	return false
+}
+
+// applyAAAAMode drops addresses in reply if the AAAA mode prefers the family of counterpart,
+// and counterpart contains addresses.
+func (s *Server) applyAAAAMode(logger *logrus.Entry, reply, counterpart *upstreamReply) *upstreamReply {
+	if counterpart == nil || counterpart.Msg == nil {
+		return reply
+	}
+	qtype := reply.Question[0].Qtype
+	if !s.aaaaModeDrops(qtype) || firstAddress(counterpart.Msg) == nil {
+		return reply
+	}
+	logger.Debugf("Drop %s answers as the domain has addresses of the other family (%s).", dns.TypeToString[qtype], s.AAAAMode)
+	dropAnswers(reply.Msg, qtype)
+	return reply
+}
+
+// dualStackCounterpart returns an AAAA request for an A request and vice versa,
+// if a dual stack preference is configured, or the AAAA mode may drop answers of req.
+// Otherwise it returns nil.
+func (s *Server) dualStackCounterpart(req *dns.Msg) *dns.Msg {
+	if s.DualStackPreference == DualStackNone && !s.aaaaModeDrops(req.Question[0].Qtype) {
+		return nil
+	}
+	return counterpartRequest(req)
+}
+
+// counterpartRequest returns an AAAA request for an A request and vice versa, or nil for other requests.
+func counterpartRequest(req *dns.Msg) *dns.Msg {
+	var qtype uint16
+	switch req.Question[0].Qtype {
+	case dns.TypeA:
+		qtype = dns.TypeAAAA
+	case dns.TypeAAAA:
+		qtype = dns.TypeA
+	default:
+		return nil
+	}
+	m := req.Copy()
+	m.Id = dns.Id()
+	m.Question[0].Qtype = qtype
+	return m
+}
+
+// applyDualStackPreference drops addresses in reply if its locality mismatches the counterpart
+// and the preferred family is the counterpart.
+func (s *Server) applyDualStackPreference(ctx context.Context, logger *logrus.Entry, reply, counterpart *upstreamReply) *upstreamReply {
+	if counterpart == nil || s.DualStackPreference == DualStackNone {
+		return reply
+	}
+	domestic, ok := s.isDomesticReply(ctx, reply.Msg)
+	if !ok {
+		return reply
+	}
+	counterDomestic, ok := s.isDomesticReply(ctx, counterpart.Msg)
+	if !ok || domestic == counterDomestic {
+		return reply
+	}
+
+	qtype := reply.Question[0].Qtype
+	var drop bool
+	switch s.DualStackPreference {
+	case DualStackIPv4:
+		drop = qtype == dns.TypeAAAA
+	case DualStackIPv6:
+		drop = qtype == dns.TypeA
+	case DualStackDomestic:
+		drop = !domestic
+	}
+	if drop {
+		logger.Debugf("Locality of A and AAAA answers mismatch. Drop %s answers as %s is preferred.",
+			dns.TypeToString[qtype], s.DualStackPreference)
+		dropAnswers(reply.Msg, qtype)
+	}
+	return reply
+}
+
+// isDomesticReply checks whether the answer of m is located in China by the answer match policy.
+// ok is false if m contains no address.
+func (s *Server) isDomesticReply(ctx context.Context, m *dns.Msg) (domestic, ok bool) {
+	if m == nil {
+		return false, false
+	}
+	ips := answerIPs(m)
+	if len(ips) == 0 {
+		return false, false
+	}
+	contain, err := s.isChinaAnswer(ctx, ips)
+	if err != nil {
+		return false, false
+	}
+	return contain, true
+}
+
+// firstAddress returns the first A/AAAA address in the answer section of m, or nil.
+func firstAddress(m *dns.Msg) net.IP {
+	for _, rr := range m.Answer {
+		switch answer := rr.(type) {
+		case *dns.A:
+			return answer.A
+		case *dns.AAAA:
+			return answer.AAAA
+		}
+	}
+	return nil
+}
+
+// dropAnswers removes records of rrtype from the answer section of m.
+func dropAnswers(m *dns.Msg, rrtype uint16) {
+	kept := m.Answer[:0]
+	for _, rr := range m.Answer {
+		if rr.Header().Rrtype != rrtype {
+			kept = append(kept, rr)
+		}
+	}
+	m.Answer = kept
+}
+
+// WithCounterpartPrefetch resolves AAAA questions in the background when A questions are resolved, and vice versa,
+// and caches the answers, so that the second query of a dual-stack client is a cache hit. It doubles upstream
+// queries of addresses, so keep it disabled on constrained links. It takes effect only if the cache is enabled.
+func WithCounterpartPrefetch(enabled bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.PrefetchCounterpart = enabled
+		return nil
+	}
+}
+
+// prefetchCounterpart resolves and caches the counterpart of req (see counterpartRequest) in the background,
+// unless it's cached or not answered by upstreams. req should be normalized.
+func (s *Server) prefetchCounterpart(logger *logrus.Entry, req *dns.Msg, client net.IP) {
+	if !s.PrefetchCounterpart || s.cache == nil {
+		return
+	}
+	counterReq := counterpartRequest(req)
+	if counterReq == nil {
+		return
+	}
+	// Answers of the counterpart depending on its own counterpart are left to its query.
+	if s.filteredAAAAReply(counterReq) != nil || s.dualStackCounterpart(counterReq) != nil ||
+		s.answerHosts(counterReq) != nil || s.answerRewrite(counterReq) != nil {
+		return
+	}
+	q := &counterReq.Question[0]
+	if fresh, _ := s.cacheGet(q); fresh != nil {
+		return
+	}
+	counterpartPrefetches.Add(1)
+	cq := questionString(q)
+	logger = logger.WithField("prefetch", cq)
+	ctx, cancel := context.WithTimeout(context.Background(), s.queryTimeout(clientLimits{}))
+	if s.PinUpstreams {
+		ctx = withPinnedClient(ctx, client)
+	}
+	s.goroutines.Go("prefetch counterpart "+cq, cancel, func() {
+		defer cancel()
+		reply := s.resolveShared(ctx, logger, counterReq)
+		reply = s.synthesizeDNS64(ctx, logger, counterReq, reply)
+		if upstreamFailed(reply) {
+			return
+		}
+		if s.shouldStripECH(q.Name) {
+			stripECH(reply.Msg)
+		}
+		s.stripRewrite(logger, q.Name, reply.Msg)
+		s.clampTTLs(reply.Msg)
+		s.cacheSet(q, reply.Msg, reply.provenance())
+		logger.Debug("Counterpart prefetched.")
+	})
+}
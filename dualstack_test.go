@@ -0,0 +1,153 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestAAAAReply(name string, ips ...string) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dns.TypeAAAA)
+	m.Response = true
+	for _, ip := range ips {
+		m.Answer = append(m.Answer, &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: dns.Fqdn(name), Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+			AAAA: net.ParseIP(ip),
+		})
+	}
+	return m
+}
+
+func TestAAAAMode(t *testing.T) {
+	logger := logrus.WithField("test", t.Name())
+	o := newServerOptions()
+	if err := WithAAAAMode("prefer-ipv5")(o); err == nil {
+		t.Error("Unknown AAAA mode should fail")
+	}
+
+	for _, tc := range []struct {
+		mode            string
+		filtered        bool
+		counterpartOf   map[uint16]bool // whether a counterpart is resolved for qtype
+		keptA, keptAAAA int
+	}{
+		{AAAAKeep, false, map[uint16]bool{dns.TypeA: false, dns.TypeAAAA: false}, 1, 1},
+		{AAAAFilter, true, map[uint16]bool{dns.TypeA: false, dns.TypeAAAA: false}, 1, 1},
+		{AAAAPreferIPv4, false, map[uint16]bool{dns.TypeA: false, dns.TypeAAAA: true}, 1, 0},
+		{AAAAPreferIPv6, false, map[uint16]bool{dns.TypeA: true, dns.TypeAAAA: false}, 0, 1},
+	} {
+		o := newServerOptions()
+		if err := WithAAAAMode(tc.mode)(o); err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{serverOptions: o}
+
+		a := newTestReply("example.com", 60, "1.1.1.1")
+		aaaa := newTestAAAAReply("example.com", "2606:4700::1111")
+		if filtered := s.filteredAAAAReply(aaaa); (filtered != nil) != tc.filtered || s.filteredAAAAReply(a) != nil {
+			t.Errorf("%s: AAAA questions should be filtered: %v", tc.mode, tc.filtered)
+		}
+		for qtype, ok := range tc.counterpartOf {
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", qtype)
+			if (s.dualStackCounterpart(req) != nil) != ok {
+				t.Errorf("%s: counterpart of %s should be resolved: %v", tc.mode, dns.TypeToString[qtype], ok)
+			}
+		}
+
+		s.applyAAAAMode(logger, &upstreamReply{Msg: a}, &upstreamReply{Msg: aaaa})
+		s.applyAAAAMode(logger, &upstreamReply{Msg: aaaa}, &upstreamReply{Msg: newTestReply("example.com", 60, "1.1.1.1")})
+		if len(a.Answer) != tc.keptA || len(aaaa.Answer) != tc.keptAAAA {
+			t.Errorf("%s: unexpected answers kept: %d A, %d AAAA", tc.mode, len(a.Answer), len(aaaa.Answer))
+		}
+	}
+
+	s := &Server{serverOptions: newServerOptions()}
+	s.AAAAMode = AAAAPreferIPv4
+	aaaa := newTestAAAAReply("ipv6.example.com", "2606:4700::1111")
+	s.applyAAAAMode(logger, &upstreamReply{Msg: aaaa}, &upstreamReply{Msg: newTestReply("ipv6.example.com", 60)})
+	if len(aaaa.Answer) != 1 {
+		t.Error("AAAA answers of IPv6 only domains should be kept")
+	}
+}
+
+func TestPrefetchCounterpart(t *testing.T) {
+	o := newServerOptions()
+	o.Delay = time.Second
+	o.TrustedServers = resolverList{startAnswerUpstream(t, "142.250.1.1")}
+	if err := WithCounterpartPrefetch(true)(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second)), goroutines: newGoroutineTracker(),
+		cache: NewMemoryCache(10, 0), inflight: newInflightTable(), provenance: newProvenanceLog(8)}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	s.Serve(newFakeResponseWriter("192.168.1.2"), req)
+	aaaa := dns.Question{Name: "example.com.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if m, _ := s.cacheGet(&aaaa); m != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("AAAA question should be prefetched")
+		}
+	}
+
+	s.AAAAMode = AAAAPreferIPv4
+	req.SetQuestion("example.org.", dns.TypeA)
+	prefetches := counterpartPrefetches.Value()
+	s.prefetchCounterpart(logrus.NewEntry(logrus.StandardLogger()), req, nil)
+	if counterpartPrefetches.Value() != prefetches {
+		t.Error("AAAA question whose answers depend on A answers should not be prefetched")
+	}
+}
+
+func TestDualStackPreference(t *testing.T) {
+	logger := logrus.WithField("test", t.Name())
+	china := writeTestList(t, "china.list", "1.0.1.0/24\n240e::/20\n")
+	if err := WithDualStackPreference("ipv5")(newServerOptions()); err == nil {
+		t.Error("Unknown dual stack preference should fail")
+	}
+
+	for _, tc := range []struct {
+		pref            string
+		a, aaaa         []string
+		keptA, keptAAAA int
+	}{
+		{DualStackNone, []string{"1.0.1.1"}, []string{"2606:4700::1111"}, 1, 1},
+		{DualStackIPv4, []string{"1.0.1.1"}, []string{"2606:4700::1111"}, 1, 0},
+		{DualStackIPv6, []string{"1.0.1.1"}, []string{"2606:4700::1111"}, 0, 1},
+		{DualStackDomestic, []string{"1.0.1.1"}, []string{"2606:4700::1111"}, 1, 0},
+		{DualStackDomestic, []string{"8.8.8.8"}, []string{"240e::1"}, 0, 1},
+		// Answers of the same locality are kept.
+		{DualStackIPv4, []string{"8.8.8.8"}, []string{"2606:4700::1111"}, 1, 1},
+		{DualStackIPv6, []string{"1.0.1.1"}, []string{"240e::1"}, 1, 1},
+		// An answer is located by all its IPs, not the first one.
+		{DualStackIPv4, []string{"1.0.1.1", "8.8.8.8"}, []string{"2606:4700::1111"}, 2, 1},
+		{DualStackDomestic, []string{"8.8.8.8"}, []string{"240e::1", "2606:4700::1111"}, 1, 2},
+		// Answers without addresses are kept.
+		{DualStackIPv4, []string{"1.0.1.1"}, nil, 1, 0},
+	} {
+		o := newServerOptions()
+		for _, f := range []ServerOption{WithCHNList(china), WithDualStackPreference(tc.pref)} {
+			if err := f(o); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s := &Server{serverOptions: o}
+
+		a := newTestReply("example.com", 60, tc.a...)
+		aaaa := newTestAAAAReply("example.com", tc.aaaa...)
+		s.applyDualStackPreference(context.Background(), logger, &upstreamReply{Msg: a}, &upstreamReply{Msg: aaaa.Copy()})
+		s.applyDualStackPreference(context.Background(), logger, &upstreamReply{Msg: aaaa}, &upstreamReply{Msg: newTestReply("example.com", 60, tc.a...)})
+		if len(a.Answer) != tc.keptA || len(aaaa.Answer) != tc.keptAAAA {
+			t.Errorf("%q %v %v: unexpected answers kept: %d A, %d AAAA", tc.pref, tc.a, tc.aaaa, len(a.Answer), len(aaaa.Answer))
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package gochinadns
+
+import (
+	"github.com/miekg/dns"
+)
+
+// stripECH removes ECH parameters from SVCB/HTTPS records in the answer section of m.
+// ECH breaks SNI-based whitelisting middleboxes, so without it clients fall back to plain TLS.
+// Note that this invalidates DNSSEC signatures of the rewritten RRsets.
+func stripECH(m *dns.Msg) {
+	for _, rr := range m.Answer {
+		switch svcb := rr.(type) {
+		case *dns.SVCB:
+			svcb.Value = stripECHValues(svcb.Value)
+		case *dns.HTTPS:
+			svcb.Value = stripECHValues(svcb.Value)
+		}
+	}
+}
+
+func stripECHValues(values []dns.SVCBKeyValue) []dns.SVCBKeyValue {
+	kept := values[:0]
+	for _, kv := range values {
+		switch v := kv.(type) {
+		case *dns.SVCBECHConfig:
+			continue
+		case *dns.SVCBMandatory:
+			// ECH must not stay mandatory once removed, or the record becomes unusable.
+			codes := v.Code[:0]
+			for _, code := range v.Code {
+				if code != dns.SVCB_ECHCONFIG {
+					codes = append(codes, code)
+				}
+			}
+			v.Code = codes
+			if len(codes) == 0 {
+				continue
+			}
+		}
+		kept = append(kept, kv)
+	}
+	return kept
+}
+
+// shouldStripECH checks whether ECH parameters should be stripped for name.
+// Domains in ECHPreserve take precedence over ECHStrip.
+func (s *Server) shouldStripECH(name string) bool {
+	s.listsMu.RLock()
+	defer s.listsMu.RUnlock()
+	return s.ECHStrip.Contain(name) && !s.ECHPreserve.Contain(name)
+}
@@ -0,0 +1,53 @@
+package gochinadns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestStripECH(t *testing.T) {
+	for _, tc := range []struct {
+		rr, want string
+	}{
+		{`example.com. 300 IN HTTPS 1 . alpn="h2" echconfig="AAAA"`, `example.com.	300	IN	HTTPS	1 . alpn="h2"`},
+		{`example.com. 300 IN HTTPS 1 . mandatory="echconfig,alpn" alpn="h2" echconfig="AAAA"`, `example.com.	300	IN	HTTPS	1 . mandatory="alpn" alpn="h2"`},
+		{`example.com. 300 IN HTTPS 1 . mandatory="echconfig" echconfig="AAAA"`, `example.com.	300	IN	HTTPS	1 .`},
+		{`_dns.example.com. 300 IN SVCB 1 dns.example.com. alpn="dot" echconfig="AAAA"`, `_dns.example.com.	300	IN	SVCB	1 dns.example.com. alpn="dot"`},
+		{`example.com. 300 IN HTTPS 1 . alpn="h2,h3"`, `example.com.	300	IN	HTTPS	1 . alpn="h2,h3"`},
+	} {
+		rr, err := dns.NewRR(tc.rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := new(dns.Msg)
+		m.Answer = []dns.RR{rr}
+		stripECH(m)
+		if got := m.Answer[0].String(); got != tc.want {
+			t.Errorf("stripECH(%s) = %s, want %s", tc.rr, got, tc.want)
+		}
+	}
+}
+
+func TestShouldStripECH(t *testing.T) {
+	o := newServerOptions()
+	for _, f := range []ServerOption{
+		WithECHStrip(writeTestList(t, "strip.list", "example.com\n")),
+		WithECHPreserve(writeTestList(t, "preserve.list", "www.example.com\n")),
+	} {
+		if err := f(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{serverOptions: o}
+	for name, want := range map[string]bool{
+		"example.com.":     true,
+		"cdn.example.com.": true,
+		"www.example.com.": false,
+		"example.org.":     false,
+	} {
+		if got := s.shouldStripECH(name); got != want {
+			t.Errorf("shouldStripECH(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
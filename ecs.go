@@ -0,0 +1,106 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Policies of EDNS Client Subnet (RFC 7871) options in queries to upstreams.
+// Besides them, a policy can be a subnet in CIDR format, which is injected into queries in place of the client's.
+const (
+	ECSForward = "forward" // forward ECS of clients as is
+	ECSStrip   = "strip"   // remove ECS of clients
+)
+
+// checkECSPolicy checks policy, and returns the subnet to inject if policy is a CIDR.
+func checkECSPolicy(policy string) (*net.IPNet, error) {
+	switch policy {
+	case "", ECSForward, ECSStrip:
+		return nil, nil
+	}
+	_, subnet, err := net.ParseCIDR(policy)
+	if err != nil {
+		return nil, fmt.Errorf("unknown ECS policy %s, expect forward, strip or a subnet", policy)
+	}
+	return subnet, nil
+}
+
+// WithECS sets ECS policies of trusted and untrusted resolvers. See ECSXXX. A policy can also be a subnet to inject,
+// e.g. the /24 of the public IP, so that CDNs answer nearby addresses, while no client IP is revealed.
+// It can be overridden per resolver by `ip[:port]?ecs=policy`.
+func WithECS(trusted, untrusted string) ServerOption {
+	return func(o *serverOptions) error {
+		for _, policy := range []string{trusted, untrusted} {
+			if _, err := checkECSPolicy(policy); err != nil {
+				return err
+			}
+		}
+		o.ECSTrusted, o.ECSUntrusted = trusted, untrusted
+		return nil
+	}
+}
+
+// ecsPolicy returns the ECS policy for server. The policy of the resolver takes precedence over the group's.
+func (s *Server) ecsPolicy(server *Resolver, trusted bool) string {
+	if policy := server.params().ecs; policy != "" {
+		return policy
+	}
+	if trusted {
+		return s.ECSTrusted
+	}
+	return s.ECSUntrusted
+}
+
+// lookupUntrusted looks up req in an untrusted server, with ECS of the untrusted policy, and the question name in
+// random case if CaseRandomization is set.
+func (s *Server) lookupUntrusted(ctx context.Context, req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	s.budgets.Spend(server)
+	policy := s.ecsPolicy(server, false)
+	applyECS(req, policy)
+	if s.CaseRandomization && server.upstream == nil {
+		reply, rtt, err = lookupRandomizedCase(ctx, req, server, s.lookupNormal)
+	} else {
+		reply, rtt, err = s.lookupNormal(ctx, req, server)
+	}
+	if reply != nil && policy != "" && policy != ECSForward {
+		removeECS(reply)
+	}
+	return
+}
+
+// applyECS replaces ECS of req according to policy. req should have been normalized.
+func applyECS(req *dns.Msg, policy string) {
+	if policy == "" || policy == ECSForward {
+		return
+	}
+	removeECS(req)
+	subnet, _ := checkECSPolicy(policy)
+	if subnet == nil {
+		return
+	}
+	opt := req.IsEdns0()
+	if opt == nil {
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		opt = req.IsEdns0()
+	}
+	ones, _ := subnet.Mask.Size()
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: subnet.IP}
+	if subnet.IP.To4() == nil {
+		ecs.Family = 2
+	}
+	opt.Option = append(opt.Option, ecs)
+}
+
+// removeECS removes ECS options of m. Replies to queries with ECS changed by policies should go without ECS,
+// since the scope of them is not about the client.
+func removeECS(m *dns.Msg) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	opt.Option = removeEDNSOption(opt.Option, dns.EDNS0SUBNET)
+}
@@ -0,0 +1,72 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestApplyECS(t *testing.T) {
+	newReq := func() *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		req.SetEdns0(4096, true)
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("192.0.2.1")})
+		return req
+	}
+	subnetOf := func(req *dns.Msg) *dns.EDNS0_SUBNET {
+		for _, o := range req.IsEdns0().Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				return ecs
+			}
+		}
+		return nil
+	}
+
+	req := newReq()
+	applyECS(req, ECSForward)
+	if ecs := subnetOf(req); ecs == nil || !ecs.Address.Equal(net.ParseIP("192.0.2.1")) {
+		t.Errorf("ECS should be forwarded as is: %v", ecs)
+	}
+
+	req = newReq()
+	applyECS(req, ECSStrip)
+	if ecs := subnetOf(req); ecs != nil {
+		t.Errorf("ECS should be stripped: %v", ecs)
+	}
+	if !req.IsEdns0().Do() {
+		t.Error("DO bit should be kept")
+	}
+
+	req = newReq()
+	applyECS(req, "203.0.113.7/24")
+	if ecs := subnetOf(req); ecs == nil || ecs.SourceNetmask != 24 || !ecs.Address.Equal(net.ParseIP("203.0.113.0")) {
+		t.Errorf("ECS should be replaced by the subnet: %v", ecs)
+	}
+
+	req = new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeAAAA)
+	applyECS(req, "2001:db8::/56")
+	if ecs := subnetOf(req); ecs == nil || ecs.Family != 2 || ecs.SourceNetmask != 56 {
+		t.Errorf("IPv6 subnet should be injected: %v", ecs)
+	}
+}
+
+func TestWithECS(t *testing.T) {
+	o := newServerOptions()
+	if err := WithECS(ECSStrip, "203.0.113.0/24")(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o}
+	if p := s.ecsPolicy(&Resolver{}, true); p != ECSStrip {
+		t.Errorf("trusted policy = %s", p)
+	}
+	if p := s.ecsPolicy(&Resolver{ECS: ECSForward}, false); p != ECSForward {
+		t.Errorf("policy of the resolver should take precedence, got %s", p)
+	}
+	if err := WithECS("nowhere", ECSForward)(o); err == nil {
+		t.Error("invalid policy should fail")
+	}
+}
@@ -0,0 +1,104 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// EDNSOff is the EDNS size of resolvers which queries are sent to without EDNS. See Resolver.EDNSSize.
+const EDNSOff = -1
+
+const (
+	// ednsFormErrThreshold is the number of consecutive FORMERR replies to queries with EDNS, answered without EDNS,
+	// before EDNS is disabled, so that a single malformed reply doesn't disable it.
+	ednsFormErrThreshold = 3
+	// ednsRetryAfter is how long EDNS stays disabled by FORMERR replies, after which the resolver is probed with EDNS
+	// again, in case it's upgraded, or the replies came from a middlebox on the path for a while.
+	ednsRetryAfter = 30 * time.Minute
+)
+
+// parseEDNSSize parses the edns parameter of a resolver, which is off or an EDNS UDP size.
+func parseEDNSSize(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	if s == "off" {
+		return EDNSOff, nil
+	}
+	size, err := strconv.Atoi(s)
+	if err != nil || size < dns.MinMsgSize || size > dns.MaxMsgSize {
+		return 0, fmt.Errorf("invalid EDNS size [%s], expect off or %d-%d", s, dns.MinMsgSize, dns.MaxMsgSize)
+	}
+	return size, nil
+}
+
+// ednsParam returns the edns parameter of r, or an empty string if r doesn't override the EDNS size.
+func (r *Resolver) ednsParam() string {
+	switch {
+	case r.EDNSSize == EDNSOff:
+		return "off"
+	case r.EDNSSize > 0:
+		return strconv.Itoa(r.EDNSSize)
+	}
+	return ""
+}
+
+// noEDNS tells whether queries are sent to r without EDNS, either configured or learned from FORMERR replies within
+// ednsRetryAfter.
+func (r *Resolver) noEDNS() bool {
+	if r.params().ednsSize == EDNSOff {
+		return true
+	}
+	broken := atomic.LoadInt64(&r.ednsBroken)
+	return broken != 0 && time.Now().UnixNano()-broken < int64(ednsRetryAfter)
+}
+
+// prepareEDNS removes EDNS from req if r doesn't support it, or sets the EDNS UDP size of r.
+// The size is lowered further if replies of r are limited (see limitUDPSize).
+func (r *Resolver) prepareEDNS(req *dns.Msg) {
+	if r.noEDNS() {
+		cleanEdns0(req)
+		return
+	}
+	if size := r.params().ednsSize; size > 0 {
+		if e := req.IsEdns0(); e != nil {
+			e.SetUDPSize(uint16(size))
+		} else {
+			req.SetEdns0(uint16(size), false)
+		}
+	}
+	r.limitUDPSize(req)
+}
+
+// lookupEDNSFallback looks up req in server by lookup, with EDNS prepared for server. Old resolvers not supporting EDNS
+// reply FORMERR to queries with it (RFC 6891 section 7), so the query is retried without EDNS. EDNS is disabled for
+// ednsRetryAfter once ednsFormErrThreshold queries in a row are answered so, and probed again after it.
+func lookupEDNSFallback(ctx context.Context, req *dns.Msg, server *Resolver, lookup LookupFunc) (*dns.Msg, time.Duration, error) {
+	server.prepareEDNS(req)
+	edns := req.IsEdns0() != nil
+	reply, rtt, err := lookup(ctx, req, server)
+	if err != nil || !edns || ctx.Err() != nil {
+		return reply, rtt, err
+	}
+	if reply.Rcode != dns.RcodeFormatError {
+		atomic.StoreInt32(&server.ednsFormErrs, 0)
+		return reply, rtt, err
+	}
+	cleanEdns0(req)
+	reply, rtt0, err := lookup(ctx, req, server)
+	if err != nil || reply.Rcode == dns.RcodeFormatError {
+		// The query is malformed either way, which says nothing about EDNS.
+		return reply, rtt + rtt0, err
+	}
+	if atomic.AddInt32(&server.ednsFormErrs, 1) >= ednsFormErrThreshold {
+		atomic.StoreInt32(&server.ednsFormErrs, 0)
+		atomic.StoreInt64(&server.ednsBroken, time.Now().UnixNano())
+		logEntry(ctx).WithField("server", server).Warnf("FORMERR replies to queries with EDNS. Disable EDNS for %s.", ednsRetryAfter)
+	}
+	return reply, rtt + rtt0, err
+}
@@ -0,0 +1,73 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestEDNSFallback(t *testing.T) {
+	var ednsQueries int32
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		if req.IsEdns0() != nil {
+			atomic.AddInt32(&ednsQueries, 1)
+			m.SetRcode(req, dns.RcodeFormatError)
+		} else {
+			m = newTestReply(req.Question[0].Name, 60, "114.114.114.114")
+			m.SetReply(req)
+		}
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = upstream.ActivateAndServe() }()
+	defer func() { _ = upstream.Shutdown() }()
+	r, err := ParseResolver("udp@"+pc.LocalAddr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(WithTimeout(time.Second))
+	for i := 0; i < ednsFormErrThreshold+1; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		reply, _, err := c.LookupContext(context.Background(), req, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Rcode != dns.RcodeSuccess || len(reply.Answer) != 1 {
+			t.Fatalf("Query should be retried without EDNS, got %s", reply)
+		}
+	}
+	if n := atomic.LoadInt32(&ednsQueries); n != ednsFormErrThreshold {
+		t.Errorf("EDNS should not be sent after %d FORMERR replies, got %d queries with EDNS", ednsFormErrThreshold, n)
+	}
+	if !r.noEDNS() {
+		t.Error("Resolver should be learned not supporting EDNS")
+	}
+	// EDNS is probed again after a while.
+	atomic.StoreInt64(&r.ednsBroken, time.Now().Add(-ednsRetryAfter).UnixNano())
+	if r.noEDNS() {
+		t.Errorf("EDNS should be retried after %s", ednsRetryAfter)
+	}
+
+	r, _ = ParseResolver("8.8.8.8?edns=1232", false)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	r.prepareEDNS(req)
+	if req.IsEdns0().UDPSize() != 1232 {
+		t.Errorf("EDNS size should be set by the resolver, got %d", req.IsEdns0().UDPSize())
+	}
+	if r.String() != "udp@8.8.8.8:53?edns=1232" {
+		t.Errorf("Unexpected resolver string %s", r)
+	}
+}
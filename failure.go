@@ -0,0 +1,192 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Steps of the failure policy, tried in order when all upstreams fail. SERVFAIL is answered if all steps fail.
+const (
+	FailureRetry    = "retry"    // resolve once more with doubled timeouts
+	FailureStale    = "stale"    // serve an expired cached answer, see WithServeStale
+	FailureServfail = "servfail" // answer SERVFAIL, which ends the policy
+)
+
+// VerdictFailed is the verdict of SERVFAIL answered by the server after all upstreams failed.
+const VerdictFailed = "failed"
+
+// WithFailurePolicy sets steps tried in order when all upstreams time out or fail, see FailureXXX. SERVFAIL is
+// answered if all steps fail, so that clients don't cache an empty answer as NODATA. Empty steps are ignored.
+func WithFailurePolicy(steps ...string) ServerOption {
+	return func(o *serverOptions) error {
+		policy := make([]string, 0, len(steps))
+		for _, step := range steps {
+			step = strings.TrimSpace(step)
+			if step == "" {
+				continue
+			}
+			if n := len(policy); n > 0 && policy[n-1] == FailureServfail {
+				return fmt.Errorf("failure policy step [%s] after %s", step, FailureServfail)
+			}
+			switch step {
+			case FailureRetry, FailureStale, FailureServfail:
+			default:
+				return fmt.Errorf("unknown failure policy step [%s], expect retry, stale or servfail", step)
+			}
+			policy = append(policy, step)
+		}
+		o.FailurePolicy = policy
+		return nil
+	}
+}
+
+// upstreamFailed tells whether upstreams failed to resolve a query with reply.
+func upstreamFailed(reply *upstreamReply) bool {
+	return reply == nil || reply.Rcode == dns.RcodeServerFailure
+}
+
+// answerFailure applies the failure policy to req after upstreams failed with reply (nil if nothing replied), and
+// returns the reply to serve. resolve resolves req again until ctx is done, stale is the expired cached answer if any,
+// and errs are errors of upstreams to log.
+func (s *Server) answerFailure(
+	ctx context.Context, logger *logrus.Entry, req *dns.Msg, reply *upstreamReply, stale *dns.Msg,
+	timeout time.Duration, errs *upstreamErrors, resolve func(context.Context) *upstreamReply,
+) *upstreamReply {
+	if reply != nil && reply.server != nil {
+		errs.Add(reply.server, fmt.Errorf("%s", dns.RcodeToString[reply.Rcode]))
+	}
+	logger.WithField("errors", errs.String()).Warn("All upstreams failed.")
+
+	for _, step := range s.FailurePolicy {
+		switch step {
+		case FailureRetry:
+			if errors.Is(ctx.Err(), context.Canceled) {
+				// The query is canceled, e.g. by the admin API, rather than timed out.
+				continue
+			}
+			logger.Info("Upstreams failed. Retry with doubled timeouts.")
+			rctx, cancel := context.WithTimeout(withRetry(boundContext{ctx, s.lifetimeContext()}), 2*timeout)
+			retried := resolve(rctx)
+			cancel()
+			if !upstreamFailed(retried) {
+				return retried
+			}
+			if retried != nil {
+				reply = retried
+			}
+		case FailureStale:
+			if stale != nil {
+				logger.Info("Upstreams failed. Serve stale answer.")
+				stale.Id = req.Id
+				stale.Question = req.Question
+				return &upstreamReply{Msg: stale, verdict: VerdictStale}
+			}
+		}
+	}
+	if reply != nil {
+		return reply
+	}
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeServerFailure)
+	return &upstreamReply{Msg: m, verdict: VerdictFailed}
+}
+
+// detachedContext carries values of a context, like the trace ID, but not its deadline or cancellation, so that a
+// query can be retried after its deadline.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// boundContext carries values of a context, like the trace ID, but is bound to the deadline and cancellation of
+// another one, like the lifetime of the server, so that a query can be retried after its deadline until the server
+// shuts down.
+type boundContext struct {
+	context.Context
+	bound context.Context
+}
+
+func (c boundContext) Deadline() (time.Time, bool) { return c.bound.Deadline() }
+func (c boundContext) Done() <-chan struct{}       { return c.bound.Done() }
+func (c boundContext) Err() error                  { return c.bound.Err() }
+
+// lifetimeContext returns the context done once the server shuts down.
+func (s *Server) lifetimeContext() context.Context {
+	if s.lifetime == nil {
+		return context.Background()
+	}
+	return s.lifetime
+}
+
+type retryKey struct{}
+
+func withRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryKey{}, true)
+}
+
+// lookupTimeout returns the timeout of queries to server, doubled on retries of the failure policy.
+func (c *Client) lookupTimeout(ctx context.Context, server *Resolver) time.Duration {
+	timeout := server.params().timeout
+	if ctx.Value(retryKey{}) == nil {
+		return timeout
+	}
+	if timeout == 0 {
+		timeout = c.Timeout
+	}
+	if timeout == 0 {
+		timeout = dnsTimeout
+	}
+	return 2 * timeout
+}
+
+// upstreamErrors collects errors of upstreams resolving a query, to tell why all of them failed. A nil collector
+// drops errors.
+type upstreamErrors struct {
+	mu   sync.Mutex
+	errs []string
+}
+
+type upstreamErrorsKey struct{}
+
+func withUpstreamErrors(ctx context.Context) (context.Context, *upstreamErrors) {
+	errs := new(upstreamErrors)
+	return context.WithValue(ctx, upstreamErrorsKey{}, errs), errs
+}
+
+func upstreamErrorsFromContext(ctx context.Context) *upstreamErrors {
+	errs, _ := ctx.Value(upstreamErrorsKey{}).(*upstreamErrors)
+	return errs
+}
+
+// Add records err of server.
+func (e *upstreamErrors) Add(server *Resolver, err error) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.errs = append(e.errs, server.String()+": "+err.Error())
+	e.mu.Unlock()
+}
+
+// String lists errors recorded, or tells no upstream replied in time if none.
+func (e *upstreamErrors) String() string {
+	if e == nil {
+		return "no reply in time"
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if len(e.errs) == 0 {
+		return "no reply in time"
+	}
+	return strings.Join(e.errs, "; ")
+}
@@ -0,0 +1,131 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestFailurePolicy(t *testing.T) {
+	var calls int32
+	upstream := NewUpstreamResolver("flaky", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return nil, 0, errors.New("connection refused")
+		}
+		m := newTestReply(req.Question[0].Name, 60, "142.250.1.1")
+		m.Id = req.Id
+		return m, time.Millisecond, nil
+	}))
+
+	tests := []struct {
+		policy []string
+		stale  bool
+		want   int
+		ips    int
+	}{
+		{policy: nil, want: dns.RcodeServerFailure},
+		{policy: []string{FailureServfail}, stale: true, want: dns.RcodeServerFailure},
+		{policy: []string{FailureStale}, stale: true, want: dns.RcodeSuccess, ips: 1},
+		{policy: []string{FailureStale}, want: dns.RcodeServerFailure},
+		{policy: []string{FailureRetry}, want: dns.RcodeSuccess, ips: 1},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&calls, 0)
+		o := newServerOptions()
+		o.ServeStale = time.Hour
+		for _, f := range []ServerOption{WithUpstreams(true, upstream), WithFailurePolicy(tt.policy...)} {
+			if err := f(o); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second)), goroutines: newGoroutineTracker(),
+			cache: NewMemoryCache(10, 0), inflight: newInflightTable(), provenance: newProvenanceLog(8)}
+		if err := s.partitionResolvers(); err != nil {
+			t.Fatal(err)
+		}
+		if tt.stale {
+			m := newTestReply("www.google.com", 60, "142.250.2.2")
+			s.cache.Set(&m.Question[0], m, 0, time.Hour)
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.google.com.", dns.TypeA)
+		w := newFakeResponseWriter("192.168.1.2")
+		s.Serve(w, req)
+		if w.msg.Rcode != tt.want || len(answerIPs(w.msg)) != tt.ips {
+			t.Errorf("Policy %v: unexpected reply %v", tt.policy, w.msg)
+		}
+	}
+
+	for _, policy := range [][]string{{"drop"}, {FailureServfail, FailureStale}} {
+		if err := WithFailurePolicy(policy...)(newServerOptions()); err == nil {
+			t.Errorf("Policy %v should be invalid", policy)
+		}
+	}
+}
+
+func TestLookupTimeoutOnRetry(t *testing.T) {
+	c := NewClient(WithTimeout(time.Second))
+	server := &Resolver{Addr: "8.8.8.8:53"}
+	if timeout := c.lookupTimeout(context.Background(), server); timeout != 0 {
+		t.Errorf("Timeout of the client should be used, got %s", timeout)
+	}
+	ctx := withRetry(detachedContext{context.Background()})
+	if timeout := c.lookupTimeout(ctx, server); timeout != 2*time.Second {
+		t.Errorf("Timeout should be doubled on retries, got %s", timeout)
+	}
+	server.Timeout = 3 * time.Second
+	if timeout := c.lookupTimeout(ctx, server); timeout != 6*time.Second {
+		t.Errorf("Timeout of the resolver should be doubled on retries, got %s", timeout)
+	}
+}
+
+func TestFailureRetryContext(t *testing.T) {
+	o := newServerOptions()
+	if err := WithFailurePolicy(FailureRetry)(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o}
+	s.lifetime, s.endLifetime = context.WithCancel(context.Background())
+	req := new(dns.Msg).SetQuestion("www.google.com.", dns.TypeA)
+	logger := logrus.WithField("test", t.Name())
+	// retry returns whether ctx is retried, along with the context of the retry and its error then.
+	retry := func(ctx context.Context) (retried bool, rctx context.Context, err error) {
+		reply := s.answerFailure(ctx, logger, req, nil, nil, time.Second, nil, func(ctx context.Context) *upstreamReply {
+			retried, rctx, err = true, ctx, ctx.Err()
+			return nil
+		})
+		if reply.Rcode != dns.RcodeServerFailure {
+			t.Errorf("Unexpected reply %v", reply.Msg)
+		}
+		return
+	}
+
+	// Queries timed out are retried beyond their deadlines, until the server shuts down.
+	ctx, cancel := context.WithTimeout(withTraceID(context.Background(), "trace"), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	retried, rctx, err := retry(ctx)
+	if !retried || err != nil || rctx.Value(retryKey{}) == nil || traceIDFromContext(rctx) != "trace" {
+		t.Errorf("Query timed out should be retried with its values, retried %v", retried)
+	}
+	if deadline, ok := rctx.Deadline(); !ok || time.Until(deadline) > 2*time.Second {
+		t.Errorf("Retry should be bounded by doubled timeouts, got deadline %v", deadline)
+	}
+	s.endLifetime()
+	if retried, _, err = retry(ctx); !retried || err == nil {
+		t.Error("Retries should be given up once the server shuts down")
+	}
+
+	// Queries canceled are not retried.
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if retried, _, _ = retry(ctx); retried {
+		t.Error("Query canceled should not be retried")
+	}
+}
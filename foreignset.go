@@ -0,0 +1,110 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cherrot/gochinadns/netset"
+)
+
+// foreignIPQueueSize is the max number of foreign IPs waiting to be added to sets.
+const foreignIPQueueSize = 1024
+
+// WithForeignIPSets adds foreign IPs in trusted answers to kernel sets, for routing rules of transparent proxies.
+// IPv4 addresses are added to set4, and IPv6 ones to set6. A set is either "name" of an ipset,
+// or "family@table@set" of an nftables set. Empty sets are skipped. It can be applied multiple times.
+func WithForeignIPSets(set4, set6 string) ServerOption {
+	return func(o *serverOptions) error {
+		for _, spec := range []struct {
+			name string
+			sets *[]netset.Set
+		}{{set4, &o.ForeignSets4}, {set6, &o.ForeignSets6}} {
+			if spec.name == "" {
+				continue
+			}
+			set, err := netset.Parse(spec.name)
+			if err != nil {
+				return fmt.Errorf("invalid foreign IP set: %w", err)
+			}
+			*spec.sets = append(*spec.sets, set)
+		}
+		return nil
+	}
+}
+
+// WithIPSetMinTTL raises TTLs of answers with IPs served to clients to at least ttl while foreign IP sets are active
+// (see WithForeignIPSets), so that client caches and set entries don't churn faster than policy routing follows.
+// Unlike WithTTLClamp, answers are cached by their own TTLs, and cache hits are raised as they are served.
+// Disabled if 0. TTLs are in whole seconds.
+func WithIPSetMinTTL(ttl time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if ttl < 0 {
+			return fmt.Errorf("invalid ipset min TTL: %s", ttl)
+		}
+		o.IPSetMinTTL = ttl
+		return nil
+	}
+}
+
+// raiseSetTTLs raises TTLs of records in the answer section of m to IPSetMinTTL, if m answers any IP and foreign IP
+// sets are active.
+func (s *Server) raiseSetTTLs(m *dns.Msg) {
+	if s.IPSetMinTTL <= 0 || s.foreignIPs == nil || len(answerIPs(m)) == 0 {
+		return
+	}
+	min := uint32(s.IPSetMinTTL / time.Second)
+	for _, rr := range m.Answer {
+		if h := rr.Header(); h.Ttl < min {
+			h.Ttl = min
+		}
+	}
+}
+
+// collectForeignIPs queues IPs outside China in trusted answers, to add them to foreign IP sets.
+func (s *Server) collectForeignIPs(e *AnswerEvent) {
+	if e.Cached || (e.Verdict != VerdictOverseas && e.Verdict != VerdictTrusted) {
+		return
+	}
+	for _, ip := range answerIPs(e.Answer) {
+		if china, err := s.isChinaIP(context.Background(), ip); err != nil || china {
+			continue
+		}
+		select {
+		case s.foreignIPs <- ip:
+		default:
+			logrus.WithField("ip", ip).Warn("Too many foreign IPs to add to sets. Drop it.")
+		}
+	}
+}
+
+// runForeignSets adds queued foreign IPs to sets, until ctx is done.
+func (s *Server) runForeignSets(ctx context.Context) {
+	if s.foreignIPs == nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ip := <-s.foreignIPs:
+			s.addForeignIP(ip)
+		}
+	}
+}
+
+func (s *Server) addForeignIP(ip net.IP) {
+	sets := s.ForeignSets6
+	if ip.To4() != nil {
+		sets = s.ForeignSets4
+	}
+	for _, set := range sets {
+		if err := set.Add(ip); err != nil {
+			logrus.WithError(err).WithField("ip", ip).Errorf("Fail to add foreign IP to %s.", set)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/cherrot/gochinadns/netset"
+)
+
+type fakeSet struct {
+	ips []string
+}
+
+func (s *fakeSet) Add(ip net.IP) error {
+	s.ips = append(s.ips, ip.String())
+	return nil
+}
+
+func (s *fakeSet) String() string { return "fake" }
+
+func TestForeignIPSets(t *testing.T) {
+	china := writeTestList(t, "china.list", "1.0.1.0/24\n")
+	o := newServerOptions()
+	if err := WithCHNList(china)(o); err != nil {
+		t.Fatal(err)
+	}
+	set4, set6 := new(fakeSet), new(fakeSet)
+	o.ForeignSets4, o.ForeignSets6 = []netset.Set{set4}, []netset.Set{set6}
+	s := &Server{serverOptions: o, foreignIPs: make(chan net.IP, foreignIPQueueSize)}
+
+	answer := new(dns.Msg)
+	for _, ip := range []string{"1.0.1.1", "8.8.8.8", "2001:4860::8888"} {
+		var rr dns.RR
+		if v4 := net.ParseIP(ip).To4(); v4 != nil {
+			rr = &dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA}, A: v4}
+		} else {
+			rr = &dns.AAAA{Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA}, AAAA: net.ParseIP(ip)}
+		}
+		answer.Answer = append(answer.Answer, rr)
+	}
+	s.collectForeignIPs(&AnswerEvent{Answer: answer, Verdict: VerdictChina})
+	s.collectForeignIPs(&AnswerEvent{Answer: answer, Cached: true})
+	if len(s.foreignIPs) != 0 {
+		t.Fatal("Only trusted answers should be collected")
+	}
+	s.collectForeignIPs(&AnswerEvent{Answer: answer, Verdict: VerdictOverseas})
+	for len(s.foreignIPs) > 0 {
+		s.addForeignIP(<-s.foreignIPs)
+	}
+	if len(set4.ips) != 1 || set4.ips[0] != "8.8.8.8" {
+		t.Errorf("Unexpected IPv4 set %v", set4.ips)
+	}
+	if len(set6.ips) != 1 || set6.ips[0] != "2001:4860::8888" {
+		t.Errorf("Unexpected IPv6 set %v", set6.ips)
+	}
+}
+
+func TestIPSetMinTTL(t *testing.T) {
+	o := newServerOptions()
+	if err := WithIPSetMinTTL(5 * time.Minute)(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o}
+
+	m := newTestReply("www.google.com.", 60, "8.8.8.8")
+	s.raiseSetTTLs(m)
+	if m.Answer[0].Header().Ttl != 60 {
+		t.Error("TTLs should be kept without foreign IP sets")
+	}
+
+	s.foreignIPs = make(chan net.IP, 1)
+	s.raiseSetTTLs(m)
+	if m.Answer[0].Header().Ttl != 300 {
+		t.Errorf("Unexpected TTL %d", m.Answer[0].Header().Ttl)
+	}
+	m = newTestReply("www.google.com.", 600, "8.8.8.8")
+	s.raiseSetTTLs(m)
+	if m.Answer[0].Header().Ttl != 600 {
+		t.Errorf("Longer TTLs should be kept, got %d", m.Answer[0].Header().Ttl)
+	}
+	m = new(dns.Msg)
+	m.Answer = []dns.RR{&dns.TXT{Hdr: dns.RR_Header{Rrtype: dns.TypeTXT, Ttl: 60}}}
+	s.raiseSetTTLs(m)
+	if m.Answer[0].Header().Ttl != 60 {
+		t.Error("TTLs of answers without IPs should be kept")
+	}
+
+	if err := WithIPSetMinTTL(-time.Second)(o); err == nil {
+		t.Error("Negative TTL should fail")
+	}
+}
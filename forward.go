@@ -0,0 +1,140 @@
+package gochinadns
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// forwardTable routes domains (and their subdomains) to designated upstreams, bypassing the trusted/untrusted race.
+type forwardTable map[string]resolverList
+
+// Lookup returns upstreams of the longest domain suffix of name in the table, or nil if none matches.
+func (t forwardTable) Lookup(name string) resolverList {
+	if len(t) == 0 {
+		return nil
+	}
+	name = strings.ToLower(strings.Trim(name, "."))
+	for {
+		if servers := t[name]; servers != nil {
+			return servers
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return nil
+		}
+		name = name[i+1:]
+	}
+}
+
+// parseForwardRule parses a dnsmasq style rule: server=/domain[/domain...]/upstream
+// The upstream is in the same format as ParseResolver. A dnsmasq style port (ip#port) is also accepted.
+func parseForwardRule(line string, tcpOnly bool) (domains []string, server *Resolver, err error) {
+	const prefix = "server=/"
+	if !strings.HasPrefix(line, prefix) {
+		return nil, nil, fmt.Errorf("rule should start with %s", prefix)
+	}
+	fields := strings.Split(line[len(prefix):], "/")
+	addr := fields[len(fields)-1]
+	for _, domain := range fields[:len(fields)-1] {
+		if domain = strings.ToLower(strings.Trim(domain, ".")); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	if len(domains) == 0 || addr == "" {
+		return nil, nil, fmt.Errorf("domain and upstream are required")
+	}
+	if i := strings.LastIndex(addr, "#"); i >= 0 && !strings.Contains(addr, "@") && !strings.Contains(addr, "://") {
+		addr = addr[:i] + ":" + addr[i+1:]
+		if strings.Count(addr, ":") > 1 {
+			addr = "[" + addr[:i] + "]" + addr[i:]
+		}
+	}
+	server, err = ParseResolver(addr, tcpOnly)
+	return
+}
+
+// WithForwardRules loads dnsmasq style conditional forwarding rules, one per line:
+//
+//	server=/corp.example.com/10.0.0.1
+//	server=/lan/home.arpa/192.168.1.1#5353
+//
+// Queries of these domains and their subdomains are only sent to the designated upstreams.
+// Multiple upstreams of a domain are queried in order like other upstreams.
+// Upstreams in ip[:port] format are queried over TCP only if tcpOnly is true, like WithTrustedResolvers.
+func WithForwardRules(tcpOnly bool, path string) ServerOption {
+	return func(o *serverOptions) error {
+		if path == "" {
+			return fmt.Errorf("%w for forward rules", ErrEmptyPath)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return o.ListErrors.add(fmt.Errorf("fail to open forward rules: %w", err))
+		}
+		defer file.Close()
+
+		if o.ForwardRules == nil {
+			o.ForwardRules = make(forwardTable)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			domains, server, err := parseForwardRule(line, tcpOnly)
+			if err != nil {
+				if err := o.ListErrors.add(fmt.Errorf("parse forward rule [%s] failed: %w", line, err)); err != nil {
+					return err
+				}
+				continue
+			}
+			for _, domain := range domains {
+				o.ForwardRules[domain] = uniqueAppendResolver(o.ForwardRules[domain], server)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return o.ListErrors.add(fmt.Errorf("fail to scan forward rules: %v", err.Error()))
+		}
+		return nil
+	}
+}
+
+// forwardServers returns the designated upstreams of name, or nil if it's not routed by forward rules.
+func (s *Server) forwardServers(name string) resolverList {
+	s.listsMu.RLock()
+	defer s.listsMu.RUnlock()
+	return s.ForwardRules.Lookup(name)
+}
+
+// forward looks up req in the designated servers only.
+func (s *Server) forward(parent context.Context, logger *logrus.Entry, req *dns.Msg, servers resolverList) *upstreamReply {
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	result := make(chan *upstreamReply, 1)
+	s.goroutines.Go("forward "+questionString(&req.Question[0]), cancel, func() {
+		lookupInServers(ctx, cancel, result, req, servers, s.Delay, s.Clock, s.hooks.hookLookup(s.lookupNormal), s.goroutines)
+	})
+
+	select {
+	case reply := <-result:
+		logger.Debug("Forwarded to ", reply.server)
+		reply.verdict = VerdictForwarded
+		return reply
+	case <-ctx.Done():
+		// lookupInServers may cancel ctx right after sending a reply.
+		select {
+		case reply := <-result:
+			reply.verdict = VerdictForwarded
+			return reply
+		default:
+		}
+		logger.Warn("No reply from forward servers.")
+		return nil
+	}
+}
@@ -0,0 +1,86 @@
+package gochinadns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestWithForwardRules(t *testing.T) {
+	path := writeTestList(t, "forward.rules", `# intranet
+server=/corp.example.com/10.0.0.1
+server=/corp.example.com/10.0.0.2#5353
+server=/lan/home.arpa/tcp@192.168.1.1
+server=/v6.example.com/fd00::1#53
+`)
+	o := newServerOptions()
+	if err := WithForwardRules(false, path)(o); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{"www.corp.example.com.", []string{"10.0.0.1:53", "10.0.0.2:5353"}},
+		{"CORP.example.com.", []string{"10.0.0.1:53", "10.0.0.2:5353"}},
+		{"nas.lan.", []string{"192.168.1.1:53"}},
+		{"router.home.arpa.", []string{"192.168.1.1:53"}},
+		{"v6.example.com.", []string{"[fd00::1]:53"}},
+		{"example.com.", nil},
+		{"notcorp.example.com.", nil},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, r := range o.ForwardRules.Lookup(tt.name) {
+			got = append(got, r.GetAddr())
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("Lookup(%s) = %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("Lookup(%s) = %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+
+	o = newServerOptions()
+	if err := WithForwardRules(true, path)(o); err != nil {
+		t.Fatal(err)
+	}
+	if p := o.ForwardRules.Lookup("www.corp.example.com.")[0].GetProtocols(); len(p) != 1 || p[0] != "tcp" {
+		t.Errorf("Upstreams should be queried over TCP only, got %v", p)
+	}
+
+	bad := writeTestList(t, "bad.rules", "server=/8.8.8.8\n")
+	if err := applyListOption(WithForwardRules(false, bad)); err == nil {
+		t.Error("Rule without upstream should fail")
+	}
+}
+
+func TestForward(t *testing.T) {
+	addr := startTestUpstream(t)
+	path := writeTestList(t, "forward.rules", "server=/corp.example.com/"+addr+"\n")
+	o := newServerOptions()
+	if err := WithForwardRules(false, path)(o); err != nil {
+		t.Fatal(err)
+	}
+	o.Delay = 100 * time.Millisecond
+	s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second))}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.corp.example.com.", dns.TypeA)
+	reply := s.resolve(context.Background(), logrus.NewEntry(logrus.StandardLogger()), req)
+	if reply == nil {
+		t.Fatal("No reply from forward server")
+	}
+	if reply.verdict != VerdictForwarded || reply.server.GetAddr() != addr {
+		t.Errorf("Unexpected reply from %s with verdict %s", reply.server, reply.verdict)
+	}
+}
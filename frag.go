@@ -0,0 +1,100 @@
+package gochinadns
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// flagDayUDPSize is the EDNS UDP size recommended by DNS Flag Day 2020 to avoid IP fragmentation.
+	flagDayUDPSize = 1232
+	// fragTimeoutThreshold is the number of consecutive UDP timeouts with EDNS UDP size flagDayUDPSize,
+	// after which an upstream is considered unable to deliver large UDP replies, and is switched to TCP.
+	fragTimeoutThreshold = 3
+	// fragRetryAfter is how long the EDNS UDP size stays lowered and TCP stays preferred, after which the upstream
+	// is queried as before again, in case the path to it stops dropping fragments.
+	fragRetryAfter = 30 * time.Minute
+)
+
+// fragState adapts EDNS UDP size and transport of an upstream to fragmentation-related timeouts.
+type fragState struct {
+	ednsLimit   uint32 // EDNS UDP size limit, 0 if not limited
+	udpTimeouts int32  // consecutive UDP timeouts with a limited EDNS UDP size
+	preferTCP   int32  // 1 if TCP is preferred to UDP
+	adapted     int64  // unix nanoseconds of the last adaptation, 0 if not adapted
+}
+
+// onUDPTimeout records a UDP timeout of a query advertising EDNS UDP size.
+// Timeouts of queries with a large size are likely caused by fragmented replies being dropped,
+// so the size is lowered to flagDayUDPSize first, then the upstream is switched to TCP if it keeps timing out.
+func (r *Resolver) onUDPTimeout(size uint16) {
+	if size <= dns.MinMsgSize {
+		return
+	}
+	if size > flagDayUDPSize {
+		if atomic.SwapUint32(&r.frag.ednsLimit, flagDayUDPSize) != flagDayUDPSize {
+			atomic.StoreInt64(&r.frag.adapted, time.Now().UnixNano())
+			logrus.WithField("server", r).Warnf("UDP query with EDNS size %d timed out. Lower it to %d.", size, flagDayUDPSize)
+		}
+		return
+	}
+	if atomic.AddInt32(&r.frag.udpTimeouts, 1) >= fragTimeoutThreshold && atomic.SwapInt32(&r.frag.preferTCP, 1) == 0 {
+		atomic.StoreInt64(&r.frag.adapted, time.Now().UnixNano())
+		logrus.WithField("server", r).Warnf("UDP queries keep timing out with EDNS size %d. Prefer TCP.", size)
+	}
+}
+
+// onUDPSuccess resets the count of consecutive UDP timeouts.
+func (r *Resolver) onUDPSuccess() {
+	atomic.StoreInt32(&r.frag.udpTimeouts, 0)
+}
+
+// expireFrag undoes adaptations to fragmentation once they are older than fragRetryAfter.
+func (r *Resolver) expireFrag() {
+	adapted := atomic.LoadInt64(&r.frag.adapted)
+	if adapted == 0 || time.Now().UnixNano()-adapted < int64(fragRetryAfter) {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&r.frag.adapted, adapted, 0) {
+		atomic.StoreUint32(&r.frag.ednsLimit, 0)
+		atomic.StoreInt32(&r.frag.udpTimeouts, 0)
+		atomic.StoreInt32(&r.frag.preferTCP, 0)
+		logrus.WithField("server", r).Infof("Retry UDP queries with the original EDNS size after %s.", fragRetryAfter)
+	}
+}
+
+func (r *Resolver) ednsLimit() uint16 {
+	r.expireFrag()
+	return uint16(atomic.LoadUint32(&r.frag.ednsLimit))
+}
+
+func (r *Resolver) prefersTCP() bool {
+	r.expireFrag()
+	return atomic.LoadInt32(&r.frag.preferTCP) == 1
+}
+
+// preferTCPIn moves tcp ahead of udp in protocols, or replaces udp by tcp for upstreams without declared protocols.
+func (r *Resolver) preferTCPIn(protocols []string) []string {
+	if r.autoProtocols {
+		return []string{"tcp"}
+	}
+	result := make([]string, 0, len(protocols))
+	for _, p := range protocols {
+		if p == "tcp" {
+			result = append([]string{"tcp"}, result...)
+		} else {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
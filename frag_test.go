@@ -0,0 +1,54 @@
+package gochinadns
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestFragmentationFallback(t *testing.T) {
+	r, err := ParseResolver("udp+tcp@8.8.8.8", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	req.SetEdns0(4096, false)
+
+	r.onUDPTimeout(4096)
+	r.limitUDPSize(req)
+	if size := req.IsEdns0().UDPSize(); size != flagDayUDPSize {
+		t.Fatalf("EDNS size should be lowered to %d, got %d", flagDayUDPSize, size)
+	}
+
+	for i := 0; i < fragTimeoutThreshold-1; i++ {
+		r.onUDPTimeout(flagDayUDPSize)
+	}
+	r.onUDPSuccess()
+	r.onUDPTimeout(flagDayUDPSize)
+	if r.prefersTCP() {
+		t.Error("A UDP success should reset consecutive timeouts")
+	}
+
+	for i := 0; i < fragTimeoutThreshold; i++ {
+		r.onUDPTimeout(flagDayUDPSize)
+	}
+	if p := r.protocols(); len(p) != 2 || p[0] != "tcp" {
+		t.Errorf("TCP should be preferred, got %v", p)
+	}
+
+	atomic.StoreInt64(&r.frag.adapted, time.Now().Add(-fragRetryAfter).UnixNano())
+	if p := r.protocols(); r.ednsLimit() != 0 || p[0] != "udp" {
+		t.Errorf("Adaptations should expire, got EDNS limit %d and %v", r.ednsLimit(), p)
+	}
+
+	auto, _ := ParseResolver("8.8.8.8", false)
+	for i := 0; i < fragTimeoutThreshold; i++ {
+		auto.onUDPTimeout(flagDayUDPSize)
+	}
+	if p := auto.protocols(); len(p) != 1 || p[0] != "tcp" {
+		t.Errorf("Upstream without declared protocols should switch to TCP, got %v", p)
+	}
+}
@@ -0,0 +1,227 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/yl2chen/cidranger"
+
+	"github.com/cherrot/gochinadns/mmdb"
+)
+
+const (
+	// chinaCountryCode is the ISO 3166-1 country code of China in GeoIP databases.
+	chinaCountryCode = "CN"
+	// CountryUnknown is the ISO 3166-1 user-assigned code of IPs of unknown countries.
+	CountryUnknown = "ZZ"
+)
+
+// IPMatcher checks whether an IP is in a set, e.g. a CIDR list or a GeoIP country. cidranger.Ranger implements it.
+type IPMatcher interface {
+	Contains(ip net.IP) (bool, error)
+}
+
+// GeoInfo is the location of an IP by a GeoProvider.
+type GeoInfo struct {
+	Country string     // ISO 3166-1 country code, empty if unknown
+	ASN     uint32     // number of the autonomous system announcing the IP, 0 if unknown
+	Network *net.IPNet // network of the IP with the same location, nil if unknown
+	Source  string     // where the location comes from, e.g. the path of a database
+}
+
+// GeoProvider locates IPs by country and autonomous system, e.g. by a GeoIP database or API. Embedders may plug in
+// their own providers by WithGeoProvider, wrapped by NewCachedGeoProvider if locating IPs is slow.
+// Locate must be safe for concurrent use, and should give up once ctx is done, e.g. when the query is.
+type GeoProvider interface {
+	Locate(ctx context.Context, ip net.IP) (GeoInfo, error)
+}
+
+// mmdbProvider locates IPs by a MaxMind DB, such as GeoLite2-Country or GeoLite2-ASN.
+type mmdbProvider struct {
+	db   *mmdb.Reader
+	path string
+}
+
+// NewMMDBGeoProvider returns a GeoProvider of the MaxMind DB at path, such as GeoLite2-Country.mmdb. Country databases
+// locate countries, and ASN databases locate autonomous systems.
+func NewMMDBGeoProvider(path string) (GeoProvider, error) {
+	if path == "" {
+		return nil, fmt.Errorf("%w for GeoIP database", ErrEmptyPath)
+	}
+	db, err := mmdb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("fail to load GeoIP database: %w", err)
+	}
+	return &mmdbProvider{db: db, path: path}, nil
+}
+
+// Locate returns the location of ip. The registered country is used if the country is absent, e.g. for anycast
+// networks.
+func (p *mmdbProvider) Locate(_ context.Context, ip net.IP) (GeoInfo, error) {
+	record, network, err := p.db.Lookup(ip)
+	if err != nil {
+		return GeoInfo{}, err
+	}
+	info := GeoInfo{Network: network, Source: p.path}
+	r, _ := record.(map[string]interface{})
+	for _, key := range []string{"country", "registered_country"} {
+		if c, ok := r[key].(map[string]interface{}); ok {
+			if code, ok := c["iso_code"].(string); ok {
+				info.Country = code
+				break
+			}
+		}
+	}
+	if asn, ok := r["autonomous_system_number"].(uint64); ok {
+		info.ASN = uint32(asn)
+	}
+	return info, nil
+}
+
+// cidrProvider locates IPs in CIDR lists as a country.
+type cidrProvider struct {
+	country string
+	ranger  cidranger.Ranger
+}
+
+// NewCIDRGeoProvider returns a GeoProvider locating IPs in CIDR lists at paths, like China route lists, as country.
+// Other IPs are located nowhere.
+func NewCIDRGeoProvider(country string, paths ...string) (GeoProvider, error) {
+	p := &cidrProvider{country: country, ranger: cidranger.NewPCTrieRanger()}
+	for _, path := range paths {
+		if _, err := loadCIDRList(p.ranger, path, "CIDR list of "+country, nil); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// Locate returns country for ip in the lists, along with the most specific network and its source.
+func (p *cidrProvider) Locate(_ context.Context, ip net.IP) (GeoInfo, error) {
+	entries, err := p.ranger.ContainingNetworks(ip)
+	if err != nil || len(entries) == 0 {
+		return GeoInfo{}, err
+	}
+	entry := entries[len(entries)-1]
+	network := entry.Network()
+	info := GeoInfo{Country: p.country, Network: &network}
+	if e, ok := entry.(*sourcedEntry); ok {
+		info.Source = e.source
+	}
+	return info, nil
+}
+
+// cachedProvider caches locations of a GeoProvider.
+type cachedProvider struct {
+	provider GeoProvider
+	size     int
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedGeoInfo
+}
+
+type cachedGeoInfo struct {
+	info    GeoInfo
+	expires time.Time
+}
+
+// NewCachedGeoProvider caches locations of up to size IPs by provider for ttl, e.g. of a commercial GeoIP API,
+// so that answers aren't delayed by it for IPs seen recently. Errors are not cached.
+func NewCachedGeoProvider(provider GeoProvider, size int, ttl time.Duration) GeoProvider {
+	return &cachedProvider{provider: provider, size: size, ttl: ttl, entries: make(map[string]cachedGeoInfo)}
+}
+
+func (p *cachedProvider) Locate(ctx context.Context, ip net.IP) (GeoInfo, error) {
+	key := string(normalizeIP(ip))
+	now := time.Now()
+	p.mu.Lock()
+	e, ok := p.entries[key]
+	p.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.info, nil
+	}
+
+	info, err := p.provider.Locate(ctx, ip)
+	if err != nil || p.size <= 0 {
+		return info, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.entries) >= p.size {
+		for k, e := range p.entries {
+			if !now.Before(e.expires) {
+				delete(p.entries, k)
+			}
+		}
+		// Still full of live entries, drop any of them.
+		for k := range p.entries {
+			if len(p.entries) < p.size {
+				break
+			}
+			delete(p.entries, k)
+		}
+	}
+	p.entries[key] = cachedGeoInfo{info: info, expires: now.Add(p.ttl)}
+	return info, nil
+}
+
+// geoMatcher matches IPs located in a country by a GeoProvider.
+type geoMatcher struct {
+	provider GeoProvider
+	country  string
+}
+
+func (m *geoMatcher) Contains(ip net.IP) (bool, error) {
+	return m.containsContext(context.Background(), ip)
+}
+
+// containsContext is Contains giving up once ctx is done.
+func (m *geoMatcher) containsContext(ctx context.Context, ip net.IP) (bool, error) {
+	info, err := m.provider.Locate(ctx, ip)
+	return info.Country == m.country, err
+}
+
+// locateCountry returns the country of ip located by the GeoIP provider, or CountryUnknown. Without a provider, IPs
+// are only told apart as in China or not by China route lists.
+func (s *Server) locateCountry(ctx context.Context, ip net.IP) (string, error) {
+	if geo, ok := s.loadMatchers().backend.(*geoMatcher); ok {
+		info, err := geo.provider.Locate(ctx, ip)
+		if err != nil || info.Country == "" {
+			return CountryUnknown, err
+		}
+		return info.Country, nil
+	}
+	china, err := s.isChinaIP(ctx, ip)
+	if err != nil || !china {
+		return CountryUnknown, err
+	}
+	return chinaCountryCode, nil
+}
+
+// WithGeoProvider checks whether an IP belongs to China by its country located by provider instead of China route
+// lists, see GeoProvider. A separate IPv6 China route list (WithCHNList6) and the exclusion list still apply.
+func WithGeoProvider(provider GeoProvider) ServerOption {
+	return func(o *serverOptions) error {
+		if provider == nil {
+			return fmt.Errorf("no GeoIP provider")
+		}
+		o.ChinaBackend = &geoMatcher{provider: provider, country: chinaCountryCode}
+		return nil
+	}
+}
+
+// WithGeoIP checks whether an IP belongs to China by a MaxMind DB (e.g. GeoLite2-Country.mmdb) instead of
+// China route lists. A separate IPv6 China route list (WithCHNList6) and the exclusion list still apply.
+func WithGeoIP(path string) ServerOption {
+	return func(o *serverOptions) error {
+		provider, err := NewMMDBGeoProvider(path)
+		if err != nil {
+			return err
+		}
+		return WithGeoProvider(provider)(o)
+	}
+}
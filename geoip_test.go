@@ -0,0 +1,213 @@
+package gochinadns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestMMDB writes an IPv4 MaxMind DB with record size 24, mapping networks to country codes.
+func writeTestMMDB(t *testing.T, countries map[string]string) string {
+	t.Helper()
+	str := func(s string) []byte { return append([]byte{2<<5 | byte(len(s))}, s...) }
+	uint32Val := func(v uint32) []byte {
+		b := []byte{6<<5 | 4, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(b[1:], v)
+		return b
+	}
+	cat := func(parts ...[]byte) (b []byte) {
+		for _, p := range parts {
+			b = append(b, p...)
+		}
+		return
+	}
+
+	// Records are node indexes, emptyRecord, or -(data offset) - 1.
+	const emptyRecord = 1 << 30
+	nodes := [][2]int{{emptyRecord, emptyRecord}}
+	var data []byte
+	for cidr, country := range countries {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := network.Mask.Size()
+		offset := len(data)
+		data = append(data, cat([]byte{7<<5 | 1}, str("country"), []byte{7<<5 | 1}, str("iso_code"), str(country))...)
+
+		ip, node := network.IP.To4(), 0
+		for depth := 0; depth < ones; depth++ {
+			bit := ip[depth/8] >> (7 - depth%8) & 1
+			if depth == ones-1 {
+				nodes[node][bit] = -offset - 1
+				break
+			}
+			if nodes[node][bit] == emptyRecord {
+				nodes = append(nodes, [2]int{emptyRecord, emptyRecord})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var buf []byte
+	n := len(nodes)
+	for _, node := range nodes {
+		for _, r := range node {
+			v := r
+			if r == emptyRecord {
+				v = n
+			} else if r < 0 {
+				v = n + 16 - r - 1
+			}
+			buf = append(buf, byte(v>>16), byte(v>>8), byte(v))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, data...)
+	buf = append(buf, "\xAB\xCD\xEFMaxMind.com"...)
+	buf = append(buf, cat([]byte{7<<5 | 3},
+		str("node_count"), uint32Val(uint32(n)),
+		str("record_size"), uint32Val(24),
+		str("ip_version"), uint32Val(4))...)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestWithGeoIP(t *testing.T) {
+	path := writeTestMMDB(t, map[string]string{"1.0.1.0/24": "CN", "8.8.8.0/24": "US"})
+	o := newServerOptions()
+	if err := WithGeoIP(path)(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"1.0.1.1", true},
+		{"1.0.2.1", false},
+		{"8.8.8.8", false},
+		{"2001:db8::1", false},
+	}
+	for _, tt := range tests {
+		got, err := s.isChinaIP(context.Background(), net.ParseIP(tt.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("isChinaIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	c, err := s.ClassifyIP(net.ParseIP("1.0.1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := c.Matches[ListGeoIP]; len(m) != 1 || m[0].Network != "1.0.1.0/24" {
+		t.Errorf("Unexpected GeoIP matches %v", m)
+	}
+
+	if err := WithGeoIP(writeTestList(t, "bad.mmdb", "1.0.1.0/24\n"))(newServerOptions()); err == nil {
+		t.Error("Invalid database should fail")
+	}
+}
+
+// countingGeoProvider locates IPs by a map, counting calls. It fails once ctx is done, like a GeoIP API.
+type countingGeoProvider struct {
+	infos map[string]GeoInfo
+	calls int
+}
+
+func (p *countingGeoProvider) Locate(ctx context.Context, ip net.IP) (GeoInfo, error) {
+	p.calls++
+	if err := ctx.Err(); err != nil {
+		return GeoInfo{}, err
+	}
+	if info, ok := p.infos[ip.String()]; ok {
+		return info, nil
+	}
+	return GeoInfo{}, errors.New("unknown IP")
+}
+
+func TestWithGeoProvider(t *testing.T) {
+	provider := &countingGeoProvider{infos: map[string]GeoInfo{
+		"1.0.1.1": {Country: "CN", ASN: 4134, Source: "api"},
+		"8.8.8.8": {Country: "US", ASN: 15169},
+	}}
+	o := newServerOptions()
+	if err := WithGeoProvider(NewCachedGeoProvider(provider, 1, time.Minute))(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o}
+
+	c, err := s.ClassifyIP(net.ParseIP("1.0.1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.China || c.Country != "CN" || c.ASN != 4134 {
+		t.Errorf("Unexpected classification %+v", c)
+	}
+	if m := c.Matches[ListGeoIP]; len(m) != 1 || m[0] != (CIDRMatch{Network: "1.0.1.1", Source: "api"}) {
+		t.Errorf("Unexpected GeoIP matches %v", m)
+	}
+	calls := provider.calls
+	if ok, _ := s.isChinaIP(context.Background(), net.ParseIP("1.0.1.1")); !ok || provider.calls != calls {
+		t.Errorf("Location should be cached, calls %d -> %d", calls, provider.calls)
+	}
+	if ok, _ := s.isChinaIP(context.Background(), net.ParseIP("8.8.8.8")); ok {
+		t.Error("8.8.8.8 should not be China IP")
+	}
+	if ok, _ := s.isChinaIP(context.Background(), net.ParseIP("1.0.1.1")); !ok || provider.calls != calls+2 {
+		t.Errorf("Cache should be bounded, calls %d -> %d", calls, provider.calls)
+	}
+
+	calls = provider.calls
+	for i := 0; i < 2; i++ {
+		if _, err := s.isChinaIP(context.Background(), net.ParseIP("9.9.9.9")); err == nil {
+			t.Error("Errors of provider should be returned")
+		}
+	}
+	if provider.calls != calls+2 {
+		t.Errorf("Errors should not be cached, calls %d -> %d", calls, provider.calls)
+	}
+
+	// Answers are located with the context of the query.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := s.isChinaAnswer(ctx, []net.IP{net.ParseIP("8.8.4.4")}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Locating answers of a query given up should fail, got %v", err)
+	}
+}
+
+func TestCIDRGeoProvider(t *testing.T) {
+	path := writeTestList(t, "chnroute.txt", "1.0.0.0/16\n1.0.1.0/24\n")
+	p, err := NewCIDRGeoProvider("CN", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := p.Locate(context.Background(), net.ParseIP("1.0.1.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Country != "CN" || info.Network.String() != "1.0.1.0/24" || info.Source != path {
+		t.Errorf("Unexpected location %+v", info)
+	}
+	if info, _ = p.Locate(context.Background(), net.ParseIP("8.8.8.8")); info.Country != "" {
+		t.Errorf("Unexpected location %+v", info)
+	}
+
+	if _, err = NewCIDRGeoProvider("CN", writeTestList(t, "bad.txt", "not a cidr\n")); err == nil {
+		t.Error("Invalid list should fail")
+	}
+}
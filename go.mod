@@ -7,5 +7,8 @@ require (
 	github.com/miekg/dns v1.1.35
 	github.com/sirupsen/logrus v1.7.0
 	github.com/yl2chen/cidranger v1.0.2
+	golang.org/x/net v0.0.0-20190923162816-aa69164e4478
 	golang.org/x/sync v0.0.0-20190423024810-112230192c58
+	golang.org/x/sys v0.0.0-20191026070338-33540a1f6037
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,125 @@
+package gochinadns
+
+import (
+	"context"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// lookupGoroutines is the number of running lookup goroutines of all servers.
+var lookupGoroutines = expvar.NewInt("chinadns_lookup_goroutines")
+
+type trackedGoroutine struct {
+	name    string
+	start   time.Time
+	cancel  context.CancelFunc
+	overdue bool
+}
+
+// goroutineTracker accounts goroutines spawned to serve queries, so that leaked ones can be noticed and canceled.
+type goroutineTracker struct {
+	mu         sync.Mutex
+	seq        uint64
+	goroutines map[uint64]*trackedGoroutine
+}
+
+func newGoroutineTracker() *goroutineTracker {
+	return &goroutineTracker{goroutines: make(map[uint64]*trackedGoroutine)}
+}
+
+// Go runs f in a new goroutine and tracks it until f returns.
+// cancel is called if the goroutine runs longer than the max age of the watchdog.
+func (t *goroutineTracker) Go(name string, cancel context.CancelFunc, f func()) {
+	if t == nil {
+		go f()
+		return
+	}
+	g := &trackedGoroutine{name: name, start: time.Now(), cancel: cancel}
+	t.mu.Lock()
+	t.seq++
+	id := t.seq
+	t.goroutines[id] = g
+	t.mu.Unlock()
+	lookupGoroutines.Add(1)
+
+	go func() {
+		defer func() {
+			t.mu.Lock()
+			delete(t.goroutines, id)
+			t.mu.Unlock()
+			lookupGoroutines.Add(-1)
+		}()
+		f()
+	}()
+}
+
+// Len returns the number of running goroutines.
+func (t *goroutineTracker) Len() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.goroutines)
+}
+
+// Subsystems returns the number of running goroutines by subsystem, which is the first word of their names, like
+// lookup or forward.
+func (t *goroutineTracker) Subsystems() map[string]int {
+	subsystems := make(map[string]int)
+	if t == nil {
+		return subsystems
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, g := range t.goroutines {
+		subsystems[strings.SplitN(g.name, " ", 2)[0]]++
+	}
+	return subsystems
+}
+
+// Watch checks goroutines periodically until ctx is done,
+// logging and canceling those running longer than maxAge.
+func (t *goroutineTracker) Watch(ctx context.Context, maxAge time.Duration) {
+	if t == nil || maxAge <= 0 {
+		return
+	}
+	interval := maxAge / 2
+	if interval > 10*time.Second {
+		interval = 10 * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.cancelOverdue(now, maxAge)
+		}
+	}
+}
+
+func (t *goroutineTracker) cancelOverdue(now time.Time, maxAge time.Duration) (n int) {
+	var overdue []*trackedGoroutine
+	t.mu.Lock()
+	for _, g := range t.goroutines {
+		if !g.overdue && now.Sub(g.start) > maxAge {
+			g.overdue = true
+			overdue = append(overdue, g)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, g := range overdue {
+		logrus.WithField("goroutine", g.name).Warnf("Goroutine is running for %s. Cancel it.", now.Sub(g.start).Truncate(time.Millisecond))
+		if g.cancel != nil {
+			g.cancel()
+		}
+	}
+	return len(overdue)
+}
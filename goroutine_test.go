@@ -0,0 +1,32 @@
+package gochinadns
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGoroutineTrackerCancelOverdue(t *testing.T) {
+	tr := newGoroutineTracker()
+	ctx, cancel := context.WithCancel(context.Background())
+	stuck := make(chan struct{})
+	tr.Go("stuck", cancel, func() { <-ctx.Done(); close(stuck) })
+	done := make(chan struct{})
+	tr.Go("quick", nil, func() { close(done) })
+	<-done
+
+	if n := tr.cancelOverdue(time.Now(), time.Minute); n != 0 {
+		t.Errorf("No goroutine should be overdue, got %d", n)
+	}
+	if n := tr.cancelOverdue(time.Now().Add(2*time.Minute), time.Minute); n != 1 {
+		t.Errorf("Expect 1 overdue goroutine, got %d", n)
+	}
+	select {
+	case <-stuck:
+	case <-time.After(time.Second):
+		t.Fatal("Overdue goroutine should be canceled")
+	}
+	if n := tr.cancelOverdue(time.Now().Add(3*time.Minute), time.Minute); n != 0 {
+		t.Errorf("Overdue goroutine should be reported only once, got %d", n)
+	}
+}
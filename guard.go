@@ -0,0 +1,153 @@
+package gochinadns
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// guardInterval is the interval to check memory usage and open file descriptors.
+	guardInterval = 10 * time.Second
+	// fdScarceRatio is the ratio of open file descriptors to the limit, beyond which they are scarce.
+	fdScarceRatio = 0.8
+	// memoryLowRatio is the ratio of the low watermark of memory usage to the limit, below which the cache stops
+	// shrinking once it exceeds the limit.
+	memoryLowRatio = 0.8
+	// memoryMaxBackoff is the max checks skipped between shrinks, i.e. 5 minutes.
+	memoryMaxBackoff = 30
+)
+
+var (
+	memoryShrinks = expvar.NewInt("chinadns_memory_shrinks")
+	estimatedMem  = expvar.NewInt("chinadns_estimated_memory")
+	openFDsGauge  = expvar.NewInt("chinadns_open_fds")
+	// fdsScarce is 1 if open file descriptors are close to the limit, when pools stop growing their connections.
+	fdsScarce int32
+)
+
+// WithMemoryLimit shrinks the response cache by half, and returns freed memory to the OS, once the estimated memory
+// usage of the process exceeds limit bytes, so that it stays in the budget of routers with 64-128MB of memory. The usage
+// is estimated from the Go runtime, which is close to RSS. Checked every 10s. The cache keeps shrinking until the usage
+// drops below 80% of limit, backing off from one check to 5 minutes in between, since memory is returned to the OS
+// lazily, and the cache shouldn't be emptied before it is. Disabled if 0.
+func WithMemoryLimit(limit int) ServerOption {
+	return func(o *serverOptions) error {
+		if limit < 0 {
+			return fmt.Errorf("invalid memory limit: %d", limit)
+		}
+		o.MemoryLimit = limit
+		return nil
+	}
+}
+
+// WithGCPercent sets the GC target percentage of the process on start, see debug.SetGCPercent. A lower one trades
+// CPU for a smaller heap. Unchanged if 0.
+func WithGCPercent(percent int) ServerOption {
+	return func(o *serverOptions) error {
+		if percent < 0 {
+			return fmt.Errorf("invalid GC percent: %d", percent)
+		}
+		o.GCPercent = percent
+		return nil
+	}
+}
+
+// runGuard checks memory usage and open file descriptors periodically until ctx is done.
+func (s *Server) runGuard(ctx context.Context) {
+	if s.GCPercent > 0 {
+		old := debug.SetGCPercent(s.GCPercent)
+		logrus.Infof("Set GC percent to %d (was %d).", s.GCPercent, old)
+	}
+	if open, limit, ok := openFDs(); ok {
+		logrus.Infof("Open file descriptors: %d of %d.", open, limit)
+	}
+	ticker := time.NewTicker(guardInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.checkMemory()
+			checkFDs()
+		}
+	}
+}
+
+// memoryGuard is the state of checkMemory between checks.
+type memoryGuard struct {
+	over    bool // the usage exceeded the limit, and hasn't dropped below the low watermark since
+	skip    int  // checks to skip before shrinking again
+	backoff int  // checks to skip after the next shrink, doubled on each shrink
+}
+
+// checkMemory shrinks the cache if the estimated memory usage exceeds MemoryLimit, and keeps shrinking it with
+// backoff until the usage drops below the low watermark.
+func (s *Server) checkMemory() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	usage := m.Sys - m.HeapReleased
+	estimatedMem.Set(int64(usage))
+	g := &s.memGuard
+	if s.MemoryLimit <= 0 || usage <= uint64(memoryLowRatio*float64(s.MemoryLimit)) {
+		if g.over {
+			logrus.Infof("Estimated memory usage is back to %.1f MiB.", float64(usage)/(1<<20))
+		}
+		*g = memoryGuard{}
+		return
+	}
+	if !g.over && usage <= uint64(s.MemoryLimit) {
+		return
+	}
+	if g.over && g.skip > 0 {
+		g.skip--
+		return
+	}
+	if !g.over {
+		g.over, g.backoff = true, 1
+	}
+	g.skip = g.backoff
+	if g.backoff *= 2; g.backoff > memoryMaxBackoff {
+		g.backoff = memoryMaxBackoff
+	}
+	memoryShrinks.Add(1)
+	n := 0
+	if c, ok := s.cache.(interface{ Shrink() int }); ok {
+		n = c.Shrink()
+	}
+	debug.FreeOSMemory()
+	if usage > uint64(s.MemoryLimit) {
+		logrus.Warnf("Estimated memory usage %.1f MiB exceeds the limit %.1f MiB. Evicted %d cache entries.",
+			float64(usage)/(1<<20), float64(s.MemoryLimit)/(1<<20), n)
+	} else {
+		logrus.Warnf("Estimated memory usage %.1f MiB is still above %.0f%% of the limit. Evicted %d cache entries.",
+			float64(usage)/(1<<20), memoryLowRatio*100, n)
+	}
+}
+
+// checkFDs tells pools whether file descriptors are scarce.
+func checkFDs() {
+	open, limit, ok := openFDs()
+	if !ok {
+		return
+	}
+	openFDsGauge.Set(int64(open))
+	scarce := int32(0)
+	if float64(open) > fdScarceRatio*float64(limit) {
+		scarce = 1
+	}
+	if atomic.SwapInt32(&fdsScarce, scarce) != scarce {
+		if scarce == 1 {
+			logrus.Warnf("Open file descriptors are close to the limit (%d of %d). Stop growing connection pools.", open, limit)
+		} else {
+			logrus.Infof("Open file descriptors are back to %d of %d.", open, limit)
+		}
+	}
+}
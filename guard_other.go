@@ -0,0 +1,9 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package gochinadns
+
+// openFDs is unsupported on this platform.
+func openFDs() (open, limit int, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,49 @@
+package gochinadns
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestMemoryGuard(t *testing.T) {
+	c := NewMemoryCache(100, 0)
+	for i := 0; i < 10; i++ {
+		m := newTestReply(fmt.Sprintf("%d.example.com", i), 60, "1.1.1.1")
+		c.Set(&m.Question[0], m, time.Minute, 0)
+	}
+	recent := newTestReply("9.example.com", 60, "1.1.1.1")
+
+	s := &Server{serverOptions: newServerOptions(), cache: c}
+	s.checkMemory()
+	if c.Len() != 10 {
+		t.Fatalf("Cache should not shrink without a limit, got %d entries", c.Len())
+	}
+	s.MemoryLimit = 1
+	shrinks := memoryShrinks.Value()
+	s.checkMemory()
+	if c.Len() != 5 || memoryShrinks.Value() != shrinks+1 {
+		t.Fatalf("Cache should shrink by half beyond the limit, got %d entries", c.Len())
+	}
+	if m, _ := c.Get(&recent.Question[0]); m == nil {
+		t.Error("Recently used entries should be kept")
+	}
+
+	// The cache keeps shrinking until the usage drops below the low watermark, backing off in between.
+	for i, want := range []int{5, 3, 3, 3, 2} {
+		s.checkMemory()
+		if c.Len() != want {
+			t.Fatalf("Check %d: expect %d entries, got %d", i, want, c.Len())
+		}
+	}
+	s.MemoryLimit = 1 << 40
+	s.checkMemory()
+	if s.memGuard != (memoryGuard{}) {
+		t.Errorf("Guard should be reset below the low watermark, got %+v", s.memGuard)
+	}
+
+	if open, limit, ok := openFDs(); runtime.GOOS == "linux" && (!ok || open <= 0 || limit < open) {
+		t.Errorf("Unexpected open file descriptors %d of %d", open, limit)
+	}
+}
@@ -0,0 +1,30 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package gochinadns
+
+import (
+	"os"
+	"syscall"
+)
+
+// openFDs returns the number of open file descriptors of the process and their limit.
+func openFDs() (open, limit int, ok bool) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, 0, false
+	}
+	for _, dir := range []string{"/proc/self/fd", "/dev/fd"} {
+		f, err := os.Open(dir)
+		if err != nil {
+			continue
+		}
+		names, err := f.Readdirnames(-1)
+		_ = f.Close()
+		if err == nil {
+			// The descriptor reading the directory is left out.
+			return len(names) - 1, int(rlimit.Cur), true
+		}
+	}
+	return 0, 0, false
+}
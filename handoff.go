@@ -0,0 +1,282 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ListenFDsEnv is the environment variable handing listening sockets over to a new process on Upgrade,
+	// as file descriptors of the UDP sockets and the TCP listeners, like `3,4`, followed by those of the admin API,
+	// DoT, DoH, debug and stats listeners, which are empty if disabled, like `3,4,,5`. Sockets of multiple listening addresses
+	// are joined by `+`, like `3+5,4+6`.
+	ListenFDsEnv = "CHINADNS_LISTEN_FDS"
+	// readyFDEnv is the environment variable of the file descriptor to notify the old process through,
+	// once the new process serves.
+	readyFDEnv = "CHINADNS_READY_FD"
+	// upgradeTimeout limits waiting for the new process to serve on Upgrade, including loading lists and refining
+	// resolvers.
+	upgradeTimeout = time.Minute
+)
+
+// sockets are listening sockets of a server. DoT and DoH listeners are plain TCP listeners, which TLS is applied on.
+// DNS sockets of the primary listening address come first. A nil socket is disabled.
+type sockets struct {
+	udp   []net.PacketConn
+	tcp   []net.Listener
+	admin net.Listener
+	dot   net.Listener
+	doh   net.Listener
+	debug net.Listener
+	stats net.Listener
+}
+
+// listeners returns the optional listeners of s in the order of ListenFDsEnv, after the DNS sockets.
+func (s *sockets) listeners() []*net.Listener {
+	return []*net.Listener{&s.admin, &s.dot, &s.doh, &s.debug, &s.stats}
+}
+
+func (s sockets) close() {
+	for _, conn := range s.udp {
+		_ = conn.Close()
+	}
+	for _, ln := range s.tcp {
+		_ = ln.Close()
+	}
+	for _, ln := range s.listeners() {
+		if *ln != nil {
+			_ = (*ln).Close()
+		}
+	}
+}
+
+// listeners are listening sockets of a running server, to hand over on Upgrade.
+type listeners struct {
+	mu      sync.Mutex
+	sockets sockets
+}
+
+func (l *listeners) set(s sockets) {
+	l.mu.Lock()
+	l.sockets = s
+	l.mu.Unlock()
+}
+
+func (l *listeners) get() sockets {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sockets
+}
+
+// listenAddrs returns all listening addresses of DNS, the primary one first.
+func (o *serverOptions) listenAddrs() []string {
+	return append([]string{o.Listen}, o.ExtraListens...)
+}
+
+// listen creates the listening sockets of the server, or inherits them from the old process on Upgrade,
+// or from the init system by socket activation. Sockets are inherited only once, and created again if Run runs again.
+func (s *Server) listen() (sockets, error) {
+	if fds := os.Getenv(ListenFDsEnv); fds != "" {
+		_ = os.Unsetenv(ListenFDsEnv)
+		inherited, err := inheritListeners(fds)
+		if err == nil {
+			logrus.Info("Inherited listening sockets from the old process.")
+		}
+		return inherited, err
+	}
+
+	// Sockets not activated by the init system are created on their own. DNS sockets of a transport are created
+	// on all listening addresses, unless any of them is activated. Both transports of an address are bound together,
+	// so that they fall back to the same port (see bindDNS).
+	var (
+		a   sockets
+		err error
+	)
+	if s.SocketActivation {
+		if a, err = activatedSockets(); err != nil {
+			return sockets{}, err
+		}
+	}
+	lc := listenConfig(s.ReusePort)
+	bindUDP, bindTCP := len(a.udp) == 0, len(a.tcp) == 0
+	for _, addr := range s.listenAddrs() {
+		err = s.bindDNS(addr, func(addr string) error {
+			var conn net.PacketConn
+			if bindUDP {
+				c, err := lc.ListenPacket(context.Background(), "udp", addr)
+				if err != nil {
+					if isAddrInUse(err) {
+						return newBindError("udp", addr, err)
+					}
+					return err
+				}
+				conn = c
+				a.udp = append(a.udp, conn)
+			}
+			if bindTCP {
+				ln, err := lc.Listen(context.Background(), "tcp", addr)
+				if err != nil {
+					if conn != nil {
+						_ = conn.Close()
+						a.udp = a.udp[:len(a.udp)-1]
+					}
+					if isAddrInUse(err) {
+						return newBindError("tcp", addr, err)
+					}
+					return err
+				}
+				a.tcp = append(a.tcp, ln)
+			}
+			return nil
+		})
+		if err != nil {
+			a.close()
+			return sockets{}, err
+		}
+	}
+	for _, l := range []struct {
+		ln   *net.Listener
+		lc   *net.ListenConfig
+		addr string
+	}{
+		{&a.admin, listenConfig(false), s.AdminListen},
+		{&a.dot, lc, s.DoTListen},
+		{&a.doh, lc, s.DoHListen},
+		{&a.debug, listenConfig(false), s.DebugListen},
+		{&a.stats, listenConfig(false), s.StatsListen},
+	} {
+		if *l.ln != nil || l.addr == "" {
+			continue
+		}
+		if *l.ln, err = l.lc.Listen(context.Background(), "tcp", l.addr); err != nil {
+			a.close()
+			return sockets{}, err
+		}
+	}
+	return a, nil
+}
+
+// inheritListeners returns listening sockets of file descriptors like `3,4`, `3,4,,5` or `3+5,4+6`
+// (see ListenFDsEnv).
+func inheritListeners(fds string) (inherited sockets, err error) {
+	parts := strings.Split(fds, ",")
+	lns := inherited.listeners()
+	if len(parts) < 2 || len(parts) > 2+len(lns) {
+		return sockets{}, fmt.Errorf("invalid %s: %s", ListenFDsEnv, fds)
+	}
+	// All descriptors are checked before any is used.
+	fdsOf := make([][]int, len(parts))
+	for i, part := range parts {
+		if i >= 2 && part == "" {
+			continue
+		}
+		ps := strings.Split(part, "+")
+		if i >= 2 && len(ps) > 1 { // only DNS sockets may be multiple
+			return sockets{}, fmt.Errorf("invalid %s: %s", ListenFDsEnv, fds)
+		}
+		for _, p := range ps {
+			fd, err := strconv.Atoi(p)
+			if err != nil {
+				return sockets{}, fmt.Errorf("invalid %s: %s", ListenFDsEnv, fds)
+			}
+			fdsOf[i] = append(fdsOf[i], fd)
+		}
+	}
+	files := make([][]*os.File, len(parts))
+	for i, fds := range fdsOf {
+		for _, fd := range fds {
+			f := os.NewFile(uintptr(fd), ListenFDsEnv+"-"+strconv.Itoa(fd))
+			defer f.Close() // the sockets are duplicated by net
+			files[i] = append(files[i], f)
+		}
+	}
+	defer func() {
+		if err != nil {
+			inherited.close()
+			inherited = sockets{}
+		}
+	}()
+	for _, f := range files[0] {
+		conn, err := net.FilePacketConn(f)
+		if err != nil {
+			return inherited, fmt.Errorf("fail to inherit UDP socket: %w", err)
+		}
+		inherited.udp = append(inherited.udp, conn)
+	}
+	for _, f := range files[1] {
+		ln, err := net.FileListener(f)
+		if err != nil {
+			return inherited, fmt.Errorf("fail to inherit TCP listener: %w", err)
+		}
+		inherited.tcp = append(inherited.tcp, ln)
+	}
+	for i, fs := range files[2:] {
+		if len(fs) == 0 {
+			continue
+		}
+		if *lns[i], err = net.FileListener(fs[0]); err != nil {
+			return inherited, fmt.Errorf("fail to inherit listener %s: %w", parts[i+2], err)
+		}
+	}
+	return inherited, nil
+}
+
+// readyNotifier returns a function notifying the old process once the server serves on Upgrade,
+// or nil if the server is not started by Upgrade.
+func readyNotifier() func() {
+	v := os.Getenv(readyFDEnv)
+	if v == "" {
+		return nil
+	}
+	_ = os.Unsetenv(readyFDEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		logrus.Warnf("Invalid %s: %s", readyFDEnv, v)
+		return nil
+	}
+	f := os.NewFile(uintptr(fd), readyFDEnv)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if _, err := f.Write([]byte{1}); err != nil {
+				logrus.WithError(err).Warn("Fail to notify the old process.")
+			}
+			_ = f.Close()
+		})
+	}
+}
+
+// notifyReadyOnStart calls ready once both the UDP and the TCP servers are started.
+func (s *Server) notifyReadyOnStart(ready func()) {
+	var (
+		mu      sync.Mutex
+		pending = 2
+	)
+	started := func() {
+		mu.Lock()
+		pending--
+		done := pending == 0
+		mu.Unlock()
+		if done {
+			ready()
+		}
+	}
+	for _, srv := range []*dns.Server{s.UDPServer, s.TCPServer} {
+		notify := srv.NotifyStartedFunc
+		srv.NotifyStartedFunc = func() {
+			if notify != nil {
+				notify()
+			}
+			started()
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package gochinadns
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+// reusePortSupported tells whether sockets can share ports, see WithReusePort. Windows has no equivalent of
+// SO_REUSEPORT, as SO_REUSEADDR there lets other processes hijack the port rather than balance queries.
+const reusePortSupported = false
+
+// listenConfig returns the config to create listening sockets. SO_REUSEPORT is unsupported.
+func listenConfig(bool) *net.ListenConfig {
+	return new(net.ListenConfig)
+}
+
+// Upgrade is unsupported on this platform.
+func (s *Server) Upgrade() (*os.Process, error) {
+	return nil, errors.New("upgrade is unsupported on this platform")
+}
@@ -0,0 +1,198 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestInheritListeners(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	dot, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dot.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readyR.Close()
+
+	// The inherited descriptors are closed by the server, so they must not be owned by an *os.File, whose finalizer
+	// would close them again, maybe after they are reused by other tests.
+	// The admin API is disabled.
+	os.Setenv(ListenFDsEnv, fmt.Sprintf("%d,%d,,%d",
+		dupFD(t, udp.(*net.UDPConn)), dupFD(t, tcp.(*net.TCPListener)), dupFD(t, dot.(*net.TCPListener))))
+	os.Setenv(readyFDEnv, fmt.Sprint(dupFD(t, readyW)))
+	readyW.Close()
+	s := &Server{serverOptions: newServerOptions()}
+	got, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer got.close()
+	if len(got.udp) != 1 || got.udp[0].LocalAddr().String() != udp.LocalAddr().String() || len(got.tcp) != 1 ||
+		got.tcp[0].Addr().String() != tcp.Addr().String() || got.admin != nil || got.dot.Addr().String() != dot.Addr().String() {
+		t.Errorf("Listeners should be inherited, got %+v", got)
+	}
+	if os.Getenv(ListenFDsEnv) != "" {
+		t.Error("Listeners should be inherited only once")
+	}
+
+	// DNS sockets of multiple listening addresses.
+	got, err = inheritListeners(fmt.Sprintf("%d+%d,%d", dupFD(t, udp.(*net.UDPConn)), dupFD(t, udp.(*net.UDPConn)),
+		dupFD(t, tcp.(*net.TCPListener))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer got.close()
+	if len(got.udp) != 2 || len(got.tcp) != 1 {
+		t.Errorf("Multiple UDP sockets should be inherited, got %+v", got)
+	}
+	if _, err = inheritListeners("3,4,5+6"); err == nil {
+		t.Error("Multiple admin listeners should fail")
+	}
+
+	ready := readyNotifier()
+	if ready == nil {
+		t.Fatal("Ready notifier should be set")
+	}
+	ready()
+	if n, err := readyR.Read(make([]byte, 1)); n != 1 || err != nil {
+		t.Errorf("Old process should be notified, got %d, %v", n, err)
+	}
+}
+
+func TestListenAddrs(t *testing.T) {
+	o := newServerOptions()
+	if err := WithListenAddrs("127.0.0.1:0", "127.0.0.1:0")(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o}
+	got, err := s.listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer got.close()
+	if len(got.udp) != 2 || len(got.tcp) != 2 || got.udp[0].LocalAddr().String() == got.udp[1].LocalAddr().String() {
+		t.Errorf("DNS sockets should be created on all listening addresses, got %+v", got)
+	}
+	if err = WithListenAddrs()(o); err == nil {
+		t.Error("No listening address should fail")
+	}
+}
+
+func TestListenConfigReusePort(t *testing.T) {
+	ctx := context.Background()
+	ln, err := listenConfig(true).Listen(ctx, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	shared, err := listenConfig(true).Listen(ctx, "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Port should be shared: %v", err)
+	}
+	shared.Close()
+	if ln, err := listenConfig(false).Listen(ctx, "tcp", ln.Addr().String()); err == nil {
+		ln.Close()
+		t.Error("Port should not be shared without reusePort")
+	}
+}
+
+func TestActivate(t *testing.T) {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcp.Close()
+	admin, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	files := func(conns ...syscall.Conn) []*os.File {
+		var files []*os.File
+		for _, c := range conns {
+			files = append(files, os.NewFile(uintptr(dupFD(t, c)), "test"))
+		}
+		return files
+	}
+
+	// DNS sockets are named after the socket unit by default, and told apart by their types.
+	a, err := activate(files(admin.(*net.TCPListener), tcp.(*net.TCPListener), udp.(*net.UDPConn)),
+		[]string{ActivationAdminName, "chinadns.socket", "chinadns.socket"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+	if len(a.udp) != 1 || a.udp[0].LocalAddr().String() != udp.LocalAddr().String() || len(a.tcp) != 1 ||
+		a.tcp[0].Addr().String() != tcp.Addr().String() || a.admin.Addr().String() != admin.Addr().String() {
+		t.Errorf("Sockets should be activated, got %+v", a)
+	}
+
+	// Only the admin API is activated, and DNS sockets are created by the server.
+	a, err = activate(files(admin.(*net.TCPListener)), []string{ActivationAdminName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+	if a.udp != nil || a.tcp != nil || a.admin == nil {
+		t.Errorf("Only the admin API should be activated, got %+v", a)
+	}
+
+	// DNS sockets of multiple listening addresses.
+	a, err = activate(files(tcp.(*net.TCPListener), tcp.(*net.TCPListener)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.close()
+	if len(a.tcp) != 2 || len(a.udp) != 0 {
+		t.Errorf("Multiple TCP sockets should be activated, got %+v", a)
+	}
+
+	if _, err = activate(files(admin.(*net.TCPListener), admin.(*net.TCPListener)),
+		[]string{ActivationAdminName, ActivationAdminName}); err == nil {
+		t.Error("Duplicate admin sockets should fail")
+	}
+}
+
+// dupFD returns a duplicate of the file descriptor of f, which is owned by the caller.
+func dupFD(t *testing.T, f syscall.Conn) int {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		fd     int
+		dupErr error
+	)
+	if err = rc.Control(func(s uintptr) { fd, dupErr = syscall.Dup(int(s)) }); err == nil {
+		err = dupErr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd
+}
@@ -0,0 +1,146 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package gochinadns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// reusePortSupported tells whether sockets can share ports by reusePortOptions, see WithReusePort.
+const reusePortSupported = true
+
+// reusePortUnsupported is logged once if the kernel supports none of reusePortOptions.
+var reusePortUnsupported sync.Once
+
+// listenConfig returns the config to create listening sockets, with the first of reusePortOptions the kernel supports
+// set if reusePort. Sockets are created without them if none is supported, e.g. on Linux<3.9.
+func listenConfig(reusePort bool) *net.ListenConfig {
+	lc := new(net.ListenConfig)
+	if reusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var opErr error
+			if err := c.Control(func(fd uintptr) {
+				for _, opt := range reusePortOptions {
+					opErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, opt, 1)
+					if opErr != unix.ENOPROTOOPT && opErr != unix.EINVAL {
+						return
+					}
+				}
+				reusePortUnsupported.Do(func() {
+					logrus.WithError(opErr).Warn("SO_REUSEPORT is unsupported by the kernel. Listen without it.")
+				})
+				opErr = nil
+			}); err != nil {
+				return err
+			}
+			return opErr
+		}
+	}
+	return lc
+}
+
+// Upgrade starts a new process of the current executable with the same arguments and environment,
+// hands the listening sockets over to it (see ListenFDsEnv), and waits until it serves.
+// The caller should stop the server then, e.g. by canceling Run, so that queries being served are drained.
+// Both processes serve the same sockets during the switchover, so no query is dropped.
+// The new process is killed, and the server keeps serving, if it fails to serve within upgradeTimeout.
+func (s *Server) Upgrade() (*os.Process, error) {
+	socks := s.listeners.get()
+	if len(socks.udp) == 0 || len(socks.tcp) == 0 {
+		return nil, errors.New("server is not running")
+	}
+	// Extra files are numbered from 3 in the new process.
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	handOver := func(c interface{}, name string) (string, error) {
+		f, err := c.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			return "", fmt.Errorf("fail to hand over %s: %w", name, err)
+		}
+		files = append(files, f)
+		return strconv.Itoa(2 + len(files)), nil
+	}
+	var udpFDs, tcpFDs []string
+	for _, conn := range socks.udp {
+		fd, err := handOver(conn, "UDP socket "+conn.LocalAddr().String())
+		if err != nil {
+			return nil, err
+		}
+		udpFDs = append(udpFDs, fd)
+	}
+	for _, ln := range socks.tcp {
+		fd, err := handOver(ln, "listener "+ln.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		tcpFDs = append(tcpFDs, fd)
+	}
+	fds := []string{strings.Join(udpFDs, "+"), strings.Join(tcpFDs, "+")}
+	for _, ln := range socks.listeners() {
+		if *ln == nil {
+			fds = append(fds, "")
+			continue
+		}
+		fd, err := handOver(*ln, "listener "+(*ln).Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, fd)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyR.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		_ = readyW.Close()
+		return nil, err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), ListenFDsEnv+"="+strings.TrimRight(strings.Join(fds, ","), ","),
+		readyFDEnv+"="+strconv.Itoa(3+len(files)))
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err = cmd.Start()
+	_ = readyW.Close()
+	if err != nil {
+		return nil, fmt.Errorf("fail to start new process: %w", err)
+	}
+	go func() { _ = cmd.Wait() }()
+
+	// The read fails if the new process exits before serving, since the write end is closed here.
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = errors.New("timeout")
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		return nil, fmt.Errorf("new process fails to serve: %w", err)
+	}
+	return cmd.Process, nil
+}
@@ -0,0 +1,69 @@
+package gochinadns
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// WithHealthCheck checks health of each upstream every interval by querying a test domain (see WithTestDomains),
+// in addition to statistics of real queries, which are used to order upstreams (see WithSelection).
+// Upstreams failing consecutively are skipped until they recover, unless all of them are failing.
+// Health checks are disabled if interval is 0, and failing upstreams are never skipped then.
+func WithHealthCheck(interval time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		o.HealthCheckInterval = interval
+		return nil
+	}
+}
+
+// runHealthChecks checks health of upstreams every HealthCheckInterval, until ctx is done.
+func (s *Server) runHealthChecks(ctx context.Context) {
+	if s.HealthCheckInterval <= 0 || len(s.TestDomains) == 0 {
+		return
+	}
+	ticker := s.Clock.NewTicker(s.HealthCheckInterval)
+	defer ticker.Stop()
+	for round := 0; ; round++ {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		s.checkHealth(s.TestDomains[round%len(s.TestDomains)])
+		trusted, untrusted := s.resolvers()
+		s.degraded.update(s.Clock.Now(), s.upstreams, trusted, untrusted)
+	}
+}
+
+// checkHealth queries name in all upstreams concurrently, including drained ones, and records the results.
+// Upstreams which exhausted their budgets are not checked.
+func (s *Server) checkHealth(name string) {
+	trusted, untrusted := s.resolvers()
+	var wg sync.WaitGroup
+	check := func(r *Resolver, lookup LookupFunc) {
+		defer wg.Done()
+		if s.budgets.Exhausted(r) {
+			return
+		}
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(name), dns.TypeA)
+		_, rtt, err := lookup(context.Background(), req, r)
+		s.upstreams.Record(&UpstreamReplyEvent{Question: req.Question[0], Upstream: r, RTT: rtt, Err: err})
+		if err != nil {
+			logrus.WithField("server", r).WithError(err).Debug("Health check failed.")
+		}
+	}
+	for _, r := range trusted {
+		wg.Add(1)
+		go check(r, s.lookupTrusted)
+	}
+	for _, r := range untrusted {
+		wg.Add(1)
+		go check(r, s.lookupUntrusted)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,38 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckHealth(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := ParseResolver(pc.LocalAddr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = pc.Close()
+	alive := startAnswerUpstream(t, "142.250.1.1")
+
+	o := newServerOptions()
+	o.HealthCheckInterval = time.Minute
+	o.TrustedServers = resolverList{dead, alive}
+	s := &Server{serverOptions: o, Client: NewClient(WithTimeout(200 * time.Millisecond)), upstreams: newUpstreamTable()}
+
+	for i := 0; i < unhealthyErrors; i++ {
+		s.checkHealth("www.google.com")
+	}
+	if st := s.upstreams.get(alive); st.Queries != unhealthyErrors || st.Errors != 0 || st.AvgRTT == 0 {
+		t.Errorf("Unexpected status of the alive upstream %+v", st)
+	}
+	if st := s.upstreams.get(dead); st.ConsecutiveErrors != unhealthyErrors || st.FailureRate == 0 {
+		t.Errorf("Unexpected status of the dead upstream %+v", st)
+	}
+	if trusted, _ := s.selectedResolvers(nil); len(trusted) != 1 || trusted[0] != alive {
+		t.Errorf("Dead upstream should be skipped, got %s", trusted)
+	}
+}
@@ -0,0 +1,28 @@
+package gochinadns
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// fakeResponseWriter records the message written by a handler.
+type fakeResponseWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func newFakeResponseWriter(remote string) *fakeResponseWriter {
+	return &fakeResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP(remote), Port: 5353}}
+}
+
+func (w *fakeResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv6loopback, Port: 53}
+}
+func (w *fakeResponseWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *fakeResponseWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *fakeResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *fakeResponseWriter) Close() error                { return nil }
+func (w *fakeResponseWriter) TsigStatus() error           { return nil }
+func (w *fakeResponseWriter) TsigTimersOnly(bool)         {}
+func (w *fakeResponseWriter) Hijack()                     {}
@@ -0,0 +1,115 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// QueryEvent is emitted when a query arrives.
+type QueryEvent struct {
+	Question  dns.Question
+	Client    net.IP
+	Transport string // "udp" or "tcp"
+}
+
+// UpstreamReplyEvent is emitted when an upstream replies or fails.
+type UpstreamReplyEvent struct {
+	Question dns.Question
+	Upstream *Resolver
+	Reply    *dns.Msg // may be nil if Err is not nil
+	RTT      time.Duration
+	Err      error
+}
+
+// AnswerEvent is emitted when an answer is selected and about to be written to the client.
+type AnswerEvent struct {
+	Question  dns.Question
+	Client    net.IP
+	Answer    *dns.Msg
+	Upstream  *Resolver // nil if the answer is not from an upstream
+	Verdict   string    // see VerdictXXX, empty if answered from cache
+	Cached    bool
+	Latency   time.Duration // time elapsed since the query arrived
+	Transport string        // "udp" or "tcp"
+}
+
+// BlockedEvent is emitted when a query is blocked by domain blacklist or scheduled blocking rules.
+type BlockedEvent struct {
+	Question  dns.Question
+	Client    net.IP
+	Transport string // "udp" or "tcp"
+}
+
+// hooks holds callbacks registered on a server.
+type hooks struct {
+	query         []func(*QueryEvent)
+	upstreamReply []func(*UpstreamReplyEvent)
+	answer        []func(*AnswerEvent)
+	blocked       []func(*BlockedEvent)
+}
+
+// OnQuery registers f to be called when a query arrives.
+// Hooks are called synchronously in the serving goroutine, so they should return quickly.
+// Hooks must be registered before the server runs.
+func (s *Server) OnQuery(f func(*QueryEvent)) {
+	s.hooks.query = append(s.hooks.query, f)
+}
+
+// OnUpstreamReply registers f to be called when an upstream replies or fails.
+// Lookups given up since another upstream replied first are neither.
+func (s *Server) OnUpstreamReply(f func(*UpstreamReplyEvent)) {
+	s.hooks.upstreamReply = append(s.hooks.upstreamReply, f)
+}
+
+// OnAnswerSelected registers f to be called when an answer is selected for a query.
+func (s *Server) OnAnswerSelected(f func(*AnswerEvent)) {
+	s.hooks.answer = append(s.hooks.answer, f)
+}
+
+// OnBlocked registers f to be called when a query is blocked.
+func (s *Server) OnBlocked(f func(*BlockedEvent)) {
+	s.hooks.blocked = append(s.hooks.blocked, f)
+}
+
+func (h *hooks) emitQuery(e *QueryEvent) {
+	for _, f := range h.query {
+		f(e)
+	}
+}
+
+func (h *hooks) emitUpstreamReply(e *UpstreamReplyEvent) {
+	for _, f := range h.upstreamReply {
+		f(e)
+	}
+}
+
+func (h *hooks) emitAnswer(e *AnswerEvent) {
+	for _, f := range h.answer {
+		f(e)
+	}
+}
+
+func (h *hooks) emitBlocked(e *BlockedEvent) {
+	for _, f := range h.blocked {
+		f(e)
+	}
+}
+
+// hookLookup wraps lookup to emit upstream reply events, except for lookups canceled.
+func (h *hooks) hookLookup(lookup LookupFunc) LookupFunc {
+	if len(h.upstreamReply) == 0 {
+		return lookup
+	}
+	return func(ctx context.Context, req *dns.Msg, server *Resolver) (*dns.Msg, time.Duration, error) {
+		reply, rtt, err := lookup(ctx, req, server)
+		if errors.Is(err, context.Canceled) {
+			return reply, rtt, err
+		}
+		h.emitUpstreamReply(&UpstreamReplyEvent{Question: req.Question[0], Upstream: server, Reply: reply, RTT: rtt, Err: err})
+		return reply, rtt, err
+	}
+}
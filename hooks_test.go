@@ -0,0 +1,39 @@
+package gochinadns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHooks(t *testing.T) {
+	o := newServerOptions()
+	o.DomainBlacklist = new(domainList)
+	_ = o.DomainBlacklist.add("blocked.com")
+	s := &Server{serverOptions: o, cache: NewMemoryCache(10, 0), provenance: newProvenanceLog(8)}
+	cached := newTestReply("cached.com", 60, "1.1.1.1")
+	s.cache.Set(&cached.Question[0], cached, time.Minute, 0)
+
+	var queries, blocked []string
+	var answers []*AnswerEvent
+	s.OnQuery(func(e *QueryEvent) { queries = append(queries, e.Question.Name) })
+	s.OnBlocked(func(e *BlockedEvent) { blocked = append(blocked, e.Question.Name) })
+	s.OnAnswerSelected(func(e *AnswerEvent) { answers = append(answers, e) })
+
+	for _, name := range []string{"blocked.com.", "cached.com."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		s.Serve(newFakeResponseWriter("192.168.1.2"), req)
+	}
+
+	if len(queries) != 2 {
+		t.Errorf("Expect 2 query events, got %v", queries)
+	}
+	if len(blocked) != 1 || blocked[0] != "blocked.com." {
+		t.Errorf("Expect blocked event of blocked.com., got %v", blocked)
+	}
+	if len(answers) != 1 || !answers[0].Cached || answers[0].Client.String() != "192.168.1.2" {
+		t.Errorf("Expect a cached answer event, got %+v", answers)
+	}
+}
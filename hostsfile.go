@@ -0,0 +1,162 @@
+package gochinadns
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// hostsTTL is the TTL of answers from hosts files.
+const hostsTTL = 60
+
+// hostsTable contains static records loaded from hosts files.
+type hostsTable struct {
+	names     map[string][]net.IP // IPs of exact names
+	wildcards map[string][]net.IP // IPs of subdomains of names, declared as *.name
+	ptr       map[string][]string // names of reverse names (in-addr.arpa and ip6.arpa)
+}
+
+func newHostsTable() *hostsTable {
+	return &hostsTable{
+		names:     make(map[string][]net.IP),
+		wildcards: make(map[string][]net.IP),
+		ptr:       make(map[string][]string),
+	}
+}
+
+// Add adds names of ip. A name of *.domain matches all subdomains of domain.
+func (t *hostsTable) Add(ip net.IP, names ...string) {
+	for _, name := range names {
+		name = strings.ToLower(dns.Fqdn(name))
+		if strings.HasPrefix(name, "*.") {
+			name = name[2:]
+			t.wildcards[name] = append(t.wildcards[name], ip)
+			continue
+		}
+		t.names[name] = append(t.names[name], ip)
+		if rev, err := dns.ReverseAddr(ip.String()); err == nil {
+			t.ptr[rev] = append(t.ptr[rev], name)
+		}
+	}
+}
+
+// Lookup returns IPs of name, and whether name is found.
+// Exact names take precedence over wildcards, and longer wildcards take precedence over shorter ones.
+func (t *hostsTable) Lookup(name string) ([]net.IP, bool) {
+	name = strings.ToLower(dns.Fqdn(name))
+	if ips, ok := t.names[name]; ok {
+		return ips, true
+	}
+	for {
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return nil, false
+		}
+		name = name[i+1:]
+		if ips, ok := t.wildcards[name]; ok {
+			return ips, true
+		}
+	}
+}
+
+// Answer answers A, AAAA and PTR questions of req found in the table, or returns nil if not found.
+// A name found with no address of the questioned family is answered with no records (NODATA).
+func (t *hostsTable) Answer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: hostsTTL}
+	var answer []dns.RR
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		ips, ok := t.Lookup(q.Name)
+		if !ok {
+			return nil
+		}
+		for _, ip := range ips {
+			if ip4 := ip.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+				answer = append(answer, &dns.A{Hdr: hdr, A: ip4})
+			} else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+				answer = append(answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+	case dns.TypePTR:
+		names, ok := t.ptr[strings.ToLower(q.Name)]
+		if !ok {
+			return nil
+		}
+		for _, name := range names {
+			answer = append(answer, &dns.PTR{Hdr: hdr, Ptr: name})
+		}
+	default:
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	m.Answer = answer
+	return m
+}
+
+// WithHosts loads static records from a hosts file in /etc/hosts format:
+//
+//	192.168.1.10 nas.lan nas.home.arpa
+//	192.168.1.20 *.k8s.lan
+//
+// A name of *.domain matches all subdomains of domain. Matching A, AAAA and PTR queries are answered locally.
+func WithHosts(path string) ServerOption {
+	return func(o *serverOptions) error {
+		if path == "" {
+			return fmt.Errorf("%w for hosts file", ErrEmptyPath)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return o.ListErrors.add(fmt.Errorf("fail to open hosts file: %w", err))
+		}
+		defer file.Close()
+
+		if o.Hosts == nil {
+			o.Hosts = newHostsTable()
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			ip := net.ParseIP(fields[0])
+			if ip == nil || len(fields) < 2 {
+				if err := o.ListErrors.add(fmt.Errorf("invalid hosts entry [%s]", line)); err != nil {
+					return err
+				}
+				continue
+			}
+			o.Hosts.Add(ip, fields[1:]...)
+		}
+		if err := scanner.Err(); err != nil {
+			return o.ListErrors.add(fmt.Errorf("fail to scan hosts file: %v", err.Error()))
+		}
+		return nil
+	}
+}
+
+// answerHosts answers req from hosts files, or returns nil if not found.
+func (s *Server) answerHosts(req *dns.Msg) *dns.Msg {
+	s.listsMu.RLock()
+	defer s.listsMu.RUnlock()
+	if s.Hosts == nil {
+		return nil
+	}
+	return s.Hosts.Answer(req)
+}
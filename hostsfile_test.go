@@ -0,0 +1,79 @@
+package gochinadns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestWithHosts(t *testing.T) {
+	path := writeTestList(t, "hosts", `# home lab
+192.168.1.10 nas.lan NAS.home.arpa # storage
+fd00::10     nas.lan
+192.168.1.20 *.k8s.lan
+192.168.1.30 api.k8s.lan
+`)
+	o := newServerOptions()
+	if err := WithHosts(path)(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o}
+
+	tests := []struct {
+		name  string
+		qtype uint16
+		want  []string // nil if not answered locally
+	}{
+		{"nas.lan.", dns.TypeA, []string{"192.168.1.10"}},
+		{"nas.home.arpa.", dns.TypeA, []string{"192.168.1.10"}},
+		{"nas.lan.", dns.TypeAAAA, []string{"fd00::10"}},
+		{"web.k8s.lan.", dns.TypeAAAA, []string{}},
+		{"a.web.k8s.lan.", dns.TypeA, []string{"192.168.1.20"}},
+		{"api.k8s.lan.", dns.TypeA, []string{"192.168.1.30"}},
+		{"k8s.lan.", dns.TypeA, nil},
+		{"nas.lan.", dns.TypeMX, nil},
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, []string{"nas.lan.", "nas.home.arpa."}},
+		{"20.1.168.192.in-addr.arpa.", dns.TypePTR, nil},
+	}
+	for _, tt := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, tt.qtype)
+		m := s.answerHosts(req)
+		if tt.want == nil {
+			if m != nil {
+				t.Errorf("%s %s should not be answered locally, got %v", tt.name, dns.TypeToString[tt.qtype], m.Answer)
+			}
+			continue
+		}
+		if m == nil {
+			t.Errorf("%s %s should be answered locally", tt.name, dns.TypeToString[tt.qtype])
+			continue
+		}
+		var got []string
+		for _, rr := range m.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				got = append(got, rr.A.String())
+			case *dns.AAAA:
+				got = append(got, rr.AAAA.String())
+			case *dns.PTR:
+				got = append(got, rr.Ptr)
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s %s = %v, want %v", tt.name, dns.TypeToString[tt.qtype], got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s %s = %v, want %v", tt.name, dns.TypeToString[tt.qtype], got, tt.want)
+				break
+			}
+		}
+	}
+
+	bad := writeTestList(t, "bad", "nas.lan 192.168.1.10\n")
+	if err := applyListOption(WithHosts(bad)); err == nil {
+		t.Error("Invalid hosts entry should fail")
+	}
+}
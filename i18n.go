@@ -0,0 +1,153 @@
+package gochinadns
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Languages of user-facing messages, like errors of the admin API.
+const (
+	LangEnglish = "en"
+	LangChinese = "zh-CN" // Simplified Chinese
+)
+
+// catalogs maps user-facing messages in English to their translations by language. Messages are formats of
+// fmt.Sprintf if they take arguments. Messages absent in a catalog are left in English.
+var catalogs = map[string]map[string]string{
+	LangChinese: {
+		// Errors of the admin API.
+		"method not allowed":                         "不支持该请求方法",
+		"invalid top":                                "top 参数无效",
+		"stats are disabled":                         "统计未启用",
+		"invalid query id":                           "查询 ID 无效",
+		"query not found":                            "查询不存在",
+		"invalid client":                             "客户端无效",
+		"invalid rtt":                                "rtt 参数无效",
+		"invalid loss":                               "loss 参数无效",
+		"invalid ttl":                                "ttl 参数无效",
+		"resolver not found":                         "上游服务器不存在",
+		"cache backend can't be inspected":           "缓存后端不支持查看",
+		"invalid cidr":                               "CIDR 无效",
+		"cache backend can't be flushed":             "缓存后端不支持清空",
+		"cache backend can't be flushed selectively": "缓存后端不支持按条件清空",
+		"invalid ip":                                 "IP 无效",
+
+		// Usage of subcommands.
+		"Usage: chinadns [options] classify IP...": "用法：chinadns [选项] classify IP...",
+		"Usage: chinadns [options] check-config\n" +
+			"Options and lists are checked without starting the server.": "用法：chinadns [选项] check-config\n" +
+			"检查选项和列表，但不启动服务。",
+		"Configuration is valid: %d trusted and %d untrusted servers": "配置有效：%d 个可信服务器，%d 个不可信服务器",
+		"Usage: chinadns [options] diff -servers A,B [-qtype TYPE] DOMAIN...\n" +
+			"A and B are in the same format as -s, or local for the running server.": "用法：chinadns [选项] diff -servers A,B [-qtype 类型] 域名...\n" +
+			"A 和 B 的格式与 -s 相同，local 表示正在运行的服务。",
+		"Unknown query type %s": "未知的查询类型 %s",
+		"Invalid server %s: %v": "服务器 %s 无效：%v",
+		"Usage: chinadns [options] stats [TOP]\n" +
+			"Stats are fetched from the running server by -admin-listen, and kept for -stats-period.": "用法：chinadns [选项] stats [TOP]\n" +
+			"统计数据通过 -admin-listen 从正在运行的服务获取，保留 -stats-period 时长。",
+		"The stats subcommand needs -admin-listen of the running server.": "stats 子命令需要正在运行的服务的 -admin-listen。",
+		"Usage: chinadns -redact-key-file FILE decrypt-name TOKEN...":     "用法：chinadns -redact-key-file 文件 decrypt-name 令牌...",
+		"Usage: chinadns [options] doctor\n" +
+			"Checks are done by the same options the server runs with.": "用法：chinadns [选项] doctor\n" +
+			"使用与服务运行时相同的选项进行检查。",
+		"Usage: chinadns [options] service install|uninstall|start|stop\n" +
+			"The service runs with the options of install.": "用法：chinadns [选项] service install|uninstall|start|stop\n" +
+			"服务以 install 时的选项运行。",
+		"Unknown service action %s": "未知的服务操作 %s",
+		"The service subcommand is only supported on Windows. Run chinadns by the init system, like systemd, procd or launchd.": "service 子命令仅支持 Windows，其他平台请通过 systemd、procd 或 launchd 等 init 系统运行 chinadns。",
+		"Usage: chinadns [options] bench [-bench-count N] [DOMAIN...]\n" +
+			"Upstreams are those of -s and -trusted-servers, and domains are -test-domains if not given.": "用法：chinadns [选项] bench [-bench-count 次数] [域名...]\n" +
+			"测试 -s 和 -trusted-servers 中的上游，未指定域名时使用 -test-domains。",
+		"Usage: chinadns [options] bench-self [-bench-baseline FILE] [BENCHMARK...]\n" +
+			"Benchmarks are %s.": "用法：chinadns [选项] bench-self [-bench-baseline 文件] [基准测试...]\n" +
+			"可用的基准测试：%s。",
+
+		// Reports of the stats subcommand.
+		"Queries since %s: %d (%.1f%% cached, %.1f%% blocked)": "自 %s 起的查询：%d（缓存命中 %.1f%%，拦截 %.1f%%）",
+		"Top domains":         "热门域名",
+		"Top blocked domains": "热门拦截域名",
+		"Top clients":         "活跃客户端",
+		"Answers by upstream": "各上游应答数",
+		"Answers by country":  "各国家或地区应答数",
+
+		// Reports of the bench subcommand.
+		"%s (%s): answered %d/%d, rtt %s/%s/%s, china %d/%d, poisoned %d/%d, role %s": "%s（%s）：应答 %d/%d，延迟 %s/%s/%s，国内 IP %d/%d，污染 %d/%d，建议角色 %s",
+
+		// Reports of the bench-self subcommand.
+		"%s: %d ns/op, %d B/op, %d allocs/op (%d runs)": "%s：%d ns/次，%d B/次，%d 次分配/次（运行 %d 次）",
+
+		// Checks and advice of the doctor subcommand.
+		"Advice:":                                 "建议：",
+		"%s %s is available":                      "%s %s 可用",
+		"%s %s is served by %s":                   "%s %s 已由 %s 提供服务",
+		"%s %s is in use":                         "%s %s 已被占用",
+		"%s %s is in use by %s":                   "%s %s 已被 %s 占用",
+		"%s %s needs privileges":                  "%s %s 需要特权",
+		"no other DNS daemon is running":          "没有其他 DNS 服务在运行",
+		"%s running":                              "%s 正在运行",
+		"%s; nameservers of /etc/resolv.conf: %s": "%s；/etc/resolv.conf 中的 nameserver：%s",
+		"no China route list":                     "没有中国路由表",
+		"%s was updated %d days ago":              "%s 于 %d 天前更新",
+		"%s was updated %s ago":                   "%s 于 %s 前更新",
+		"%s answered %s in %s":                    "%s 在 %[3]s 内应答了 %[2]s",
+		"no trusted server":                       "没有可信服务器",
+		"%s answered %s without poisoned IPs":     "%s 应答 %s 时没有污染 IP",
+		"%s answered %s with poisoned IP %s":      "%s 应答 %s 时返回了污染 IP %s",
+		"Free %s or listen on another port by -p or -fallback-port.":                                                                  "释放 %s，或通过 -p 或 -fallback-port 监听其他端口。",
+		"Set DNSStubListener=no in /etc/systemd/resolved.conf and restart systemd-resolved, or listen on another port by -p.":         "在 /etc/systemd/resolved.conf 中设置 DNSStubListener=no 并重启 systemd-resolved，或通过 -p 监听其他端口。",
+		"Listen on another port by -p (e.g. 5353), and forward dnsmasq to it by server=127.0.0.1#5353 and no-resolv in dnsmasq.conf.": "通过 -p 监听其他端口（如 5353），并在 dnsmasq.conf 中设置 server=127.0.0.1#5353 和 no-resolv 将 dnsmasq 转发到该端口。",
+		"Run as root, or grant the binary the capability by `setcap cap_net_bind_service=+ep chinadns`.":                              "以 root 运行，或通过 `setcap cap_net_bind_service=+ep chinadns` 授予程序相应权限。",
+		"Check the addresses of -b and -p.": "检查 -b 和 -p 的地址。",
+		"Make sure other DNS daemons neither listen on the addresses of chinadns, nor answer clients without forwarding to chinadns.":        "确保其他 DNS 服务既不监听 chinadns 的地址，也不绕过 chinadns 直接应答客户端。",
+		"Fix the configuration, so that the server can start.":                                                                               "修正配置，使服务能够启动。",
+		"Set a China route list by -c, -chnlist-url or -geoip, or all answers are located overseas.":                                         "通过 -c、-chnlist-url 或 -geoip 设置中国路由表，否则所有应答都会被视为海外地址。",
+		"Download the list to %s, or fix its path.":                                                                                          "将列表下载到 %s，或修正其路径。",
+		"Update %s. China route lists can be downloaded and refreshed by -chnlist-url.":                                                      "更新 %s。中国路由表可通过 -chnlist-url 自动下载和刷新。",
+		"Check the network and firewall to %s, or remove %s from upstreams.":                                                                 "检查到 %s 的网络和防火墙，或从上游中移除 %s。",
+		"Check the network and firewall to %s, or query it by %s@%[1]s only if that works.":                                                  "检查到 %s 的网络和防火墙，或在可用时仅通过 %s@%[1]s 查询。",
+		"Add servers outside China by -s or -trusted-servers, or all answers of untrusted servers are accepted.":                             "通过 -s 或 -trusted-servers 添加境外服务器，否则不可信服务器的所有应答都会被接受。",
+		"Check whether %s is reachable.":                                                                                                     "检查 %s 是否可达。",
+		"Query %s over an encrypted transport (tls:// or https://), or through a tunnel by -trusted-proxy, since it's poisoned on the path.": "%s 在传输路径上被污染，请通过加密传输（tls:// 或 https://）或 -trusted-proxy 隧道查询。",
+	},
+}
+
+// ParseLanguage returns the language of a tag like en, zh, zh-CN or zh_CN.UTF-8 (as in $LANG), which is LangEnglish if
+// the tag is empty. Only English and Simplified Chinese are supported.
+func ParseLanguage(tag string) (string, error) {
+	t := strings.ToLower(strings.Replace(tag, "_", "-", -1))
+	if i := strings.IndexAny(t, ".@"); i >= 0 {
+		t = t[:i]
+	}
+	switch {
+	case t == "", t == "c", t == "posix", t == "en", strings.HasPrefix(t, "en-"):
+		return LangEnglish, nil
+	case t == "zh", t == "zh-cn", t == "zh-sg", strings.HasPrefix(t, "zh-hans"):
+		return LangChinese, nil
+	}
+	return "", fmt.Errorf("unsupported language [%s], expect en or zh-CN", tag)
+}
+
+// Localize returns message in lang, formatted with args if any. message is in English, and left so if it's not in
+// the catalog of lang.
+func Localize(lang, message string, args ...interface{}) string {
+	if m, ok := catalogs[lang][message]; ok {
+		message = m
+	}
+	if len(args) == 0 {
+		return message
+	}
+	return fmt.Sprintf(message, args...)
+}
+
+// WithLanguage sets the language of user-facing messages, like errors of the admin API, see ParseLanguage.
+func WithLanguage(lang string) ServerOption {
+	return func(o *serverOptions) error {
+		l, err := ParseLanguage(lang)
+		if err != nil {
+			return err
+		}
+		o.Language = l
+		return nil
+	}
+}
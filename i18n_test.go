@@ -0,0 +1,93 @@
+package gochinadns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"testing"
+)
+
+func TestParseLanguage(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want string
+	}{
+		{"", LangEnglish},
+		{"en_US.UTF-8", LangEnglish},
+		{"C", LangEnglish},
+		{"zh", LangChinese},
+		{"zh_CN.UTF-8", LangChinese},
+		{"zh-Hans-CN", LangChinese},
+		{"zh-TW", ""},
+		{"fr", ""},
+	}
+	for _, tt := range tests {
+		got, err := ParseLanguage(tt.tag)
+		if got != tt.want || (err != nil) != (tt.want == "") {
+			t.Errorf("ParseLanguage(%q) = %q, %v, want %q", tt.tag, got, err, tt.want)
+		}
+	}
+}
+
+func TestLocalize(t *testing.T) {
+	if got := Localize(LangChinese, "%s was updated %d days ago", "./china.list", 120); got != "./china.list 于 120 天前更新" {
+		t.Errorf("Unexpected message %q", got)
+	}
+	if got := Localize(LangChinese, "%s answered %s in %s", "udp@8.8.8.8:53", "www.qq.com", "12ms"); got != "udp@8.8.8.8:53 在 12ms 内应答了 www.qq.com" {
+		t.Errorf("Unexpected reordered message %q", got)
+	}
+	if got := Localize(LangEnglish, "invalid ip"); got != "invalid ip" {
+		t.Errorf("English messages should be kept, got %q", got)
+	}
+	if got := Localize(LangChinese, "unknown 100%"); got != "unknown 100%" {
+		t.Errorf("Messages without args should not be formatted, got %q", got)
+	}
+
+	// Translations must take the same args as their messages.
+	verbs := regexp.MustCompile(`%(\[\d+\])?[-+# 0-9.]*[a-zA-Z%]`)
+	kinds := func(s string) []string {
+		var k []string
+		for _, v := range verbs.FindAllString(s, -1) {
+			k = append(k, v[len(v)-1:])
+		}
+		sort.Strings(k)
+		return k
+	}
+	for lang, catalog := range catalogs {
+		for message, translation := range catalog {
+			if a, b := kinds(message), kinds(translation); len(a) != len(b) {
+				t.Errorf("%s: verbs of %q differ from %q", lang, translation, message)
+			} else {
+				for i := range a {
+					if a[i] != b[i] {
+						t.Errorf("%s: verbs of %q differ from %q", lang, translation, message)
+						break
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestAdminErrorLanguage(t *testing.T) {
+	o := newServerOptions()
+	if err := WithLanguage("zh_CN.UTF-8")(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o}
+	w := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/status", nil))
+	var e adminError
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusMethodNotAllowed || e.Error != "method not allowed" || e.Message != "不支持该请求方法" {
+		t.Errorf("Unexpected error response %d %s", w.Code, w.Body)
+	}
+
+	if err := WithLanguage("fr")(o); err == nil {
+		t.Error("Unsupported language should fail")
+	}
+}
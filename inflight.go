@@ -0,0 +1,150 @@
+package gochinadns
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// States of an in-flight query.
+const (
+	QueryStateQuerying         = "querying"
+	QueryStateWaitingTrusted   = "waiting trusted"
+	QueryStateWaitingUntrusted = "waiting untrusted"
+	QueryStateReplying         = "replying"
+)
+
+// InFlightQuery describes a query which is being served.
+type InFlightQuery struct {
+	ID       uint64        `json:"id"`
+	Trace    string        `json:"trace"` // trace ID in logs of the query
+	Question string        `json:"question"`
+	Client   string        `json:"client"`
+	Start    time.Time     `json:"start"`
+	Age      time.Duration `json:"age"`
+	State    string        `json:"state"`
+}
+
+type inflightEntry struct {
+	mu     sync.Mutex
+	query  InFlightQuery
+	cancel context.CancelFunc
+}
+
+func (e *inflightEntry) SetState(state string) {
+	if e == nil {
+		return
+	}
+	e.mu.Lock()
+	e.query.State = state
+	e.mu.Unlock()
+}
+
+func (e *inflightEntry) snapshot(now time.Time) InFlightQuery {
+	e.mu.Lock()
+	q := e.query
+	e.mu.Unlock()
+	q.Age = now.Sub(q.Start)
+	return q
+}
+
+// inflightTable tracks queries being served so that stuck ones can be inspected and canceled.
+type inflightTable struct {
+	mu      sync.Mutex
+	seq     uint64
+	queries map[uint64]*inflightEntry
+}
+
+func newInflightTable() *inflightTable {
+	return &inflightTable{queries: make(map[uint64]*inflightEntry)}
+}
+
+func (t *inflightTable) Add(question, client, trace string, cancel context.CancelFunc) *inflightEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.seq++
+	e := &inflightEntry{
+		query: InFlightQuery{
+			ID:       t.seq,
+			Trace:    trace,
+			Question: question,
+			Client:   client,
+			Start:    time.Now(),
+			State:    QueryStateQuerying,
+		},
+		cancel: cancel,
+	}
+	t.queries[e.query.ID] = e
+	return e
+}
+
+func (t *inflightTable) Remove(e *inflightEntry) {
+	t.mu.Lock()
+	delete(t.queries, e.query.ID)
+	t.mu.Unlock()
+}
+
+func (t *inflightTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.queries)
+}
+
+// List returns in-flight queries, the oldest first.
+func (t *inflightTable) List() []InFlightQuery {
+	now := time.Now()
+	t.mu.Lock()
+	list := make([]InFlightQuery, 0, len(t.queries))
+	for _, e := range t.queries {
+		list = append(list, e.snapshot(now))
+	}
+	t.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].ID < list[j].ID
+	})
+	return list
+}
+
+// Cancel cancels the query of the given ID. It reports whether the query was found.
+func (t *inflightTable) Cancel(id uint64) bool {
+	t.mu.Lock()
+	e := t.queries[id]
+	t.mu.Unlock()
+	if e == nil {
+		return false
+	}
+	e.cancel()
+	return true
+}
+
+type inflightKey struct{}
+
+func withInflightEntry(ctx context.Context, e *inflightEntry) context.Context {
+	return context.WithValue(ctx, inflightKey{}, e)
+}
+
+// queryState is the state of an in-flight query, or of queries sharing a resolution.
+type queryState interface {
+	SetState(state string)
+}
+
+// inflightFromContext returns the state of the query of ctx, which is a no-op if the query isn't tracked.
+func inflightFromContext(ctx context.Context) queryState {
+	if q, ok := ctx.Value(inflightKey{}).(queryState); ok {
+		return q
+	}
+	return (*inflightEntry)(nil)
+}
+
+// InFlight returns queries being served, the oldest first.
+func (s *Server) InFlight() []InFlightQuery {
+	return s.inflight.List()
+}
+
+// CancelQuery cancels an in-flight query by its ID, which is answered by the failure policy (see WithFailurePolicy)
+// without retries, with SERVFAIL unless a stale answer is served. It reports whether the query was found.
+func (s *Server) CancelQuery(id uint64) bool {
+	return s.inflight.Cancel(id)
+}
@@ -0,0 +1,119 @@
+package gochinadns
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestInflightTable(t *testing.T) {
+	table := newInflightTable()
+	var canceled []int
+	var entries []*inflightEntry
+	for i, question := range []string{"a.example.com. A", "b.example.com. AAAA", "c.example.com. A"} {
+		i := i
+		entries = append(entries, table.Add(question, "192.168.1.20:5353", "trace", func() { canceled = append(canceled, i) }))
+	}
+	entries[1].SetState(QueryStateWaitingTrusted)
+
+	list := table.List()
+	if len(list) != 3 || table.Len() != 3 {
+		t.Fatalf("Unexpected queries %+v", list)
+	}
+	for i, q := range list {
+		if i > 0 && q.ID <= list[i-1].ID {
+			t.Errorf("Queries should be listed the oldest first, got %+v", list)
+		}
+	}
+	if list[0].Question != "a.example.com. A" || list[0].State != QueryStateQuerying || list[1].State != QueryStateWaitingTrusted {
+		t.Errorf("Unexpected queries %+v", list)
+	}
+
+	table.Remove(entries[0])
+	if list = table.List(); len(list) != 2 || list[0].ID != entries[1].query.ID {
+		t.Errorf("Removed query should not be listed, got %+v", list)
+	}
+	if !table.Cancel(entries[2].query.ID) || table.Cancel(entries[0].query.ID) {
+		t.Error("Only queries in flight should be canceled")
+	}
+	if len(canceled) != 1 || canceled[0] != 2 {
+		t.Errorf("Unexpected canceled queries %v", canceled)
+	}
+	// States of queries not tracked are ignored.
+	inflightFromContext(context.Background()).SetState(QueryStateReplying)
+}
+
+func TestCancelQueryAdmin(t *testing.T) {
+	stuck := NewUpstreamResolver("stuck", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+		<-ctx.Done()
+		return nil, 0, ctx.Err()
+	}))
+	s, err := NewServer(NewClient(WithTimeout(5*time.Second)), WithSkipRefineResolvers(true), WithUpstreams(true, stuck))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	h := s.AdminHandler()
+	cancel := func(method, id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/queries/cancel", strings.NewReader(url.Values{"id": {id}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	w := newFakeResponseWriter("192.168.1.20")
+	done := make(chan struct{})
+	go func() {
+		s.Serve(w, new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA))
+		close(done)
+	}()
+	var queries []InFlightQuery
+	for start := time.Now(); len(queries) == 0 && time.Since(start) < time.Second; time.Sleep(time.Millisecond) {
+		queries = s.InFlight()
+	}
+	if len(queries) != 1 {
+		t.Fatalf("Expect a query in flight, got %+v", queries)
+	}
+
+	for _, tc := range []struct {
+		method, id string
+		code       int
+	}{
+		{http.MethodGet, strconv.FormatUint(queries[0].ID, 10), http.StatusMethodNotAllowed},
+		{http.MethodPost, "one", http.StatusBadRequest},
+		{http.MethodPost, "12345", http.StatusNotFound},
+	} {
+		if rec := cancel(tc.method, tc.id); rec.Code != tc.code {
+			t.Errorf("%s %s: got %d, want %d", tc.method, tc.id, rec.Code, tc.code)
+		}
+	}
+	select {
+	case <-done:
+		t.Fatal("Query should not be canceled by bad requests")
+	default:
+	}
+
+	id := strconv.FormatUint(queries[0].ID, 10)
+	if rec := cancel(http.MethodPost, id); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"canceled":`+id) {
+		t.Fatalf("Unexpected response %d %s", rec.Code, rec.Body)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Canceled query should be answered at once")
+	}
+	if w.msg == nil || w.msg.Rcode != dns.RcodeServerFailure {
+		t.Errorf("Canceled query should be answered SERVFAIL, got %v", w.msg)
+	}
+	if queries = s.InFlight(); len(queries) != 0 {
+		t.Errorf("Canceled query should be removed, got %+v", queries)
+	}
+}
@@ -0,0 +1,49 @@
+package gochinadns
+
+import (
+	"net"
+)
+
+// Prefixes of IPv6 addresses embedding IPv4 ones.
+var (
+	prefix6to4   = net.IP{0x20, 0x02}                                  // 2002::/16 (RFC 3056), IPv4 in bits 16-47
+	prefixTeredo = net.IP{0x20, 0x01, 0, 0}                            // 2001::/32 (RFC 4380), obfuscated client IPv4 in bits 96-127
+	prefixNAT64  = net.IP{0, 0x64, 0xff, 0x9b, 0, 0, 0, 0, 0, 0, 0, 0} // 64:ff9b::/96 (RFC 6052), IPv4 in bits 96-127
+)
+
+// embeddedIPv4 returns the IPv4 address embedded in ip, which is IPv4-mapped (::ffff:a.b.c.d), 6to4, Teredo or
+// NAT64 (well-known prefix), so that it can be classified by IPv4 lists. It returns nil if ip embeds no IPv4 address.
+func embeddedIPv4(ip net.IP) net.IP {
+	if len(ip) != net.IPv6len {
+		return nil
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	switch {
+	case hasIPPrefix(ip, prefix6to4):
+		return net.IPv4(ip[2], ip[3], ip[4], ip[5]).To4()
+	case hasIPPrefix(ip, prefixTeredo):
+		return net.IPv4(^ip[12], ^ip[13], ^ip[14], ^ip[15]).To4()
+	case hasIPPrefix(ip, prefixNAT64):
+		return net.IPv4(ip[12], ip[13], ip[14], ip[15]).To4()
+	}
+	return nil
+}
+
+// normalizeIP returns the IPv4 address embedded in ip, or ip itself if it embeds none.
+func normalizeIP(ip net.IP) net.IP {
+	if ip4 := embeddedIPv4(ip); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+func hasIPPrefix(ip, prefix net.IP) bool {
+	for i, b := range prefix {
+		if ip[i] != b {
+			return false
+		}
+	}
+	return true
+}
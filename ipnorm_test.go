@@ -0,0 +1,57 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestEmbeddedIPv4(t *testing.T) {
+	for ip, want := range map[string]string{
+		"::ffff:1.0.1.1":                       "1.0.1.1",
+		"2002:100:101::1":                      "1.0.1.1",
+		"2001:0:4136:e378:8000:63bf:feff:fefe": "1.0.1.1",
+		"64:ff9b::1.0.1.1":                     "1.0.1.1",
+		"240e::1":                              "",
+		"1.0.1.1":                              "",
+	} {
+		got := embeddedIPv4(net.ParseIP(ip).To16())
+		if ip == "1.0.1.1" {
+			got = embeddedIPv4(net.ParseIP(ip).To4())
+		}
+		if (got == nil && want != "") || (got != nil && got.String() != want) {
+			t.Errorf("embeddedIPv4(%s) = %v, want %q", ip, got, want)
+		}
+	}
+}
+
+func TestClassifyEmbeddedIPv4(t *testing.T) {
+	o := newServerOptions()
+	for _, opt := range []ServerOption{
+		WithCHNList(writeTestList(t, "china.list", "1.0.1.0/24\n")),
+		WithCHNList6(writeTestList(t, "china6.list", "240e::/20\n")),
+		WithIPBlacklist(writeTestList(t, "blacklist", "8.7.198.45\n")),
+	} {
+		if err := opt(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{serverOptions: o}
+
+	for ip, china := range map[string]bool{"2002:100:101::1": true, "64:ff9b::808:808": false, "240e::1": true} {
+		if got, err := s.isChinaIP(context.Background(), net.ParseIP(ip)); err != nil || got != china {
+			t.Errorf("isChinaIP(%s) = %v, %v, want %v", ip, got, err, china)
+		}
+	}
+	if hit, _ := s.isBlacklistedIP(net.ParseIP("2002:807:c62d::1")); !hit {
+		t.Error("6to4 address embedding a blacklisted IPv4 address should be blacklisted")
+	}
+
+	c, err := s.ClassifyIP(net.ParseIP("2002:100:101::1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.China || c.Embedded != "1.0.1.1" || len(c.Matches[ListChina]) != 1 {
+		t.Errorf("Unexpected classification %+v", c)
+	}
+}
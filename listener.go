@@ -0,0 +1,33 @@
+package gochinadns
+
+import (
+	"expvar"
+
+	"github.com/miekg/dns"
+)
+
+// listenerQueries counts queries received by each listener, keyed by transport and bind address like "udp [::]:53",
+// so that multi-homed deployments can see which interface carries what load.
+var listenerQueries = expvar.NewMap("chinadns_listener_queries")
+
+// listenerHandler returns a handler serving queries received by the listener of transport bound to addr,
+// which are counted in listenerQueries. UDP queries are rate limited if enabled, and their responses failing to be
+// sent are counted as drops. Queries admitted are bounded by WithMaxInFlight.
+func (s *Server) listenerHandler(transport, addr string) dns.Handler {
+	key := transport + " " + addr
+	serve := s.Serve
+	if s.admission != nil {
+		serve = func(w dns.ResponseWriter, req *dns.Msg) { s.admission.serve(w, req, s.Serve) }
+	}
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		listenerQueries.Add(key, 1)
+		if transport == "udp" {
+			w = &udpDropWriter{ResponseWriter: w}
+		}
+		if transport == "udp" && s.limiter != nil {
+			s.limiter.serve(w, req, serve)
+			return
+		}
+		serve(w, req)
+	})
+}
@@ -0,0 +1,35 @@
+package gochinadns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestListenerHandler(t *testing.T) {
+	s, err := NewServer(NewClient(),
+		WithListenAddr("127.0.0.1:5353"),
+		WithSkipRefineResolvers(true),
+		WithDomainBlacklist(writeTestList(t, "blacklist", "ads.example.com\n")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"udp 127.0.0.1:5353": "3", "tcp 127.0.0.1:5353": "1"}
+	for key := range want {
+		// Counters are global, and kept from previous runs of the test.
+		listenerQueries.Delete(key)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("ads.example.com.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		s.UDPServer.Handler.ServeDNS(newFakeResponseWriter("127.0.0.1"), req.Copy())
+	}
+	s.TCPServer.Handler.ServeDNS(newFakeResponseWriter("127.0.0.1"), req.Copy())
+
+	for key, n := range want {
+		if v := listenerQueries.Get(key); v == nil || v.String() != n {
+			t.Errorf("queries of %s = %v, want %s", key, v, n)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package gochinadns
+
+import (
+	"bufio"
+	"bytes"
+	"expvar"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yl2chen/cidranger"
+)
+
+const (
+	// cidrLineBytes is the estimated average length of a line in CIDR lists, to size arenas by file size.
+	cidrLineBytes = 16
+	// minArenaChunk and maxArenaChunk bound the number of entries allocated at once by an arena.
+	minArenaChunk = 256
+	maxArenaChunk = 1 << 16
+	// maxListErrors is the number of errors of loading lists kept to be reported.
+	maxListErrors = 20
+)
+
+// listErrorsGauge is the number of errors skipped in loading the current lists. See WithPermissiveLists.
+var listErrorsGauge = expvar.NewInt("chinadns_list_errors")
+
+// Masks shared by all entries of CIDR lists, indexed by prefix length.
+var (
+	cidrMasks4 [net.IPv4len*8 + 1]net.IPMask
+	cidrMasks6 [net.IPv6len*8 + 1]net.IPMask
+)
+
+func init() {
+	for i := range cidrMasks4 {
+		cidrMasks4[i] = net.CIDRMask(i, net.IPv4len*8)
+	}
+	for i := range cidrMasks6 {
+		cidrMasks6[i] = net.CIDRMask(i, net.IPv6len*8)
+	}
+}
+
+// cidrArena allocates entries of CIDR lists and their IPs in chunks, instead of several allocations per line.
+// A chunk is never reallocated, since the ranger keeps pointers to its entries.
+type cidrArena struct {
+	chunk   int
+	entries []sourcedEntry
+	ips     []byte
+}
+
+// newCIDRArena creates an arena for a list of size bytes, or an unknown size if 0.
+func newCIDRArena(size int64) *cidrArena {
+	chunk := int(size / cidrLineBytes)
+	if chunk < minArenaChunk {
+		chunk = minArenaChunk
+	} else if chunk > maxArenaChunk {
+		chunk = maxArenaChunk
+	}
+	return &cidrArena{chunk: chunk}
+}
+
+// entry returns a new entry of a network with ip and a prefix length of ones. ip is copied into the arena.
+func (a *cidrArena) entry(ip net.IP, ones int, source string, line int) *sourcedEntry {
+	if len(a.entries) == cap(a.entries) {
+		a.entries = make([]sourcedEntry, 0, a.chunk)
+	}
+	if cap(a.ips)-len(a.ips) < len(ip) {
+		a.ips = make([]byte, 0, a.chunk*net.IPv4len+net.IPv6len)
+	}
+	start := len(a.ips)
+	a.ips = append(a.ips, ip...)
+	network := net.IPNet{IP: a.ips[start:len(a.ips):len(a.ips)]}
+	if len(ip) == net.IPv6len {
+		network.Mask = cidrMasks6[ones]
+	} else {
+		network.Mask = cidrMasks4[ones]
+	}
+	a.entries = append(a.entries, sourcedEntry{network: network, source: source, line: line})
+	return &a.entries[len(a.entries)-1]
+}
+
+// parseCIDR parses a CIDR like net.ParseCIDR, without allocating for IPv4 ones.
+// The returned ip is masked, with 4 bytes for IPv4 and 16 bytes for IPv6, and may be overwritten in buf by the next call.
+func parseCIDR(b []byte, buf *[net.IPv6len]byte) (ip net.IP, ones int, ok bool) {
+	if ip, ones, ok = parseIPv4CIDR(b, buf); ok {
+		return
+	}
+	_, network, err := net.ParseCIDR(string(b))
+	if err != nil {
+		return nil, 0, false
+	}
+	ones, _ = network.Mask.Size()
+	return network.IP, ones, true
+}
+
+// parseIPv4CIDR parses an IPv4 CIDR like 1.2.3.0/24 into buf, and returns the masked IP.
+func parseIPv4CIDR(b []byte, buf *[net.IPv6len]byte) (net.IP, int, bool) {
+	ip := buf[:net.IPv4len]
+	octet, digits, i := 0, 0, 0
+	for n, c := range b {
+		switch {
+		case c >= '0' && c <= '9' && digits < 3:
+			octet = octet*10 + int(c-'0')
+			digits++
+		case (c == '.' && i < net.IPv4len-1 || c == '/' && i == net.IPv4len-1) && digits > 0 && octet <= 0xff:
+			ip[i] = byte(octet)
+			octet, digits = 0, 0
+			i++
+			if c == '/' {
+				ones, ok := parsePrefixLen(b[n+1:])
+				if !ok {
+					return nil, 0, false
+				}
+				mask := cidrMasks4[ones]
+				for j := range ip {
+					ip[j] &= mask[j]
+				}
+				return ip, ones, true
+			}
+		default:
+			return nil, 0, false
+		}
+	}
+	return nil, 0, false
+}
+
+// parsePrefixLen parses the prefix length of an IPv4 CIDR.
+func parsePrefixLen(b []byte) (int, bool) {
+	if len(b) == 0 || len(b) > 2 {
+		return 0, false
+	}
+	ones := 0
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		ones = ones*10 + int(c-'0')
+	}
+	return ones, ones <= net.IPv4len*8
+}
+
+// listErrors collects errors of loading lists, i.e. missing files and bad lines, which are skipped to load the rest.
+// A nil listErrors doesn't collect errors, so that loading fails at the first error.
+type listErrors struct {
+	count int
+	errs  []error // the first maxListErrors errors
+}
+
+// add records err, or returns it if l is nil.
+func (l *listErrors) add(err error) error {
+	if l == nil {
+		return err
+	}
+	l.count++
+	if len(l.errs) < maxListErrors {
+		l.errs = append(l.errs, err)
+	}
+	return nil
+}
+
+// Len returns the number of errors, which is 0 if l is nil.
+func (l *listErrors) Len() int {
+	if l == nil {
+		return 0
+	}
+	return l.count
+}
+
+// WithPermissiveLists skips missing list files and bad lines of lists with warnings, so that the server starts (or
+// reloads) with whatever is loaded, e.g. after a botched list update. Loading fails at any error by default.
+// The number of errors skipped is exported as the chinadns_list_errors metric.
+func WithPermissiveLists(enabled bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.PermissiveLists = enabled
+		return nil
+	}
+}
+
+// checkListErrors returns the first error of loading lists, or logs the errors as warnings if lists are loaded
+// permissively.
+func (o *serverOptions) checkListErrors() error {
+	errs := &o.ListErrors
+	if errs.Len() == 0 {
+		return nil
+	}
+	if !o.PermissiveLists {
+		return errs.errs[0]
+	}
+	for _, err := range errs.errs {
+		logrus.Warn("Skipped list error: ", err)
+	}
+	if more := errs.count - len(errs.errs); more > 0 {
+		logrus.Warnf("Skipped %d more list errors.", more)
+	}
+	return nil
+}
+
+// loadCIDRList inserts CIDRs in file path into ranger. A new ranger is created if ranger is nil.
+// desc describes the list in error messages. Errors are collected in errs, see listErrors.
+func loadCIDRList(ranger cidranger.Ranger, path, desc string, errs *listErrors) (cidranger.Ranger, error) {
+	return loadCIDRs(ranger, path, desc, false, errs)
+}
+
+// loadCIDRs is loadCIDRList also accepting bare IPs as CIDRs of a single address if bareIPs is true.
+// Lines are parsed from a stream into an arena, so that a large list creates little garbage.
+func loadCIDRs(ranger cidranger.Ranger, path, desc string, bareIPs bool, errs *listErrors) (cidranger.Ranger, error) {
+	if path == "" {
+		return ranger, fmt.Errorf("%w for %s", ErrEmptyPath, desc)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return ranger, errs.add(fmt.Errorf("fail to open %s: %w", desc, err))
+	}
+	defer file.Close()
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+
+	load := startListLoad()
+	if ranger == nil {
+		ranger = cidranger.NewPCTrieRanger()
+	}
+	var (
+		arena   = newCIDRArena(size)
+		buf     [net.IPv6len]byte
+		scanner = bufio.NewScanner(file)
+		count   int
+	)
+	for line := 1; scanner.Scan(); line++ {
+		ip, ones, ok := parseCIDR(scanner.Bytes(), &buf)
+		if !ok && bareIPs {
+			if ip = net.ParseIP(scanner.Text()); ip != nil {
+				if ip4 := ip.To4(); ip4 != nil {
+					ip = ip4
+				}
+				ones, ok = 8*len(ip), true
+			}
+		}
+		if !ok {
+			_, _, err := net.ParseCIDR(scanner.Text())
+			if err := errs.add(fmt.Errorf("parse %s as CIDR failed: %v", scanner.Text(), err.Error())); err != nil {
+				return ranger, err
+			}
+			continue
+		}
+		if err = ranger.Insert(arena.entry(ip, ones, path, line)); err != nil {
+			if err := errs.add(fmt.Errorf("insert %s as CIDR failed: %v", scanner.Text(), err.Error())); err != nil {
+				return ranger, err
+			}
+			continue
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		if err := errs.add(fmt.Errorf("fail to scan %s: %v", desc, err.Error())); err != nil {
+			return ranger, err
+		}
+	}
+	load.done(desc, path, count)
+	return ranger, nil
+}
+
+// loadDomainTrie adds domains in file path into trie. A new trie is created if trie is nil.
+// desc describes the list in error messages. Errors are collected in errs, see listErrors.
+func loadDomainTrie(trie *domainTrie, path, desc string, errs *listErrors) (*domainTrie, error) {
+	if path == "" {
+		return trie, fmt.Errorf("%w for %s", ErrEmptyPath, desc)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return trie, errs.add(fmt.Errorf("fail to open %s: %w", desc, err))
+	}
+	defer file.Close()
+
+	load := startListLoad()
+	if trie == nil {
+		trie = new(domainTrie)
+	}
+	scanner := bufio.NewScanner(file)
+	count := 0
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			trie.addBytes(scanner.Bytes())
+			count++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		if err := errs.add(fmt.Errorf("fail to scan %s: %v", desc, err.Error())); err != nil {
+			return trie, err
+		}
+	}
+	load.done(desc, path, count)
+	return trie, nil
+}
+
+// listLoad measures time and heap growth of loading a list.
+type listLoad struct {
+	start time.Time
+	heap  uint64
+}
+
+func startListLoad() listLoad {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return listLoad{start: time.Now(), heap: m.HeapAlloc}
+}
+
+// done logs the load time and heap growth of the list at path with count entries.
+func (l listLoad) done(desc, path string, count int) {
+	elapsed := time.Since(l.start)
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	grown := float64(int64(m.HeapAlloc)-int64(l.heap)) / (1 << 20)
+	logrus.Infof("Loaded %s %s: %d entries in %s, heap %+.1f MiB.", desc, path, count, elapsed.Round(time.Millisecond), grown)
+}
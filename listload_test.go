@@ -0,0 +1,118 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseCIDR(t *testing.T) {
+	var buf [net.IPv6len]byte
+	for _, s := range []string{
+		"1.0.1.0/24", "1.0.1.7/24", "0.0.0.0/0", "255.255.255.255/32", "10.0.0.0/8",
+		"240e::/20", "::ffff:1.2.3.4/120",
+		"", " 1.0.1.0/24", "1.0.1.0", "1.0.1.0/", "1.0.1.0/33", "1.0.1.256/24", "1.0.1/24", "1.0.1.0.0/24", "1.0.1.0/2a", "a.b.c.d/8",
+	} {
+		ip, ones, ok := parseCIDR([]byte(s), &buf)
+		_, want, err := net.ParseCIDR(s)
+		if ok != (err == nil) {
+			t.Errorf("parseCIDR(%q) ok = %v, but net.ParseCIDR error = %v", s, ok, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		wantOnes, _ := want.Mask.Size()
+		if !ip.Equal(want.IP) || len(ip) != len(want.IP) || ones != wantOnes {
+			t.Errorf("parseCIDR(%q) = %s/%d, want %s", s, ip, ones, want)
+		}
+	}
+}
+
+func TestLoadCIDRs(t *testing.T) {
+	path := writeTestList(t, "blacklist", "1.0.1.0/24\n8.8.8.8\n240e::1\n")
+	ranger, err := loadCIDRs(nil, path, "IP blacklist", true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"1.0.1.100", "8.8.8.8", "240e::1"} {
+		if ok, _ := ranger.Contains(net.ParseIP(ip)); !ok {
+			t.Errorf("%s should be loaded", ip)
+		}
+	}
+	if ok, _ := ranger.Contains(net.ParseIP("8.8.4.4")); ok {
+		t.Error("Bare IP should match itself only")
+	}
+
+	if _, err = loadCIDRs(nil, path, "China route list", false, nil); err == nil || !strings.Contains(err.Error(), "8.8.8.8") {
+		t.Errorf("Bare IP should be rejected in CIDR lists, got %v", err)
+	}
+}
+
+func TestDomainTrieAddBytes(t *testing.T) {
+	tr := new(domainTrie)
+	tr.addBytes([]byte(" google.com. \n"))
+	tr.addBytes([]byte("a.example.org"))
+	for name, want := range map[string]bool{
+		"google.com":      true,
+		"www.google.com.": true,
+		"example.org":     false,
+		"a.example.org":   true,
+		"b.example.org":   false,
+	} {
+		if got := tr.Contain(name); got != want {
+			t.Errorf("Contain(%s) = %v, want %v", name, got, want)
+		}
+	}
+	tr.addBytes([]byte("."))
+	if !tr.Contain("example.net") {
+		t.Error("`.` should contain all domains")
+	}
+}
+
+// applyListOption applies a list option to new options, and checks errors of loading lists like NewServer.
+func applyListOption(opt ServerOption) error {
+	o := newServerOptions()
+	if err := opt(o); err != nil {
+		return err
+	}
+	return o.checkListErrors()
+}
+
+func TestPermissiveLists(t *testing.T) {
+	china := writeTestList(t, "china.list", "1.0.1.0/24\nnot a cidr\n1.0.2.0/24\n")
+	hosts := writeTestList(t, "hosts", "192.168.1.10 nas.lan\nnas.lan\n")
+	missing := china + ".missing"
+	opts := []ServerOption{WithCHNList(china), WithHosts(hosts), WithDomainBlacklist(missing)}
+
+	o := newServerOptions()
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.checkListErrors(); err == nil || !strings.Contains(err.Error(), "not a cidr") {
+		t.Errorf("The first list error should fail by default, got %v", err)
+	}
+
+	o = newServerOptions()
+	for _, opt := range append(opts, WithPermissiveLists(true)) {
+		if err := opt(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := o.checkListErrors(); err != nil || o.ListErrors.Len() != 3 {
+		t.Fatalf("3 list errors should be skipped, got %d: %v", o.ListErrors.Len(), err)
+	}
+	s := &Server{serverOptions: o}
+	if china, _ := s.isChinaIP(context.Background(), net.ParseIP("1.0.2.1")); !china {
+		t.Error("Lines after a bad line should be loaded")
+	}
+	if _, ok := o.Hosts.Lookup("nas.lan"); !ok {
+		t.Error("Good hosts entries should be loaded")
+	}
+	if err := WithDomainBlacklist("")(o); err == nil {
+		t.Error("Empty path should fail even if lists are loaded permissively")
+	}
+}
@@ -0,0 +1,118 @@
+package gochinadns
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logSuppressedField is the field of summaries of suppressed logs, which are never suppressed themselves.
+const logSuppressedField = "suppressed"
+
+var logsSuppressed = expvar.NewInt("chinadns_logs_suppressed")
+
+// ThrottleLogs limits repeated warning and error logs of logger to burst per interval, so that an upstream failing
+// thousands of times a minute doesn't bury other logs. Logs are repeated if they have the same level, message and
+// server. Suppressed logs are summarized once per interval, with the number of them and the error of the last one.
+// Logs of lower levels are not limited. It returns a function to stop throttling.
+func ThrottleLogs(logger *logrus.Logger, interval time.Duration, burst int) (stop func()) {
+	if interval <= 0 || burst <= 0 {
+		return func() {}
+	}
+	t := newLogThrottle(logger.Formatter, burst)
+	logger.SetFormatter(t)
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.flush(logger, interval)
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			logger.SetFormatter(t.Formatter)
+			t.flush(logger, interval)
+		})
+	}
+}
+
+// logThrottle is a logrus formatter formatting nothing for logs beyond the limit.
+type logThrottle struct {
+	logrus.Formatter
+	burst int
+
+	mu     sync.Mutex
+	counts map[logKey]*logCount
+}
+
+type logKey struct {
+	level   logrus.Level
+	message string
+	server  interface{}
+}
+
+type logCount struct {
+	logged     int
+	suppressed int
+	err        interface{} // error of the last suppressed log
+}
+
+func newLogThrottle(formatter logrus.Formatter, burst int) *logThrottle {
+	return &logThrottle{Formatter: formatter, burst: burst, counts: make(map[logKey]*logCount)}
+}
+
+func (t *logThrottle) Format(entry *logrus.Entry) ([]byte, error) {
+	if entry.Level > logrus.WarnLevel || entry.Data[logSuppressedField] != nil {
+		return t.Formatter.Format(entry)
+	}
+	key := logKey{level: entry.Level, message: entry.Message, server: entry.Data["server"]}
+	t.mu.Lock()
+	c := t.counts[key]
+	if c == nil {
+		c = new(logCount)
+		t.counts[key] = c
+	}
+	if c.logged < t.burst {
+		c.logged++
+		t.mu.Unlock()
+		return t.Formatter.Format(entry)
+	}
+	c.suppressed++
+	c.err = entry.Data[logrus.ErrorKey]
+	t.mu.Unlock()
+	logsSuppressed.Add(1)
+	return nil, nil
+}
+
+// flush logs summaries of logs suppressed in the last interval, and resets the limits.
+func (t *logThrottle) flush(logger *logrus.Logger, interval time.Duration) {
+	t.mu.Lock()
+	counts := t.counts
+	t.counts = make(map[logKey]*logCount)
+	t.mu.Unlock()
+
+	for key, c := range counts {
+		if c.suppressed == 0 {
+			continue
+		}
+		fields := logrus.Fields{logSuppressedField: c.suppressed}
+		if key.server != nil {
+			fields["server"] = key.server
+		}
+		if c.err != nil {
+			fields[logrus.ErrorKey] = c.err
+		}
+		logger.WithFields(fields).Logf(key.level, "%s (repeated %d more times in %s)", key.message, c.suppressed, interval)
+	}
+}
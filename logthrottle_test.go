@@ -0,0 +1,55 @@
+package gochinadns
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogThrottle(t *testing.T) {
+	var out bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&out)
+	logger.SetLevel(logrus.DebugLevel)
+	logger.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true})
+	throttle := newLogThrottle(logger.Formatter, 2)
+	logger.SetFormatter(throttle)
+
+	for i := 0; i < 5; i++ {
+		logger.WithField("server", "8.8.8.8:53").WithError(errors.New("i/o timeout")).Error("Fail to send UDP query.")
+		logger.WithField("server", "1.1.1.1:53").Error("Fail to send UDP query.")
+		logger.Debug("Query sent.")
+	}
+	if n := strings.Count(out.String(), "Fail to send UDP query."); n != 4 {
+		t.Errorf("2 errors of each server should be logged, got %d:\n%s", n, out.String())
+	}
+	if n := strings.Count(out.String(), "Query sent."); n != 5 {
+		t.Errorf("Debug logs should not be throttled, got %d", n)
+	}
+
+	out.Reset()
+	throttle.flush(logger, time.Minute)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Suppressed errors of each server should be summarized, got:\n%s", out.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "repeated 3 more times in 1m0s") || !strings.Contains(line, "suppressed=3") {
+			t.Errorf("Unexpected summary %s", line)
+		}
+		if strings.Contains(line, "8.8.8.8:53") && !strings.Contains(line, "i/o timeout") {
+			t.Errorf("Summary should contain the last error, got %s", line)
+		}
+	}
+
+	out.Reset()
+	throttle.flush(logger, time.Minute)
+	logger.Error("Fail to send UDP query.")
+	if out.String() == "" || strings.Contains(out.String(), "repeated") {
+		t.Errorf("Limits should be reset after a flush, got %s", out.String())
+	}
+}
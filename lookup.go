@@ -1,6 +1,7 @@
 package gochinadns
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -9,55 +10,122 @@ import (
 )
 
 // LookupFunc looks up DNS request to the given server and returns DNS reply, its RTT time and an error.
-type LookupFunc func(request *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error)
+// ctx is canceled once the reply is not needed anymore, e.g. another server replied first.
+type LookupFunc func(ctx context.Context, request *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error)
 
+// Upstream resolves DNS queries by itself, instead of sending them to a DNS server over the network.
+// It allows embedding programs to inject custom upstreams, such as an in-process recursive resolver or a test double.
+// See NewUpstreamResolver.
+type Upstream interface {
+	// Resolve returns the reply of req and its RTT. req may be changed, and the reply is not changed by the caller.
+	Resolve(ctx context.Context, req *dns.Msg) (reply *dns.Msg, rtt time.Duration, err error)
+}
+
+// UpstreamFunc is an adapter to use a function as an Upstream.
+type UpstreamFunc func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error)
+
+// Resolve calls f(ctx, req).
+func (f UpstreamFunc) Resolve(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	return f(ctx, req)
+}
+
+// Lookup is LookupContext with the background context.
 func (c *Client) Lookup(req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	return c.LookupContext(context.Background(), req, server)
+}
+
+// LookupContext looks up req in server, with pointer mutation if the client is created with WithMutation.
+// Replies are limited by WithMaxReplySize and WithMaxAdditional.
+func (c *Client) LookupContext(ctx context.Context, req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
 	if c.Mutation {
-		return c.lookupMutation(req, server)
+		reply, rtt, err = c.lookupMutation(ctx, req, server)
+	} else {
+		reply, rtt, err = c.lookupNormal(ctx, req, server)
 	}
-	return c.lookupNormal(req, server)
+	if err == nil {
+		reply, err = c.limitReply(reply)
+	}
+	return
 }
 
 // lookupNormal send a DNS request to the specific server and get its corresponding reply.
 // DNS Proxy Implementation Guidelines: https://tools.ietf.org/html/rfc5625
 // DNS query processing: https://tools.ietf.org/html/rfc1034#section-3.7
 // Happy Eyeballs: https://tools.ietf.org/html/rfc6555#section-5.4 and #section-6
-func (c *Client) lookupNormal(req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
-	logger := logrus.WithFields(logrus.Fields{
+func (c *Client) lookupNormal(ctx context.Context, req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	if server.upstream != nil {
+		return server.upstream.Resolve(ctx, req)
+	}
+	return lookupEDNSFallback(ctx, req, server, c.withTimeout(c.lookupTimeout(ctx, server)).exchangeNormal)
+}
+
+// exchangeNormal sends req to server by its protocols in order, until one of them succeeds.
+func (c *Client) exchangeNormal(ctx context.Context, req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	logger := logEntry(ctx).WithFields(logrus.Fields{
 		"question": questionString(&req.Question[0]),
 		"server":   server,
 	})
 
 	var rtt0 time.Duration
 
-	for _, protocol := range server.GetProtocols() {
+	for _, protocol := range c.protocolsOf(server) {
 		switch protocol {
 		case "udp":
 			logger.Debug("Query upstream udp")
-			reply, rtt0, err = c.UDPCli.Exchange(req, server.GetAddr())
+			reply, rtt0, err = c.exchangeUDP(ctx, req, server.GetAddr())
 			rtt += rtt0
+			if err == nil && reply.Truncated {
+				server.onUDPSuccess()
+				reply, rtt0, err = c.retryTruncated(logger, server, func() (*dns.Msg, time.Duration, error) {
+					return c.exchangeTCP(ctx, req, server.GetAddr())
+				})
+				rtt += rtt0
+				return
+			}
 			if err == nil {
+				server.onUDPSuccess()
 				return
 			}
-			logger.WithError(err).Error("Fail to send UDP query.")
-			if reply != nil && reply.Truncated {
-				logger.Error("Truncated msg received. Consider enlarge your UDP max size.")
+			if ctx.Err() != nil {
+				return nil, rtt, ctx.Err()
 			}
+			if isTimeout(err) {
+				server.onUDPTimeout(getUDPSize(req))
+			}
+			logger.WithError(err).Error("Fail to send UDP query.")
 		case "tcp":
 			logger.Debug("Query upstream tcp")
-			reply, rtt0, err = c.TCPCli.Exchange(req, server.GetAddr())
+			reply, rtt0, err = c.exchangeTCP(ctx, req, server.GetAddr())
 			rtt += rtt0
 			if err == nil {
 				return
 			}
+			if ctx.Err() != nil {
+				return nil, rtt, ctx.Err()
+			}
 			logger.WithError(err).Error("Fail to send TCP query.")
 		case "doh":
 			logger.Debug("Query upstream doh")
-			reply, rtt, err = c.DoHCli.Exchange(req, server.GetAddr())
+			reply, rtt, err = c.exchangeDoH(ctx, req, server)
 			if err == nil {
 				return
 			}
+			if ctx.Err() != nil {
+				return nil, rtt, ctx.Err()
+			}
 			logger.WithError(err).Error("Fail to send DoH query.")
+		case "dot":
+			logger.Debug("Query upstream dot")
+			reply, rtt0, err = c.exchangeDoT(ctx, req, server)
+			rtt += rtt0
+			if err == nil {
+				server.onDoTSuccess()
+				return
+			}
+			if ctx.Err() != nil {
+				return nil, rtt, ctx.Err()
+			}
+			logger.WithError(err).Error("Fail to send DoT query.")
 		default:
 			logger.Errorf("Protocol %s is unsupported in normal method.", protocol)
 			return
@@ -68,52 +136,91 @@ func (c *Client) lookupNormal(req *dns.Msg, server *Resolver) (reply *dns.Msg, r
 
 // lookupMutation does the same as lookupNormal, with pointer mutation for DNS query.
 // DNS Compression: https://tools.ietf.org/html/rfc1035#section-4.1.4
-func (c *Client) lookupMutation(req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
-	logger := logrus.WithFields(logrus.Fields{
+func (c *Client) lookupMutation(ctx context.Context, req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	if server.upstream != nil {
+		return server.upstream.Resolve(ctx, req)
+	}
+	return lookupEDNSFallback(ctx, req, server, c.withTimeout(c.lookupTimeout(ctx, server)).exchangeMutation)
+}
+
+// exchangeMutation sends req with pointer mutation to server by its protocols in order, until one of them succeeds.
+func (c *Client) exchangeMutation(ctx context.Context, req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	logger := logEntry(ctx).WithFields(logrus.Fields{
 		"question": questionString(&req.Question[0]),
 		"server":   server,
 	})
 
-	var buffer []byte
-	buffer, err = req.Pack()
+	buffer, buf, err := packMsg(req)
 	if err != nil {
 		return nil, 0, fmt.Errorf("fail to pack request: %v", err.Error())
 	}
+	defer putBuffer(buf)
 	buffer = mutateQuestion2(buffer)
 
 	// FIXME: may cause unexpected timeout (especially in `proto1+proto2@addr` case)
 	t := time.Now()
-	for _, protocol := range server.GetProtocols() {
+	for _, protocol := range c.protocolsOf(server) {
 		switch protocol {
 		case "udp":
 			logger.Debug("Query upstream udp")
 			ddl := t.Add(c.UDPCli.Timeout)
 			udpSize := getUDPSize(req)
-			reply, err = rawLookup(c.UDPCli, req.Id, buffer, server, ddl, udpSize)
+			reply, err = rawLookup(ctx, c.dialUDP, req, buffer, server, ddl, udpSize)
+			if err == nil && reply.Truncated {
+				server.onUDPSuccess()
+				reply, _, err = c.retryTruncated(logger, server, func() (*dns.Msg, time.Duration, error) {
+					reply, err := c.exchangeTCPRaw(ctx, req, buffer, server.GetAddr())
+					return reply, 0, err
+				})
+				rtt = time.Since(t)
+				return
+			}
 			if err == nil {
+				server.onUDPSuccess()
 				rtt = time.Since(t)
 				return
 			}
-			logger.WithError(err).Error("Fail to send UDP mutation query. ")
-			if reply != nil && reply.Truncated {
-				logger.Error("Truncated msg received. Consider enlarge your UDP max size.")
+			if ctx.Err() != nil {
+				return nil, rtt, ctx.Err()
+			}
+			if isTimeout(err) {
+				server.onUDPTimeout(udpSize)
 			}
+			logger.WithError(err).Error("Fail to send UDP mutation query. ")
 		case "tcp":
 			logger.Debug("Query upstream tcp")
-			ddl := time.Now().Add(c.TCPCli.Timeout)
-			reply, err = rawLookup(c.TCPCli, req.Id, buffer, server, ddl, 0)
+			reply, err = c.exchangeTCPRaw(ctx, req, buffer, server.GetAddr())
 			if err == nil {
 				rtt = time.Since(t)
 				return
 			}
+			if ctx.Err() != nil {
+				return nil, rtt, ctx.Err()
+			}
 			logger.WithError(err).Error("Fail to send TCP mutation query.")
 		case "doh":
 			logger.Debug("Query upstream doh")
-			reply, rtt, err = c.DoHCli.Exchange(req, server.GetAddr())
+			reply, rtt, err = c.exchangeDoH(ctx, req, server)
 			if err == nil {
 				return
 			}
+			if ctx.Err() != nil {
+				return nil, rtt, ctx.Err()
+			}
 			logger.WithError(err).Error("Fail to send DoH query.")
+		case "dot":
+			// Mutation makes no sense as the query is encrypted.
+			logger.Debug("Query upstream dot")
+			reply, _, err = c.exchangeDoT(ctx, req, server)
+			if err == nil {
+				server.onDoTSuccess()
+				rtt = time.Since(t)
+				return
+			}
+			if ctx.Err() != nil {
+				return nil, rtt, ctx.Err()
+			}
+			logger.WithError(err).Error("Fail to send DoT query.")
 		default:
 			logger.Errorf("Protocol %s is unsupported in mutation method.", protocol)
 			return
@@ -123,28 +230,50 @@ func (c *Client) lookupMutation(req *dns.Msg, server *Resolver) (reply *dns.Msg,
 	return
 }
 
-func rawLookup(cli *dns.Client, id uint16, req []byte, server *Resolver, ddl time.Time, udpSize uint16) (*dns.Msg, error) {
-	conn, err := cli.Dial(server.GetAddr())
+// retryTruncated retries a query truncated over UDP by exchange over TCP to the same server.
+// It fails if the TCP attempt fails, so that the next server is queried instead of using the truncated reply.
+func (c *Client) retryTruncated(logger *logrus.Entry, server *Resolver, exchange func() (*dns.Msg, time.Duration, error)) (*dns.Msg, time.Duration, error) {
+	logger = logger.WithField("attempt", "tcp")
+	logger.Debug("Truncated UDP reply. Retry over TCP.")
+	reply, rtt, err := exchange()
+	if err != nil {
+		logger.WithError(err).Error("Fail to retry truncated query over TCP.")
+		return nil, rtt, fmt.Errorf("retry truncated query to %s over TCP: %w", server, err)
+	}
+	logger.Debug("Truncated query retried over TCP.")
+	return reply, rtt, nil
+}
+
+// rawLookup sends raw, the packed req, to server, and reads the reply of req.
+func rawLookup(ctx context.Context, dial func(string) (*dns.Conn, error), req *dns.Msg, raw []byte, server *Resolver, ddl time.Time, udpSize uint16) (*dns.Msg, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn, err := dial(server.GetAddr())
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
 	conn.UDPSize = udpSize
 
 	_ = conn.SetWriteDeadline(ddl)
-	if _, err := conn.Write(req); err != nil {
+	if _, err := conn.Write(raw); err != nil {
 		return nil, err
 	}
 
 	_ = conn.SetReadDeadline(ddl)
-	reply, err := conn.ReadMsg()
+	reply, err := readMsg(conn)
+	if err == nil {
+		reply, err = readValidReply(conn, req, reply, replyCheckFromContext(ctx))
+	}
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
-	if reply.Id != id {
-		err = dns.ErrId
-	}
-	return reply, err
+	return reply, nil
 }
 
 func setUDPSize(req *dns.Msg, size uint16) uint16 {
@@ -170,14 +299,15 @@ func getUDPSize(req *dns.Msg) uint16 {
 	return dns.MinMsgSize
 }
 
-//nolint:deadcode,unused
+// cleanEdns0 removes OPT records from req.
 func cleanEdns0(req *dns.Msg) {
-	for {
-		if req.IsEdns0() == nil {
-			break
+	extra := req.Extra[:0]
+	for _, rr := range req.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
 		}
-		req.Extra = req.Extra[:len(req.Extra)-1]
 	}
+	req.Extra = extra
 }
 
 // DNS compression pointer mutation: https://gist.github.com/klzgrad/f124065c0616022b65e5#file-sendmsg-c-L30-L63
@@ -235,6 +365,7 @@ func mutateQuestion2(raw []byte) []byte {
 	return mutation
 }
 
+// questionString formats q for logs and the admin API. The name is redacted by RedactName.
 func questionString(q *dns.Question) string {
-	return q.Name + " " + dns.TypeToString[q.Qtype]
+	return RedactName(q.Name) + " " + dns.TypeToString[q.Qtype]
 }
@@ -0,0 +1,150 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestLookupTruncated(t *testing.T) {
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("10.0.0.1"),
+			})
+		} else {
+			m.Truncated = true
+		}
+		_ = w.WriteMsg(m)
+	})
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skip("Fail to listen TCP on the same port: ", err)
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: handler}
+	tcp := &dns.Server{Listener: l, Handler: handler}
+	go func() { _ = udp.ActivateAndServe() }()
+	go func() { _ = tcp.ActivateAndServe() }()
+	defer func() { _ = udp.Shutdown() }()
+
+	server, err := ParseResolver(pc.LocalAddr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(WithTimeout(time.Second))
+	req := new(dns.Msg)
+	req.SetQuestion("large.example.com.", dns.TypeA)
+	reply, _, err := c.Lookup(req, server)
+	if err != nil {
+		t.Fatal("Truncated query should be retried over TCP: ", err)
+	}
+	if reply.Truncated || len(reply.Answer) != 1 {
+		t.Errorf("Reply over TCP should be used, got %v", reply)
+	}
+
+	_ = tcp.Shutdown()
+	if reply, _, err := c.Lookup(req, server); err == nil {
+		t.Errorf("Truncated reply should not be used if TCP retry fails, got %v", reply)
+	}
+}
+
+func TestUpstreamResolver(t *testing.T) {
+	o := newServerOptions()
+	o.Delay = time.Second
+	trusted := NewUpstreamResolver("in-process", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+		m := newTestReply(req.Question[0].Name, 60, "142.250.1.1")
+		m.Id = req.Id
+		return m, time.Millisecond, nil
+	}))
+	canceled := make(chan struct{})
+	untrusted := NewUpstreamResolver("stalled", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+		<-ctx.Done()
+		close(canceled)
+		return nil, 0, ctx.Err()
+	}))
+	for _, f := range []ServerOption{WithUpstreams(true, trusted), WithUpstreams(false, untrusted)} {
+		if err := f(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := WithUpstreams(true, &Resolver{Addr: "8.8.8.8:53"})(o); !errors.Is(err, ErrInvalidResolver) {
+		t.Errorf("Resolvers of DNS servers should not be added as custom upstreams, got %v", err)
+	}
+	s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second)), goroutines: newGoroutineTracker()}
+	if err := s.partitionResolvers(); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.UntrustedServers) != 1 || s.UntrustedServers[0] != untrusted {
+		t.Fatalf("Custom upstreams should be untrusted unless declared, got %s", s.UntrustedServers)
+	}
+	if untrusted.String() != "custom@stalled" {
+		t.Errorf("Unexpected name %s", untrusted)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.google.com.", dns.TypeA)
+	reply := s.resolve(context.Background(), logrus.WithField("test", t.Name()), req)
+	if reply == nil || reply.server != trusted {
+		t.Fatalf("Reply should be resolved by the custom upstream, got %+v", reply)
+	}
+	if ips := answerIPs(reply.Msg); len(ips) != 1 || !ips[0].Equal(net.ParseIP("142.250.1.1")) {
+		t.Errorf("Unexpected answer %v", reply.Answer)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("Context of the lookup should be canceled once a reply is chosen")
+	}
+}
+
+func TestLookupCanceled(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	server, err := ParseResolver("udp@"+pc.LocalAddr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(WithTimeout(5 * time.Second))
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if _, _, err := c.LookupContext(ctx, req, server); !errors.Is(err, context.Canceled) {
+		t.Errorf("Lookup should be canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Lookup should be given up once canceled, took %s", elapsed)
+	}
+	if atomic.LoadUint32(&server.frag.ednsLimit) != 0 {
+		t.Error("Canceled lookups should not be taken as UDP timeouts")
+	}
+
+	s := &Server{serverOptions: newServerOptions(), Client: c}
+	if d := s.queryTimeout(clientLimits{}); d != defaultQueryTimeout {
+		t.Errorf("Unexpected query timeout of UDP clients %s", d)
+	}
+	s.QueryTimeout = time.Second
+	if d := s.queryTimeout(clientLimits{tcp: true}); d != 5*time.Second {
+		t.Errorf("Query timeout should not be shorter than the client timeout, got %s", d)
+	}
+}
@@ -0,0 +1,147 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"net"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// mirrorQueueSize is the max number of messages waiting to be mirrored. Messages are dropped if the queue is full.
+	mirrorQueueSize = 1024
+	// mirrorOptionCode is the EDNS0 local option code (RFC 6891 local/experimental use) carrying the verdict
+	// and the upstream in mirrored answers.
+	mirrorOptionCode = 65001
+)
+
+// mirrorDropped counts mirrored messages dropped since the target can't keep up.
+var mirrorDropped = expvar.NewInt("chinadns_mirror_dropped")
+
+// WithMirror mirrors percent (0 to 100) of queries and their final answers to addr in host:port format over UDP,
+// for offline analysis of policy quality. The target may be a resolver or a collector, and its replies are discarded.
+// Answers carry the verdict and the upstream in an EDNS0 local option 65001, like "verdict=overseas upstream=udp@8.8.8.8:53".
+// Nothing is mirrored if names are redacted.
+func WithMirror(addr string, percent float64) ServerOption {
+	return func(o *serverOptions) error {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid mirror target %s: %w", addr, err)
+		}
+		if percent < 0 || percent > 100 {
+			return fmt.Errorf("invalid mirror percent %v, expect 0 to 100", percent)
+		}
+		o.Mirror = addr
+		o.MirrorPercent = percent
+		return nil
+	}
+}
+
+// mirror sends sampled queries and answers to the mirror target in its own goroutine,
+// so that serving is not blocked by the target.
+type mirror struct {
+	addr     string
+	percent  float64
+	messages chan []byte
+
+	conn   net.Conn // dialed on the first run
+	failed bool     // the target fails to dial, and messages are dropped
+}
+
+// newMirror creates the mirror of o. It returns nil if mirroring is disabled.
+func newMirror(o *serverOptions) *mirror {
+	if o.Mirror == "" || o.MirrorPercent == 0 {
+		return nil
+	}
+	return &mirror{
+		addr:     o.Mirror,
+		percent:  o.MirrorPercent,
+		messages: make(chan []byte, mirrorQueueSize),
+	}
+}
+
+// sampled tells whether a query should be mirrored.
+func (m *mirror) sampled() bool {
+	return m.percent >= 100 || rand.Float64()*100 < m.percent
+}
+
+// send queues msg to be mirrored. msg is dropped if the queue is full.
+func (m *mirror) send(msg *dns.Msg) {
+	b, err := msg.Pack()
+	if err != nil {
+		logrus.WithError(err).Debug("Fail to pack mirrored message.")
+		return
+	}
+	select {
+	case m.messages <- b:
+	default:
+		mirrorDropped.Add(1)
+	}
+}
+
+// mirrorAnswer mirrors the query and the answer of e if it's sampled.
+func (m *mirror) mirrorAnswer(e *AnswerEvent) {
+	if redacting() || !m.sampled() {
+		return
+	}
+	q := new(dns.Msg)
+	q.SetQuestion(e.Question.Name, e.Question.Qtype)
+	q.Question[0].Qclass = e.Question.Qclass
+	q.Id = e.Answer.Id
+	m.send(q)
+
+	a := e.Answer.Copy()
+	info := "verdict=" + e.Verdict
+	if e.Cached {
+		info = "verdict=cached"
+	}
+	if e.Upstream != nil {
+		info += " upstream=" + e.Upstream.String()
+	}
+	opt := a.IsEdns0()
+	if opt == nil {
+		a.SetEdns0(dns.DefaultMsgSize, false)
+		opt = a.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: mirrorOptionCode, Data: []byte(info)})
+	m.send(a)
+}
+
+// run sends queued messages until ctx is done. The socket is kept open to run again.
+func (m *mirror) run(ctx context.Context) {
+	if m.conn == nil && !m.failed {
+		conn, err := net.Dial("udp", m.addr)
+		if err != nil {
+			logrus.WithError(err).Error("Query mirroring is disabled.")
+			m.failed = true
+			return
+		}
+		m.conn = conn
+		// Drain replies of the target, so that they don't pile up in the socket buffer.
+		go func() {
+			buf := make([]byte, dns.MaxMsgSize)
+			for {
+				if _, err := conn.Read(buf); errors.Is(err, net.ErrClosed) {
+					return
+				}
+			}
+		}()
+	}
+	if m.failed {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case b := <-m.messages:
+			// Errors like ICMP port unreachable are ignored, since the target is best effort.
+			_, _ = m.conn.Write(b)
+		}
+	}
+}
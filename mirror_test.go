@@ -0,0 +1,80 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestMirror(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	o := newServerOptions()
+	if err := WithMirror(pc.LocalAddr().String(), 100)(o); err != nil {
+		t.Fatal(err)
+	}
+	m := newMirror(o)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.run(ctx)
+
+	answer := newTestReply("example.com.", 60, "142.250.1.1")
+	upstream, _ := ParseResolver("8.8.8.8", false)
+	m.mirrorAnswer(&AnswerEvent{Question: answer.Question[0], Answer: answer, Upstream: upstream, Verdict: VerdictOverseas})
+
+	var msgs []*dns.Msg
+	buf := make([]byte, dns.MaxMsgSize)
+	_ = pc.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(msgs) < 2 {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := new(dns.Msg)
+		if err := msg.Unpack(buf[:n]); err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	if q := msgs[0]; q.Response || q.Question[0].Name != "example.com." {
+		t.Errorf("First mirrored message should be the query: %v", q)
+	}
+	a := msgs[1]
+	if !a.Response || len(a.Answer) != 1 {
+		t.Fatalf("Second mirrored message should be the answer: %v", a)
+	}
+	var info string
+	if opt := a.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == mirrorOptionCode {
+				info = string(l.Data)
+			}
+		}
+	}
+	if want := "verdict=overseas upstream=" + upstream.String(); info != want {
+		t.Errorf("Mirrored answer info = %q, want %q", info, want)
+	}
+	if answer.IsEdns0() != nil {
+		t.Error("Mirroring should not modify the answer to the client")
+	}
+}
+
+func TestWithMirror(t *testing.T) {
+	o := newServerOptions()
+	if err := WithMirror("127.0.0.1", 10)(o); err == nil {
+		t.Error("Mirror target without port should be rejected")
+	}
+	if err := WithMirror("127.0.0.1:53", 101)(o); err == nil {
+		t.Error("Mirror percent beyond 100 should be rejected")
+	}
+	if err := WithMirror("127.0.0.1:53", 0)(o); err != nil || newMirror(o) != nil {
+		t.Errorf("Mirroring should be disabled with 0 percent: %v", err)
+	}
+}
@@ -0,0 +1,322 @@
+// Package mmdb reads MaxMind DB files, such as GeoLite2-Country.mmdb.
+// Only lookups are supported. See https://maxmind.github.io/MaxMind-DB/ for the format.
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+)
+
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// dataSectionSeparator is the size of zeros between the search tree and the data section.
+const dataSectionSeparator = 16
+
+// ErrInvalidDatabase is returned if the database is malformed.
+var ErrInvalidDatabase = errors.New("invalid MaxMind DB")
+
+// Metadata describes a database.
+type Metadata struct {
+	NodeCount    uint
+	RecordSize   uint
+	IPVersion    uint
+	DatabaseType string
+	BuildEpoch   uint64
+}
+
+// Reader looks up IPs in a database loaded into memory.
+type Reader struct {
+	Metadata
+	buf       []byte
+	data      []byte // the data section
+	ipv4Start uint   // node of ::/96 in an IPv6 database, where IPv4 addresses are looked up
+}
+
+// Open loads the database in file path.
+func Open(path string) (*Reader, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(buf)
+}
+
+// FromBytes parses a database in buf.
+func FromBytes(buf []byte) (*Reader, error) {
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%w: metadata not found", ErrInvalidDatabase)
+	}
+	meta := decoder{buf: buf[i+len(metadataMarker):]}
+	v, _, err := meta.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidDatabase, err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: metadata is not a map", ErrInvalidDatabase)
+	}
+	r := &Reader{buf: buf}
+	r.NodeCount = uint(toUint(m["node_count"]))
+	r.RecordSize = uint(toUint(m["record_size"]))
+	r.IPVersion = uint(toUint(m["ip_version"]))
+	r.DatabaseType, _ = m["database_type"].(string)
+	r.BuildEpoch = toUint(m["build_epoch"])
+	if r.RecordSize != 24 && r.RecordSize != 28 && r.RecordSize != 32 {
+		return nil, fmt.Errorf("%w: unsupported record size %d", ErrInvalidDatabase, r.RecordSize)
+	}
+	if r.IPVersion != 4 && r.IPVersion != 6 {
+		return nil, fmt.Errorf("%w: unsupported IP version %d", ErrInvalidDatabase, r.IPVersion)
+	}
+
+	treeSize := r.NodeCount * r.RecordSize / 4
+	if treeSize+dataSectionSeparator > uint(i) {
+		return nil, fmt.Errorf("%w: search tree exceeds the file", ErrInvalidDatabase)
+	}
+	r.data = buf[treeSize+dataSectionSeparator : i]
+
+	if r.IPVersion == 6 {
+		for bit := 0; bit < 96 && r.ipv4Start < r.NodeCount; bit++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// Lookup returns the record of ip and the network it belongs to.
+// The record is nil if ip is not found. IPv6 addresses are never found in an IPv4 database.
+func (r *Reader) Lookup(ip net.IP) (record interface{}, network *net.IPNet, err error) {
+	node, bits := uint(0), 128
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, node, bits = ip4, r.ipv4Start, 32
+	} else if r.IPVersion == 4 {
+		return nil, nil, nil
+	} else {
+		ip = ip.To16()
+	}
+
+	depth := 0
+	for ; depth < bits && node < r.NodeCount; depth++ {
+		bit := ip[depth>>3] >> (7 - uint(depth&7)) & 1
+		node = r.record(node, uint(bit))
+	}
+	network = &net.IPNet{IP: ip.Mask(net.CIDRMask(depth, bits)), Mask: net.CIDRMask(depth, bits)}
+	if node == r.NodeCount {
+		return nil, network, nil
+	}
+	if node < r.NodeCount {
+		return nil, nil, fmt.Errorf("%w: search tree is deeper than %d bits", ErrInvalidDatabase, bits)
+	}
+
+	offset := node - r.NodeCount - dataSectionSeparator
+	if offset >= uint(len(r.data)) {
+		return nil, nil, fmt.Errorf("%w: data pointer out of range", ErrInvalidDatabase)
+	}
+	d := decoder{buf: r.data}
+	record, _, err = d.decode(offset)
+	return record, network, err
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (r *Reader) record(node, bit uint) uint {
+	b := r.buf[node*r.RecordSize/4:]
+	switch r.RecordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// Data types of the data section.
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// maxDepth is the max depth of nested values, to stop decoding loops of pointers in malformed databases.
+const maxDepth = 32
+
+type decoder struct {
+	buf   []byte
+	depth int
+}
+
+// decode decodes the value at offset, and returns it with the offset of the next value.
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+	if d.depth++; d.depth > maxDepth {
+		return nil, 0, errors.New("values are nested too deep")
+	}
+	defer func() { d.depth-- }()
+	typ, size, offset, err := d.decodeControl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == typePointer {
+		v, _, err := d.decode(size)
+		return v, offset, err
+	}
+	switch typ {
+	case typeBool:
+		return size != 0, offset, nil
+	case typeMap:
+		m := make(map[string]interface{})
+		for i := uint(0); i < size; i++ {
+			k, o, err := d.decode(offset)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			if m[key], offset, err = d.decode(o); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case typeArray:
+		if size > uint(len(d.buf)) {
+			return nil, 0, errors.New("array exceeds the data section")
+		}
+		a := make([]interface{}, size)
+		for i := range a {
+			if a[i], offset, err = d.decode(offset); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return nil, 0, errors.New("value exceeds the data section")
+	}
+	b := d.buf[offset : offset+size]
+	next := offset + size
+
+	switch typ {
+	case typeString:
+		return string(b), next, nil
+	case typeBytes:
+		return append([]byte(nil), b...), next, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errors.New("invalid double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), next, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errors.New("invalid float size")
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), next, nil
+	case typeUint16, typeUint32, typeUint64:
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v, next, nil
+	case typeInt32:
+		var v uint32
+		for _, c := range b {
+			v = v<<8 | uint32(c)
+		}
+		return int32(v), next, nil
+	case typeUint128:
+		return append([]byte(nil), b...), next, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+}
+
+// decodeControl decodes the control byte(s) at offset, and returns the type and size of the value, and its offset.
+// The size of a pointer is the offset it points to.
+func (d *decoder) decodeControl(offset uint) (typ, size, next uint, err error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, errors.New("offset exceeds the data section")
+	}
+	ctrl := d.buf[offset]
+	offset++
+	typ = uint(ctrl >> 5)
+	if typ == typeExtended {
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, errors.New("unexpected end of the data section")
+		}
+		typ = 7 + uint(d.buf[offset])
+		offset++
+	}
+
+	// Integers following the control byte, of n bytes.
+	follow := func(n uint) (uint, error) {
+		if offset+n > uint(len(d.buf)) {
+			return 0, errors.New("unexpected end of the data section")
+		}
+		var v uint
+		for _, c := range d.buf[offset : offset+n] {
+			v = v<<8 | uint(c)
+		}
+		offset += n
+		return v, nil
+	}
+
+	if typ == typePointer {
+		n := uint(ctrl>>3&0x3) + 1
+		v, err := follow(n)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		switch n {
+		case 1:
+			size = uint(ctrl&0x7)<<8 | v
+		case 2:
+			size = (uint(ctrl&0x7)<<16 | v) + 2048
+		case 3:
+			size = (uint(ctrl&0x7)<<24 | v) + 526336
+		default:
+			size = v
+		}
+		return typ, size, offset, nil
+	}
+
+	size = uint(ctrl & 0x1f)
+	switch size {
+	case 29:
+		size, err = follow(1)
+		size += 29
+	case 30:
+		size, err = follow(2)
+		size += 285
+	case 31:
+		size, err = follow(3)
+		size += 65821
+	}
+	return typ, size, offset, err
+}
+
+func toUint(v interface{}) uint64 {
+	u, _ := v.(uint64)
+	return u
+}
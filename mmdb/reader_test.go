@@ -0,0 +1,235 @@
+package mmdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// ctrl encodes the control byte(s) of a value of typ and size, which is less than 29.
+func ctrl(typ, size int) []byte {
+	if typ < 8 {
+		return []byte{byte(typ<<5 | size)}
+	}
+	return []byte{byte(size), byte(typ - 7)}
+}
+
+func str(s string) []byte { return append(ctrl(typeString, len(s)), s...) }
+
+func uint32Val(v uint32) []byte {
+	b := append(ctrl(typeUint32, 4), 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[1:], v)
+	return b
+}
+
+func cat(parts ...[]byte) (b []byte) {
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return
+}
+
+// country encodes a record of a country database, like {"country": {"iso_code": code}}.
+func country(code string) []byte {
+	return cat(ctrl(typeMap, 1), str("country"), ctrl(typeMap, 1), str("iso_code"), str(code))
+}
+
+// buildDB builds a database of ipVersion and recordSize, mapping networks to country codes. IPv4 networks are
+// inserted at ::/96 in IPv6 databases.
+func buildDB(t *testing.T, ipVersion, recordSize int, countries map[string]string) []byte {
+	t.Helper()
+	// Records are node indexes, emptyRecord, or -(data offset) - 1.
+	const emptyRecord = 1 << 30
+	nodes := [][2]int{{emptyRecord, emptyRecord}}
+	var data []byte
+	for cidr, code := range countries {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, bits := network.Mask.Size()
+		ip := network.IP.To4()
+		if ipVersion == 6 {
+			ip = network.IP.To16()
+			if bits == 32 {
+				ip, ones = append(make(net.IP, 12), network.IP.To4()...), ones+96
+			}
+		}
+		offset := len(data)
+		data = append(data, country(code)...)
+
+		node := 0
+		for depth := 0; depth < ones; depth++ {
+			bit := ip[depth/8] >> (7 - depth%8) & 1
+			if depth == ones-1 {
+				nodes[node][bit] = -offset - 1
+				break
+			}
+			if nodes[node][bit] == emptyRecord {
+				nodes = append(nodes, [2]int{emptyRecord, emptyRecord})
+				nodes[node][bit] = len(nodes) - 1
+			}
+			node = nodes[node][bit]
+		}
+	}
+
+	var buf []byte
+	n := len(nodes)
+	for _, node := range nodes {
+		var v [2]uint32
+		for i, r := range node {
+			v[i] = uint32(r)
+			if r == emptyRecord {
+				v[i] = uint32(n)
+			} else if r < 0 {
+				v[i] = uint32(n + dataSectionSeparator - r - 1)
+			}
+		}
+		switch recordSize {
+		case 24:
+			buf = append(buf, byte(v[0]>>16), byte(v[0]>>8), byte(v[0]), byte(v[1]>>16), byte(v[1]>>8), byte(v[1]))
+		case 28:
+			buf = append(buf, byte(v[0]>>16), byte(v[0]>>8), byte(v[0]), byte(v[0]>>20&0xF0|v[1]>>24&0x0F),
+				byte(v[1]>>16), byte(v[1]>>8), byte(v[1]))
+		case 32:
+			buf = append(buf, make([]byte, 8)...)
+			binary.BigEndian.PutUint32(buf[len(buf)-8:], v[0])
+			binary.BigEndian.PutUint32(buf[len(buf)-4:], v[1])
+		}
+	}
+	buf = append(buf, make([]byte, dataSectionSeparator)...)
+	buf = append(buf, data...)
+	buf = append(buf, metadataMarker...)
+	return append(buf, cat(ctrl(typeMap, 5),
+		str("node_count"), uint32Val(uint32(n)),
+		str("record_size"), uint32Val(uint32(recordSize)),
+		str("ip_version"), uint32Val(uint32(ipVersion)),
+		str("database_type"), str("Test-Country"),
+		str("build_epoch"), uint32Val(1600000000))...)
+}
+
+func TestLookup(t *testing.T) {
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			countries := map[string]string{"1.0.1.0/24": "CN", "8.8.8.0/24": "US"}
+			if ipVersion == 6 {
+				countries["240e::/20"] = "CN"
+			}
+			r, err := FromBytes(buildDB(t, ipVersion, recordSize, countries))
+			if err != nil {
+				t.Fatalf("IPv%d, record size %d: %v", ipVersion, recordSize, err)
+			}
+			if r.IPVersion != uint(ipVersion) || r.RecordSize != uint(recordSize) || r.DatabaseType != "Test-Country" ||
+				r.BuildEpoch != 1600000000 {
+				t.Errorf("IPv%d, record size %d: unexpected metadata %+v", ipVersion, recordSize, r.Metadata)
+			}
+
+			tests := []struct {
+				ip, country, network string
+			}{
+				{"1.0.1.1", "CN", "1.0.1.0/24"},
+				{"8.8.8.8", "US", "8.8.8.0/24"},
+				{"1.0.2.1", "", ""},
+				{"240e::1", "CN", "240e::/20"},
+				{"2001:db8::1", "", ""},
+			}
+			for _, tt := range tests {
+				record, network, err := r.Lookup(net.ParseIP(tt.ip))
+				if err != nil {
+					t.Fatalf("IPv%d, record size %d: Lookup(%s): %v", ipVersion, recordSize, tt.ip, err)
+				}
+				if ipVersion == 4 && tt.ip == "240e::1" {
+					tt.country, tt.network = "", ""
+				}
+				var got string
+				if record != nil {
+					got, _ = record.(map[string]interface{})["country"].(map[string]interface{})["iso_code"].(string)
+				}
+				if got != tt.country {
+					t.Errorf("IPv%d, record size %d: Lookup(%s) = %v, want %s", ipVersion, recordSize, tt.ip, record, tt.country)
+				}
+				if tt.network != "" && (network == nil || network.String() != tt.network) {
+					t.Errorf("IPv%d, record size %d: network of %s = %v, want %s", ipVersion, recordSize, tt.ip, network, tt.network)
+				}
+			}
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	double := make([]byte, 8)
+	binary.BigEndian.PutUint64(double, math.Float64bits(1.5))
+	float := make([]byte, 4)
+	binary.BigEndian.PutUint32(float, math.Float32bits(2.5))
+	tests := []struct {
+		name string
+		buf  []byte
+		want interface{}
+	}{
+		{"string", str("CN"), "CN"},
+		{"double", cat(ctrl(typeDouble, 8), double), 1.5},
+		{"float", cat(ctrl(typeFloat, 4), float), float32(2.5)},
+		{"bytes", cat(ctrl(typeBytes, 2), []byte{1, 2}), []byte{1, 2}},
+		{"uint16", cat(ctrl(typeUint16, 2), []byte{1, 0}), uint64(256)},
+		{"uint32", uint32Val(70000), uint64(70000)},
+		{"uint64", cat(ctrl(typeUint64, 5), []byte{1, 0, 0, 0, 0}), uint64(1 << 32)},
+		{"uint128", cat(ctrl(typeUint128, 1), []byte{9}), []byte{9}},
+		{"int32", cat(ctrl(typeInt32, 4), []byte{0xff, 0xff, 0xff, 0xfe}), int32(-2)},
+		{"bool", ctrl(typeBool, 1), true},
+		{"array", cat(ctrl(typeArray, 2), str("a"), str("b")), []interface{}{"a", "b"}},
+		{"map", cat(ctrl(typeMap, 1), str("k"), str("v")), map[string]interface{}{"k": "v"}},
+		// A pointer to the string after it, of 1 byte following the control byte.
+		{"pointer", cat([]byte{typePointer << 5, 2}, str("p")), "p"},
+		{"long string", cat(ctrl(typeString, 29), []byte{1}, bytes.Repeat([]byte("x"), 30)), string(bytes.Repeat([]byte("x"), 30))},
+	}
+	for _, tt := range tests {
+		d := decoder{buf: tt.buf}
+		got, _, err := d.decode(0)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+
+	for name, buf := range map[string][]byte{
+		"pointer loop":     {typePointer << 5, 0},
+		"truncated string": str("CN")[:2],
+		"invalid double":   cat(ctrl(typeDouble, 4), float),
+		"non-string key":   cat(ctrl(typeMap, 1), uint32Val(1), str("v")),
+		"empty":            nil,
+	} {
+		d := decoder{buf: buf}
+		if _, _, err := d.decode(0); err == nil {
+			t.Errorf("%s should fail", name)
+		}
+	}
+}
+
+func TestFromBytesInvalid(t *testing.T) {
+	valid := buildDB(t, 4, 24, map[string]string{"1.0.1.0/24": "CN"})
+	i := bytes.LastIndex(valid, metadataMarker)
+	meta := func(recordSize, ipVersion, nodeCount uint32) []byte {
+		return cat(valid[:i], metadataMarker, ctrl(typeMap, 3),
+			str("node_count"), uint32Val(nodeCount),
+			str("record_size"), uint32Val(recordSize),
+			str("ip_version"), uint32Val(ipVersion))
+	}
+	for name, buf := range map[string][]byte{
+		"no metadata":         valid[:i],
+		"metadata not a map":  cat(valid[:i], metadataMarker, str("CN")),
+		"record size":         meta(16, 4, 1),
+		"IP version":          meta(24, 5, 1),
+		"tree exceeding file": meta(24, 4, 1000),
+	} {
+		if _, err := FromBytes(buf); !errors.Is(err, ErrInvalidDatabase) {
+			t.Errorf("%s: expect ErrInvalidDatabase, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Strategies of compression pointer mutation. Mutation only applies to trusted UDP and TCP resolvers.
+const (
+	MutationNever    = "never"
+	MutationAlways   = "always"
+	MutationPolluted = "polluted" // only for domains in polluted domain list or mutation domain list
+)
+
+func checkMutationStrategy(strategy string) error {
+	switch strategy {
+	case "", MutationNever, MutationAlways, MutationPolluted:
+		return nil
+	}
+	return fmt.Errorf("unknown mutation strategy: %s", strategy)
+}
+
+// mutationStrategy returns the mutation strategy for server.
+// The strategy of the resolver takes precedence over the server's, which defaults to the client's Mutation switch.
+func (s *Server) mutationStrategy(server *Resolver) string {
+	if strategy := server.params().mutation; strategy != "" {
+		return strategy
+	}
+	return s.defaultMutationStrategy()
+}
+
+// defaultMutationStrategy returns the mutation strategy of resolvers which don't override it.
+func (s *Server) defaultMutationStrategy() string {
+	if s.MutationStrategy != "" {
+		return s.MutationStrategy
+	}
+	if s.Mutation {
+		return MutationAlways
+	}
+	return MutationNever
+}
+
+func (s *Server) shouldMutate(name string, server *Resolver) bool {
+	switch s.mutationStrategy(server) {
+	case MutationAlways:
+		return true
+	case MutationPolluted:
+		s.listsMu.RLock()
+		defer s.listsMu.RUnlock()
+		return s.DomainPolluted.Contain(name) || s.PollutedSites.Contain(name) || s.MutationDomains.Contain(name)
+	}
+	return false
+}
+
+// lookupTrusted looks up req in a trusted server, with pointer mutation if the strategy says so,
+// and ECS of the trusted policy. The query goes through TrustedProxy if set.
+func (s *Server) lookupTrusted(ctx context.Context, req *dns.Msg, server *Resolver) (reply *dns.Msg, rtt time.Duration, err error) {
+	c := s.trustedClient()
+	s.budgets.Spend(server)
+	policy := s.ecsPolicy(server, true)
+	applyECS(req, policy)
+	if s.shouldMutate(req.Question[0].Name, server) {
+		reply, rtt, err = c.lookupMutation(ctx, req, server)
+	} else {
+		reply, rtt, err = c.lookupNormal(ctx, req, server)
+	}
+	if reply != nil && policy != "" && policy != ECSForward {
+		removeECS(reply)
+	}
+	return
+}
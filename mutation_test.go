@@ -0,0 +1,37 @@
+package gochinadns
+
+import "testing"
+
+func TestShouldMutate(t *testing.T) {
+	o := newServerOptions()
+	o.MutationStrategy = MutationPolluted
+	o.DomainPolluted = new(domainTrie)
+	o.DomainPolluted.Add("google.com")
+	o.MutationDomains = new(domainTrie)
+	o.MutationDomains.Add("twitter.com")
+	s := &Server{serverOptions: o, Client: NewClient()}
+
+	inherit := &Resolver{Addr: "8.8.8.8:53", Protocols: []string{"udp"}}
+	never := &Resolver{Addr: "1.1.1.1:53", Protocols: []string{"udp"}, Mutation: MutationNever}
+	tests := []struct {
+		name   string
+		server *Resolver
+		want   bool
+	}{
+		{"www.google.com.", inherit, true},
+		{"twitter.com.", inherit, true},
+		{"example.com.", inherit, false},
+		{"www.google.com.", never, false},
+	}
+	for _, tt := range tests {
+		if got := s.shouldMutate(tt.name, tt.server); got != tt.want {
+			t.Errorf("shouldMutate(%s, %s) = %v, want %v", tt.name, tt.server, got, tt.want)
+		}
+	}
+
+	s.MutationStrategy = ""
+	s.Client = NewClient(WithMutation(true))
+	if !s.shouldMutate("example.com.", inherit) {
+		t.Error("Strategy should default to the Mutation switch of the client")
+	}
+}
@@ -0,0 +1,50 @@
+// Package netset adds IPs to ipset or nftables sets of the Linux kernel by netlink,
+// so that routing rules of transparent proxies can match them.
+package netset
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrUnsupported is returned on platforms without ipset and nftables.
+var ErrUnsupported = errors.New("ipset and nftables are only supported on Linux")
+
+// Set is a kernel set of IP addresses of a single family.
+type Set interface {
+	// Add adds ip to the set. Adding an existing IP is not an error.
+	Add(ip net.IP) error
+	String() string
+}
+
+// Parse parses spec of a set: "name" for an ipset, or "family@table@set" for an nftables set,
+// where family is one of ip, ip6 and inet.
+func Parse(spec string) (Set, error) {
+	fields := strings.Split(spec, "@")
+	switch len(fields) {
+	case 1:
+		if spec == "" {
+			return nil, errors.New("empty ipset name")
+		}
+		return newIPSet(spec)
+	case 3:
+		family, ok := nftFamilies[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("unsupported nftables family %s", fields[0])
+		}
+		if fields[1] == "" || fields[2] == "" {
+			return nil, fmt.Errorf("table and set are required in %s", spec)
+		}
+		return newNFTSet(fields[0], family, fields[1], fields[2])
+	}
+	return nil, fmt.Errorf("invalid set %s, expect name or family@table@set", spec)
+}
+
+// nftFamilies maps nftables families to NFPROTO_XXX values.
+var nftFamilies = map[string]uint8{
+	"inet": 1,
+	"ip":   2,
+	"ip6":  10,
+}
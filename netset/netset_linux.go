@@ -0,0 +1,263 @@
+package netset
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Constants of netlink and nfnetlink. See linux/netlink.h, linux/netfilter/nfnetlink.h,
+// linux/netfilter/ipset/ip_set.h and linux/netfilter/nf_tables.h.
+const (
+	netlinkNetfilter = 12
+
+	nlmFRequest = 0x1
+	nlmFAck     = 0x4
+	nlmFCreate  = 0x400
+
+	nlmsgError    = 0x2
+	nlmsgHdrLen   = 16
+	nfgenmsgLen   = 4
+	nlaFNested    = 0x8000
+	nlaFByteorder = 0x4000
+
+	nfnlMsgBatchBegin = 0x10
+	nfnlMsgBatchEnd   = 0x11
+	nfnlSubsysIPSet   = 6
+	nfnlSubsysNFT     = 10
+
+	ipsetProtocol     = 6
+	ipsetCmdAdd       = 9
+	ipsetAttrProtocol = 1
+	ipsetAttrSetname  = 2
+	ipsetAttrData     = 7
+	ipsetAttrIP       = 1
+	ipsetAttrIPv4     = 1
+	ipsetAttrIPv6     = 2
+
+	nftMsgNewSetElem     = 12
+	nftaSetElemListTable = 1
+	nftaSetElemListSet   = 2
+	nftaSetElemListElems = 3
+	nftaListElem         = 1
+	nftaSetElemKey       = 1
+	nftaDataValue        = 1
+)
+
+// ackTimeout is the timeout to wait for the ack of a request.
+const ackTimeout = time.Second
+
+var nativeEndian binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 0 {
+		nativeEndian = binary.BigEndian
+	}
+}
+
+// conn is a netfilter netlink socket, opened lazily and reopened after failures.
+type conn struct {
+	mu  sync.Mutex
+	fd  int // -1 if not opened
+	seq uint32
+}
+
+func newConn() *conn {
+	return &conn{fd: -1}
+}
+
+func (c *conn) open() error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, netlinkNetfilter)
+	if err != nil {
+		return fmt.Errorf("fail to open netlink socket: %w", err)
+	}
+	tv := syscall.NsecToTimeval(ackTimeout.Nanoseconds())
+	if err = syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err == nil {
+		err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("fail to set up netlink socket: %w", err)
+	}
+	c.fd = fd
+	return nil
+}
+
+func (c *conn) close() {
+	if c.fd >= 0 {
+		syscall.Close(c.fd)
+		c.fd = -1
+	}
+}
+
+// request sends messages built by build (which gets sequence numbers to use), and waits for the ack of seq ackSeq.
+func (c *conn) request(build func(seq uint32) (msgs []byte, ackSeq uint32)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fd < 0 {
+		if err := c.open(); err != nil {
+			return err
+		}
+	}
+	msgs, ackSeq := build(c.seq + 1)
+	c.seq += 3
+	if err := syscall.Sendto(c.fd, msgs, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		c.close()
+		return fmt.Errorf("fail to send netlink message: %w", err)
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			c.close()
+			return fmt.Errorf("fail to receive netlink ack: %w", err)
+		}
+		for b := buf[:n]; len(b) >= nlmsgHdrLen; {
+			l := int(nativeEndian.Uint32(b))
+			if l < nlmsgHdrLen || l > len(b) {
+				break
+			}
+			typ, seq := nativeEndian.Uint16(b[4:]), nativeEndian.Uint32(b[8:])
+			if typ == nlmsgError && l >= nlmsgHdrLen+4 {
+				if errno := int32(nativeEndian.Uint32(b[nlmsgHdrLen:])); errno != 0 {
+					return syscall.Errno(-errno)
+				}
+				if seq == ackSeq {
+					return nil
+				}
+			}
+			b = b[align(l):]
+		}
+	}
+}
+
+// message builds a netlink message with a nfgenmsg header.
+type message struct {
+	buf []byte
+}
+
+func newMessage(typ, flags uint16, seq uint32, family uint8, resID uint16) *message {
+	m := &message{buf: make([]byte, nlmsgHdrLen+nfgenmsgLen, 128)}
+	nativeEndian.PutUint16(m.buf[4:], typ)
+	nativeEndian.PutUint16(m.buf[6:], flags)
+	nativeEndian.PutUint32(m.buf[8:], seq)
+	m.buf[nlmsgHdrLen] = family
+	binary.BigEndian.PutUint16(m.buf[nlmsgHdrLen+2:], resID)
+	return m
+}
+
+// attr appends an attribute of data.
+func (m *message) attr(typ uint16, data []byte) {
+	hdr := make([]byte, 4)
+	nativeEndian.PutUint16(hdr, uint16(4+len(data)))
+	nativeEndian.PutUint16(hdr[2:], typ)
+	m.buf = append(m.buf, hdr...)
+	m.buf = append(m.buf, data...)
+	m.buf = append(m.buf, make([]byte, align(len(data))-len(data))...)
+}
+
+// nest appends a nested attribute of attributes appended by f.
+func (m *message) nest(typ uint16, f func()) {
+	start := len(m.buf)
+	m.attr(typ|nlaFNested, nil)
+	f()
+	nativeEndian.PutUint16(m.buf[start:], uint16(len(m.buf)-start))
+}
+
+func (m *message) bytes() []byte {
+	nativeEndian.PutUint32(m.buf, uint32(len(m.buf)))
+	return m.buf
+}
+
+func align(l int) int {
+	return (l + 3) &^ 3
+}
+
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
+
+type ipSet struct {
+	name string
+	conn *conn
+}
+
+func newIPSet(name string) (Set, error) {
+	return &ipSet{name: name, conn: newConn()}, nil
+}
+
+func (s *ipSet) Add(ip net.IP) error {
+	return s.conn.request(func(seq uint32) ([]byte, uint32) {
+		return s.message(ip, seq), seq
+	})
+}
+
+// message returns the message adding ip to the set.
+func (s *ipSet) message(ip net.IP, seq uint32) []byte {
+	family, attr := uint8(syscall.AF_INET6), uint16(ipsetAttrIPv6)
+	if ip4 := ip.To4(); ip4 != nil {
+		family, attr, ip = syscall.AF_INET, ipsetAttrIPv4, ip4
+	}
+	m := newMessage(nfnlSubsysIPSet<<8|ipsetCmdAdd, nlmFRequest|nlmFAck, seq, family, 0)
+	m.attr(ipsetAttrProtocol, []byte{ipsetProtocol})
+	m.attr(ipsetAttrSetname, cstring(s.name))
+	m.nest(ipsetAttrData, func() {
+		m.nest(ipsetAttrIP, func() {
+			m.attr(attr|nlaFByteorder, ip)
+		})
+	})
+	return m.bytes()
+}
+
+func (s *ipSet) String() string {
+	return "ipset " + s.name
+}
+
+type nftSet struct {
+	familyName string
+	family     uint8
+	table, set string
+	conn       *conn
+}
+
+func newNFTSet(familyName string, family uint8, table, set string) (Set, error) {
+	return &nftSet{familyName: familyName, family: family, table: table, set: set, conn: newConn()}, nil
+}
+
+func (s *nftSet) Add(ip net.IP) error {
+	return s.conn.request(func(seq uint32) ([]byte, uint32) {
+		return s.messages(ip, seq), seq + 1
+	})
+}
+
+// messages returns the batch of messages adding ip to the set, of sequence numbers from seq to seq+2.
+// Only the second one, of seq+1, is acked.
+func (s *nftSet) messages(ip net.IP, seq uint32) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	begin := newMessage(nfnlMsgBatchBegin, nlmFRequest, seq, syscall.AF_UNSPEC, nfnlSubsysNFT)
+	m := newMessage(nfnlSubsysNFT<<8|nftMsgNewSetElem, nlmFRequest|nlmFCreate|nlmFAck, seq+1, s.family, 0)
+	m.attr(nftaSetElemListTable, cstring(s.table))
+	m.attr(nftaSetElemListSet, cstring(s.set))
+	m.nest(nftaSetElemListElems, func() {
+		m.nest(nftaListElem, func() {
+			m.nest(nftaSetElemKey, func() {
+				m.attr(nftaDataValue, ip)
+			})
+		})
+	})
+	end := newMessage(nfnlMsgBatchEnd, nlmFRequest, seq+2, syscall.AF_UNSPEC, nfnlSubsysNFT)
+	msgs := append(begin.bytes(), m.bytes()...)
+	return append(msgs, end.bytes()...)
+}
+
+func (s *nftSet) String() string {
+	return "nftables set " + s.familyName + "@" + s.table + "@" + s.set
+}
@@ -0,0 +1,142 @@
+package netset
+
+import (
+	"bytes"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// nlmsg is a parsed netlink message.
+type nlmsg struct {
+	typ, flags uint16
+	seq        uint32
+	family     uint8
+	resID      uint16
+	attrs      []byte
+}
+
+// parseMessages parses netlink messages with nfgenmsg headers in b.
+func parseMessages(t *testing.T, b []byte) (msgs []nlmsg) {
+	t.Helper()
+	for len(b) > 0 {
+		l := int(nativeEndian.Uint32(b))
+		if l < nlmsgHdrLen+nfgenmsgLen || l > len(b) {
+			t.Fatalf("Invalid message length %d of %d bytes", l, len(b))
+		}
+		msgs = append(msgs, nlmsg{
+			typ:    nativeEndian.Uint16(b[4:]),
+			flags:  nativeEndian.Uint16(b[6:]),
+			seq:    nativeEndian.Uint32(b[8:]),
+			family: b[nlmsgHdrLen],
+			resID:  uint16(b[nlmsgHdrLen+2])<<8 | uint16(b[nlmsgHdrLen+3]),
+			attrs:  b[nlmsgHdrLen+nfgenmsgLen : l],
+		})
+		b = b[align(l):]
+	}
+	return
+}
+
+// attr returns the data of the attribute of typ (with flags) in attrs, following nested attributes by path.
+func attr(t *testing.T, attrs []byte, path ...uint16) []byte {
+	t.Helper()
+	for len(attrs) >= 4 {
+		l, typ := int(nativeEndian.Uint16(attrs)), nativeEndian.Uint16(attrs[2:])
+		if l < 4 || l > len(attrs) {
+			t.Fatalf("Invalid attribute length %d of %d bytes", l, len(attrs))
+		}
+		if typ == path[0] {
+			if len(path) == 1 {
+				return attrs[4:l]
+			}
+			return attr(t, attrs[4:l], path[1:]...)
+		}
+		attrs = attrs[align(l):]
+	}
+	t.Fatalf("Attribute %#x not found", path[0])
+	return nil
+}
+
+func TestIPSetMessage(t *testing.T) {
+	set, err := Parse("chinadns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.String() != "ipset chinadns" {
+		t.Errorf("Unexpected set %s", set)
+	}
+
+	for _, tc := range []struct {
+		ip     string
+		family uint8
+		attr   uint16
+		want   []byte
+	}{
+		{"8.8.8.8", syscall.AF_INET, ipsetAttrIPv4, []byte{8, 8, 8, 8}},
+		{"2001:db8::1", syscall.AF_INET6, ipsetAttrIPv6, net.ParseIP("2001:db8::1")},
+	} {
+		msgs := parseMessages(t, set.(*ipSet).message(net.ParseIP(tc.ip), 7))
+		if len(msgs) != 1 {
+			t.Fatalf("%s: expect 1 message, got %d", tc.ip, len(msgs))
+		}
+		m := msgs[0]
+		if m.typ != nfnlSubsysIPSet<<8|ipsetCmdAdd || m.flags != nlmFRequest|nlmFAck || m.seq != 7 || m.family != tc.family {
+			t.Errorf("%s: unexpected header %+v", tc.ip, m)
+		}
+		if p := attr(t, m.attrs, ipsetAttrProtocol); !bytes.Equal(p, []byte{ipsetProtocol}) {
+			t.Errorf("%s: unexpected protocol %v", tc.ip, p)
+		}
+		if name := attr(t, m.attrs, ipsetAttrSetname); string(name) != "chinadns\x00" {
+			t.Errorf("%s: unexpected set name %q", tc.ip, name)
+		}
+		ip := attr(t, m.attrs, ipsetAttrData|nlaFNested, ipsetAttrIP|nlaFNested, tc.attr|nlaFByteorder)
+		if !bytes.Equal(ip, tc.want) {
+			t.Errorf("%s: unexpected IP %v", tc.ip, ip)
+		}
+	}
+}
+
+func TestNFTSetMessages(t *testing.T) {
+	set, err := Parse("inet@fw@proxied")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if set.String() != "nftables set inet@fw@proxied" {
+		t.Errorf("Unexpected set %s", set)
+	}
+
+	msgs := parseMessages(t, set.(*nftSet).messages(net.ParseIP("8.8.8.8"), 10))
+	if len(msgs) != 3 {
+		t.Fatalf("Expect a batch of 3 messages, got %d", len(msgs))
+	}
+	begin, m, end := msgs[0], msgs[1], msgs[2]
+	if begin.typ != nfnlMsgBatchBegin || begin.seq != 10 || begin.resID != nfnlSubsysNFT ||
+		end.typ != nfnlMsgBatchEnd || end.seq != 12 || end.resID != nfnlSubsysNFT {
+		t.Errorf("Unexpected batch %+v, %+v", begin, end)
+	}
+	if m.typ != nfnlSubsysNFT<<8|nftMsgNewSetElem || m.flags != nlmFRequest|nlmFCreate|nlmFAck || m.seq != 11 ||
+		m.family != nftFamilies["inet"] {
+		t.Errorf("Unexpected header %+v", m)
+	}
+	if table := attr(t, m.attrs, nftaSetElemListTable); string(table) != "fw\x00" {
+		t.Errorf("Unexpected table %q", table)
+	}
+	if name := attr(t, m.attrs, nftaSetElemListSet); string(name) != "proxied\x00" {
+		t.Errorf("Unexpected set %q", name)
+	}
+	key := attr(t, m.attrs, nftaSetElemListElems|nlaFNested, nftaListElem|nlaFNested, nftaSetElemKey|nlaFNested, nftaDataValue)
+	if !bytes.Equal(key, []byte{8, 8, 8, 8}) {
+		t.Errorf("Unexpected key %v", key)
+	}
+}
+
+func TestAddWithoutSet(t *testing.T) {
+	// The set doesn't exist, or netlink is not permitted, so the error of the ack or the socket is returned.
+	set, err := Parse("chinadns-test-missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = set.Add(net.ParseIP("8.8.8.8")); err == nil {
+		t.Error("Adding to a missing set should fail")
+	}
+}
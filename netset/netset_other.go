@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package netset
+
+func newIPSet(name string) (Set, error) {
+	return nil, ErrUnsupported
+}
+
+func newNFTSet(familyName string, family uint8, table, set string) (Set, error) {
+	return nil, ErrUnsupported
+}
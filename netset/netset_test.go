@@ -0,0 +1,11 @@
+package netset
+
+import "testing"
+
+func TestParse(t *testing.T) {
+	for _, spec := range []string{"", "ip@fw", "bridge@fw@proxied", "ip@@proxied", "ip@fw@"} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) should fail", spec)
+		}
+	}
+}
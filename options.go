@@ -2,13 +2,18 @@ package gochinadns
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/yl2chen/cidranger"
+
+	"github.com/cherrot/gochinadns/clock"
+	"github.com/cherrot/gochinadns/netset"
 )
 
 var (
@@ -20,26 +25,173 @@ type ServerOption func(*serverOptions) error
 
 type serverOptions struct {
 	Listen           string           // Listening address, such as `[::]:53`, `0.0.0.0:53`
+	ExtraListens     []string         // Listening addresses besides Listen, served the same way
+	BindRetries      int              // Times to retry binding a DNS listening address in use
+	BindBackoff      time.Duration    // Wait before the first retry of binding, doubled on each retry
+	FallbackPort     int              // Port to listen for DNS on instead, if a listening address is still in use
 	ChinaCIDR        cidranger.Ranger // CIDR ranger to check whether an IP belongs to China
+	ChinaCIDR6       cidranger.Ranger // Optional CIDR ranger to check IPv6 addresses only, overriding ChinaCIDR
+	ChinaCIDRExclude cidranger.Ranger // Optional CIDR ranger excluded from ChinaCIDR and ChinaCIDR6
+	ChinaBackend     IPMatcher        // Optional backend to check IPs instead of ChinaCIDR, e.g. a GeoIP database
+	ChinaListURL     string           // Optional URL to download a China route list from, used along with ChinaCIDR
+	ChinaListRefresh time.Duration    // Interval to download the China route list again. Disabled if 0.
 	IPBlacklist      cidranger.Ranger
-	DomainBlacklist  *domainTrie
+	DomainBlacklist  *domainList // Domains blocked, matched by suffixes, wildcards or regular expressions
+	DomainWhitelist  *domainTrie // Domains never blocked, overriding DomainBlacklist
 	DomainPolluted   *domainTrie
+	PollutedSites    *domainList   // Domains from gfwlist or geosite.dat, routed like DomainPolluted
+	BlockSchedule    blockSchedule // Domains blocked for some clients during some time windows
+	BlockResponse    string        // Response to blocked queries. See BlockXXX.
+	BlockSinkhole    []net.IP      // IPs to answer blocked A and AAAA questions with, parsed from BlockResponse
+	ECHStrip         *domainTrie   // Domains whose ECH parameters in HTTPS/SVCB records are stripped
+	ECHPreserve      *domainTrie   // Domains whose ECH parameters are always preserved, overriding ECHStrip
 	Servers          resolverList  // DNS servers, will be partitioned into TrustedServers and UntrustedServers in bootstrap.
 	TrustedServers   resolverList  // DNS servers which can be trusted
 	UntrustedServers resolverList  // DNS servers which may return polluted results
 	Bidirectional    bool          // Drop results of trusted servers which containing IPs in China
 	ReusePort        bool          // Enable SO_REUSEPORT
 	Delay            time.Duration // Delay (in seconds) to query another DNS server when no reply received
-	TestDomains      []string      // Domain names to test connection health before starting a server
+	TestDomains      []string      // Domain names to test connection health before starting a server, and in health checks
+	CanaryDomains    []string      // Domain names known to be poisoned, to learn poisoned IPs from untrusted servers
+	CanaryInterval   time.Duration // Interval to query canary domains. Disabled if 0.
 	SkipRefine       bool
+	AdminListen      string // Listening address of the admin HTTP API. Disabled if empty.
+	DebugListen      string // Listening address of pprof and dumps of internal state. Disabled if empty.
+	StatsListen      string // Listening address of read-only counters for dashboards. Disabled if empty.
+	StatsAllowOrigin string // Origin allowed to read the stats listener by CORS. Any origin if empty.
+	Language         string // Language of user-facing messages, like errors of the admin API. See LangXXX.
+	UbusSocket       string // Path of the ubusd socket to register the server on. Disabled if empty.
+	WhoAnswered      bool   // Answer TXT questions like `whoanswered.example.com.chinadns.` with provenance of answers
+	Shuffle          string // Mode to reorder A/AAAA records in answers. See ShuffleXXX for available modes.
+
+	ForeignSets4        []netset.Set     // Kernel sets to add IPv4 addresses outside China in trusted answers to
+	ForeignSets6        []netset.Set     // Kernel sets to add IPv6 addresses outside China in trusted answers to
+	IPSetMinTTL         time.Duration    // Min TTL of answers with IPs served while foreign IP sets are active. Disabled if 0.
+	Hosts               *hostsTable      // Static records answered locally
+	PermissiveLists     bool             // Skip bad lines and missing files of lists. See WithPermissiveLists.
+	ListErrors          listErrors       // Errors of loading lists
+	RewriteRules        *rewriteTable    // Rules to rewrite answers of names
+	Tenants             *tenantTable     // Named client networks to break down stats and query logs by
+	ForwardRules        forwardTable     // Domains routed to designated upstreams, bypassing the trusted/untrusted race
+	MutationStrategy    string           // See MutationXXX. Defaults to the Mutation switch of the client if empty.
+	MutationDomains     *domainTrie      // Domains to mutate queries of with MutationPolluted strategy, besides polluted domains.
+	ProbeInterval       time.Duration    // Interval to probe capabilities of UDP and TCP upstreams. Disabled if 0.
+	HealthCheckInterval time.Duration    // Interval to check health of upstreams, and skip failing ones. Disabled if 0.
+	AuditInterval       time.Duration    // Interval to audit consistency of answers of both groups. Disabled if 0.
+	AuditSample         int              // Number of recently answered questions audited per round
+	Selection           string           // Strategy to select upstreams within a group. See SelectXXX.
+	PinUpstreams        bool             // Pin each client to an upstream within each group. See WithPinning.
+	Budgets             []UpstreamBudget // Query budgets of upstreams. See WithUpstreamBudgets.
+	OpportunisticDoT    bool             // Upgrade UDP and TCP upstreams to DoT if probed available
+	DDR                 bool             // Upgrade UDP and TCP upstreams to DoT discovered by DDR. See WithDDR.
+	ECSTrusted          string           // ECS policy of trusted resolvers. See ECSXXX. Defaults to forward if empty.
+	ECSUntrusted        string           // ECS policy of untrusted resolvers. See ECSXXX. Defaults to forward if empty.
+	DNSSEC              bool             // Validate DNSSEC signatures of trusted answers
+	TrustedProxy        string           // Proxy URL to query trusted servers through, such as socks5://127.0.0.1:1080
+	GoroutineMaxAge     time.Duration    // Lookup goroutines running longer than it are logged and canceled. Disabled if 0.
+	DualStackPreference string           // Preferred family when A and AAAA answers mismatch in locality. See DualStackXXX.
+	AAAAMode            string           // Mode of handling AAAA questions and answers. See AAAAXXX.
+	DNS64Prefix         *net.IPNet       // NAT64 prefix to synthesize AAAA records from A records with. Disabled if nil.
+	PrefetchCounterpart bool             // Resolve and cache AAAA questions along with A questions, and vice versa
+	CaseRandomization   bool             // Randomize the case of question names sent to untrusted resolvers. See WithCaseRandomization.
+	RecursionMode       string           // Mode of handling the RD bit of queries. See RecursionXXX.
+	BlockedQTypes       map[uint16]bool  // Query types answered by QTypeAction without querying upstreams
+	QTypeAction         string           // Action on queries of BlockedQTypes. See QTypeXXX.
+	AnomalyEntropy      float64          // Entropy of labels to flag names as anomalous. Disabled if 0. See WithNameAnomalies.
+	AnomalyAction       string           // Action on queries of anomalous names. See AnomalyXXX.
+	AnomalyQPS          float64          // Rate of queries of anomalous names allowed per client with AnomalyLimit
+	TunnelWindow        time.Duration    // Window of detecting clients tunneling through DNS. Disabled if 0.
+	TunnelAction        string           // Action on clients detected tunneling. See TunnelXXX.
+	TunnelLabelLen      int              // Length of labels deemed long by tunnel detection
+	TunnelSubdomains    int              // Unique names under a domain in a window beyond which a client is tunneling
+	TunnelTXTRatio      float64          // Share of TXT and NULL queries under a domain from which a client is tunneling
+	StatsPeriod         time.Duration    // Period of rolling counters of queries by domain, client and upstream. Disabled if 0.
+	RcodePolicy         string           // Policy of error rcodes in untrusted replies. See RcodeXXX.
+	EmptyAnswerPolicy   string           // Policy of empty answers in untrusted replies. See EmptyAnswerXXX.
+	TrustedSettings     string           // Default parameters of trusted resolvers, like timeout=5s. See WithGroupSettings.
+	UntrustedSettings   string           // Default parameters of untrusted resolvers. See WithGroupSettings.
+	AnswerMatch         string           // Policy of locating answers with multiple IPs. See AnswerMatchXXX.
+	VerdictTTL          time.Duration    // How long verdicts of domains route their queries to a group. Disabled if 0.
+	CNAMEChaseDepth     int              // Max follow-up queries chasing a dangling CNAME chain. Disabled if 0.
+	Scorer              Scorer           // Scorer of replies to pick the best one. The first acceptable one is picked if nil.
+	ScoreBudget         time.Duration    // Latency budget to wait for replies to score
+	CacheStrategies     []*cacheStrategy // How answers of domain sets are cached. The first set containing a name applies.
+	VerdictStore        VerdictStore     // Optional store to share verdicts with other servers
+	DegradeAfter        time.Duration    // Untrusted upstreams slower than trusted ones for it are degraded. Disabled if 0.
+	VerifyStrikes       int              // Disagreements of trusted servers with China answers to flag a domain. Disabled if 0.
+
+	QueryTimeout   time.Duration // Deadline to resolve a query of a UDP client, doubled for TCP clients. Defaults to 5s if 0.
+	TCPReadTimeout time.Duration // Timeout to read the first query of a TCP connection. Defaults to 2s if 0.
+	TCPIdleTimeout time.Duration // Timeout to wait for subsequent queries of a TCP connection. Defaults to 8s if 0.
+	TCPMaxConns    int           // Max concurrent TCP connections. Unlimited if 0.
+	TCPMaxQueries  int           // Max queries per TCP connection. Defaults to 128 if 0, and unlimited if negative.
+	MaxInFlight    int           // Max queries served at a time. Unlimited if 0.
+	MaxQueued      int           // Max queries waiting for a slot beyond MaxInFlight, rejected beyond it
+
+	RateLimitQPS    float64 // Max UDP queries per second of each client on average. Disabled if 0.
+	RateLimitBurst  int     // Max UDP queries of each client in a burst
+	RateLimitAction string  // Action on queries beyond the rate limit. See RateLimitXXX.
+
+	QueryLog        string // Path of the query log. Disabled if empty.
+	QueryLogFormat  string // Format of the query log. See QueryLogXXX.
+	QueryLogMaxSize int64  // Size of the query log to rotate at. Never rotated if 0.
+	QueryLogBackups int    // Number of rotated query logs to keep
+
+	Mirror        string  // Target (host:port) to mirror queries and answers to over UDP. Disabled if empty.
+	MirrorPercent float64 // Percent of queries to mirror
+
+	CacheEntries  int           // Max entries of the response cache. Cache is disabled if 0.
+	CacheMaxBytes int           // Max estimated memory usage of the response cache. Unlimited if 0.
+	ServeStale    time.Duration // How long expired answers are kept to serve when upstreams fail (RFC 8767). Disabled if 0.
+	FailurePolicy []string      // Steps tried in order when all upstreams fail, before answering SERVFAIL. See FailureXXX.
+	Cache         Cache         // Cache backend. An in-memory cache bounded by CacheEntries and CacheMaxBytes is used if nil.
+	CacheFile     string        // File to save the response cache to on shutdown, and load it from on start. Disabled if empty.
+	Redis         string        // URL of the Redis server sharing the cache and verdicts, with the password redacted
+	MemoryLimit   int           // Estimated memory usage of the process beyond which the cache is shrunk. Disabled if 0.
+	GCPercent     int           // GC target percentage set on start. Unchanged if 0.
+	MinTTL        time.Duration // TTLs of answers from upstreams are raised to it. Disabled if 0.
+	MaxTTL        time.Duration // TTLs of answers from upstreams are lowered to it. Disabled if 0.
+
+	DoTListen      string           // Listening address of DNS over TLS. Disabled if empty.
+	DoHListen      string           // Listening address of DNS over HTTPS. Disabled if empty.
+	DoHPath        string           // URL path of DNS over HTTPS
+	TLSCertificate *tls.Certificate // Certificate of DoT and DoH servers
+
+	SocketActivation bool // Use listening sockets passed by the init system, see WithSocketActivation
+
+	AllowedClients []*net.IPNet // Networks of clients allowed to query. All clients are allowed if empty.
+
+	Clock clock.Clock // Clock pacing lookups and expiring cache entries and budgets. See WithClock.
 }
 
 func newServerOptions() *serverOptions {
 	return &serverOptions{
-		Listen:      "[::]:53",
-		TestDomains: []string{"qq.com"},
-		ChinaCIDR:   cidranger.NewPCTrieRanger(),
-		IPBlacklist: cidranger.NewPCTrieRanger(),
+		Listen:           "[::]:53",
+		DoHPath:          DefaultDoHPath,
+		SocketActivation: true,
+		BindBackoff:      time.Second,
+		TestDomains:      []string{"qq.com"},
+		Selection:        SelectSequential,
+		BlockResponse:    BlockEmpty,
+		TunnelLabelLen:   40,
+		TunnelSubdomains: 100,
+		TunnelTXTRatio:   0.5,
+		GoroutineMaxAge:  time.Minute,
+		FailurePolicy:    []string{FailureStale},
+		Language:         LangEnglish,
+		ChinaCIDR:        cidranger.NewPCTrieRanger(),
+		IPBlacklist:      cidranger.NewPCTrieRanger(),
+		Clock:            clock.Real,
+	}
+}
+
+// WithClock replaces the clock of the server, which paces lookups in upstreams, expires entries of the in-memory
+// cache and budgets, times health checks and measures latency. A clock.Fake makes them deterministic in tests.
+// Timeouts of queries and exchanges are still timed by the system clock.
+func WithClock(c clock.Clock) ServerOption {
+	return func(o *serverOptions) error {
+		o.Clock = c
+		return nil
 	}
 }
 
@@ -50,126 +202,291 @@ func WithListenAddr(addr string) ServerOption {
 	}
 }
 
-func WithCHNList(path string) ServerOption {
+// WithListenAddrs listens on all of addrs, such as `127.0.0.1:53` and `[::1]:5353`, each by UDP and TCP.
+// The first address replaces the one of WithListenAddr.
+func WithListenAddrs(addrs ...string) ServerOption {
 	return func(o *serverOptions) error {
-		if path == "" {
-			return fmt.Errorf("%w for China route list", ErrEmptyPath)
+		if len(addrs) == 0 {
+			return errors.New("no listening address")
 		}
-		file, err := os.Open(path)
-		if err != nil {
-			return fmt.Errorf("fail to open China route list: %w", err)
+		o.Listen, o.ExtraListens = addrs[0], addrs[1:]
+		return nil
+	}
+}
 
-		}
-		defer file.Close()
+func WithAdminListenAddr(addr string) ServerOption {
+	return func(o *serverOptions) error {
+		o.AdminListen = addr
+		return nil
+	}
+}
 
-		if o.ChinaCIDR == nil {
-			o.ChinaCIDR = cidranger.NewPCTrieRanger()
-		}
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			_, network, err := net.ParseCIDR(scanner.Text())
-			if err != nil {
-				return fmt.Errorf("parse %s as CIDR failed: %v", scanner.Text(), err.Error())
-			}
-			err = o.ChinaCIDR.Insert(cidranger.NewBasicRangerEntry(*network))
-			if err != nil {
-				return fmt.Errorf("insert %s as CIDR failed: %v", scanner.Text(), err.Error())
-			}
-		}
-		if err := scanner.Err(); err != nil {
-			return fmt.Errorf("fail to scan china route list: %v", err.Error())
+// WithMutationStrategy sets the compression pointer mutation strategy of trusted resolvers. See MutationXXX.
+// It can be overridden per resolver by `ip[:port]?mutation=strategy`.
+func WithMutationStrategy(strategy string) ServerOption {
+	return func(o *serverOptions) error {
+		if err := checkMutationStrategy(strategy); err != nil {
+			return err
 		}
+		o.MutationStrategy = strategy
 		return nil
 	}
 }
 
-func WithIPBlacklist(path string) ServerOption {
+// WithMutationDomains loads domains to mutate queries of with MutationPolluted strategy, besides polluted domains.
+func WithMutationDomains(path string) ServerOption {
+	return func(o *serverOptions) (err error) {
+		o.MutationDomains, err = loadDomainTrie(o.MutationDomains, path, "mutation domain list", &o.ListErrors)
+		return
+	}
+}
+
+// WithProbeInterval enables probing capabilities of UDP and TCP upstreams on start and every interval.
+// Transports of upstreams declared in ip[:port] format, and EDNS UDP size of queries, are chosen by probed capabilities.
+func WithProbeInterval(interval time.Duration) ServerOption {
 	return func(o *serverOptions) error {
-		if path == "" {
-			return fmt.Errorf("%w for IP blacklist", ErrEmptyPath)
+		if interval < 0 {
+			return fmt.Errorf("invalid probe interval: %s", interval)
 		}
-		file, err := os.Open(path)
-		if err != nil {
-			return fmt.Errorf("fail to open IP blacklist: %w", err)
-		}
-		defer file.Close()
+		o.ProbeInterval = interval
+		return nil
+	}
+}
+
+// WithOpportunisticDoT upgrades UDP and TCP upstreams to DoT on port 853 of the same IP, if DoT is found available
+// by probing (see WithProbeInterval) with a certificate valid for the IP. Once a DoT query succeeds,
+// the upstream is pinned to DoT and never falls back to plain transports, to protect against downgrade attacks.
+func WithOpportunisticDoT(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.OpportunisticDoT = b
+		return nil
+	}
+}
 
-		if o.IPBlacklist == nil {
-			o.IPBlacklist = cidranger.NewPCTrieRanger()
+// WithGoroutineMaxAge sets the max age of goroutines looking up a query.
+// Goroutines running longer are logged and canceled by a watchdog. Set to 0 to disable the watchdog.
+func WithGoroutineMaxAge(d time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if d < 0 {
+			return fmt.Errorf("invalid goroutine max age: %s", d)
 		}
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			_, network, err := net.ParseCIDR(scanner.Text())
-			if err != nil {
-				ip := net.ParseIP(scanner.Text())
-				if ip == nil {
-					return fmt.Errorf("parse %s as CIDR failed: %v", scanner.Text(), err.Error())
-				}
-				l := 8 * len(ip)
-				network = &net.IPNet{IP: ip, Mask: net.CIDRMask(l, l)}
-			}
-			err = o.IPBlacklist.Insert(cidranger.NewBasicRangerEntry(*network))
-			if err != nil {
-				return fmt.Errorf("insert %s as CIDR failed: %v", scanner.Text(), err.Error())
-			}
+		o.GoroutineMaxAge = d
+		return nil
+	}
+}
+
+// WithWhoAnswered enables answering TXT questions like `whoanswered.example.com.chinadns.`
+// with the upstream and decision which produced the latest answers of `example.com`.
+func WithWhoAnswered(b bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.WhoAnswered = b
+		return nil
+	}
+}
+
+// WithAnswerShuffle reorders A/AAAA records in answers randomly, in a round-robin way, or by speed reports of
+// external tools (see Server.ReportSpeed), instead of always returning them in upstream order.
+func WithAnswerShuffle(mode string) ServerOption {
+	return func(o *serverOptions) error {
+		if _, err := newShuffler(mode); err != nil {
+			return err
 		}
-		if err := scanner.Err(); err != nil {
-			return fmt.Errorf("fail to scan IP blacklist: %v", err.Error())
+		o.Shuffle = mode
+		return nil
+	}
+}
+
+// WithCache enables the response cache, bounded by max entries and estimated memory usage (unlimited if 0).
+func WithCache(maxEntries, maxBytes int) ServerOption {
+	return func(o *serverOptions) error {
+		if maxEntries < 0 || maxBytes < 0 {
+			return fmt.Errorf("invalid cache size: %d entries, %d bytes", maxEntries, maxBytes)
 		}
+		o.CacheEntries = maxEntries
+		o.CacheMaxBytes = maxBytes
 		return nil
 	}
 }
 
-func WithDomainBlacklist(path string) ServerOption {
+// WithQueryTimeout sets the deadline to resolve a query of a UDP client, after which lookups in upstreams are given up
+// and their sockets are closed. TCP clients get twice of it. It's never shorter than the timeout of the client, and
+// defaults to 5s if 0, when stub resolvers usually have retried or given up.
+func WithQueryTimeout(timeout time.Duration) ServerOption {
 	return func(o *serverOptions) error {
-		if path == "" {
-			return fmt.Errorf("%w for domain blacklist", ErrEmptyPath)
+		if timeout < 0 {
+			return fmt.Errorf("invalid query timeout: %s", timeout)
 		}
-		file, err := os.Open(path)
-		if err != nil {
-			return fmt.Errorf("fail to open domain blacklist: %w", err)
+		o.QueryTimeout = timeout
+		return nil
+	}
+}
+
+// WithTCPTimeouts sets timeouts of TCP connections of the listener: read for the first query, and idle for
+// subsequent ones. The defaults of package dns (2s and 8s) are used if 0.
+func WithTCPTimeouts(read, idle time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if read < 0 || idle < 0 {
+			return fmt.Errorf("invalid TCP timeouts: read %s, idle %s", read, idle)
 		}
-		defer file.Close()
+		o.TCPReadTimeout = read
+		o.TCPIdleTimeout = idle
+		return nil
+	}
+}
 
-		if o.DomainBlacklist == nil {
-			o.DomainBlacklist = new(domainTrie)
+// WithTCPLimits limits concurrent TCP connections (unlimited if 0) and queries per connection (128 if 0, and
+// unlimited if negative) of the listener, so that slow or idle clients can't exhaust resources.
+// Connections over the limits are closed.
+func WithTCPLimits(maxConns, maxQueries int) ServerOption {
+	return func(o *serverOptions) error {
+		if maxConns < 0 {
+			return fmt.Errorf("invalid max TCP connections: %d", maxConns)
 		}
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			o.DomainBlacklist.Add(scanner.Text())
+		o.TCPMaxConns = maxConns
+		o.TCPMaxQueries = maxQueries
+		return nil
+	}
+}
+
+// WithServeStale keeps expired answers in cache for d, to serve when upstreams time out or fail (RFC 8767).
+func WithServeStale(d time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if d < 0 {
+			return fmt.Errorf("invalid serve-stale duration: %s", d)
 		}
-		if err := scanner.Err(); err != nil {
-			return fmt.Errorf("fail to scan domain blacklist: %v", err.Error())
+		o.ServeStale = d
+		return nil
+	}
+}
+
+// WithCacheBackend replaces the in-memory response cache by c.
+func WithCacheBackend(c Cache) ServerOption {
+	return func(o *serverOptions) error {
+		o.Cache = c
+		return nil
+	}
+}
+
+// WithCHNList loads a China route list. It can be applied multiple times to load the union of lists.
+func WithCHNList(path string) ServerOption {
+	return func(o *serverOptions) (err error) {
+		o.ChinaCIDR, err = loadCIDRList(o.ChinaCIDR, path, "China route list", &o.ListErrors)
+		return
+	}
+}
+
+// WithCHNListExclude loads a list of CIDRs which are excluded from China route lists (both IPv4 and IPv6 ones),
+// e.g. a corporate block which should be treated as overseas.
+func WithCHNListExclude(path string) ServerOption {
+	return func(o *serverOptions) (err error) {
+		o.ChinaCIDRExclude, err = loadCIDRList(o.ChinaCIDRExclude, path, "China route exclusion list", &o.ListErrors)
+		return
+	}
+}
+
+// WithCHNList6 loads a separate China route list used to check IPv6 addresses only.
+// This is useful when the quality of IPv6 routes differs from IPv4 ones.
+func WithCHNList6(path string) ServerOption {
+	return func(o *serverOptions) (err error) {
+		o.ChinaCIDR6, err = loadCIDRList(o.ChinaCIDR6, path, "China IPv6 route list", &o.ListErrors)
+		return
+	}
+}
+
+// WithDualStackPreference sets the preferred address family when A and AAAA answers of a domain
+// mismatch in locality. Answers of the other family are dropped. See DualStackXXX for available values.
+func WithDualStackPreference(pref string) ServerOption {
+	return func(o *serverOptions) error {
+		if err := checkDualStackPreference(pref); err != nil {
+			return err
 		}
+		o.DualStackPreference = pref
 		return nil
 	}
 }
 
-func WithDomainPolluted(path string) ServerOption {
+func WithIPBlacklist(path string) ServerOption {
+	return func(o *serverOptions) (err error) {
+		o.IPBlacklist, err = loadCIDRs(o.IPBlacklist, path, "IP blacklist", true, &o.ListErrors)
+		return
+	}
+}
+
+// WithDomainBlacklist loads domains to block. See domainList for the format, and WithBlockResponse for responses.
+func WithDomainBlacklist(path string) ServerOption {
+	return func(o *serverOptions) (err error) {
+		o.DomainBlacklist, err = loadDomainList(o.DomainBlacklist, path, "domain blacklist", &o.ListErrors)
+		return
+	}
+}
+
+// WithDomainWhitelist loads domains which are never blocked even if they hit the domain blacklist.
+func WithDomainWhitelist(path string) ServerOption {
+	return func(o *serverOptions) (err error) {
+		o.DomainWhitelist, err = loadDomainTrie(o.DomainWhitelist, path, "domain whitelist", &o.ListErrors)
+		return
+	}
+}
+
+// WithBlockSchedule loads scheduled blocking rules. See parseScheduledRule for the rule format.
+// Empty lines and lines starting with `#` are ignored.
+func WithBlockSchedule(path string) ServerOption {
 	return func(o *serverOptions) error {
 		if path == "" {
-			return fmt.Errorf("%w for polluted domain list", ErrEmptyPath)
+			return fmt.Errorf("%w for block schedule", ErrEmptyPath)
 		}
 		file, err := os.Open(path)
 		if err != nil {
-			return fmt.Errorf("fail to open polluted domain list: %w", err)
+			return o.ListErrors.add(fmt.Errorf("fail to open block schedule: %w", err))
 		}
 		defer file.Close()
 
-		if o.DomainPolluted == nil {
-			o.DomainPolluted = new(domainTrie)
-		}
 		scanner := bufio.NewScanner(file)
 		for scanner.Scan() {
-			o.DomainPolluted.Add(scanner.Text())
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			rule, err := parseScheduledRule(line)
+			if err != nil {
+				if err := o.ListErrors.add(fmt.Errorf("parse block schedule rule [%s] failed: %w", line, err)); err != nil {
+					return err
+				}
+				continue
+			}
+			o.BlockSchedule = append(o.BlockSchedule, rule)
 		}
 		if err := scanner.Err(); err != nil {
-			return fmt.Errorf("fail to scan polluted domain list: %v", err.Error())
+			return o.ListErrors.add(fmt.Errorf("fail to scan block schedule: %v", err.Error()))
 		}
 		return nil
 	}
 }
 
+// WithECHStrip loads domains whose ECH parameters in HTTPS/SVCB answers will be stripped.
+// Add `.` to the list to strip ECH for all domains.
+func WithECHStrip(path string) ServerOption {
+	return func(o *serverOptions) (err error) {
+		o.ECHStrip, err = loadDomainTrie(o.ECHStrip, path, "ECH strip list", &o.ListErrors)
+		return
+	}
+}
+
+// WithECHPreserve loads domains whose ECH parameters are always preserved, even if they are in ECH strip list.
+func WithECHPreserve(path string) ServerOption {
+	return func(o *serverOptions) (err error) {
+		o.ECHPreserve, err = loadDomainTrie(o.ECHPreserve, path, "ECH preserve list", &o.ListErrors)
+		return
+	}
+}
+
+func WithDomainPolluted(path string) ServerOption {
+	return func(o *serverOptions) (err error) {
+		o.DomainPolluted, err = loadDomainTrie(o.DomainPolluted, path, "polluted domain list", &o.ListErrors)
+		return
+	}
+}
+
 func WithTrustedResolvers(tcpOnly bool, resolvers ...string) ServerOption {
 	return func(o *serverOptions) error {
 		for _, schema := range resolvers {
@@ -196,6 +513,53 @@ func WithResolvers(tcpOnly bool, resolvers ...string) ServerOption {
 	}
 }
 
+// WithGroupSettings sets default parameters of resolvers of the trusted group if trusted is true, or of the untrusted
+// group otherwise, in the format of resolvers like `timeout=5s&mutation=never&tcp=true` (see ParseResolver).
+// Parameters of a resolver take precedence, and tcp only applies to resolvers in ip[:port] format. Unlike parameters
+// of resolvers, they apply to DoH resolvers too.
+func WithGroupSettings(trusted bool, params string) ServerOption {
+	return func(o *serverOptions) error {
+		if _, err := parseResolverParams(params); err != nil {
+			return fmt.Errorf("invalid settings of resolvers [%s]: %w", params, err)
+		}
+		if trusted {
+			o.TrustedSettings = params
+		} else {
+			o.UntrustedSettings = params
+		}
+		return nil
+	}
+}
+
+// groupSettings returns default parameters of resolvers of the trusted group if trusted is true, or of the untrusted
+// group otherwise.
+func (o *serverOptions) groupSettings(trusted bool) resolverParams {
+	params := o.UntrustedSettings
+	if trusted {
+		params = o.TrustedSettings
+	}
+	p, _ := parseResolverParams(params) // checked by WithGroupSettings
+	return p
+}
+
+// WithUpstreams adds resolvers of custom upstreams (see NewUpstreamResolver), which are trusted if trusted is true,
+// and untrusted otherwise, since they can't be located by China route lists.
+func WithUpstreams(trusted bool, resolvers ...*Resolver) ServerOption {
+	return func(o *serverOptions) error {
+		for _, r := range resolvers {
+			if r == nil || r.upstream == nil {
+				return fmt.Errorf("%w: not a custom upstream", ErrInvalidResolver)
+			}
+			if trusted {
+				o.TrustedServers = uniqueAppendResolver(o.TrustedServers, r)
+			} else {
+				o.Servers = uniqueAppendResolver(o.Servers, r)
+			}
+		}
+		return nil
+	}
+}
+
 func uniqueAppendString(to []string, item string) []string {
 	for _, e := range to {
 		if item == e {
@@ -221,9 +585,11 @@ func WithBidirectional(b bool) ServerOption {
 	}
 }
 
+// WithReusePort lets processes share listening ports by SO_REUSEPORT (SO_REUSEPORT_LB on FreeBSD), which balances
+// queries among them on Linux, DragonFly and FreeBSD. It's ignored on platforms without it, like Windows.
 func WithReusePort(b bool) ServerOption {
 	return func(o *serverOptions) error {
-		o.ReusePort = b
+		o.ReusePort = b && reusePortSupported
 		return nil
 	}
 }
@@ -242,6 +608,20 @@ func WithTestDomains(testDomains ...string) ServerOption {
 	}
 }
 
+// WithCanaryDomains sets domains known to be poisoned by untrusted servers, e.g. www.google.com.
+// They are queried every interval through untrusted servers, and IPs in the replies (but not in replies of
+// trusted servers) are blacklisted for a day. The replies are never served to clients.
+func WithCanaryDomains(interval time.Duration, domains ...string) ServerOption {
+	return func(o *serverOptions) error {
+		if interval < 0 {
+			return fmt.Errorf("invalid canary interval: %s", interval)
+		}
+		o.CanaryInterval = interval
+		o.CanaryDomains = domains
+		return nil
+	}
+}
+
 func WithSkipRefineResolvers(skip bool) ServerOption {
 	return func(o *serverOptions) error {
 		o.SkipRefine = skip
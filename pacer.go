@@ -0,0 +1,49 @@
+package gochinadns
+
+import (
+	"context"
+	"time"
+
+	"github.com/cherrot/gochinadns/clock"
+)
+
+// pacer paces lookups of a question in servers one after another. The next lookup starts after delay since the
+// previous one started, or once a lookup in flight fails, whichever is first. Each failure starts one lookup, and
+// the delay restarts with every lookup, so that no lookup is started by a timer fired before the previous lookup.
+type pacer struct {
+	delay   time.Duration // lookups start at once if 0
+	failed  chan struct{}
+	started bool // whether the first lookup started, which never waits
+	clock   clock.Clock
+}
+
+// newPacer returns a pacer of n lookups, timed by clk.
+func newPacer(n int, delay time.Duration, clk clock.Clock) *pacer {
+	return &pacer{delay: delay, failed: make(chan struct{}, n), clock: clk}
+}
+
+// Fail notes a failed lookup, so that the next one starts at once. It never blocks within n failures.
+func (p *pacer) Fail() {
+	select {
+	case p.failed <- struct{}{}:
+	default:
+	}
+}
+
+// Wait blocks until the next lookup may start. It returns false if ctx is done before that.
+// It's not safe for concurrent use.
+func (p *pacer) Wait(ctx context.Context) bool {
+	if !p.started || p.delay <= 0 {
+		p.started = true
+		return ctx.Err() == nil
+	}
+	t := p.clock.NewTimer(p.delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-p.failed:
+	case <-t.C():
+	}
+	return ctx.Err() == nil
+}
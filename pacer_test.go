@@ -0,0 +1,108 @@
+package gochinadns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cherrot/gochinadns/clock"
+	"github.com/miekg/dns"
+)
+
+func TestPacer(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1600000000, 0))
+	p := newPacer(3, time.Second, clk)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if !p.Wait(ctx) || clk.Waiters() != 0 {
+		t.Fatal("The first lookup should start at once")
+	}
+
+	// The delay elapses.
+	done := make(chan bool)
+	go func() { done <- p.Wait(ctx) }()
+	clk.BlockUntil(1)
+	clk.Advance(time.Second)
+	if !<-done {
+		t.Fatal("The second lookup should start after the delay")
+	}
+
+	// A lookup fails before the delay elapses.
+	go func() { done <- p.Wait(ctx) }()
+	clk.BlockUntil(1)
+	clk.Advance(500 * time.Millisecond)
+	p.Fail()
+	if !<-done {
+		t.Fatal("The third lookup should start once a lookup fails")
+	}
+	// The delay restarts with the third lookup, so the fourth one doesn't start when the timer of the third would
+	// have fired.
+	go func() { done <- p.Wait(ctx) }()
+	clk.BlockUntil(1)
+	clk.Advance(500 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("The delay should restart with every lookup")
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	if <-done {
+		t.Error("Wait should return false once ctx is done")
+	}
+	if n := clk.Waiters(); n != 0 {
+		t.Errorf("All timers should be stopped, got %d pending", n)
+	}
+
+	p = newPacer(3, 0, clk)
+	ctx = context.Background()
+	for i := 0; i < 3; i++ {
+		if !p.Wait(ctx) {
+			t.Fatal("All lookups should start at once without delay")
+		}
+	}
+}
+
+func TestLookupInServersFakeClock(t *testing.T) {
+	servers := resolverList{
+		&Resolver{Addr: "192.0.2.1:53", Protocols: []string{"udp"}},
+		&Resolver{Addr: "192.0.2.2:53", Protocols: []string{"udp"}},
+	}
+	queried := make(chan *Resolver, len(servers))
+	lookup := func(ctx context.Context, req *dns.Msg, server *Resolver) (*dns.Msg, time.Duration, error) {
+		queried <- server
+		if server == servers[0] {
+			<-ctx.Done()
+			return nil, 0, ctx.Err()
+		}
+		return newTestReply(req.Question[0].Name, 60, "192.0.2.10"), time.Millisecond, nil
+	}
+	clk := clock.NewFake(time.Unix(1600000000, 0))
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan *upstreamReply, 1)
+	done := make(chan struct{})
+	go func() {
+		lookupInServers(ctx, cancel, result, new(dns.Msg).SetQuestion("example.com.", dns.TypeA),
+			servers, 100*time.Millisecond, clk, lookup, newGoroutineTracker())
+		close(done)
+	}()
+
+	if r := <-queried; r != servers[0] {
+		t.Fatalf("The first server should be queried first, got %s", r)
+	}
+	clk.BlockUntil(1)
+	clk.Advance(99 * time.Millisecond)
+	select {
+	case r := <-queried:
+		t.Fatalf("%s should not be queried before the delay", r)
+	case <-time.After(50 * time.Millisecond):
+	}
+	clk.Advance(time.Millisecond)
+	if r := <-queried; r != servers[1] {
+		t.Fatalf("The second server should be queried after the delay, got %s", r)
+	}
+	if rep := <-result; rep.server != servers[1] {
+		t.Errorf("Reply should come from the second server, got %s", rep.server)
+	}
+	<-done
+}
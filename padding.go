@@ -0,0 +1,60 @@
+package gochinadns
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// paddingBlockSize is the block size queries over encrypted transports are padded to, as recommended by RFC 8467
+// section 4.1.
+const paddingBlockSize = 128
+
+// WithPadding pads queries over DoT and DoH with the EDNS(0) padding option (RFC 7830) to a multiple of 128 bytes,
+// so that names can't be told by the length of encrypted queries. Queries without EDNS, e.g. to resolvers with
+// `?edns=off`, are not padded. Padding of replies is removed.
+func WithPadding(b bool) ClientOption {
+	return func(o *clientOptions) {
+		o.Padding = b
+	}
+}
+
+// padQuery returns a copy of req padded to a multiple of paddingBlockSize, or req itself if padding is disabled or
+// req has no EDNS.
+func (c *Client) padQuery(req *dns.Msg) *dns.Msg {
+	if !c.Padding || req.IsEdns0() == nil {
+		return req
+	}
+	padded := req.Copy()
+	opt := padded.IsEdns0()
+	opt.Option = removeEDNSOption(opt.Option, dns.EDNS0PADDING)
+	// The option itself takes 4 bytes of code and length.
+	n := padded.Len() + 4
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, (paddingBlockSize-n%paddingBlockSize)%paddingBlockSize)})
+	return padded
+}
+
+// unpadReply removes padding from reply, which is useless to clients over other transports.
+func unpadReply(reply *dns.Msg) {
+	if reply == nil {
+		return
+	}
+	if opt := reply.IsEdns0(); opt != nil {
+		opt.Option = removeEDNSOption(opt.Option, dns.EDNS0PADDING)
+	}
+}
+
+// exchangeDoH sends req to server over DoH, padded if enabled.
+func (c *Client) exchangeDoH(ctx context.Context, req *dns.Msg, server *Resolver) (*dns.Msg, time.Duration, error) {
+	reply, rtt, err := c.DoHCli.ExchangeContext(c.withDoHTrace(ctx, server.GetAddr()), c.padQuery(req), server.GetAddr())
+	unpadReply(reply)
+	return reply, rtt, err
+}
+
+// exchangeDoT sends req to server over DoT, padded if enabled.
+func (c *Client) exchangeDoT(ctx context.Context, req *dns.Msg, server *Resolver) (*dns.Msg, time.Duration, error) {
+	reply, rtt, err := c.DoTCli.ExchangeContext(ctx, c.padQuery(req), server.dotAddr(), server.ServerName)
+	unpadReply(reply)
+	return reply, rtt, err
+}
@@ -0,0 +1,47 @@
+package gochinadns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPadQuery(t *testing.T) {
+	c := NewClient(WithPadding(true))
+	for _, name := range []string{"a.cn.", "www.example.com.", "a-very-long-label-of-a-name-being-padded.example.com."} {
+		req := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		req.SetEdns0(1232, false)
+		padded := c.padQuery(req)
+		if padded == req || len(req.IsEdns0().Option) != 0 {
+			t.Fatalf("%s: query should be padded in a copy", name)
+		}
+		raw, err := padded.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(raw)%paddingBlockSize != 0 {
+			t.Errorf("%s: padded to %d bytes, want a multiple of %d", name, len(raw), paddingBlockSize)
+		}
+		// Padding again doesn't grow the query.
+		if again := c.padQuery(padded); again.Len() != len(raw) {
+			t.Errorf("%s: padded again to %d bytes, want %d", name, again.Len(), len(raw))
+		}
+	}
+
+	req := new(dns.Msg).SetQuestion("example.com.", dns.TypeA)
+	if c.padQuery(req) != req {
+		t.Error("Query without EDNS should not be padded")
+	}
+	req.SetEdns0(1232, false)
+	if NewClient().padQuery(req) != req {
+		t.Error("Query should not be padded if padding is disabled")
+	}
+
+	reply := new(dns.Msg).SetReply(req)
+	reply.SetEdns0(1232, false)
+	reply.IsEdns0().Option = append(reply.IsEdns0().Option, &dns.EDNS0_PADDING{Padding: make([]byte, 100)})
+	unpadReply(reply)
+	if len(reply.IsEdns0().Option) != 0 {
+		t.Errorf("Padding of reply should be removed, got %v", reply.IsEdns0().Option)
+	}
+}
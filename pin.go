@@ -0,0 +1,179 @@
+package gochinadns
+
+import (
+	"context"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxPinnings bounds the number of clients pinned to upstreams. An arbitrary pinning is dropped to pin a new client.
+const maxPinnings = 4096
+
+// Pinning is the upstreams a client is pinned to, in each group.
+type Pinning struct {
+	Client    string    `json:"client"`
+	Trusted   string    `json:"trusted,omitempty"`
+	Untrusted string    `json:"untrusted,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// WithPinning pins each client to an upstream within the trusted and the untrusted group, chosen by hashing the
+// client IP, so that its CDN mappings and session affinity remain stable. The pinned upstream is queried first
+// regardless of the selection strategy, and others are queried as usual if it's unhealthy or slow.
+// A client keeps its upstreams until the pinnings are cleared (see ClearPinnings), or the upstreams are removed.
+// Replies to pinned clients are neither served from the cache nor cached, since the cache is shared by clients
+// pinned to different upstreams.
+func WithPinning(enabled bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.PinUpstreams = enabled
+		return nil
+	}
+}
+
+type pinKey struct{}
+
+// withPinnedClient returns a context of a query from client, whose upstreams are pinned.
+func withPinnedClient(ctx context.Context, client net.IP) context.Context {
+	return context.WithValue(ctx, pinKey{}, client)
+}
+
+// pinnedClientFromContext returns the client of a query whose upstreams are pinned, or nil.
+func pinnedClientFromContext(ctx context.Context) net.IP {
+	client, _ := ctx.Value(pinKey{}).(net.IP)
+	return client
+}
+
+// pinTable keeps upstreams pinned by clients. It's nil-safe.
+type pinTable struct {
+	mu   sync.Mutex
+	pins map[string]*Pinning
+}
+
+func newPinTable() *pinTable {
+	return &pinTable{pins: make(map[string]*Pinning)}
+}
+
+// Pin returns the upstream pinned by client in a group, where trusted tells the group. If client pins none, or an
+// upstream not in all (the resolvers of the group), an upstream in candidates is pinned by rendezvous hashing,
+// which keeps most clients on their upstreams when upstreams change. It returns an empty string if table is nil.
+func (t *pinTable) Pin(client net.IP, trusted bool, candidates, all resolverList) string {
+	if t == nil || client == nil || len(candidates) == 0 {
+		return ""
+	}
+	key := client.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.pins[key]
+	if p == nil {
+		if len(t.pins) >= maxPinnings {
+			for k := range t.pins {
+				delete(t.pins, k)
+				break
+			}
+		}
+		p = &Pinning{Client: key, Since: time.Now()}
+		t.pins[key] = p
+	}
+	pinned := &p.Untrusted
+	if trusted {
+		pinned = &p.Trusted
+	}
+	if *pinned == "" || !containsResolver(all, *pinned) {
+		*pinned = rendezvous(key, candidates).String()
+	}
+	return *pinned
+}
+
+// List returns pinnings, ordered by clients.
+func (t *pinTable) List() []Pinning {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	list := make([]Pinning, 0, len(t.pins))
+	for _, p := range t.pins {
+		list = append(list, *p)
+	}
+	t.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Client < list[j].Client })
+	return list
+}
+
+// Clear removes the pinning of client, or all pinnings if client is nil. It returns the number of pinnings removed.
+func (t *pinTable) Clear(client net.IP) int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if client == nil {
+		n := len(t.pins)
+		t.pins = make(map[string]*Pinning)
+		return n
+	}
+	if _, ok := t.pins[client.String()]; !ok {
+		return 0
+	}
+	delete(t.pins, client.String())
+	return 1
+}
+
+// rendezvous returns the resolver in list with the highest hash of key and itself.
+func rendezvous(key string, list resolverList) *Resolver {
+	var (
+		best *Resolver
+		max  uint64
+	)
+	for _, r := range list {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(r.String()))
+		if sum := h.Sum64(); best == nil || sum > max {
+			best, max = r, sum
+		}
+	}
+	return best
+}
+
+func containsResolver(list resolverList, addr string) bool {
+	for _, r := range list {
+		if r.String() == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// pinResolvers moves the upstream pinned by client to the front of list, the selected resolvers of a group.
+// all is the resolvers of the group. list is returned as is if client is nil or the pinned upstream isn't in list,
+// e.g. it's unhealthy.
+func (s *Server) pinResolvers(client net.IP, trusted bool, list, all resolverList) resolverList {
+	pinned := s.pins.Pin(client, trusted, list, all)
+	if pinned == "" {
+		return list
+	}
+	for i, r := range list {
+		if r.String() == pinned {
+			result := make(resolverList, 0, len(list))
+			result = append(result, r)
+			result = append(result, list[:i]...)
+			return append(result, list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// Pinnings returns upstreams pinned by clients. See WithPinning.
+func (s *Server) Pinnings() []Pinning {
+	return s.pins.List()
+}
+
+// ClearPinnings clears upstreams pinned by client, or by all clients if client is nil, so that they are pinned
+// again on their next queries. It returns the number of clients cleared.
+func (s *Server) ClearPinnings(client net.IP) int {
+	return s.pins.Clear(client)
+}
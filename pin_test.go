@@ -0,0 +1,89 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestPinResolvers(t *testing.T) {
+	o := newServerOptions()
+	if err := WithPinning(true)(o); err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range []string{"1.1.1.1", "8.8.8.8", "9.9.9.9"} {
+		r, err := ParseResolver(addr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.TrustedServers = append(o.TrustedServers, r)
+	}
+	s := &Server{serverOptions: o, upstreams: newUpstreamTable(), pins: newPinTable()}
+
+	firsts := make(map[string]bool)
+	for i := 1; i <= 32; i++ {
+		client := net.ParseIP(fmt.Sprintf("192.168.1.%d", i))
+		trusted, _ := s.selectedResolvers(client)
+		if len(trusted) != 3 {
+			t.Fatalf("All resolvers should be selected, got %v", trusted)
+		}
+		for j := 0; j < 3; j++ {
+			if again, _ := s.selectedResolvers(client); again[0] != trusted[0] {
+				t.Fatalf("%s should be pinned to %s, got %s", client, trusted[0], again[0])
+			}
+		}
+		firsts[trusted[0].String()] = true
+	}
+	if len(firsts) < 2 {
+		t.Errorf("Clients should be spread over upstreams, got %v", firsts)
+	}
+
+	client := net.ParseIP("192.168.1.1")
+	pinned, _ := s.selectedResolvers(client)
+	s.TrustedServers = resolverList{pinned[1], pinned[2]}
+	if trusted, _ := s.selectedResolvers(client); trusted[0] == pinned[0] {
+		t.Error("Removed upstream should be unpinned")
+	}
+	if list := s.Pinnings(); len(list) != 32 || list[0].Trusted == "" || list[0].Untrusted != "" {
+		t.Errorf("Unexpected pinnings %+v", list)
+	}
+	if n := s.ClearPinnings(client); n != 1 || len(s.Pinnings()) != 31 {
+		t.Errorf("Pinning of %s should be cleared, got %d", client, n)
+	}
+	if n := s.ClearPinnings(nil); n != 31 || len(s.Pinnings()) != 0 {
+		t.Errorf("All pinnings should be cleared, got %d", n)
+	}
+	if trusted, _ := s.selectedResolvers(nil); trusted[0] != s.TrustedServers[0] || len(s.Pinnings()) != 0 {
+		t.Error("Queries without clients should not be pinned")
+	}
+}
+
+func TestPinnedClientsSkipCache(t *testing.T) {
+	var queries int32
+	upstream := NewUpstreamResolver("counting", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+		atomic.AddInt32(&queries, 1)
+		return newTestReply(req.Question[0].Name, 600, "142.250.1.1"), time.Millisecond, nil
+	}))
+	s, err := NewServer(NewClient(), WithSkipRefineResolvers(true), WithPinning(true), WithCache(16, 0),
+		WithUpstreams(true, upstream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	for i := 0; i < 2; i++ {
+		w := newFakeResponseWriter("192.168.1.10")
+		s.Serve(w, req.Copy())
+		if w.msg == nil || len(w.msg.Answer) != 1 {
+			t.Fatalf("Unexpected reply %v", w.msg)
+		}
+	}
+	if n := atomic.LoadInt32(&queries); n != 2 || s.cache.Len() != 0 {
+		t.Errorf("Replies to pinned clients should not be cached, %d upstream queries with %d entries", n, s.cache.Len())
+	}
+}
@@ -0,0 +1,198 @@
+package gochinadns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cherrot/gochinadns/dot"
+)
+
+// probeUDPSize is the EDNS UDP size advertised in probes, to learn the max size an upstream accepts.
+const probeUDPSize = 4096
+
+// Capabilities are protocol capabilities of an upstream learned by probing.
+type Capabilities struct {
+	UDP        bool      `json:"udp"`
+	TCP        bool      `json:"tcp"`
+	DoT        bool      `json:"dot"`                // DoT is available with a certificate valid for the IP
+	DoTAddr    string    `json:"dot_addr,omitempty"` // address of DoT, on port 853 unless discovered by DDR
+	DDR        bool      `json:"ddr"`                // DoT is discovered by DDR (RFC 9462), see WithDDR
+	EDNS       bool      `json:"edns"`
+	Cookie     bool      `json:"cookie"`       // the upstream replies server cookies (RFC 7873)
+	MaxUDPSize uint16    `json:"max_udp_size"` // UDP size advertised by the upstream, 0 if EDNS is unsupported
+	Transports []string  `json:"transports"`   // transports chosen for the upstream, in order
+	Probed     time.Time `json:"probed"`
+}
+
+// chooseTransports sets Transports by availability of UDP and TCP.
+// DoT is not chosen automatically since the upstream is not declared as a DoT one. Use tls://ip to do so.
+func (c *Capabilities) chooseTransports() {
+	c.Transports = nil
+	if c.UDP {
+		c.Transports = append(c.Transports, "udp")
+	}
+	if c.TCP {
+		c.Transports = append(c.Transports, "tcp")
+	}
+}
+
+// Capabilities returns probed capabilities of r, or nil if not probed.
+func (r *Resolver) Capabilities() *Capabilities {
+	c, _ := r.caps.Load().(*Capabilities)
+	return c
+}
+
+// protocols returns protocols to query r with. Probed transports are used if protocols of r are not declared explicitly.
+// TCP is preferred if UDP replies seem dropped due to fragmentation, and DoT is preferred if r is upgraded.
+func (r *Resolver) protocols() []string {
+	protocols := r.Protocols
+	if r.autoProtocols {
+		if c := r.Capabilities(); c != nil && len(c.Transports) > 0 {
+			protocols = c.Transports
+		}
+	}
+	if r.prefersTCP() {
+		protocols = r.preferTCPIn(protocols)
+	}
+	return r.upgradeProtocols(protocols)
+}
+
+// limitUDPSize lowers EDNS UDP size of req to the size advertised by r, and the size limited on fragmentation,
+// to avoid fragmented replies.
+func (r *Resolver) limitUDPSize(req *dns.Msg) {
+	limit := r.ednsLimit()
+	if c := r.Capabilities(); c != nil && c.MaxUDPSize > dns.MinMsgSize && (limit == 0 || c.MaxUDPSize < limit) {
+		limit = c.MaxUDPSize
+	}
+	if limit == 0 {
+		return
+	}
+	if e := req.IsEdns0(); e != nil && e.UDPSize() > limit {
+		e.SetUDPSize(limit)
+	}
+}
+
+// runProbes probes upstreams immediately and then every ProbeInterval, until ctx is done.
+func (s *Server) runProbes(ctx context.Context) {
+	if s.ProbeInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.ProbeInterval)
+	defer ticker.Stop()
+	for {
+		s.probeResolvers()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeResolvers probes all UDP and TCP upstreams concurrently. DoT of trusted upstreams is probed through
+// TrustedProxy if set, like queries to them.
+func (s *Server) probeResolvers() {
+	trusted, untrusted := s.resolvers()
+	var wg sync.WaitGroup
+	for i, list := range []resolverList{trusted, untrusted} {
+		dotCli := s.DoTCli
+		if i == 0 {
+			dotCli = s.trustedClient().DoTCli
+		}
+		for _, r := range list {
+			host, _, err := net.SplitHostPort(r.GetAddr())
+			if err != nil || net.ParseIP(host) == nil || !hasProtocol(r, "udp", "tcp") {
+				continue
+			}
+			wg.Add(1)
+			go func(r *Resolver) {
+				defer wg.Done()
+				c := s.probeResolver(r, dotCli)
+				r.caps.Store(c)
+				logrus.WithField("server", r).Debugf("Probed capabilities: %+v", *c)
+				if (s.OpportunisticDoT || c.DDR) && c.DoT {
+					r.enableUpgrade()
+				} else if !c.DoT && r.upgradeState() == upgradePinned {
+					logrus.WithField("server", r).Warn("DoT is unavailable, but the upstream is pinned to DoT. Possible downgrade attack?")
+				}
+			}(r)
+		}
+	}
+	wg.Wait()
+}
+
+// probeResolver probes capabilities of r, probing DoT by dotCli.
+func (s *Server) probeResolver(r *Resolver, dotCli *dot.Client) *Capabilities {
+	c := &Capabilities{Probed: time.Now()}
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(s.probeDomain()), dns.TypeA)
+	req.SetEdns0(probeUDPSize, false)
+	if cookie, err := clientCookie(); err == nil {
+		opt := req.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	}
+
+	if reply, _, err := s.UDPCli.Exchange(req.Copy(), r.GetAddr()); err == nil {
+		c.UDP = true
+		if opt := reply.IsEdns0(); opt != nil {
+			c.EDNS = true
+			c.MaxUDPSize = opt.UDPSize()
+			for _, o := range opt.Option {
+				// A client cookie is 8 bytes, followed by a server cookie of 8 to 32 bytes, in hex.
+				if cookie, ok := o.(*dns.EDNS0_COOKIE); ok && len(cookie.Cookie) > 16 {
+					c.Cookie = true
+				}
+			}
+		}
+	}
+	if _, _, err := s.TCPCli.Exchange(req.Copy(), r.GetAddr()); err == nil {
+		c.TCP = true
+	}
+	host, _, _ := net.SplitHostPort(r.GetAddr())
+	if s.DDR {
+		if addr := s.discoverDoT(r, net.ParseIP(host), req, dotCli); addr != "" {
+			c.DoT, c.DDR, c.DoTAddr = true, true, addr
+		}
+	}
+	// DoT on port 853 is probed only to upgrade to it, or to detect downgrades of upgraded upstreams.
+	if !c.DDR && (s.OpportunisticDoT || r.upgradeState() == upgradePinned) {
+		if _, _, err := dotCli.Exchange(req.Copy(), net.JoinHostPort(host, dotPort), ""); err == nil {
+			c.DoT, c.DoTAddr = true, net.JoinHostPort(host, dotPort)
+		}
+	}
+	c.chooseTransports()
+	return c
+}
+
+func (s *Server) probeDomain() string {
+	if len(s.TestDomains) > 0 {
+		return s.TestDomains[0]
+	}
+	return "qq.com"
+}
+
+func clientCookie() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hasProtocol(r *Resolver, protocols ...string) bool {
+	for _, p := range r.GetProtocols() {
+		for _, want := range protocols {
+			if p == want {
+				return true
+			}
+		}
+	}
+	return false
+}
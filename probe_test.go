@@ -0,0 +1,109 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTestUpstream starts an upstream on UDP and TCP of the same port, replying with EDNS size 1232 and a server cookie.
+func startTestUpstream(t *testing.T) string {
+	t.Helper()
+	handler := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.SetEdns0(1232, false)
+		if opt := req.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+					m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: c.Cookie + "0102030405060708"})
+				}
+			}
+		}
+		_ = w.WriteMsg(m)
+	})
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		pc.Close()
+		t.Skip("Fail to listen TCP on the same port: ", err)
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: handler}
+	tcp := &dns.Server{Listener: l, Handler: handler}
+	go func() { _ = udp.ActivateAndServe() }()
+	go func() { _ = tcp.ActivateAndServe() }()
+	t.Cleanup(func() {
+		_ = udp.Shutdown()
+		_ = tcp.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
+
+func TestProbeResolver(t *testing.T) {
+	addr := startTestUpstream(t)
+	var dotDials int
+	s := &Server{serverOptions: newServerOptions(), Client: NewClient(WithTimeout(time.Second), WithConnObserver(func(e *ConnEvent) {
+		if e.Phase == ConnDialStart && strings.HasSuffix(e.Addr, ":"+dotPort) {
+			dotDials++
+		}
+	}))}
+	r, err := ParseResolver(addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := s.probeResolver(r, s.DoTCli)
+	if !c.UDP || !c.TCP || !c.EDNS || !c.Cookie || c.DoT {
+		t.Errorf("Unexpected capabilities %+v", *c)
+	}
+	if dotDials != 0 {
+		t.Errorf("DoT should not be probed without opportunistic DoT, got %d dials", dotDials)
+	}
+	s.OpportunisticDoT = true
+	if c = s.probeResolver(r, s.DoTCli); c.DoT || dotDials == 0 {
+		t.Errorf("DoT should be probed with opportunistic DoT, got %+v and %d dials", *c, dotDials)
+	}
+
+	// DoT of trusted upstreams is probed through the trusted proxy.
+	var proxied []string
+	s.proxyCli = NewClient(WithTimeout(time.Second), WithDialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		proxied = append(proxied, addr)
+		return nil, errors.New("proxy is down")
+	}))
+	s.TrustedServers = resolverList{r}
+	dotDials = 0
+	s.probeResolvers()
+	if dotDials != 0 || len(proxied) != 1 || !strings.HasSuffix(proxied[0], ":"+dotPort) {
+		t.Errorf("DoT should be probed through the trusted proxy, got %d direct dials, and %v through the proxy", dotDials, proxied)
+	}
+	if c.MaxUDPSize != 1232 {
+		t.Errorf("Max UDP size should be 1232, got %d", c.MaxUDPSize)
+	}
+
+	r.caps.Store(&Capabilities{TCP: true, EDNS: true, MaxUDPSize: 1232, Transports: []string{"tcp"}})
+	if p := r.protocols(); len(p) != 1 || p[0] != "tcp" {
+		t.Errorf("Probed transports should be used, got %v", p)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	r.limitUDPSize(req)
+	if size := req.IsEdns0().UDPSize(); size != 1232 {
+		t.Errorf("UDP size should be limited to 1232, got %d", size)
+	}
+
+	explicit, _ := ParseResolver("udp@"+addr, false)
+	explicit.caps.Store(&Capabilities{Transports: []string{"tcp"}})
+	if p := explicit.protocols(); len(p) != 1 || p[0] != "udp" {
+		t.Errorf("Declared protocols should be kept, got %v", p)
+	}
+}
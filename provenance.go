@@ -0,0 +1,166 @@
+package gochinadns
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	whoAnsweredLabel = "whoanswered."
+	whoAnsweredZone  = ".chinadns."
+
+	provenanceLogSize = 4096
+)
+
+// Provenance describes which upstream and decision produced an answer.
+type Provenance struct {
+	Upstream string        `json:"upstream,omitempty"`
+	Verdict  string        `json:"verdict"`
+	RTT      time.Duration `json:"rtt"`
+	Time     time.Time     `json:"time"`
+}
+
+// describe formats p with its age at now, which comes from the clock of the server like p.Time.
+func (p Provenance) describe(now time.Time) string {
+	upstream := p.Upstream
+	if upstream == "" {
+		upstream = "-"
+	}
+	return fmt.Sprintf("upstream=%s verdict=%s rtt=%s age=%s",
+		upstream, p.Verdict, p.RTT, now.Sub(p.Time).Truncate(time.Second))
+}
+
+func (r *upstreamReply) provenance() Provenance {
+	p := Provenance{Verdict: r.verdict, RTT: r.rtt}
+	if r.server != nil {
+		p.Upstream = r.server.String()
+	}
+	return p
+}
+
+// provenanceLog remembers provenance of the latest answers of recently served domains.
+type provenanceLog struct {
+	mu      sync.Mutex
+	records map[string]map[uint16]Provenance
+	names   []string // FIFO of names in records, for eviction
+	size    int
+	now     func() time.Time
+}
+
+func newProvenanceLog(size int) *provenanceLog {
+	return &provenanceLog{
+		records: make(map[string]map[uint16]Provenance),
+		size:    size,
+		now:     time.Now,
+	}
+}
+
+func (l *provenanceLog) Record(q *dns.Question, p Provenance) {
+	if p.Time.IsZero() {
+		p.Time = l.now()
+	}
+	name := strings.ToLower(q.Name)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	byType := l.records[name]
+	if byType == nil {
+		if len(l.names) >= l.size {
+			delete(l.records, l.names[0])
+			l.names = l.names[1:]
+		}
+		byType = make(map[uint16]Provenance)
+		l.records[name] = byType
+		l.names = append(l.names, name)
+	}
+	byType[q.Qtype] = p
+}
+
+// Lookup returns provenance of the latest answers of name, indexed by question type.
+func (l *provenanceLog) Lookup(name string) map[uint16]Provenance {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	byType := l.records[strings.ToLower(dns.Fqdn(name))]
+	if byType == nil {
+		return nil
+	}
+	ret := make(map[uint16]Provenance, len(byType))
+	for t, p := range byType {
+		ret[t] = p
+	}
+	return ret
+}
+
+// Recent returns up to n questions of the latest answers, the most recent names first. Blocked questions are skipped,
+// as are questions of names and verdicts for which keep returns false, if keep is not nil.
+func (l *provenanceLog) Recent(n int, keep func(name, verdict string) bool) []dns.Question {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var questions []dns.Question
+	for i := len(l.names) - 1; i >= 0 && len(questions) < n; i-- {
+		name := l.names[i]
+		for t, p := range l.records[name] {
+			if p.Verdict != VerdictBlocked && (keep == nil || keep(name, p.Verdict)) && len(questions) < n {
+				questions = append(questions, dns.Question{Name: name, Qtype: t, Qclass: dns.ClassINET})
+			}
+		}
+	}
+	return questions
+}
+
+// serveWhoAnswered answers TXT questions like `whoanswered.example.com.chinadns.`
+// with provenance of the latest answers of `example.com`, and of its cached answers.
+// It reports whether the request is such a question.
+func (s *Server) serveWhoAnswered(w dns.ResponseWriter, req *dns.Msg) bool {
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+	if q.Qclass != dns.ClassINET || !strings.HasPrefix(name, whoAnsweredLabel) || !strings.HasSuffix(name, whoAnsweredZone) {
+		return false
+	}
+	target := strings.TrimSuffix(strings.TrimPrefix(name, whoAnsweredLabel), whoAnsweredZone)
+	if target == "" {
+		return false
+	}
+
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Authoritative = true
+	if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY {
+		records := s.provenance.Lookup(target)
+		types := make([]uint16, 0, len(records))
+		for t := range records {
+			types = append(types, t)
+		}
+		sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+		now := s.Clock.Now()
+		for _, t := range types {
+			reply.Answer = append(reply.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+				Txt: []string{dns.TypeToString[t] + " " + records[t].describe(now)},
+			})
+		}
+		// Cached answers may come from earlier resolutions than the latest ones.
+		entries, _ := s.InspectCache(target)
+		for _, e := range entries {
+			if e.Provenance != nil {
+				reply.Answer = append(reply.Answer, &dns.TXT{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+					Txt: []string{e.Type + " cached " + e.Provenance.describe(now)},
+				})
+			}
+		}
+		if len(reply.Answer) == 0 {
+			reply.Rcode = dns.RcodeNameError
+		}
+	}
+	_ = w.WriteMsg(reply)
+	return true
+}
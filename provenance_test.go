@@ -0,0 +1,66 @@
+package gochinadns
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/cherrot/gochinadns/clock"
+)
+
+func TestProvenanceLogEviction(t *testing.T) {
+	l := newProvenanceLog(2)
+	for _, name := range []string{"a.com.", "b.com.", "c.com."} {
+		l.Record(&dns.Question{Name: name, Qtype: dns.TypeA}, Provenance{Verdict: VerdictChina})
+	}
+	if l.Lookup("a.com") != nil {
+		t.Error("The oldest name should be evicted")
+	}
+	if l.Lookup("C.com.")[dns.TypeA].Verdict != VerdictChina {
+		t.Error("Lookup should be case insensitive and accept non-FQDN names")
+	}
+}
+
+func TestServeWhoAnswered(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1600000000, 0))
+	cache := NewMemoryCache(10, 0)
+	cache.now = clk.Now
+	s := &Server{serverOptions: newServerOptions(), provenance: newProvenanceLog(8), cache: cache}
+	s.Clock = clk
+	s.provenance.now = clk.Now
+	s.provenance.Record(&dns.Question{Name: "example.com.", Qtype: dns.TypeA}, Provenance{Upstream: "udp@1.1.1.1:53", Verdict: VerdictOverseas})
+	m := newTestReply("example.com.", 60, "1.0.1.1")
+	m.Question[0].Qtype = dns.TypeAAAA
+	s.cacheSet(&m.Question[0], m, Provenance{Upstream: "udp@114.114.114.114:53", Verdict: VerdictChina})
+	clk.Advance(30 * time.Second)
+
+	req := new(dns.Msg)
+	req.SetQuestion("whoanswered.Example.com.chinadns.", dns.TypeTXT)
+	w := newFakeResponseWriter("127.0.0.1")
+	if !s.serveWhoAnswered(w, req) {
+		t.Fatal("Sidecar question should be served")
+	}
+	if len(w.msg.Answer) != 2 {
+		t.Fatalf("Expect 2 TXT answers, got %d", len(w.msg.Answer))
+	}
+	txt := w.msg.Answer[0].(*dns.TXT).Txt[0]
+	if !strings.HasPrefix(txt, "A upstream=udp@1.1.1.1:53 verdict=overseas") || !strings.HasSuffix(txt, " age=30s") {
+		t.Errorf("Unexpected TXT answer %q", txt)
+	}
+	if txt = w.msg.Answer[1].(*dns.TXT).Txt[0]; !strings.HasPrefix(txt, "AAAA cached upstream=udp@114.114.114.114:53 verdict=china") ||
+		!strings.HasSuffix(txt, " age=30s") {
+		t.Errorf("Unexpected TXT answer of the cache %q", txt)
+	}
+
+	req.SetQuestion("whoanswered.unknown.com.chinadns.", dns.TypeTXT)
+	if !s.serveWhoAnswered(w, req) || w.msg.Rcode != dns.RcodeNameError {
+		t.Error("Unknown domain should get NXDOMAIN")
+	}
+
+	req.SetQuestion("example.com.", dns.TypeTXT)
+	if s.serveWhoAnswered(w, req) {
+		t.Error("Normal question should not be served as sidecar")
+	}
+}
@@ -0,0 +1,219 @@
+// Package proxy dials TCP connections through SOCKS5 (RFC 1928) or HTTP CONNECT proxies.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// DialFunc dials addr on network, like net.Dialer.DialContext. Only TCP is supported by proxies.
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// New returns a DialFunc dialing through the proxy at rawURL, in format socks5://[user:pass@]host:port
+// or http://[user:pass@]host:port. timeout limits connecting to the proxy and the handshake.
+func New(rawURL string, timeout time.Duration) (DialFunc, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %s: host is required", rawURL)
+	}
+	p := &proxy{addr: u.Host, user: u.User, dialer: &net.Dialer{Timeout: timeout}, timeout: timeout}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return p.dialSOCKS5, nil
+	case "http":
+		return p.dialHTTP, nil
+	}
+	return nil, fmt.Errorf("unsupported proxy scheme %s, expect socks5 or http", u.Scheme)
+}
+
+type proxy struct {
+	addr    string
+	user    *url.Userinfo
+	dialer  *net.Dialer
+	timeout time.Duration
+}
+
+// connect connects to the proxy, and runs handshake on the connection with a deadline.
+func (p *proxy) connect(ctx context.Context, network, addr string, handshake func(net.Conn, string) error) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("network %s is not supported by proxies", network)
+	}
+	conn, err := p.dialer.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, fmt.Errorf("fail to connect to proxy: %w", err)
+	}
+	if p.timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(p.timeout))
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if err = handshake(conn, addr); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (p *proxy) dialSOCKS5(ctx context.Context, network, addr string) (net.Conn, error) {
+	return p.connect(ctx, network, addr, p.socks5Handshake)
+}
+
+// SOCKS5 constants of RFC 1928 and RFC 1929.
+const (
+	socks5Version      = 5
+	socks5NoAuth       = 0
+	socks5UserPass     = 2
+	socks5NoAcceptable = 0xff
+	socks5Connect      = 1
+	socks5IPv4         = 1
+	socks5Domain       = 3
+	socks5IPv6         = 4
+)
+
+func (p *proxy) socks5Handshake(conn net.Conn, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %s", portStr)
+	}
+
+	method := byte(socks5NoAuth)
+	if p.user != nil {
+		method = socks5UserPass
+	}
+	if _, err = conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return fmt.Errorf("fail to read SOCKS5 method: %w", err)
+	}
+	if buf[0] != socks5Version || buf[1] == socks5NoAcceptable || buf[1] != method {
+		return errors.New("SOCKS5 proxy rejects the authentication method")
+	}
+	if method == socks5UserPass {
+		user := p.user.Username()
+		pass, _ := p.user.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("SOCKS5 username or password is too long")
+		}
+		req := append([]byte{1, byte(len(user))}, user...)
+		req = append(append(req, byte(len(pass))), pass...)
+		if _, err = conn.Write(req); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			return fmt.Errorf("fail to read SOCKS5 authentication: %w", err)
+		}
+		if buf[1] != 0 {
+			return errors.New("SOCKS5 authentication failed")
+		}
+	}
+
+	req := []byte{socks5Version, socks5Connect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("SOCKS5 host name is too long")
+		}
+		req = append(append(req, socks5Domain, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, socks5IPv4), ip4...)
+	} else {
+		req = append(append(req, socks5IPv6), ip.To16()...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	// Reply: VER REP RSV ATYP BND.ADDR BND.PORT
+	reply := make([]byte, 4)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return fmt.Errorf("fail to read SOCKS5 reply: %w", err)
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("SOCKS5 proxy fails to connect %s: code %d", addr, reply[1])
+	}
+	var skip int
+	switch reply[3] {
+	case socks5IPv4:
+		skip = net.IPv4len
+	case socks5IPv6:
+		skip = net.IPv6len
+	case socks5Domain:
+		if _, err = io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		skip = int(buf[0])
+	default:
+		return fmt.Errorf("unknown SOCKS5 address type %d", reply[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+func (p *proxy) dialHTTP(ctx context.Context, network, addr string) (net.Conn, error) {
+	var br *bufio.Reader
+	conn, err := p.connect(ctx, network, addr, func(conn net.Conn, addr string) error {
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if p.user != nil {
+			pass, _ := p.user.Password()
+			auth := base64.StdEncoding.EncodeToString([]byte(p.user.Username() + ":" + pass))
+			req.Header.Set("Proxy-Authorization", "Basic "+auth)
+		}
+		if err := req.Write(conn); err != nil {
+			return err
+		}
+		br = bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			return fmt.Errorf("fail to read HTTP CONNECT response: %w", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("HTTP proxy fails to connect %s: %s", addr, resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads data buffered in handshake first.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,269 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startEcho starts a TCP server echoing what it reads, and returns its address.
+func startEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// startProxy starts a proxy serving each connection by serve, and returns its address.
+func startProxy(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// relay connects conn to addr until either side closes.
+func relay(conn net.Conn, r io.Reader, addr string) {
+	target, err := net.Dial("tcp", addr)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	go func() { _, _ = io.Copy(target, r) }()
+	_, _ = io.Copy(conn, target)
+}
+
+// serveSOCKS5 serves a SOCKS5 CONNECT request of IPv4 or domain addresses, requiring user and pass if not empty.
+func serveSOCKS5(user, pass string) func(net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(conn, buf); err != nil || buf[0] != socks5Version {
+			return
+		}
+		methods := make([]byte, buf[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			return
+		}
+		method := byte(socks5NoAuth)
+		if user != "" {
+			method = socks5UserPass
+		}
+		if methods[0] != method {
+			_, _ = conn.Write([]byte{socks5Version, socks5NoAcceptable})
+			return
+		}
+		_, _ = conn.Write([]byte{socks5Version, method})
+		if method == socks5UserPass {
+			var creds [2]string
+			for i := -1; i < len(creds); i++ {
+				if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+					return
+				}
+				if i < 0 {
+					continue // version
+				}
+				b := make([]byte, buf[0])
+				if _, err := io.ReadFull(conn, b); err != nil {
+					return
+				}
+				creds[i] = string(b)
+			}
+			if creds[0] != user || creds[1] != pass {
+				_, _ = conn.Write([]byte{1, 1})
+				return
+			}
+			_, _ = conn.Write([]byte{1, 0})
+		}
+
+		req := make([]byte, 4)
+		if _, err := io.ReadFull(conn, req); err != nil || req[1] != socks5Connect {
+			return
+		}
+		var host string
+		switch req[3] {
+		case socks5IPv4:
+			ip := make(net.IP, net.IPv4len)
+			if _, err := io.ReadFull(conn, ip); err != nil {
+				return
+			}
+			host = ip.String()
+		case socks5Domain:
+			if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+				return
+			}
+			b := make([]byte, buf[0])
+			if _, err := io.ReadFull(conn, b); err != nil {
+				return
+			}
+			host = string(b)
+		default:
+			return
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(buf))))
+		if host == "localhost" {
+			// Hosts are resolved by the proxy.
+			addr = net.JoinHostPort("127.0.0.1", strconv.Itoa(int(binary.BigEndian.Uint16(buf))))
+		}
+		_, _ = conn.Write([]byte{socks5Version, 0, 0, socks5IPv4, 0, 0, 0, 0, 0, 0})
+		relay(conn, conn, addr)
+	}
+}
+
+// serveHTTPConnect serves an HTTP CONNECT request, requiring the Proxy-Authorization auth if not empty.
+func serveHTTPConnect(auth string) func(net.Conn) {
+	return func(conn net.Conn) {
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		req, err := http.ReadRequest(br)
+		if err != nil || req.Method != http.MethodConnect {
+			return
+		}
+		if auth != "" && req.Header.Get("Proxy-Authorization") != auth {
+			_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+			return
+		}
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		relay(conn, br, req.Host)
+	}
+}
+
+// echo writes a message through conn, and checks it's echoed.
+func echo(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+		t.Errorf("Unexpected echo %q: %v", b, err)
+	}
+}
+
+func TestSOCKS5(t *testing.T) {
+	target := startEcho(t)
+	_, port, _ := net.SplitHostPort(target)
+
+	dial, err := New("socks5://"+startProxy(t, serveSOCKS5("", "")), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn)
+	if conn, err = dial(context.Background(), "tcp", net.JoinHostPort("localhost", port)); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn)
+	if _, err = dial(context.Background(), "udp", target); err == nil {
+		t.Error("UDP should not be supported")
+	}
+
+	proxy := startProxy(t, serveSOCKS5("user", "pass"))
+	if dial, err = New("socks5://user:pass@"+proxy, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err = dial(context.Background(), "tcp", target); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn)
+	for _, rawURL := range []string{"socks5://user:wrong@" + proxy, "socks5://" + proxy} {
+		if dial, err = New(rawURL, time.Second); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = dial(context.Background(), "tcp", target); err == nil {
+			t.Errorf("%s should be rejected", rawURL)
+		}
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	target := startEcho(t)
+
+	dial, err := New("http://"+startProxy(t, serveHTTPConnect("")), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial(context.Background(), "tcp", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn)
+
+	proxy := startProxy(t, serveHTTPConnect("Basic dXNlcjpwYXNz")) // user:pass
+	if dial, err = New("http://user:pass@"+proxy, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err = dial(context.Background(), "tcp", target); err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn)
+	if dial, err = New("http://"+proxy, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dial(context.Background(), "tcp", target); err == nil {
+		t.Error("Unauthenticated request should be rejected")
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, rawURL := range []string{"socks4://127.0.0.1:1080", "socks5://", "127.0.0.1:1080", "http://%zz"} {
+		if _, err := New(rawURL, time.Second); err == nil {
+			t.Errorf("New(%s) should fail", rawURL)
+		}
+	}
+
+	// The handshake times out if the proxy never replies.
+	proxy := startProxy(t, func(conn net.Conn) {
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	dial, err := New("socks5://"+proxy, 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err = dial(context.Background(), "tcp", "127.0.0.1:53"); err == nil || time.Since(start) > time.Second {
+		t.Errorf("Handshake should time out, got %v in %s", err, time.Since(start))
+	}
+}
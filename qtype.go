@@ -0,0 +1,81 @@
+package gochinadns
+
+import (
+	"expvar"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Actions on queries of blocked types. See WithBlockedQTypes.
+const (
+	QTypeEmpty  = "empty"  // answer without records
+	QTypeRefuse = "refuse" // answer REFUSED
+)
+
+// blockedQTypes counts queries answered by the action on blocked types, by type.
+var blockedQTypes = expvar.NewMap("chinadns_blocked_qtypes")
+
+// WithBlockedQTypes answers queries of qtypes by action without querying upstreams, e.g. ANY, which is abused for
+// amplification, or HTTPS and SVCB, whose ECH parameters and alternative endpoints break some proxy setups.
+// Types are names like ANY or numbers like TYPE65. See QTypeXXX for available actions.
+func WithBlockedQTypes(action string, qtypes ...string) ServerOption {
+	return func(o *serverOptions) error {
+		switch action {
+		case QTypeEmpty, QTypeRefuse:
+		default:
+			return fmt.Errorf("unknown qtype action [%s], expect empty or refuse", action)
+		}
+		blocked := make(map[uint16]bool, len(qtypes))
+		for _, name := range qtypes {
+			name = strings.ToUpper(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			qtype, ok := dns.StringToType[name]
+			if !ok && strings.HasPrefix(name, "TYPE") {
+				n, err := strconv.ParseUint(name[len("TYPE"):], 10, 16)
+				qtype, ok = uint16(n), err == nil
+			}
+			if !ok {
+				return fmt.Errorf("unknown query type: %s", name)
+			}
+			blocked[qtype] = true
+		}
+		if len(blocked) == 0 {
+			blocked = nil
+		}
+		o.BlockedQTypes, o.QTypeAction = blocked, action
+		return nil
+	}
+}
+
+// blockedQTypeReply returns the reply to req by the action if its type is blocked, along with the verdict of it.
+// Otherwise it returns nil.
+func (s *Server) blockedQTypeReply(req *dns.Msg) (*dns.Msg, string) {
+	qtype := req.Question[0].Qtype
+	if !s.BlockedQTypes[qtype] {
+		return nil, ""
+	}
+	blockedQTypes.Add(dns.Type(qtype).String(), 1)
+	m := new(dns.Msg)
+	if s.QTypeAction == QTypeRefuse {
+		m.SetRcode(req, dns.RcodeRefused)
+		return m, VerdictRefused
+	}
+	m.SetReply(req)
+	return m, VerdictFiltered
+}
+
+// blockedQTypeNames returns names of blocked types in order.
+func (s *Server) blockedQTypeNames() []string {
+	var names []string
+	for qtype := range s.BlockedQTypes {
+		names = append(names, dns.Type(qtype).String())
+	}
+	sort.Strings(names)
+	return names
+}
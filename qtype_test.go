@@ -0,0 +1,43 @@
+package gochinadns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestBlockedQTypes(t *testing.T) {
+	for action, rcode := range map[string]int{QTypeEmpty: dns.RcodeSuccess, QTypeRefuse: dns.RcodeRefused} {
+		s, err := NewServer(NewClient(),
+			WithSkipRefineResolvers(true),
+			WithBlockedQTypes(action, "any", " HTTPS", "TYPE64"),
+			WithDomainBlacklist(writeTestList(t, "blacklist", "ads.example.com\n")),
+			WithBlockResponse(BlockNXDomain),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, qtype := range []uint16{dns.TypeANY, dns.TypeHTTPS, dns.TypeSVCB} {
+			w := newFakeResponseWriter("192.168.1.20")
+			s.Serve(w, new(dns.Msg).SetQuestion("www.example.com.", qtype))
+			if w.msg == nil || w.msg.Rcode != rcode || len(w.msg.Answer) != 0 {
+				t.Errorf("%s query should be answered by %s, got %v", dns.Type(qtype), action, w.msg)
+			}
+		}
+		// Others are served as usual, the blacklist for instance.
+		w := newFakeResponseWriter("192.168.1.20")
+		s.Serve(w, new(dns.Msg).SetQuestion("ads.example.com.", dns.TypeA))
+		if w.msg == nil || w.msg.Rcode != dns.RcodeNameError {
+			t.Errorf("A query should not be blocked by its type, got %v", w.msg)
+		}
+		if names := s.Config().BlockedQTypes; len(names) != 3 || names[0] != "ANY" {
+			t.Errorf("Unexpected blocked types in config: %v", names)
+		}
+	}
+
+	for _, f := range []ServerOption{WithBlockedQTypes("drop", "ANY"), WithBlockedQTypes(QTypeEmpty, "BOGUS")} {
+		if err := f(newServerOptions()); err == nil {
+			t.Error("Invalid action or type should fail")
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package gochinadns
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Formats of the query log.
+const (
+	QueryLogJSON   = "json"   // a JSON object per line
+	QueryLogDNSTap = "dnstap" // dnstap (https://dnstap.info) in Frame Streams, readable by tools like dnstap-read
+)
+
+const (
+	// queryLogQueueSize is the max number of records waiting to be written. Records are dropped if the queue is full.
+	queryLogQueueSize = 4096
+	// queryLogFlushInterval is the interval to flush buffered records into the file.
+	queryLogFlushInterval = time.Second
+)
+
+// queryLogDropped counts records dropped since the writer can't keep up.
+var queryLogDropped = expvar.NewInt("chinadns_querylog_dropped")
+
+// QueryRecord is a record of the query log.
+type QueryRecord struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client,omitempty"`
+	Transport string    `json:"transport,omitempty"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Upstream  string    `json:"upstream,omitempty"`
+	Verdict   string    `json:"verdict,omitempty"` // see VerdictXXX
+	Tenant    string    `json:"tenant,omitempty"`  // see WithTenants
+	Cached    bool      `json:"cached,omitempty"`
+	Rcode     string    `json:"rcode"`
+	RTT       float64   `json:"rtt_ms"` // time elapsed since the query arrived, in milliseconds
+
+	client   net.IP
+	latency  time.Duration
+	response []byte // packed answer for dnstap, nil if names are redacted
+}
+
+// WithQueryLog writes a record per query into the file at path, in format QueryLogJSON or QueryLogDNSTap.
+// The file is rotated when it grows beyond maxSize bytes (never if 0), and up to backups rotated files are kept
+// as path.1, path.2, etc. Names are redacted by RedactName, and messages are left out of dnstap records if so.
+func WithQueryLog(path, format string, maxSize int64, backups int) ServerOption {
+	return func(o *serverOptions) error {
+		switch format {
+		case "":
+			format = QueryLogJSON
+		case QueryLogJSON, QueryLogDNSTap:
+		default:
+			return fmt.Errorf("unknown query log format %s, expect json or dnstap", format)
+		}
+		if maxSize < 0 || backups < 0 {
+			return fmt.Errorf("invalid query log rotation: max size %d, backups %d", maxSize, backups)
+		}
+		o.QueryLog = path
+		o.QueryLogFormat = format
+		o.QueryLogMaxSize = maxSize
+		o.QueryLogBackups = backups
+		return nil
+	}
+}
+
+// queryLog writes records into a file in its own goroutine, so that serving is not blocked by disk IO.
+type queryLog struct {
+	path    string
+	format  string
+	maxSize int64
+	backups int
+	records chan *QueryRecord
+
+	tenantOf func(net.IP) string // returns the tenant of a client, nil if tenants are not defined
+
+	file   *os.File // opened on the first run
+	w      *bufio.Writer
+	size   int64
+	failed bool // the file fails to open, and records are dropped
+}
+
+// newQueryLog creates the query log of o. It returns nil if the query log is disabled.
+func newQueryLog(o *serverOptions) *queryLog {
+	if o.QueryLog == "" {
+		return nil
+	}
+	return &queryLog{
+		path:    o.QueryLog,
+		format:  o.QueryLogFormat,
+		maxSize: o.QueryLogMaxSize,
+		backups: o.QueryLogBackups,
+		records: make(chan *QueryRecord, queryLogQueueSize),
+	}
+}
+
+func (l *queryLog) open() error {
+	flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if l.format == QueryLogDNSTap {
+		// A dnstap file can't be appended to, since it must have a single start frame.
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(l.path, flag, 0o640)
+	if err != nil {
+		return fmt.Errorf("fail to open query log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	l.file, l.w, l.size = file, bufio.NewWriter(file), info.Size()
+	if l.format == QueryLogDNSTap {
+		l.write(dnstapStartFrame())
+	}
+	return nil
+}
+
+func (l *queryLog) close() error {
+	if l.format == QueryLogDNSTap {
+		l.write(dnstapStopFrame())
+	}
+	err := l.w.Flush()
+	if e := l.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (l *queryLog) write(b []byte) {
+	n, _ := l.w.Write(b)
+	l.size += int64(n)
+}
+
+// rotate closes the file and opens a new one, after the file is shifted to a backup.
+func (l *queryLog) rotate() error {
+	if err := l.close(); err != nil {
+		logrus.WithError(err).Error("Fail to close query log.")
+	}
+	l.shift()
+	return l.open()
+}
+
+// shift renames the file to path.1, and path.N to path.N+1. The file is removed if no backup is kept.
+func (l *queryLog) shift() {
+	if l.backups == 0 {
+		_ = os.Remove(l.path)
+		return
+	}
+	_ = os.Remove(fmt.Sprintf("%s.%d", l.path, l.backups))
+	for i := l.backups - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+	}
+	_ = os.Rename(l.path, l.path+".1")
+}
+
+// Log queues r to be written. r is dropped if the queue is full.
+func (l *queryLog) Log(r *QueryRecord) {
+	select {
+	case l.records <- r:
+	default:
+		queryLogDropped.Add(1)
+	}
+}
+
+// run writes queued records until ctx is done, and flushes the file then. The file is kept open to run again.
+func (l *queryLog) run(ctx context.Context) {
+	if l.file == nil && !l.failed {
+		if info, err := os.Stat(l.path); err == nil && info.Size() > 0 && l.format == QueryLogDNSTap {
+			l.shift()
+		}
+		if err := l.open(); err != nil {
+			logrus.WithError(err).Error("Query log is disabled.")
+			l.failed = true
+		}
+	}
+	if l.failed {
+		return
+	}
+
+	ticker := time.NewTicker(queryLogFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			_ = l.w.Flush()
+			return
+		case <-ticker.C:
+			if err := l.w.Flush(); err != nil {
+				logrus.WithError(err).Error("Fail to write query log.")
+			}
+		case r := <-l.records:
+			l.write(l.encode(r))
+			if l.maxSize > 0 && l.size >= l.maxSize {
+				if err := l.rotate(); err != nil {
+					logrus.WithError(err).Error("Fail to rotate query log. Query log is disabled.")
+					l.failed = true
+					return
+				}
+			}
+		}
+	}
+}
+
+func (l *queryLog) encode(r *QueryRecord) []byte {
+	if l.format == QueryLogDNSTap {
+		return dnstapFrame(r)
+	}
+	b, _ := json.Marshal(r)
+	return append(b, '\n')
+}
+
+// newQueryRecord creates a record of a query. m is packed for dnstap.
+func (l *queryLog) newQueryRecord(q *dns.Question, client net.IP, transport string, m *dns.Msg, latency time.Duration) *QueryRecord {
+	r := &QueryRecord{
+		Time:      time.Now(),
+		Transport: transport,
+		Name:      RedactName(q.Name),
+		Type:      dns.TypeToString[q.Qtype],
+		Rcode:     dns.RcodeToString[m.Rcode],
+		RTT:       float64(latency) / float64(time.Millisecond),
+		client:    client,
+		latency:   latency,
+	}
+	if client != nil {
+		r.Client = client.String()
+	}
+	if l.tenantOf != nil {
+		r.Tenant = l.tenantOf(client)
+	}
+	if l.format == QueryLogDNSTap && !redacting() {
+		r.response, _ = m.Pack()
+	}
+	return r
+}
+
+func (l *queryLog) logAnswer(e *AnswerEvent) {
+	r := l.newQueryRecord(&e.Question, e.Client, e.Transport, e.Answer, e.Latency)
+	r.Verdict, r.Cached = e.Verdict, e.Cached
+	if e.Upstream != nil {
+		r.Upstream = e.Upstream.String()
+	}
+	l.Log(r)
+}
+
+func (l *queryLog) logBlocked(e *BlockedEvent) {
+	m := new(dns.Msg)
+	m.SetQuestion(e.Question.Name, e.Question.Qtype)
+	m.Response = true
+	r := l.newQueryRecord(&e.Question, e.Client, e.Transport, m, 0)
+	r.Verdict = VerdictBlocked
+	l.Log(r)
+}
+
+// Frame Streams (https://github.com/farsightsec/fstrm) control frames, and the content type of dnstap.
+const (
+	fstrmControlStart = 2
+	fstrmControlStop  = 3
+	fstrmFieldType    = 1
+	dnstapContentType = "protobuf:dnstap.Dnstap"
+	dnstapTypeMessage = 1
+	dnstapClientResp  = 6
+	dnstapFamilyINET  = 1
+	dnstapFamilyINET6 = 2
+	dnstapProtocolUDP = 1
+	dnstapProtocolTCP = 2
+	protoWireVarint   = 0
+	protoWireBytes    = 2
+	protoWireFixed32  = 5
+)
+
+func dnstapStartFrame() []byte {
+	ctrl := appendBE32(nil, fstrmControlStart)
+	ctrl = appendBE32(ctrl, fstrmFieldType)
+	ctrl = appendBE32(ctrl, uint32(len(dnstapContentType)))
+	ctrl = append(ctrl, dnstapContentType...)
+	return append(appendBE32(appendBE32(nil, 0), uint32(len(ctrl))), ctrl...)
+}
+
+func dnstapStopFrame() []byte {
+	return appendBE32(appendBE32(appendBE32(nil, 0), 4), fstrmControlStop)
+}
+
+// dnstapFrame encodes r as a CLIENT_RESPONSE message of dnstap in a data frame. Fields without a counterpart
+// in dnstap, such as the verdict and the upstream, are put into the extra field in text.
+func dnstapFrame(r *QueryRecord) []byte {
+	var msg []byte
+	msg = protoVarint(msg, 1, dnstapClientResp)
+	if ip4 := r.client.To4(); ip4 != nil {
+		msg = protoVarint(msg, 2, dnstapFamilyINET)
+		msg = protoBytes(msg, 4, ip4)
+	} else if r.client != nil {
+		msg = protoVarint(msg, 2, dnstapFamilyINET6)
+		msg = protoBytes(msg, 4, r.client)
+	}
+	if r.Transport == "tcp" {
+		msg = protoVarint(msg, 3, dnstapProtocolTCP)
+	} else {
+		msg = protoVarint(msg, 3, dnstapProtocolUDP)
+	}
+	queried := r.Time.Add(-r.latency)
+	msg = protoVarint(msg, 8, uint64(queried.Unix()))
+	msg = protoFixed32(msg, 9, uint32(queried.Nanosecond()))
+	msg = protoVarint(msg, 12, uint64(r.Time.Unix()))
+	msg = protoFixed32(msg, 13, uint32(r.Time.Nanosecond()))
+	if r.response != nil {
+		msg = protoBytes(msg, 14, r.response)
+	}
+
+	extra := []string{"name=" + r.Name, "type=" + r.Type, "rcode=" + r.Rcode}
+	if r.Upstream != "" {
+		extra = append(extra, "upstream="+r.Upstream)
+	}
+	if r.Verdict != "" {
+		extra = append(extra, "verdict="+r.Verdict)
+	}
+	if r.Cached {
+		extra = append(extra, "cached=true")
+	}
+	if r.Tenant != "" {
+		extra = append(extra, "tenant="+r.Tenant)
+	}
+	var tap []byte
+	tap = protoBytes(tap, 2, []byte(GetVersion()))
+	tap = protoBytes(tap, 3, []byte(strings.Join(extra, " ")))
+	tap = protoBytes(tap, 14, msg)
+	tap = protoVarint(tap, 15, dnstapTypeMessage)
+	return append(appendBE32(nil, uint32(len(tap))), tap...)
+}
+
+func appendBE32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func protoVarint(b []byte, field int, v uint64) []byte {
+	b = appendUvarint(b, uint64(field)<<3|protoWireVarint)
+	return appendUvarint(b, v)
+}
+
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = appendUvarint(b, uint64(field)<<3|protoWireBytes)
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func protoFixed32(b []byte, field int, v uint32) []byte {
+	b = appendUvarint(b, uint64(field)<<3|protoWireFixed32)
+	return append(b, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
@@ -0,0 +1,106 @@
+package gochinadns
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// runQueryLog runs l until records queued by log are written.
+func runQueryLog(l *queryLog, log func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		l.run(ctx)
+		close(done)
+	}()
+	log()
+	for len(l.records) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+}
+
+func TestQueryLogJSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.log")
+	o := newServerOptions()
+	if err := WithQueryLog(path, QueryLogJSON, 300, 1)(o); err != nil {
+		t.Fatal(err)
+	}
+	l := newQueryLog(o)
+
+	answer := newTestReply("example.com.", 60, "142.250.1.1")
+	upstream, _ := ParseResolver("8.8.8.8", false)
+	runQueryLog(l, func() {
+		l.logBlocked(&BlockedEvent{Question: dns.Question{Name: "ads.example.com.", Qtype: dns.TypeA}, Client: net.ParseIP("192.0.2.1"), Transport: "udp"})
+		for i := 0; i < 3; i++ {
+			l.logAnswer(&AnswerEvent{
+				Question:  answer.Question[0],
+				Client:    net.ParseIP("192.0.2.1"),
+				Answer:    answer,
+				Upstream:  upstream,
+				Verdict:   VerdictOverseas,
+				Latency:   30 * time.Millisecond,
+				Transport: "tcp",
+			})
+		}
+	})
+
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("Query log should be rotated: %v", err)
+	}
+	if _, err := os.Stat(path + ".2"); err == nil {
+		t.Error("Only 1 rotated query log should be kept")
+	}
+	b, err := os.ReadFile(path + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	var r QueryRecord
+	if err = json.Unmarshal([]byte(lines[len(lines)-1]), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "example.com." || r.Type != "A" || r.Verdict != VerdictOverseas || r.Upstream != upstream.String() ||
+		r.Rcode != "NOERROR" || r.Client != "192.0.2.1" || r.Transport != "tcp" || r.RTT != 30 {
+		t.Errorf("Unexpected record: %+v", r)
+	}
+}
+
+func TestQueryLogDNSTap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "query.tap")
+	o := newServerOptions()
+	if err := WithQueryLog(path, QueryLogDNSTap, 0, 0)(o); err != nil {
+		t.Fatal(err)
+	}
+	l := newQueryLog(o)
+	runQueryLog(l, func() {
+		l.logBlocked(&BlockedEvent{Question: dns.Question{Name: "ads.example.com.", Qtype: dns.TypeA}, Client: net.ParseIP("2001:db8::1")})
+	})
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, dnstapStartFrame()) {
+		t.Fatalf("dnstap log should begin with a start frame: %q", b)
+	}
+	for _, s := range []string{"verdict=blocked", "name=ads.example.com.", "\x03ads\x07example\x03com\x00"} {
+		if !bytes.Contains(b, []byte(s)) {
+			t.Errorf("dnstap log should contain %q", s)
+		}
+	}
+
+	if err := WithQueryLog(path, "text", 0, 0)(o); err == nil {
+		t.Error("Unknown format should fail")
+	}
+}
@@ -0,0 +1,98 @@
+package gochinadns
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"expvar"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errCaseMismatch = errors.New("case of the question name mismatches")
+	caseMismatches  = expvar.NewInt("chinadns_case_mismatches")
+)
+
+// WithCaseRandomization randomizes the case of question names sent to untrusted resolvers (DNS 0x20, see
+// https://tools.ietf.org/html/draft-vixie-dnsext-dns0x20-00), and discards replies not echoing the case exactly.
+// Off-path injectors have to guess the case besides the ID and port then. Over UDP, the lookup keeps waiting for
+// the genuine reply after discarding a mismatched one. Resolvers which don't preserve the case fail all queries.
+func WithCaseRandomization(enabled bool) ServerOption {
+	return func(o *serverOptions) error {
+		o.CaseRandomization = enabled
+		return nil
+	}
+}
+
+type replyCheckKey struct{}
+
+// withReplyCheck returns a context of a lookup whose replies are discarded unless check returns nil.
+func withReplyCheck(ctx context.Context, check func(*dns.Msg) error) context.Context {
+	return context.WithValue(ctx, replyCheckKey{}, check)
+}
+
+// replyCheckFromContext returns the check of replies of a lookup, or nil.
+func replyCheckFromContext(ctx context.Context) func(*dns.Msg) error {
+	check, _ := ctx.Value(replyCheckKey{}).(func(*dns.Msg) error)
+	return check
+}
+
+// lookupRandomizedCase looks up req by lookup with the question name in random case, and checks that the reply
+// echoes it. The case of names in the reply is restored.
+func lookupRandomizedCase(ctx context.Context, req *dns.Msg, server *Resolver, lookup LookupFunc) (*dns.Msg, time.Duration, error) {
+	name := req.Question[0].Name
+	randomized := randomizeCase(name)
+	req.Question[0].Name = randomized
+	check := func(reply *dns.Msg) error {
+		if len(reply.Question) == 0 || reply.Question[0].Name != randomized {
+			caseMismatches.Add(1)
+			logEntry(ctx).WithFields(logrus.Fields{"question": questionString(&req.Question[0]), "server": server}).
+				Debug("Discard a reply with mismatched case of the question name.")
+			return errCaseMismatch
+		}
+		return nil
+	}
+	reply, rtt, err := lookup(withReplyCheck(ctx, check), req, server)
+	if err != nil {
+		return reply, rtt, err
+	}
+	// DoH and DoT replies are not checked by exchanges.
+	if err = check(reply); err != nil {
+		return nil, rtt, err
+	}
+	restoreCase(reply, randomized, name)
+	return reply, rtt, nil
+}
+
+// randomizeCase flips the case of each letter in name randomly.
+func randomizeCase(name string) string {
+	bits := make([]byte, len(name))
+	if _, err := rand.Read(bits); err != nil {
+		return name
+	}
+	b := []byte(name)
+	for i, c := range b {
+		if ('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && bits[i]&1 == 1 {
+			b[i] ^= 0x20
+		}
+	}
+	return string(b)
+}
+
+// restoreCase replaces owner names of records in m which are randomized by name.
+func restoreCase(m *dns.Msg, randomized, name string) {
+	for i := range m.Question {
+		if m.Question[i].Name == randomized {
+			m.Question[i].Name = name
+		}
+	}
+	forEachRR(m, func(rr dns.RR) {
+		if h := rr.Header(); strings.EqualFold(h.Name, randomized) {
+			h.Name = name
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startInjectedUpstream starts a UDP upstream, replying to each query with a forged reply of the question name in
+// swapped case first, followed by the genuine reply if genuine is set.
+func startInjectedUpstream(t *testing.T, genuine bool) *Resolver {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := new(dns.Msg)
+			if req.Unpack(buf[:n]) != nil {
+				continue
+			}
+			forged := newTestReply(swapCase(req.Question[0].Name), 60, "203.0.113.1")
+			forged.Id = req.Id
+			b, _ := forged.Pack()
+			_, _ = pc.WriteTo(b, addr)
+			if genuine {
+				m := newTestReply(req.Question[0].Name, 60, "142.250.1.1")
+				m.Id = req.Id
+				b, _ = m.Pack()
+				_, _ = pc.WriteTo(b, addr)
+			}
+		}
+	}()
+	r, err := ParseResolver(pc.LocalAddr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func swapCase(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' {
+			b[i] ^= 0x20
+		}
+	}
+	return string(b)
+}
+
+func TestCaseRandomization(t *testing.T) {
+	o := newServerOptions()
+	if err := WithCaseRandomization(true)(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o, Client: NewClient(WithTimeout(200 * time.Millisecond))}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	reply, _, err := s.lookupUntrusted(context.Background(), req.Copy(), startInjectedUpstream(t, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := firstAddress(reply); !ip.Equal(net.ParseIP("142.250.1.1")) {
+		t.Errorf("Forged reply should be discarded, got %s", ip)
+	}
+	if reply.Question[0].Name != "www.example.com." || reply.Answer[0].Header().Name != "www.example.com." {
+		t.Errorf("Case of names should be restored, got %s", reply)
+	}
+
+	if _, _, err = s.lookupUntrusted(context.Background(), req.Copy(), startInjectedUpstream(t, false)); !errors.Is(err, errCaseMismatch) {
+		t.Errorf("Lookup should fail with mismatched case, got %v", err)
+	}
+}
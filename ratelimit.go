@@ -0,0 +1,187 @@
+package gochinadns
+
+import (
+	"container/list"
+	"expvar"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Actions on UDP queries of clients exceeding the rate limit.
+const (
+	RateLimitDrop     = "drop"     // reply nothing
+	RateLimitRefuse   = "refuse"   // reply REFUSED
+	RateLimitTruncate = "truncate" // reply an empty answer with TC set, so that genuine clients retry over TCP
+)
+
+const (
+	// rateLimitUnit is the response size charged as one query, so that large responses cost more tokens.
+	rateLimitUnit = 512
+	// rateLimitSweepInterval is the interval to remove buckets of idle clients.
+	rateLimitSweepInterval = time.Minute
+	// rateLimitMaxBuckets caps buckets of clients, so that floods of spoofed sources don't exhaust memory. Buckets
+	// of the least recently seen clients are evicted beyond it.
+	rateLimitMaxBuckets = 100000
+)
+
+var rateLimited = expvar.NewInt("chinadns_rate_limited")
+
+// WithRateLimit limits UDP queries of each client (by IP, or /64 of IPv6) to qps on average, with bursts of burst.
+// A response costs a query per 512 bytes, to protect against DNS amplification. Queries beyond the limit are dealt
+// with by action, see RateLimitXXX. TCP queries are not limited, since their source addresses can't be spoofed.
+func WithRateLimit(qps float64, burst int, action string) ServerOption {
+	return func(o *serverOptions) error {
+		if qps < 0 || burst < 0 {
+			return fmt.Errorf("invalid rate limit: %v qps with bursts of %d", qps, burst)
+		}
+		switch action {
+		case RateLimitDrop, RateLimitRefuse, RateLimitTruncate:
+		default:
+			return fmt.Errorf("unknown rate limit action: %s", action)
+		}
+		if burst == 0 {
+			burst = int(qps) + 1
+		}
+		o.RateLimitQPS, o.RateLimitBurst, o.RateLimitAction = qps, burst, action
+		return nil
+	}
+}
+
+// rateLimiter is a token bucket limiter keyed by client.
+type rateLimiter struct {
+	rate   float64 // tokens per second
+	burst  float64
+	action string
+
+	mu        sync.Mutex
+	buckets   map[string]*list.Element // of *tokenBucket in lru
+	lru       *list.List               // the most recently seen at the front
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for the options, or nil if rate limiting is disabled.
+func newRateLimiter(o *serverOptions) *rateLimiter {
+	if o.RateLimitQPS <= 0 {
+		return nil
+	}
+	return &rateLimiter{
+		rate:      o.RateLimitQPS,
+		burst:     float64(o.RateLimitBurst),
+		action:    o.RateLimitAction,
+		buckets:   make(map[string]*list.Element),
+		lru:       list.New(),
+		lastSweep: time.Now(),
+	}
+}
+
+// rateLimitKey returns the key of the bucket of ip. IPv6 clients are limited by /64, which is usually a single host.
+func rateLimitKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4)
+	}
+	return string(ip.Mask(net.CIDRMask(64, 128)))
+}
+
+// allow takes a token of key, and returns false if no token is left.
+func (l *rateLimiter) allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) > rateLimitSweepInterval {
+		l.sweep(now)
+	}
+	b := l.refill(key, now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// charge takes cost tokens of key after a response is written. Tokens may go negative, down to -burst.
+func (l *rateLimiter) charge(key string, cost float64, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.refill(key, now)
+	if b.tokens -= cost; b.tokens < -l.burst {
+		b.tokens = -l.burst
+	}
+}
+
+func (l *rateLimiter) refill(key string, now time.Time) *tokenBucket {
+	e := l.buckets[key]
+	if e == nil {
+		if l.lru.Len() >= rateLimitMaxBuckets {
+			oldest := l.lru.Back()
+			delete(l.buckets, oldest.Value.(*tokenBucket).key)
+			l.lru.Remove(oldest)
+		}
+		b := &tokenBucket{key: key, tokens: l.burst, last: now}
+		l.buckets[key] = l.lru.PushFront(b)
+		return b
+	}
+	l.lru.MoveToFront(e)
+	b := e.Value.(*tokenBucket)
+	if b.tokens += now.Sub(b.last).Seconds() * l.rate; b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	return b
+}
+
+// sweep removes buckets which would be full by now, as if they were never used.
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, e := range l.buckets {
+		if b := e.Value.(*tokenBucket); b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+			l.lru.Remove(e)
+		}
+	}
+	l.lastSweep = now
+}
+
+// serve serves req of a UDP client by next, unless the client exceeds the limit.
+func (l *rateLimiter) serve(w dns.ResponseWriter, req *dns.Msg, next func(dns.ResponseWriter, *dns.Msg)) {
+	key := rateLimitKey(clientIP(w))
+	if l.allow(key, time.Now()) {
+		next(&chargedWriter{ResponseWriter: w, limiter: l, key: key}, req)
+		return
+	}
+	rateLimited.Add(1)
+	logrus.WithField("client", clientIP(w)).Debug("Rate limited: ", l.action)
+	m := new(dns.Msg)
+	switch l.action {
+	case RateLimitRefuse:
+		m.SetRcode(req, dns.RcodeRefused)
+	case RateLimitTruncate:
+		m.SetReply(req)
+		m.Truncated = true
+	default:
+		return
+	}
+	_ = w.WriteMsg(m)
+}
+
+// chargedWriter charges the client for the size of responses beyond a query.
+type chargedWriter struct {
+	dns.ResponseWriter
+	limiter *rateLimiter
+	key     string
+}
+
+func (w *chargedWriter) WriteMsg(m *dns.Msg) error {
+	if extra := m.Len() / rateLimitUnit; extra > 0 {
+		w.limiter.charge(w.key, float64(extra), time.Now())
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
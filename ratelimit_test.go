@@ -0,0 +1,86 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRateLimiter(t *testing.T) {
+	o := newServerOptions()
+	if err := WithRateLimit(2, 3, RateLimitRefuse)(o); err != nil {
+		t.Fatal(err)
+	}
+	l := newRateLimiter(o)
+	now := time.Now()
+	key := rateLimitKey(net.ParseIP("192.0.2.1"))
+	for i := 0; i < 3; i++ {
+		if !l.allow(key, now) {
+			t.Fatalf("Query %d in the burst should be allowed", i)
+		}
+	}
+	if l.allow(key, now) {
+		t.Error("Query beyond the burst should be limited")
+	}
+	if !l.allow(rateLimitKey(net.ParseIP("192.0.2.2")), now) {
+		t.Error("Other clients should not be limited")
+	}
+	if !l.allow(key, now.Add(500*time.Millisecond)) {
+		t.Error("A token should be refilled in 500ms")
+	}
+
+	// Large responses cost more.
+	l.charge(key, 4, now.Add(time.Second))
+	if l.allow(key, now.Add(2*time.Second)) {
+		t.Error("Client should be limited after large responses")
+	}
+
+	if rateLimitKey(net.ParseIP("2001:db8::1")) != rateLimitKey(net.ParseIP("2001:db8::2")) {
+		t.Error("IPv6 clients in the same /64 should share a bucket")
+	}
+
+	// Buckets are capped, evicting the least recently seen clients.
+	for i := 0; i < rateLimitMaxBuckets; i++ {
+		l.allow(rateLimitKey(net.IPv4(10, byte(i>>16), byte(i>>8), byte(i))), now)
+	}
+	if len(l.buckets) != rateLimitMaxBuckets || l.lru.Len() != rateLimitMaxBuckets {
+		t.Errorf("%d buckets, want %d", len(l.buckets), rateLimitMaxBuckets)
+	}
+	if _, ok := l.buckets[key]; ok {
+		t.Error("Bucket of the least recently seen client should be evicted")
+	}
+}
+
+func TestRateLimiterServe(t *testing.T) {
+	o := newServerOptions()
+	if err := WithRateLimit(1, 1, RateLimitTruncate)(o); err != nil {
+		t.Fatal(err)
+	}
+	l := newRateLimiter(o)
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeANY)
+
+	served := 0
+	next := func(w dns.ResponseWriter, req *dns.Msg) {
+		served++
+		m := new(dns.Msg)
+		m.SetReply(req)
+		_ = w.WriteMsg(m)
+	}
+	for i := 0; i < 2; i++ {
+		w := newFakeResponseWriter("192.0.2.1")
+		l.serve(w, req, next)
+		if i == 1 && (w.msg == nil || !w.msg.Truncated) {
+			t.Errorf("Limited query should get a truncated reply, got %v", w.msg)
+		}
+	}
+	if served != 1 {
+		t.Errorf("%d queries served, want 1", served)
+	}
+
+	if err := WithRateLimit(1, 1, "ignore")(newServerOptions()); err == nil {
+		t.Error("Unknown action should fail")
+	}
+}
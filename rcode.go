@@ -0,0 +1,103 @@
+package gochinadns
+
+import (
+	"expvar"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Policies of error rcodes in replies of untrusted servers.
+const (
+	RcodeSuspicious = ""       // wait for trusted replies on SERVFAIL, and on NXDOMAIN of polluted domains
+	RcodeAccept     = "accept" // accept error rcodes as is, like answers without IPs
+	RcodeStrict     = "strict" // wait for trusted replies on any error rcode, including NXDOMAIN of all domains
+)
+
+// Policies of empty answers (NOERROR without records) in replies of untrusted servers.
+const (
+	EmptyAnswerAccept  = ""        // accept empty answers as is
+	EmptyAnswerAddress = "address" // wait for trusted replies on empty answers of A and AAAA queries
+	EmptyAnswerAll     = "all"     // wait for trusted replies on empty answers of all queries
+)
+
+var (
+	suspiciousRcodes       = expvar.NewInt("chinadns_suspicious_rcodes")
+	suspiciousEmptyAnswers = expvar.NewInt("chinadns_suspicious_empty_answers")
+)
+
+// WithRcodePolicy sets the policy of error rcodes in replies of untrusted servers. Spoofed NXDOMAIN or SERVFAIL
+// replies may arrive before genuine ones, and are accepted as is without a policy. Suspicious replies are set aside
+// to wait for trusted replies, and only used as fallback. See RcodeXXX for available policies.
+func WithRcodePolicy(policy string) ServerOption {
+	return func(o *serverOptions) error {
+		switch policy {
+		case RcodeSuspicious, RcodeAccept, RcodeStrict:
+		default:
+			return fmt.Errorf("unknown rcode policy [%s], expect accept or strict", policy)
+		}
+		o.RcodePolicy = policy
+		return nil
+	}
+}
+
+// WithEmptyAnswerPolicy sets the policy of empty answers in replies of untrusted servers. Some poisoned paths answer
+// NOERROR without records instead of bogus IPs, which are accepted as is without a policy. Suspicious replies are set
+// aside to wait for trusted replies like suspicious rcodes, and only used as fallback. See EmptyAnswerXXX for
+// available policies.
+func WithEmptyAnswerPolicy(policy string) ServerOption {
+	return func(o *serverOptions) error {
+		switch policy {
+		case EmptyAnswerAccept, EmptyAnswerAddress, EmptyAnswerAll:
+		default:
+			return fmt.Errorf("unknown empty answer policy [%s], expect address or all", policy)
+		}
+		o.EmptyAnswerPolicy = policy
+		return nil
+	}
+}
+
+// isSuspiciousEmpty tells whether rep, an untrusted reply, is a suspicious empty answer by the empty answer policy.
+func (s *Server) isSuspiciousEmpty(rep *upstreamReply) bool {
+	if s.EmptyAnswerPolicy == EmptyAnswerAccept || rep.Rcode != dns.RcodeSuccess || len(rep.Answer) > 0 {
+		return false
+	}
+	if s.EmptyAnswerPolicy == EmptyAnswerAddress && len(rep.Question) > 0 {
+		if qt := rep.Question[0].Qtype; qt != dns.TypeA && qt != dns.TypeAAAA {
+			return false
+		}
+	}
+	suspiciousEmptyAnswers.Add(1)
+	return true
+}
+
+// isSuspiciousRcode tells whether the rcode of rep, an untrusted reply, is suspicious by the rcode policy.
+// NXDOMAIN is suspicious under the default policy if the question or a CNAME target in the answer is polluted.
+func (s *Server) isSuspiciousRcode(rep *upstreamReply) bool {
+	var suspicious bool
+	switch {
+	case s.RcodePolicy == RcodeAccept || rep.Rcode == dns.RcodeSuccess:
+	case rep.Rcode == dns.RcodeServerFailure || s.RcodePolicy == RcodeStrict:
+		suspicious = true
+	case rep.Rcode == dns.RcodeNameError:
+		suspicious = s.repliesPollutedName(rep.Msg)
+	}
+	if suspicious {
+		suspiciousRcodes.Add(1)
+	}
+	return suspicious
+}
+
+// repliesPollutedName tells whether the question of m or a CNAME target in its answer is a polluted domain.
+// Polluted questions are never sent to untrusted servers, but CNAME chains may lead there.
+func (s *Server) repliesPollutedName(m *dns.Msg) bool {
+	if len(m.Question) > 0 && s.isDomainPolluted(m.Question[0].Name) {
+		return true
+	}
+	for _, rr := range m.Answer {
+		if cname, ok := rr.(*dns.CNAME); ok && s.isDomainPolluted(cname.Target) {
+			return true
+		}
+	}
+	return false
+}
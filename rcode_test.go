@@ -0,0 +1,128 @@
+package gochinadns
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRcodePolicy(t *testing.T) {
+	polluted := new(domainTrie)
+	polluted.Add("google.com")
+	for _, tc := range []struct {
+		policy string
+		rcode  int
+		cname  string
+		want   bool // whether the trusted reply is chosen
+	}{
+		{RcodeSuspicious, dns.RcodeServerFailure, "", true},
+		{RcodeSuspicious, dns.RcodeNameError, "", false},
+		{RcodeSuspicious, dns.RcodeNameError, "www.google.com.", true},
+		{RcodeSuspicious, dns.RcodeRefused, "", false},
+		{RcodeStrict, dns.RcodeNameError, "", true},
+		{RcodeStrict, dns.RcodeRefused, "", true},
+		{RcodeAccept, dns.RcodeServerFailure, "", false},
+	} {
+		o := newServerOptions()
+		o.Delay = time.Second
+		o.DomainPolluted = polluted
+		trusted := NewUpstreamResolver("trusted", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			}
+			m := newTestReply(req.Question[0].Name, 60, "142.250.1.1")
+			m.Id = req.Id
+			return m, 50 * time.Millisecond, nil
+		}))
+		untrusted := NewUpstreamResolver("untrusted", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+			m := new(dns.Msg)
+			m.SetRcode(req, tc.rcode)
+			if tc.cname != "" {
+				m.Answer = append(m.Answer, &dns.CNAME{
+					Hdr:    dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+					Target: tc.cname,
+				})
+			}
+			return m, time.Millisecond, nil
+		}))
+		for _, f := range []ServerOption{WithUpstreams(true, trusted), WithUpstreams(false, untrusted), WithRcodePolicy(tc.policy)} {
+			if err := f(o); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second)), goroutines: newGoroutineTracker()}
+		if err := s.partitionResolvers(); err != nil {
+			t.Fatal(err)
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		reply := s.resolve(context.Background(), logrus.WithField("test", t.Name()), req)
+		if reply == nil {
+			t.Fatalf("%q %s: no reply", tc.policy, dns.RcodeToString[tc.rcode])
+		}
+		if got := reply.server == trusted; got != tc.want {
+			t.Errorf("%q %s (CNAME %q): trusted reply chosen %v, want %v", tc.policy, dns.RcodeToString[tc.rcode], tc.cname, got, tc.want)
+		}
+	}
+	if err := WithRcodePolicy("lenient")(newServerOptions()); err == nil {
+		t.Error("Unknown rcode policy should fail")
+	}
+}
+
+func TestEmptyAnswerPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy string
+		qtype  uint16
+		want   bool // whether the trusted reply is chosen
+	}{
+		{EmptyAnswerAccept, dns.TypeA, false},
+		{EmptyAnswerAddress, dns.TypeA, true},
+		{EmptyAnswerAddress, dns.TypeAAAA, true},
+		{EmptyAnswerAddress, dns.TypeMX, false},
+		{EmptyAnswerAll, dns.TypeMX, true},
+	} {
+		o := newServerOptions()
+		o.Delay = time.Second
+		trusted := NewUpstreamResolver("trusted", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+			select {
+			case <-time.After(50 * time.Millisecond):
+			case <-ctx.Done():
+				return nil, 0, ctx.Err()
+			}
+			m := newTestReply(req.Question[0].Name, 60, "142.250.1.1")
+			m.Id = req.Id
+			return m, 50 * time.Millisecond, nil
+		}))
+		untrusted := NewUpstreamResolver("untrusted", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+			return new(dns.Msg).SetReply(req), time.Millisecond, nil
+		}))
+		for _, f := range []ServerOption{WithUpstreams(true, trusted), WithUpstreams(false, untrusted), WithEmptyAnswerPolicy(tc.policy)} {
+			if err := f(o); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second)), goroutines: newGoroutineTracker()}
+		if err := s.partitionResolvers(); err != nil {
+			t.Fatal(err)
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", tc.qtype)
+		reply := s.resolve(context.Background(), logrus.WithField("test", t.Name()), req)
+		if reply == nil {
+			t.Fatalf("%q %s: no reply", tc.policy, dns.TypeToString[tc.qtype])
+		}
+		if got := reply.server == trusted; got != tc.want {
+			t.Errorf("%q %s: trusted reply chosen %v, want %v", tc.policy, dns.TypeToString[tc.qtype], got, tc.want)
+		}
+	}
+	if err := WithEmptyAnswerPolicy("lenient")(newServerOptions()); err == nil {
+		t.Error("Unknown empty answer policy should fail")
+	}
+}
@@ -0,0 +1,44 @@
+package gochinadns
+
+import (
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+// Modes of handling the RD (recursion desired) bit of queries.
+const (
+	RecursionForce    = ""         // set RD in all queries to upstreams
+	RecursionPreserve = "preserve" // keep RD of clients, e.g. for authoritative-only servers behind forward rules
+	RecursionRefuse   = "refuse"   // refuse iterative queries (without RD), and set RD in the others
+)
+
+// WithRecursionMode sets the mode of handling the RD bit of queries. See RecursionXXX for available modes.
+func WithRecursionMode(mode string) ServerOption {
+	return func(o *serverOptions) error {
+		switch mode {
+		case RecursionForce, RecursionPreserve, RecursionRefuse:
+		default:
+			return fmt.Errorf("unknown recursion mode [%s], expect preserve or refuse", mode)
+		}
+		o.RecursionMode = mode
+		return nil
+	}
+}
+
+// refusedIterativeReply returns a REFUSED reply to req if it's an iterative query refused by the recursion mode.
+// Otherwise it returns nil.
+func (s *Server) refusedIterativeReply(req *dns.Msg) *dns.Msg {
+	if s.RecursionMode != RecursionRefuse || req.RecursionDesired {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetRcode(req, dns.RcodeRefused)
+	return m
+}
+
+// cacheable tells whether the reply of req can be cached. Replies of iterative queries are not, since they may be
+// referrals instead of answers.
+func cacheable(req *dns.Msg) bool {
+	return req.RecursionDesired
+}
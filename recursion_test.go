@@ -0,0 +1,40 @@
+package gochinadns
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRecursionMode(t *testing.T) {
+	for _, tc := range []struct {
+		mode        string
+		refused     bool // whether an iterative query is refused
+		preservedRD bool // whether RD of an iterative query is preserved
+	}{
+		{RecursionForce, false, false},
+		{RecursionPreserve, false, true},
+		{RecursionRefuse, true, false},
+	} {
+		o := newServerOptions()
+		if err := WithRecursionMode(tc.mode)(o); err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{serverOptions: o, Client: NewClient()}
+		req := new(dns.Msg)
+		req.SetQuestion("intranet.example.", dns.TypeA)
+		req.RecursionDesired = false
+
+		m := s.refusedIterativeReply(req)
+		if (m != nil) != tc.refused || m != nil && m.Rcode != dns.RcodeRefused {
+			t.Errorf("%q: iterative query should be refused: %v, got %v", tc.mode, tc.refused, m)
+		}
+		s.normalizeRequest(req)
+		if req.RecursionDesired == tc.preservedRD {
+			t.Errorf("%q: RD should be preserved: %v", tc.mode, tc.preservedRD)
+		}
+	}
+	if err := WithRecursionMode("iterate")(newServerOptions()); err == nil {
+		t.Error("Unknown recursion mode should be rejected")
+	}
+}
@@ -0,0 +1,129 @@
+package gochinadns
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+// Prefixes of redacted names.
+const (
+	hmacNamePrefix      = "h:"
+	encryptedNamePrefix = "e:"
+)
+
+// NameRedactor transforms domain names exported in logs, events and the admin API,
+// so that browsing history is not stored in cleartext.
+type NameRedactor interface {
+	RedactName(name string) string
+}
+
+var nameRedactor atomic.Value // of redactorHolder
+
+type redactorHolder struct {
+	NameRedactor
+}
+
+// SetNameRedactor sets the redactor applied to exported domain names. Names are exported in cleartext if r is nil.
+func SetNameRedactor(r NameRedactor) {
+	nameRedactor.Store(redactorHolder{r})
+}
+
+// RedactName transforms name by the redactor set by SetNameRedactor.
+// Hooks exporting events should apply it to names too.
+func RedactName(name string) string {
+	if h, ok := nameRedactor.Load().(redactorHolder); ok && h.NameRedactor != nil {
+		return h.RedactName(name)
+	}
+	return name
+}
+
+// redacting tells whether names are redacted, so that raw messages with cleartext names shouldn't be exported.
+func redacting() bool {
+	h, ok := nameRedactor.Load().(redactorHolder)
+	return ok && h.NameRedactor != nil
+}
+
+// deriveKey derives a key for purpose from the site key.
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func canonicalName(name string) []byte {
+	return []byte(strings.ToLower(strings.TrimSuffix(name, ".")))
+}
+
+type hmacRedactor struct {
+	key []byte
+}
+
+// NewHMACRedactor returns a redactor replacing names by HMAC-SHA256 tokens of key.
+// The same name always gets the same token, so tokens can be correlated but not reversed.
+func NewHMACRedactor(key []byte) NameRedactor {
+	return &hmacRedactor{key: deriveKey(key, "chinadns name hmac")}
+}
+
+func (r *hmacRedactor) RedactName(name string) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write(canonicalName(name))
+	return hmacNamePrefix + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+type aesRedactor struct {
+	aead  cipher.AEAD
+	ivKey []byte
+}
+
+// NewAESRedactor returns a redactor encrypting names by AES-256-GCM with a nonce derived from the name,
+// so that the same name always gets the same token, and tokens can be decrypted by DecryptName with key.
+func NewAESRedactor(key []byte) (NameRedactor, error) {
+	if len(key) == 0 {
+		return nil, errors.New("empty name encryption key")
+	}
+	block, err := aes.NewCipher(deriveKey(key, "chinadns name encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &aesRedactor{aead: aead, ivKey: deriveKey(key, "chinadns name nonce")}, nil
+}
+
+func (r *aesRedactor) RedactName(name string) string {
+	plain := canonicalName(name)
+	mac := hmac.New(sha256.New, r.ivKey)
+	mac.Write(plain)
+	nonce := mac.Sum(nil)[:r.aead.NonceSize()]
+	return encryptedNamePrefix + base64.RawURLEncoding.EncodeToString(r.aead.Seal(nonce, nonce, plain, nil))
+}
+
+// DecryptName decrypts a name encrypted by a redactor from NewAESRedactor with key.
+func DecryptName(key []byte, token string) (string, error) {
+	if !strings.HasPrefix(token, encryptedNamePrefix) {
+		return "", errors.New("not an encrypted name")
+	}
+	r, err := NewAESRedactor(key)
+	if err != nil {
+		return "", err
+	}
+	aead := r.(*aesRedactor).aead
+	b, err := base64.RawURLEncoding.DecodeString(token[len(encryptedNamePrefix):])
+	if err != nil || len(b) < aead.NonceSize() {
+		return "", errors.New("malformed encrypted name")
+	}
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return "", errors.New("fail to decrypt name: wrong key or corrupted token")
+	}
+	return string(plain), nil
+}
@@ -0,0 +1,43 @@
+package gochinadns
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNameRedactors(t *testing.T) {
+	key := []byte("site key")
+	h := NewHMACRedactor(key)
+	token := h.RedactName("www.Example.com.")
+	if !strings.HasPrefix(token, hmacNamePrefix) || strings.Contains(token, "example") {
+		t.Errorf("Unexpected HMAC token %s", token)
+	}
+	if h.RedactName("www.example.com") != token {
+		t.Error("Tokens of the same name should be the same")
+	}
+	if NewHMACRedactor([]byte("other key")).RedactName("www.example.com.") == token {
+		t.Error("Tokens of different keys should differ")
+	}
+
+	e, err := NewAESRedactor(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token = e.RedactName("www.example.com.")
+	if e.RedactName("www.example.com.") != token || e.RedactName("example.com.") == token {
+		t.Error("Encrypted names should be deterministic")
+	}
+	name, err := DecryptName(key, token)
+	if err != nil || name != "www.example.com" {
+		t.Errorf("DecryptName(%s) = %s, %v", token, name, err)
+	}
+	if _, err := DecryptName([]byte("other key"), token); err == nil {
+		t.Error("Decrypting with a wrong key should fail")
+	}
+
+	SetNameRedactor(h)
+	defer SetNameRedactor(nil)
+	if RedactName("www.example.com.") != h.RedactName("www.example.com.") {
+		t.Error("RedactName should apply the redactor set")
+	}
+}
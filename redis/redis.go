@@ -0,0 +1,321 @@
+// Package redis implements a minimal Redis client of the RESP2 protocol, which is enough for a shared cache.
+// Connections are pooled, and authenticated and switched to the database of the client on dialing.
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultPort    = "6379"
+	defaultTimeout = 2 * time.Second
+	maxIdleConns   = 8
+	maxBulkLen     = 512 << 20 // the limit of Redis strings
+	maxArrayLen    = 1 << 20
+)
+
+// Error is an error reply of the server.
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+var errProtocol = errors.New("redis: protocol error")
+
+// Client is a Redis client safe for concurrent use.
+type Client struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+
+	mu   sync.Mutex
+	idle []*conn
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// NewClient returns a client of the server at addr, which authenticates with password if it's not empty, and
+// selects database db. Each command times out after timeout, 2s if 0.
+func NewClient(addr, password string, db int, timeout time.Duration) *Client {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	return &Client{addr: addr, password: password, db: db, timeout: timeout}
+}
+
+// ParseURL returns a client of the server at a URL like `redis://[:password@]host[:port][/db]`.
+func ParseURL(rawurl string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid redis URL: %s", rawurl)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	password, _ := u.User.Password()
+	db := 0
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		if db, err = strconv.Atoi(path); err != nil || db < 0 {
+			return nil, fmt.Errorf("invalid redis database: %s", path)
+		}
+	}
+	return NewClient(addr, password, db, timeout), nil
+}
+
+// Do sends a command of args, which are strings, byte slices or integers, and returns its reply: a string for
+// simple strings, an int64 for integers, a []byte for bulk strings, nil for null bulk strings, or an []interface{}
+// of them for arrays. Error replies are returned as Error.
+func (c *Client) Do(args ...interface{}) (interface{}, error) {
+	co, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := co.do(c.timeout, args...)
+	if _, ok := err.(Error); err != nil && !ok {
+		// The connection may be out of sync.
+		_ = co.Close()
+		return nil, err
+	}
+	c.put(co)
+	return reply, err
+}
+
+// Get returns the value of key, or nil if it's absent.
+func (c *Client) Get(key string) ([]byte, error) {
+	reply, err := c.Do("GET", key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+	b, ok := reply.([]byte)
+	if !ok {
+		return nil, errProtocol
+	}
+	return b, nil
+}
+
+// Set sets key to value, which expires after ttl (rounded to milliseconds), or never if ttl is 0.
+func (c *Client) Set(key string, value []byte, ttl time.Duration) error {
+	args := []interface{}{"SET", key, value}
+	if ttl > 0 {
+		ms := ttl.Milliseconds()
+		if ms == 0 {
+			ms = 1
+		}
+		args = append(args, "PX", ms)
+	}
+	_, err := c.Do(args...)
+	return err
+}
+
+// Del removes keys, and returns the number of keys removed.
+func (c *Client) Del(keys ...string) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	args := make([]interface{}, 0, len(keys)+1)
+	args = append(args, "DEL")
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	reply, err := c.Do(args...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, errProtocol
+	}
+	return n, nil
+}
+
+// Scan calls f with keys matching pattern in batches, until all of them are scanned or f returns an error.
+// Keys changed during the scan may be missed or repeated.
+func (c *Client) Scan(pattern string, f func(keys []string) error) error {
+	cursor := "0"
+	for {
+		reply, err := c.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000)
+		if err != nil {
+			return err
+		}
+		arr, ok := reply.([]interface{})
+		if !ok || len(arr) != 2 {
+			return errProtocol
+		}
+		next, ok1 := arr[0].([]byte)
+		list, ok2 := arr[1].([]interface{})
+		if !ok1 || !ok2 {
+			return errProtocol
+		}
+		keys := make([]string, 0, len(list))
+		for _, k := range list {
+			if b, ok := k.([]byte); ok {
+				keys = append(keys, string(b))
+			}
+		}
+		if len(keys) > 0 {
+			if err = f(keys); err != nil {
+				return err
+			}
+		}
+		if cursor = string(next); cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// Close closes idle connections.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	idle := c.idle
+	c.idle = nil
+	c.mu.Unlock()
+	for _, co := range idle {
+		_ = co.Close()
+	}
+	return nil
+}
+
+func (c *Client) get() (*conn, error) {
+	c.mu.Lock()
+	if n := len(c.idle); n > 0 {
+		co := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return co, nil
+	}
+	c.mu.Unlock()
+
+	nc, err := net.DialTimeout("tcp", c.addr, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	co := &conn{Conn: nc, r: bufio.NewReader(nc)}
+	if c.password != "" {
+		if _, err = co.do(c.timeout, "AUTH", c.password); err != nil {
+			_ = co.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err = co.do(c.timeout, "SELECT", c.db); err != nil {
+			_ = co.Close()
+			return nil, err
+		}
+	}
+	return co, nil
+}
+
+func (c *Client) put(co *conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.idle) >= maxIdleConns {
+		_ = co.Close()
+		return
+	}
+	c.idle = append(c.idle, co)
+}
+
+// do sends a command and reads its reply within timeout.
+func (co *conn) do(timeout time.Duration, args ...interface{}) (interface{}, error) {
+	_ = co.SetDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		var b []byte
+		switch v := arg.(type) {
+		case string:
+			b = []byte(v)
+		case []byte:
+			b = v
+		case int:
+			b = strconv.AppendInt(nil, int64(v), 10)
+		case int64:
+			b = strconv.AppendInt(nil, v, 10)
+		default:
+			return nil, fmt.Errorf("redis: unsupported argument type %T", arg)
+		}
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(b)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, b...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := co.Write(buf); err != nil {
+		return nil, err
+	}
+	return readReply(co.r)
+}
+
+// readReply reads a reply in RESP2.
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errProtocol
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, Error(body)
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, errProtocol
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > maxBulkLen {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err = io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n > maxArrayLen {
+			return nil, errProtocol
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]interface{}, n)
+		for i := range arr {
+			if arr[i], err = readReply(r); err != nil {
+				if _, ok := err.(Error); !ok {
+					return nil, err
+				}
+				arr[i] = err
+			}
+		}
+		return arr, nil
+	}
+	return nil, errProtocol
+}
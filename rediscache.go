@@ -0,0 +1,252 @@
+package gochinadns
+
+import (
+	"encoding/binary"
+	"expvar"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+
+	"github.com/cherrot/gochinadns/redis"
+)
+
+// DefaultRedisPrefix is the prefix of keys of RedisCache by default.
+const DefaultRedisPrefix = "chinadns:"
+
+const (
+	// redisEntryHeader is the length of the header of a cache entry in Redis, which is the time it's stored and the
+	// time it expires in Unix nanoseconds, followed by the reply in wire format.
+	redisEntryHeader = 16
+	// redisTimeout bounds each command to Redis, well under timeouts of queries, which wait for the cache.
+	redisTimeout = 200 * time.Millisecond
+	// redisBackoffMin is how long Redis is skipped after it fails, doubled on each failure in a row up to
+	// redisBackoffMax.
+	redisBackoffMin = time.Second
+	redisBackoffMax = time.Minute
+)
+
+// redisSkipped counts commands skipped as Redis failed recently, see redisBreaker.
+var redisSkipped = expvar.NewInt("chinadns_redis_skipped")
+
+// WithRedis shares the response cache and cached verdicts (see WithVerdictCache) with other servers, e.g. a pair
+// behind a load balancer, in the Redis server at a URL like `redis://[:password@]host[:port][/db]`, with keys
+// prefixed by prefix (DefaultRedisPrefix if empty). It replaces the in-memory cache, see RedisCache.
+func WithRedis(rawurl, prefix string) ServerOption {
+	return func(o *serverOptions) error {
+		c, err := NewRedisCache(rawurl, prefix)
+		if err != nil {
+			return err
+		}
+		u, _ := url.Parse(rawurl)
+		o.Cache, o.VerdictStore, o.Redis = c, c, u.Redacted()
+		return nil
+	}
+}
+
+// RedisCache is a Cache in Redis shared by servers, which also shares their cached verdicts as a VerdictStore.
+// Entries are expired by Redis once they can't be served any more. Errors of Redis are logged and taken as misses,
+// so that queries are still resolved by upstreams, and Redis is skipped for a backoff from 1s to a minute after it
+// fails, so that queries don't wait for an unreachable Redis in turn. Commands time out after 200ms.
+type RedisCache struct {
+	client  *redis.Client
+	prefix  string
+	now     func() time.Time
+	breaker redisBreaker
+}
+
+// redisBreaker skips Redis for a backoff after it fails.
+type redisBreaker struct {
+	mu      sync.Mutex
+	until   time.Time     // when Redis is tried again
+	backoff time.Duration // of the last failure, 0 if Redis succeeded since
+}
+
+// allow tells whether Redis may be tried at now.
+func (b *redisBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !now.Before(b.until)
+}
+
+// done records the result err of a command at now, and returns the backoff if Redis is skipped from now on by
+// this failure, or 0 otherwise, e.g. if it's skipped already by a concurrent failure.
+func (b *redisBreaker) done(err error, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		b.backoff = 0
+		return 0
+	}
+	if now.Before(b.until) {
+		return 0
+	}
+	if b.backoff *= 2; b.backoff < redisBackoffMin {
+		b.backoff = redisBackoffMin
+	} else if b.backoff > redisBackoffMax {
+		b.backoff = redisBackoffMax
+	}
+	b.until = now.Add(b.backoff)
+	return b.backoff
+}
+
+// do runs command unless Redis is skipped, and tells whether it succeeds. A failure skipping Redis is logged with
+// msg.
+func (c *RedisCache) do(msg string, command func() error) bool {
+	if !c.breaker.allow(c.now()) {
+		redisSkipped.Add(1)
+		return false
+	}
+	err := command()
+	if backoff := c.breaker.done(err, c.now()); backoff > 0 {
+		logrus.WithError(err).Warnf("%s Skip Redis for %s.", msg, backoff)
+	}
+	return err == nil
+}
+
+// NewRedisCache returns a cache in the Redis server at a URL like `redis://[:password@]host[:port][/db]`, with keys
+// prefixed by prefix (DefaultRedisPrefix if empty).
+func NewRedisCache(rawurl, prefix string) (*RedisCache, error) {
+	client, err := redis.ParseURL(rawurl, redisTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == "" {
+		prefix = DefaultRedisPrefix
+	}
+	return &RedisCache{client: client, prefix: prefix, now: time.Now}, nil
+}
+
+func (c *RedisCache) entryKey(q *dns.Question) string {
+	return c.prefix + "cache:" + strings.ToLower(q.Name) + "/" + strconv.Itoa(int(q.Qtype)) + "/" + strconv.Itoa(int(q.Qclass))
+}
+
+func (c *RedisCache) verdictKey(name string) string {
+	return c.prefix + "verdict:" + strings.ToLower(name)
+}
+
+// Get implements Cache.
+func (c *RedisCache) Get(q *dns.Question) (*dns.Msg, time.Duration) {
+	var b []byte
+	ok := c.do("Fail to get the cache entry from Redis.", func() (err error) {
+		b, err = c.client.Get(c.entryKey(q))
+		return
+	})
+	if !ok || len(b) < redisEntryHeader {
+		return nil, 0
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(b[redisEntryHeader:]); err != nil {
+		return nil, 0
+	}
+	stored := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	expire := time.Unix(0, int64(binary.BigEndian.Uint64(b[8:])))
+	now := c.now()
+	decreaseTTL(m, now.Sub(stored))
+	return m, expire.Sub(now)
+}
+
+// Set implements Cache.
+func (c *RedisCache) Set(q *dns.Question, m *dns.Msg, ttl, stale time.Duration) {
+	packed, err := m.Pack()
+	if err != nil {
+		return
+	}
+	now := c.now()
+	b := make([]byte, redisEntryHeader, redisEntryHeader+len(packed))
+	binary.BigEndian.PutUint64(b, uint64(now.UnixNano()))
+	binary.BigEndian.PutUint64(b[8:], uint64(now.Add(ttl).UnixNano()))
+	b = append(b, packed...)
+	c.do("Fail to set the cache entry in Redis.", func() error { return c.client.Set(c.entryKey(q), b, ttl+stale) })
+}
+
+// Delete implements Cache.
+func (c *RedisCache) Delete(q *dns.Question) {
+	c.do("Fail to delete the cache entry from Redis.", func() error {
+		_, err := c.client.Del(c.entryKey(q))
+		return err
+	})
+}
+
+// Len implements Cache. It scans all keys of entries, so it's slow for a large cache.
+func (c *RedisCache) Len() int {
+	n := 0
+	c.do("Fail to count cache entries in Redis.", func() error {
+		return c.client.Scan(c.prefix+"cache:*", func(keys []string) error {
+			n += len(keys)
+			return nil
+		})
+	})
+	return n
+}
+
+// Flush removes all entries.
+func (c *RedisCache) Flush() {
+	c.do("Fail to flush the cache in Redis.", func() error {
+		_, err := c.deleteMatching(c.prefix + "cache:*")
+		return err
+	})
+}
+
+// Route implements VerdictStore.
+func (c *RedisCache) Route(name string) (string, time.Time) {
+	var b []byte
+	ok := c.do("Fail to get the verdict from Redis.", func() (err error) {
+		b, err = c.client.Get(c.verdictKey(name))
+		return
+	})
+	if !ok {
+		return "", time.Time{}
+	}
+	// Values are like `trusted 1600000000000000000`, with the expiry in Unix nanoseconds.
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		return "", time.Time{}
+	}
+	expires, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", time.Time{}
+	}
+	return fields[0], time.Unix(0, expires)
+}
+
+// SetRoute implements VerdictStore.
+func (c *RedisCache) SetRoute(name, route string, expires time.Time) {
+	c.do("Fail to set the verdict in Redis.", func() (err error) {
+		if ttl := expires.Sub(c.now()); route == "" || ttl <= 0 {
+			_, err = c.client.Del(c.verdictKey(name))
+		} else {
+			err = c.client.Set(c.verdictKey(name), []byte(route+" "+strconv.FormatInt(expires.UnixNano(), 10)), ttl)
+		}
+		return
+	})
+}
+
+// ClearRoutes implements VerdictStore.
+func (c *RedisCache) ClearRoutes(names ...string) int {
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = c.verdictKey(name)
+	}
+	var n int64
+	c.do("Fail to clear verdicts in Redis.", func() (err error) {
+		n, err = c.client.Del(keys...)
+		return
+	})
+	return int(n)
+}
+
+// deleteMatching removes keys matching pattern, and returns the number of keys removed.
+func (c *RedisCache) deleteMatching(pattern string) (int, error) {
+	n := 0
+	err := c.client.Scan(pattern, func(keys []string) error {
+		deleted, err := c.client.Del(keys...)
+		n += int(deleted)
+		return err
+	})
+	return n, err
+}
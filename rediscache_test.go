@@ -0,0 +1,208 @@
+package gochinadns
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cherrot/gochinadns/clock"
+)
+
+// fakeRedis serves GET, SET (with PX), DEL, SCAN (in a single batch) and AUTH of Redis.
+type fakeRedis struct {
+	password string
+
+	mu     sync.Mutex
+	values map[string]string
+	expiry map[string]time.Time
+}
+
+func newFakeRedis(t *testing.T, password string) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	r := &fakeRedis{password: password, values: make(map[string]string), expiry: make(map[string]time.Time)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	br := bufio.NewReader(conn)
+	authed := r.password == ""
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, n)
+		for i := range args {
+			line, _ = br.ReadString('\n')
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			b := make([]byte, size+2)
+			if _, err = io.ReadFull(br, b); err != nil {
+				return
+			}
+			args[i] = string(b[:size])
+		}
+		cmd := strings.ToUpper(args[0])
+		if cmd == "AUTH" {
+			authed = args[1] == r.password
+		}
+		if !authed {
+			_, _ = io.WriteString(conn, "-NOAUTH Authentication required.\r\n")
+			continue
+		}
+		_, _ = io.WriteString(conn, r.do(cmd, args[1:]))
+	}
+}
+
+func (r *fakeRedis) do(cmd string, args []string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, t := range r.expiry {
+		if !time.Now().Before(t) {
+			delete(r.values, key)
+			delete(r.expiry, key)
+		}
+	}
+	bulk := func(s string) string { return "$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n" }
+	switch cmd {
+	case "AUTH", "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		v, ok := r.values[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return bulk(v)
+	case "SET":
+		r.values[args[0]] = args[1]
+		delete(r.expiry, args[0])
+		if len(args) == 4 && strings.ToUpper(args[2]) == "PX" {
+			ms, _ := strconv.Atoi(args[3])
+			r.expiry[args[0]] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, key := range args {
+			if _, ok := r.values[key]; ok {
+				delete(r.values, key)
+				n++
+			}
+		}
+		return ":" + strconv.Itoa(n) + "\r\n"
+	case "SCAN":
+		prefix := strings.TrimSuffix(args[2], "*")
+		var keys []string
+		for key := range r.values {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, bulk(key))
+			}
+		}
+		return "*2\r\n" + bulk("0") + "*" + strconv.Itoa(len(keys)) + "\r\n" + strings.Join(keys, "")
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisCache(t *testing.T) {
+	addr := newFakeRedis(t, "secret")
+	if _, err := NewRedisCache("http://"+addr, ""); err == nil {
+		t.Error("Non-redis URL should fail")
+	}
+	now := time.Now()
+	nodes := make([]*RedisCache, 2)
+	for i := range nodes {
+		c, err := NewRedisCache("redis://:secret@"+addr+"/1", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.now = func() time.Time { return now }
+		nodes[i] = c
+	}
+
+	m := newTestReply("www.qq.com", 60, "1.0.1.1")
+	nodes[0].Set(&m.Question[0], m, 60*time.Second, time.Minute)
+	now = now.Add(20 * time.Second)
+	got, ttl := nodes[1].Get(&m.Question[0])
+	if got == nil || got.Answer[0].Header().Ttl != 40 || ttl != 40*time.Second {
+		t.Fatalf("Entry should be shared with TTL decreased, got %v (%s remaining)", got, ttl)
+	}
+	if n := nodes[1].Len(); n != 1 {
+		t.Errorf("Expect 1 entry, got %d", n)
+	}
+	nodes[1].Flush()
+	if got, _ := nodes[0].Get(&m.Question[0]); got != nil {
+		t.Errorf("Flushed entry should be gone, got %v", got)
+	}
+
+	clk := clock.NewFake(now)
+	verdicts := []*verdictCache{newVerdictCache(time.Minute, clk, nodes[0]), newVerdictCache(time.Minute, clk, nodes[1])}
+	if route := verdicts[1].Route("www.google.com."); route != "" {
+		t.Fatalf("Unexpected verdict %q", route)
+	}
+	verdicts[0].Set("www.google.com.", RouteTrusted)
+	if route := verdicts[1].Route("WWW.google.com."); route != "" {
+		t.Errorf("Missing verdict should be remembered for a while, got %q", route)
+	}
+	clk.Advance(verdictMissTTL)
+	if route := verdicts[1].Route("WWW.google.com."); route != RouteTrusted {
+		t.Errorf("Verdict should be shared, got %q", route)
+	}
+
+	// Only verdicts set by a server are cleared from Redis by it.
+	verdicts[1].Set("www.qq.com.", RouteUntrusted)
+	if n := verdicts[0].Clear(); n != 1 {
+		t.Errorf("Expect 1 verdict cleared, got %d", n)
+	}
+	if route, _ := nodes[1].Route("www.google.com."); route != "" {
+		t.Errorf("Shared verdict should be cleared, got %q", route)
+	}
+	if route, _ := nodes[0].Route("www.qq.com."); route != RouteUntrusted {
+		t.Errorf("Verdict of another server should be kept, got %q", route)
+	}
+	if n := verdicts[1].Clear(); n != 2 {
+		t.Errorf("Expect 2 verdicts cleared, got %d", n)
+	}
+	if route, _ := nodes[0].Route("www.qq.com."); route != "" {
+		t.Errorf("Verdict should be cleared by the server setting it, got %q", route)
+	}
+
+	c, err := NewRedisCache("redis://:wrong@"+addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.now = func() time.Time { return now }
+	if got, _ := c.Get(&m.Question[0]); got != nil {
+		t.Error("Unauthenticated client should miss")
+	}
+	// Redis is skipped for a backoff after it fails.
+	skipped := redisSkipped.Value()
+	c.Get(&m.Question[0])
+	c.Set(&m.Question[0], m, time.Minute, 0)
+	if n := redisSkipped.Value() - skipped; n != 2 {
+		t.Errorf("Expect 2 commands skipped, got %d", n)
+	}
+	now = now.Add(redisBackoffMin)
+	c.Get(&m.Question[0])
+	if n := redisSkipped.Value() - skipped; n != 2 || c.breaker.backoff != 2*redisBackoffMin {
+		t.Errorf("Redis should be tried again after the backoff, doubled on failure, got %d skips, %s", n, c.breaker.backoff)
+	}
+}
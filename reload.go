@@ -0,0 +1,71 @@
+package gochinadns
+
+import (
+	"github.com/sirupsen/logrus"
+)
+
+// Reload reloads route lists, blacklists and other domain lists from their files,
+// by applying options of the server again. In-flight queries and listeners are not affected.
+// The reloaded lists are checked on a shadow instance before they are switched to (see ApplyConfig),
+// and the lists are kept unchanged if any of them fails to load or to pass the checks.
+// Note that resolvers are not partitioned again with the reloaded China route lists.
+func (s *Server) Reload() error {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+	o := newServerOptions()
+	for _, f := range s.opts {
+		if err := f(o); err != nil {
+			return err
+		}
+	}
+	if err := o.checkListErrors(); err != nil {
+		return err
+	}
+	o.TrustedServers, o.UntrustedServers = s.resolvers()
+	if err := s.warmCheck(s.newShadow(o)); err != nil {
+		return err
+	}
+	s.cutover(o, false)
+	logrus.Info("Lists reloaded.")
+	return nil
+}
+
+// cutover switches the server to lists of o, and to resolvers of o if resolvers is true,
+// at once under the locks, so that a query sees either the old configuration or the new one.
+func (s *Server) cutover(o *serverOptions, resolvers bool) {
+	s.listsMu.Lock()
+	if resolvers {
+		s.resolversMu.Lock()
+		s.TrustedServers = o.TrustedServers
+		s.UntrustedServers = o.UntrustedServers
+	}
+	s.ChinaCIDR = o.ChinaCIDR
+	s.ChinaCIDR6 = o.ChinaCIDR6
+	s.ChinaCIDRExclude = o.ChinaCIDRExclude
+	s.ChinaBackend = o.ChinaBackend
+	s.IPBlacklist = o.IPBlacklist
+	s.DomainBlacklist = o.DomainBlacklist
+	s.DomainWhitelist = o.DomainWhitelist
+	s.DomainPolluted = o.DomainPolluted
+	s.PollutedSites = o.PollutedSites
+	s.MutationDomains = o.MutationDomains
+	s.ForwardRules = o.ForwardRules
+	s.Hosts = o.Hosts
+	s.RewriteRules = o.RewriteRules
+	s.Tenants = o.Tenants
+	s.BlockSchedule = o.BlockSchedule
+	s.ECHStrip = o.ECHStrip
+	s.ECHPreserve = o.ECHPreserve
+	s.CacheStrategies = o.CacheStrategies
+	s.budgets.Set(o.Budgets)
+	s.ListErrors = o.ListErrors
+	listErrorsGauge.Set(int64(o.ListErrors.Len()))
+	s.matchers.Store(s.compileMatchers())
+	s.certificate.set(o.TLSCertificate)
+	// Verdicts depend on the lists.
+	s.verdicts.Clear()
+	if resolvers {
+		s.resolversMu.Unlock()
+	}
+	s.listsMu.Unlock()
+}
@@ -0,0 +1,127 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestReload(t *testing.T) {
+	china := writeTestList(t, "china.list", "1.0.1.0/24\n")
+	polluted := writeTestList(t, "polluted.list", "google.com\n")
+	opts := []ServerOption{WithCHNList(china), WithDomainPolluted(polluted)}
+	o := newServerOptions()
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{serverOptions: o, opts: opts, Client: NewClient()}
+
+	if err := os.WriteFile(china, []byte("8.8.8.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(polluted, []byte("twitter.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := s.isChinaIP(context.Background(), net.ParseIP("8.8.8.8")); !ok {
+		t.Error("China route list should be reloaded")
+	}
+	if s.isDomainPolluted("google.com.") || !s.isDomainPolluted("twitter.com.") {
+		t.Error("Polluted domain list should be reloaded")
+	}
+
+	if err := os.Remove(china); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("Reload should fail if a list is missing")
+	}
+	if ok, _ := s.isChinaIP(context.Background(), net.ParseIP("8.8.8.8")); !ok {
+		t.Error("Lists should be kept if reload fails")
+	}
+}
+
+func TestReloadWarmCheck(t *testing.T) {
+	blacklist := writeTestList(t, "blacklist.list", "ads.example.org\n")
+	opts := []ServerOption{WithDomainBlacklist(blacklist), WithTestDomains("example.com"), WithDelay(time.Second)}
+	o := newServerOptions()
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o.TrustedServers = resolverList{startAnswerUpstream(t, "142.250.1.1")}
+	s := &Server{serverOptions: o, opts: opts, Client: NewClient(WithTimeout(time.Second)), provenance: newProvenanceLog(16)}
+	for _, name := range []string{"a.example.net.", "b.example.net.", "c.example.org."} {
+		s.provenance.Record(&dns.Question{Name: name, Qtype: dns.TypeA}, Provenance{Verdict: VerdictTrusted})
+	}
+
+	// A blacklist blocking most of the recent traffic is rejected.
+	if err := os.WriteFile(blacklist, []byte("example.net\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("Reload should fail if mirrored questions regress")
+	}
+	if s.isDomainBlocked("a.example.net.", nil) {
+		t.Error("Lists should be kept if the warm check fails")
+	}
+
+	// So is one blocking a test domain.
+	if err := os.WriteFile(blacklist, []byte("example.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("Reload should fail if the health check fails")
+	}
+
+	if err := os.WriteFile(blacklist, []byte("ads.example.org\ntracker.example.org\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.isDomainBlocked("tracker.example.org.", nil) {
+		t.Error("Blacklist should be reloaded")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	live := startAnswerUpstream(t, "142.250.1.1")
+	o := newServerOptions()
+	o.TestDomains = []string{"example.com"}
+	o.Delay = time.Second
+	o.TrustedServers = resolverList{live}
+	s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second))}
+
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.LocalAddr().String()
+	_ = dead.Close()
+	if err := s.ApplyConfig(WithTestDomains("example.com"), WithDelay(time.Second), WithTrustedResolvers(false, deadAddr)); err == nil {
+		t.Error("Config with dead resolvers should be rejected")
+	}
+	if trusted, _ := s.resolvers(); len(trusted) != 1 || trusted[0] != live {
+		t.Errorf("Resolvers should be kept if the config is rejected, got %v", trusted)
+	}
+
+	other := startAnswerUpstream(t, "142.250.1.2")
+	err = s.ApplyConfig(WithTestDomains("example.com"), WithDelay(time.Second), WithTrustedResolvers(false, live.String(), other.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, _ := s.resolvers()
+	if len(trusted) != 2 || trusted[0] != live || trusted[1].String() != other.String() {
+		t.Errorf("Unexpected resolvers after the config is applied: %v", trusted)
+	}
+}
@@ -0,0 +1,81 @@
+package gochinadns
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+var errReplyTooLarge = errors.New("reply too large")
+
+// WithMaxReplySize limits replies of upstreams to size bytes (packed with compression). Authority and additional
+// records (besides OPT) of a larger reply are stripped, and it's rejected as a failed lookup if it's still larger,
+// protecting clients and the cache from hostile or buggy upstreams. Disabled if 0.
+func WithMaxReplySize(size int) ClientOption {
+	return func(o *clientOptions) {
+		o.MaxReplySize = size
+	}
+}
+
+// WithMaxAdditional keeps at most n records (besides OPT) in the additional section of replies of upstreams, so that
+// answers can't be inflated by glue records, which amplify replies to (maybe spoofed) clients. Disabled if 0.
+func WithMaxAdditional(n int) ClientOption {
+	return func(o *clientOptions) {
+		o.MaxAdditional = n
+	}
+}
+
+// limitReply enforces MaxAdditional and MaxReplySize on reply, returning a stripped copy of it if any record is
+// removed, or errReplyTooLarge if it's too large even without authority and additional records.
+func (c *Client) limitReply(reply *dns.Msg) (*dns.Msg, error) {
+	if reply == nil {
+		return nil, nil
+	}
+	if c.MaxAdditional > 0 && additionalRecords(reply) > c.MaxAdditional {
+		reply = reply.Copy()
+		reply.Extra = limitAdditional(reply.Extra, c.MaxAdditional)
+	}
+	if c.MaxReplySize <= 0 || packedLen(reply) <= c.MaxReplySize {
+		return reply, nil
+	}
+	stripped := reply.Copy()
+	stripped.Ns, stripped.Extra = nil, limitAdditional(stripped.Extra, 0)
+	if size := packedLen(stripped); size > c.MaxReplySize {
+		return nil, fmt.Errorf("%w: %d bytes without authority and additional records, over %d bytes",
+			errReplyTooLarge, size, c.MaxReplySize)
+	}
+	return stripped, nil
+}
+
+// additionalRecords returns the number of records in the additional section of m, besides OPT.
+func additionalRecords(m *dns.Msg) int {
+	n := 0
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			n++
+		}
+	}
+	return n
+}
+
+// limitAdditional returns the first n records of extra, and OPT records after them.
+func limitAdditional(extra []dns.RR, n int) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range extra {
+		if rr.Header().Rrtype == dns.TypeOPT || n > 0 {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				n--
+			}
+			kept = append(kept, rr)
+		}
+	}
+	return kept
+}
+
+// packedLen returns the length of m packed with compression, as it's sent to clients.
+func packedLen(m *dns.Msg) int {
+	compressed := *m
+	compressed.Compress = true
+	return compressed.Len()
+}
@@ -0,0 +1,53 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestLimitReply(t *testing.T) {
+	reply := newTestReply("www.example.com.", 60, "1.2.3.4")
+	for i := 0; i < 20; i++ {
+		reply.Ns = append(reply.Ns, &dns.NS{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET},
+			Ns: fmt.Sprintf("ns%d.example.net.", i)})
+		reply.Extra = append(reply.Extra, &dns.A{Hdr: dns.RR_Header{Name: fmt.Sprintf("ns%d.example.net.", i),
+			Rrtype: dns.TypeA, Class: dns.ClassINET}, A: net.IPv4(10, 0, 0, byte(i))})
+	}
+	reply.SetEdns0(1232, false)
+	upstream := NewUpstreamResolver("test", UpstreamFunc(func(context.Context, *dns.Msg) (*dns.Msg, time.Duration, error) {
+		return reply, 0, nil
+	}))
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+
+	c := NewClient(WithMaxAdditional(2))
+	got, _, err := c.LookupContext(context.Background(), req, upstream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Extra) != 3 || got.IsEdns0() == nil || len(got.Ns) != 20 {
+		t.Errorf("Additional records should be capped, with OPT kept, got %v", got.Extra)
+	}
+	if len(reply.Extra) != 21 {
+		t.Error("Replies of upstreams should not be modified")
+	}
+
+	c = NewClient(WithMaxReplySize(256))
+	if got, _, err = c.LookupContext(context.Background(), req, upstream); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Ns) != 0 || len(got.Extra) != 1 || len(got.Answer) != 1 {
+		t.Errorf("Authority and additional records of large replies should be stripped, got %v", got)
+	}
+
+	c = NewClient(WithMaxReplySize(32))
+	if _, _, err = c.LookupContext(context.Background(), req, upstream); !errors.Is(err, errReplyTooLarge) {
+		t.Errorf("Replies too large should be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+package gochinadns
+
+import "golang.org/x/sys/unix"
+
+// soReusePortLB is SO_REUSEPORT_LB of FreeBSD>=12, which balances connections and datagrams among sockets sharing a
+// port like SO_REUSEPORT of Linux does. SO_REUSEPORT of FreeBSD only lets them share the port.
+const soReusePortLB = 0x10000
+
+// reusePortOptions are socket options to share listening ports by, in the order of preference.
+var reusePortOptions = []int{soReusePortLB, unix.SO_REUSEPORT}
@@ -0,0 +1,9 @@
+//go:build darwin || dragonfly || linux || netbsd || openbsd
+// +build darwin dragonfly linux netbsd openbsd
+
+package gochinadns
+
+import "golang.org/x/sys/unix"
+
+// reusePortOptions are socket options to share listening ports by, in the order of preference.
+var reusePortOptions = []int{unix.SO_REUSEPORT}
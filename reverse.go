@@ -0,0 +1,66 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// ReverseLookup looks up names of ip by PTR queries, for dashboards and integrations to display.
+// Hosts files and forward rules are checked first. Otherwise IPs in China are looked up in untrusted servers,
+// and other IPs in trusted servers. Replies are cached like answers to clients.
+func (s *Server) ReverseLookup(ip net.IP) ([]string, error) {
+	name, err := dns.ReverseAddr(ip.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP %s: %w", ip, err)
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypePTR)
+	q := &req.Question[0]
+
+	if m := s.answerHosts(req); m != nil {
+		return ptrNames(m), nil
+	}
+	if m, _ := s.cacheGet(q); m != nil {
+		return ptrNames(m), nil
+	}
+
+	trusted, untrusted := s.activeResolvers()
+	servers, lookup, verdict := trusted, s.lookupTrusted, VerdictTrusted
+	if forward := s.forwardServers(name); forward != nil {
+		servers, lookup, verdict = forward, s.lookupNormal, VerdictForwarded
+	} else if china, err := s.isChinaIP(context.Background(), ip); err != nil {
+		return nil, err
+	} else if china {
+		servers, lookup, verdict = untrusted, s.lookupUntrusted, VerdictChina
+	}
+
+	s.normalizeRequest(req)
+	err = errors.New("no server to look up")
+	for _, server := range servers {
+		var reply *dns.Msg
+		var rtt time.Duration
+		if reply, rtt, err = lookup(context.Background(), req.Copy(), server); err != nil {
+			logrus.WithField("server", server).WithError(err).Debug("Fail to look up PTR of ", ip)
+			continue
+		}
+		s.cacheSet(q, reply, Provenance{Upstream: server.String(), Verdict: verdict, RTT: rtt})
+		return ptrNames(reply), nil
+	}
+	return nil, err
+}
+
+func ptrNames(m *dns.Msg) []string {
+	var names []string
+	for _, rr := range m.Answer {
+		if ptr, ok := rr.(*dns.PTR); ok {
+			names = append(names, ptr.Ptr)
+		}
+	}
+	return names
+}
@@ -0,0 +1,68 @@
+package gochinadns
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startPTRUpstream starts an upstream answering PTR queries with target, and counts queries.
+func startPTRUpstream(t *testing.T, target string, queries *int32) *Resolver {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(queries, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.PTR{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: 60},
+			Ptr: target,
+		})
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+
+	r, err := ParseResolver(pc.LocalAddr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestReverseLookup(t *testing.T) {
+	var trustedQueries, untrustedQueries int32
+	o := newServerOptions()
+	o.TrustedServers = resolverList{startPTRUpstream(t, "foreign.example.", &trustedQueries)}
+	o.UntrustedServers = resolverList{startPTRUpstream(t, "china.example.", &untrustedQueries)}
+	if err := WithCHNList(writeTestList(t, "china.list", "1.2.3.0/24\n"))(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second)), cache: NewMemoryCache(10, 0)}
+
+	for _, tt := range []struct {
+		ip   string
+		want string
+	}{
+		{"1.2.3.4", "china.example."},
+		{"8.8.8.8", "foreign.example."},
+		{"8.8.8.8", "foreign.example."}, // cached
+	} {
+		names, err := s.ReverseLookup(net.ParseIP(tt.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(names) != 1 || names[0] != tt.want {
+			t.Errorf("ReverseLookup(%s) = %v, want %s", tt.ip, names, tt.want)
+		}
+	}
+	if tq, uq := atomic.LoadInt32(&trustedQueries), atomic.LoadInt32(&untrustedQueries); tq != 1 || uq != 1 {
+		t.Errorf("Unexpected queries: %d trusted, %d untrusted", tq, uq)
+	}
+}
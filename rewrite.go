@@ -0,0 +1,304 @@
+package gochinadns
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// rewriteTTL is the TTL of records made by rewrite rules.
+const rewriteTTL = 60
+
+// rewriteRule is how answers of a name are rewritten.
+type rewriteRule struct {
+	ips       []net.IP        // addresses to answer A and AAAA questions with
+	cname     string          // target to answer questions with, by a CNAME record
+	stripType map[uint16]bool // types of records to strip from answers
+	stripIP   []net.IP        // addresses of A and AAAA records to strip from answers
+}
+
+// rewriteTable contains rewrite rules of names, in the same matching rules of hosts files.
+type rewriteTable struct {
+	names     map[string]*rewriteRule
+	wildcards map[string]*rewriteRule // subdomains of names, declared as *.name
+}
+
+func newRewriteTable() *rewriteTable {
+	return &rewriteTable{
+		names:     make(map[string]*rewriteRule),
+		wildcards: make(map[string]*rewriteRule),
+	}
+}
+
+// Lookup returns the rule of name, or nil if none matches.
+// Exact names take precedence over wildcards, and longer wildcards take precedence over shorter ones.
+func (t *rewriteTable) Lookup(name string) *rewriteRule {
+	if t == nil {
+		return nil
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+	if rule := t.names[name]; rule != nil {
+		return rule
+	}
+	for {
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return nil
+		}
+		name = name[i+1:]
+		if rule := t.wildcards[name]; rule != nil {
+			return rule
+		}
+	}
+}
+
+// Add parses a rule of a name, which is one of:
+//
+//	name address ip [ip...]
+//	name cname target
+//	name strip type|ip [type|ip...]
+//
+// Rules of the same name are merged. A name can't be both answered by addresses and by a CNAME record.
+func (t *rewriteTable) Add(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return fmt.Errorf("name, action and arguments are required")
+	}
+	name := strings.ToLower(dns.Fqdn(fields[0]))
+	table := t.names
+	if strings.HasPrefix(name, "*.") {
+		name = name[2:]
+		table = t.wildcards
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return fmt.Errorf("invalid name %s", fields[0])
+	}
+	rule := table[name]
+	if rule == nil {
+		rule = &rewriteRule{stripType: make(map[uint16]bool)}
+	}
+
+	// Arguments are all checked before the rule is changed, so that a bad line changes nothing.
+	args := fields[2:]
+	switch action := strings.ToLower(fields[1]); action {
+	case "address":
+		if rule.cname != "" {
+			return fmt.Errorf("%s is already answered by cname", fields[0])
+		}
+		ips := make([]net.IP, 0, len(args))
+		for _, arg := range args {
+			ip := net.ParseIP(arg)
+			if ip == nil {
+				return fmt.Errorf("invalid address %s", arg)
+			}
+			ips = append(ips, ip)
+		}
+		rule.ips = append(rule.ips, ips...)
+	case "cname":
+		if len(args) != 1 {
+			return fmt.Errorf("cname requires exactly one target")
+		}
+		if len(rule.ips) > 0 {
+			return fmt.Errorf("%s is already answered by addresses", fields[0])
+		}
+		target := strings.ToLower(dns.Fqdn(args[0]))
+		if _, ok := dns.IsDomainName(target); !ok {
+			return fmt.Errorf("invalid target %s", args[0])
+		}
+		rule.cname = target
+	case "strip":
+		var (
+			ips   []net.IP
+			types []uint16
+		)
+		for _, arg := range args {
+			if ip := net.ParseIP(arg); ip != nil {
+				ips = append(ips, ip)
+			} else if qtype, ok := dns.StringToType[strings.ToUpper(arg)]; ok {
+				types = append(types, qtype)
+			} else {
+				return fmt.Errorf("invalid type or address %s", arg)
+			}
+		}
+		rule.stripIP = append(rule.stripIP, ips...)
+		for _, qtype := range types {
+			rule.stripType[qtype] = true
+		}
+	default:
+		return fmt.Errorf("unknown action %s", action)
+	}
+	table[name] = rule
+	return nil
+}
+
+// answer answers A and AAAA questions of req by addresses of rule, or returns nil if rule has no addresses.
+// A name with no address of the questioned family is answered with no records (NODATA).
+func (rule *rewriteRule) answer(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if rule == nil || len(rule.ips) == 0 || q.Qclass != dns.ClassINET || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+		return nil
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	m.RecursionAvailable = true
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: rewriteTTL}
+	for _, ip := range rule.ips {
+		if ip4 := ip.To4(); ip4 != nil && q.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+		} else if ip4 == nil && q.Qtype == dns.TypeAAAA {
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return m
+}
+
+// strip removes records of m matching rule, including signatures of stripped types, and returns the number of
+// records removed. The AD bit is cleared if any record is removed, since the answer is no longer authenticated.
+func (rule *rewriteRule) strip(m *dns.Msg) int {
+	if rule == nil || (len(rule.stripType) == 0 && len(rule.stripIP) == 0) {
+		return 0
+	}
+	removed := 0
+	answer := m.Answer[:0]
+	for _, rr := range m.Answer {
+		if rule.strips(rr) {
+			removed++
+			continue
+		}
+		answer = append(answer, rr)
+	}
+	m.Answer = answer
+	if removed > 0 {
+		m.AuthenticatedData = false
+	}
+	return removed
+}
+
+func (rule *rewriteRule) strips(rr dns.RR) bool {
+	if rule.stripType[rr.Header().Rrtype] {
+		return true
+	}
+	var ip net.IP
+	switch rr := rr.(type) {
+	case *dns.A:
+		ip = rr.A
+	case *dns.AAAA:
+		ip = rr.AAAA
+	case *dns.RRSIG:
+		return rule.stripType[rr.TypeCovered]
+	}
+	for _, stripped := range rule.stripIP {
+		if ip != nil && stripped.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// WithRewriteRules loads rules to rewrite answers of names, one per line:
+//
+//	intranet.example.com address 10.0.0.5 fd00::5
+//	*.svc.example.com    address 10.0.0.6
+//	www.example.com      cname   www.example.internal
+//	example.org          strip   AAAA HTTPS 203.0.113.1
+//
+// address answers A and AAAA questions locally, cname answers questions with a CNAME record to the target followed
+// by records of the target, and strip removes records of the types or the addresses from answers.
+// A name of *.domain matches all subdomains of domain, like hosts files.
+func WithRewriteRules(path string) ServerOption {
+	return func(o *serverOptions) error {
+		if path == "" {
+			return fmt.Errorf("%w for rewrite rules", ErrEmptyPath)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return o.ListErrors.add(fmt.Errorf("fail to open rewrite rules: %w", err))
+		}
+		defer file.Close()
+
+		if o.RewriteRules == nil {
+			o.RewriteRules = newRewriteTable()
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			if line = strings.TrimSpace(line); line == "" {
+				continue
+			}
+			if err := o.RewriteRules.Add(line); err != nil {
+				if err := o.ListErrors.add(fmt.Errorf("parse rewrite rule [%s] failed: %w", line, err)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return o.ListErrors.add(fmt.Errorf("fail to scan rewrite rules: %v", err.Error()))
+		}
+		return nil
+	}
+}
+
+// rewriteRule returns the rewrite rule of name, or nil if none matches.
+func (s *Server) rewriteRule(name string) *rewriteRule {
+	s.listsMu.RLock()
+	defer s.listsMu.RUnlock()
+	return s.RewriteRules.Lookup(name)
+}
+
+// answerRewrite answers req by addresses of rewrite rules, or returns nil if not rewritten.
+func (s *Server) answerRewrite(req *dns.Msg) *dns.Msg {
+	return s.rewriteRule(req.Question[0].Name).answer(req)
+}
+
+// stripRewrite removes records of m, the answer of name, by rewrite rules.
+func (s *Server) stripRewrite(logger *logrus.Entry, name string, m *dns.Msg) {
+	if n := s.rewriteRule(name).strip(m); n > 0 {
+		logger.Debugf("Stripped %d records by rewrite rules.", n)
+	}
+}
+
+type rewrittenKey struct{}
+
+// resolveRewrite answers req with a CNAME record to target, followed by records of target answered locally or
+// resolved through upstreams. CNAME rules of target are not followed, to avoid loops.
+func (s *Server) resolveRewrite(ctx context.Context, logger *logrus.Entry, req *dns.Msg, target string) *upstreamReply {
+	q := req.Question[0]
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: q.Qclass, Ttl: rewriteTTL},
+		Target: target,
+	}
+	logger = logger.WithField("rewrite", target)
+	logger.Debug("Rewritten by CNAME.")
+
+	treq := req.Copy()
+	treq.Question[0].Name = target
+	var reply *upstreamReply
+	if q.Qtype == dns.TypeCNAME {
+		m := new(dns.Msg)
+		m.SetReply(treq)
+		reply = &upstreamReply{Msg: m, verdict: VerdictRewritten}
+	} else if m := s.answerRewrite(treq); m != nil {
+		reply = &upstreamReply{Msg: m, verdict: VerdictRewritten}
+	} else if m := s.answerHosts(treq); m != nil {
+		reply = &upstreamReply{Msg: m, verdict: VerdictHosts}
+	} else if reply = s.resolve(context.WithValue(ctx, rewrittenKey{}, true), logger, treq); reply == nil {
+		return nil
+	}
+
+	m := reply.Msg.Copy()
+	m.Id = req.Id
+	m.Question = req.Question
+	m.AuthenticatedData = false
+	m.Answer = append([]dns.RR{cname}, m.Answer...)
+	return &upstreamReply{Msg: m, server: reply.server, rtt: reply.rtt, verdict: reply.verdict}
+}
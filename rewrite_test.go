@@ -0,0 +1,110 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestWithRewriteRules(t *testing.T) {
+	path := writeTestList(t, "rewrite.rules", `# split horizon
+intranet.example.com address 10.0.0.5 fd00::5
+*.svc.example.com    address 10.0.0.6
+www.example.com      cname   Intranet.example.com
+cdn.example.com      cname   cdn.example.net.
+example.org          strip   AAAA 203.0.113.1
+`)
+	o := newServerOptions()
+	if err := WithRewriteRules(path)(o); err != nil {
+		t.Fatal(err)
+	}
+	o.Delay = time.Second
+	o.TrustedServers = resolverList{startAnswerUpstream(t, "203.0.113.1", "203.0.113.2")}
+	s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second)), goroutines: newGoroutineTracker()}
+	logger := logrus.WithField("test", t.Name())
+
+	answers := func(m *dns.Msg) (got []string) {
+		for _, rr := range m.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				got = append(got, rr.A.String())
+			case *dns.AAAA:
+				got = append(got, rr.AAAA.String())
+			case *dns.CNAME:
+				got = append(got, rr.Hdr.Name+">"+rr.Target)
+			}
+		}
+		return
+	}
+	for _, tt := range []struct {
+		name  string
+		qtype uint16
+		want  string // empty if not answered locally
+	}{
+		{"Intranet.example.com.", dns.TypeA, "[10.0.0.5]"},
+		{"intranet.example.com.", dns.TypeAAAA, "[fd00::5]"},
+		{"a.svc.example.com.", dns.TypeA, "[10.0.0.6]"},
+		{"a.svc.example.com.", dns.TypeAAAA, "[]"},
+		{"svc.example.com.", dns.TypeA, ""},
+		{"intranet.example.com.", dns.TypeMX, ""},
+		{"www.example.com.", dns.TypeA, ""},
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(tt.name, tt.qtype)
+		m := s.answerRewrite(req)
+		if got := ""; m != nil {
+			got = fmt.Sprint(answers(m))
+			if got != tt.want {
+				t.Errorf("%s %s should be answered %s, got %s", tt.name, dns.TypeToString[tt.qtype], tt.want, got)
+			}
+		} else if tt.want != "" {
+			t.Errorf("%s %s should be answered locally", tt.name, dns.TypeToString[tt.qtype])
+		}
+	}
+
+	for name, want := range map[string]string{
+		"www.example.com.": "[www.example.com.>intranet.example.com. 10.0.0.5]",
+		"cdn.example.com.": "[cdn.example.com.>cdn.example.net. 203.0.113.1 203.0.113.2]",
+		"example.net.":     "[203.0.113.1 203.0.113.2]",
+	} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		reply := s.resolve(context.Background(), logger, req)
+		if reply == nil {
+			t.Fatalf("%s should be resolved", name)
+		}
+		if got := fmt.Sprint(answers(reply.Msg)); got != want {
+			t.Errorf("%s should be answered %s, got %s", name, want, got)
+		}
+		if reply.Question[0].Name != name {
+			t.Errorf("Question of %s should be kept, got %s", name, reply.Question[0].Name)
+		}
+	}
+
+	m := newTestReply("example.org.", 60, "203.0.113.1", "203.0.113.2")
+	m.Answer = append(m.Answer, newTestAAAAReply("example.org.", "2001:db8::1").Answer...)
+	m.AuthenticatedData = true
+	s.stripRewrite(logger, "example.org.", m)
+	if got := fmt.Sprint(answers(m)); got != "[203.0.113.2]" || m.AuthenticatedData {
+		t.Errorf("AAAA records and 203.0.113.1 should be stripped, got %s", got)
+	}
+
+	for _, line := range []string{
+		"example.com address 10.0.0.1 example.net",
+		"example.com cname a.example.com b.example.com",
+		"example.com strip NOTATYPE",
+		"example.com forward 10.0.0.1",
+		"example.com",
+	} {
+		if err := newRewriteTable().Add(line); err == nil {
+			t.Errorf("Invalid rule [%s] should fail", line)
+		}
+	}
+	if err := o.RewriteRules.Add("intranet.example.com cname example.net"); err == nil {
+		t.Error("A name answered by addresses should not be answered by cname")
+	}
+}
@@ -0,0 +1,183 @@
+package gochinadns
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// scheduledRule blocks a domain set for some clients during a weekly time window.
+type scheduledRule struct {
+	clients []*net.IPNet // nil matches all clients
+	days    [7]bool      // days on which the window starts
+	start   int          // minutes since midnight
+	end     int          // minutes since midnight. The window wraps midnight if end <= start.
+	loc     *time.Location
+	domains *domainTrie
+}
+
+// Active reports whether the time window of this rule covers t.
+func (r *scheduledRule) Active(t time.Time) bool {
+	t = t.In(r.loc)
+	now := t.Hour()*60 + t.Minute()
+	if r.start < r.end {
+		return r.days[t.Weekday()] && r.start <= now && now < r.end
+	}
+	// the window wraps midnight, so early hours belong to the window started yesterday.
+	yesterday := (t.Weekday() + 6) % 7
+	return (r.days[t.Weekday()] && now >= r.start) || (r.days[yesterday] && now < r.end)
+}
+
+func (r *scheduledRule) matchClient(ip net.IP) bool {
+	if r.clients == nil {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range r.clients {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// blockSchedule is a set of scheduled blocking rules.
+type blockSchedule []*scheduledRule
+
+// Blocks reports whether any rule blocks name for client at time t.
+func (s blockSchedule) Blocks(client net.IP, name string, t time.Time) bool {
+	for _, r := range s {
+		if r.matchClient(client) && r.Active(t) && r.domains.Contain(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseScheduledRule parses a rule line in format:
+//
+//	<clients> <days> <hh:mm-hh:mm> <timezone> <domain list path>
+//
+// where clients is a comma separated CIDR list or `*`, days is a comma separated list of
+// weekdays or ranges (such as `sun-thu,sat`) or `*`, and timezone is an IANA name or `Local`.
+// For example, `192.168.2.0/24 sun-thu 21:00-07:00 Asia/Shanghai /etc/chinadns/video.list`
+// blocks video sites for clients in 192.168.2.0/24 on school nights.
+func parseScheduledRule(line string) (*scheduledRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expect 5 fields but got %d", len(fields))
+	}
+	r := new(scheduledRule)
+
+	if fields[0] != "*" {
+		for _, c := range strings.Split(fields[0], ",") {
+			network, err := parseCIDROrIP(c)
+			if err != nil {
+				return nil, err
+			}
+			r.clients = append(r.clients, network)
+		}
+	}
+
+	if err := parseWeekdays(fields[1], &r.days); err != nil {
+		return nil, err
+	}
+
+	window := strings.Split(fields[2], "-")
+	if len(window) != 2 {
+		return nil, fmt.Errorf("invalid time window %s", fields[2])
+	}
+	var err error
+	if r.start, err = parseClock(window[0]); err != nil {
+		return nil, err
+	}
+	if r.end, err = parseClock(window[1]); err != nil {
+		return nil, err
+	}
+
+	if r.loc, err = time.LoadLocation(fields[3]); err != nil {
+		return nil, fmt.Errorf("fail to load timezone %s: %w", fields[3], err)
+	}
+
+	if r.domains, err = loadDomainTrie(nil, fields[4], "domain list "+fields[4], nil); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func parseWeekdays(s string, days *[7]bool) error {
+	if s == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return nil
+	}
+	for _, item := range strings.Split(strings.ToLower(s), ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		from, ok := weekdays[bounds[0]]
+		if !ok {
+			return fmt.Errorf("invalid weekday %s", bounds[0])
+		}
+		to := from
+		if len(bounds) == 2 {
+			if to, ok = weekdays[bounds[1]]; !ok {
+				return fmt.Errorf("invalid weekday %s", bounds[1])
+			}
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock parses hh:mm as minutes since midnight.
+func parseClock(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid clock %s", s)
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 24 {
+		return 0, fmt.Errorf("invalid clock %s", s)
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 || h == 24 && m != 0 {
+		return 0, fmt.Errorf("invalid clock %s", s)
+	}
+	return h*60 + m, nil
+}
+
+// parseCIDROrIP parses s as a CIDR, or a single IP address.
+func parseCIDROrIP(s string) (*net.IPNet, error) {
+	_, network, err := net.ParseCIDR(s)
+	if err == nil {
+		return network, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("parse %s as CIDR failed: %v", s, err.Error())
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	l := 8 * len(ip)
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(l, l)}, nil
+}
@@ -0,0 +1,63 @@
+package gochinadns
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScheduledRule(t *testing.T) {
+	list := filepath.Join(t.TempDir(), "video.list")
+	if err := os.WriteFile(list, []byte("youtube.com\nbilibili.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rule, err := parseScheduledRule("192.168.2.0/24 sun-thu 21:00-07:00 Asia/Shanghai " + list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedule := blockSchedule{rule}
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	kid, parent := net.ParseIP("192.168.2.10"), net.ParseIP("192.168.1.10")
+
+	tests := []struct {
+		name   string
+		client net.IP
+		domain string
+		time   time.Time
+		want   bool
+	}{
+		{"sunday night", kid, "www.youtube.com", time.Date(2021, 3, 7, 22, 0, 0, 0, shanghai), true},
+		{"monday early morning", kid, "www.youtube.com", time.Date(2021, 3, 8, 6, 59, 0, 0, shanghai), true},
+		{"monday morning", kid, "www.youtube.com", time.Date(2021, 3, 8, 7, 0, 0, 0, shanghai), false},
+		{"friday night", kid, "www.youtube.com", time.Date(2021, 3, 5, 22, 0, 0, 0, shanghai), false},
+		{"friday early morning", kid, "www.youtube.com", time.Date(2021, 3, 5, 6, 0, 0, 0, shanghai), true},
+		{"saturday early morning", kid, "www.youtube.com", time.Date(2021, 3, 6, 6, 0, 0, 0, shanghai), false},
+		{"timezone conversion", kid, "bilibili.com", time.Date(2021, 3, 7, 14, 0, 0, 0, time.UTC), true},
+		{"other clients", parent, "www.youtube.com", time.Date(2021, 3, 7, 22, 0, 0, 0, shanghai), false},
+		{"other domains", kid, "github.com", time.Date(2021, 3, 7, 22, 0, 0, 0, shanghai), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := schedule.Blocks(tt.client, tt.domain, tt.time); got != tt.want {
+				t.Errorf("Blocks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScheduledRuleErrors(t *testing.T) {
+	for _, line := range []string{
+		"* * 21:00-07:00 Local",
+		"* xyz 21:00-07:00 Local /dev/null",
+		"* * 25:00-07:00 Local /dev/null",
+		"* * 21:00 Local /dev/null",
+		"* * 21:00-07:00 Mars/Olympus /dev/null",
+		"300.0.0.1 * 21:00-07:00 Local /dev/null",
+	} {
+		if _, err := parseScheduledRule(line); err == nil {
+			t.Errorf("Rule %q should be invalid", line)
+		}
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 var (
-	supportedProtocols   = []string{"udp", "tcp", "doh"}
+	supportedProtocols   = []string{"udp", "tcp", "doh", "dot"}
 	supportedProtocolMap = make(map[string]bool)
 
 	ErrUnknowProtocol  = errors.New("unknown protocol")
@@ -28,8 +31,35 @@ func SupportedProtocols() []string {
 
 // Resolver contains info about a single upstream DNS server.
 type Resolver struct {
-	Addr      string   //address of the resolver in format ip:port
-	Protocols []string //list of protocols to use with this resolver, in order of execution
+	Addr       string        //address of the resolver in format ip:port
+	Protocols  []string      //list of protocols to use with this resolver, in order of execution
+	ServerName string        //name to verify the certificate of a DoT resolver. The IP of Addr is verified if empty.
+	Mutation   string        //mutation strategy overriding the server's. See MutationXXX.
+	ECS        string        //ECS policy overriding the server's. See ECSXXX.
+	EDNSSize   int           //EDNS UDP size advertised to the resolver, overriding the server's if not 0. EDNSOff disables EDNS.
+	Timeout    time.Duration //timeout of queries to the resolver, overriding the client's if not 0.
+
+	upstream      Upstream       // resolving queries instead of Addr if not nil. See NewUpstreamResolver.
+	autoProtocols bool           // protocols are not declared explicitly, so they can be chosen by probing
+	tcpDefault    bool           // in ip[:port] format without the tcp parameter, so that tcp of its group applies
+	group         resolverParams // parameters of its group, which the exported ones override. See params.
+	caps          atomic.Value   // of *Capabilities
+	frag          fragState
+	upgrade       int32 // opportunistic DoT upgrade state. See upgradeXXX.
+	drained       int32 // 1 if drained for maintenance, so that no query is sent to it except probes
+	ednsFormErrs  int32 // consecutive FORMERR replies to queries with EDNS, answered without it
+	ednsBroken    int64 // unix nanoseconds when EDNS is disabled by FORMERR replies, 0 if not
+}
+
+// upstreamProtocol is the protocol of resolvers of custom upstreams.
+const upstreamProtocol = "custom"
+
+// NewUpstreamResolver returns a resolver of a custom upstream u, which resolves queries instead of a DNS server.
+// name is the address of it in logs, the admin API and the status, and should be unique among resolvers.
+// It's never probed for transports, but health checks, selection strategies and statistics apply as usual.
+// See WithUpstreams.
+func NewUpstreamResolver(name string, u Upstream) *Resolver {
+	return &Resolver{Addr: name, Protocols: []string{upstreamProtocol}, upstream: u}
 }
 
 func (r *Resolver) GetAddr() string {
@@ -45,6 +75,24 @@ func (r *Resolver) String() string {
 	sb.WriteString(strings.Join(r.Protocols, "+"))
 	sb.WriteByte('@')
 	sb.WriteString(r.Addr)
+	if r.ServerName != "" {
+		sb.WriteByte('#')
+		sb.WriteString(r.ServerName)
+	}
+	sep := byte('?')
+	var timeout string
+	if r.Timeout > 0 {
+		timeout = r.Timeout.String()
+	}
+	for _, param := range [...][2]string{{"mutation", r.Mutation}, {"ecs", r.ECS}, {"edns", r.ednsParam()}, {"timeout", timeout}} {
+		if param[1] != "" {
+			sb.WriteByte(sep)
+			sb.WriteString(param[0])
+			sb.WriteByte('=')
+			sb.WriteString(param[1])
+			sep = '&'
+		}
+	}
 	return sb.String()
 }
 
@@ -61,17 +109,34 @@ func (r resolverList) String() string {
 }
 
 // ParseResolver takes a single resolver in schema string format and outputs a resolver struct.
-// It also accept regular ip[:port] format for backwards compatibility.
+// It also accept regular ip[:port] format for backwards compatibility, a https:// URL for DoH resolvers,
+// and udp://, tcp:// and tls:// URLs for UDP, TCP and DoT resolvers.
 // The schema is defined as:  [protocol[+protocol]@]host[:port][/endpoint]
+// Resolvers may override the mutation strategy, ECS policy, EDNS size and timeout by a suffix like
+// `?mutation=never&ecs=strip&edns=off&timeout=5s`, after the query string of a DoH URL if any, and resolvers in
+// ip[:port] format may override tcpOnly by `?tcp=true` or `?tcp=false`.
 func ParseResolver(schema string, tcpOnly bool) (r *Resolver, err error) {
 	err = nil
 	var (
 		addr   string
 		protos []string
+		auto   bool
+		plain  bool // in ip[:port] format
 	)
 	fields := strings.Split(schema, "@")
-	if len(fields) == 1 { // schema in ip[:port] format
+	if len(fields) == 1 && strings.HasPrefix(strings.ToLower(schema), "https://") { // schema in DoH URL format
+		addr = schema
+		protos = []string{"doh"}
+	} else if len(fields) == 1 && strings.HasPrefix(strings.ToLower(schema), "tls://") { // schema in DoT URL format
+		addr = schema[len("tls://"):]
+		protos = []string{"dot"}
+	} else if scheme := strings.ToLower(schema[:strings.Index(schema, ":")+1]); len(fields) == 1 &&
+		(scheme == "udp:" || scheme == "tcp:") && strings.HasPrefix(schema[len(scheme):], "//") { // schema in udp:// or tcp:// URL format
+		addr = strings.TrimSuffix(schema[len(scheme)+2:], "/")
+		protos = []string{scheme[:3]}
+	} else if len(fields) == 1 { // schema in ip[:port] format
 		addr = fields[0]
+		auto, plain = !tcpOnly, true
 		if tcpOnly {
 			protos = []string{"tcp"}
 		} else {
@@ -87,16 +152,49 @@ func ParseResolver(schema string, tcpOnly bool) (r *Resolver, err error) {
 		}
 	}
 
-	// Process host port
-	if _, _, err = net.SplitHostPort(addr); err != nil {
-		if strings.Contains(err.Error(), "missing port in address") ||
-			strings.Contains(err.Error(), "too many colons in address") {
-			if strings.Contains(addr, "[") {
+	// Resolvers may override the mutation strategy, ECS policy, EDNS size and timeout by a suffix:
+	// ip[:port]?mutation=strategy&ecs=policy&edns=size&timeout=duration&tcp=bool
+	var params resolverParams
+	if i := resolverParamsIndex(addr); i >= 0 {
+		if params, err = parseResolverParams(addr[i+1:]); err != nil {
+			return
+		}
+		addr = addr[:i]
+		if params.tcp != nil {
+			if !plain {
+				err = fmt.Errorf("%w: tcp is only for resolvers in ip[:port] format", ErrInvalidResolver)
+				return
+			}
+			auto = !*params.tcp
+			protos = []string{"udp"}
+			if *params.tcp {
+				protos = []string{"tcp"}
+			}
+		}
+	}
+
+	// DoT resolvers may pin a server name to verify: ip[:port]#name
+	var serverName string
+	if i := strings.LastIndex(addr, "#"); i >= 0 && protos[0] == "dot" {
+		addr, serverName = addr[:i], addr[i+1:]
+	}
+	defaultPort := "53"
+	if protos[0] == "dot" {
+		defaultPort = "853"
+	}
+
+	// Process host port. URLs (of DoH servers) are kept as is.
+	if !strings.Contains(addr, "://") {
+		if _, _, err = net.SplitHostPort(addr); err != nil {
+			if strings.Contains(err.Error(), "missing port in address") ||
+				strings.Contains(err.Error(), "too many colons in address") {
+				if strings.Contains(addr, "[") {
+					return
+				}
+				addr, err = net.JoinHostPort(addr, defaultPort), nil
+			} else {
 				return
 			}
-			addr, err = net.JoinHostPort(addr, "53"), nil
-		} else {
-			return
 		}
 	}
 
@@ -108,12 +206,111 @@ func ParseResolver(schema string, tcpOnly bool) (r *Resolver, err error) {
 	}
 
 	r = &Resolver{
-		Addr:      addr,
-		Protocols: protos,
+		Addr:       addr,
+		Protocols:  protos,
+		ServerName: serverName,
+		Mutation:   params.mutation,
+		ECS:        params.ecs,
+		EDNSSize:   params.ednsSize,
+		Timeout:    params.timeout,
+
+		autoProtocols: auto,
+		tcpDefault:    plain && params.tcp == nil,
 	}
 	return
 }
 
+// resolverParams are parameters of a resolver overriding settings of the server. See ParseResolver.
+type resolverParams struct {
+	mutation, ecs string
+	ednsSize      int
+	timeout       time.Duration
+	tcp           *bool // nil if absent
+}
+
+// resolverParamKeys are keys of parameters of a resolver. See parseResolverParams.
+var resolverParamKeys = map[string]bool{"mutation": true, "ecs": true, "edns": true, "timeout": true, "tcp": true}
+
+// resolverParamsIndex returns the index of the `?` before the parameters of a resolver at the end of addr, or -1 if
+// there are none. A query string of other keys, like that of a DoH URL, is not parameters of the resolver.
+func resolverParamsIndex(addr string) int {
+	i := strings.LastIndex(addr, "?")
+	if i < 0 {
+		return -1
+	}
+	for _, param := range strings.Split(addr[i+1:], "&") {
+		if key := strings.SplitN(param, "=", 2)[0]; !resolverParamKeys[key] {
+			return -1
+		}
+	}
+	return i
+}
+
+// parseResolverParams parses parameters of a resolver like `mutation=never&timeout=5s`.
+func parseResolverParams(query string) (p resolverParams, err error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return p, err
+	}
+	p.mutation, p.ecs = values.Get("mutation"), values.Get("ecs")
+	if err = checkMutationStrategy(p.mutation); err != nil {
+		return p, err
+	}
+	if _, err = checkECSPolicy(p.ecs); err != nil {
+		return p, err
+	}
+	if p.ednsSize, err = parseEDNSSize(values.Get("edns")); err != nil {
+		return p, err
+	}
+	if v := values.Get("timeout"); v != "" {
+		if p.timeout, err = time.ParseDuration(v); err != nil || p.timeout <= 0 {
+			return p, fmt.Errorf("invalid timeout [%s]", v)
+		}
+	}
+	if v := values.Get("tcp"); v != "" {
+		tcp, err := strconv.ParseBool(v)
+		if err != nil {
+			return p, fmt.Errorf("invalid tcp [%s], expect true or false", v)
+		}
+		p.tcp = &tcp
+	}
+	return p, nil
+}
+
+// applyDefaults applies parameters of the group of r (see WithGroupSettings) which r doesn't override. They are kept
+// apart from the exported ones, so that String reports r as declared.
+func (r *Resolver) applyDefaults(p resolverParams) {
+	if r.upstream != nil {
+		return
+	}
+	r.group = p
+	if r.tcpDefault && p.tcp != nil {
+		r.autoProtocols = !*p.tcp
+		r.Protocols = []string{"udp"}
+		if *p.tcp {
+			r.Protocols = []string{"tcp"}
+		}
+	}
+}
+
+// params returns the effective parameters of r, i.e. its own ones, or those of its group if it doesn't override them.
+func (r *Resolver) params() resolverParams {
+	p := r.group
+	if r.Mutation != "" {
+		p.mutation = r.Mutation
+	}
+	if r.ECS != "" {
+		p.ecs = r.ECS
+	}
+	if r.EDNSSize != 0 {
+		p.ednsSize = r.EDNSSize
+	}
+	if r.Timeout != 0 {
+		p.timeout = r.Timeout
+	}
+	return p
+}
+
 // checkProtocolHost checks if a valid protocol-host pair is specified.
 func checkProtocolHost(proto, addr string) error {
 	if _, ok := supportedProtocolMap[proto]; !ok {
@@ -121,8 +318,8 @@ func checkProtocolHost(proto, addr string) error {
 	}
 	var errInvalid = fmt.Errorf("%w [%s@%s]", ErrInvalidResolver, proto, addr)
 	switch proto {
-	case "udp", "tcp":
-		// Only IP format is allowd for UDP and TCP DNS protocol
+	case "udp", "tcp", "dot":
+		// Only IP format is allowd for UDP, TCP and DoT DNS protocol
 		host, _, err := net.SplitHostPort(addr)
 		if err != nil {
 			return err
@@ -3,6 +3,7 @@ package gochinadns
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func Test_schemaToResolver(t *testing.T) {
@@ -13,8 +14,10 @@ func Test_schemaToResolver(t *testing.T) {
 		wantErr bool
 	}{
 		{"8.8.8.8:53", &Resolver{
-			Addr:      "8.8.8.8:53",
-			Protocols: []string{"udp"},
+			Addr:          "8.8.8.8:53",
+			Protocols:     []string{"udp"},
+			autoProtocols: true,
+			tcpDefault:    true,
 		}, false},
 		{"udp@8.8.8.8:54", &Resolver{
 			Addr:      "8.8.8.8:54",
@@ -36,13 +39,17 @@ func Test_schemaToResolver(t *testing.T) {
 		{"asdf@8.8.8.8:53", nil, true},
 		{"wut+tcp@8.8.8.8:53", nil, true},
 		{"2a09::", &Resolver{
-			Addr:      "[2a09::]:53",
-			Protocols: []string{"udp"},
+			Addr:          "[2a09::]:53",
+			Protocols:     []string{"udp"},
+			autoProtocols: true,
+			tcpDefault:    true,
 		}, false},
 		{"[2a09::]", nil, true},
 		{"[2a09::]:123", &Resolver{
-			Addr:      "[2a09::]:123",
-			Protocols: []string{"udp"},
+			Addr:          "[2a09::]:123",
+			Protocols:     []string{"udp"},
+			autoProtocols: true,
+			tcpDefault:    true,
 		}, false},
 		{"tcp+udp@2a09::", &Resolver{
 			Addr:      "[2a09::]:53",
@@ -53,8 +60,110 @@ func Test_schemaToResolver(t *testing.T) {
 			Protocols: []string{"doh"},
 		}, false},
 		{"doh+udp@https://doh.serv/query", nil, true},
-		{"https://doh.serv/query", nil, true},
+		{"tls://1.1.1.1", &Resolver{
+			Addr:      "1.1.1.1:853",
+			Protocols: []string{"dot"},
+		}, false},
+		{"tls://8.8.8.8:8853#dns.google", &Resolver{
+			Addr:       "8.8.8.8:8853",
+			Protocols:  []string{"dot"},
+			ServerName: "dns.google",
+		}, false},
+		{"dot@2606:4700:4700::1111#cloudflare-dns.com", &Resolver{
+			Addr:       "[2606:4700:4700::1111]:853",
+			Protocols:  []string{"dot"},
+			ServerName: "cloudflare-dns.com",
+		}, false},
+		{"tls://dns.google", nil, true},
+		{"udp://119.29.29.29", &Resolver{
+			Addr:      "119.29.29.29:53",
+			Protocols: []string{"udp"},
+		}, false},
+		{"TCP://8.8.8.8:53/", &Resolver{
+			Addr:      "8.8.8.8:53",
+			Protocols: []string{"tcp"},
+		}, false},
+		{"tcp://[2a09::]:5353?mutation=never", &Resolver{
+			Addr:      "[2a09::]:5353",
+			Protocols: []string{"tcp"},
+			Mutation:  MutationNever,
+		}, false},
+		{"udp://doh.serv/query", nil, true},
+		{"https://doh.serv/query", &Resolver{
+			Addr:      "https://doh.serv/query",
+			Protocols: []string{"doh"},
+		}, false},
+		{"https://dns.google:8443/dns-query", &Resolver{
+			Addr:      "https://dns.google:8443/dns-query",
+			Protocols: []string{"doh"},
+		}, false},
 		{"udp@https://doh.serv/query", nil, true},
+		{"8.8.8.8?mutation=never", &Resolver{
+			Addr:      "8.8.8.8:53",
+			Protocols: []string{"udp"},
+			Mutation:  MutationNever,
+
+			autoProtocols: true,
+			tcpDefault:    true,
+		}, false},
+		{"tcp@[2a09::]:53?mutation=polluted", &Resolver{
+			Addr:      "[2a09::]:53",
+			Protocols: []string{"tcp"},
+			Mutation:  MutationPolluted,
+		}, false},
+		{"8.8.8.8?mutation=sometimes", nil, true},
+		{"udp@114.114.114.114?ecs=203.0.113.0/24", &Resolver{
+			Addr:      "114.114.114.114:53",
+			Protocols: []string{"udp"},
+			ECS:       "203.0.113.0/24",
+		}, false},
+		{"8.8.8.8?mutation=never&ecs=strip", &Resolver{
+			Addr:      "8.8.8.8:53",
+			Protocols: []string{"udp"},
+			Mutation:  MutationNever,
+			ECS:       ECSStrip,
+
+			autoProtocols: true,
+			tcpDefault:    true,
+		}, false},
+		{"8.8.8.8?ecs=somewhere", nil, true},
+		{"udp@114.114.114.114?edns=off", &Resolver{
+			Addr:      "114.114.114.114:53",
+			Protocols: []string{"udp"},
+			EDNSSize:  EDNSOff,
+		}, false},
+		{"8.8.8.8?ecs=strip&edns=1232", &Resolver{
+			Addr:      "8.8.8.8:53",
+			Protocols: []string{"udp"},
+			ECS:       ECSStrip,
+			EDNSSize:  1232,
+
+			autoProtocols: true,
+			tcpDefault:    true,
+		}, false},
+		{"8.8.8.8?edns=100", nil, true},
+		{"8.8.8.8?timeout=5s&tcp=true", &Resolver{
+			Addr:      "8.8.8.8:53",
+			Protocols: []string{"tcp"},
+			Timeout:   5 * time.Second,
+		}, false},
+		{"8.8.8.8?tcp=false", &Resolver{
+			Addr:      "8.8.8.8:53",
+			Protocols: []string{"udp"},
+
+			autoProtocols: true,
+		}, false},
+		{"tcp@8.8.8.8?tcp=false", nil, true},
+		{"8.8.8.8?timeout=0s", nil, true},
+		{"doh@https://doh.serv/query?ct=application/dns-message", &Resolver{
+			Addr:      "https://doh.serv/query?ct=application/dns-message",
+			Protocols: []string{"doh"},
+		}, false},
+		{"https://doh.serv/query?ct=application/dns-message?timeout=5s", &Resolver{
+			Addr:      "https://doh.serv/query?ct=application/dns-message",
+			Protocols: []string{"doh"},
+			Timeout:   5 * time.Second,
+		}, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.input, func(t *testing.T) {
@@ -69,3 +178,45 @@ func Test_schemaToResolver(t *testing.T) {
 		})
 	}
 }
+
+func TestGroupSettings(t *testing.T) {
+	o := newServerOptions()
+	for _, f := range []ServerOption{
+		WithTrustedResolvers(true, "8.8.8.8", "1.1.1.1?timeout=1s&tcp=false", "https://dns.google/dns-query"),
+		WithGroupSettings(true, "timeout=8s&tcp=true&mutation=never"),
+	} {
+		if err := f(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{serverOptions: o, Client: NewClient(WithTimeout(2 * time.Second))}
+	if err := s.partitionResolvers(); err != nil {
+		t.Fatal(err)
+	}
+	// Settings of the group are not reported as parameters of resolvers, which are matched by their strings.
+	want := []string{"tcp@8.8.8.8:53", "udp@1.1.1.1:53?timeout=1s", "doh@https://dns.google/dns-query"}
+	if got := resolverStrings(s.TrustedServers); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected trusted servers %v, want %v", got, want)
+	}
+	for i, timeout := range []time.Duration{8 * time.Second, time.Second, 8 * time.Second} {
+		r := s.TrustedServers[i]
+		if p := r.params(); p.timeout != timeout || p.mutation != MutationNever || s.mutationStrategy(r) != MutationNever {
+			t.Errorf("%s: unexpected effective parameters %+v", r, p)
+		}
+	}
+	if got := s.queryTimeout(clientLimits{}); got != 8*time.Second {
+		t.Errorf("Query timeout should be the longest timeout of resolvers, got %s", got)
+	}
+
+	c := s.Client.withTimeout(8 * time.Second)
+	if c.Timeout != 8*time.Second || c.DoHCli == s.Client.DoHCli || c.tcpPool != s.Client.tcpPool ||
+		c.UDPCli.Timeout != 8*time.Second || c.TCPCli.Timeout != 8*time.Second {
+		t.Errorf("Unexpected client of another timeout: %+v", c)
+	}
+	if s.Client.withTimeout(8*time.Second) != c || s.Client.withTimeout(0) != s.Client {
+		t.Error("Clients of timeouts should be reused")
+	}
+	if err := WithGroupSettings(false, "timeout=soon")(o); err == nil {
+		t.Error("Invalid settings should fail")
+	}
+}
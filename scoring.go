@@ -0,0 +1,279 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// saneTTLMax is the max TTL (a week) of sane answers. Longer TTLs are seen in forged answers rather than real zones.
+const saneTTLMax = 7 * 24 * 3600
+
+// DefaultScoreWeights are weights of the default scorer, which picks replies like the race without scoring: an
+// untrusted answer in China beats a trusted one overseas, and an untrusted answer overseas is never acceptable. In
+// bidirectional mode, a trusted answer in China isn't acceptable either, but is still preferred to an untrusted one
+// overseas.
+var DefaultScoreWeights = ScoreWeights{Origin: 1, Latency: 1, Locality: 2, Blacklist: 10, TTL: 1}
+
+// ScoreInput describes a reply raced in upstreams, to be scored by a Scorer.
+type ScoreInput struct {
+	Trusted       bool          // from a trusted upstream
+	RTT           time.Duration // of the upstream
+	Budget        time.Duration // latency budget of the race, see WithAnswerScorer
+	Addressed     bool          // the answer has IPs, maybe at the end of a chased CNAME chain
+	China         bool          // the answer is located in China, see WithAnswerMatch
+	Blacklisted   bool          // the answer hits IP blacklist, fails DNSSEC validation, or is a suspicious untrusted reply
+	NearBlacklist bool          // the answer has IPs in a /24 (/64 for IPv6) with blacklisted ones
+	InsaneTTL     bool          // the answer has TTLs of 0 or beyond a week
+	Bidirectional bool          // trusted answers in China are doubted, see WithBidirectional
+}
+
+// Scorer scores replies raced in upstreams. Replies scoring above zero are acceptable.
+type Scorer interface {
+	Score(in *ScoreInput) float64
+}
+
+// ScorerFunc is a function as a Scorer.
+type ScorerFunc func(in *ScoreInput) float64
+
+// Score implements Scorer.
+func (f ScorerFunc) Score(in *ScoreInput) float64 { return f(in) }
+
+// ScoreWeights are weights of inputs in the default Scorer, where larger Origin means strictness, and larger Latency
+// means speed.
+type ScoreWeights struct {
+	Origin    float64 // added to trusted replies
+	Latency   float64 // subtracted in proportion to the RTT in the latency budget
+	Locality  float64 // added to answers in China, or subtracted if trusted and Bidirectional, and from untrusted ones overseas
+	Blacklist float64 // subtracted from blacklisted answers, and half of it from answers near blacklisted IPs
+	TTL       float64 // subtracted from answers of insane TTLs
+}
+
+// Score implements Scorer.
+func (w ScoreWeights) Score(in *ScoreInput) float64 {
+	var score float64
+	if in.Trusted {
+		score += w.Origin
+	}
+	if in.Budget > 0 {
+		score -= w.Latency * float64(in.RTT) / float64(in.Budget)
+	}
+	if in.Addressed {
+		if in.China && in.Trusted && in.Bidirectional {
+			score -= w.Locality
+		} else if in.China {
+			score += w.Locality
+		} else if !in.Trusted {
+			score -= w.Locality
+		}
+	}
+	if in.Blacklisted {
+		score -= w.Blacklist
+	} else if in.NearBlacklist {
+		score -= w.Blacklist / 2
+	}
+	if in.InsaneTTL {
+		score -= w.TTL
+	}
+	return score
+}
+
+// String formats w like "origin=1,latency=1,locality=2,blacklist=10,ttl=1", see ParseScoreWeights.
+func (w ScoreWeights) String() string {
+	f := func(v float64) string { return strconv.FormatFloat(v, 'g', -1, 64) }
+	return "origin=" + f(w.Origin) + ",latency=" + f(w.Latency) + ",locality=" + f(w.Locality) +
+		",blacklist=" + f(w.Blacklist) + ",ttl=" + f(w.TTL)
+}
+
+// ParseScoreWeights parses weights in format "origin=1,latency=2", where weights absent are those of
+// DefaultScoreWeights.
+func ParseScoreWeights(s string) (ScoreWeights, error) {
+	w := DefaultScoreWeights
+	for _, field := range strings.Split(s, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return w, fmt.Errorf("invalid score weight: %s", field)
+		}
+		v, err := strconv.ParseFloat(kv[1], 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return w, fmt.Errorf("invalid score weight: %s", field)
+		}
+		switch kv[0] {
+		case "origin":
+			w.Origin = v
+		case "latency":
+			w.Latency = v
+		case "locality":
+			w.Locality = v
+		case "blacklist":
+			w.Blacklist = v
+		case "ttl":
+			w.TTL = v
+		default:
+			return w, fmt.Errorf("unknown score weight: %s", kv[0])
+		}
+	}
+	return w, nil
+}
+
+// WithAnswerScorer picks the reply scoring highest by scorer among those raced in trusted and untrusted upstreams
+// within budget since the race starts, instead of the first acceptable one. Once budget is spent, the race waits on
+// only if no acceptable reply (scoring above zero) has arrived, and falls back to the best one when upstreams are done.
+func WithAnswerScorer(scorer Scorer, budget time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if scorer == nil {
+			return errors.New("answer scorer is required")
+		}
+		if budget <= 0 {
+			return fmt.Errorf("invalid latency budget of answer scoring: %s", budget)
+		}
+		o.Scorer, o.ScoreBudget = scorer, budget
+		return nil
+	}
+}
+
+// WithScoreWeights is WithAnswerScorer with the default scorer of weights, in format of ParseScoreWeights.
+func WithScoreWeights(weights string, budget time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		w, err := ParseScoreWeights(weights)
+		if err != nil {
+			return err
+		}
+		return WithAnswerScorer(w, budget)(o)
+	}
+}
+
+// scorerString describes the scorer of the options, which is "custom" unless it's the default scorer.
+func (o *serverOptions) scorerString() string {
+	switch scorer := o.Scorer.(type) {
+	case nil:
+		return ""
+	case ScoreWeights:
+		return scorer.String()
+	}
+	return "custom"
+}
+
+// pickScored waits for replies of the trusted and untrusted groups, which are sent before their contexts are done,
+// and returns the one scoring highest (nil if nothing replied). Replies are waited for within the latency budget
+// since start, and beyond it only until an acceptable one arrives.
+func (s *Server) pickScored(
+	ctx context.Context, logger *logrus.Entry, start time.Time,
+	tdone <-chan struct{}, trusted <-chan *upstreamReply, udone <-chan struct{}, untrusted <-chan *upstreamReply,
+) (best *upstreamReply) {
+	bestScore := math.Inf(-1)
+	consider := func(replies <-chan *upstreamReply, trusted bool) {
+		select {
+		case rep := <-replies:
+			if rep, score := s.scoreReply(ctx, logger, rep, trusted); best == nil || score > bestScore {
+				best, bestScore = rep, score
+			}
+		default:
+		}
+	}
+
+	timer := s.Clock.NewTimer(s.ScoreBudget - s.Clock.Now().Sub(start))
+	defer timer.Stop()
+	budget := timer.C()
+	for tdone != nil || udone != nil {
+		select {
+		case <-tdone:
+			tdone = nil
+			consider(trusted, true)
+		case <-udone:
+			udone = nil
+			consider(untrusted, false)
+		case <-budget:
+			budget = nil
+			logger.Debug("Latency budget is spent.")
+		}
+		if budget == nil && best != nil && bestScore > 0 {
+			break
+		}
+	}
+	if best != nil {
+		logger.WithFields(logrus.Fields{"server": best.server, "score": bestScore}).Debug("Pick the reply scoring highest.")
+	}
+	return
+}
+
+// scoreReply scores rep, and returns it with its verdict, or the reply of its chased CNAME chain (see WithCNAMEChase).
+func (s *Server) scoreReply(ctx context.Context, logger *logrus.Entry, rep *upstreamReply, trusted bool) (*upstreamReply, float64) {
+	in := &ScoreInput{Trusted: trusted, RTT: rep.rtt, Budget: s.ScoreBudget, Bidirectional: s.Bidirectional}
+	if !trusted && (s.isSuspiciousRcode(rep) || s.isSuspiciousEmpty(rep)) {
+		in.Blacklisted = true
+	}
+	rep, ips := s.addressedReply(ctx, logger, rep)
+	rep.verdict = VerdictNoAddress
+	if len(ips) > 0 {
+		in.Addressed = true
+		hit, err := s.isBlacklistedAnswer(ips)
+		if err != nil {
+			logger.WithError(err).Error("Blacklist CIDR error.")
+		}
+		if !hit && trusted && s.dnssec != nil && errors.Is(s.dnssec.Validate(ctx, rep.Msg), errDNSSECBogus) {
+			hit = true
+		}
+		in.Blacklisted = in.Blacklisted || hit
+		in.NearBlacklist = s.isNearBlacklistedAnswer(ips)
+		if in.China, err = s.isChinaAnswer(ctx, ips); err != nil {
+			logger.WithError(err).Error("CIDR error.")
+		}
+		switch {
+		case trusted && in.China:
+			rep.verdict = VerdictTrusted
+		case trusted:
+			rep.verdict = VerdictOverseas
+		case in.China:
+			rep.verdict = VerdictChina
+		}
+	}
+	if in.Blacklisted || (!trusted && in.Addressed && !in.China) || (trusted && in.China && s.Bidirectional) {
+		rep.verdict = VerdictFallback
+	}
+	in.InsaneTTL = hasInsaneTTL(rep.Msg)
+
+	score := s.Scorer.Score(in)
+	logger.WithFields(logrus.Fields{"server": rep.server, "score": score}).Debug("Score the reply.")
+	return rep, score
+}
+
+// isNearBlacklistedAnswer tells whether any of ips is in a /24 (/64 for IPv6) with IPs in the IP blacklist.
+func (s *Server) isNearBlacklistedAnswer(ips []net.IP) bool {
+	blacklist := s.loadMatchers().blacklist
+	for _, ip := range ips {
+		var network net.IPNet
+		if ip4 := ip.To4(); ip4 != nil {
+			network.Mask = net.CIDRMask(24, 32)
+			network.IP = ip4.Mask(network.Mask)
+		} else {
+			network.Mask = net.CIDRMask(64, 128)
+			network.IP = ip.Mask(network.Mask)
+		}
+		if blacklist.Overlaps(&network) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasInsaneTTL tells whether m has answer records of TTL 0 or beyond a week.
+func hasInsaneTTL(m *dns.Msg) bool {
+	for _, rr := range m.Answer {
+		if ttl := rr.Header().Ttl; ttl == 0 || ttl > saneTTLMax {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestAnswerScoring(t *testing.T) {
+	china := writeTestList(t, "china.list", "1.0.1.0/24\n")
+	blacklist := writeTestList(t, "blacklist.list", "93.46.8.89/32\n")
+	upstream := func(name, ip string, rtt time.Duration) *Resolver {
+		return NewUpstreamResolver(name, UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+			m := newTestReply(req.Question[0].Name, 60, ip)
+			m.Id = req.Id
+			return m, rtt, nil
+		}))
+	}
+	for _, tc := range []struct {
+		name          string
+		weights       string
+		bidirectional bool
+		trusted       string // answer of the trusted upstream
+		untrusted     string
+		rtt           time.Duration // of the untrusted upstream
+		verdict       string
+	}{
+		{"china", "", false, "142.250.1.1", "1.0.1.1", time.Millisecond, VerdictChina},
+		{"poisoned", "", false, "142.250.1.1", "93.46.8.89", time.Millisecond, VerdictOverseas},
+		{"near blacklist", "", false, "142.250.1.1", "93.46.8.1", time.Millisecond, VerdictOverseas},
+		{"overseas", "", false, "142.250.1.1", "8.8.8.8", time.Millisecond, VerdictOverseas},
+		{"strict", "origin=5", false, "142.250.1.1", "1.0.1.1", time.Millisecond, VerdictOverseas},
+		{"slow", "latency=10", false, "142.250.1.1", "1.0.1.1", 100 * time.Millisecond, VerdictOverseas},
+		{"trusted china", "", false, "1.0.1.2", "1.0.1.1", time.Millisecond, VerdictTrusted},
+		// Trusted answers in China are doubted in bidirectional mode, unless untrusted ones are worse.
+		{"bidirectional", "", true, "1.0.1.2", "1.0.1.1", time.Millisecond, VerdictChina},
+		{"bidirectional overseas", "", true, "1.0.1.2", "8.8.8.8", time.Millisecond, VerdictFallback},
+	} {
+		o := newServerOptions()
+		for _, f := range []ServerOption{
+			WithCHNList(china), WithIPBlacklist(blacklist), WithBidirectional(tc.bidirectional), WithScoreWeights(tc.weights, 100*time.Millisecond),
+			WithUpstreams(true, upstream("trusted", tc.trusted, 10*time.Millisecond)),
+			WithUpstreams(false, upstream("untrusted", tc.untrusted, tc.rtt)),
+		} {
+			if err := f(o); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second)), goroutines: newGoroutineTracker()}
+		if err := s.partitionResolvers(); err != nil {
+			t.Fatal(err)
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		reply := s.resolve(context.Background(), logrus.WithField("test", t.Name()), req)
+		if reply == nil {
+			t.Fatalf("%s: no reply", tc.name)
+		}
+		if reply.verdict != tc.verdict {
+			t.Errorf("%s: verdict %s, want %s", tc.name, reply.verdict, tc.verdict)
+		}
+	}
+
+	if _, err := ParseScoreWeights("origin=1,speed=2"); err == nil {
+		t.Error("Unknown weight should fail")
+	}
+	if w, err := ParseScoreWeights("latency=0.5"); err != nil || w.Latency != 0.5 || w.Origin != DefaultScoreWeights.Origin {
+		t.Errorf("Unexpected weights %v, %v", w, err)
+	}
+	if err := WithScoreWeights("", 0)(newServerOptions()); err == nil {
+		t.Error("Scoring without a latency budget should fail")
+	}
+}
+
+func TestCIDRSetOverlaps(t *testing.T) {
+	blacklist := writeTestList(t, "blacklist.list", "93.46.8.89/32\n2001:db8::1/128\n")
+	o := newServerOptions()
+	if err := WithIPBlacklist(blacklist)(o); err != nil {
+		t.Fatal(err)
+	}
+	set := newCIDRSet(o.IPBlacklist)
+	for _, tc := range []struct {
+		network string
+		overlap bool
+	}{
+		{"93.46.8.0/24", true},
+		{"93.46.9.0/24", false},
+		{"93.0.0.0/8", true},
+		{"2001:db8::/64", true},
+		{"2001:db8:1::/64", false},
+	} {
+		_, network, _ := net.ParseCIDR(tc.network)
+		if got := set.Overlaps(network); got != tc.overlap {
+			t.Errorf("%s overlaps: %v, want %v", tc.network, got, tc.overlap)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package gochinadns
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Strategies to select upstreams within the trusted or the untrusted group.
+const (
+	SelectSequential = "sequential"  // in the configured (or refined) order, querying the next one after Delay
+	SelectParallel   = "parallel"    // all at once, taking the first reply
+	SelectRoundRobin = "round-robin" // like SelectSequential, starting from the next upstream on each query
+	SelectWeighted   = "weighted"    // like SelectSequential, in random order weighted by the inverse of expected latency
+	SelectFastest    = "fastest"     // like SelectSequential, in order of expected latency
+)
+
+// minSuccessRate bounds the success rate an upstream is scored by, so that a flaky one is still ordered by latency.
+const minSuccessRate = 0.05
+
+// WithSelection sets the strategy to select upstreams within the trusted or the untrusted group. See SelectXXX.
+// The expected latency of an upstream is its average RTT divided by its success rate, learned from queries and
+// health checks (see WithHealthCheck). Defaults to SelectSequential.
+func WithSelection(strategy string) ServerOption {
+	return func(o *serverOptions) error {
+		switch strategy {
+		case "":
+			strategy = SelectSequential
+		case SelectSequential, SelectParallel, SelectRoundRobin, SelectWeighted, SelectFastest:
+		default:
+			return fmt.Errorf("unknown selection strategy [%s]", strategy)
+		}
+		o.Selection = strategy
+		return nil
+	}
+}
+
+// rankedResolver is a resolver with its health and expected latency.
+type rankedResolver struct {
+	r       *Resolver
+	score   float64 // expected latency, 0 if unknown
+	healthy bool
+}
+
+// rank returns list along with health and expected latency of each resolver.
+func (t *upstreamTable) rank(list resolverList) []rankedResolver {
+	ranked := make([]rankedResolver, len(list))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, r := range list {
+		e := rankedResolver{r: r, healthy: true}
+		if st := t.stats[r.String()]; st != nil {
+			e.healthy = st.ConsecutiveErrors < unhealthyErrors
+			if st.AvgRTT > 0 {
+				rate := 1 - st.FailureRate
+				if rate < minSuccessRate {
+					rate = minSuccessRate
+				}
+				e.score = float64(st.AvgRTT) / rate
+			}
+		}
+		ranked[i] = e
+	}
+	return ranked
+}
+
+// selectedResolvers returns active trusted and untrusted resolvers in the order to send queries to.
+// Unhealthy resolvers are left out if health checks are enabled, unless all of them in a group are unhealthy.
+// Upstreams pinned by client are put first if pinning is enabled (see WithPinning). client may be nil.
+func (s *Server) selectedResolvers(client net.IP) (trusted, untrusted resolverList) {
+	trusted, untrusted = s.activeResolvers()
+	trusted = s.selectResolvers(trusted, &s.selectCounters[0])
+	untrusted = s.selectResolvers(untrusted, &s.selectCounters[1])
+	if client != nil && s.pins != nil {
+		allTrusted, allUntrusted := s.resolvers()
+		trusted = s.pinResolvers(client, true, trusted, allTrusted)
+		untrusted = s.pinResolvers(client, false, untrusted, allUntrusted)
+	}
+	return
+}
+
+// selectResolvers orders list by the selection strategy. counter is the round-robin counter of the group.
+func (s *Server) selectResolvers(list resolverList, counter *uint32) resolverList {
+	if len(list) < 2 || s.HealthCheckInterval <= 0 && (s.Selection == SelectSequential || s.Selection == SelectParallel) {
+		return list
+	}
+	ranked := s.upstreams.rank(list)
+	if s.HealthCheckInterval > 0 {
+		healthy := ranked[:0:0]
+		for _, e := range ranked {
+			if e.healthy {
+				healthy = append(healthy, e)
+			}
+		}
+		if len(healthy) > 0 {
+			ranked = healthy
+		}
+	}
+
+	switch s.Selection {
+	case SelectRoundRobin:
+		n := int(atomic.AddUint32(counter, 1) % uint32(len(ranked)))
+		ranked = append(ranked[n:len(ranked):len(ranked)], ranked[:n]...)
+	case SelectWeighted:
+		weightedShuffle(ranked)
+	case SelectFastest:
+		// Upstreams without statistics keep their positions ahead, to be measured.
+		sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].score < ranked[j].score })
+	}
+	result := make(resolverList, len(ranked))
+	for i, e := range ranked {
+		result[i] = e.r
+	}
+	return result
+}
+
+// weightedShuffle shuffles ranked randomly, weighting each resolver by the inverse of its expected latency
+// (Efraimidis-Spirakis). Resolvers without statistics are weighted by the average of others.
+func weightedShuffle(ranked []rankedResolver) {
+	var sum float64
+	known := 0
+	for _, e := range ranked {
+		if e.score > 0 {
+			sum += 1 / e.score
+			known++
+		}
+	}
+	keys := make(map[*Resolver]float64, len(ranked))
+	for _, e := range ranked {
+		// Weights are normalized by the average, so that the exponent doesn't underflow keys.
+		w := 1.0
+		if e.score > 0 {
+			w = 1 / e.score / (sum / float64(known))
+		}
+		keys[e.r] = math.Pow(rand.Float64(), 1/w)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool { return keys[ranked[i].r] > keys[ranked[j].r] })
+}
+
+// selectionDelay returns the delay to query the next upstream within a group.
+func (s *Server) selectionDelay() time.Duration {
+	if s.Selection == SelectParallel {
+		return 0
+	}
+	return s.Delay
+}
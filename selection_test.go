@@ -0,0 +1,103 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cherrot/gochinadns/clock"
+	"github.com/miekg/dns"
+)
+
+func TestSelectResolvers(t *testing.T) {
+	slow := &Resolver{Addr: "1.1.1.1:53", Protocols: []string{"udp"}}
+	fast := &Resolver{Addr: "8.8.8.8:53", Protocols: []string{"udp"}}
+	flaky := &Resolver{Addr: "9.9.9.9:53", Protocols: []string{"udp"}}
+	dead := &Resolver{Addr: "208.67.222.222:53", Protocols: []string{"udp"}}
+	tb := newUpstreamTable()
+	tb.Record(&UpstreamReplyEvent{Upstream: slow, RTT: 100 * time.Millisecond})
+	tb.Record(&UpstreamReplyEvent{Upstream: fast, RTT: 20 * time.Millisecond})
+	tb.Record(&UpstreamReplyEvent{Upstream: flaky, RTT: 15 * time.Millisecond})
+	for i := 0; i < 2; i++ {
+		tb.Record(&UpstreamReplyEvent{Upstream: flaky, Err: errors.New("i/o timeout")})
+	}
+	for i := 0; i < unhealthyErrors; i++ {
+		tb.Record(&UpstreamReplyEvent{Upstream: dead, Err: errors.New("i/o timeout")})
+	}
+	list := resolverList{dead, slow, flaky, fast}
+
+	o := newServerOptions()
+	s := &Server{serverOptions: o, upstreams: tb}
+	var counter uint32
+	if got := s.selectResolvers(list, &counter); len(got) != 4 || got[0] != dead {
+		t.Errorf("Sequential selection should keep the order without health checks, got %s", got)
+	}
+
+	o.HealthCheckInterval = time.Minute
+	if got := s.selectResolvers(list, &counter); len(got) != 3 || got[0] != slow {
+		t.Errorf("Unhealthy resolver should be skipped, got %s", got)
+	}
+	if got := s.selectResolvers(resolverList{dead, dead}, &counter); len(got) != 2 {
+		t.Error("All resolvers should be kept if all of them are unhealthy")
+	}
+
+	o.Selection = SelectFastest
+	if got := s.selectResolvers(list, &counter); len(got) != 3 || got[0] != fast || got[1] != flaky || got[2] != slow {
+		t.Errorf("Unexpected order of fastest selection %s", got)
+	}
+
+	o.Selection = SelectRoundRobin
+	first := make(map[*Resolver]bool)
+	for i := 0; i < 3; i++ {
+		got := s.selectResolvers(list, &counter)
+		if len(got) != 3 {
+			t.Fatalf("Unexpected round-robin selection %s", got)
+		}
+		first[got[0]] = true
+	}
+	if len(first) != 3 {
+		t.Errorf("Round-robin selection should start from each resolver in turn, got %v", first)
+	}
+
+	o.Selection = SelectWeighted
+	counts := make(map[*Resolver]int)
+	for i := 0; i < 1000; i++ {
+		counts[s.selectResolvers(list, &counter)[0]]++
+	}
+	if counts[fast] <= counts[slow] || counts[slow] == 0 {
+		t.Errorf("Weighted selection should favor fast resolvers, got fast %d, slow %d", counts[fast], counts[slow])
+	}
+}
+
+func TestLookupInServersParallel(t *testing.T) {
+	servers := resolverList{
+		&Resolver{Addr: "192.0.2.1:53", Protocols: []string{"udp"}},
+		&Resolver{Addr: "192.0.2.2:53", Protocols: []string{"udp"}},
+	}
+	queried := make(chan *Resolver, len(servers))
+	release := make(chan struct{})
+	lookup := func(ctx context.Context, req *dns.Msg, server *Resolver) (*dns.Msg, time.Duration, error) {
+		queried <- server
+		<-release
+		return nil, 0, errors.New("i/o timeout")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		lookupInServers(ctx, cancel, make(chan *upstreamReply, 1), new(dns.Msg).SetQuestion("example.com.", dns.TypeA),
+			servers, 0, clock.Real, lookup, newGoroutineTracker())
+		close(done)
+	}()
+
+	// Neither lookup returns before both servers are queried.
+	for range servers {
+		select {
+		case <-queried:
+		case <-time.After(time.Second):
+			t.Fatal("All servers should be queried at once")
+		}
+	}
+	close(release)
+	<-done
+}
@@ -0,0 +1,318 @@
+package gochinadns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/yl2chen/cidranger"
+)
+
+// Names of canonical benchmarks, see SelfBenchmarks.
+const (
+	BenchCIDRMatch   = "cidr-match"   // classify IPs by a China route list of benchCIDRs prefixes
+	BenchDomainMatch = "domain-match" // match names against a domain list of benchDomains suffixes and wildcards
+	BenchCacheGet    = "cache-get"    // get replies from a full in-memory cache
+	BenchCacheSet    = "cache-set"    // set replies into a full in-memory cache, evicting the oldest
+	BenchServe       = "serve"        // serve queries end to end without the cache, raced in fake upstreams
+)
+
+const (
+	// benchCIDRs is the number of prefixes in the route list of BenchCIDRMatch, about the size of China route lists.
+	benchCIDRs = 8000
+	// benchDomains is the number of entries in the domain list of BenchDomainMatch, like a domain blacklist.
+	benchDomains = 50000
+	// benchKeys is the number of IPs, names or questions benchmarks go through.
+	benchKeys = 4096
+	// benchSeed makes fixtures of benchmarks the same on every run.
+	benchSeed = 1
+	// benchTime is how long RunSelfBenchmark runs a benchmark at least, the default of `go test -benchtime`.
+	benchTime = time.Second
+	// benchMaxN is the max number of iterations RunSelfBenchmark runs a benchmark.
+	benchMaxN = 1e9
+)
+
+// SelfBenchmark is a canonical benchmark of a hot path of the server, shared by `go test -bench` and the bench-self
+// subcommand, so that refactors for performance are measured the same way on development machines and on routers.
+// Fixtures are generated in memory, and nothing goes to the network.
+type SelfBenchmark struct {
+	Name string
+	// Setup generates fixtures, and returns the operation to time, run with iterations 0, 1, 2... in each round, see
+	// RunSelfBenchmark.
+	Setup func() (op func(i int) error, err error)
+}
+
+// SelfBenchResult is the result of a SelfBenchmark.
+type SelfBenchResult struct {
+	Name        string `json:"name"`
+	N           int    `json:"n"` // iterations
+	NsPerOp     int64  `json:"ns_per_op"`
+	BytesPerOp  int64  `json:"bytes_per_op"`
+	AllocsPerOp int64  `json:"allocs_per_op"`
+}
+
+// SelfBenchmarks returns canonical benchmarks of the CIDR matcher, the domain matcher, the cache and serving queries,
+// see BenchXXX.
+func SelfBenchmarks() []SelfBenchmark {
+	return []SelfBenchmark{
+		{BenchCIDRMatch, benchCIDRMatch},
+		{BenchDomainMatch, benchDomainMatch},
+		{BenchCacheGet, benchCacheGet},
+		{BenchCacheSet, benchCacheSet},
+		{BenchServe, benchServe},
+	}
+}
+
+// RunSelfBenchmark runs bm for about a second like `go test -bench`, growing iterations until they take long enough.
+// It fails if the setup or any iteration of bm fails.
+func RunSelfBenchmark(bm SelfBenchmark) (*SelfBenchResult, error) {
+	op, err := bm.Setup()
+	if err != nil {
+		return nil, err
+	}
+	var ms runtime.MemStats
+	for n := 1; ; {
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		mallocs, bytes := ms.Mallocs, ms.TotalAlloc
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			if err = op(i); err != nil {
+				return nil, err
+			}
+		}
+		d := time.Since(start)
+		runtime.ReadMemStats(&ms)
+		if d >= benchTime || n >= benchMaxN {
+			return &SelfBenchResult{
+				Name:        bm.Name,
+				N:           n,
+				NsPerOp:     d.Nanoseconds() / int64(n),
+				BytesPerOp:  int64(ms.TotalAlloc-bytes) / int64(n),
+				AllocsPerOp: int64(ms.Mallocs-mallocs) / int64(n),
+			}, nil
+		}
+		n = nextBenchN(n, d)
+	}
+}
+
+// nextBenchN predicts iterations to run for benchTime after n iterations took d, with 20% more, and grows at least
+// by 1 and at most by 100 times, like `go test -bench`.
+func nextBenchN(n int, d time.Duration) int {
+	if d <= 0 {
+		d = 1
+	}
+	next := int64(float64(n) * float64(benchTime) / float64(d) * 1.2)
+	if max := int64(n) * 100; next > max {
+		next = max
+	}
+	if next <= int64(n) {
+		next = int64(n) + 1
+	}
+	if next > benchMaxN {
+		next = benchMaxN
+	}
+	return int(next)
+}
+
+// benchRouteList returns a route list of benchCIDRs random IPv4 prefixes from /12 to /24, and IPs half in it.
+func benchRouteList(rnd *rand.Rand) (cidranger.Ranger, []net.IP) {
+	ranger := cidranger.NewPCTrieRanger()
+	networks := make([]*net.IPNet, 0, benchCIDRs)
+	for len(networks) < benchCIDRs {
+		ip := make(net.IP, net.IPv4len)
+		rnd.Read(ip)
+		mask := net.CIDRMask(12+rnd.Intn(13), 32)
+		network := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		if err := ranger.Insert(cidranger.NewBasicRangerEntry(*network)); err == nil {
+			networks = append(networks, network)
+		}
+	}
+	ips := make([]net.IP, benchKeys)
+	for i := range ips {
+		ip := make(net.IP, net.IPv4len)
+		rnd.Read(ip)
+		if i%2 == 0 {
+			network := networks[rnd.Intn(len(networks))]
+			for j := range ip {
+				ip[j] = network.IP[j] | ip[j]&^network.Mask[j]
+			}
+		}
+		ips[i] = ip
+	}
+	return ranger, ips
+}
+
+// benchName returns a random name of labels of up to 10 letters under tld.
+func benchName(rnd *rand.Rand, labels int, tld string) string {
+	name := tld
+	for i := 0; i < labels; i++ {
+		label := make([]byte, 1+rnd.Intn(10))
+		for j := range label {
+			label[j] = 'a' + byte(rnd.Intn(26))
+		}
+		name = string(label) + "." + name
+	}
+	return name
+}
+
+func benchCIDRMatch() (func(int) error, error) {
+	rnd := rand.New(rand.NewSource(benchSeed))
+	ranger, ips := benchRouteList(rnd)
+	set := newCIDRSet(ranger)
+	return func(i int) error {
+		set.Has(ips[i%len(ips)])
+		return nil
+	}, nil
+}
+
+func benchDomainMatch() (func(int) error, error) {
+	rnd := rand.New(rand.NewSource(benchSeed))
+	l := new(domainList)
+	domains := make([]string, benchDomains)
+	for i := range domains {
+		domains[i] = benchName(rnd, 1+rnd.Intn(2), "com")
+		entry := domains[i]
+		if i%100 == 0 {
+			entry = "*." + entry
+		}
+		if err := l.add(entry); err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, benchKeys)
+	for i := range names {
+		if i%2 == 0 {
+			names[i] = benchName(rnd, 1, domains[rnd.Intn(len(domains))]) + "."
+		} else {
+			names[i] = benchName(rnd, 3, "net.")
+		}
+	}
+	return func(i int) error {
+		l.Contain(names[i%len(names)])
+		return nil
+	}, nil
+}
+
+// benchCache returns a cache full of replies of questions.
+func benchCache(rnd *rand.Rand) (*MemoryCache, []dns.Question) {
+	c := NewMemoryCache(benchKeys, 0)
+	questions := make([]dns.Question, benchKeys)
+	for i := range questions {
+		m := new(dns.Msg)
+		m.SetQuestion(benchName(rnd, 2, "com."), dns.TypeA)
+		m.Response = true
+		m.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: m.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 600},
+			A:   net.IPv4(1, 0, byte(i>>8), byte(i)),
+		}}
+		questions[i] = m.Question[0]
+		c.Set(&questions[i], m, 10*time.Minute, 0)
+	}
+	return c, questions
+}
+
+func benchCacheGet() (func(int) error, error) {
+	c, questions := benchCache(rand.New(rand.NewSource(benchSeed)))
+	return func(i int) error {
+		if m, _ := c.Get(&questions[i%len(questions)]); m == nil {
+			return errors.New("cached reply is missing")
+		}
+		return nil
+	}, nil
+}
+
+func benchCacheSet() (func(int) error, error) {
+	rnd := rand.New(rand.NewSource(benchSeed))
+	c, _ := benchCache(rnd)
+	_, questions := benchCache(rnd) // other questions, each evicting the oldest entry
+	replies := make([]*dns.Msg, len(questions))
+	for i := range questions {
+		replies[i] = new(dns.Msg)
+		replies[i].SetQuestion(questions[i].Name, questions[i].Qtype)
+		replies[i].Response = true
+	}
+	return func(i int) error {
+		j := i % len(questions)
+		c.Set(&questions[j], replies[j], 10*time.Minute, 0)
+		return nil
+	}, nil
+}
+
+// benchServer returns a server of fake upstreams answering instantly: the untrusted one with IPs in its China route
+// list, and the trusted one overseas, so that queries are served by races in both groups.
+func benchServer(rnd *rand.Rand) (*Server, error) {
+	ranger, ips := benchRouteList(rnd)
+	var china, overseas []net.IP
+	set := newCIDRSet(ranger)
+	for _, ip := range ips {
+		if set.Has(ip) {
+			china = append(china, ip)
+		} else {
+			overseas = append(overseas, ip)
+		}
+	}
+	upstream := func(ips []net.IP) Upstream {
+		return UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+			m := new(dns.Msg)
+			m.SetReply(req)
+			m.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 600},
+				A:   ips[int(req.Id)%len(ips)],
+			}}
+			return m, time.Millisecond, nil
+		})
+	}
+	return NewServer(NewClient(WithTimeout(time.Second)),
+		WithSkipRefineResolvers(true),
+		WithUpstreams(false, NewUpstreamResolver("bench-untrusted", upstream(china))),
+		WithUpstreams(true, NewUpstreamResolver("bench-trusted", upstream(overseas))),
+		func(o *serverOptions) error {
+			o.ChinaCIDR = ranger
+			return nil
+		},
+	)
+}
+
+func benchServe() (func(int) error, error) {
+	rnd := rand.New(rand.NewSource(benchSeed))
+	s, err := benchServer(rnd)
+	if err != nil {
+		return nil, err
+	}
+	reqs := make([]*dns.Msg, benchKeys)
+	for i := range reqs {
+		reqs[i] = new(dns.Msg).SetQuestion(benchName(rnd, 2, "com."), dns.TypeA)
+	}
+	w := &benchResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 20), Port: 5353}}
+	return func(i int) error {
+		w.msg = nil
+		s.Serve(w, reqs[i%len(reqs)])
+		if w.msg == nil || len(w.msg.Answer) == 0 {
+			return fmt.Errorf("unexpected reply: %v", w.msg)
+		}
+		return nil
+	}, nil
+}
+
+// benchResponseWriter records the reply to a query of a benchmark over UDP.
+type benchResponseWriter struct {
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *benchResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv6loopback, Port: 53}
+}
+func (w *benchResponseWriter) RemoteAddr() net.Addr        { return w.remote }
+func (w *benchResponseWriter) WriteMsg(m *dns.Msg) error   { w.msg = m; return nil }
+func (w *benchResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *benchResponseWriter) Close() error                { return nil }
+func (w *benchResponseWriter) TsigStatus() error           { return nil }
+func (w *benchResponseWriter) TsigTimersOnly(bool)         {}
+func (w *benchResponseWriter) Hijack()                     {}
@@ -0,0 +1,108 @@
+package gochinadns
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// benchmark runs the operation of a SelfBenchmark set up by setup for b.
+func benchmark(b *testing.B, setup func() (func(int) error, error)) {
+	op, err := setup()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err = op(i); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCIDRMatch(b *testing.B)   { benchmark(b, benchCIDRMatch) }
+func BenchmarkDomainMatch(b *testing.B) { benchmark(b, benchDomainMatch) }
+func BenchmarkCacheGet(b *testing.B)    { benchmark(b, benchCacheGet) }
+func BenchmarkCacheSet(b *testing.B)    { benchmark(b, benchCacheSet) }
+func BenchmarkServe(b *testing.B)       { benchmark(b, benchServe) }
+
+func TestBenchServer(t *testing.T) {
+	s, err := benchServer(rand.New(rand.NewSource(benchSeed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newFakeResponseWriter("192.168.1.20")
+	s.Serve(w, new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA))
+	// Either group may win the race, as both answer acceptably at once.
+	if w.msg == nil || len(w.msg.Answer) != 1 || w.msg.Answer[0].Header().Name != "www.example.com." {
+		t.Fatalf("Unexpected reply %v", w.msg)
+	}
+
+	seen := make(map[string]bool)
+	for _, bm := range SelfBenchmarks() {
+		if seen[bm.Name] || bm.Setup == nil {
+			t.Errorf("Invalid benchmark %s", bm.Name)
+		}
+		seen[bm.Name] = true
+	}
+}
+
+func TestRunSelfBenchmark(t *testing.T) {
+	var ops int
+	r, err := RunSelfBenchmark(SelfBenchmark{"noop", func() (func(int) error, error) {
+		return func(i int) error {
+			ops++
+			return nil
+		}, nil
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Name != "noop" || r.N <= 1 || r.NsPerOp >= int64(benchTime) || r.AllocsPerOp != 0 || ops < r.N {
+		t.Errorf("Unexpected result %+v of %d ops", r, ops)
+	}
+
+	fail := errors.New("fail")
+	if _, err = RunSelfBenchmark(SelfBenchmark{"fail", func() (func(int) error, error) {
+		return func(i int) error { return fail }, nil
+	}}); err != fail {
+		t.Errorf("Failing benchmark should fail, got %v", err)
+	}
+	for _, tc := range []struct {
+		n    int
+		d    time.Duration
+		want int
+	}{
+		{1, 0, 100},
+		{100, 10 * time.Millisecond, 10000},
+		{100, 100 * time.Millisecond, 1200},
+		{100, 2 * time.Second, 101},
+		{1e8, time.Millisecond, benchMaxN},
+	} {
+		if got := nextBenchN(tc.n, tc.d); got != tc.want {
+			t.Errorf("nextBenchN(%d, %s) = %d, want %d", tc.n, tc.d, got, tc.want)
+		}
+	}
+}
+
+func TestBenchRouteList(t *testing.T) {
+	ranger, ips := benchRouteList(rand.New(rand.NewSource(benchSeed)))
+	in := 0
+	for _, ip := range ips {
+		if ok, _ := ranger.Contains(ip); ok {
+			in++
+		}
+	}
+	// Half of IPs are picked in the list, and a few others may happen to be.
+	if in < len(ips)/2 || in > len(ips)*3/4 {
+		t.Errorf("Unexpected IPs in the list: %d/%d", in, len(ips))
+	}
+	if _, err := ranger.Contains(net.IPv4(1, 2, 3, 4)); err != nil {
+		t.Error(err)
+	}
+}
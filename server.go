@@ -2,24 +2,90 @@ package gochinadns
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/cherrot/gochinadns/hosts"
 	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
+	"github.com/yl2chen/cidranger"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 )
 
 // Server represents a DNS Server instance
 type Server struct {
 	*serverOptions
 	*Client
-	UDPServer *dns.Server
-	TCPServer *dns.Server
+	UDPServer   *dns.Server
+	TCPServer   *dns.Server
+	AdminServer *http.Server // nil if the admin API is disabled
+	DebugServer *http.Server // nil if the debug listener is disabled
+	StatsServer *http.Server // nil if the stats listener is disabled
+	DoTServer   *dns.Server  // nil if DNS over TLS is disabled, or the server is not running
+	DoHServer   *http.Server // nil if DNS over HTTPS is disabled, or the server is not running
+
+	// ExtraServers serve DNS sockets besides those of UDPServer and TCPServer, e.g. of WithListenAddrs.
+	// Nil if there are none, or the server is not running.
+	ExtraServers []*dns.Server
+
+	inflight   *inflightTable
+	provenance *provenanceLog
+	shuffler   *shuffler
+	speeds     *speedTable // speed reports of prefixes by external tools, see ReportSpeed
+	cache      Cache       // nil if cache is disabled
+	hooks      hooks
+	goroutines *goroutineTracker
+	flights    singleflight.Group // resolutions of queries in flight, shared by identical queries
+	flightMu   sync.Mutex
+	flightCtxs map[string]*flightContext // contexts of resolutions in flights, by key
+
+	upstreams *upstreamTable
+	canary    *canaryState
+	proxyCli  *Client          // client querying trusted servers through TrustedProxy, nil if no proxy
+	dnssec    *dnssecValidator // nil if DNSSEC validation is disabled
+	limiter   *rateLimiter     // limiter of UDP queries per client, nil if disabled
+	queryLog  *queryLog        // nil if the query log is disabled
+	mirror    *mirror          // nil if mirroring is disabled
+	tunnels   *tunnelDetector  // detector of clients tunneling through DNS, nil if disabled
+	stats     *statsTable      // rolling counters of queries, nil if disabled
+	started   time.Time
+
+	selectCounters [2]uint32       // round-robin counters of trusted and untrusted servers, see SelectRoundRobin
+	listeners      listeners       // listening sockets of Run, to hand over on Upgrade
+	tenantStats    *tenantStats    // counters of tenants, see WithTenants
+	audit          *auditLog       // results of recent audits, nil if audits are disabled
+	pins           *pinTable       // upstreams pinned by clients, nil if pinning is disabled
+	budgets        *budgetTable    // query budgets of upstreams
+	verdicts       *verdictCache   // groups of domains by their verdicts, nil if disabled
+	degraded       *degradedTable  // untrusted upstreams slower than trusted ones, nil if disabled
+	verifier       *verifier       // verifier of China answers, nil if disabled
+	certificate    certificate     // certificate of DoT and DoH servers
+	allowedClients *cidrSet        // networks of clients allowed to query, nil if all clients are
+	anomalyLimiter *rateLimiter    // limiter of clients querying anomalous names, nil if disabled
+	admission      *admission      // bounds queries being served, nil if unlimited
+	udpKernelBase  udpKernelErrors // UDP buffer errors of the host when the server is created
+	memGuard       memoryGuard     // state of checkMemory
+
+	chinaRemote cidranger.Ranger // China route list downloaded from ChinaListURL, guarded by listsMu
+	matchers    atomic.Value     // of *cidrMatchers compiled from CIDR lists, replaced when lists change
+	foreignIPs  chan net.IP      // foreign IPs to add to ForeignSets4 and ForeignSets6, nil if no set
+
+	// lifetime is done once the server shuts down, giving up work beyond the deadlines of queries, like retries.
+	lifetime    context.Context
+	endLifetime context.CancelFunc
+
+	opts        []ServerOption // to reload lists
+	applyMu     sync.Mutex     // serializes Reload and ApplyConfig
+	listsMu     sync.RWMutex   // guards lists loaded from files, which are replaced on reload
+	resolversMu sync.RWMutex   // guards TrustedServers and UntrustedServers, which may be changed at runtime
 }
 
 // NewServer creates a new server instance
@@ -30,16 +96,113 @@ func NewServer(cli *Client, opts ...ServerOption) (s *Server, err error) {
 			return
 		}
 	}
+	if err = o.checkListErrors(); err != nil {
+		return
+	}
+	listErrorsGauge.Set(int64(o.ListErrors.Len()))
 
 	s = &Server{
 		serverOptions: o,
+		opts:          opts,
 		Client:        cli,
 		UDPServer:     &dns.Server{Addr: o.Listen, Net: "udp", ReusePort: o.ReusePort},
 		TCPServer:     &dns.Server{Addr: o.Listen, Net: "tcp", ReusePort: o.ReusePort},
+		inflight:      newInflightTable(),
+		goroutines:    newGoroutineTracker(),
+		upstreams:     newUpstreamTable(),
+		canary:        newCanaryState(),
+		provenance:    newProvenanceLog(provenanceLogSize),
+		started:       time.Now(),
+	}
+	s.udpKernelBase, _ = readUDPKernelErrors()
+	s.lifetime, s.endLifetime = context.WithCancel(context.Background())
+	s.tenantStats = newTenantStats()
+	if o.AuditInterval > 0 {
+		s.audit = new(auditLog)
+	}
+	if o.PinUpstreams {
+		s.pins = newPinTable()
+	}
+	s.verdicts = newVerdictCache(o.VerdictTTL, o.Clock, o.VerdictStore)
+	s.degraded = newDegradedTable(o.DegradeAfter)
+	s.allowedClients = newClientACL(o.AllowedClients)
+	if s.verifier = newVerifier(o.VerifyStrikes, o.Clock.Now); s.verifier != nil {
+		s.OnAnswerSelected(s.queueChinaVerification)
+	}
+	// Budgets may be configured later by ApplyConfig.
+	s.budgets = newBudgetTable(o.Budgets)
+	s.budgets.now = o.Clock.Now
+	s.provenance.now = o.Clock.Now
+	s.OnUpstreamReply(s.upstreams.Record)
+	// Tenants may be configured later by ApplyConfig, and clients of no tenant are not counted.
+	s.OnAnswerSelected(s.countTenantAnswer)
+	s.OnBlocked(s.countTenantBlocked)
+	if s.stats = newStatsTable(o.StatsPeriod, o.Clock.Now); s.stats != nil {
+		s.OnAnswerSelected(s.countStatsAnswer)
+		s.OnBlocked(s.countStatsBlocked)
+	}
+	if len(o.ForeignSets4) > 0 || len(o.ForeignSets6) > 0 {
+		s.foreignIPs = make(chan net.IP, foreignIPQueueSize)
+		s.OnAnswerSelected(s.collectForeignIPs)
+	}
+	s.limiter = newRateLimiter(o)
+	s.admission = newAdmission(o)
+	s.anomalyLimiter = newAnomalyLimiter(o)
+	s.tunnels = newTunnelDetector(o)
+	s.UDPServer.Handler = s.listenerHandler("udp", o.Listen)
+	s.TCPServer.Handler = s.listenerHandler("tcp", o.Listen)
+	if s.shuffler, err = newShuffler(o.Shuffle); err != nil {
+		s = nil
+		return
+	}
+	s.speeds = newSpeedTable()
+	s.shuffler.speeds = s.speeds
+	if o.Cache != nil {
+		s.cache = o.Cache
+	} else if o.CacheEntries > 0 {
+		c := NewMemoryCache(o.CacheEntries, o.CacheMaxBytes)
+		c.now = o.Clock.Now
+		s.cache = c
+	}
+	s.loadCacheFile()
+	s.loadBudgetFile()
+	if o.DNSSEC {
+		s.dnssec = newDNSSECValidator(s.lookupDNSSEC, rootAnchors...)
+	}
+	if o.TrustedProxy != "" {
+		if s.proxyCli, err = newProxyClient(cli, o.TrustedProxy); err != nil {
+			s = nil
+			return
+		}
+	}
+	if s.queryLog = newQueryLog(o); s.queryLog != nil {
+		s.queryLog.tenantOf = s.tenantOf
+		s.OnAnswerSelected(s.queryLog.logAnswer)
+		s.OnBlocked(s.queryLog.logBlocked)
+	}
+	if s.mirror = newMirror(o); s.mirror != nil {
+		s.OnAnswerSelected(s.mirror.mirrorAnswer)
+	}
+	if (o.DoTListen != "" || o.DoHListen != "") && o.TLSCertificate == nil {
+		return nil, errNoCertificate
+	}
+	s.certificate.set(o.TLSCertificate)
+	if o.AdminListen != "" {
+		s.AdminServer = &http.Server{Addr: o.AdminListen, Handler: s.AdminHandler()}
 	}
-	s.UDPServer.Handler = dns.HandlerFunc(s.Serve)
-	s.TCPServer.Handler = dns.HandlerFunc(s.Serve)
+	if o.DebugListen != "" {
+		s.DebugServer = &http.Server{Addr: o.DebugListen, Handler: s.DebugHandler()}
+	}
+	if o.StatsListen != "" {
+		s.StatsServer = &http.Server{Addr: o.StatsListen, Handler: s.StatsHandler()}
+	}
+	registerRecentErrors()
 
+	if o.ChinaListURL != "" {
+		if e := s.fetchChinaList(context.Background()); e != nil {
+			logrus.WithError(e).Error("Fail to download China route list. Will retry on refresh.")
+		}
+	}
 	if err = s.partitionResolvers(); err != nil {
 		s = nil
 		return
@@ -50,52 +213,254 @@ func NewServer(cli *Client, opts ...ServerOption) (s *Server, err error) {
 	return
 }
 
-// Run start the default DNS server.
-func (s *Server) Run() error {
+// shutdownTimeout limits waiting for queries being served when Run is canceled.
+const shutdownTimeout = 4 * time.Second
+
+// errListenerClosed is returned by a listener closed without error, to stop other listeners of Run.
+var errListenerClosed = errors.New("listener closed")
+
+// Run starts the DNS server, and blocks until ctx is done, Shutdown is called or a listener fails.
+// When ctx is done, listeners stop accepting new queries, and queries being served are drained for up to
+// shutdownTimeout before Run returns. Background tasks such as probes stop along.
+func (s *Server) Run(ctx context.Context) error {
 	logrus.Info("Start server at ", s.Listen)
-	eg, _ := errgroup.WithContext(context.Background())
-	eg.Go(s.UDPServer.ListenAndServe)
-	eg.Go(s.TCPServer.ListenAndServe)
+	socks, err := s.listen()
+	if err != nil {
+		return err
+	}
+	s.UDPServer.PacketConn = socks.udp[0]
+	s.limitTCPServer(s.TCPServer, socks.tcp[0])
+	s.ExtraServers = nil
+	for _, conn := range socks.udp[1:] {
+		logrus.Infof("Start server at %s (udp)", conn.LocalAddr())
+		srv := &dns.Server{Net: "udp", PacketConn: conn}
+		srv.Handler = s.listenerHandler("udp", conn.LocalAddr().String())
+		s.ExtraServers = append(s.ExtraServers, srv)
+	}
+	for _, ln := range socks.tcp[1:] {
+		logrus.Infof("Start server at %s (tcp)", ln.Addr())
+		srv := &dns.Server{Net: "tcp"}
+		s.limitTCPServer(srv, ln)
+		srv.Handler = s.listenerHandler("tcp", ln.Addr().String())
+		s.ExtraServers = append(s.ExtraServers, srv)
+	}
+	if socks.admin != nil && s.AdminServer == nil {
+		// The admin API is enabled by socket activation only.
+		s.AdminServer = &http.Server{Handler: s.AdminHandler()}
+	}
+	if socks.debug != nil && s.DebugServer == nil {
+		s.DebugServer = &http.Server{Handler: s.DebugHandler()}
+	}
+	if socks.stats != nil && s.StatsServer == nil {
+		s.StatsServer = &http.Server{Handler: s.StatsHandler()}
+	}
+	if socks.dot != nil {
+		if s.DoTServer, err = s.newDoTServer(socks.dot); err != nil {
+			socks.close()
+			return err
+		}
+	}
+	if socks.doh != nil {
+		if s.DoHServer, err = s.newDoHServer(socks.doh); err != nil {
+			socks.close()
+			return err
+		}
+	}
+	s.listeners.set(socks)
+	defer s.listeners.set(sockets{})
+	if ready := readyNotifier(); ready != nil {
+		s.notifyReadyOnStart(ready)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go s.goroutines.Watch(ctx, s.GoroutineMaxAge)
+	go s.runProbes(ctx)
+	go s.runHealthChecks(ctx)
+	go s.runCanaries(ctx)
+	go s.runAudits(ctx)
+	go s.runChinaListRefresh(ctx)
+	go s.runForeignSets(ctx)
+	go s.runStatsLocations(ctx)
+	go s.runVerifications(ctx)
+	go s.runGuard(ctx)
+	go s.runUbus(ctx)
+	if s.queryLog != nil {
+		go s.queryLog.run(ctx)
+	}
+	if s.mirror != nil {
+		go s.mirror.run(ctx)
+	}
+
+	eg, egCtx := errgroup.WithContext(ctx)
+	listen := func(f func() error) {
+		eg.Go(func() error {
+			if err := f(); err != nil && err != http.ErrServerClosed {
+				return err
+			}
+			return errListenerClosed
+		})
+	}
+	listen(s.UDPServer.ActivateAndServe)
+	listen(s.TCPServer.ActivateAndServe)
+	for _, srv := range s.ExtraServers {
+		listen(srv.ActivateAndServe)
+	}
+	if socks.admin != nil {
+		logrus.Info("Start admin API at ", socks.admin.Addr())
+		listen(func() error { return s.AdminServer.Serve(socks.admin) })
+	}
+	if socks.debug != nil {
+		logrus.Warnf("Start debug listener at %s. It exposes profiles and internal state without authentication.", socks.debug.Addr())
+		listen(func() error { return s.DebugServer.Serve(socks.debug) })
+	}
+	if socks.stats != nil {
+		logrus.Info("Start stats listener at ", socks.stats.Addr())
+		listen(func() error { return s.StatsServer.Serve(socks.stats) })
+	}
+	if s.DoTServer != nil {
+		logrus.Info("Start DNS over TLS at ", socks.dot.Addr())
+		listen(s.DoTServer.ActivateAndServe)
+	}
+	if s.DoHServer != nil {
+		logrus.Info("Start DNS over HTTPS at ", socks.doh.Addr())
+		listen(func() error { return s.DoHServer.ServeTLS(socks.doh, "", "") })
+	}
+	eg.Go(func() error {
+		<-egCtx.Done()
+		if ctx.Err() != nil {
+			logrus.Info("Shutting down server. Drain queries being served.")
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			logrus.WithError(err).Debug("Fail to shut down listeners gracefully.")
+		}
+		return nil
+	})
+	err = eg.Wait()
+	// Queries being served are drained by now.
+	s.saveCacheFile()
+	s.saveBudgetFile()
+	if err != errListenerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops listeners gracefully, waiting for queries being served until ctx is done, so that Run returns.
+// Retries of queries being served are given up right away.
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.endLifetime != nil {
+		s.endLifetime()
+	}
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.Go(func() error { return s.UDPServer.ShutdownContext(ctx) })
+	eg.Go(func() error { return s.TCPServer.ShutdownContext(ctx) })
+	for _, srv := range s.ExtraServers {
+		srv := srv
+		eg.Go(func() error { return srv.ShutdownContext(ctx) })
+	}
+	if s.AdminServer != nil {
+		eg.Go(func() error { return s.AdminServer.Shutdown(ctx) })
+	}
+	if s.DebugServer != nil {
+		eg.Go(func() error { return s.DebugServer.Shutdown(ctx) })
+	}
+	if s.StatsServer != nil {
+		eg.Go(func() error { return s.StatsServer.Shutdown(ctx) })
+	}
+	if s.DoTServer != nil {
+		eg.Go(func() error { return s.DoTServer.ShutdownContext(ctx) })
+	}
+	if s.DoHServer != nil {
+		eg.Go(func() error { return s.DoHServer.Shutdown(ctx) })
+	}
 	return eg.Wait()
 }
 
 // partitionResolvers partitions resolvers into untrusted and trusted separately
-// If a DoH server is not in an IP format, and it's hostname is not in system's hosts file (e.g. /etc/hosts),
-// I will treat it a trusted server by default.
 func (s *Server) partitionResolvers() error {
 	for _, resolver := range s.Servers {
-		var (
-			ip net.IP
-			err error
-		)
-		if len(resolver.GetProtocols()) == 1 && resolver.GetProtocols()[0] == "doh" {
-			if ip, err = s.resolveDoHAddr(resolver.GetAddr()); err != nil {
-				return err
-			}
-			if ip == nil {
-				logrus.Warnf("I can't find IP for [%s] in system's hosts file, trust it by default.", resolver.GetAddr())
-				s.TrustedServers = uniqueAppendResolver(s.TrustedServers, resolver)
-				continue
-			}
+		trusted, err := s.isTrustedResolver(resolver)
+		if err != nil {
+			return err
+		}
+		if trusted {
+			s.TrustedServers = uniqueAppendResolver(s.TrustedServers, resolver)
 		} else {
-			host, _, err := net.SplitHostPort(resolver.GetAddr())
-			if err != nil {
-				return err
-			}
-			ip = net.ParseIP(host)
+			s.UntrustedServers = uniqueAppendResolver(s.UntrustedServers, resolver)
 		}
+	}
+	for _, r := range s.TrustedServers {
+		r.applyDefaults(s.groupSettings(true))
+	}
+	for _, r := range s.UntrustedServers {
+		r.applyDefaults(s.groupSettings(false))
+	}
+	return nil
+}
 
-		contain, err := s.ChinaCIDR.Contains(ip)
+// isTrustedResolver checks whether resolver is located outside China.
+// If a DoH server is not in an IP format, and it's hostname is not in system's hosts file (e.g. /etc/hosts),
+// I will treat it a trusted server by default. Custom upstreams are untrusted, which can't be located.
+func (s *Server) isTrustedResolver(resolver *Resolver) (bool, error) {
+	var (
+		ip  net.IP
+		err error
+	)
+	if resolver.upstream != nil {
+		return false, nil
+	}
+	if len(resolver.GetProtocols()) == 1 && resolver.GetProtocols()[0] == "doh" {
+		if ip, err = s.resolveDoHAddr(resolver.GetAddr()); err != nil {
+			return false, err
+		}
+		if ip == nil {
+			logrus.Warnf("I can't find IP for [%s] in system's hosts file, trust it by default.", resolver.GetAddr())
+			return true, nil
+		}
+	} else {
+		host, _, err := net.SplitHostPort(resolver.GetAddr())
 		if err != nil {
-			return fmt.Errorf("fail to check if %s is in China: %v", resolver.GetAddr(), err.Error())
+			return false, err
 		}
-		if contain {
-			s.UntrustedServers = uniqueAppendResolver(s.UntrustedServers, resolver)
+		ip = net.ParseIP(host)
+	}
+
+	contain, err := s.isChinaIP(context.Background(), ip)
+	if err != nil {
+		return false, fmt.Errorf("fail to check if %s is in China: %v", resolver.GetAddr(), err.Error())
+	}
+	return !contain, nil
+}
+
+// isChinaIP checks whether ip belongs to China, i.e. it's in China route lists (or the China backend) and not excluded.
+// IPv6 addresses are checked in the separate IPv6 China route list if it's loaded,
+// except ones embedding IPv4 addresses (see embeddedIPv4), which are checked by the embedded IPv4 addresses.
+func (s *Server) isChinaIP(ctx context.Context, ip net.IP) (bool, error) {
+	ip = normalizeIP(ip)
+	m := s.loadMatchers()
+	var (
+		contain bool
+		err     error
+	)
+	switch {
+	case ip.To4() == nil && m.china6 != nil:
+		contain = m.china6.Has(ip)
+	case m.backend != nil:
+		if geo, ok := m.backend.(*geoMatcher); ok {
+			contain, err = geo.containsContext(ctx, ip)
 		} else {
-			s.TrustedServers = uniqueAppendResolver(s.TrustedServers, resolver)
+			contain, err = m.backend.Contains(ip)
 		}
+	default:
+		contain = m.china.Has(ip) || m.remote.Has(ip)
 	}
-	return nil
+	if err != nil || !contain {
+		return contain, err
+	}
+	return !m.exclude.Has(ip), nil
 }
 
 func (s *Server) refineResolvers() {
@@ -109,7 +474,7 @@ func (s *Server) refineResolvers() {
 	go s.UDPServer.ListenAndServe() //nolint:errcheck
 	go s.TCPServer.ListenAndServe() //nolint:errcheck
 
-	refine := func(resolvers resolverList) (availLen int) {
+	refine := func(resolvers resolverList, lookup LookupFunc) (availLen int) {
 		const _loop = 3
 		availLen = len(resolvers)
 		var (
@@ -121,7 +486,7 @@ func (s *Server) refineResolvers() {
 			for j := 0; j < _loop; j++ {
 				for _, name := range s.TestDomains {
 					req.SetQuestion(dns.Fqdn(name), dns.TypeA)
-					_, rtt, err := s.Lookup(req, rs)
+					_, rtt, err := lookup(context.Background(), req, rs)
 					if err != nil {
 						tests[i].errCnt++
 						continue
@@ -154,7 +519,7 @@ func (s *Server) refineResolvers() {
 	un := make(resolverList, len(s.UntrustedServers))
 	copy(t, s.TrustedServers)
 	copy(un, s.UntrustedServers)
-	availTrusted, availUntrusted := refine(t), refine(un)
+	availTrusted, availUntrusted := refine(t, s.trustedClient().LookupContext), refine(un, s.LookupContext)
 
 	_ = s.UDPServer.Shutdown()
 	_ = s.TCPServer.Shutdown()
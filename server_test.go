@@ -0,0 +1,122 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func writeTestList(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestIsChinaIP(t *testing.T) {
+	o := newServerOptions()
+	for _, opt := range []ServerOption{
+		WithCHNList(writeTestList(t, "china.list", "1.0.1.0/24\n240e::/20\n")),
+		WithCHNList(writeTestList(t, "hk.list", "43.224.0.0/16\n")),
+		WithCHNListExclude(writeTestList(t, "corp.list", "1.0.1.128/25\n")),
+	} {
+		if err := opt(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{serverOptions: o}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"1.0.1.1", true},
+		{"43.224.1.1", true},
+		{"1.0.1.129", false},
+		{"8.8.8.8", false},
+		{"240e::1", true},
+	}
+	for _, tt := range tests {
+		got, err := s.isChinaIP(context.Background(), net.ParseIP(tt.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("isChinaIP(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestClassifyIP(t *testing.T) {
+	china := writeTestList(t, "china.list", "1.0.1.0/24\n1.0.2.0/23\n")
+	o := newServerOptions()
+	if err := WithCHNList(china)(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o}
+
+	c, err := s.ClassifyIP(net.ParseIP("1.0.3.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.China || c.Blacklisted {
+		t.Errorf("Unexpected classification %+v", c)
+	}
+	want := CIDRMatch{Network: "1.0.2.0/23", Source: china, Line: 2}
+	if got := c.Matches[ListChina]; len(got) != 1 || got[0] != want {
+		t.Errorf("Matches = %+v, want %+v", got, want)
+	}
+}
+
+func TestRunDrainsQueries(t *testing.T) {
+	s, err := NewServer(NewClient(), WithListenAddr("127.0.0.1:0"), WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{}, 2)
+	s.UDPServer.NotifyStartedFunc = func() { started <- struct{}{} }
+	s.TCPServer.NotifyStartedFunc = func() { started <- struct{}{} }
+	serving := make(chan struct{})
+	s.UDPServer.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		close(serving)
+		time.Sleep(200 * time.Millisecond)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		_ = w.WriteMsg(m)
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Run(ctx) }()
+	<-started
+	<-started
+
+	replied := make(chan error, 1)
+	go func() {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		_, _, err := new(dns.Client).Exchange(req, s.UDPServer.PacketConn.LocalAddr().String())
+		replied <- err
+	}()
+	<-serving
+	cancel()
+
+	if err := <-replied; err != nil {
+		t.Errorf("Query being served should be replied on shutdown: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run should return nil when canceled, got %v", err)
+		}
+	case <-time.After(shutdownTimeout):
+		t.Error("Run should return when canceled")
+	}
+}
@@ -0,0 +1,85 @@
+package gochinadns
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Modes to reorder address records in answers.
+const (
+	ShuffleNone       = ""
+	ShuffleRandom     = "random"
+	ShuffleRoundRobin = "round-robin"
+	ShuffleSpeed      = "speed" // ordered by speed reports, see Server.ReportSpeed
+
+	maxRoundRobinNames = 10000
+)
+
+// shuffler reorders A/AAAA records in answers, spreading client load across endpoints.
+// Other records (such as CNAMEs) keep their positions.
+type shuffler struct {
+	mode   string
+	speeds *speedTable // speed reports to rank records by in ShuffleSpeed mode
+
+	mu       sync.Mutex
+	counters map[string]int // round-robin offsets per question
+}
+
+func newShuffler(mode string) (*shuffler, error) {
+	switch mode {
+	case ShuffleNone, ShuffleRandom, ShuffleRoundRobin, ShuffleSpeed:
+	default:
+		return nil, fmt.Errorf("unknown shuffle mode [%s]", mode)
+	}
+	return &shuffler{mode: mode, counters: make(map[string]int)}, nil
+}
+
+func (sh *shuffler) Shuffle(m *dns.Msg) {
+	if sh == nil || sh.mode == ShuffleNone {
+		return
+	}
+	var positions []int
+	for i, rr := range m.Answer {
+		switch rr.(type) {
+		case *dns.A, *dns.AAAA:
+			positions = append(positions, i)
+		}
+	}
+	n := len(positions)
+	if n < 2 {
+		return
+	}
+
+	addrs := make([]dns.RR, n)
+	for i, p := range positions {
+		addrs[i] = m.Answer[p]
+	}
+	switch sh.mode {
+	case ShuffleRandom:
+		rand.Shuffle(n, func(i, j int) { addrs[i], addrs[j] = addrs[j], addrs[i] })
+	case ShuffleRoundRobin:
+		offset := sh.next(&m.Question[0])
+		addrs = append(addrs[offset%n:], addrs[:offset%n]...)
+	case ShuffleSpeed:
+		sh.speeds.Rank(addrs)
+	}
+	for i, p := range positions {
+		m.Answer[p] = addrs[i]
+	}
+}
+
+func (sh *shuffler) next(q *dns.Question) int {
+	key := strings.ToLower(q.Name) + dns.TypeToString[q.Qtype]
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if len(sh.counters) >= maxRoundRobinNames {
+		sh.counters = make(map[string]int)
+	}
+	offset := sh.counters[key]
+	sh.counters[key] = offset + 1
+	return offset
+}
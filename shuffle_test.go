@@ -0,0 +1,87 @@
+package gochinadns
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// newShuffleReply returns a reply to an A question of name, with a CNAME followed by A records of ips.
+func newShuffleReply(name string, ips ...string) *dns.Msg {
+	m := newTestReply(name, 300, ips...)
+	cname := &dns.CNAME{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: name}
+	m.Answer = append([]dns.RR{cname}, m.Answer...)
+	return m
+}
+
+// shuffledIPs returns IPs of A records in m in order, checking the CNAME keeps its position.
+func shuffledIPs(t *testing.T, m *dns.Msg) string {
+	t.Helper()
+	if _, ok := m.Answer[0].(*dns.CNAME); !ok {
+		t.Fatalf("CNAME should keep its position, got %s", m.Answer[0])
+	}
+	ips := make([]string, 0, len(m.Answer)-1)
+	for _, rr := range m.Answer[1:] {
+		ips = append(ips, rr.(*dns.A).A.String())
+	}
+	return strings.Join(ips, ",")
+}
+
+func TestRoundRobinShuffle(t *testing.T) {
+	sh, err := newShuffler(ShuffleRoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rotated per question, regardless of case.
+	for i, name := range []string{"example.com.", "EXAMPLE.com.", "example.com.", "example.com."} {
+		m := newShuffleReply(name, "1.1.1.1", "2.2.2.2", "3.3.3.3")
+		sh.Shuffle(m)
+		want := []string{"1.1.1.1,2.2.2.2,3.3.3.3", "2.2.2.2,3.3.3.3,1.1.1.1", "3.3.3.3,1.1.1.1,2.2.2.2", "1.1.1.1,2.2.2.2,3.3.3.3"}[i]
+		if got := shuffledIPs(t, m); got != want {
+			t.Errorf("Shuffle %d: got %s, want %s", i, got, want)
+		}
+	}
+	m := newShuffleReply("example.org.", "1.1.1.1", "2.2.2.2")
+	sh.Shuffle(m)
+	if got := shuffledIPs(t, m); got != "1.1.1.1,2.2.2.2" {
+		t.Errorf("Another question should be rotated on its own, got %s", got)
+	}
+
+	// Counters are reset once too many questions are counted.
+	for i := len(sh.counters); i < maxRoundRobinNames; i++ {
+		sh.counters[strconv.Itoa(i)+".example.net.A"] = 1
+	}
+	m = newShuffleReply("example.com.", "1.1.1.1", "2.2.2.2", "3.3.3.3")
+	sh.Shuffle(m)
+	if got := shuffledIPs(t, m); got != "1.1.1.1,2.2.2.2,3.3.3.3" || len(sh.counters) != 1 {
+		t.Errorf("Counters should be reset, got %s and %d counters", got, len(sh.counters))
+	}
+}
+
+func TestRandomShuffle(t *testing.T) {
+	sh, err := newShuffler(ShuffleRandom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	orders := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		m := newShuffleReply("example.com.", "1.1.1.1", "2.2.2.2", "3.3.3.3")
+		sh.Shuffle(m)
+		got := shuffledIPs(t, m)
+		for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+			if !strings.Contains(got, ip) {
+				t.Fatalf("%s is lost in %s", ip, got)
+			}
+		}
+		orders[got] = true
+	}
+	if len(orders) < 2 {
+		t.Errorf("Records should be shuffled, got %v", orders)
+	}
+
+	if _, err = newShuffler("sorted"); err == nil {
+		t.Error("Unknown shuffle mode should fail")
+	}
+}
@@ -0,0 +1,88 @@
+package gochinadns
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/cherrot/gochinadns/sitelist"
+)
+
+// defaultGeoSiteTag is the category of geosite.dat loaded if no tags are given.
+const defaultGeoSiteTag = "gfw"
+
+// WithGFWList loads domains of sites blocked in China from a gfwlist (base64 encoded or decoded), whose queries are
+// sent to trusted servers only, like WithDomainPolluted. Exceptions (`@@` rules) of the gfwlist are honored,
+// but never override WithDomainPolluted.
+func WithGFWList(path string) ServerOption {
+	return func(o *serverOptions) error {
+		if path == "" {
+			return fmt.Errorf("%w for gfwlist", ErrEmptyPath)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return o.ListErrors.add(fmt.Errorf("fail to open gfwlist: %w", err))
+		}
+		defer file.Close()
+
+		load := startListLoad()
+		rules, exceptions, err := sitelist.ParseGFWList(file)
+		if err != nil {
+			return o.ListErrors.add(fmt.Errorf("fail to parse gfwlist: %w", err))
+		}
+		if o.PollutedSites, err = addSiteRules(o.PollutedSites, rules, exceptions, &o.ListErrors); err != nil {
+			return fmt.Errorf("fail to load gfwlist: %w", err)
+		}
+		load.done("gfwlist", path, len(rules)+len(exceptions))
+		return nil
+	}
+}
+
+// WithGeoSite loads domains of tags (categories like `gfw` and `geolocation-!cn`) from a v2ray geosite.dat,
+// whose queries are sent to trusted servers only, like WithDomainPolluted. Tags default to `gfw`.
+func WithGeoSite(path string, tags ...string) ServerOption {
+	return func(o *serverOptions) error {
+		if path == "" {
+			return fmt.Errorf("%w for geosite.dat", ErrEmptyPath)
+		}
+		if len(tags) == 0 {
+			tags = []string{defaultGeoSiteTag}
+		}
+		load := startListLoad()
+		rules, err := sitelist.LoadGeoSite(path, tags...)
+		if err != nil {
+			return o.ListErrors.add(fmt.Errorf("fail to load geosite.dat: %w", err))
+		}
+		if o.PollutedSites, err = addSiteRules(o.PollutedSites, rules, nil, &o.ListErrors); err != nil {
+			return fmt.Errorf("fail to load geosite.dat: %w", err)
+		}
+		load.done("geosite "+strings.Join(tags, ","), path, len(rules))
+		return nil
+	}
+}
+
+// addSiteRules adds rules and exceptions of site lists into list. A new list is created if list is nil.
+// Errors are collected in errs, see listErrors.
+func addSiteRules(list *domainList, rules, exceptions []sitelist.Rule, errs *listErrors) (*domainList, error) {
+	if list == nil {
+		list = new(domainList)
+	}
+	for _, rule := range rules {
+		if err := list.addRule(rule); err != nil {
+			if err := errs.add(fmt.Errorf("bad %s rule %s: %w", rule.Type, rule.Value, err)); err != nil {
+				return list, err
+			}
+		}
+	}
+	if len(exceptions) > 0 && list.except == nil {
+		list.except = new(domainList)
+	}
+	for _, rule := range exceptions {
+		if err := list.except.addRule(rule); err != nil {
+			if err := errs.add(fmt.Errorf("bad %s exception %s: %w", rule.Type, rule.Value, err)); err != nil {
+				return list, err
+			}
+		}
+	}
+	return list, nil
+}
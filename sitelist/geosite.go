@@ -0,0 +1,168 @@
+package sitelist
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrInvalidGeoSite is returned if geosite.dat is malformed.
+var ErrInvalidGeoSite = errors.New("invalid geosite.dat")
+
+// Protobuf wire types used by geosite.dat.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// LoadGeoSite loads rules of tags from geosite.dat in file path. See ParseGeoSite.
+func LoadGeoSite(path string, tags ...string) ([]Rule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseGeoSite(data, tags...)
+}
+
+// ParseGeoSite parses rules of tags (country codes of geosite.dat, such as `gfw` or `geolocation-!cn`, in any case)
+// from geosite.dat in data. It is an error if any of tags is not found. Attributes of rules are ignored.
+//
+// geosite.dat is a GeoSiteList message of v2ray in protobuf:
+//
+//	message Domain { Type type = 1; string value = 2; repeated Attribute attribute = 3; }
+//	message GeoSite { string country_code = 1; repeated Domain domain = 2; }
+//	message GeoSiteList { repeated GeoSite entry = 1; }
+func ParseGeoSite(data []byte, tags ...string) ([]Rule, error) {
+	found := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		found[strings.ToLower(tag)] = false
+	}
+
+	var rules []Rule
+	list := message{buf: data}
+	for {
+		field, entry, err := list.next()
+		if err != nil {
+			return nil, err
+		}
+		if field == 0 {
+			break
+		}
+		if field != 1 || entry == nil {
+			continue
+		}
+		tag, domains, err := parseGeoSite(entry)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := found[tag]; !ok {
+			continue
+		}
+		found[tag] = true
+		for _, d := range domains {
+			rule, err := parseDomain(d)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+	}
+	for _, tag := range tags {
+		if !found[strings.ToLower(tag)] {
+			return nil, fmt.Errorf("tag %s not found in geosite.dat", tag)
+		}
+	}
+	return rules, nil
+}
+
+// parseGeoSite returns the country code in lower case and domain messages of a GeoSite message.
+func parseGeoSite(buf []byte) (tag string, domains [][]byte, err error) {
+	m := message{buf: buf}
+	for {
+		field, value, err := m.next()
+		if err != nil || field == 0 {
+			return tag, domains, err
+		}
+		switch field {
+		case 1:
+			tag = strings.ToLower(string(value))
+		case 2:
+			domains = append(domains, value)
+		}
+	}
+}
+
+// parseDomain parses a Domain message.
+func parseDomain(buf []byte) (rule Rule, err error) {
+	m := message{buf: buf}
+	for {
+		field, value, err := m.next()
+		if err != nil {
+			return rule, err
+		}
+		switch field {
+		case 0:
+			if rule.Type < Keyword || rule.Type > Full {
+				return rule, fmt.Errorf("%w: unknown domain type %d", ErrInvalidGeoSite, rule.Type)
+			}
+			if rule.Type != Regexp {
+				rule.Value = strings.ToLower(strings.TrimSuffix(rule.Value, "."))
+			}
+			return rule, nil
+		case 1:
+			rule.Type = Type(m.varint)
+		case 2:
+			rule.Value = string(value)
+		}
+	}
+}
+
+// message iterates over fields of a protobuf message.
+type message struct {
+	buf    []byte
+	varint uint64 // value of the last varint field
+}
+
+// next returns the number and the value of the next field, where value is nil unless the field is
+// length-delimited, and the value of a varint field is kept in m.varint. Field number 0 means the end of message.
+func (m *message) next() (field uint64, value []byte, err error) {
+	if len(m.buf) == 0 {
+		return 0, nil, nil
+	}
+	key, n := binary.Uvarint(m.buf)
+	if n <= 0 || key>>3 == 0 {
+		return 0, nil, fmt.Errorf("%w: bad field key", ErrInvalidGeoSite)
+	}
+	m.buf = m.buf[n:]
+	field = key >> 3
+	switch key & 7 {
+	case wireVarint:
+		if m.varint, n = binary.Uvarint(m.buf); n <= 0 {
+			return 0, nil, fmt.Errorf("%w: bad varint of field %d", ErrInvalidGeoSite, field)
+		}
+		m.buf = m.buf[n:]
+	case wireFixed64, wireFixed32:
+		size := 8
+		if key&7 == wireFixed32 {
+			size = 4
+		}
+		if len(m.buf) < size {
+			return 0, nil, fmt.Errorf("%w: truncated field %d", ErrInvalidGeoSite, field)
+		}
+		m.buf = m.buf[size:]
+	case wireBytes:
+		size, n := binary.Uvarint(m.buf)
+		if n <= 0 || uint64(len(m.buf)-n) < size {
+			return 0, nil, fmt.Errorf("%w: truncated field %d", ErrInvalidGeoSite, field)
+		}
+		value = m.buf[n : n+int(size)]
+		m.buf = m.buf[n+int(size):]
+	default:
+		return 0, nil, fmt.Errorf("%w: unsupported wire type %d of field %d", ErrInvalidGeoSite, key&7, field)
+	}
+	return field, value, nil
+}
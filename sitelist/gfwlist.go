@@ -0,0 +1,75 @@
+package sitelist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+)
+
+// autoProxyHeader starts a decoded gfwlist.
+const autoProxyHeader = "[AutoProxy"
+
+// ParseGFWList parses a gfwlist in the AutoProxy (adblock like) format, either base64 encoded as published or
+// decoded. Rules of domains whose sites are blocked are returned, as well as exceptions (`@@` rules) of sites
+// which are not blocked though matching the rules.
+//
+// gfwlist matches URLs rather than domain names, so hosts of URL and keyword rules are taken as Domain rules, and
+// rules whose hosts can not be told, such as regular expressions of URLs or wildcards in the middle of hosts,
+// are skipped. This is how gfwlist is converted to domain lists of dnsmasq in general.
+func ParseGFWList(r io.Reader) (rules, exceptions []Rule, err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte(autoProxyHeader)) {
+		encoded := bytes.Join(bytes.Fields(data), nil)
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(encoded)))
+		n, err := base64.StdEncoding.Decode(decoded, encoded)
+		if err != nil {
+			return nil, nil, err
+		}
+		data = decoded[:n]
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		exception := strings.HasPrefix(line, "@@")
+		host, ok := gfwlistHost(strings.TrimPrefix(line, "@@"))
+		if !ok {
+			continue
+		}
+		rule := Rule{Type: Domain, Value: host}
+		if exception {
+			exceptions = append(exceptions, rule)
+		} else {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, exceptions, scanner.Err()
+}
+
+// gfwlistHost returns the host a gfwlist rule matches, or false if it can not be told.
+func gfwlistHost(rule string) (string, bool) {
+	if len(rule) > 1 && rule[0] == '/' && rule[len(rule)-1] == '/' {
+		return "", false // regular expression of URLs
+	}
+	rule = strings.TrimLeft(rule, "|")
+	for _, scheme := range []string{"http://", "https://"} {
+		rule = strings.TrimPrefix(rule, scheme)
+	}
+	if i := strings.IndexAny(rule, "/:?^"); i >= 0 {
+		rule = rule[:i]
+	}
+	host := strings.ToLower(strings.Trim(strings.TrimPrefix(rule, "*"), "."))
+	if strings.ContainsAny(host, "*%") || !strings.Contains(host, ".") || net.ParseIP(host) != nil {
+		return "", false
+	}
+	return host, true
+}
@@ -0,0 +1,34 @@
+// Package sitelist parses maintained lists of sites, gfwlist (https://github.com/gfwlist/gfwlist) and v2ray
+// geosite.dat (https://github.com/v2fly/domain-list-community), into domain rules.
+package sitelist
+
+// Type is the way a rule matches domain names.
+type Type int
+
+// Types of rules, in the same order as domain types of geosite.dat.
+const (
+	Keyword Type = iota // names containing the value
+	Regexp              // names matching the value as a regular expression
+	Domain              // the value and its subdomains
+	Full                // the value only
+)
+
+func (t Type) String() string {
+	switch t {
+	case Keyword:
+		return "keyword"
+	case Regexp:
+		return "regexp"
+	case Domain:
+		return "domain"
+	case Full:
+		return "full"
+	}
+	return "unknown"
+}
+
+// Rule matches domain names by Value in the way of Type. Values are in lower case, without the trailing dot.
+type Rule struct {
+	Type  Type
+	Value string
+}
@@ -0,0 +1,95 @@
+package gochinadns
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestWithGFWList(t *testing.T) {
+	list := `[AutoProxy 0.2.9]
+! comment
+||google.com
+|https://www.twitter.com/path
+.youtube.com
+example.org/path
+/^https?:\/\/[^\/]+blogspot\.(.*)/
+||*.google.*
+@@||cn.google.com
+`
+	encoded := base64.StdEncoding.EncodeToString([]byte(list))
+	for name, content := range map[string]string{"decoded": list, "encoded": encoded[:30] + "\n" + encoded[30:]} {
+		o := newServerOptions()
+		if err := WithGFWList(writeTestList(t, "gfwlist.txt", content))(o); err != nil {
+			t.Fatal(name, err)
+		}
+		s := &Server{serverOptions: o}
+		for domain, polluted := range map[string]bool{
+			"google.com.":        true,
+			"www.google.com.":    true,
+			"cn.google.com.":     false,
+			"www.twitter.com.":   true,
+			"youtube.com.":       true,
+			"www.example.org.":   true,
+			"blogspot.com.":      false,
+			"google.com.hk.":     false,
+			"www.baidu.com.":     false,
+			"notyoutube.com.cn.": false,
+		} {
+			if s.isDomainPolluted(domain) != polluted {
+				t.Errorf("%s: %s should be polluted: %v", name, domain, polluted)
+			}
+		}
+	}
+}
+
+// protoField encodes a length-delimited protobuf field.
+func protoField(num uint64, value []byte) []byte {
+	b := appendUvarint(nil, num<<3|2)
+	b = appendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+func geoSiteDomain(typ uint64, value string) []byte {
+	b := appendUvarint(nil, 1<<3)
+	b = appendUvarint(b, typ)
+	b = append(b, protoField(2, []byte(value))...)
+	return append(b, protoField(3, protoField(1, []byte("ads")))...) // attribute
+}
+
+func TestWithGeoSite(t *testing.T) {
+	gfw := protoField(1, []byte("GFW"))
+	gfw = append(gfw, protoField(2, geoSiteDomain(2, "google.com"))...)
+	gfw = append(gfw, protoField(2, geoSiteDomain(3, "twitter.com"))...)
+	gfw = append(gfw, protoField(2, geoSiteDomain(0, "blogspot"))...)
+	gfw = append(gfw, protoField(2, geoSiteDomain(1, `^ad[0-9]+\.example\.org$`))...)
+	cn := protoField(1, []byte("CN"))
+	cn = append(cn, protoField(2, geoSiteDomain(2, "baidu.com"))...)
+	data := append(protoField(1, gfw), protoField(1, cn)...)
+	path := writeTestList(t, "geosite.dat", string(data))
+
+	o := newServerOptions()
+	if err := WithGeoSite(path)(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o}
+	for domain, polluted := range map[string]bool{
+		"www.google.com.":      true,
+		"twitter.com.":         true,
+		"www.twitter.com.":     false,
+		"foo.blogspot.com.hk.": true,
+		"ad12.example.org.":    true,
+		"ads.example.org.":     false,
+		"baidu.com.":           false,
+	} {
+		if s.isDomainPolluted(domain) != polluted {
+			t.Errorf("%s should be polluted: %v", domain, polluted)
+		}
+	}
+
+	if err := applyListOption(WithGeoSite(path, "gfw", "private")); err == nil {
+		t.Error("Missing tags should fail")
+	}
+	if err := applyListOption(WithGeoSite(writeTestList(t, "bad.dat", string(data[:len(data)-3])))); err == nil {
+		t.Error("Truncated geosite.dat should fail")
+	}
+}
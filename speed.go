@@ -0,0 +1,205 @@
+package gochinadns
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/yl2chen/cidranger"
+)
+
+const (
+	// maxSpeedReports bounds the number of prefixes with speed reports. Reports of new prefixes are rejected beyond it
+	// until some expire.
+	maxSpeedReports = 65536
+	// defaultSpeedReportTTL is how long a speed report is used if its reporter doesn't tell.
+	defaultSpeedReportTTL = 10 * time.Minute
+)
+
+var errTooManySpeedReports = errors.New("too many speed reports")
+
+// SpeedReport is the latency and quality of IPs in a prefix, measured by an external tool.
+type SpeedReport struct {
+	Prefix  string        `json:"prefix"`
+	RTT     time.Duration `json:"rtt"`
+	Loss    float64       `json:"loss"` // packet loss rate, from 0 to 1
+	Expires time.Time     `json:"expires"`
+}
+
+// score is the expected latency of a prefix, counting retransmissions due to loss. Lower is better.
+// It's +Inf if the prefix is unreachable.
+func (r *SpeedReport) score() float64 {
+	if r.Loss >= 1 {
+		return math.Inf(1)
+	}
+	return float64(r.RTT) / (1 - r.Loss)
+}
+
+// speedEntry is a ranger entry of a speed report.
+type speedEntry struct {
+	network net.IPNet
+	report  *SpeedReport
+}
+
+func (e *speedEntry) Network() net.IPNet {
+	return e.network
+}
+
+// speedTable keeps speed reports of prefixes, matching IPs by the longest prefix. It's nil-safe.
+type speedTable struct {
+	mu      sync.RWMutex
+	ranger  cidranger.Ranger
+	reports map[string]*speedEntry // indexed by prefix
+}
+
+func newSpeedTable() *speedTable {
+	return &speedTable{ranger: cidranger.NewPCTrieRanger(), reports: make(map[string]*speedEntry)}
+}
+
+// Report records a speed report of prefix, replacing the previous one.
+func (t *speedTable) Report(network *net.IPNet, rtt time.Duration, loss float64, ttl time.Duration) error {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+	e := &speedEntry{network: *network, report: &SpeedReport{
+		Prefix:  network.String(),
+		RTT:     rtt,
+		Loss:    loss,
+		Expires: now.Add(ttl),
+	}}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.reports[e.report.Prefix]; !ok && len(t.reports) >= maxSpeedReports {
+		t.expireLocked(now)
+		if len(t.reports) >= maxSpeedReports {
+			return errTooManySpeedReports
+		}
+	}
+	if old, ok := t.reports[e.report.Prefix]; ok {
+		t.ranger.Remove(old.network) //nolint:errcheck
+	}
+	if err := t.ranger.Insert(e); err != nil {
+		return err
+	}
+	t.reports[e.report.Prefix] = e
+	return nil
+}
+
+func (t *speedTable) expireLocked(now time.Time) {
+	for prefix, e := range t.reports {
+		if !now.Before(e.report.Expires) {
+			t.ranger.Remove(e.network) //nolint:errcheck
+			delete(t.reports, prefix)
+		}
+	}
+}
+
+// Lookup returns the unexpired report of the longest prefix containing ip, or nil.
+func (t *speedTable) Lookup(ip net.IP) *SpeedReport {
+	if t == nil {
+		return nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	entries, err := t.ranger.ContainingNetworks(ip)
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	// Networks are returned from the shortest prefix to the longest.
+	for i := len(entries) - 1; i >= 0; i-- {
+		if r := entries[i].(*speedEntry).report; now.Before(r.Expires) {
+			return r
+		}
+	}
+	return nil
+}
+
+// List returns unexpired reports sorted by prefix.
+func (t *speedTable) List() []SpeedReport {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+	t.mu.RLock()
+	reports := make([]SpeedReport, 0, len(t.reports))
+	for _, e := range t.reports {
+		if now.Before(e.report.Expires) {
+			reports = append(reports, *e.report)
+		}
+	}
+	t.mu.RUnlock()
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Prefix < reports[j].Prefix })
+	return reports
+}
+
+// Clear removes all reports, and returns the number of them.
+func (t *speedTable) Clear() int {
+	if t == nil {
+		return 0
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := len(t.reports)
+	t.ranger = cidranger.NewPCTrieRanger()
+	t.reports = make(map[string]*speedEntry)
+	return n
+}
+
+// Rank sorts address records by speed reports of their IPs, from the fastest. Records without reports follow
+// the measured ones in their original order, and those of unreachable prefixes are moved to the end.
+func (t *speedTable) Rank(addrs []dns.RR) {
+	scores := make(map[dns.RR]float64, len(addrs))
+	for _, rr := range addrs {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if r := t.Lookup(ip); r != nil {
+			scores[rr] = r.score()
+		} else {
+			scores[rr] = math.MaxFloat64 // between measured and unreachable ones
+		}
+	}
+	sort.SliceStable(addrs, func(i, j int) bool { return scores[addrs[i]] < scores[addrs[j]] })
+}
+
+// ReportSpeed records the latency and packet loss rate (from 0 to 1) of prefix measured by an external tool, for
+// ttl (10 minutes if 0). prefix is a CIDR or a single IP. With the speed shuffle mode (see WithAnswerShuffle),
+// address records in answers are ordered by reports of the longest prefixes containing them, so that clients trying
+// addresses in order connect to the fastest one first. A report replaces the previous one of the same prefix.
+func (s *Server) ReportSpeed(prefix string, rtt time.Duration, loss float64, ttl time.Duration) error {
+	network, err := parseCIDROrIP(prefix)
+	if err != nil {
+		return err
+	}
+	if rtt < 0 {
+		return fmt.Errorf("negative rtt %s", rtt)
+	}
+	if loss < 0 || loss > 1 || math.IsNaN(loss) {
+		return fmt.Errorf("loss %v out of range [0, 1]", loss)
+	}
+	if ttl <= 0 {
+		ttl = defaultSpeedReportTTL
+	}
+	return s.speeds.Report(network, rtt, loss, ttl)
+}
+
+// Speeds returns unexpired speed reports, sorted by prefix.
+func (s *Server) Speeds() []SpeedReport {
+	return s.speeds.List()
+}
+
+// ClearSpeeds removes all speed reports, and returns the number of them.
+func (s *Server) ClearSpeeds() int {
+	return s.speeds.Clear()
+}
@@ -0,0 +1,64 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSpeedShuffle(t *testing.T) {
+	s := &Server{speeds: newSpeedTable()}
+	sh, err := newShuffler(ShuffleSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh.speeds = s.speeds
+
+	for _, r := range []struct {
+		prefix string
+		rtt    time.Duration
+		loss   float64
+	}{
+		{"1.2.3.0/24", 80 * time.Millisecond, 0},
+		{"1.2.3.4", 10 * time.Millisecond, 0.5}, // the longest prefix wins
+		{"5.6.7.0/24", 30 * time.Millisecond, 0},
+		{"9.9.9.9", time.Millisecond, 1},
+		{"2001:db8::/32", 50 * time.Millisecond, 0},
+	} {
+		if err := s.ReportSpeed(r.prefix, r.rtt, r.loss, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.ReportSpeed("1.2.3.0/24", time.Millisecond, 2, 0); err == nil {
+		t.Error("Loss out of range should be rejected")
+	}
+	if n := len(s.Speeds()); n != 5 {
+		t.Errorf("5 reports should be listed, got %d", n)
+	}
+
+	m := newTestReply("example.com.", 300, "9.9.9.9", "8.8.8.8", "1.2.3.5", "1.2.3.4", "5.6.7.8")
+	m.Answer = append([]dns.RR{&dns.CNAME{Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300}, Target: "example.com."}}, m.Answer...)
+	sh.Shuffle(m)
+	want := []string{"1.2.3.4", "5.6.7.8", "1.2.3.5", "8.8.8.8", "9.9.9.9"}
+	if _, ok := m.Answer[0].(*dns.CNAME); !ok {
+		t.Fatalf("CNAME should keep its position, got %s", m.Answer[0])
+	}
+	for i, ip := range want {
+		if got := m.Answer[i+1].(*dns.A).A.String(); got != ip {
+			t.Errorf("Answer %d should be %s, got %s", i, ip, got)
+		}
+	}
+
+	network, _ := parseCIDROrIP("5.6.7.0/24")
+	if err := s.speeds.Report(network, 0, 0, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if r := s.speeds.Lookup(net.ParseIP("5.6.7.8")); r != nil {
+		t.Errorf("Expired report should not be used, got %+v", r)
+	}
+	if n := s.ClearSpeeds(); n != 5 || len(s.Speeds()) != 0 {
+		t.Errorf("Reports should be cleared, got %d", n)
+	}
+}
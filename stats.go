@@ -0,0 +1,318 @@
+package gochinadns
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// statsBuckets is the number of buckets the period of stats is divided into, which expire one by one.
+	statsBuckets = 24
+	// statsMaxKeys bounds the number of domains or clients counted in a bucket. Those beyond it are counted in totals
+	// only, while top talkers are likely counted already.
+	statsMaxKeys = 1000
+	// DefaultStatsTop is the number of top domains and clients reported by default.
+	DefaultStatsTop = 10
+	// statsLocateQueueSize is the max number of answers waiting to be located by country. Those beyond it aren't
+	// counted by country.
+	statsLocateQueueSize = 1024
+	// statsLocateTimeout bounds the time to locate IPs of an answer, so that a slow GeoIP provider doesn't hold up
+	// answers queued after it.
+	statsLocateTimeout = time.Second
+)
+
+// answerCountries counts answers by countries of their IPs since the server starts, while stats are enabled.
+var answerCountries = expvar.NewMap("chinadns_answer_countries")
+
+// WithStats keeps rolling counters of queries in the last period, by domain, client and upstream, for reports of top
+// talkers and answers by country, see Stats. Disabled if period is 0.
+func WithStats(period time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if period < 0 {
+			return fmt.Errorf("invalid stats period: %s", period)
+		}
+		o.StatsPeriod = period
+		return nil
+	}
+}
+
+// StatsCount is a count of queries of a domain, from a client or answered by an upstream in StatsReport.
+type StatsCount struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+// StatsReport reports queries in the last period of stats. Domain names are redacted by RedactName.
+type StatsReport struct {
+	Since      time.Time    `json:"since"` // when counting began, at most a period ago
+	Queries    uint64       `json:"queries"`
+	Cached     uint64       `json:"cached"`
+	Blocked    uint64       `json:"blocked"`
+	TopDomains []StatsCount `json:"top_domains"`
+	TopBlocked []StatsCount `json:"top_blocked"`
+	TopClients []StatsCount `json:"top_clients"`
+	Upstreams  []StatsCount `json:"upstreams"` // answers of each upstream used, most first
+	// Countries count answers by countries of their IPs, most first, see StatsSlice.
+	Countries []StatsCount `json:"countries"`
+	// Timeline has answers by country in each slice of the period, oldest first, to tell how they change over time.
+	Timeline []StatsSlice `json:"timeline"`
+}
+
+// StatsSlice counts answers by country in a slice of the period of stats, a 24th of it, in StatsReport.
+// An answer is counted once in each country of its IPs, located by the GeoIP provider if any (see WithGeoProvider),
+// or as CN or CountryUnknown by China route lists otherwise. Answers without IPs aren't counted.
+type StatsSlice struct {
+	Start     time.Time    `json:"start"`
+	Countries []StatsCount `json:"countries"`
+}
+
+// statsBucket counts queries in a slice of the period.
+type statsBucket struct {
+	start                    time.Time
+	queries, cached, blocked uint64
+	domains, blockedDomains  map[string]uint64
+	clients, upstreams       map[string]uint64
+	countries                map[string]uint64
+}
+
+func newStatsBucket(start time.Time) *statsBucket {
+	return &statsBucket{
+		start:          start,
+		domains:        make(map[string]uint64),
+		blockedDomains: make(map[string]uint64),
+		clients:        make(map[string]uint64),
+		upstreams:      make(map[string]uint64),
+		countries:      make(map[string]uint64),
+	}
+}
+
+// statsTable keeps rolling counters of queries. A nil table is disabled.
+type statsTable struct {
+	period time.Duration
+	now    func() time.Time
+
+	mu      sync.Mutex
+	buckets []*statsBucket // oldest first
+
+	// located queues answers to locate by country off the path of replies, see runStatsLocations.
+	located chan statsLocation
+}
+
+// statsLocation is IPs of an answer to locate by country, counted in the bucket of when it's answered.
+type statsLocation struct {
+	at  time.Time
+	ips []net.IP
+}
+
+// newStatsTable returns a table of the last period, or nil if period is not positive.
+func newStatsTable(period time.Duration, now func() time.Time) *statsTable {
+	if period <= 0 {
+		return nil
+	}
+	return &statsTable{period: period, now: now, located: make(chan statsLocation, statsLocateQueueSize)}
+}
+
+// bucket returns the current bucket, dropping expired ones. It must be called with mu held.
+func (t *statsTable) bucket(now time.Time) *statsBucket {
+	t.expire(now)
+	if n := len(t.buckets); n > 0 && now.Sub(t.buckets[n-1].start) < t.period/statsBuckets {
+		return t.buckets[n-1]
+	}
+	b := newStatsBucket(now)
+	t.buckets = append(t.buckets, b)
+	return b
+}
+
+// expire drops buckets older than the period. It must be called with mu held.
+func (t *statsTable) expire(now time.Time) {
+	i := 0
+	for i < len(t.buckets) && now.Sub(t.buckets[i].start) >= t.period {
+		i++
+	}
+	t.buckets = t.buckets[i:]
+}
+
+// bucketAt returns the bucket of at, or nil if it has expired. It must be called with mu held.
+func (t *statsTable) bucketAt(at time.Time) *statsBucket {
+	t.expire(t.now())
+	for i := len(t.buckets) - 1; i >= 0; i-- {
+		if !t.buckets[i].start.After(at) {
+			return t.buckets[i]
+		}
+	}
+	return nil
+}
+
+// addStatsKey counts a query in m by key, unless m is full of other keys.
+func addStatsKey(m map[string]uint64, key string) {
+	if _, ok := m[key]; ok || len(m) < statsMaxKeys {
+		m[key]++
+	}
+}
+
+// countStatsAnswer counts an answer, and queues it to be located by country, as GeoIP providers may be slow.
+func (s *Server) countStatsAnswer(e *AnswerEvent) {
+	t := s.stats
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	var ips []net.IP
+	if e.Answer != nil {
+		ips = answerIPs(e.Answer)
+	}
+	if len(ips) > 0 {
+		select {
+		case t.located <- statsLocation{at: now, ips: ips}:
+		default:
+			logrus.WithField("question", e.Question.Name).Debug("Too many answers to locate. Don't count it by country.")
+		}
+	}
+	b := t.bucket(now)
+	b.queries++
+	if e.Cached {
+		b.cached++
+	}
+	addStatsKey(b.domains, strings.ToLower(e.Question.Name))
+	addStatsKey(b.clients, e.Client.String())
+	if e.Upstream != nil {
+		b.upstreams[e.Upstream.String()]++
+	}
+}
+
+// runStatsLocations counts queued answers by country, until ctx is done.
+func (s *Server) runStatsLocations(ctx context.Context) {
+	if s.stats == nil {
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case l := <-s.stats.located:
+			s.countStatsLocation(ctx, l)
+		}
+	}
+}
+
+// countStatsLocation counts the answer of l by countries of its IPs, in the bucket of when it was answered.
+func (s *Server) countStatsLocation(ctx context.Context, l statsLocation) {
+	ctx, cancel := context.WithTimeout(ctx, statsLocateTimeout)
+	defer cancel()
+	countries := s.ipCountries(ctx, l.ips)
+	for _, country := range countries {
+		answerCountries.Add(country, 1)
+	}
+	t := s.stats
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b := t.bucketAt(l.at); b != nil {
+		for _, country := range countries {
+			addStatsKey(b.countries, country)
+		}
+	}
+}
+
+// ipCountries returns distinct countries of ips, see StatsSlice.
+func (s *Server) ipCountries(ctx context.Context, ips []net.IP) (countries []string) {
+	seen := make(map[string]bool)
+	for _, ip := range ips {
+		country, err := s.locateCountry(ctx, ip)
+		if err != nil {
+			logrus.WithError(err).WithField("ip", ip).Debug("Fail to locate the answer IP.")
+		}
+		if !seen[country] {
+			seen[country] = true
+			countries = append(countries, country)
+		}
+	}
+	return countries
+}
+
+func (s *Server) countStatsBlocked(e *BlockedEvent) {
+	t := s.stats
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucket(t.now())
+	b.queries++
+	b.blocked++
+	name := strings.ToLower(e.Question.Name)
+	addStatsKey(b.domains, name)
+	addStatsKey(b.blockedDomains, name)
+	addStatsKey(b.clients, e.Client.String())
+}
+
+// Stats reports queries in the last period of stats (see WithStats), with top domains, blocked domains and clients
+// of at most top each. It returns nil if stats are disabled.
+func (s *Server) Stats(top int) *StatsReport {
+	t := s.stats
+	if t == nil {
+		return nil
+	}
+	domains, blocked := make(map[string]uint64), make(map[string]uint64)
+	clients, upstreams := make(map[string]uint64), make(map[string]uint64)
+	countries := make(map[string]uint64)
+	r := &StatsReport{Timeline: []StatsSlice{}}
+	t.mu.Lock()
+	now := t.now()
+	t.expire(now)
+	r.Since = now
+	if len(t.buckets) > 0 {
+		r.Since = t.buckets[0].start
+	}
+	for _, b := range t.buckets {
+		r.Queries += b.queries
+		r.Cached += b.cached
+		r.Blocked += b.blocked
+		mergeStats(domains, b.domains)
+		mergeStats(blocked, b.blockedDomains)
+		mergeStats(clients, b.clients)
+		mergeStats(upstreams, b.upstreams)
+		mergeStats(countries, b.countries)
+		r.Timeline = append(r.Timeline, StatsSlice{Start: b.start, Countries: topStatsCounts(b.countries, len(b.countries), nil)})
+	}
+	t.mu.Unlock()
+
+	r.TopDomains = topStatsCounts(domains, top, RedactName)
+	r.TopBlocked = topStatsCounts(blocked, top, RedactName)
+	r.TopClients = topStatsCounts(clients, top, nil)
+	r.Upstreams = topStatsCounts(upstreams, len(upstreams), nil)
+	r.Countries = topStatsCounts(countries, len(countries), nil)
+	return r
+}
+
+func mergeStats(dst, src map[string]uint64) {
+	for key, n := range src {
+		dst[key] += n
+	}
+}
+
+// topStatsCounts returns at most top counts of m, most first, with names transformed by name if it's not nil.
+func topStatsCounts(m map[string]uint64, top int, name func(string) string) []StatsCount {
+	counts := make([]StatsCount, 0, len(m))
+	for key, n := range m {
+		counts = append(counts, StatsCount{Name: key, Count: n})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Name < counts[j].Name
+	})
+	if top >= 0 && len(counts) > top {
+		counts = counts[:top]
+	}
+	if name != nil {
+		for i := range counts {
+			counts[i].Name = name(counts[i].Name)
+		}
+	}
+	return counts
+}
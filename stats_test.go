@@ -0,0 +1,116 @@
+package gochinadns
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cherrot/gochinadns/clock"
+	"github.com/miekg/dns"
+)
+
+func TestStats(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1600000000, 0))
+	s, err := NewServer(NewClient(), WithSkipRefineResolvers(true), WithClock(clk), WithStats(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &Resolver{Addr: "114.114.114.114:53"}
+	answer := func(client, name string, cached bool) {
+		e := &AnswerEvent{Question: dns.Question{Name: name, Qtype: dns.TypeA}, Client: net.ParseIP(client), Cached: cached}
+		if !cached {
+			e.Upstream = upstream
+		}
+		s.hooks.emitAnswer(e)
+	}
+	answer("192.168.1.20", "WWW.qq.com.", false)
+	clk.Advance(12 * time.Hour)
+	answer("192.168.1.20", "www.qq.com.", true)
+	answer("192.168.1.21", "www.baidu.com.", false)
+	s.hooks.emitBlocked(&BlockedEvent{Question: dns.Question{Name: "ads.example.com.", Qtype: dns.TypeA}, Client: net.ParseIP("192.168.1.21")})
+
+	r := s.Stats(1)
+	if r.Queries != 4 || r.Cached != 1 || r.Blocked != 1 || !r.Since.Equal(time.Unix(1600000000, 0)) {
+		t.Fatalf("Unexpected totals %+v", r)
+	}
+	if len(r.TopDomains) != 1 || r.TopDomains[0] != (StatsCount{Name: "www.qq.com.", Count: 2}) {
+		t.Errorf("Unexpected top domains %v", r.TopDomains)
+	}
+	if len(r.TopBlocked) != 1 || r.TopBlocked[0].Name != "ads.example.com." {
+		t.Errorf("Unexpected top blocked domains %v", r.TopBlocked)
+	}
+	// Ties are broken by names.
+	if len(r.TopClients) != 1 || r.TopClients[0] != (StatsCount{Name: "192.168.1.20", Count: 2}) {
+		t.Errorf("Unexpected top clients %v", r.TopClients)
+	}
+	if len(r.Upstreams) != 1 || r.Upstreams[0] != (StatsCount{Name: upstream.String(), Count: 2}) {
+		t.Errorf("Unexpected upstreams %v", r.Upstreams)
+	}
+
+	// Counters expire after the period.
+	clk.Advance(12 * time.Hour)
+	if r = s.Stats(10); r.Queries != 3 || len(r.TopDomains) != 3 {
+		t.Errorf("Expired counters should be dropped, got %+v", r)
+	}
+
+	w := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats?top=2", nil))
+	var report StatsReport
+	if err = json.Unmarshal(w.Body.Bytes(), &report); w.Code != http.StatusOK || err != nil || len(report.TopDomains) != 2 {
+		t.Errorf("Unexpected stats response %d %s", w.Code, w.Body)
+	}
+	disabled := &Server{serverOptions: newServerOptions()}
+	w = httptest.NewRecorder()
+	disabled.AdminHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Stats should be unavailable if disabled, got %d", w.Code)
+	}
+}
+
+func TestStatsCountries(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1600000000, 0))
+	provider := &countingGeoProvider{infos: map[string]GeoInfo{
+		"1.0.1.1": {Country: "CN"},
+		"1.0.1.2": {Country: "CN"},
+		"8.8.8.8": {Country: "US"},
+	}}
+	s, err := NewServer(NewClient(), WithSkipRefineResolvers(true), WithClock(clk), WithStats(24*time.Hour),
+		WithGeoProvider(provider))
+	if err != nil {
+		t.Fatal(err)
+	}
+	answer := func(name string, ips ...string) {
+		e := &AnswerEvent{Question: dns.Question{Name: name, Qtype: dns.TypeA}, Client: net.ParseIP("192.168.1.20")}
+		e.Answer = newTestReply(name, 60, ips...)
+		s.hooks.emitAnswer(e)
+	}
+	answer("www.qq.com.", "1.0.1.1", "1.0.1.2") // counted once in a country
+	clk.Advance(2 * time.Hour)
+	answer("www.google.com.", "8.8.8.8")
+	answer("www.example.com.", "9.9.9.9", "1.0.1.1")
+	answer("empty.example.com.")
+	// Answers are located off the path of replies, in buckets of when they're answered.
+	for len(s.stats.located) > 0 {
+		s.countStatsLocation(context.Background(), <-s.stats.located)
+	}
+
+	r := s.Stats(10)
+	want := []StatsCount{{Name: "CN", Count: 2}, {Name: "US", Count: 1}, {Name: CountryUnknown, Count: 1}}
+	if len(r.Countries) != len(want) {
+		t.Fatalf("Unexpected countries %v", r.Countries)
+	}
+	for i := range want {
+		if r.Countries[i] != want[i] {
+			t.Errorf("Unexpected countries %v", r.Countries)
+		}
+	}
+	if len(r.Timeline) != 2 || !r.Timeline[0].Start.Equal(time.Unix(1600000000, 0)) ||
+		len(r.Timeline[0].Countries) != 1 || r.Timeline[0].Countries[0] != (StatsCount{Name: "CN", Count: 1}) ||
+		len(r.Timeline[1].Countries) != 3 {
+		t.Errorf("Unexpected timeline %+v", r.Timeline)
+	}
+}
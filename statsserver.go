@@ -0,0 +1,89 @@
+package gochinadns
+
+import "net/http"
+
+// statsMaxAge is how long browsers may cache preflight results of the stats listener, in seconds.
+const statsMaxAge = "86400"
+
+// WithStatsListenAddr serves read-only counters of the server on addr at /stats, such as `0.0.0.0:8054`, for
+// status widgets of dashboards, see PublicStats. Unlike the admin API, it exposes no names, clients or upstream
+// addresses, and changes nothing, so it may listen beyond localhost. Disabled if empty.
+func WithStatsListenAddr(addr string) ServerOption {
+	return func(o *serverOptions) error {
+		o.StatsListen = addr
+		return nil
+	}
+}
+
+// WithStatsAllowOrigin sets the origin allowed to read the stats listener in browsers by CORS, like
+// `https://dash.lan`. Any origin is allowed if it's `*`, the default.
+func WithStatsAllowOrigin(origin string) ServerOption {
+	return func(o *serverOptions) error {
+		o.StatsAllowOrigin = origin
+		return nil
+	}
+}
+
+// PublicStats are counters of the server safe to expose without authentication, served by the stats listener.
+// Fields are those of Status, excluding addresses.
+type PublicStats struct {
+	SchemaVersion    int            `json:"schema_version"` // same as that of Status
+	Version          string         `json:"version"`
+	Uptime           int64          `json:"uptime"` // in seconds
+	Upstreams        int            `json:"upstreams"`
+	HealthyUpstreams int            `json:"healthy_upstreams"`
+	Counters         StatusCounters `json:"counters"`
+}
+
+// PublicStats returns counters of the server for the stats listener.
+func (s *Server) PublicStats() *PublicStats {
+	st := s.Status()
+	ps := &PublicStats{
+		SchemaVersion: st.SchemaVersion,
+		Version:       st.Version,
+		Uptime:        st.Uptime,
+		Upstreams:     len(st.Upstreams),
+		Counters:      st.Counters,
+	}
+	for _, u := range st.Upstreams {
+		if u.Healthy {
+			ps.HealthyUpstreams++
+		}
+	}
+	return ps
+}
+
+// StatsHandler returns an HTTP handler serving PublicStats in JSON at /stats, with CORS headers for dashboards
+// embedding it, see WithStatsAllowOrigin.
+func (s *Server) StatsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", s.handlePublicStats)
+	return mux
+}
+
+func (s *Server) handlePublicStats(w http.ResponseWriter, r *http.Request) {
+	origin := s.StatsAllowOrigin
+	if origin == "" {
+		origin = "*"
+	}
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	if origin != "*" {
+		h.Add("Vary", "Origin")
+	}
+	h.Set("Cache-Control", "no-store")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		writeJSON(w, http.StatusOK, s.PublicStats())
+	case http.MethodOptions:
+		h.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			h.Set("Access-Control-Allow-Headers", headers)
+		}
+		h.Set("Access-Control-Max-Age", statsMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		h.Set("Allow", "GET, HEAD, OPTIONS")
+		s.writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,53 @@
+package gochinadns
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatsHandler(t *testing.T) {
+	s, err := NewServer(NewClient(), WithSkipRefineResolvers(true), WithStatsListenAddr("127.0.0.1:0"),
+		WithStatsAllowOrigin("https://dash.lan"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.StatsServer == nil {
+		t.Fatal("Stats server should be created")
+	}
+
+	w := httptest.NewRecorder()
+	s.StatsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected status %d: %s", w.Code, w.Body)
+	}
+	if origin := w.Header().Get("Access-Control-Allow-Origin"); origin != "https://dash.lan" {
+		t.Errorf("Unexpected allowed origin: %q", origin)
+	}
+	var st map[string]interface{}
+	if err = json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st["schema_version"] != float64(StatusSchemaVersion) || st["counters"] == nil {
+		t.Errorf("Unexpected stats: %s", w.Body)
+	}
+	if _, ok := st["listen"]; ok {
+		t.Errorf("Listening address should not be exposed: %s", w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodOptions, "/stats", nil)
+	r.Header.Set("Access-Control-Request-Headers", "accept")
+	s.StatsHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Methods") == "" ||
+		w.Header().Get("Access-Control-Allow-Headers") != "accept" {
+		t.Errorf("Unexpected preflight response %d: %v", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	s.StatsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/stats", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Unexpected status of POST %d", w.Code)
+	}
+}
@@ -0,0 +1,117 @@
+package gochinadns
+
+import (
+	"expvar"
+	"runtime"
+	"time"
+)
+
+const (
+	// StatusSchemaVersion is the version of the Status schema. It's increased on incompatible changes only,
+	// so that router UIs can check whether they understand the document.
+	StatusSchemaVersion = 1
+	// unhealthyErrors is the number of consecutive errors making an upstream unhealthy.
+	unhealthyErrors = 3
+)
+
+// Status is a stable machine-readable status document of the server, for router UIs such as a LuCI app.
+// Fields are only added within a schema version. Durations are in milliseconds, and times are Unix seconds.
+type Status struct {
+	SchemaVersion int              `json:"schema_version"`
+	Version       string           `json:"version"`
+	GoVersion     string           `json:"go_version"`
+	Uptime        int64            `json:"uptime"` // in seconds
+	Listen        string           `json:"listen"`
+	Upstreams     []UpstreamHealth `json:"upstreams"`
+	Counters      StatusCounters   `json:"counters"`
+	Tenants       []TenantStatus   `json:"tenants,omitempty"` // see WithTenants
+}
+
+// UpstreamHealth is the health of an upstream in Status.
+type UpstreamHealth struct {
+	Address     string  `json:"address"`
+	Trusted     bool    `json:"trusted"`
+	Healthy     bool    `json:"healthy"` // not drained, and not failing consecutively
+	Drained     bool    `json:"drained"`
+	Queries     uint64  `json:"queries"`
+	Errors      uint64  `json:"errors"`
+	AvgRTT      float64 `json:"avg_rtt_ms"`
+	FailureRate float64 `json:"failure_rate"` // moving average of failures, from 0 to 1
+	LastSuccess int64   `json:"last_success"` // 0 if never
+}
+
+// StatusCounters are counters of the server since it starts, in Status.
+type StatusCounters struct {
+	Queries         int64  `json:"queries"`
+	InFlight        int    `json:"in_flight"`
+	Deduplicated    int64  `json:"deduplicated"`
+	RateLimited     int64  `json:"rate_limited"`
+	Rejected        int64  `json:"rejected"`  // queries rejected as too many are in flight, see WithMaxInFlight
+	TCPConns        int64  `json:"tcp_conns"` // open TCP connections
+	CacheEntries    int    `json:"cache_entries"`
+	CacheHits       uint64 `json:"cache_hits"`
+	CacheMisses     uint64 `json:"cache_misses"`
+	QueryLogDropped int64  `json:"query_log_dropped"`
+	UDPWriteDrops   int64  `json:"udp_write_drops"` // UDP responses failing to be sent, e.g. as the socket buffer is full
+	// UDP datagrams of the host dropped by the kernel as send or receive buffers are full, since the server starts.
+	// Linux only.
+	UDPSndbufErrors int64 `json:"udp_sndbuf_errors"`
+	UDPRcvbufErrors int64 `json:"udp_rcvbuf_errors"`
+	ListErrors      int64 `json:"list_errors"` // errors skipped in loading the current lists, see WithPermissiveLists
+}
+
+// Status returns the status document of the server.
+func (s *Server) Status() *Status {
+	st := &Status{
+		SchemaVersion: StatusSchemaVersion,
+		Version:       GetVersion(),
+		GoVersion:     runtime.Version(),
+		Uptime:        int64(time.Since(s.started) / time.Second),
+		Listen:        s.Listen,
+		Upstreams:     []UpstreamHealth{},
+		Tenants:       s.TenantStats(),
+	}
+	for _, u := range s.Upstreams() {
+		h := UpstreamHealth{
+			Address:     u.Resolver,
+			Trusted:     u.Trusted,
+			Healthy:     !u.Drained && u.ConsecutiveErrors < unhealthyErrors,
+			Drained:     u.Drained,
+			Queries:     u.Queries,
+			Errors:      u.Errors,
+			AvgRTT:      float64(u.AvgRTT) / float64(time.Millisecond),
+			FailureRate: u.FailureRate,
+		}
+		if !u.LastSuccess.IsZero() {
+			h.LastSuccess = u.LastSuccess.Unix()
+		}
+		st.Upstreams = append(st.Upstreams, h)
+	}
+
+	c := &st.Counters
+	listenerQueries.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			c.Queries += v.Value()
+		}
+	})
+	c.InFlight = len(s.InFlight())
+	c.Deduplicated = dedupedQueries.Value()
+	c.RateLimited = rateLimited.Value()
+	c.Rejected = queriesRejected.Value()
+	c.TCPConns = tcpConns.Value()
+	c.QueryLogDropped = queryLogDropped.Value()
+	c.UDPWriteDrops = udpWriteDropped()
+	if e, err := readUDPKernelErrors(); err == nil {
+		e = e.sub(s.udpKernelBase)
+		c.UDPSndbufErrors, c.UDPRcvbufErrors = e.SndbufErrors, e.RcvbufErrors
+	}
+	c.ListErrors = listErrorsGauge.Value()
+	if s.cache != nil {
+		c.CacheEntries = s.cache.Len()
+	}
+	if mc, ok := s.cache.(*MemoryCache); ok {
+		cs := mc.Stats()
+		c.CacheHits, c.CacheMisses = cs.Hits, cs.Misses
+	}
+	return st
+}
@@ -0,0 +1,51 @@
+package gochinadns
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatus(t *testing.T) {
+	good := &Resolver{Addr: "8.8.8.8:53", Protocols: []string{"udp"}}
+	bad := &Resolver{Addr: "114.114.114.114:53", Protocols: []string{"udp"}}
+	o := newServerOptions()
+	o.TrustedServers = resolverList{good}
+	o.UntrustedServers = resolverList{bad}
+	s := &Server{
+		serverOptions: o,
+		inflight:      newInflightTable(),
+		upstreams:     newUpstreamTable(),
+		cache:         NewMemoryCache(10, 0),
+		started:       time.Now().Add(-time.Minute),
+	}
+	s.upstreams.Record(&UpstreamReplyEvent{Upstream: good, RTT: 20 * time.Millisecond})
+	for i := 0; i < unhealthyErrors; i++ {
+		s.upstreams.Record(&UpstreamReplyEvent{Upstream: bad, Err: errors.New("i/o timeout")})
+	}
+
+	rec := httptest.NewRecorder()
+	s.AdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Unexpected status code %d", rec.Code)
+	}
+	var st Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.SchemaVersion != StatusSchemaVersion || st.Version != GetVersion() || st.Uptime != 60 {
+		t.Errorf("Unexpected status %+v", st)
+	}
+	if len(st.Upstreams) != 2 {
+		t.Fatalf("Unexpected upstreams %+v", st.Upstreams)
+	}
+	if u := st.Upstreams[0]; !u.Trusted || !u.Healthy || u.AvgRTT != 20 || u.LastSuccess == 0 {
+		t.Errorf("Unexpected health of the good upstream %+v", u)
+	}
+	if u := st.Upstreams[1]; u.Trusted || u.Healthy || u.Errors != unhealthyErrors {
+		t.Errorf("Upstream failing consecutively should be unhealthy: %+v", u)
+	}
+}
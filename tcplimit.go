@@ -0,0 +1,127 @@
+package gochinadns
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultTCPMaxQueries is the default max number of queries per TCP connection, the same as package dns.
+	defaultTCPMaxQueries = 128
+	// defaultTCPIdleTimeout is the default idle timeout of TCP connections, the same as package dns.
+	defaultTCPIdleTimeout = 8 * time.Second
+)
+
+var (
+	tcpConns = expvar.NewInt("chinadns_tcp_conns")
+
+	errTooManyTCPQueries = errors.New("too many queries on the TCP connection")
+)
+
+// tcpLimiter limits concurrent connections and queries per connection of a TCP server.
+type tcpLimiter struct {
+	conns      int64 // accessed atomically, so it's the first field to be 64-bit aligned
+	maxConns   int64 // unlimited if 0
+	maxQueries int   // unlimited if negative
+}
+
+// listen returns a listener of ln, which counts connections until they are closed, and closes new ones over the
+// limit right away.
+func (l *tcpLimiter) listen(ln net.Listener) net.Listener {
+	if ln == nil {
+		return nil
+	}
+	return &limitedListener{Listener: ln, limiter: l}
+}
+
+// decorate returns a reader of a single connection, which is closed by the server once the reader fails.
+func (l *tcpLimiter) decorate(r dns.Reader) dns.Reader {
+	return &limitedReader{Reader: r, limiter: l}
+}
+
+type limitedListener struct {
+	net.Listener
+	limiter *tcpLimiter
+}
+
+func (ln *limitedListener) Accept() (net.Conn, error) {
+	l := ln.limiter
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if n := atomic.AddInt64(&l.conns, 1); l.maxConns > 0 && n > l.maxConns {
+			atomic.AddInt64(&l.conns, -1)
+			logrus.WithField("client", conn.RemoteAddr()).Debug("Too many TCP connections. Reject the connection.")
+			_ = conn.Close()
+			continue
+		}
+		tcpConns.Add(1)
+		return &limitedConn{Conn: conn, limiter: l}, nil
+	}
+}
+
+// limitedConn is a connection counted by its limiter until it's closed.
+type limitedConn struct {
+	net.Conn
+	limiter *tcpLimiter
+	once    sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.limiter.conns, -1)
+		tcpConns.Add(-1)
+	})
+	return c.Conn.Close()
+}
+
+type limitedReader struct {
+	dns.Reader
+	limiter *tcpLimiter
+	queries int
+}
+
+func (r *limitedReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	if l := r.limiter; l.maxQueries >= 0 && r.queries >= l.maxQueries {
+		return nil, errTooManyTCPQueries
+	}
+	r.queries++
+	return r.Reader.ReadTCP(conn, timeout)
+}
+
+// tcpIdleTimeout returns the timeout to wait for subsequent queries of a TCP connection.
+func (o *serverOptions) tcpIdleTimeout() time.Duration {
+	if o.TCPIdleTimeout > 0 {
+		return o.TCPIdleTimeout
+	}
+	return defaultTCPIdleTimeout
+}
+
+// limitTCPServer applies timeouts and limits of TCP connections in options to srv, which serves on ln.
+func (o *serverOptions) limitTCPServer(srv *dns.Server, ln net.Listener) {
+	if o.TCPReadTimeout > 0 {
+		srv.ReadTimeout = o.TCPReadTimeout
+	}
+	if o.TCPIdleTimeout > 0 {
+		idle := o.TCPIdleTimeout
+		srv.IdleTimeout = func() time.Duration { return idle }
+	}
+	maxQueries := o.TCPMaxQueries
+	if maxQueries == 0 {
+		maxQueries = defaultTCPMaxQueries
+	}
+	limiter := &tcpLimiter{maxConns: int64(o.TCPMaxConns), maxQueries: maxQueries}
+	// Queries are counted by the limiter, and connections are counted until they are closed by the server.
+	srv.MaxTCPQueries = -1
+	srv.DecorateReader = limiter.decorate
+	srv.Listener = limiter.listen(ln)
+}
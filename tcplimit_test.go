@@ -0,0 +1,101 @@
+package gochinadns
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// nopReader reads a query from a TCP connection successfully unless fail is set.
+type nopReader struct {
+	dns.Reader
+	fail bool
+}
+
+func (r *nopReader) ReadTCP(conn net.Conn, timeout time.Duration) ([]byte, error) {
+	if r.fail {
+		return nil, errTooManyTCPQueries
+	}
+	return []byte{}, nil
+}
+
+func TestTCPLimiter(t *testing.T) {
+	l := &tcpLimiter{maxConns: 2, maxQueries: 2}
+	r := l.decorate(&nopReader{})
+	for i := 0; i < 2; i++ {
+		if _, err := r.ReadTCP(nil, time.Second); err != nil {
+			t.Fatalf("Query %d should be read: %v", i, err)
+		}
+	}
+	if _, err := r.ReadTCP(nil, time.Second); err != errTooManyTCPQueries {
+		t.Errorf("Query over the limit should be rejected, got %v", err)
+	}
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := l.listen(inner)
+	defer ln.Close()
+	accept := func() net.Conn {
+		t.Helper()
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { client.Close() })
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	// Connections are released once closed, however many are opened over time.
+	for i := 0; i < 5; i++ {
+		conn := accept()
+		if err := conn.Close(); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close() // released only once
+	}
+	if n := atomic.LoadInt64(&l.conns); n != 0 {
+		t.Fatalf("Closed connections should be released, %d left", n)
+	}
+
+	held := []net.Conn{accept(), accept()}
+	rejected, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rejected.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	_ = rejected.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := rejected.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Connection over the limit should be closed, got %v", err)
+	}
+
+	held[0].Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn := <-accepted
+	if conn == nil || conn.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Fatalf("Connection within the limit should be accepted, got %v", conn)
+	}
+	conn.Close()
+	held[1].Close()
+	if n := atomic.LoadInt64(&l.conns); n != 0 {
+		t.Errorf("Closed connections should be released, %d left", n)
+	}
+}
@@ -0,0 +1,282 @@
+package gochinadns
+
+import (
+	"context"
+	"encoding/binary"
+	"expvar"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Limits of pooled TCP connections to upstreams.
+const (
+	tcpPoolConns = 4 // connections kept to each upstream
+	// tcpPipelineDepth is the number of queries in flight on a connection, beyond which another one is dialed.
+	tcpPipelineDepth = 32
+	// tcpPoolIdleTimeout closes idle connections, which most servers do in tens of seconds (RFC 7766 section 6.2.3).
+	tcpPoolIdleTimeout = 30 * time.Second
+)
+
+var tcpPoolDials = expvar.NewInt("chinadns_tcp_pool_dials")
+
+// tcpPool keeps persistent TCP connections to upstreams, over which queries are pipelined (RFC 7766 section 6.2.1.1),
+// so that a TCP query doesn't pay for a handshake. Broken connections are left out, and dialed again on demand.
+type tcpPool struct {
+	dial    func(addr string) (*dns.Conn, error)
+	onReuse func(addr string) // called when a connection is reused for a query, if not nil
+
+	mu      sync.Mutex
+	entries map[string]*tcpPoolEntry // by upstream address
+}
+
+type tcpPoolEntry struct {
+	mu    sync.Mutex // held while dialing, so that queries to an upstream don't dial in a stampede
+	conns []*pipelinedConn
+}
+
+func newTCPPool(dial func(addr string) (*dns.Conn, error)) *tcpPool {
+	return &tcpPool{dial: dial, entries: make(map[string]*tcpPoolEntry)}
+}
+
+// exchange sends the packed query raw to addr and returns the packed reply, until ctx is done or deadline.
+// The query is retried once if the connection turns out to be closed by the server, e.g. for being idle.
+func (p *tcpPool) exchange(ctx context.Context, raw []byte, addr string, deadline time.Time) ([]byte, error) {
+	pc, reused, err := p.get(addr)
+	if err != nil {
+		return nil, err
+	}
+	if reused && p.onReuse != nil {
+		p.onReuse(addr)
+	}
+	reply, err := pc.exchange(ctx, raw, deadline)
+	if err != nil && reused && pc.closed() && ctx.Err() == nil && time.Now().Before(deadline) {
+		if pc, _, err = p.get(addr); err != nil {
+			return nil, err
+		}
+		reply, err = pc.exchange(ctx, raw, deadline)
+	}
+	return reply, err
+}
+
+// get returns the least busy connection to addr, or a new one if all of them are busy, unless file descriptors are
+// scarce. It also tells whether the connection has been used before.
+func (p *tcpPool) get(addr string) (pc *pipelinedConn, reused bool, err error) {
+	p.mu.Lock()
+	e := p.entries[addr]
+	if e == nil {
+		e = new(tcpPoolEntry)
+		p.entries[addr] = e
+	}
+	p.mu.Unlock()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	live := make([]*pipelinedConn, 0, len(e.conns))
+	for _, c := range e.conns {
+		if !c.closed() {
+			live = append(live, c)
+		}
+	}
+	e.conns = live
+	for _, c := range e.conns {
+		if pc == nil || c.inFlight() < pc.inFlight() {
+			pc = c
+		}
+	}
+	if pc != nil && (pc.inFlight() < tcpPipelineDepth || len(e.conns) >= tcpPoolConns || atomic.LoadInt32(&fdsScarce) == 1) {
+		return pc, true, nil
+	}
+	conn, err := p.dial(addr)
+	if err != nil {
+		if pc != nil {
+			// Busy is better than nothing.
+			return pc, true, nil
+		}
+		return nil, false, err
+	}
+	tcpPoolDials.Add(1)
+	c := newPipelinedConn(conn)
+	e.conns = append(e.conns, c)
+	return c, false, nil
+}
+
+// pipelinedConn is a TCP connection to an upstream, where queries in flight are matched with replies by ID.
+type pipelinedConn struct {
+	conn *dns.Conn
+	wmu  sync.Mutex // serializes writes of queries
+
+	mu       sync.Mutex
+	pending  map[uint16]chan []byte // by query ID on the wire
+	nextID   uint16
+	lastRead time.Time
+	err      error // why the connection is closed, nil if it's open
+}
+
+func newPipelinedConn(conn *dns.Conn) *pipelinedConn {
+	pc := &pipelinedConn{conn: conn, pending: make(map[uint16]chan []byte), nextID: dns.Id(), lastRead: time.Now()}
+	_ = conn.SetReadDeadline(time.Now().Add(tcpPoolIdleTimeout))
+	go pc.readLoop()
+	return pc
+}
+
+// readLoop dispatches replies to queries in flight, until the connection is broken or idle for tcpPoolIdleTimeout.
+func (pc *pipelinedConn) readLoop() {
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, err := pc.conn.Read(buf)
+		if err != nil {
+			pc.close(err)
+			return
+		}
+		if n < 2 {
+			continue
+		}
+		b := make([]byte, n)
+		copy(b, buf[:n])
+		id := binary.BigEndian.Uint16(b)
+		pc.mu.Lock()
+		pc.lastRead = time.Now()
+		ch := pc.pending[id]
+		delete(pc.pending, id)
+		pc.mu.Unlock()
+		if ch != nil {
+			ch <- b
+		}
+	}
+}
+
+// exchange sends the packed query raw and waits for its packed reply, until ctx is done or deadline. The query ID is
+// replaced on the wire, since queries of different clients may share one, and restored in the reply.
+func (pc *pipelinedConn) exchange(ctx context.Context, raw []byte, deadline time.Time) ([]byte, error) {
+	sent := time.Now()
+	ch := make(chan []byte, 1)
+	pc.mu.Lock()
+	if pc.err != nil {
+		err := pc.err
+		pc.mu.Unlock()
+		return nil, err
+	}
+	id := pc.nextID
+	for pc.pending[id] != nil {
+		id++
+	}
+	pc.nextID = id + 1
+	pc.pending[id] = ch
+	pc.mu.Unlock()
+
+	buf := getBuffer(len(raw))
+	query := *buf
+	copy(query, raw)
+	binary.BigEndian.PutUint16(query, id)
+	pc.wmu.Lock()
+	_ = pc.conn.SetWriteDeadline(deadline)
+	_, err := pc.conn.Write(query)
+	if err == nil {
+		// Replies are waited for as long as queries are sent.
+		_ = pc.conn.SetReadDeadline(time.Now().Add(tcpPoolIdleTimeout))
+	}
+	pc.wmu.Unlock()
+	putBuffer(buf)
+	if err != nil {
+		pc.close(err)
+		return nil, err
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case b, ok := <-ch:
+		if !ok {
+			return nil, pc.closeError()
+		}
+		copy(b, raw[:2])
+		return b, nil
+	case <-ctx.Done():
+		pc.forget(id, sent, false)
+		return nil, ctx.Err()
+	case <-timer.C:
+		pc.forget(id, sent, true)
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+// forget gives up the query of id sent at sent. If it has timed out, and nothing is read since it was sent, the
+// connection is considered dead and closed.
+func (pc *pipelinedConn) forget(id uint16, sent time.Time, timedOut bool) {
+	pc.mu.Lock()
+	delete(pc.pending, id)
+	dead := timedOut && pc.lastRead.Before(sent)
+	pc.mu.Unlock()
+	if dead {
+		pc.close(os.ErrDeadlineExceeded)
+	}
+}
+
+// close closes the connection for err, and fails queries in flight.
+func (pc *pipelinedConn) close(err error) {
+	pc.mu.Lock()
+	if pc.err == nil {
+		pc.err = err
+	}
+	pending := pc.pending
+	pc.pending = nil
+	pc.mu.Unlock()
+	_ = pc.conn.Close()
+	for _, ch := range pending {
+		close(ch)
+	}
+}
+
+func (pc *pipelinedConn) closed() bool {
+	return pc.closeError() != nil
+}
+
+func (pc *pipelinedConn) closeError() error {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.err
+}
+
+func (pc *pipelinedConn) inFlight() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.pending)
+}
+
+// stats returns states of pooled connections of each upstream address, sorted by address.
+func (p *tcpPool) stats() []UpstreamConnStats {
+	p.mu.Lock()
+	addrs := make([]string, 0, len(p.entries))
+	entries := make([]*tcpPoolEntry, 0, len(p.entries))
+	for addr, e := range p.entries {
+		addrs = append(addrs, addr)
+		entries = append(entries, e)
+	}
+	p.mu.Unlock()
+
+	stats := make([]UpstreamConnStats, 0, len(entries))
+	for i, e := range entries {
+		st := UpstreamConnStats{Upstream: addrs[i]}
+		e.mu.Lock()
+		for _, c := range e.conns {
+			if c.closed() {
+				continue
+			}
+			st.Open++
+			if n := c.inFlight(); n > 0 {
+				st.InFlight += n
+			} else {
+				st.Idle++
+			}
+		}
+		e.mu.Unlock()
+		stats = append(stats, st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Upstream < stats[j].Upstream })
+	return stats
+}
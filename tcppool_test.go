@@ -0,0 +1,75 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTCPPool(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: l, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := newTestReply(req.Question[0].Name, 60, "1.0.1.1")
+		m.SetReply(req)
+		_ = w.WriteMsg(m)
+		if req.Question[0].Name == "bye.example.com." {
+			_ = w.Close()
+		}
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+
+	c := NewClient(WithTimeout(time.Second))
+	addr := l.Addr().String()
+	lookup := func(name string, id uint16) error {
+		req := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		req.Id = id
+		reply, _, err := c.exchangeTCP(context.Background(), req, addr)
+		if err == nil && (reply.Id != id || reply.Question[0].Name != name) {
+			t.Errorf("Unexpected reply of %s: %v", name, reply)
+		}
+		return err
+	}
+
+	dials := tcpPoolDials.Value()
+	for i := 0; i < 5; i++ {
+		if err := lookup("www.qq.com.", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := tcpPoolDials.Value() - dials; n != 1 {
+		t.Errorf("Sequential queries should share a connection, got %d dials", n)
+	}
+
+	// Queries of the same ID are pipelined apart.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if err := lookup(name, 1); err != nil {
+				t.Error(err)
+			}
+		}(dns.Fqdn(string(rune('a'+i)) + ".example.com"))
+	}
+	wg.Wait()
+
+	if err := lookup("bye.example.com.", 2); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond) // until the close is read
+	dials = tcpPoolDials.Value()
+	if err := lookup("www.qq.com.", 3); err != nil {
+		t.Fatal("Connection closed by the server should be dialed again: ", err)
+	}
+	if n := tcpPoolDials.Value() - dials; n != 1 {
+		t.Errorf("Expect a new connection, got %d dials", n)
+	}
+}
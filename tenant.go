@@ -0,0 +1,217 @@
+package gochinadns
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tenant is a named group of client networks, such as a household served by a shared resolver.
+type tenant struct {
+	name     string
+	networks []*net.IPNet
+}
+
+// tenantNetwork is a network of a tenant in tenantTable.
+type tenantNetwork struct {
+	network *net.IPNet
+	tenant  string
+}
+
+// tenantTable finds tenants of clients. Networks are sorted by prefix length in descending order,
+// so that the most specific network wins if networks of tenants overlap.
+type tenantTable struct {
+	tenants  []tenant
+	networks []tenantNetwork
+}
+
+// Lookup returns the name of the tenant client belongs to, or an empty string if none.
+func (t *tenantTable) Lookup(client net.IP) string {
+	if t == nil || client == nil {
+		return ""
+	}
+	for _, n := range t.networks {
+		if n.network.Contains(client) {
+			return n.tenant
+		}
+	}
+	return ""
+}
+
+// add adds a tenant in format `<name> <networks>`, where networks is a comma separated CIDR list.
+func (t *tenantTable) add(line string) error {
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return fmt.Errorf("expect 2 fields but got %d", len(fields))
+	}
+	tn := tenant{name: fields[0]}
+	for _, c := range strings.Split(fields[1], ",") {
+		network, err := parseCIDROrIP(c)
+		if err != nil {
+			return err
+		}
+		tn.networks = append(tn.networks, network)
+	}
+	for _, network := range tn.networks {
+		t.networks = append(t.networks, tenantNetwork{network: network, tenant: tn.name})
+	}
+	t.tenants = append(t.tenants, tn)
+	sort.SliceStable(t.networks, func(i, j int) bool {
+		li, _ := t.networks[i].network.Mask.Size()
+		lj, _ := t.networks[j].network.Mask.Size()
+		return li > lj
+	})
+	return nil
+}
+
+// WithTenants loads named tenant networks from file path, to break down stats and query logs per tenant.
+// Each line is a tenant in format `<name> <networks>`, where networks is a comma separated CIDR list,
+// such as `home-a 192.168.1.0/24,fd00:1::/64`. Clients outside the networks belong to no tenant.
+func WithTenants(path string) ServerOption {
+	return func(o *serverOptions) error {
+		if path == "" {
+			return fmt.Errorf("%w for tenants", ErrEmptyPath)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return o.ListErrors.add(fmt.Errorf("fail to open tenants: %w", err))
+		}
+		defer file.Close()
+
+		if o.Tenants == nil {
+			o.Tenants = new(tenantTable)
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			if err := o.Tenants.add(line); err != nil {
+				if err := o.ListErrors.add(fmt.Errorf("parse tenant [%s] failed: %w", line, err)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return o.ListErrors.add(fmt.Errorf("fail to scan tenants: %v", err.Error()))
+		}
+		return nil
+	}
+}
+
+// TenantStatus is the stats of a tenant in Status.
+type TenantStatus struct {
+	Name       string   `json:"name"`
+	Networks   []string `json:"networks"`
+	Queries    uint64   `json:"queries"`
+	Cached     uint64   `json:"cached"`
+	Blocked    uint64   `json:"blocked"`
+	Failed     uint64   `json:"failed"` // answered with SERVFAIL
+	AvgLatency float64  `json:"avg_latency_ms"`
+}
+
+// tenantCounters are counters of a tenant.
+type tenantCounters struct {
+	queries uint64
+	cached  uint64
+	blocked uint64
+	failed  uint64
+	latency uint64 // sum of latency in microseconds
+}
+
+// tenantStats counts queries per tenant. Counters are kept by names, so that they survive reloading tenants.
+type tenantStats struct {
+	mu       sync.RWMutex
+	counters map[string]*tenantCounters
+}
+
+func newTenantStats() *tenantStats {
+	return &tenantStats{counters: make(map[string]*tenantCounters)}
+}
+
+// get returns counters of tenant, creating them if absent.
+func (st *tenantStats) get(tenant string) *tenantCounters {
+	st.mu.RLock()
+	c := st.counters[tenant]
+	st.mu.RUnlock()
+	if c != nil {
+		return c
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if c = st.counters[tenant]; c == nil {
+		c = new(tenantCounters)
+		st.counters[tenant] = c
+	}
+	return c
+}
+
+// tenantOf returns the name of the tenant client belongs to, or an empty string if none.
+func (s *Server) tenantOf(client net.IP) string {
+	s.listsMu.RLock()
+	defer s.listsMu.RUnlock()
+	return s.Tenants.Lookup(client)
+}
+
+func (s *Server) countTenantAnswer(e *AnswerEvent) {
+	tenant := s.tenantOf(e.Client)
+	if tenant == "" {
+		return
+	}
+	c := s.tenantStats.get(tenant)
+	atomic.AddUint64(&c.queries, 1)
+	if e.Cached {
+		atomic.AddUint64(&c.cached, 1)
+	}
+	if e.Answer != nil && e.Answer.Rcode == dns.RcodeServerFailure {
+		atomic.AddUint64(&c.failed, 1)
+	}
+	atomic.AddUint64(&c.latency, uint64(e.Latency/time.Microsecond))
+}
+
+func (s *Server) countTenantBlocked(e *BlockedEvent) {
+	tenant := s.tenantOf(e.Client)
+	if tenant == "" {
+		return
+	}
+	c := s.tenantStats.get(tenant)
+	atomic.AddUint64(&c.queries, 1)
+	atomic.AddUint64(&c.blocked, 1)
+}
+
+// TenantStats returns stats of tenants, in the order they are defined.
+func (s *Server) TenantStats() []TenantStatus {
+	s.listsMu.RLock()
+	var tenants []tenant
+	if s.Tenants != nil {
+		tenants = s.Tenants.tenants
+	}
+	s.listsMu.RUnlock()
+
+	stats := make([]TenantStatus, 0, len(tenants))
+	for _, tn := range tenants {
+		ts := TenantStatus{Name: tn.name}
+		for _, n := range tn.networks {
+			ts.Networks = append(ts.Networks, n.String())
+		}
+		c := s.tenantStats.get(tn.name)
+		ts.Queries = atomic.LoadUint64(&c.queries)
+		ts.Cached = atomic.LoadUint64(&c.cached)
+		ts.Blocked = atomic.LoadUint64(&c.blocked)
+		ts.Failed = atomic.LoadUint64(&c.failed)
+		if ts.Queries > ts.Blocked {
+			ts.AvgLatency = float64(atomic.LoadUint64(&c.latency)) / float64(ts.Queries-ts.Blocked) / 1000
+		}
+		stats = append(stats, ts)
+	}
+	return stats
+}
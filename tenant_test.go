@@ -0,0 +1,70 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTenants(t *testing.T) {
+	o := newServerOptions()
+	path := writeTestList(t, "tenants", "# household networks\nhome-a 192.168.1.0/24,fd00:1::/64\nhome-b 192.168.0.0/16\n")
+	if err := WithTenants(path)(o); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyListOption(WithTenants(writeTestList(t, "bad", "home-c 192.168.3.0/33\n"))); err == nil {
+		t.Error("Invalid networks should fail")
+	}
+	s := &Server{serverOptions: o, tenantStats: newTenantStats()}
+
+	for client, tenant := range map[string]string{
+		"192.168.1.10": "home-a",
+		"fd00:1::10":   "home-a",
+		"192.168.2.10": "home-b",
+		"10.0.0.1":     "",
+	} {
+		if got := s.tenantOf(net.ParseIP(client)); got != tenant {
+			t.Errorf("Tenant of %s should be %q, got %q", client, tenant, got)
+		}
+	}
+
+	answer := newTestReply("example.com.", 60, "1.1.1.1")
+	failed := new(dns.Msg)
+	failed.Rcode = dns.RcodeServerFailure
+	s.countTenantAnswer(&AnswerEvent{Client: net.ParseIP("192.168.1.10"), Answer: answer, Latency: 10 * time.Millisecond})
+	s.countTenantAnswer(&AnswerEvent{Client: net.ParseIP("192.168.1.11"), Answer: answer, Cached: true})
+	s.countTenantAnswer(&AnswerEvent{Client: net.ParseIP("192.168.2.10"), Answer: failed, Latency: 20 * time.Millisecond})
+	s.countTenantBlocked(&BlockedEvent{Client: net.ParseIP("192.168.1.10")})
+	s.countTenantAnswer(&AnswerEvent{Client: net.ParseIP("10.0.0.1"), Answer: answer})
+
+	stats := s.TenantStats()
+	if len(stats) != 2 || stats[0].Name != "home-a" || len(stats[0].Networks) != 2 {
+		t.Fatalf("Unexpected tenant stats %+v", stats)
+	}
+	if a := stats[0]; a.Queries != 3 || a.Cached != 1 || a.Blocked != 1 || a.Failed != 0 || a.AvgLatency != 5 {
+		t.Errorf("Unexpected stats of home-a %+v", a)
+	}
+	if b := stats[1]; b.Queries != 1 || b.Failed != 1 || b.AvgLatency != 20 {
+		t.Errorf("Unexpected stats of home-b %+v", b)
+	}
+}
+
+func TestTenantsCutover(t *testing.T) {
+	s, err := NewServer(NewClient(), WithSkipRefineResolvers(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tenants configured after the server is created are counted.
+	o := newServerOptions()
+	if err = WithTenants(writeTestList(t, "tenants", "home-a 192.168.1.0/24\n"))(o); err != nil {
+		t.Fatal(err)
+	}
+	s.cutover(o, false)
+	s.hooks.emitAnswer(&AnswerEvent{Client: net.ParseIP("192.168.1.10"), Answer: newTestReply("example.com.", 60, "1.1.1.1")})
+	s.hooks.emitBlocked(&BlockedEvent{Client: net.ParseIP("192.168.1.10")})
+	if stats := s.TenantStats(); len(stats) != 1 || stats[0].Queries != 2 || stats[0].Blocked != 1 {
+		t.Errorf("Unexpected tenant stats %+v", stats)
+	}
+}
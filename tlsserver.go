@@ -0,0 +1,229 @@
+package gochinadns
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/cherrot/gochinadns/doh"
+)
+
+// DefaultDoHPath is the URL path of the DoH server by default.
+const DefaultDoHPath = "/dns-query"
+
+// dohReadTimeout limits reading headers of a DoH request, including the TLS handshake.
+const dohReadTimeout = 10 * time.Second
+
+var errNoCertificate = errors.New("DoT and DoH servers need a TLS certificate")
+
+// WithDoTListenAddr serves DNS over TLS on addr, such as `[::]:853`, so that clients like Android Private DNS
+// can query the server directly. A certificate is needed, see WithTLSCertificate. Disabled if empty.
+func WithDoTListenAddr(addr string) ServerOption {
+	return func(o *serverOptions) error {
+		o.DoTListen = addr
+		return nil
+	}
+}
+
+// WithDoHListenAddr serves DNS over HTTPS on addr, such as `[::]:443`, at path (DefaultDoHPath if empty), so that
+// browsers can query the server directly. A certificate is needed, see WithTLSCertificate. Disabled if empty.
+func WithDoHListenAddr(addr, path string) ServerOption {
+	return func(o *serverOptions) error {
+		if path == "" {
+			path = DefaultDoHPath
+		}
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("invalid DoH path: %s", path)
+		}
+		o.DoHListen, o.DoHPath = addr, path
+		return nil
+	}
+}
+
+// WithTLSCertificate loads the certificate of DoT and DoH servers from PEM files. The files are loaded again on
+// reload, so that a renewed certificate is served without restarting.
+func WithTLSCertificate(certFile, keyFile string) ServerOption {
+	return func(o *serverOptions) error {
+		if certFile == "" && keyFile == "" {
+			return nil
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("fail to load TLS certificate: %w", err)
+		}
+		o.TLSCertificate = &cert
+		return nil
+	}
+}
+
+// certificate holds the current certificate of DoT and DoH servers, which is replaced on reload.
+type certificate struct {
+	v atomic.Value // of *tls.Certificate
+}
+
+func (c *certificate) set(cert *tls.Certificate) {
+	if cert != nil {
+		c.v.Store(cert)
+	}
+}
+
+func (c *certificate) get(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := c.v.Load().(*tls.Certificate)
+	if cert == nil {
+		return nil, errNoCertificate
+	}
+	return cert, nil
+}
+
+// tlsConfig returns the TLS config of DoT and DoH servers negotiating protos by ALPN, or an error if no certificate
+// is loaded.
+func (s *Server) tlsConfig(protos ...string) (*tls.Config, error) {
+	if _, err := s.certificate.get(nil); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate: s.certificate.get,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     protos,
+	}, nil
+}
+
+// newDoTServer returns the DoT server serving on ln.
+func (s *Server) newDoTServer(ln net.Listener) (*dns.Server, error) {
+	config, err := s.tlsConfig("dot")
+	if err != nil {
+		return nil, err
+	}
+	srv := &dns.Server{Net: "tcp-tls", TLSConfig: config}
+	s.limitTCPServer(srv, ln)
+	srv.Listener = tls.NewListener(srv.Listener, config)
+	srv.Handler = s.listenerHandler("dot", ln.Addr().String())
+	return srv, nil
+}
+
+// newDoHServer returns the DoH server, which serves on a listener by ServeTLS.
+func (s *Server) newDoHServer(ln net.Listener) (*http.Server, error) {
+	config, err := s.tlsConfig("h2", "http/1.1")
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(s.DoHPath, s.dohHandler(s.listenerHandler("doh", ln.Addr().String())))
+	return &http.Server{Handler: mux, TLSConfig: config, ReadHeaderTimeout: dohReadTimeout, IdleTimeout: s.tcpIdleTimeout()}, nil
+}
+
+// dohHandler serves DoH queries in GET and POST requests (RFC 8484 section 4.1) with h.
+func (s *Server) dohHandler(h dns.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			b   []byte
+			err error
+		)
+		switch r.Method {
+		case http.MethodGet:
+			// base64url without padding, though padded ones are tolerated.
+			b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get("dns"), "="))
+		case http.MethodPost:
+			if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != doh.DoHMediaType {
+				http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+				return
+			}
+			b, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, dns.MaxMsgSize))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		req := new(dns.Msg)
+		if err == nil {
+			err = req.Unpack(b)
+		}
+		if err == nil && len(req.Question) != 1 {
+			err = errors.New("not exactly one question")
+		}
+		if err != nil {
+			http.Error(w, "bad query: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		rw := &dohResponseWriter{local: dohLocalAddr(r), remote: dohRemoteAddr(r)}
+		h.ServeDNS(rw, req)
+		if rw.msg == nil {
+			http.Error(w, "no reply", http.StatusBadGateway)
+			return
+		}
+		out, err := rw.msg.Pack()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", doh.DoHMediaType)
+		// Replies are cacheable by HTTP for their smallest TTL (RFC 8484 section 5.1).
+		if ttl, ok := minAnswerTTL(rw.msg); ok {
+			w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl)))
+		}
+		_, _ = w.Write(out)
+	})
+}
+
+// minAnswerTTL returns the smallest TTL of records in m except OPT, or false if there is none.
+func minAnswerTTL(m *dns.Msg) (ttl uint32, ok bool) {
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if !ok || rr.Header().Ttl < ttl {
+				ttl, ok = rr.Header().Ttl, true
+			}
+		}
+	}
+	return
+}
+
+func dohLocalAddr(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+func dohRemoteAddr(r *http.Request) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+// dohResponseWriter records the reply to a DoH query. Queries over DoH are served like those over TCP.
+type dohResponseWriter struct {
+	local, remote net.Addr
+	msg           *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr       { return w.local }
+func (w *dohResponseWriter) RemoteAddr() net.Addr      { return w.remote }
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error { w.msg = m; return nil }
+func (w *dohResponseWriter) Close() error              { return nil }
+func (w *dohResponseWriter) TsigStatus() error         { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool)       {}
+func (w *dohResponseWriter) Hijack()                   {}
+func (w *dohResponseWriter) Write(b []byte) (n int, err error) {
+	m := new(dns.Msg)
+	if err = m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
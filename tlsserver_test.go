@@ -0,0 +1,131 @@
+package gochinadns
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/cherrot/gochinadns/doh"
+)
+
+func TestDoHHandler(t *testing.T) {
+	s := &Server{serverOptions: newServerOptions()}
+	var remote net.Addr
+	h := s.dohHandler(dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		remote = w.RemoteAddr()
+		m := newTestReply(req.Question[0].Name, 300, "1.0.1.1")
+		m.Answer = append(m.Answer, newTestReply(req.Question[0].Name, 60, "1.0.1.2").Answer...)
+		m.SetReply(req)
+		_ = w.WriteMsg(m)
+	}))
+	req := new(dns.Msg).SetQuestion("www.qq.com.", dns.TypeA)
+	b, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(r *http.Request) {
+		r.RemoteAddr = "192.0.2.1:4433"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != doh.DoHMediaType {
+			t.Fatalf("%s: unexpected response %d %s", r.Method, w.Code, w.Body)
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "max-age=60" {
+			t.Errorf("%s: reply should be cached for the smallest TTL, got %q", r.Method, cc)
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(w.Body.Bytes()); err != nil || m.Id != req.Id || len(m.Answer) != 2 {
+			t.Errorf("%s: unexpected reply %v, %v", r.Method, m, err)
+		}
+		if remote.Network() != "tcp" || remote.String() != "192.0.2.1:4433" {
+			t.Errorf("%s: DoH queries should be served like TCP queries, got %s %s", r.Method, remote.Network(), remote)
+		}
+	}
+
+	check(httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(b), nil))
+	post := httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(b))
+	post.Header.Set("Content-Type", doh.DoHMediaType)
+	check(post)
+	post = httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(b))
+	post.Header.Set("Content-Type", doh.DoHMediaType+"; charset=binary")
+	check(post)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dns-query?dns=bad", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Malformed query should be rejected, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/dns-query", bytes.NewReader(b)))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Query without the media type should be rejected, got %d", w.Code)
+	}
+}
+
+func TestDoTServer(t *testing.T) {
+	s := &Server{serverOptions: newServerOptions()}
+	if _, err := s.newDoTServer(nil); err != errNoCertificate {
+		t.Fatalf("DoT server should need a certificate, got %v", err)
+	}
+	s.certificate.set(newTestCertificate(t))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := s.newDoTServer(ln)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Handler = dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := newTestReply(req.Question[0].Name, 60, "1.0.1.1")
+		m.SetReply(req)
+		_ = w.WriteMsg(m)
+	})
+	go srv.ActivateAndServe() //nolint:errcheck
+	defer srv.Shutdown()      //nolint:errcheck
+
+	cli := &dns.Client{Net: "tcp-tls", Timeout: time.Second, TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	var rep *dns.Msg
+	for i := 0; i < 10; i++ { // until the server starts
+		if rep, _, err = cli.Exchange(new(dns.Msg).SetQuestion("www.qq.com.", dns.TypeA), ln.Addr().String()); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || len(rep.Answer) != 1 {
+		t.Fatalf("Unexpected DoT reply %v, %v", rep, err)
+	}
+}
+
+// newTestCertificate returns a self-signed certificate of localhost.
+func newTestCertificate(t *testing.T) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
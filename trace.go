@@ -0,0 +1,43 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// traceField is the log field of trace IDs.
+const traceField = "trace"
+
+// traceSeq numbers queries for trace IDs. It starts at random, so that IDs of a restarted server are unlikely to
+// repeat those in logs of the last run.
+var traceSeq = uint32(rand.New(rand.NewSource(time.Now().UnixNano())).Int63())
+
+// newTraceID returns the trace ID of a query, which is logged in the trace field of all logs of the query, so that
+// interleaved logs can be told apart.
+func newTraceID() string {
+	return fmt.Sprintf("%08x", atomic.AddUint32(&traceSeq, 1))
+}
+
+type traceKey struct{}
+
+func withTraceID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, traceKey{}, id)
+}
+
+func traceIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(traceKey{}).(string)
+	return id
+}
+
+// logEntry returns the logger of ctx, which carries the trace ID of the query of ctx if any.
+func logEntry(ctx context.Context) *logrus.Entry {
+	if id := traceIDFromContext(ctx); id != "" {
+		return logrus.WithField(traceField, id)
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
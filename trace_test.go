@@ -0,0 +1,54 @@
+package gochinadns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestTraceIDs(t *testing.T) {
+	addr := startTestUpstream(t)
+	s, err := NewServer(NewClient(WithTimeout(time.Second)), WithSkipRefineResolvers(true), WithTrustedResolvers(false, "udp@"+addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := test.NewLocal(logrus.StandardLogger())
+	defer hook.Reset()
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.DebugLevel)
+	defer logrus.SetLevel(level)
+
+	for _, name := range []string{"www.example.com.", "www.example.org."} {
+		s.Serve(newFakeResponseWriter("192.168.1.20"), new(dns.Msg).SetQuestion(name, dns.TypeA))
+	}
+	traces := make(map[string]string) // by question
+	upstreamLogs := 0
+	for _, e := range hook.AllEntries() {
+		question, _ := e.Data["question"].(string)
+		if question == "" {
+			continue
+		}
+		trace, _ := e.Data[traceField].(string)
+		if trace == "" {
+			t.Errorf("Log %q of %s has no trace ID", e.Message, question)
+			continue
+		}
+		if traces[question] == "" {
+			traces[question] = trace
+		} else if traces[question] != trace {
+			t.Errorf("Log %q of %s has trace ID %s, expect %s", e.Message, question, trace, traces[question])
+		}
+		if e.Data["server"] != nil {
+			upstreamLogs++
+		}
+	}
+	if len(traces) != 2 || traces["www.example.com. A"] == traces["www.example.org. A"] {
+		t.Errorf("Queries should have their own trace IDs, got %v", traces)
+	}
+	if upstreamLogs == 0 {
+		t.Error("Logs of upstream lookups should be traced")
+	}
+}
@@ -0,0 +1,144 @@
+package gochinadns
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxKeepaliveTimeout is the max idle timeout which can be advertised by edns-tcp-keepalive, in units of 100ms.
+const maxKeepaliveTimeout = 0xffff * 100 * time.Millisecond
+
+// clientLimits are constraints of the transport a client queried over, which replies to it must conform to.
+type clientLimits struct {
+	tcp     bool
+	edns    bool   // the client supports EDNS (RFC 6891)
+	do      bool   // the client sets the DO bit, accepting DNSSEC records (RFC 3225)
+	udpSize int    // max size of UDP replies
+	qtype   uint16 // type of the question, kept even if it's a DNSSEC type
+
+	keepalive time.Duration // idle timeout advertised by edns-tcp-keepalive (RFC 7828), or 0 if not asked for
+}
+
+// newClientLimits records limits of req received from w. It should be called before req is normalized.
+// idle is the idle timeout of TCP connections, advertised to TCP clients asking for it by edns-tcp-keepalive.
+func newClientLimits(w dns.ResponseWriter, req *dns.Msg, idle time.Duration) clientLimits {
+	l := clientLimits{tcp: w.RemoteAddr().Network() == "tcp", udpSize: dns.MinMsgSize, qtype: req.Question[0].Qtype}
+	if opt := req.IsEdns0(); opt != nil {
+		l.edns = true
+		l.do = opt.Do()
+		if size := int(opt.UDPSize()); size > dns.MinMsgSize {
+			l.udpSize = size
+		}
+		// The option is ignored over UDP (RFC 7828 section 3.2.1).
+		if l.tcp && hasEDNSOption(opt, dns.EDNS0TCPKEEPALIVE) {
+			l.keepalive = idle
+			if l.keepalive > maxKeepaliveTimeout {
+				l.keepalive = maxKeepaliveTimeout
+			}
+		}
+	}
+	return l
+}
+
+func (l clientLimits) transport() string {
+	if l.tcp {
+		return "tcp"
+	}
+	return "udp"
+}
+
+// fit returns a reply conforming to l. The OPT record is removed if the client doesn't support EDNS,
+// DNSSEC records are removed if the client doesn't set the DO bit (RFC 4035 section 3.2.1),
+// and UDP replies larger than the client accepts are truncated with TC set, so that the client retries over TCP.
+// edns-tcp-keepalive options of upstreams are replaced by ours, since they are about connections to upstreams.
+// m is copied if changed.
+func (l clientLimits) fit(m *dns.Msg) *dns.Msg {
+	if opt := m.IsEdns0(); l.keepalive > 0 || opt != nil && hasEDNSOption(opt, dns.EDNS0TCPKEEPALIVE) {
+		m = m.Copy()
+		opt := m.IsEdns0()
+		if opt == nil {
+			m.SetEdns0(dns.DefaultMsgSize, false)
+			opt = m.IsEdns0()
+		}
+		opt.Option = removeEDNSOption(opt.Option, dns.EDNS0TCPKEEPALIVE)
+		if timeout := uint16(l.keepalive / (100 * time.Millisecond)); timeout > 0 {
+			opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Length: 2, Timeout: timeout})
+		}
+	}
+	if opt := m.IsEdns0(); !l.do && (opt != nil && opt.Do() || hasDNSSECRecords(m, l.qtype)) {
+		m = m.Copy()
+		m.Answer = stripDNSSECRecords(m.Answer, l.qtype)
+		m.Ns = stripDNSSECRecords(m.Ns, l.qtype)
+		m.Extra = stripDNSSECRecords(m.Extra, l.qtype)
+		if opt := m.IsEdns0(); opt != nil {
+			opt.SetDo(false)
+		}
+	}
+	if !l.edns && m.IsEdns0() != nil {
+		m = m.Copy()
+		extra := m.Extra[:0]
+		for _, rr := range m.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		m.Extra = extra
+	}
+	if !l.tcp && m.Len() > l.udpSize {
+		m = m.Copy()
+		m.Truncate(l.udpSize)
+	}
+	return m
+}
+
+// isDNSSECType tells whether t is a type of DNSSEC records, which are only returned to clients setting the DO bit.
+func isDNSSECType(t uint16) bool {
+	switch t {
+	case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+		return true
+	}
+	return false
+}
+
+func hasDNSSECRecords(m *dns.Msg, qtype uint16) bool {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if t := rr.Header().Rrtype; t != qtype && isDNSSECType(t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stripDNSSECRecords removes DNSSEC records from rrs in place, except ones of qtype.
+func stripDNSSECRecords(rrs []dns.RR, qtype uint16) []dns.RR {
+	result := rrs[:0]
+	for _, rr := range rrs {
+		if t := rr.Header().Rrtype; t == qtype || !isDNSSECType(t) {
+			result = append(result, rr)
+		}
+	}
+	return result
+}
+
+func hasEDNSOption(opt *dns.OPT, code uint16) bool {
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// removeEDNSOption returns options without those of code. options is changed in place.
+func removeEDNSOption(options []dns.EDNS0, code uint16) []dns.EDNS0 {
+	result := options[:0]
+	for _, o := range options {
+		if o.Option() != code {
+			result = append(result, o)
+		}
+	}
+	return result
+}
@@ -0,0 +1,117 @@
+package gochinadns
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientLimitsFit(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	for i := 0; i < 64; i++ {
+		reply.Answer = append(reply.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.IPv4(10, 0, 0, byte(i)),
+		})
+	}
+	reply.SetEdns0(4096, false)
+
+	udp := newClientLimits(newFakeResponseWriter("127.0.0.1"), req, defaultTCPIdleTimeout)
+	m := udp.fit(reply)
+	if m.IsEdns0() != nil {
+		t.Error("OPT record should be removed for clients without EDNS")
+	}
+	if !m.Truncated || m.Len() > dns.MinMsgSize {
+		t.Errorf("Reply of %d bytes should be truncated to %d", m.Len(), dns.MinMsgSize)
+	}
+	if len(reply.Answer) != 64 || reply.IsEdns0() == nil {
+		t.Error("Original reply should not be changed")
+	}
+
+	req.SetEdns0(1232, false)
+	if m := newClientLimits(newFakeResponseWriter("127.0.0.1"), req, defaultTCPIdleTimeout).fit(reply); m.Truncated || m.IsEdns0() == nil {
+		t.Error("Reply fitting the EDNS UDP size should be kept")
+	}
+
+	w := newFakeResponseWriter("127.0.0.1")
+	w.remote = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}
+	tcp := newClientLimits(w, req, defaultTCPIdleTimeout)
+	if tcp.transport() != "tcp" {
+		t.Errorf("Unexpected transport %s", tcp.transport())
+	}
+}
+
+func TestClientLimitsFitDNSSEC(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.", dns.TypeA)
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.Answer = []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "www.example.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("10.0.0.1")},
+		&dns.RRSIG{Hdr: dns.RR_Header{Name: "www.example.", Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 60}, TypeCovered: dns.TypeA},
+	}
+	reply.SetEdns0(4096, true)
+
+	req.SetEdns0(4096, false)
+	m := newClientLimits(newFakeResponseWriter("127.0.0.1"), req, defaultTCPIdleTimeout).fit(reply)
+	if len(m.Answer) != 1 || m.IsEdns0().Do() {
+		t.Errorf("DNSSEC records should be removed for clients without DO: %v", m)
+	}
+	if len(reply.Answer) != 2 {
+		t.Error("Original reply should not be changed")
+	}
+
+	req.IsEdns0().SetDo()
+	if m := newClientLimits(newFakeResponseWriter("127.0.0.1"), req, defaultTCPIdleTimeout).fit(reply); len(m.Answer) != 2 {
+		t.Error("DNSSEC records should be kept for clients with DO")
+	}
+}
+
+func TestClientLimitsKeepalive(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(1232, false)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	reply := new(dns.Msg)
+	reply.SetReply(req)
+	reply.SetEdns0(1232, false)
+	reply.IsEdns0().Option = append(reply.IsEdns0().Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE, Length: 2, Timeout: 1200})
+
+	keepalive := func(m *dns.Msg) *dns.EDNS0_TCP_KEEPALIVE {
+		if opt := m.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if o, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+					return o
+				}
+			}
+		}
+		return nil
+	}
+	if m := newClientLimits(newFakeResponseWriter("127.0.0.1"), req, 30*time.Second).fit(reply); keepalive(m) != nil {
+		t.Errorf("Keepalive of upstreams should be removed over UDP, got %v", keepalive(m))
+	}
+	if keepalive(reply).Timeout != 1200 {
+		t.Error("Original reply should not be changed")
+	}
+
+	w := newFakeResponseWriter("127.0.0.1")
+	w.remote = &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 5353}
+	if m := newClientLimits(w, req, 30*time.Second).fit(reply); keepalive(m) == nil || keepalive(m).Timeout != 300 {
+		t.Errorf("Our idle timeout should be advertised over TCP, got %v", keepalive(m))
+	}
+	empty := new(dns.Msg)
+	empty.SetReply(req)
+	if m := newClientLimits(w, req, 30*time.Second).fit(empty); keepalive(m) == nil || keepalive(m).Timeout != 300 {
+		t.Errorf("Our idle timeout should be advertised in replies without OPT, got %v", m)
+	}
+
+	req.IsEdns0().Option = nil
+	if m := newClientLimits(w, req, 30*time.Second).fit(reply); keepalive(m) != nil {
+		t.Errorf("Keepalive should not be advertised to clients not asking for it, got %v", keepalive(m))
+	}
+}
@@ -1,6 +1,7 @@
 package gochinadns
 
 import (
+	"bytes"
 	"strings"
 )
 
@@ -10,35 +11,44 @@ type domainTrie struct {
 }
 
 func (tr *domainTrie) Add(domain string) {
-	domain = strings.TrimSpace(domain)
-	if domain == "" {
+	tr.addBytes([]byte(domain))
+}
+
+// addBytes adds domain to the trie. Labels are only copied into strings for new nodes,
+// so that loading a large list with many shared suffixes creates little garbage.
+func (tr *domainTrie) addBytes(domain []byte) {
+	domain = bytes.TrimSpace(domain)
+	if len(domain) == 0 {
 		return
 	}
 
-	domain = strings.Trim(domain, ".")
+	domain = bytes.Trim(domain, ".")
 	// "." contains all domains
-	if domain == "" {
+	if len(domain) == 0 {
 		tr.end = true
 		tr.children = nil
 		return
 	}
 
 	node := tr
-	labels := strings.Split(domain, ".")
-	for i := len(labels) - 1; i >= 0; i-- {
+	for end := len(domain); end >= 0; {
 		// domain is already contained in this trie.
 		if node.end {
 			return
 		}
 
-		if node.children == nil {
-			node.children = make(map[string]*domainTrie)
-		}
-		label := labels[i]
-		if node.children[label] == nil {
-			node.children[label] = new(domainTrie)
+		i := bytes.LastIndexByte(domain[:end], '.')
+		label := domain[i+1 : end]
+		child := node.children[string(label)]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[string]*domainTrie)
+			}
+			child = new(domainTrie)
+			node.children[string(label)] = child
 		}
-		node = node.children[label]
+		node = child
+		end = i
 	}
 	node.end = true
 }
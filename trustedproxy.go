@@ -0,0 +1,48 @@
+package gochinadns
+
+import (
+	"net/url"
+
+	"github.com/cherrot/gochinadns/proxy"
+)
+
+// WithTrustedProxy queries trusted servers through the proxy at proxyURL, in format socks5://[user:pass@]host:port
+// or http://[user:pass@]host:port (HTTP CONNECT). Proxies only relay TCP, so UDP queries to trusted servers are sent
+// over TCP instead, while DoT and DoH queries are tunneled as is. Untrusted servers are always queried directly.
+func WithTrustedProxy(proxyURL string) ServerOption {
+	return func(o *serverOptions) error {
+		if _, err := proxy.New(proxyURL, 0); err != nil {
+			return err
+		}
+		o.TrustedProxy = proxyURL
+		return nil
+	}
+}
+
+// newProxyClient creates a client like cli, which dials through the proxy at proxyURL.
+func newProxyClient(cli *Client, proxyURL string) (*Client, error) {
+	dial, err := proxy.New(proxyURL, cli.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	o := *cli.clientOptions
+	o.Dial = dial
+	return newClient(&o), nil
+}
+
+// trustedClient returns the client to query trusted servers with.
+func (s *Server) trustedClient() *Client {
+	if s.proxyCli != nil {
+		return s.proxyCli
+	}
+	return s.Client
+}
+
+// redactedProxy returns TrustedProxy with its password masked.
+func (s *Server) redactedProxy() string {
+	u, err := url.Parse(s.TrustedProxy)
+	if err != nil {
+		return ""
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,119 @@
+package gochinadns
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startSOCKS5 starts a minimal no-auth SOCKS5 proxy, which sends each target it connects to targets.
+func startSOCKS5(t *testing.T, targets chan<- string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 262)
+				// Greeting with 1 method, and CONNECT to an IPv4 address.
+				if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+					return
+				}
+				_, _ = conn.Write([]byte{5, 0})
+				if _, err := io.ReadFull(conn, buf[:10]); err != nil || buf[3] != 1 {
+					return
+				}
+				target := net.JoinHostPort(net.IP(buf[4:8]).String(), strconv.Itoa(int(binary.BigEndian.Uint16(buf[8:10]))))
+				targets <- target
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer upstream.Close()
+				_, _ = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+				go func() { _, _ = io.Copy(upstream, conn) }()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestTrustedProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := &dns.Server{Listener: ln, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP("142.250.1.1"),
+		})
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = upstream.ActivateAndServe() }()
+	defer func() { _ = upstream.Shutdown() }()
+
+	targets := make(chan string, 4)
+	o := newServerOptions()
+	if err = WithTrustedProxy("socks5://" + startSOCKS5(t, targets))(o); err != nil {
+		t.Fatal(err)
+	}
+	cli := NewClient(WithTimeout(2 * time.Second))
+	s := &Server{serverOptions: o, Client: cli}
+	if s.proxyCli, err = newProxyClient(cli, o.TrustedProxy); err != nil {
+		t.Fatal(err)
+	}
+
+	// Declared as UDP, which can't go through the proxy.
+	r, err := ParseResolver("udp@"+ln.Addr().String(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.proxyCli.protocolsOf(r); len(got) != 1 || got[0] != "tcp" {
+		t.Fatalf("protocols through proxy = %v, want [tcp]", got)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.google.com.", dns.TypeA)
+	reply, _, err := s.lookupTrusted(context.Background(), req, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ips := answerIPs(reply); len(ips) != 1 || !ips[0].Equal(net.ParseIP("142.250.1.1")) {
+		t.Fatalf("answer = %v", reply.Answer)
+	}
+	select {
+	case target := <-targets:
+		if target != ln.Addr().String() {
+			t.Fatalf("proxied to %s, want %s", target, ln.Addr())
+		}
+	default:
+		t.Fatal("query didn't go through the proxy")
+	}
+}
+
+func TestWithTrustedProxyInvalid(t *testing.T) {
+	for _, u := range []string{"socks4://127.0.0.1:1080", "127.0.0.1:1080", "http://"} {
+		if err := WithTrustedProxy(u)(newServerOptions()); err == nil {
+			t.Errorf("WithTrustedProxy(%q) succeeded, want error", u)
+		}
+	}
+}
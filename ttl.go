@@ -0,0 +1,39 @@
+package gochinadns
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// WithTTLClamp clamps TTLs of records in the answer section of replies from upstreams into [min, max],
+// before they are cached and returned, so that short TTLs (e.g. of CDNs) don't hammer upstreams, and long TTLs
+// don't pin stale data. A bound of 0 is disabled. TTLs are in whole seconds.
+func WithTTLClamp(min, max time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		if min < 0 || max < 0 || (max > 0 && min > max) {
+			return fmt.Errorf("invalid TTL bounds: min %s, max %s", min, max)
+		}
+		o.MinTTL = min
+		o.MaxTTL = max
+		return nil
+	}
+}
+
+// clampTTLs clamps TTLs of records in the answer section of m by MinTTL and MaxTTL.
+func (s *Server) clampTTLs(m *dns.Msg) {
+	if s.MinTTL <= 0 && s.MaxTTL <= 0 {
+		return
+	}
+	min, max := uint32(s.MinTTL/time.Second), uint32(s.MaxTTL/time.Second)
+	for _, rr := range m.Answer {
+		h := rr.Header()
+		if h.Ttl < min {
+			h.Ttl = min
+		}
+		if max > 0 && h.Ttl > max {
+			h.Ttl = max
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package gochinadns
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestClampTTLs(t *testing.T) {
+	if err := WithTTLClamp(time.Hour, time.Minute)(newServerOptions()); err == nil {
+		t.Error("Min TTL above max TTL should fail")
+	}
+	o := newServerOptions()
+	if err := WithTTLClamp(time.Minute, time.Hour)(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o}
+
+	m := newTestReply("example.com", 10, "1.1.1.1")
+	m.Answer = append(m.Answer, newTestReply("example.com", 86400, "1.0.0.1").Answer...)
+	m.Answer = append(m.Answer, newTestReply("example.com", 300, "8.8.8.8").Answer...)
+	m.SetEdns0(dns.DefaultMsgSize, false)
+	s.clampTTLs(m)
+	for i, want := range []uint32{60, 3600, 300} {
+		if got := m.Answer[i].Header().Ttl; got != want {
+			t.Errorf("TTL of answer %d should be %d, got %d", i, want, got)
+		}
+	}
+	if ttl, _ := cacheTTL(m); ttl != 60 {
+		t.Errorf("Reply should be cached for the clamped TTL, got %d", ttl)
+	}
+}
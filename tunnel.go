@@ -0,0 +1,229 @@
+package gochinadns
+
+import (
+	"container/list"
+	"expvar"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Actions on clients tunneling through DNS. See WithTunnelDetection.
+const (
+	TunnelAlert = "alert" // log a warning and count them only
+	TunnelBlock = "block" // also block their queries under the domain for a window
+)
+
+// Reasons of detecting a tunnel, which are keys of chinadns_tunnels.
+const (
+	tunnelSubdomains = "subdomains"  // too many unique names under the domain
+	tunnelLongLabels = "long_labels" // most names under the domain have long labels
+	tunnelTXT        = "txt"         // most queries under the domain are of TXT or NULL
+)
+
+const (
+	// tunnelMinQueries is the number of queries of a client under a domain in a window before the share of long
+	// labels and TXT queries is judged.
+	tunnelMinQueries = 20
+	// maxTunnelPairs bounds the number of pairs of clients and domains tracked in a window, beyond which the least
+	// recently active pair is evicted.
+	maxTunnelPairs = 1024
+)
+
+var tunnels = expvar.NewMap("chinadns_tunnels")
+
+// WithTunnelDetection detects clients tunneling data through DNS queries under a domain in each window, by too many
+// unique names, mostly long labels, or mostly TXT and NULL queries under the domain, see WithTunnelThresholds.
+// Detections are logged and counted by reason in chinadns_tunnels, and dealt with by action, see TunnelXXX.
+// Domains are told by the public suffix list, like example.com.cn or user.github.io. Names in the domain whitelist
+// and reverse lookups are never tracked. Disabled if window is 0.
+func WithTunnelDetection(window time.Duration, action string) ServerOption {
+	return func(o *serverOptions) error {
+		if window < 0 {
+			return fmt.Errorf("invalid tunnel detection window: %s", window)
+		}
+		switch action {
+		case TunnelAlert, TunnelBlock:
+		default:
+			return fmt.Errorf("unknown tunnel action [%s], expect alert or block", action)
+		}
+		o.TunnelWindow, o.TunnelAction = window, action
+		return nil
+	}
+}
+
+// WithTunnelThresholds sets thresholds of WithTunnelDetection: labels of labelLen characters or more are long, more
+// than subdomains unique names under a domain in a window are too many, and TXT and NULL queries of txtRatio of all
+// queries under a domain or more are too many. They are 40, 100 and 0.5 by default.
+func WithTunnelThresholds(labelLen, subdomains int, txtRatio float64) ServerOption {
+	return func(o *serverOptions) error {
+		if labelLen <= 0 || labelLen > 63 || subdomains <= 0 || txtRatio <= 0 || txtRatio > 1 {
+			return fmt.Errorf("invalid tunnel thresholds: label length %d, %d subdomains, TXT ratio %v", labelLen, subdomains, txtRatio)
+		}
+		o.TunnelLabelLen, o.TunnelSubdomains, o.TunnelTXTRatio = labelLen, subdomains, txtRatio
+		return nil
+	}
+}
+
+// tunnelDetector tracks queries of clients under domains in fixed windows. A nil detector is disabled.
+type tunnelDetector struct {
+	window     time.Duration
+	labelLen   int
+	subdomains int
+	txtRatio   float64
+	action     string
+
+	mu      sync.Mutex
+	start   time.Time                    // of the current window
+	stats   map[tunnelPair]*list.Element // of *tunnelStats in lru
+	lru     *list.List                   // the most recently active at the front
+	blocked map[tunnelPair]time.Time     // until when
+}
+
+// tunnelPair is a client (see rateLimitKey) querying names under a domain.
+type tunnelPair struct {
+	client, domain string
+}
+
+type tunnelStats struct {
+	pair                     tunnelPair
+	queries, txt, longLabels int
+	names                    map[string]struct{} // unique names, up to one more than the threshold
+	detected                 bool
+}
+
+// newTunnelDetector returns a detector for the options, or nil if detection is disabled.
+func newTunnelDetector(o *serverOptions) *tunnelDetector {
+	if o.TunnelWindow <= 0 {
+		return nil
+	}
+	return &tunnelDetector{
+		window:     o.TunnelWindow,
+		labelLen:   o.TunnelLabelLen,
+		subdomains: o.TunnelSubdomains,
+		txtRatio:   o.TunnelTXTRatio,
+		action:     o.TunnelAction,
+		stats:      make(map[tunnelPair]*list.Element),
+		lru:        list.New(),
+		blocked:    make(map[tunnelPair]time.Time),
+	}
+}
+
+// tunnelDomain returns the domain name is under, i.e. its public suffix and one more label, like example.com.cn or
+// user.github.io. It returns an empty string if name has no more labels than that.
+func tunnelDomain(name string) string {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil || domain == name {
+		return ""
+	}
+	return domain + "."
+}
+
+// observe tracks q of client at now, and returns the reason if the client is detected tunneling under the domain of
+// q, and whether q should be blocked.
+func (d *tunnelDetector) observe(client net.IP, q *dns.Question, now time.Time) (reason string, block bool) {
+	if d == nil {
+		return "", false
+	}
+	domain := tunnelDomain(q.Name)
+	if domain == "" {
+		return "", false
+	}
+	pair := tunnelPair{client: rateLimitKey(client), domain: domain}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if until, ok := d.blocked[pair]; ok {
+		if now.Before(until) {
+			return "", true
+		}
+		delete(d.blocked, pair)
+	}
+	if now.Sub(d.start) >= d.window {
+		d.start = now
+		d.stats = make(map[tunnelPair]*list.Element)
+		d.lru.Init()
+	}
+	var st *tunnelStats
+	if e := d.stats[pair]; e != nil {
+		d.lru.MoveToFront(e)
+		st = e.Value.(*tunnelStats)
+	} else {
+		if d.lru.Len() >= maxTunnelPairs {
+			oldest := d.lru.Back()
+			delete(d.stats, oldest.Value.(*tunnelStats).pair)
+			d.lru.Remove(oldest)
+		}
+		st = &tunnelStats{pair: pair, names: make(map[string]struct{})}
+		d.stats[pair] = d.lru.PushFront(st)
+	}
+	if st.detected {
+		return "", false
+	}
+
+	name := strings.ToLower(q.Name)
+	st.queries++
+	if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeNULL {
+		st.txt++
+	}
+	for _, label := range dns.SplitDomainName(strings.TrimSuffix(name, domain)) {
+		if len(label) >= d.labelLen {
+			st.longLabels++
+			break
+		}
+	}
+	if len(st.names) <= d.subdomains {
+		st.names[name] = struct{}{}
+	}
+	switch {
+	case len(st.names) > d.subdomains:
+		reason = tunnelSubdomains
+	case st.queries < tunnelMinQueries:
+		return "", false
+	case float64(st.longLabels) >= float64(st.queries)/2:
+		reason = tunnelLongLabels
+	case float64(st.txt) >= float64(st.queries)*d.txtRatio:
+		reason = tunnelTXT
+	default:
+		return "", false
+	}
+	st.detected = true
+	if d.action == TunnelBlock {
+		d.blocked[pair] = now.Add(d.window)
+	}
+	return reason, d.action == TunnelBlock
+}
+
+// tunnelReply tracks req of client, and returns the reply blocking it if the client is detected tunneling under the
+// domain of req. Otherwise it returns nil.
+func (s *Server) tunnelReply(req *dns.Msg, client net.IP) *dns.Msg {
+	if s.tunnels == nil {
+		return nil
+	}
+	q := &req.Question[0]
+	if dns.IsSubDomain("arpa.", strings.ToLower(q.Name)) {
+		return nil
+	}
+	s.listsMu.RLock()
+	whitelisted := s.DomainWhitelist.Contain(q.Name)
+	s.listsMu.RUnlock()
+	if whitelisted {
+		return nil
+	}
+	reason, block := s.tunnels.observe(client, q, s.Clock.Now())
+	if reason != "" {
+		tunnels.Add(reason, 1)
+		logrus.WithFields(logrus.Fields{"client": client, "domain": RedactName(tunnelDomain(q.Name)), "reason": reason}).
+			Warnf("Client is likely tunneling through DNS. Action: %s.", s.TunnelAction)
+	}
+	if !block {
+		return nil
+	}
+	return s.blockedReply(req)
+}
@@ -0,0 +1,127 @@
+package gochinadns
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cherrot/gochinadns/clock"
+	"github.com/miekg/dns"
+)
+
+func TestTunnelDomain(t *testing.T) {
+	for name, want := range map[string]string{
+		"a.b.example.com.":    "example.com.",
+		"WWW.Example.COM":     "example.com.",
+		"x.y.example.com.cn.": "example.com.cn.",
+		"x.example.co.uk.":    "example.co.uk.",
+		"example.com.":        "",
+		"com.cn.":             "",
+		"x.google.com.hk.":    "google.com.hk.",
+		"a.b.user.github.io.": "user.github.io.",
+		"x.example.gov.cn.":   "example.gov.cn.",
+		"github.io.":          "",
+		".":                   "",
+	} {
+		if got := tunnelDomain(name); got != want {
+			t.Errorf("%s: expect domain %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestTunnelDetection(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1600000000, 0))
+	s, err := NewServer(NewClient(),
+		WithSkipRefineResolvers(true),
+		WithClock(clk),
+		WithTunnelDetection(time.Minute, TunnelBlock),
+		WithTunnelThresholds(30, 50, 0.5),
+		WithDomainWhitelist(writeTestList(t, "whitelist", "cdn.example.net\n")),
+		WithBlockResponse(BlockNXDomain),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunneler, other := net.ParseIP("192.168.1.20"), net.ParseIP("192.168.1.21")
+	query := func(client net.IP, name string, qtype uint16) *dns.Msg {
+		return s.tunnelReply(new(dns.Msg).SetQuestion(name, qtype), client)
+	}
+
+	// Too many unique names.
+	for i := 0; i < 50; i++ {
+		if m := query(tunneler, "n"+strconv.Itoa(i)+".t.example.com.", dns.TypeA); m != nil {
+			t.Fatalf("Query %d should not be blocked yet", i)
+		}
+	}
+	if m := query(tunneler, "n50.t.example.com.", dns.TypeA); m == nil || m.Rcode != dns.RcodeNameError {
+		t.Fatalf("Client querying too many names should be blocked, got %v", m)
+	}
+	if m := query(tunneler, "www.example.com.", dns.TypeA); m == nil {
+		t.Error("Client should stay blocked under the domain")
+	}
+	if query(tunneler, "www.example.org.", dns.TypeA) != nil || query(other, "www.example.com.", dns.TypeA) != nil {
+		t.Error("Other domains and clients should not be blocked")
+	}
+	clk.Advance(time.Minute)
+	if m := query(tunneler, "www.example.com.", dns.TypeA); m != nil {
+		t.Error("Client should be unblocked after a window")
+	}
+
+	// Mostly long labels, or mostly TXT queries, which are judged after some queries.
+	long := strings.Repeat("a", 30)
+	for i := 0; i < tunnelMinQueries-1; i++ {
+		query(other, long+".x"+strconv.Itoa(i%5)+".tunnel.org.", dns.TypeA)
+		query(other, "x"+strconv.Itoa(i%5)+".txt.org.", dns.TypeTXT)
+		query(other, "x"+strconv.Itoa(i%5)+".cdn.example.net.", dns.TypeTXT)
+	}
+	if query(other, long+".y.tunnel.org.", dns.TypeA) == nil || query(other, "y.txt.org.", dns.TypeNULL) == nil {
+		t.Error("Client querying mostly long labels or TXT records should be blocked")
+	}
+	if query(other, "y.cdn.example.net.", dns.TypeTXT) != nil || query(other, "1.1.168.192.in-addr.arpa.", dns.TypePTR) != nil {
+		t.Error("Whitelisted domains and reverse lookups should not be tracked")
+	}
+
+	for _, f := range []ServerOption{WithTunnelDetection(time.Minute, "drop"), WithTunnelThresholds(64, 100, 0.5), WithTunnelThresholds(40, 100, 0)} {
+		if err := f(newServerOptions()); err == nil {
+			t.Error("Invalid tunnel option should fail")
+		}
+	}
+}
+
+func TestTunnelPairEviction(t *testing.T) {
+	o := newServerOptions()
+	if err := WithTunnelDetection(time.Minute, TunnelAlert)(o); err != nil {
+		t.Fatal(err)
+	}
+	if err := WithTunnelThresholds(40, 12, 0.5)(o); err != nil {
+		t.Fatal(err)
+	}
+	d := newTunnelDetector(o)
+	now := time.Unix(1600000000, 0)
+	tunneler := net.ParseIP("192.168.1.20")
+	observe := func(client net.IP, name string) string {
+		reason, _ := d.observe(client, &dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}, now)
+		return reason
+	}
+
+	observe(tunneler, "n0.t.example.com.")
+	// New pairs still get tracked when the table is full, evicting the least recently active ones.
+	for i := 0; i < maxTunnelPairs; i++ {
+		if i%100 == 0 {
+			observe(tunneler, "n"+strconv.Itoa(i/100+1)+".t.example.com.")
+		}
+		observe(net.IPv4(10, 0, byte(i>>8), byte(i)), "www.example"+strconv.Itoa(i)+".com.")
+	}
+	if len(d.stats) != maxTunnelPairs || d.lru.Len() != maxTunnelPairs {
+		t.Fatalf("Expect %d pairs tracked, got %d", maxTunnelPairs, len(d.stats))
+	}
+	if _, ok := d.stats[tunnelPair{client: rateLimitKey(net.IPv4(10, 0, 0, 0)), domain: "example0.com."}]; ok {
+		t.Error("The least recently active pair should be evicted")
+	}
+	// The active pair was kept along with its names.
+	if reason := observe(tunneler, "n99.t.example.com."); reason != tunnelSubdomains {
+		t.Errorf("Active pair should be kept and detected, got reason %q", reason)
+	}
+}
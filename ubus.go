@@ -0,0 +1,90 @@
+package gochinadns
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/cherrot/gochinadns/ubus"
+)
+
+const (
+	// ubusObject is the path of the ubus object of the server, called like `ubus call chinadns status`.
+	ubusObject = "chinadns"
+	// ubusRetryInterval is the interval to connect to ubusd again if it's unavailable or restarted.
+	ubusRetryInterval = 5 * time.Second
+)
+
+// WithUbus registers the server on OpenWrt's ubus at the ubusd socket path (ubus.DefaultSocket if empty),
+// as object `chinadns` with methods `status` and `reload`, for LuCI and scripts. Disabled if not set.
+func WithUbus(socket string) ServerOption {
+	return func(o *serverOptions) error {
+		if socket == "" {
+			socket = ubus.DefaultSocket
+		}
+		o.UbusSocket = socket
+		return nil
+	}
+}
+
+// runUbus keeps the server registered on ubus until ctx is done. It connects again if ubusd restarts.
+func (s *Server) runUbus(ctx context.Context) {
+	if s.UbusSocket == "" {
+		return
+	}
+	methods := map[string]ubus.Method{
+		"status": s.ubusStatus,
+		"reload": s.ubusReload,
+	}
+	for {
+		conn, err := ubus.Dial(s.UbusSocket, ubusRetryInterval)
+		if err == nil {
+			if err = conn.AddObject(ubusObject, methods); err == nil {
+				logrus.Info("Registered on ubus as ", ubusObject)
+				stop := make(chan struct{})
+				go func() {
+					select {
+					case <-ctx.Done():
+						_ = conn.Close()
+					case <-stop:
+					}
+				}()
+				err = conn.Serve()
+				close(stop)
+			}
+			_ = conn.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.WithError(err).Warn("Disconnected from ubus. Will retry.")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(ubusRetryInterval):
+		}
+	}
+}
+
+// ubusStatus replies the status document of the server, the same as /status of the admin API.
+func (s *Server) ubusStatus(map[string]interface{}) (map[string]interface{}, int) {
+	var status map[string]interface{}
+	b, err := json.Marshal(s.Status())
+	if err == nil {
+		err = json.Unmarshal(b, &status)
+	}
+	if err != nil {
+		return map[string]interface{}{"error": err.Error()}, ubus.StatusUnknownError
+	}
+	return status, ubus.StatusOK
+}
+
+// ubusReload reloads lists like SIGHUP.
+func (s *Server) ubusReload(map[string]interface{}) (map[string]interface{}, int) {
+	if err := s.Reload(); err != nil {
+		return map[string]interface{}{"error": err.Error()}, ubus.StatusUnknownError
+	}
+	return map[string]interface{}{"reloaded": true}, ubus.StatusOK
+}
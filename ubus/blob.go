@@ -0,0 +1,259 @@
+package ubus
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// blob attributes (libubox blob.h): a 32 bit big endian header of the extended flag, 7 bits of ID and 24 bits
+// of length including the header, followed by data padded to 4 bytes.
+const (
+	blobExtended = 0x80000000
+	blobIDMask   = 0x7f000000
+	blobIDShift  = 24
+	blobLenMask  = 0x00ffffff
+	blobHdrLen   = 4
+	blobAlign    = 4
+)
+
+// blobmsg types (libubox blobmsg.h), stored as IDs of extended blob attributes.
+const (
+	blobmsgArray  = 1
+	blobmsgTable  = 2
+	blobmsgString = 3
+	blobmsgInt64  = 4
+	blobmsgInt32  = 5
+	blobmsgInt16  = 6
+	blobmsgBool   = 7
+	blobmsgDouble = 8
+)
+
+var errBadBlob = errors.New("malformed blob attribute")
+
+type blobAttr struct {
+	id       int
+	extended bool
+	data     []byte
+}
+
+func blobPad(n int) int {
+	return (n + blobAlign - 1) &^ (blobAlign - 1)
+}
+
+// putBlob appends an attribute of id and data to b, padded.
+func putBlob(b []byte, id int, extended bool, data []byte) []byte {
+	h := uint32(id)<<blobIDShift&blobIDMask | uint32(blobHdrLen+len(data))&blobLenMask
+	if extended {
+		h |= blobExtended
+	}
+	b = appendUint32(b, h)
+	b = append(b, data...)
+	for i := len(data); i < blobPad(len(data)); i++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func putBlobString(b []byte, id int, s string) []byte {
+	return putBlob(b, id, false, append([]byte(s), 0))
+}
+
+func putBlobInt32(b []byte, id int, v uint32) []byte {
+	return putBlob(b, id, false, appendUint32(nil, v))
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
+
+// parseBlobs parses consecutive attributes in b.
+func parseBlobs(b []byte) ([]blobAttr, error) {
+	var attrs []blobAttr
+	for len(b) > 0 {
+		if len(b) < blobHdrLen {
+			return nil, errBadBlob
+		}
+		h := binary.BigEndian.Uint32(b)
+		n := int(h & blobLenMask)
+		if n < blobHdrLen || n > len(b) {
+			return nil, errBadBlob
+		}
+		attrs = append(attrs, blobAttr{
+			id:       int(h & blobIDMask >> blobIDShift),
+			extended: h&blobExtended != 0,
+			data:     b[blobHdrLen:n],
+		})
+		if n = blobPad(n); n > len(b) {
+			n = len(b)
+		}
+		b = b[n:]
+	}
+	return attrs, nil
+}
+
+func (a blobAttr) uint32() uint32 {
+	if len(a.data) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(a.data)
+}
+
+func (a blobAttr) string() string {
+	s := a.data
+	for i, c := range s {
+		if c == 0 {
+			return string(s[:i])
+		}
+	}
+	return string(s)
+}
+
+// putBlobmsg appends value v named name to b as a blobmsg attribute. Supported values are maps of string keys,
+// slices, strings, booleans and numbers, as decoded by encoding/json. Nil values are skipped.
+func putBlobmsg(b []byte, name string, v interface{}) []byte {
+	var (
+		typ  int
+		data []byte
+	)
+	switch v := v.(type) {
+	case nil:
+		return b
+	case map[string]interface{}:
+		typ, data = blobmsgTable, putBlobmsgTable(nil, v)
+	case []interface{}:
+		typ = blobmsgArray
+		for _, e := range v {
+			data = putBlobmsg(data, "", e)
+		}
+	case string:
+		typ, data = blobmsgString, append([]byte(v), 0)
+	case bool:
+		typ, data = blobmsgBool, []byte{0}
+		if v {
+			data[0] = 1
+		}
+	case int:
+		typ, data = blobmsgInt64, appendUint64(nil, uint64(v))
+	case int64:
+		typ, data = blobmsgInt64, appendUint64(nil, uint64(v))
+	case uint32:
+		typ, data = blobmsgInt32, appendUint32(nil, v)
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			typ, data = blobmsgInt64, appendUint64(nil, uint64(int64(v)))
+		} else {
+			typ, data = blobmsgDouble, appendUint64(nil, math.Float64bits(v))
+		}
+	default:
+		return b
+	}
+
+	// blobmsg header: 16 bit length of name, and the name terminated by NUL, padded.
+	hdr := appendUint16(nil, uint16(len(name)))
+	hdr = append(hdr, name...)
+	hdr = append(hdr, 0)
+	for len(hdr)%blobAlign != 0 {
+		hdr = append(hdr, 0)
+	}
+	return putBlob(b, typ, true, append(hdr, data...))
+}
+
+// putBlobmsgTable appends entries of m to b in order of keys.
+func putBlobmsgTable(b []byte, m map[string]interface{}) []byte {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b = putBlobmsg(b, k, m[k])
+	}
+	return b
+}
+
+// parseBlobmsg parses a blobmsg attribute into its name and value.
+func parseBlobmsg(a blobAttr) (name string, v interface{}, err error) {
+	if !a.extended || len(a.data) < 2 {
+		return "", nil, errBadBlob
+	}
+	n := int(binary.BigEndian.Uint16(a.data))
+	hdrLen := blobPad(2 + n + 1)
+	if hdrLen > len(a.data) {
+		return "", nil, errBadBlob
+	}
+	name = string(a.data[2 : 2+n])
+	data := a.data[hdrLen:]
+	switch a.id {
+	case blobmsgTable:
+		v, err = parseBlobmsgTable(data)
+	case blobmsgArray:
+		attrs, err := parseBlobs(data)
+		if err != nil {
+			return "", nil, err
+		}
+		list := make([]interface{}, 0, len(attrs))
+		for _, attr := range attrs {
+			_, elem, err := parseBlobmsg(attr)
+			if err != nil {
+				return "", nil, err
+			}
+			list = append(list, elem)
+		}
+		v = list
+	case blobmsgString:
+		v = blobAttr{data: data}.string()
+	case blobmsgInt64:
+		if len(data) < 8 {
+			return "", nil, errBadBlob
+		}
+		v = int64(binary.BigEndian.Uint64(data))
+	case blobmsgInt32:
+		if len(data) < 4 {
+			return "", nil, errBadBlob
+		}
+		v = int64(int32(binary.BigEndian.Uint32(data)))
+	case blobmsgInt16:
+		if len(data) < 2 {
+			return "", nil, errBadBlob
+		}
+		v = int64(int16(binary.BigEndian.Uint16(data)))
+	case blobmsgBool:
+		if len(data) < 1 {
+			return "", nil, errBadBlob
+		}
+		v = data[0] != 0
+	case blobmsgDouble:
+		if len(data) < 8 {
+			return "", nil, errBadBlob
+		}
+		v = math.Float64frombits(binary.BigEndian.Uint64(data))
+	}
+	return
+}
+
+// parseBlobmsgTable parses entries of a blobmsg table in b.
+func parseBlobmsgTable(b []byte) (map[string]interface{}, error) {
+	attrs, err := parseBlobs(b)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]interface{}, len(attrs))
+	for _, a := range attrs {
+		name, v, err := parseBlobmsg(a)
+		if err != nil {
+			return nil, err
+		}
+		m[name] = v
+	}
+	return m, nil
+}
@@ -0,0 +1,247 @@
+// Package ubus publishes objects on OpenWrt's ubus, the micro bus of system services, with a minimal client
+// of the ubusd socket protocol. Methods of a published object can be called by `ubus call` and LuCI.
+package ubus
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultSocket is the default path of the ubusd socket.
+const DefaultSocket = "/var/run/ubus/ubus.sock"
+
+// Status codes of method calls (libubus ubus_msg_status).
+const (
+	StatusOK               = 0
+	StatusInvalidCommand   = 1
+	StatusInvalidArgument  = 2
+	StatusMethodNotFound   = 3
+	StatusNotFound         = 4
+	StatusNoData           = 5
+	StatusPermissionDenied = 6
+	StatusTimeout          = 7
+	StatusNotSupported     = 8
+	StatusUnknownError     = 9
+)
+
+// message types (libubus ubus_msg_type).
+const (
+	msgHello     = 0
+	msgStatus    = 1
+	msgData      = 2
+	msgInvoke    = 5
+	msgAddObject = 6
+)
+
+// message attributes (libubus ubus_msg_attr).
+const (
+	attrStatus    = 1
+	attrObjPath   = 2
+	attrObjID     = 3
+	attrMethod    = 4
+	attrSignature = 6
+	attrData      = 7
+	attrNoReply   = 10
+)
+
+const (
+	msgHdrLen    = 8
+	maxMsgLen    = 1 << 20
+	msgVersion   = 0
+	writeTimeout = 5 * time.Second
+)
+
+// Method handles a call of an object method with arguments args. It returns the reply, nil if nothing to reply,
+// and the status of the call (see StatusXXX).
+type Method func(args map[string]interface{}) (reply map[string]interface{}, status int)
+
+// Conn is a connection to ubusd.
+type Conn struct {
+	conn    net.Conn
+	peer    uint32 // ID of the connection assigned by ubusd
+	wmu     sync.Mutex
+	seq     uint16
+	objects map[uint32]map[string]Method // methods of published objects by object ID
+}
+
+type message struct {
+	typ   uint8
+	seq   uint16
+	peer  uint32
+	attrs []blobAttr
+}
+
+func (m *message) attr(id int) (blobAttr, bool) {
+	for _, a := range m.attrs {
+		if a.id == id && !a.extended {
+			return a, true
+		}
+	}
+	return blobAttr{}, false
+}
+
+// Dial connects to ubusd listening on the unix socket at path.
+func Dial(path string, timeout time.Duration) (*Conn, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: conn, objects: make(map[uint32]map[string]Method)}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	hello, err := c.readMsg()
+	if err == nil && hello.typ != msgHello {
+		err = fmt.Errorf("unexpected ubus message type %d, expect hello", hello.typ)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	c.peer = hello.peer
+	return c, nil
+}
+
+// Close closes the connection, and the published objects are removed by ubusd.
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+// AddObject publishes an object with methods at path, such as "chinadns". Methods take no declared argument.
+// It must be called before Serve.
+func (c *Conn) AddObject(path string, methods map[string]Method) error {
+	var sig []byte
+	for name := range methods {
+		sig = putBlobmsg(sig, name, map[string]interface{}{})
+	}
+	var b []byte
+	b = putBlobString(b, attrObjPath, path)
+	b = putBlob(b, attrSignature, false, sig)
+
+	c.seq++
+	seq := c.seq
+	if err := c.writeMsg(msgAddObject, seq, 0, b); err != nil {
+		return err
+	}
+	var id uint32
+	found := false
+	for {
+		m, err := c.readMsg()
+		if err != nil {
+			return err
+		}
+		if m.seq != seq {
+			continue
+		}
+		switch m.typ {
+		case msgData:
+			if a, ok := m.attr(attrObjID); ok {
+				id, found = a.uint32(), true
+			}
+		case msgStatus:
+			a, _ := m.attr(attrStatus)
+			if status := a.uint32(); status != StatusOK {
+				return fmt.Errorf("fail to add ubus object %s: status %d", path, status)
+			}
+			if !found {
+				return errors.New("no ubus object ID is replied")
+			}
+			c.objects[id] = methods
+			return nil
+		}
+	}
+}
+
+// Serve handles method calls of published objects until the connection is closed or fails.
+// Methods are called in their own goroutines.
+func (c *Conn) Serve() error {
+	for {
+		m, err := c.readMsg()
+		if err != nil {
+			return err
+		}
+		if m.typ == msgInvoke {
+			go c.invoke(m)
+		}
+	}
+}
+
+func (c *Conn) invoke(m *message) {
+	objAttr, _ := m.attr(attrObjID)
+	methodAttr, _ := m.attr(attrMethod)
+	_, noReply := m.attr(attrNoReply)
+	obj := objAttr.uint32()
+
+	status := StatusMethodNotFound
+	var reply map[string]interface{}
+	if method := c.objects[obj][methodAttr.string()]; method != nil {
+		args := map[string]interface{}{}
+		if a, ok := m.attr(attrData); ok {
+			var err error
+			if args, err = parseBlobmsgTable(a.data); err != nil {
+				status = StatusInvalidArgument
+				method = nil
+			}
+		}
+		if method != nil {
+			reply, status = method(args)
+		}
+	}
+	if noReply {
+		return
+	}
+	if reply != nil {
+		var b []byte
+		b = putBlobInt32(b, attrObjID, obj)
+		b = putBlob(b, attrData, false, putBlobmsgTable(nil, reply))
+		if err := c.writeMsg(msgData, m.seq, m.peer, b); err != nil {
+			return
+		}
+	}
+	var b []byte
+	b = putBlobInt32(b, attrObjID, obj)
+	b = putBlobInt32(b, attrStatus, uint32(status))
+	_ = c.writeMsg(msgStatus, m.seq, m.peer, b)
+}
+
+// readMsg reads a message: a header of version, type, sequence number and peer ID, followed by a blob of attributes.
+func (c *Conn) readMsg() (*message, error) {
+	hdr := make([]byte, msgHdrLen+blobHdrLen)
+	if _, err := io.ReadFull(c.conn, hdr); err != nil {
+		return nil, err
+	}
+	n := int(uint32(hdr[8])<<24|uint32(hdr[9])<<16|uint32(hdr[10])<<8|uint32(hdr[11])) & blobLenMask
+	if n < blobHdrLen || n > maxMsgLen {
+		return nil, errBadBlob
+	}
+	body := make([]byte, n-blobHdrLen)
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		return nil, err
+	}
+	attrs, err := parseBlobs(body)
+	if err != nil {
+		return nil, err
+	}
+	return &message{
+		typ:   hdr[1],
+		seq:   uint16(hdr[2])<<8 | uint16(hdr[3]),
+		peer:  uint32(hdr[4])<<24 | uint32(hdr[5])<<16 | uint32(hdr[6])<<8 | uint32(hdr[7]),
+		attrs: attrs,
+	}, nil
+}
+
+func (c *Conn) writeMsg(typ uint8, seq uint16, peer uint32, attrs []byte) error {
+	b := []byte{msgVersion, typ}
+	b = appendUint16(b, seq)
+	b = appendUint32(b, peer)
+	b = putBlob(b, 0, false, attrs)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write(b)
+	return err
+}
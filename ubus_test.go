@@ -0,0 +1,100 @@
+package gochinadns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ubusMsg encodes a ubus message of typ with attributes in attrs, each of which is a blob attribute already.
+func ubusMsg(typ uint8, seq uint16, peer uint32, attrs ...[]byte) []byte {
+	body := bytes.Join(attrs, nil)
+	b := []byte{0, typ, byte(seq >> 8), byte(seq)}
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[4:], peer)
+	binary.BigEndian.PutUint32(b[8:], uint32(4+len(body)))
+	return append(b, body...)
+}
+
+func ubusAttr(id int, data []byte) []byte {
+	b := make([]byte, 4, 4+len(data)+3)
+	binary.BigEndian.PutUint32(b, uint32(id)<<24|uint32(4+len(data)))
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func readUbusMsg(t *testing.T, conn net.Conn) (typ uint8, body []byte) {
+	t.Helper()
+	hdr := make([]byte, 12)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		t.Fatal(err)
+	}
+	body = make([]byte, binary.BigEndian.Uint32(hdr[8:])&0xffffff-4)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatal(err)
+	}
+	return hdr[1], body
+}
+
+func TestUbus(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "ubus.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	o := newServerOptions()
+	if err := WithUbus(socket)(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o, inflight: newInflightTable(), upstreams: newUpstreamTable()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.runUbus(ctx)
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	const objID = 42
+	objAttr := ubusAttr(3, []byte{0, 0, 0, objID})
+	if _, err = conn.Write(ubusMsg(0, 0, 7)); err != nil {
+		t.Fatal(err)
+	}
+	typ, body := readUbusMsg(t, conn)
+	if typ != 6 || !bytes.Contains(body, []byte("chinadns\x00")) || !bytes.Contains(body, []byte("status\x00")) {
+		t.Fatalf("Expect adding object chinadns, got type %d: %q", typ, body)
+	}
+	if _, err = conn.Write(append(ubusMsg(2, 1, 0, objAttr), ubusMsg(1, 1, 0, ubusAttr(1, []byte{0, 0, 0, 0}))...)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = conn.Write(ubusMsg(5, 9, 100, objAttr, ubusAttr(4, []byte("status\x00")))); err != nil {
+		t.Fatal(err)
+	}
+	typ, body = readUbusMsg(t, conn)
+	if typ != 2 || !bytes.Contains(body, []byte(GetVersion())) {
+		t.Errorf("Expect status data, got type %d: %q", typ, body)
+	}
+	if typ, body = readUbusMsg(t, conn); typ != 1 || !bytes.HasSuffix(body, ubusAttr(1, []byte{0, 0, 0, 0})) {
+		t.Errorf("Expect OK status, got type %d: %q", typ, body)
+	}
+
+	if _, err = conn.Write(ubusMsg(5, 10, 100, objAttr, ubusAttr(4, []byte("unknown\x00")))); err != nil {
+		t.Fatal(err)
+	}
+	if typ, body = readUbusMsg(t, conn); typ != 1 || !bytes.HasSuffix(body, ubusAttr(1, []byte{0, 0, 0, 3})) {
+		t.Errorf("Expect method not found, got type %d: %q", typ, body)
+	}
+}
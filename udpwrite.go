@@ -0,0 +1,146 @@
+package gochinadns
+
+import (
+	"bufio"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+// Reasons of dropped UDP responses in udpWriteDrops.
+const (
+	dropBufferFull = "buffer_full" // the socket buffer is full
+	dropTimeout    = "timeout"     // the write deadline is exceeded
+	dropError      = "error"       // other errors
+)
+
+var (
+	// udpWriteDrops counts UDP responses failing to be sent by reason, so that overload shows up as drops rather
+	// than silent timeouts of clients.
+	udpWriteDrops = expvar.NewMap("chinadns_udp_write_drops")
+	// udpKernelDrops reports UDP datagrams of the host dropped by the kernel as socket buffers are full, which fail
+	// no write of the server, see readUDPKernelErrors.
+	udpKernelDrops = expvar.NewMap("chinadns_udp_kernel_drops")
+)
+
+func init() {
+	for key, f := range map[string]func(udpKernelErrors) int64{
+		"sndbuf_errors": func(e udpKernelErrors) int64 { return e.SndbufErrors },
+		"rcvbuf_errors": func(e udpKernelErrors) int64 { return e.RcvbufErrors },
+	} {
+		f := f
+		udpKernelDrops.Set(key, expvar.Func(func() interface{} {
+			e, _ := readUDPKernelErrors()
+			return f(e)
+		}))
+	}
+}
+
+// udpDropWriter counts UDP responses failing to be sent as drops. They are not retried: a client retries a query
+// anyway, and waiting for the socket buffer only holds up the goroutine serving the query under overload.
+type udpDropWriter struct {
+	dns.ResponseWriter
+}
+
+func (w *udpDropWriter) WriteMsg(m *dns.Msg) error {
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (w *udpDropWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil {
+		udpWriteDrops.Add(writeErrorReason(err), 1)
+		logrus.WithError(err).WithField("client", clientIP(w)).Debugf("Drop UDP response of %d bytes.", len(b))
+	}
+	return n, err
+}
+
+// writeErrorReason returns the reason of a failed write in udpWriteDrops.
+func writeErrorReason(err error) string {
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOBUFS) {
+		return dropBufferFull
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return dropTimeout
+	}
+	return dropError
+}
+
+// udpWriteDropped returns the number of UDP responses dropped for all reasons.
+func udpWriteDropped() int64 {
+	var n int64
+	udpWriteDrops.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			n += v.Value()
+		}
+	})
+	return n
+}
+
+// udpKernelErrors are UDP datagrams of all sockets of the host, of IPv4 and IPv6, dropped by the kernel since boot.
+// A datagram dropped as the send buffer of the socket is full is counted in SndbufErrors, even if the write succeeds,
+// and a query dropped as the receive buffer is full never reaches the server, counted in RcvbufErrors.
+type udpKernelErrors struct {
+	SndbufErrors int64
+	RcvbufErrors int64
+}
+
+// sub returns counters of e since base.
+func (e udpKernelErrors) sub(base udpKernelErrors) udpKernelErrors {
+	return udpKernelErrors{SndbufErrors: e.SndbufErrors - base.SndbufErrors, RcvbufErrors: e.RcvbufErrors - base.RcvbufErrors}
+}
+
+// parseSNMP adds UDP buffer errors in r to e. r is in the format of /proc/net/snmp, where a line of field names
+// prefixed by the protocol is followed by a line of their values, or of /proc/net/snmp6, where each line is a name
+// prefixed by the protocol and its value.
+func (e *udpKernelErrors) parseSNMP(r io.Reader) error {
+	var header []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		var names, values []string
+		switch {
+		case fields[0] == "Udp:" && header == nil:
+			header = fields[1:]
+			continue
+		case fields[0] == "Udp:":
+			names, values, header = header, fields[1:], nil
+		case strings.HasPrefix(fields[0], "Udp6") && len(fields) == 2:
+			names, values = []string{strings.TrimPrefix(fields[0], "Udp6")}, fields[1:]
+		default:
+			continue
+		}
+		for i, name := range names {
+			if i >= len(values) {
+				break
+			}
+			v, err := strconv.ParseInt(values[i], 10, 64)
+			if err != nil {
+				return err
+			}
+			switch name {
+			case "SndbufErrors":
+				e.SndbufErrors += v
+			case "RcvbufErrors":
+				e.RcvbufErrors += v
+			}
+		}
+	}
+	return sc.Err()
+}
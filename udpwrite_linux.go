@@ -0,0 +1,24 @@
+package gochinadns
+
+import "os"
+
+// readUDPKernelErrors reads UDP buffer errors of the host from /proc/net/snmp and /proc/net/snmp6. Those of IPv6
+// are skipped if it's disabled.
+func readUDPKernelErrors() (udpKernelErrors, error) {
+	var e udpKernelErrors
+	for _, path := range []string{"/proc/net/snmp", "/proc/net/snmp6"} {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) && path != "/proc/net/snmp" {
+			continue
+		}
+		if err != nil {
+			return e, err
+		}
+		err = e.parseSNMP(f)
+		_ = f.Close()
+		if err != nil {
+			return e, err
+		}
+	}
+	return e, nil
+}
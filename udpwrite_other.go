@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package gochinadns
+
+import "errors"
+
+// readUDPKernelErrors is unsupported on this platform.
+func readUDPKernelErrors() (udpKernelErrors, error) {
+	return udpKernelErrors{}, errors.New("UDP buffer errors of the kernel are unsupported on this platform")
+}
@@ -0,0 +1,79 @@
+package gochinadns
+
+import (
+	"expvar"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// failingWriter fails writes with err.
+type failingWriter struct {
+	*fakeResponseWriter
+	err    error
+	writes int
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	w.writes++
+	if w.err != nil {
+		return 0, &os.SyscallError{Syscall: "sendmsg", Err: w.err}
+	}
+	return len(b), nil
+}
+
+func TestUDPDropWriter(t *testing.T) {
+	m := newTestReply("www.qq.com.", 60, "1.0.1.1")
+	full := func() int64 {
+		v, _ := udpWriteDrops.Get(dropBufferFull).(*expvar.Int)
+		if v == nil {
+			return 0
+		}
+		return v.Value()
+	}
+	dropped, fullDropped := udpWriteDropped(), full()
+	for _, err := range []error{nil, syscall.EAGAIN, syscall.ECONNREFUSED} {
+		fw := &failingWriter{fakeResponseWriter: newFakeResponseWriter("192.0.2.1"), err: err}
+		if got := (&udpDropWriter{ResponseWriter: fw}).WriteMsg(m); (got == nil) != (err == nil) || fw.writes != 1 {
+			t.Errorf("Response failing with %v should be written once, got %d writes, %v", err, fw.writes, got)
+		}
+	}
+	if n := udpWriteDropped() - dropped; n != 2 {
+		t.Errorf("Expect 2 dropped responses, got %d", n)
+	}
+	if n := full() - fullDropped; n != 1 {
+		t.Errorf("Expect 1 response dropped as the buffer is full, got %d", n)
+	}
+}
+
+func TestParseSNMP(t *testing.T) {
+	const snmp = `Ip: Forwarding DefaultTTL
+Ip: 1 64
+Udp: InDatagrams NoPorts InErrors OutDatagrams RcvbufErrors SndbufErrors InCsumErrors IgnoredMulti MemErrors
+Udp: 14645 626 7 15354 5 3 0 0 0
+UdpLite: InDatagrams NoPorts InErrors OutDatagrams RcvbufErrors SndbufErrors InCsumErrors IgnoredMulti MemErrors
+UdpLite: 0 0 0 0 100 100 0 0 0
+`
+	const snmp6 = `Ip6InReceives                   	10
+Udp6InDatagrams                 	0
+Udp6RcvbufErrors                	2
+Udp6SndbufErrors                	1
+UdpLite6SndbufErrors            	100
+`
+	var e udpKernelErrors
+	for _, s := range []string{snmp, snmp6} {
+		if err := e.parseSNMP(strings.NewReader(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if e != (udpKernelErrors{SndbufErrors: 4, RcvbufErrors: 7}) {
+		t.Errorf("Unexpected UDP buffer errors %+v", e)
+	}
+	if got := e.sub(udpKernelErrors{SndbufErrors: 1, RcvbufErrors: 2}); got != (udpKernelErrors{SndbufErrors: 3, RcvbufErrors: 5}) {
+		t.Errorf("Unexpected UDP buffer errors since base %+v", got)
+	}
+	if err := new(udpKernelErrors).parseSNMP(strings.NewReader("Udp: SndbufErrors\nUdp: x\n")); err == nil {
+		t.Error("Invalid value should fail")
+	}
+}
@@ -0,0 +1,77 @@
+package gochinadns
+
+import (
+	"net"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// dotPort is the well-known port of DNS over TLS (RFC 7858).
+const dotPort = "853"
+
+const (
+	upgradeNone      int32 = iota // plain transports only
+	upgradeAvailable              // DoT is available, tried before plain transports
+	upgradePinned                 // DoT succeeded once, and plain transports are never used again
+)
+
+// enableUpgrade upgrades a plain upstream to DoT opportunistically, after DoT is found available on dotPort.
+func (r *Resolver) enableUpgrade() {
+	if hasProtocol(r, "dot") {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&r.upgrade, upgradeNone, upgradeAvailable) {
+		logrus.WithField("server", r).Info("DoT is available. Upgrade opportunistically.")
+	}
+}
+
+// onDoTSuccess pins an opportunistically upgraded upstream to DoT, so that an attacker can't downgrade it to
+// plain transports by blocking DoT later.
+func (r *Resolver) onDoTSuccess() {
+	if atomic.CompareAndSwapInt32(&r.upgrade, upgradeAvailable, upgradePinned) {
+		logrus.WithField("server", r).Info("DoT upgrade succeeded. Pin to DoT.")
+	}
+}
+
+// upgradeState returns one of upgradeNone, upgradeAvailable and upgradePinned.
+func (r *Resolver) upgradeState() int32 {
+	return atomic.LoadInt32(&r.upgrade)
+}
+
+// upgradeProtocols applies opportunistic DoT upgrade to protocols.
+func (r *Resolver) upgradeProtocols(protocols []string) []string {
+	switch r.upgradeState() {
+	case upgradeAvailable:
+		return append([]string{"dot"}, protocols...)
+	case upgradePinned:
+		return []string{"dot"}
+	}
+	return protocols
+}
+
+// dotAddr returns the address to query r with DoT. It's the probed one for upgraded upstreams, which is dotPort
+// of the same IP unless discovered by DDR.
+func (r *Resolver) dotAddr() string {
+	if r.upgradeState() == upgradeNone {
+		return r.GetAddr()
+	}
+	if c := r.Capabilities(); c != nil && c.DoTAddr != "" {
+		return c.DoTAddr
+	}
+	host, _, err := net.SplitHostPort(r.GetAddr())
+	if err != nil {
+		return r.GetAddr()
+	}
+	return net.JoinHostPort(host, dotPort)
+}
+
+func upgradeString(state int32) string {
+	switch state {
+	case upgradeAvailable:
+		return "available"
+	case upgradePinned:
+		return "pinned"
+	}
+	return ""
+}
@@ -0,0 +1,46 @@
+package gochinadns
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUpgrade(t *testing.T) {
+	r, err := ParseResolver("1.1.1.1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.protocols(); !reflect.DeepEqual(got, []string{"udp"}) {
+		t.Errorf("Protocols should not be upgraded before enabled, got %v", got)
+	}
+	if r.dotAddr() != "1.1.1.1:53" {
+		t.Errorf("Unexpected DoT address %s", r.dotAddr())
+	}
+
+	r.enableUpgrade()
+	if got := r.protocols(); !reflect.DeepEqual(got, []string{"dot", "udp"}) {
+		t.Errorf("DoT should be tried first, got %v", got)
+	}
+	if r.dotAddr() != "1.1.1.1:853" {
+		t.Errorf("Unexpected DoT address %s", r.dotAddr())
+	}
+
+	r.onDoTSuccess()
+	if got := r.protocols(); !reflect.DeepEqual(got, []string{"dot"}) {
+		t.Errorf("Upstream should be pinned to DoT, got %v", got)
+	}
+	r.enableUpgrade()
+	if r.upgradeState() != upgradePinned {
+		t.Error("Pinned upstream should stay pinned")
+	}
+
+	dot, err := ParseResolver("dot@1.1.1.1:853", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot.enableUpgrade()
+	dot.onDoTSuccess()
+	if dot.upgradeState() != upgradeNone {
+		t.Error("Declared DoT upstream should not be upgraded")
+	}
+}
@@ -0,0 +1,489 @@
+package gochinadns
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// rttWeight is the weight of a new sample in the moving averages of RTT and failure rate.
+const rttWeight = 0.2
+
+// UpstreamStatus contains health and latency statistics of an upstream.
+type UpstreamStatus struct {
+	Resolver    string        `json:"resolver"`
+	Trusted     bool          `json:"trusted"`
+	Queries     uint64        `json:"queries"`
+	Errors      uint64        `json:"errors"`
+	AvgRTT      time.Duration `json:"avg_rtt"`
+	LastRTT     time.Duration `json:"last_rtt"`
+	LastError   string        `json:"last_error,omitempty"`
+	LastSuccess time.Time     `json:"last_success,omitempty"`
+
+	ConsecutiveErrors uint64  `json:"consecutive_errors,omitempty"` // errors since the last success
+	FailureRate       float64 `json:"failure_rate"`                 // moving average of failures, from 0 to 1
+
+	Capabilities *Capabilities  `json:"capabilities,omitempty"` // nil if not probed
+	EDNSLimit    uint16         `json:"edns_limit,omitempty"`   // EDNS UDP size limited due to fragmentation
+	PreferTCP    bool           `json:"prefer_tcp,omitempty"`   // TCP is preferred due to fragmentation
+	NoEDNS       bool           `json:"no_edns,omitempty"`      // EDNS is disabled, or learned unsupported by FORMERR replies
+	DoTUpgrade   string         `json:"dot_upgrade,omitempty"`  // "available" or "pinned" if upgraded to DoT opportunistically
+	Drained      bool           `json:"drained,omitempty"`      // drained for maintenance by DrainResolver
+	Budgets      []BudgetStatus `json:"budgets,omitempty"`      // consumption of budgets, see WithUpstreamBudgets
+	Degraded     bool           `json:"degraded,omitempty"`     // slower than trusted servers, see WithLatencyDegradation
+}
+
+// upstreamTable collects statistics of upstreams, indexed by resolver string.
+type upstreamTable struct {
+	mu    sync.Mutex
+	stats map[string]*UpstreamStatus
+}
+
+func newUpstreamTable() *upstreamTable {
+	return &upstreamTable{stats: make(map[string]*UpstreamStatus)}
+}
+
+// Record updates statistics of the upstream replying e.
+func (t *upstreamTable) Record(e *UpstreamReplyEvent) {
+	key := e.Upstream.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.stats[key]
+	if st == nil {
+		st = &UpstreamStatus{Resolver: key}
+		t.stats[key] = st
+	}
+	st.Queries++
+	if e.Err != nil {
+		st.Errors++
+		st.ConsecutiveErrors++
+		st.FailureRate = rttWeight + (1-rttWeight)*st.FailureRate
+		st.LastError = e.Err.Error()
+		return
+	}
+	st.ConsecutiveErrors = 0
+	st.FailureRate *= 1 - rttWeight
+	st.LastRTT = e.RTT
+	st.LastSuccess = time.Now()
+	if st.AvgRTT == 0 {
+		st.AvgRTT = e.RTT
+	} else {
+		st.AvgRTT = time.Duration(rttWeight*float64(e.RTT) + (1-rttWeight)*float64(st.AvgRTT))
+	}
+}
+
+func (t *upstreamTable) get(r *Resolver) UpstreamStatus {
+	key := r.String()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := UpstreamStatus{Resolver: key}
+	if t.stats[key] != nil {
+		st = *t.stats[key]
+	}
+	st.Capabilities = r.Capabilities()
+	st.EDNSLimit = r.ednsLimit()
+	st.PreferTCP = r.prefersTCP()
+	st.NoEDNS = r.noEDNS()
+	st.DoTUpgrade = upgradeString(r.upgradeState())
+	st.Drained = r.isDrained()
+	return st
+}
+
+func (t *upstreamTable) remove(r *Resolver) {
+	t.mu.Lock()
+	delete(t.stats, r.String())
+	t.mu.Unlock()
+}
+
+// resolvers returns the current trusted and untrusted resolvers.
+func (s *Server) resolvers() (trusted, untrusted resolverList) {
+	s.resolversMu.RLock()
+	defer s.resolversMu.RUnlock()
+	return s.TrustedServers, s.UntrustedServers
+}
+
+func (r *Resolver) isDrained() bool {
+	return atomic.LoadInt32(&r.drained) == 1
+}
+
+// activeResolvers returns the current trusted and untrusted resolvers to send queries to, which are not drained,
+// within their budgets (see WithUpstreamBudgets), and not degraded (see WithLatencyDegradation).
+func (s *Server) activeResolvers() (trusted, untrusted resolverList) {
+	trusted, untrusted = s.resolvers()
+	return s.budgets.withinBudget(undrained(trusted)), s.degraded.undegraded(s.budgets.withinBudget(undrained(untrusted)))
+}
+
+// undrained returns resolvers in list which are not drained. list is returned as is if none is drained.
+func undrained(list resolverList) resolverList {
+	for i, r := range list {
+		if !r.isDrained() {
+			continue
+		}
+		result := append(resolverList(nil), list[:i]...)
+		for _, r := range list[i+1:] {
+			if !r.isDrained() {
+				result = append(result, r)
+			}
+		}
+		return result
+	}
+	return list
+}
+
+// Upstreams returns status of all upstreams, trusted ones first.
+func (s *Server) Upstreams() []UpstreamStatus {
+	trusted, untrusted := s.resolvers()
+	list := make([]UpstreamStatus, 0, len(trusted)+len(untrusted))
+	for _, r := range trusted {
+		st := s.upstreams.get(r)
+		st.Trusted = true
+		st.Budgets = s.budgets.Status(r)
+		list = append(list, st)
+	}
+	for _, r := range untrusted {
+		st := s.upstreams.get(r)
+		st.Degraded = s.degraded.IsDegraded(r)
+		st.Budgets = s.budgets.Status(r)
+		list = append(list, st)
+	}
+	return list
+}
+
+// AddResolver adds resolver at runtime. It's checked against China route lists like those passed by WithResolvers,
+// unless trusted is true. Default parameters of its group apply, see WithGroupSettings.
+func (s *Server) AddResolver(resolver *Resolver, trusted bool) error {
+	if !trusted {
+		var err error
+		if trusted, err = s.isTrustedResolver(resolver); err != nil {
+			return err
+		}
+	}
+
+	resolver.applyDefaults(s.groupSettings(trusted))
+
+	s.resolversMu.Lock()
+	defer s.resolversMu.Unlock()
+	// Lists are copied on write, since snapshots may be in use by queries.
+	if trusted {
+		s.TrustedServers = uniqueAppendResolver(append(resolverList(nil), s.TrustedServers...), resolver)
+	} else {
+		s.UntrustedServers = uniqueAppendResolver(append(resolverList(nil), s.UntrustedServers...), resolver)
+	}
+	logrus.Infof("Resolver %s added (trusted: %v).", resolver, trusted)
+	return nil
+}
+
+// RemoveResolver removes the resolver with addr at runtime. It returns false if no such resolver.
+func (s *Server) RemoveResolver(addr string) bool {
+	s.resolversMu.Lock()
+	defer s.resolversMu.Unlock()
+	var removed *Resolver
+	remove := func(list resolverList) resolverList {
+		result := make(resolverList, 0, len(list))
+		for _, r := range list {
+			if r.GetAddr() == addr {
+				removed = r
+				continue
+			}
+			result = append(result, r)
+		}
+		return result
+	}
+	s.TrustedServers = remove(s.TrustedServers)
+	s.UntrustedServers = remove(s.UntrustedServers)
+	if removed == nil {
+		return false
+	}
+	s.upstreams.remove(removed)
+	logrus.Infof("Resolver %s removed.", removed)
+	return true
+}
+
+// DrainResolver drains the resolver with addr for maintenance if drain is true, or resumes it otherwise.
+// A drained resolver gets no query but probes, until resumed. It returns false if no such resolver.
+func (s *Server) DrainResolver(addr string, drain bool) bool {
+	trusted, untrusted := s.resolvers()
+	found := false
+	for _, list := range []resolverList{trusted, untrusted} {
+		for _, r := range list {
+			if r.GetAddr() != addr {
+				continue
+			}
+			found = true
+			if drain {
+				atomic.StoreInt32(&r.drained, 1)
+				logrus.Infof("Resolver %s drained.", r)
+			} else {
+				atomic.StoreInt32(&r.drained, 0)
+				logrus.Infof("Resolver %s resumed.", r)
+			}
+		}
+	}
+	return found
+}
+
+// FlushCache removes all entries of the response cache. It returns false if the cache backend can't be flushed.
+func (s *Server) FlushCache() bool {
+	switch c := s.cache.(type) {
+	case nil:
+		return true
+	case interface{ Flush() }:
+		c.Flush()
+		logrus.Info("Cache flushed.")
+		return true
+	}
+	return false
+}
+
+// EffectiveConfig is the configuration a server is running with.
+type EffectiveConfig struct {
+	Listen              string        `json:"listen"`
+	ExtraListens        []string      `json:"extra_listens,omitempty"`
+	AdminListen         string        `json:"admin_listen,omitempty"`
+	DebugListen         string        `json:"debug_listen,omitempty"`
+	StatsListen         string        `json:"stats_listen,omitempty"`
+	StatsAllowOrigin    string        `json:"stats_allow_origin,omitempty"`
+	Language            string        `json:"language"`
+	DoTListen           string        `json:"dot_listen,omitempty"`
+	DoHListen           string        `json:"doh_listen,omitempty"`
+	DoHPath             string        `json:"doh_path,omitempty"`
+	TrustedServers      []string      `json:"trusted_servers"`
+	UntrustedServers    []string      `json:"untrusted_servers"`
+	Bidirectional       bool          `json:"bidirectional"`
+	ReusePort           bool          `json:"reuse_port"`
+	SocketActivation    bool          `json:"socket_activation"`
+	BindRetries         int           `json:"bind_retries"`
+	FallbackPort        int           `json:"fallback_port,omitempty"`
+	Delay               time.Duration `json:"delay"`
+	Timeout             time.Duration `json:"timeout"`
+	QueryTimeout        time.Duration `json:"query_timeout"`
+	UDPMaxSize          int           `json:"udp_max_size"`
+	TCPOnly             bool          `json:"tcp_only"`
+	MutationStrategy    string        `json:"mutation_strategy"`
+	CaseRandomization   bool          `json:"case_randomization"`
+	EDNSPadding         bool          `json:"edns_padding"`
+	MaxReplySize        int           `json:"max_reply_size,omitempty"`
+	MaxAdditional       int           `json:"max_additional,omitempty"`
+	RecursionMode       string        `json:"recursion_mode,omitempty"`
+	BlockedQTypes       []string      `json:"blocked_qtypes,omitempty"`
+	QTypeAction         string        `json:"qtype_action,omitempty"`
+	AnomalyEntropy      float64       `json:"anomaly_entropy,omitempty"`
+	AnomalyAction       string        `json:"anomaly_action,omitempty"`
+	TunnelWindow        time.Duration `json:"tunnel_window,omitempty"`
+	TunnelAction        string        `json:"tunnel_action,omitempty"`
+	StatsPeriod         time.Duration `json:"stats_period,omitempty"`
+	AllowedClients      []string      `json:"allowed_clients,omitempty"`
+	RcodePolicy         string        `json:"rcode_policy,omitempty"`
+	EmptyAnswerPolicy   string        `json:"empty_answer_policy,omitempty"`
+	TrustedSettings     string        `json:"trusted_settings,omitempty"`
+	UntrustedSettings   string        `json:"untrusted_settings,omitempty"`
+	AnswerMatch         string        `json:"answer_match,omitempty"`
+	VerdictTTL          time.Duration `json:"verdict_ttl,omitempty"`
+	CNAMEChaseDepth     int           `json:"cname_chase_depth,omitempty"`
+	Scorer              string        `json:"scorer,omitempty"` // weights of the default scorer, or "custom"
+	ScoreBudget         time.Duration `json:"score_budget,omitempty"`
+	DegradeAfter        time.Duration `json:"degrade_after,omitempty"`
+	VerifyStrikes       int           `json:"verify_strikes,omitempty"`
+	TestDomains         []string      `json:"test_domains"`
+	HealthCheckInterval time.Duration `json:"health_check_interval"`
+	AuditInterval       time.Duration `json:"audit_interval,omitempty"`
+	Selection           string        `json:"selection"`
+	PinUpstreams        bool          `json:"pin_upstreams"`
+	Budgets             []string      `json:"budgets,omitempty"`
+	BlockResponse       string        `json:"block_response"`
+	CanaryDomains       []string      `json:"canary_domains,omitempty"`
+	CanaryInterval      time.Duration `json:"canary_interval,omitempty"`
+	SkipRefine          bool          `json:"skip_refine"`
+	WhoAnswered         bool          `json:"whoanswered"`
+	Shuffle             string        `json:"shuffle,omitempty"`
+	DualStackPreference string        `json:"dualstack_preference,omitempty"`
+	AAAAMode            string        `json:"aaaa_mode,omitempty"`
+	PrefetchCounterpart bool          `json:"prefetch_counterpart"`
+	DNS64Prefix         string        `json:"dns64_prefix,omitempty"`
+	TCPReadTimeout      time.Duration `json:"tcp_read_timeout,omitempty"`
+	TCPIdleTimeout      time.Duration `json:"tcp_idle_timeout,omitempty"`
+	TCPMaxConns         int           `json:"tcp_max_conns"`
+	TCPMaxQueries       int           `json:"tcp_max_queries"`
+	MaxInFlight         int           `json:"max_in_flight"`
+	MaxQueued           int           `json:"max_queued"`
+	RateLimitQPS        float64       `json:"rate_limit_qps,omitempty"`
+	RateLimitBurst      int           `json:"rate_limit_burst,omitempty"`
+	RateLimitAction     string        `json:"rate_limit_action,omitempty"`
+	QueryLog            string        `json:"query_log,omitempty"`
+	QueryLogFormat      string        `json:"query_log_format,omitempty"`
+	Mirror              string        `json:"mirror,omitempty"`
+	MirrorPercent       float64       `json:"mirror_percent,omitempty"`
+	CacheEntries        int           `json:"cache_entries"`
+	CacheMaxBytes       int           `json:"cache_max_bytes"`
+	ServeStale          time.Duration `json:"serve_stale"`
+	CacheStrategies     []string      `json:"cache_strategies,omitempty"` // set=strategy
+	FailurePolicy       []string      `json:"failure_policy"`
+	CacheFile           string        `json:"cache_file,omitempty"`
+	Redis               string        `json:"redis,omitempty"`
+	MemoryLimit         int           `json:"memory_limit,omitempty"`
+	GCPercent           int           `json:"gc_percent,omitempty"`
+	MinTTL              time.Duration `json:"min_ttl,omitempty"`
+	MaxTTL              time.Duration `json:"max_ttl,omitempty"`
+	IPSetMinTTL         time.Duration `json:"ipset_min_ttl,omitempty"`
+	GoroutineMaxAge     time.Duration `json:"goroutine_max_age"`
+	OpportunisticDoT    bool          `json:"opportunistic_dot"`
+	DDR                 bool          `json:"ddr"`
+	DNSSEC              bool          `json:"dnssec"`
+	ECSTrusted          string        `json:"ecs_trusted,omitempty"`
+	ECSUntrusted        string        `json:"ecs_untrusted,omitempty"`
+	TrustedProxy        string        `json:"trusted_proxy,omitempty"` // password masked
+	ChinaListURL        string        `json:"china_list_url,omitempty"`
+	ChinaListRefresh    time.Duration `json:"china_list_refresh,omitempty"`
+	PermissiveLists     bool          `json:"permissive_lists"`
+	Lists               []string      `json:"lists"` // names of loaded lists
+}
+
+// Config returns the effective configuration of the server.
+func (s *Server) Config() *EffectiveConfig {
+	trusted, untrusted := s.resolvers()
+	c := &EffectiveConfig{
+		Listen:              s.Listen,
+		ExtraListens:        s.ExtraListens,
+		AdminListen:         s.AdminListen,
+		DebugListen:         s.DebugListen,
+		StatsListen:         s.StatsListen,
+		StatsAllowOrigin:    s.StatsAllowOrigin,
+		Language:            s.Language,
+		DoTListen:           s.DoTListen,
+		DoHListen:           s.DoHListen,
+		DoHPath:             s.DoHPath,
+		TrustedServers:      resolverStrings(trusted),
+		UntrustedServers:    resolverStrings(untrusted),
+		Bidirectional:       s.Bidirectional,
+		ReusePort:           s.ReusePort,
+		SocketActivation:    s.SocketActivation,
+		BindRetries:         s.BindRetries,
+		FallbackPort:        s.FallbackPort,
+		Delay:               s.Delay,
+		Timeout:             s.Timeout,
+		QueryTimeout:        s.queryTimeout(clientLimits{}),
+		UDPMaxSize:          s.UDPMaxSize,
+		TCPOnly:             s.TCPOnly,
+		MutationStrategy:    s.defaultMutationStrategy(),
+		CaseRandomization:   s.CaseRandomization,
+		EDNSPadding:         s.Padding,
+		MaxReplySize:        s.MaxReplySize,
+		MaxAdditional:       s.MaxAdditional,
+		RecursionMode:       s.RecursionMode,
+		BlockedQTypes:       s.blockedQTypeNames(),
+		QTypeAction:         s.QTypeAction,
+		AnomalyEntropy:      s.AnomalyEntropy,
+		AnomalyAction:       s.AnomalyAction,
+		TunnelWindow:        s.TunnelWindow,
+		TunnelAction:        s.TunnelAction,
+		StatsPeriod:         s.StatsPeriod,
+		AllowedClients:      networkStrings(s.AllowedClients),
+		RcodePolicy:         s.RcodePolicy,
+		EmptyAnswerPolicy:   s.EmptyAnswerPolicy,
+		TrustedSettings:     s.TrustedSettings,
+		UntrustedSettings:   s.UntrustedSettings,
+		AnswerMatch:         s.AnswerMatch,
+		VerdictTTL:          s.VerdictTTL,
+		CNAMEChaseDepth:     s.CNAMEChaseDepth,
+		Scorer:              s.scorerString(),
+		ScoreBudget:         s.ScoreBudget,
+		DegradeAfter:        s.DegradeAfter,
+		VerifyStrikes:       s.VerifyStrikes,
+		TestDomains:         s.TestDomains,
+		HealthCheckInterval: s.HealthCheckInterval,
+		AuditInterval:       s.AuditInterval,
+		Selection:           s.Selection,
+		PinUpstreams:        s.PinUpstreams,
+		Budgets:             budgetStrings(s.budgets.Budgets()),
+		BlockResponse:       s.BlockResponse,
+		CanaryDomains:       s.CanaryDomains,
+		CanaryInterval:      s.CanaryInterval,
+		SkipRefine:          s.SkipRefine,
+		WhoAnswered:         s.WhoAnswered,
+		Shuffle:             s.Shuffle,
+		DualStackPreference: s.DualStackPreference,
+		AAAAMode:            s.AAAAMode,
+		PrefetchCounterpart: s.PrefetchCounterpart,
+		TCPReadTimeout:      s.TCPReadTimeout,
+		TCPIdleTimeout:      s.TCPIdleTimeout,
+		TCPMaxConns:         s.TCPMaxConns,
+		TCPMaxQueries:       s.TCPMaxQueries,
+		MaxInFlight:         s.MaxInFlight,
+		MaxQueued:           s.MaxQueued,
+		RateLimitQPS:        s.RateLimitQPS,
+		RateLimitBurst:      s.RateLimitBurst,
+		RateLimitAction:     s.RateLimitAction,
+		QueryLog:            s.QueryLog,
+		QueryLogFormat:      s.QueryLogFormat,
+		Mirror:              s.Mirror,
+		MirrorPercent:       s.MirrorPercent,
+		CacheEntries:        s.CacheEntries,
+		CacheMaxBytes:       s.CacheMaxBytes,
+		ServeStale:          s.ServeStale,
+		FailurePolicy:       s.FailurePolicy,
+		CacheFile:           s.CacheFile,
+		Redis:               s.Redis,
+		MemoryLimit:         s.MemoryLimit,
+		GCPercent:           s.GCPercent,
+		MinTTL:              s.MinTTL,
+		MaxTTL:              s.MaxTTL,
+		IPSetMinTTL:         s.IPSetMinTTL,
+		GoroutineMaxAge:     s.GoroutineMaxAge,
+		ChinaListURL:        s.ChinaListURL,
+		ChinaListRefresh:    s.ChinaListRefresh,
+		PermissiveLists:     s.PermissiveLists,
+		OpportunisticDoT:    s.OpportunisticDoT,
+		DDR:                 s.DDR,
+		DNSSEC:              s.DNSSEC,
+		ECSTrusted:          s.ECSTrusted,
+		ECSUntrusted:        s.ECSUntrusted,
+	}
+	if s.TrustedProxy != "" {
+		c.TrustedProxy = s.redactedProxy()
+	}
+	if s.DNS64Prefix != nil {
+		c.DNS64Prefix = s.DNS64Prefix.String()
+	}
+
+	s.listsMu.RLock()
+	loaded := map[string]bool{
+		ListChina:          s.ChinaCIDR != nil && s.ChinaCIDR.Len() > 0,
+		ListChina6:         s.ChinaCIDR6 != nil,
+		ListChinaExclude:   s.ChinaCIDRExclude != nil,
+		ListIPBlacklist:    s.IPBlacklist != nil && s.IPBlacklist.Len() > 0,
+		ListGeoIP:          s.ChinaBackend != nil,
+		ListChinaURL:       s.chinaRemote != nil,
+		"domain-blacklist": s.DomainBlacklist != nil,
+		"domain-whitelist": s.DomainWhitelist != nil,
+		"domain-polluted":  s.DomainPolluted != nil,
+		"polluted-sites":   s.PollutedSites != nil,
+		"block-schedule":   len(s.BlockSchedule) > 0,
+		"ech-strip":        s.ECHStrip != nil,
+		"ech-preserve":     s.ECHPreserve != nil,
+		"mutation-domains": s.MutationDomains != nil,
+		"forward-rules":    len(s.ForwardRules) > 0,
+		"hosts":            s.Hosts != nil,
+		"rewrite-rules":    s.RewriteRules != nil,
+		"tenants":          s.Tenants != nil,
+	}
+	c.CacheStrategies = cacheStrategyStrings(s.CacheStrategies)
+	s.listsMu.RUnlock()
+	for name, ok := range loaded {
+		if ok {
+			c.Lists = append(c.Lists, name)
+		}
+	}
+	sort.Strings(c.Lists)
+	return c
+}
+
+func resolverStrings(list resolverList) []string {
+	result := make([]string, len(list))
+	for i, r := range list {
+		result[i] = r.String()
+	}
+	return result
+}
@@ -0,0 +1,88 @@
+package gochinadns
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestUpstreamTableRecord(t *testing.T) {
+	tb := newUpstreamTable()
+	r := &Resolver{Addr: "8.8.8.8:53", Protocols: []string{"udp"}}
+	tb.Record(&UpstreamReplyEvent{Upstream: r, RTT: 100 * time.Millisecond})
+	tb.Record(&UpstreamReplyEvent{Upstream: r, RTT: 200 * time.Millisecond})
+	tb.Record(&UpstreamReplyEvent{Upstream: r, Err: errors.New("i/o timeout")})
+
+	st := tb.get(r)
+	if st.Queries != 3 || st.Errors != 1 || st.LastError != "i/o timeout" {
+		t.Errorf("Unexpected counters %+v", st)
+	}
+	if st.LastRTT != 200*time.Millisecond || st.AvgRTT != 120*time.Millisecond {
+		t.Errorf("Unexpected RTT %+v", st)
+	}
+}
+
+func TestAddRemoveResolver(t *testing.T) {
+	o := newServerOptions()
+	if err := WithCHNList(writeTestList(t, "china.list", "114.114.0.0/16\n"))(o); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{serverOptions: o, upstreams: newUpstreamTable()}
+
+	for _, addr := range []string{"114.114.114.114", "8.8.8.8"} {
+		r, err := ParseResolver(addr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.AddResolver(r, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	trusted, untrusted := s.resolvers()
+	if len(trusted) != 1 || trusted[0].Addr != "8.8.8.8:53" || len(untrusted) != 1 {
+		t.Fatalf("Resolvers should be partitioned, got %s and %s", trusted, untrusted)
+	}
+
+	if !s.RemoveResolver("114.114.114.114:53") {
+		t.Error("Resolver should be removed")
+	}
+	if s.RemoveResolver("1.1.1.1:53") {
+		t.Error("Unknown resolver should not be removed")
+	}
+	if st := s.Upstreams(); len(st) != 1 || !st[0].Trusted {
+		t.Errorf("Unexpected upstreams %+v", st)
+	}
+}
+
+func TestDrainResolver(t *testing.T) {
+	o := newServerOptions()
+	for _, addr := range []string{"8.8.8.8", "1.1.1.1"} {
+		r, err := ParseResolver(addr, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.TrustedServers = append(o.TrustedServers, r)
+	}
+	s := &Server{serverOptions: o, upstreams: newUpstreamTable()}
+
+	if !s.DrainResolver("8.8.8.8:53", true) {
+		t.Fatal("Resolver should be drained")
+	}
+	if s.DrainResolver("9.9.9.9:53", true) {
+		t.Error("Unknown resolver should not be drained")
+	}
+	if trusted, _ := s.activeResolvers(); len(trusted) != 1 || trusted[0].Addr != "1.1.1.1:53" {
+		t.Errorf("Drained resolver should not be active, got %s", trusted)
+	}
+	if trusted, _ := s.resolvers(); len(trusted) != 2 {
+		t.Error("Drained resolver should be kept, to be probed")
+	}
+	if st := s.Upstreams(); !st[0].Drained || st[1].Drained {
+		t.Errorf("Unexpected upstreams %+v", st)
+	}
+
+	s.DrainResolver("8.8.8.8:53", false)
+	if trusted, _ := s.activeResolvers(); len(trusted) != 2 {
+		t.Errorf("Resumed resolver should be active, got %s", trusted)
+	}
+}
@@ -0,0 +1,70 @@
+package gochinadns
+
+import (
+	"errors"
+	"expvar"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errQuestionMismatch = errors.New("question of the reply mismatches the query")
+	discardedReplies    = expvar.NewInt("chinadns_discarded_replies")
+)
+
+// validateReply checks that reply answers req by the ID and the question, and passes check if not nil.
+// The question may be absent from FORMERR replies, since the query may not be parsed.
+func validateReply(req, reply *dns.Msg, check func(*dns.Msg) error) error {
+	if reply.Id != req.Id {
+		return dns.ErrId
+	}
+	if len(reply.Question) == 0 && reply.Rcode == dns.RcodeFormatError {
+		return nil
+	}
+	if len(reply.Question) != len(req.Question) {
+		return errQuestionMismatch
+	}
+	for i, q := range req.Question {
+		r := reply.Question[i]
+		if r.Qtype != q.Qtype || r.Qclass != q.Qclass || !strings.EqualFold(r.Name, q.Name) {
+			return errQuestionMismatch
+		}
+	}
+	if check != nil {
+		return check(reply)
+	}
+	return nil
+}
+
+// readValidReply returns reply of req read from conn if it's valid (see validateReply). Otherwise over UDP, it keeps
+// reading replies until a valid one arrives or the read deadline expires, since an injected reply may arrive before
+// the genuine one. Replies from other addresses than the resolver never arrive, as UDP connections are connected.
+// Over TCP, an invalid reply fails, since replies can't be injected off-path.
+func readValidReply(conn *dns.Conn, req, reply *dns.Msg, check func(*dns.Msg) error) (*dns.Msg, error) {
+	err := validateReply(req, reply, check)
+	if err == nil {
+		return reply, nil
+	}
+	if _, ok := conn.Conn.(net.PacketConn); !ok {
+		return nil, err
+	}
+	for {
+		discardedReplies.Add(1)
+		logrus.WithFields(logrus.Fields{"question": questionString(&req.Question[0]), "server": conn.RemoteAddr()}).
+			WithError(err).Debug("Discard an invalid reply. Wait for another one.")
+		reply, readErr := readMsg(conn)
+		if readErr != nil {
+			if isTimeout(readErr) {
+				// No valid reply arrives, which is likely a resolver replying in a way not expected.
+				return nil, err
+			}
+			return nil, readErr
+		}
+		if err = validateReply(req, reply, check); err == nil {
+			return reply, nil
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestReadValidReply(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, dns.MaxMsgSize)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		req := new(dns.Msg)
+		if req.Unpack(buf[:n]) != nil {
+			return
+		}
+		wrongQuestion := newTestReply("example.org.", 60, "203.0.113.1")
+		wrongQuestion.Id = req.Id
+		wrongType := newTestReply(req.Question[0].Name, 60, "203.0.113.2")
+		wrongType.Id = req.Id
+		wrongType.Question[0].Qtype = dns.TypeAAAA
+		genuine := newTestReply(req.Question[0].Name, 60, "142.250.1.1")
+		genuine.Id = req.Id
+		for _, m := range []*dns.Msg{wrongQuestion, wrongType, genuine} {
+			b, _ := m.Pack()
+			_, _ = pc.WriteTo(b, addr)
+		}
+	}()
+
+	c := NewClient(WithTimeout(time.Second))
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	discarded := discardedReplies.Value()
+	reply, _, err := c.exchangeUDP(context.Background(), req, pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := firstAddress(reply); !ip.Equal(net.ParseIP("142.250.1.1")) {
+		t.Errorf("Replies of other questions should be discarded, got %s", ip)
+	}
+	if n := discardedReplies.Value() - discarded; n != 2 {
+		t.Errorf("2 replies should be discarded, got %d", n)
+	}
+
+	formErr := new(dns.Msg)
+	formErr.SetRcode(req, dns.RcodeFormatError)
+	formErr.Question = nil
+	if err := validateReply(req, formErr, nil); err != nil {
+		t.Errorf("FORMERR without question should be valid, got %v", err)
+	}
+}
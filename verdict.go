@@ -0,0 +1,249 @@
+package gochinadns
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cherrot/gochinadns/clock"
+)
+
+// Groups of upstreams a domain is routed to by its cached verdict.
+const (
+	RouteTrusted   = "trusted"   // a trusted answer was needed
+	RouteUntrusted = "untrusted" // an untrusted answer located in China was accepted
+)
+
+const (
+	// maxVerdicts bounds the number of cached verdicts, and that of names remembered without verdicts in the store.
+	maxVerdicts = 65536
+	// verdictMissTTL is how long a name without a verdict in the store is remembered, so that queries of domains
+	// racing anyway don't look up the store every time.
+	verdictMissTTL = 30 * time.Second
+)
+
+// WithVerdictCache caches the outcome of the race of each domain for ttl, i.e. whether an untrusted answer in China
+// was accepted, or a trusted answer was needed. Later queries of the domain are sent to that group only, skipping
+// the race. If the answer of the group doesn't get the same verdict, the verdict is dropped and both groups race
+// again. Verdicts are cleared when lists are reloaded, including those the server shared through a VerdictStore.
+// Disabled if ttl is 0.
+func WithVerdictCache(ttl time.Duration) ServerOption {
+	return func(o *serverOptions) error {
+		o.VerdictTTL = ttl
+		return nil
+	}
+}
+
+// VerdictStore shares cached verdicts among servers, e.g. a pair behind a load balancer. RedisCache implements it.
+type VerdictStore interface {
+	// Route returns the group name is routed to and when it expires, or an empty string if none.
+	Route(name string) (route string, expires time.Time)
+	// SetRoute routes name to route until expires, or forgets the route of name if route is empty.
+	SetRoute(name, route string, expires time.Time)
+	// ClearRoutes removes routes of names, and returns the number of them.
+	ClearRoutes(names ...string) int
+}
+
+// WithVerdictStore shares cached verdicts (see WithVerdictCache) with other servers through store, which are also
+// kept in memory until they expire.
+func WithVerdictStore(store VerdictStore) ServerOption {
+	return func(o *serverOptions) error {
+		o.VerdictStore = store
+		return nil
+	}
+}
+
+// CachedVerdict is the group a domain is routed to.
+type CachedVerdict struct {
+	Name    string    `json:"name"`
+	Route   string    `json:"route"` // see RouteXXX
+	Expires time.Time `json:"expires"`
+}
+
+// routeOf returns the group a reply of verdict should be routed to, or an empty string if the verdict is not
+// conclusive, like a fallback.
+func routeOf(verdict string) string {
+	switch verdict {
+	case VerdictChina:
+		return RouteUntrusted
+	case VerdictTrusted, VerdictOverseas:
+		return RouteTrusted
+	}
+	return ""
+}
+
+// verdictEntry is a cached verdict, which is set by this server if own, or looked up in the store otherwise.
+type verdictEntry struct {
+	CachedVerdict
+	own bool
+}
+
+// verdictCache caches groups of domains by their verdicts, and shares them through store if it's not nil.
+// A nil cache is disabled.
+type verdictCache struct {
+	ttl   time.Duration
+	clock clock.Clock
+	store VerdictStore
+
+	mu      sync.Mutex
+	entries map[string]verdictEntry // by lower case names
+	misses  map[string]time.Time    // names without verdicts in the store, until when they are remembered
+}
+
+// newVerdictCache returns a cache of verdicts for ttl shared through store (if not nil), or nil if ttl is not
+// positive.
+func newVerdictCache(ttl time.Duration, clk clock.Clock, store VerdictStore) *verdictCache {
+	if ttl <= 0 {
+		return nil
+	}
+	return &verdictCache{ttl: ttl, clock: clk, store: store, entries: make(map[string]verdictEntry),
+		misses: make(map[string]time.Time)}
+}
+
+// Route returns the group name is routed to, or an empty string if none. Routes not in memory are looked up in
+// the store, and names without routes in the store are not looked up again for verdictMissTTL.
+func (c *verdictCache) Route(name string) string {
+	if c == nil {
+		return ""
+	}
+	key := strings.ToLower(name)
+	now := c.clock.Now()
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && !now.Before(e.Expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	missed := now.Before(c.misses[key])
+	c.mu.Unlock()
+	if ok {
+		return e.Route
+	}
+	if c.store == nil || missed {
+		return ""
+	}
+	route, expires := c.store.Route(name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if route == "" || !now.Before(expires) {
+		if _, ok := c.misses[key]; !ok && len(c.misses) >= maxVerdicts {
+			c.evictMisses(now)
+		}
+		c.misses[key] = now.Add(verdictMissTTL)
+		return ""
+	}
+	c.put(key, verdictEntry{CachedVerdict: CachedVerdict{Name: name, Route: route, Expires: expires}}, now)
+	return route
+}
+
+// Set routes name to route, or forgets the route of name if route is empty.
+func (c *verdictCache) Set(name, route string) {
+	if c == nil {
+		return
+	}
+	key := strings.ToLower(name)
+	now := c.clock.Now()
+	expires := now.Add(c.ttl)
+	c.mu.Lock()
+	delete(c.misses, key)
+	if route == "" {
+		delete(c.entries, key)
+	} else {
+		c.put(key, verdictEntry{CachedVerdict: CachedVerdict{Name: name, Route: route, Expires: expires}, own: true}, now)
+	}
+	c.mu.Unlock()
+	if c.store != nil {
+		c.store.SetRoute(name, route, expires)
+	}
+}
+
+// put caches verdict e by key, evicting others if the cache is full. c.mu must be held.
+func (c *verdictCache) put(key string, e verdictEntry, now time.Time) {
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxVerdicts {
+		c.evict(now)
+	}
+	c.entries[key] = e
+}
+
+// evict removes expired verdicts, or an arbitrary one if none expired. c.mu must be held.
+func (c *verdictCache) evict(now time.Time) {
+	evicted := false
+	for key, e := range c.entries {
+		if !now.Before(e.Expires) {
+			delete(c.entries, key)
+			evicted = true
+		}
+	}
+	if evicted {
+		return
+	}
+	for key := range c.entries {
+		delete(c.entries, key)
+		return
+	}
+}
+
+// evictMisses forgets expired names without verdicts, or all of them if none expired. c.mu must be held.
+func (c *verdictCache) evictMisses(now time.Time) {
+	for key, until := range c.misses {
+		if !now.Before(until) {
+			delete(c.misses, key)
+		}
+	}
+	if len(c.misses) >= maxVerdicts {
+		c.misses = make(map[string]time.Time)
+	}
+}
+
+// List returns unexpired verdicts ordered by name.
+func (c *verdictCache) List() []CachedVerdict {
+	list := []CachedVerdict{}
+	if c == nil {
+		return list
+	}
+	now := c.clock.Now()
+	c.mu.Lock()
+	for _, e := range c.entries {
+		if now.Before(e.Expires) {
+			list = append(list, e.CachedVerdict)
+		}
+	}
+	c.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Clear removes all verdicts in memory, and those set by this server in the store, and returns the number of
+// verdicts removed from memory. Verdicts other servers set in the store are theirs to clear.
+func (c *verdictCache) Clear() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	n := len(c.entries)
+	var own []string
+	for _, e := range c.entries {
+		if e.own {
+			own = append(own, e.Name)
+		}
+	}
+	c.entries = make(map[string]verdictEntry)
+	c.misses = make(map[string]time.Time)
+	c.mu.Unlock()
+	if c.store != nil && len(own) > 0 {
+		c.store.ClearRoutes(own...)
+	}
+	return n
+}
+
+// Verdicts returns cached verdicts routing domains to a group. See WithVerdictCache.
+func (s *Server) Verdicts() []CachedVerdict {
+	return s.verdicts.List()
+}
+
+// ClearVerdicts clears all cached verdicts of the server, including those it shared through a VerdictStore, so that
+// domains race in both groups again. It returns the number of verdicts cleared.
+func (s *Server) ClearVerdicts() int {
+	return s.verdicts.Clear()
+}
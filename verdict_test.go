@@ -0,0 +1,91 @@
+package gochinadns
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+func TestVerdictCache(t *testing.T) {
+	var trustedQueries, untrustedQueries int32
+	var untrustedIP atomic.Value
+	untrustedIP.Store("1.0.1.1")
+	trusted := NewUpstreamResolver("trusted", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+		atomic.AddInt32(&trustedQueries, 1)
+		// The trusted answer arrives later, so that a China answer wins the race.
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		}
+		m := newTestReply(req.Question[0].Name, 60, "142.250.1.1")
+		m.Id = req.Id
+		return m, 50 * time.Millisecond, nil
+	}))
+	untrusted := NewUpstreamResolver("untrusted", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+		atomic.AddInt32(&untrustedQueries, 1)
+		m := newTestReply(req.Question[0].Name, 60, untrustedIP.Load().(string))
+		m.Id = req.Id
+		return m, time.Millisecond, nil
+	}))
+	o := newServerOptions()
+	o.Delay = time.Second
+	for _, f := range []ServerOption{
+		WithCHNList(writeTestList(t, "china.list", "1.0.1.0/24\n")),
+		WithUpstreams(true, trusted), WithUpstreams(false, untrusted), WithVerdictCache(time.Hour),
+	} {
+		if err := f(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second)), goroutines: newGoroutineTracker(),
+		verdicts: newVerdictCache(o.VerdictTTL, o.Clock, nil)}
+	if err := s.partitionResolvers(); err != nil {
+		t.Fatal(err)
+	}
+	resolve := func(name string) *upstreamReply {
+		atomic.StoreInt32(&trustedQueries, 0)
+		atomic.StoreInt32(&untrustedQueries, 0)
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeA)
+		reply := s.resolve(context.Background(), logrus.WithField("test", t.Name()), req)
+		if reply == nil {
+			t.Fatalf("No reply of %s", name)
+		}
+		return reply
+	}
+
+	// The China answer is accepted, and later queries are sent to untrusted servers only.
+	if reply := resolve("www.qq.com."); reply.verdict != VerdictChina {
+		t.Fatalf("Unexpected verdict %s", reply.verdict)
+	}
+	if route := s.verdicts.Route("WWW.QQ.COM."); route != RouteUntrusted {
+		t.Fatalf("Domain should be routed to untrusted servers, got %q", route)
+	}
+	if reply := resolve("www.qq.com."); reply.verdict != VerdictChina || atomic.LoadInt32(&trustedQueries) != 0 {
+		t.Errorf("Routed query should skip trusted servers, got %s with %d trusted queries", reply.verdict, trustedQueries)
+	}
+
+	// The untrusted answer moves overseas, so both groups race again, and the domain is routed to trusted servers.
+	untrustedIP.Store("8.8.8.8")
+	if reply := resolve("www.qq.com."); reply.server != trusted || reply.verdict != VerdictTrusted {
+		t.Fatalf("Trusted answer should be chosen after the verdict changed, got %s from %s", reply.verdict, reply.server)
+	}
+	if route := s.verdicts.Route("www.qq.com."); route != RouteTrusted {
+		t.Fatalf("Domain should be routed to trusted servers, got %q", route)
+	}
+	if reply := resolve("www.qq.com."); reply.server != trusted || atomic.LoadInt32(&untrustedQueries) != 0 {
+		t.Errorf("Routed query should skip untrusted servers, got %d untrusted queries", untrustedQueries)
+	}
+
+	if list := s.Verdicts(); len(list) != 1 || list[0].Route != RouteTrusted {
+		t.Errorf("Unexpected verdicts %+v", list)
+	}
+	if n := s.ClearVerdicts(); n != 1 || s.verdicts.Route("www.qq.com.") != "" {
+		t.Errorf("Verdicts should be cleared, got %d", n)
+	}
+}
@@ -0,0 +1,254 @@
+package gochinadns
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// verifyQueueSize is the max number of China answers waiting to be verified.
+	verifyQueueSize = 256
+	// verifyWorkers is the number of China answers verified concurrently.
+	verifyWorkers = 4
+	// verifyFlagTTL is how long a domain stays flagged, after which its China answers are verified again, so that
+	// domains recovering from poisoning, or flagged by mistake, are not routed as polluted forever.
+	verifyFlagTTL = 24 * time.Hour
+)
+
+var flaggedDomains = expvar.NewInt("chinadns_flagged_domains")
+
+// WithChinaVerification verifies accepted answers located in China against trusted servers in the background,
+// to catch poisoning with plausible China IPs. A domain is flagged as polluted once its trusted answers disagree
+// strikes times in a row, i.e. they share no address with the China answer and none of them is located in China.
+// Flagged domains are routed like those in the polluted domain list for a day, or until cleared, and then verified
+// again. Disabled if strikes is 0.
+func WithChinaVerification(strikes int) ServerOption {
+	return func(o *serverOptions) error {
+		if strikes < 0 {
+			return fmt.Errorf("invalid verification strikes: %d", strikes)
+		}
+		o.VerifyStrikes = strikes
+		return nil
+	}
+}
+
+// FlaggedDomain is a domain flagged as polluted by verification of its China answers.
+type FlaggedDomain struct {
+	Name      string    `json:"name"`
+	Time      time.Time `json:"time"`
+	Expires   time.Time `json:"expires"`   // when the domain is unflagged
+	Trusted   []string  `json:"trusted"`   // addresses answered by trusted servers at the last disagreement
+	Untrusted []string  `json:"untrusted"` // addresses of the China answer at the last disagreement
+}
+
+// verification is a China answer to verify.
+type verification struct {
+	question dns.Question
+	ips      []net.IP
+}
+
+// verifier verifies China answers and flags domains of disagreeing ones. A nil verifier is disabled.
+type verifier struct {
+	strikes int
+	queue   chan verification
+	now     func() time.Time
+
+	mu      sync.Mutex
+	pending map[string]bool // names being verified
+	misses  map[string]int  // consecutive disagreements by name
+	flagged map[string]FlaggedDomain
+}
+
+// newVerifier returns a verifier flagging domains after strikes disagreements, or nil if strikes is not positive.
+// Flags expire by now.
+func newVerifier(strikes int, now func() time.Time) *verifier {
+	if strikes <= 0 {
+		return nil
+	}
+	return &verifier{
+		strikes: strikes,
+		queue:   make(chan verification, verifyQueueSize),
+		now:     now,
+		pending: make(map[string]bool),
+		misses:  make(map[string]int),
+		flagged: make(map[string]FlaggedDomain),
+	}
+}
+
+// enqueue queues a China answer of q to verify, unless its name is flagged or being verified already.
+func (v *verifier) enqueue(q dns.Question, ips []net.IP) {
+	name := strings.ToLower(q.Name)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.pending[name] || v.flaggedLocked(name) {
+		return
+	}
+	select {
+	case v.queue <- verification{question: q, ips: ips}:
+		v.pending[name] = true
+	default:
+		logrus.WithField("question", questionString(&q)).Debug("Too many China answers to verify. Skip it.")
+	}
+}
+
+// record records whether trusted addresses agree with the China answer of name, and tells whether name is flagged
+// by this disagreement.
+func (v *verifier) record(name string, agree bool, trusted, untrusted []net.IP, now time.Time) bool {
+	name = strings.ToLower(name)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.pending, name)
+	if agree {
+		delete(v.misses, name)
+		return false
+	}
+	v.misses[name]++
+	if v.misses[name] < v.strikes {
+		return false
+	}
+	delete(v.misses, name)
+	v.flagged[name] = FlaggedDomain{Name: name, Time: now, Expires: now.Add(verifyFlagTTL), Trusted: ipStrings(trusted),
+		Untrusted: ipStrings(untrusted)}
+	return true
+}
+
+// flaggedLocked tells whether name is flagged, unflagging it if expired. v.mu must be held.
+func (v *verifier) flaggedLocked(name string) bool {
+	d, ok := v.flagged[name]
+	if ok && !v.now().Before(d.Expires) {
+		delete(v.flagged, name)
+		return false
+	}
+	return ok
+}
+
+// done marks name as no longer being verified, without a result.
+func (v *verifier) done(name string) {
+	v.mu.Lock()
+	delete(v.pending, strings.ToLower(name))
+	v.mu.Unlock()
+}
+
+// IsFlagged tells whether name is flagged. Subdomains of a flagged domain are not.
+func (v *verifier) IsFlagged(name string) bool {
+	if v == nil {
+		return false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.flaggedLocked(strings.ToLower(dns.Fqdn(name)))
+}
+
+// List returns flagged domains ordered by name, unflagging expired ones.
+func (v *verifier) List() []FlaggedDomain {
+	list := []FlaggedDomain{}
+	if v == nil {
+		return list
+	}
+	v.mu.Lock()
+	for name, d := range v.flagged {
+		if v.flaggedLocked(name) {
+			list = append(list, d)
+		}
+	}
+	v.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Clear unflags all domains, and returns the number of them.
+func (v *verifier) Clear() int {
+	if v == nil {
+		return 0
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	n := len(v.flagged)
+	v.flagged = make(map[string]FlaggedDomain)
+	v.misses = make(map[string]int)
+	return n
+}
+
+// FlaggedDomains returns domains flagged as polluted by verification of their China answers.
+// See WithChinaVerification.
+func (s *Server) FlaggedDomains() []FlaggedDomain {
+	return s.verifier.List()
+}
+
+// ClearFlaggedDomains unflags all domains flagged by verification, and returns the number of them.
+func (s *Server) ClearFlaggedDomains() int {
+	return s.verifier.Clear()
+}
+
+// queueChinaVerification queues China answers of A and AAAA questions from upstreams to verify.
+func (s *Server) queueChinaVerification(e *AnswerEvent) {
+	if e.Cached || e.Verdict != VerdictChina || (e.Question.Qtype != dns.TypeA && e.Question.Qtype != dns.TypeAAAA) {
+		return
+	}
+	if ips := answerIPs(e.Answer); len(ips) > 0 {
+		s.verifier.enqueue(e.Question, ips)
+	}
+}
+
+// runVerifications verifies queued China answers, until ctx is done.
+func (s *Server) runVerifications(ctx context.Context) {
+	if s.verifier == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < verifyWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case v := <-s.verifier.queue:
+					s.verifyChinaAnswer(ctx, v)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// verifyChinaAnswer resolves the question of v through trusted servers, and compares the answer with v.
+// Trusted answers without addresses prove nothing either way.
+func (s *Server) verifyChinaAnswer(ctx context.Context, v verification) {
+	req := new(dns.Msg)
+	req.SetQuestion(v.question.Name, v.question.Qtype)
+	s.normalizeRequest(req)
+	trustedServers, _ := s.activeResolvers()
+	trusted, ok := auditLookup(ctx, req, trustedServers, s.lookupTrusted)
+	if !ok || len(trusted) == 0 {
+		s.verifier.done(v.question.Name)
+		return
+	}
+	agree := sharesIP(trusted, v.ips)
+	for _, ip := range trusted {
+		if china, _ := s.isChinaIP(ctx, ip); china {
+			agree = true
+		}
+	}
+	if !s.verifier.record(v.question.Name, agree, trusted, v.ips, s.Clock.Now()) {
+		return
+	}
+	flaggedDomains.Add(1)
+	logrus.WithField("question", questionString(&v.question)).Warnf(
+		"China answer %v keeps disagreeing with trusted answer %v. Flag the domain as polluted.", ipStrings(v.ips), ipStrings(trusted))
+	if s.cache != nil {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			s.cache.Delete(&dns.Question{Name: v.question.Name, Qtype: qtype, Qclass: v.question.Qclass})
+		}
+	}
+}
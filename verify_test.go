@@ -0,0 +1,90 @@
+package gochinadns
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/cherrot/gochinadns/clock"
+)
+
+func TestChinaVerification(t *testing.T) {
+	o := newServerOptions()
+	clk := clock.NewFake(time.Unix(1600000000, 0))
+	o.Clock = clk
+	trustedIPs := map[string]string{"poisoned.com.": "142.250.1.1", "cdn.com.": "1.0.1.9", "same.com.": "1.0.1.1"}
+	trusted := NewUpstreamResolver("trusted", UpstreamFunc(func(ctx context.Context, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+		m := newTestReply(req.Question[0].Name, 60, trustedIPs[req.Question[0].Name])
+		m.Id = req.Id
+		return m, time.Millisecond, nil
+	}))
+	for _, f := range []ServerOption{
+		WithUpstreams(true, trusted),
+		WithChinaVerification(2),
+		WithCHNList(writeTestList(t, "china.list", "1.0.1.0/24\n")),
+	} {
+		if err := f(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{serverOptions: o, Client: NewClient(WithTimeout(time.Second)), verifier: newVerifier(o.VerifyStrikes, o.Clock.Now)}
+	if err := s.partitionResolvers(); err != nil {
+		t.Fatal(err)
+	}
+	s.cache = NewMemoryCache(10, 0)
+
+	verify := func(name string) {
+		q := dns.Question{Name: name, Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		s.verifyChinaAnswer(context.Background(), verification{question: q, ips: []net.IP{net.ParseIP("1.0.1.1")}})
+	}
+	m := newTestReply("poisoned.com", 60, "1.0.1.1")
+	s.cache.Set(&m.Question[0], m, time.Minute, 0)
+	for i := 0; i < 2; i++ {
+		for _, name := range []string{"poisoned.com.", "cdn.com.", "same.com."} {
+			if s.isDomainPolluted(name) {
+				t.Fatalf("%s should not be flagged after %d disagreements", name, i)
+			}
+			verify(name)
+		}
+	}
+	if !s.isDomainPolluted("Poisoned.com.") || s.isDomainPolluted("cdn.com.") || s.isDomainPolluted("same.com.") {
+		t.Errorf("Only the domain disagreeing persistently should be flagged, got %+v", s.FlaggedDomains())
+	}
+	if s.cache.Len() != 0 {
+		t.Error("Cached answers of the flagged domain should be dropped")
+	}
+	if list := s.FlaggedDomains(); len(list) != 1 || list[0].Trusted[0] != "142.250.1.1" || list[0].Untrusted[0] != "1.0.1.1" {
+		t.Errorf("Unexpected flagged domains %+v", list)
+	}
+	if s.ClearFlaggedDomains() != 1 || s.isDomainPolluted("poisoned.com.") {
+		t.Error("Flagged domains should be cleared")
+	}
+
+	// An agreement resets the strikes.
+	verify("poisoned.com.")
+	trustedIPs["poisoned.com."] = "1.0.1.1"
+	verify("poisoned.com.")
+	trustedIPs["poisoned.com."] = "142.250.1.1"
+	verify("poisoned.com.")
+	if s.isDomainPolluted("poisoned.com.") {
+		t.Error("Disagreements should be counted in a row")
+	}
+
+	// Flags expire, and the domain is verified again.
+	verify("poisoned.com.")
+	list := s.FlaggedDomains()
+	if len(list) != 1 || !list[0].Expires.Equal(clk.Now().Add(verifyFlagTTL)) {
+		t.Fatalf("Unexpected flagged domains %+v", list)
+	}
+	clk.Advance(verifyFlagTTL)
+	if s.isDomainPolluted("poisoned.com.") || len(s.FlaggedDomains()) != 0 {
+		t.Error("Flagged domain should expire")
+	}
+	s.verifier.enqueue(dns.Question{Name: "poisoned.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, nil)
+	if len(s.verifier.queue) != 1 {
+		t.Error("Expired domain should be verified again")
+	}
+}
@@ -0,0 +1,152 @@
+package gochinadns
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// warmSampleSize is the number of recently answered questions mirrored to a shadow instance.
+	warmSampleSize = 64
+	// warmMaxRegression is the max ratio of mirrored questions which may regress on a shadow instance.
+	warmMaxRegression = 0.25
+	// warmParallel limits mirrored questions resolved at the same time.
+	warmParallel = 8
+	// warmTimeout limits the resolution of a question in a check.
+	warmTimeout = 5 * time.Second
+)
+
+// ApplyConfig applies a new configuration of opts at runtime, i.e. lists and resolvers, without restarting listeners.
+// Other options, such as the listening address and the cache, take effect on restart only.
+//
+// The configuration is applied to a shadow instance first. Test domains (see WithTestDomains) and a sample of
+// recently answered questions are resolved by both the serving instance and the shadow, and the configuration is
+// rejected if test domains or too many sampled questions are resolved by the serving instance but not the shadow,
+// e.g. because of a bad blacklist or upstream set. Otherwise the server is switched to it at once.
+// Resolvers are partitioned by the new China route lists, and keep their states if their schemas are unchanged.
+// Resolvers added by AddResolver are dropped. The new options are also used by later Reload.
+func (s *Server) ApplyConfig(opts ...ServerOption) error {
+	s.applyMu.Lock()
+	defer s.applyMu.Unlock()
+	o := newServerOptions()
+	for _, f := range opts {
+		if err := f(o); err != nil {
+			return err
+		}
+	}
+	if err := o.checkListErrors(); err != nil {
+		return err
+	}
+	shadow := s.newShadow(o)
+	if err := shadow.partitionResolvers(); err != nil {
+		return err
+	}
+	trusted, untrusted := s.resolvers()
+	o.TrustedServers = keepResolvers(o.TrustedServers, trusted, untrusted)
+	o.UntrustedServers = keepResolvers(o.UntrustedServers, trusted, untrusted)
+	if err := s.warmCheck(shadow); err != nil {
+		return err
+	}
+	s.cutover(o, true)
+	s.opts = opts
+	logrus.Info("Configuration applied. Trusted resolvers: ", o.TrustedServers, ", untrusted resolvers: ", o.UntrustedServers)
+	return nil
+}
+
+// keepResolvers replaces resolvers in list by the current ones with the same schemas, which keep their states.
+func keepResolvers(list resolverList, current ...resolverList) resolverList {
+	for i, r := range list {
+		for _, cur := range current {
+			for _, c := range cur {
+				if c.String() == r.String() {
+					list[i] = c
+				}
+			}
+		}
+	}
+	return list
+}
+
+// newShadow creates a shadow instance of s with options o, which shares upstream clients and states learned
+// from upstreams with s, but serves no listener and emits no event.
+func (s *Server) newShadow(o *serverOptions) *Server {
+	return &Server{
+		serverOptions: o,
+		Client:        s.Client,
+		goroutines:    s.goroutines,
+		upstreams:     s.upstreams,
+		canary:        s.canary,
+		proxyCli:      s.proxyCli,
+		dnssec:        s.dnssec,
+	}
+}
+
+// warmCheck resolves test domains and a sample of recently answered questions by both s and shadow.
+// It returns an error if shadow regresses, i.e. fails questions s resolves.
+func (s *Server) warmCheck(shadow *Server) error {
+	for _, name := range s.TestDomains {
+		q := dns.Question{Name: dns.Fqdn(name), Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		if s.warmResolves(q) && !shadow.warmResolves(q) {
+			return fmt.Errorf("health check of %s fails with the new configuration", RedactName(q.Name))
+		}
+	}
+
+	sample := s.provenance.Recent(warmSampleSize, nil)
+	var (
+		mu                sync.Mutex
+		wg                sync.WaitGroup
+		passed, regressed int
+		sem               = make(chan struct{}, warmParallel)
+	)
+	for _, q := range sample {
+		q := q
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			if !s.warmResolves(q) {
+				return
+			}
+			ok := shadow.warmResolves(q)
+			if !ok {
+				logrus.WithField("question", questionString(&q)).Info("Mirrored question regresses with the new configuration.")
+			}
+			mu.Lock()
+			if ok {
+				passed++
+			} else {
+				regressed++
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if total := passed + regressed; total > 0 && float64(regressed) > float64(total)*warmMaxRegression {
+		return fmt.Errorf("%d of %d mirrored questions regress with the new configuration", regressed, total)
+	}
+	logrus.Infof("%d mirrored questions checked with the new configuration.", passed+regressed)
+	return nil
+}
+
+// warmResolves tells whether s resolves q, i.e. q is not blocked, and answered by hosts, rewrite rules or upstreams.
+// NXDOMAIN counts as resolved.
+func (s *Server) warmResolves(q dns.Question) bool {
+	if s.isDomainBlocked(q.Name, nil) {
+		return false
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	if s.answerHosts(req) != nil || s.answerRewrite(req) != nil {
+		return true
+	}
+	s.normalizeRequest(req)
+	ctx, cancel := context.WithTimeout(context.Background(), warmTimeout)
+	defer cancel()
+	reply := s.resolve(ctx, logrus.WithField("question", questionString(&q)), req)
+	return reply != nil && (reply.Rcode == dns.RcodeSuccess || reply.Rcode == dns.RcodeNameError)
+}